@@ -0,0 +1,417 @@
+// package appservice is an EXPERIMENTAL mock application service, for testing homeserver behaviour
+// which depends on application services, such as the /thirdparty lookup endpoints.
+// It is marked as EXPERIMENTAL as the API may break without warning.
+package appservice
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Protocol is the data for a third party protocol provided by the application service.
+type Protocol struct {
+	// The protocol metadata returned from /thirdparty/protocol/{protocol} e.g user_fields, location_fields,
+	// field_types and instances.
+	Metadata map[string]interface{}
+	// The locations (portal rooms) for this protocol. Each must have an "alias" and "fields".
+	Locations []map[string]interface{}
+	// The users for this protocol. Each must have a "userid" and "fields".
+	Users []map[string]interface{}
+}
+
+// Request is a request made by the homeserver to the application service.
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+}
+
+// EXPERIMENTAL
+// Server is a mock application service.
+type Server struct {
+	t ct.TestLike
+
+	ID              string
+	HSToken         string
+	ASToken         string
+	SenderLocalpart string
+
+	hostname  string
+	url       string
+	listening bool
+	mux       *mux.Router
+	srv       *http.Server
+
+	mu         sync.Mutex
+	protocols  map[string]Protocol
+	requests   []Request
+	pings      []string
+	pingStatus int
+
+	userQueryHandler  func(userID string) bool
+	aliasQueryHandler func(roomAlias string) bool
+}
+
+// EXPERIMENTAL
+// NewServer creates a new mock application service with the given ID.
+func NewServer(t ct.TestLike, cfg *config.Complement, id string, opts ...func(*Server)) *Server {
+	s := &Server{
+		t:               t,
+		ID:              id,
+		HSToken:         util.RandomString(32),
+		ASToken:         util.RandomString(32),
+		SenderLocalpart: id + "-bot",
+		hostname:        cfg.HostnameRunningComplement,
+		mux:             mux.NewRouter(),
+		protocols:       make(map[string]Protocol),
+		pingStatus:      200,
+	}
+	s.mux.Use(s.authenticate)
+	r := s.mux.PathPrefix("/_matrix/app/v1").Subrouter()
+	r.HandleFunc("/thirdparty/protocol/{protocol}", s.handleProtocol).Methods("GET")
+	r.HandleFunc("/thirdparty/location/{protocol}", s.handleLookup("location")).Methods("GET")
+	r.HandleFunc("/thirdparty/location", s.handleReverseLookup("location", "alias")).Methods("GET")
+	r.HandleFunc("/thirdparty/user/{protocol}", s.handleLookup("user")).Methods("GET")
+	r.HandleFunc("/thirdparty/user", s.handleReverseLookup("user", "userid")).Methods("GET")
+	r.HandleFunc("/transactions/{txnID}", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, 200, struct{}{})
+	}).Methods("PUT")
+	r.HandleFunc("/ping", s.handlePing).Methods("POST")
+	r.HandleFunc("/users/{userID}", s.handleUserQuery).Methods("GET")
+	r.HandleFunc("/rooms/{roomAlias}", s.handleAliasQuery).Methods("GET")
+	s.mux.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, 404, map[string]string{"errcode": "M_NOT_FOUND", "error": "complement: not found"})
+	})
+	s.srv = &http.Server{Handler: s.mux}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithProtocol adds a third party protocol to the application service.
+func WithProtocol(name string, p Protocol) func(*Server) {
+	return func(s *Server) {
+		s.SetProtocol(name, p)
+	}
+}
+
+// WithUserQueryHandler sets the handler for user queries. See SetUserQueryHandler.
+func WithUserQueryHandler(h func(userID string) bool) func(*Server) {
+	return func(s *Server) {
+		s.SetUserQueryHandler(h)
+	}
+}
+
+// WithAliasQueryHandler sets the handler for room alias queries. See SetAliasQueryHandler.
+func WithAliasQueryHandler(h func(roomAlias string) bool) func(*Server) {
+	return func(s *Server) {
+		s.SetAliasQueryHandler(h)
+	}
+}
+
+// SetUserQueryHandler sets the function called when the homeserver asks whether a user in the
+// application service's namespace exists. To lazily provision the user, the handler should register
+// it with the homeserver before returning true. If no handler is set, users do not exist.
+// Handlers are called on the server's goroutine, so must not fail the test via `t`.
+func (s *Server) SetUserQueryHandler(h func(userID string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userQueryHandler = h
+}
+
+// SetAliasQueryHandler sets the function called when the homeserver asks whether a room alias in
+// the application service's namespace exists. To lazily provision the room, the handler should create
+// it with the alias before returning true. If no handler is set, aliases do not exist.
+// Handlers are called on the server's goroutine, so must not fail the test via `t`.
+func (s *Server) SetAliasQueryHandler(h func(roomAlias string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aliasQueryHandler = h
+}
+
+// UserQueries returns the user IDs the homeserver has queried so far, in order.
+func (s *Server) UserQueries() []string {
+	return s.queries("/_matrix/app/v1/users/")
+}
+
+// AliasQueries returns the room aliases the homeserver has queried so far, in order.
+func (s *Server) AliasQueries() []string {
+	return s.queries("/_matrix/app/v1/rooms/")
+}
+
+func (s *Server) queries(pathPrefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for _, req := range s.requests {
+		if req.Method == "GET" && strings.HasPrefix(req.Path, pathPrefix) {
+			ids = append(ids, strings.TrimPrefix(req.Path, pathPrefix))
+		}
+	}
+	return ids
+}
+
+// SetProtocol adds or replaces the data for a third party protocol. Protocols must be added before
+// calling ApplicationService() for the homeserver to know about them, but the data can be changed at any time.
+func (s *Server) SetProtocol(name string, p Protocol) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.protocols[name] = p
+}
+
+// Requests returns all requests the homeserver has made to the application service so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Pings returns the transaction IDs of the pings the homeserver has sent to the application service
+// so far, in the order they were received. See MSC2659.
+func (s *Server) Pings() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.pings...)
+}
+
+// SetPingStatus sets the HTTP status code the application service responds to pings with, which is
+// 200 by default. Use a non-2xx code to make the homeserver treat the application service as unhealthy.
+func (s *Server) SetPingStatus(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pingStatus = code
+}
+
+// URL returns the URL of the application service. Only valid AFTER calling Listen().
+func (s *Server) URL() string {
+	if !s.listening {
+		ct.Fatalf(s.t, "URL() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the URL. Ensure you Listen() first!")
+	}
+	return s.url
+}
+
+// ApplicationService returns the registration of this application service, for use in blueprints.
+// Only valid AFTER calling Listen(). As the URL contains a random port, blueprints which use this
+// should have a unique name so a previously built image with a different URL is not used.
+func (s *Server) ApplicationService() b.ApplicationService {
+	s.mu.Lock()
+	protocols := make([]string, 0, len(s.protocols))
+	for name := range s.protocols {
+		protocols = append(protocols, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(protocols)
+	return b.ApplicationService{
+		ID:              s.ID,
+		HSToken:         s.HSToken,
+		ASToken:         s.ASToken,
+		URL:             s.URL(),
+		SenderLocalpart: s.SenderLocalpart,
+		Protocols:       protocols,
+	}
+}
+
+// Listen for requests on a random high-numbered port. Returns a function which stops the server.
+func (s *Server) Listen() (cancel func()) {
+	if s.listening {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		ct.Fatalf(s.t, "appservice.Server.Listen: net.Listen failed: %s", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	s.url = fmt.Sprintf("http://%s:%d", s.hostname, port)
+	s.listening = true
+
+	go func() {
+		defer ln.Close()
+		defer wg.Done()
+		err := s.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			s.t.Logf("appservice.Server.Listen: Serve failed: %s", err)
+		}
+	}()
+
+	return func() {
+		err := s.srv.Close()
+		if err != nil {
+			ct.Fatalf(s.t, "appservice.Server.Listen: failed to shutdown server: %s", err)
+		}
+		wg.Wait()
+	}
+}
+
+// authenticate checks the homeserver's hs_token, which can be sent in either the Authorization
+// header or the (deprecated) access_token query parameter.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Query:  req.URL.Query(),
+		})
+		s.mu.Unlock()
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = req.URL.Query().Get("access_token")
+		}
+		if token == "" {
+			writeJSON(w, 401, map[string]string{"errcode": "M_UNAUTHORIZED", "error": "missing hs_token"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.HSToken)) != 1 {
+			writeJSON(w, 403, map[string]string{"errcode": "M_FORBIDDEN", "error": "incorrect hs_token"})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// handlePing records the transaction ID of a ping from the homeserver, triggered by the
+// /appservice/{appserviceId}/ping client-server API.
+func (s *Server) handlePing(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		TransactionID string `json:"transaction_id"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSON(w, 400, map[string]string{"errcode": "M_NOT_JSON", "error": err.Error()})
+		return
+	}
+	s.mu.Lock()
+	s.pings = append(s.pings, body.TransactionID)
+	code := s.pingStatus
+	s.mu.Unlock()
+	if code < 200 || code > 299 {
+		writeJSON(w, code, map[string]string{"errcode": "M_UNKNOWN", "error": "complement: ping failed"})
+		return
+	}
+	writeJSON(w, code, struct{}{})
+}
+
+func (s *Server) handleUserQuery(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	h := s.userQueryHandler
+	s.mu.Unlock()
+	respondToQuery(w, h, mux.Vars(req)["userID"])
+}
+
+func (s *Server) handleAliasQuery(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	h := s.aliasQueryHandler
+	s.mu.Unlock()
+	respondToQuery(w, h, mux.Vars(req)["roomAlias"])
+}
+
+// respondToQuery responds to a user or room alias query using the handler, which is called without
+// holding the lock so it can make requests to the homeserver.
+func respondToQuery(w http.ResponseWriter, h func(string) bool, id string) {
+	if h == nil || !h(id) {
+		writeJSON(w, 404, map[string]string{"errcode": "M_NOT_FOUND", "error": "complement: does not exist"})
+		return
+	}
+	writeJSON(w, 200, struct{}{})
+}
+
+func (s *Server) handleProtocol(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	p, ok := s.protocols[mux.Vars(req)["protocol"]]
+	s.mu.Unlock()
+	if !ok {
+		writeJSON(w, 404, map[string]string{"errcode": "M_NOT_FOUND", "error": "unknown protocol"})
+		return
+	}
+	writeJSON(w, 200, p.Metadata)
+}
+
+// handleLookup returns the locations or users of a protocol whose fields match all the query parameters.
+func (s *Server) handleLookup(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		protocol := mux.Vars(req)["protocol"]
+		s.mu.Lock()
+		p, ok := s.protocols[protocol]
+		s.mu.Unlock()
+		if !ok {
+			writeJSON(w, 404, map[string]string{"errcode": "M_NOT_FOUND", "error": "unknown protocol"})
+			return
+		}
+		query := req.URL.Query()
+		query.Del("access_token")
+		results := []map[string]interface{}{}
+		for _, entry := range entries(p, kind) {
+			if fieldsMatch(entry, query) {
+				results = append(results, withProtocol(entry, protocol))
+			}
+		}
+		writeJSON(w, 200, results)
+	}
+}
+
+// handleReverseLookup returns the locations or users across all protocols with the given alias or user ID.
+func (s *Server) handleReverseLookup(kind, idKey string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id := req.URL.Query().Get(idKey)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		results := []map[string]interface{}{}
+		for protocol, p := range s.protocols {
+			for _, entry := range entries(p, kind) {
+				if entry[idKey] == id {
+					results = append(results, withProtocol(entry, protocol))
+				}
+			}
+		}
+		writeJSON(w, 200, results)
+	}
+}
+
+func entries(p Protocol, kind string) []map[string]interface{} {
+	if kind == "location" {
+		return p.Locations
+	}
+	return p.Users
+}
+
+func fieldsMatch(entry map[string]interface{}, query url.Values) bool {
+	fields, _ := entry["fields"].(map[string]interface{})
+	for k := range query {
+		if fmt.Sprint(fields[k]) != query.Get(k) {
+			return false
+		}
+	}
+	return true
+}
+
+func withProtocol(entry map[string]interface{}, protocol string) map[string]interface{} {
+	result := make(map[string]interface{}, len(entry)+1)
+	for k, v := range entry {
+		result[k] = v
+	}
+	result["protocol"] = protocol
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,124 @@
+package appservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/config"
+)
+
+func TestServerThirdPartyLookups(t *testing.T) {
+	srv := NewServer(t, &config.Complement{HostnameRunningComplement: "localhost"}, "test", WithProtocol("proto", Protocol{
+		Metadata: map[string]interface{}{"user_fields": []string{"name"}},
+		Users: []map[string]interface{}{
+			{"userid": "@a:hs1", "fields": map[string]interface{}{"name": "a"}},
+			{"userid": "@b:hs1", "fields": map[string]interface{}{"name": "b"}},
+		},
+	}))
+	cancel := srv.Listen()
+	defer cancel()
+
+	get := func(path string, query url.Values, token string) (int, []map[string]interface{}) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL()+path+"?"+query.Encode(), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %s", path, err)
+		}
+		defer res.Body.Close()
+		var body []map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&body)
+		return res.StatusCode, body
+	}
+
+	if code, _ := get("/_matrix/app/v1/thirdparty/user/proto", nil, "wrong"); code != 403 {
+		t.Errorf("wrong hs_token: got HTTP %d want 403", code)
+	}
+	code, users := get("/_matrix/app/v1/thirdparty/user/proto", url.Values{"name": {"b"}}, srv.HSToken)
+	if code != 200 || len(users) != 1 || users[0]["userid"] != "@b:hs1" || users[0]["protocol"] != "proto" {
+		t.Errorf("lookup by fields: got HTTP %d %v", code, users)
+	}
+	code, users = get("/_matrix/app/v1/thirdparty/user", url.Values{"userid": {"@a:hs1"}}, srv.HSToken)
+	if code != 200 || len(users) != 1 || users[0]["userid"] != "@a:hs1" {
+		t.Errorf("reverse lookup: got HTTP %d %v", code, users)
+	}
+	if code, _ := get("/_matrix/app/v1/thirdparty/user/unknown", nil, srv.HSToken); code != 404 {
+		t.Errorf("unknown protocol: got HTTP %d want 404", code)
+	}
+	if got := srv.ApplicationService().Protocols; len(got) != 1 || got[0] != "proto" {
+		t.Errorf("ApplicationService: got protocols %v", got)
+	}
+}
+
+func TestServerPing(t *testing.T) {
+	srv := NewServer(t, &config.Complement{HostnameRunningComplement: "localhost"}, "test")
+	cancel := srv.Listen()
+	defer cancel()
+
+	ping := func(txnID string) int {
+		t.Helper()
+		req, _ := http.NewRequest("POST", srv.URL()+"/_matrix/app/v1/ping", strings.NewReader(`{"transaction_id":"`+txnID+`"}`))
+		req.Header.Set("Authorization", "Bearer "+srv.HSToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("ping: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := ping("txn1"); code != 200 {
+		t.Errorf("ping: got HTTP %d want 200", code)
+	}
+	srv.SetPingStatus(503)
+	if code := ping("txn2"); code != 503 {
+		t.Errorf("ping after SetPingStatus: got HTTP %d want 503", code)
+	}
+	if got := srv.Pings(); len(got) != 2 || got[0] != "txn1" || got[1] != "txn2" {
+		t.Errorf("Pings: got %v want [txn1 txn2]", got)
+	}
+}
+
+func TestServerQueries(t *testing.T) {
+	srv := NewServer(t, &config.Complement{HostnameRunningComplement: "localhost"}, "test", WithAliasQueryHandler(func(roomAlias string) bool {
+		return roomAlias == "#exists:hs1"
+	}))
+	cancel := srv.Listen()
+	defer cancel()
+
+	get := func(path string) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL()+path, nil)
+		req.Header.Set("Authorization", "Bearer "+srv.HSToken)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %s", path, err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := get("/_matrix/app/v1/users/@bob:hs1"); code != 404 {
+		t.Errorf("user query without handler: got HTTP %d want 404", code)
+	}
+	srv.SetUserQueryHandler(func(userID string) bool { return true })
+	if code := get("/_matrix/app/v1/users/@bob:hs1"); code != 200 {
+		t.Errorf("user query: got HTTP %d want 200", code)
+	}
+	if code := get("/_matrix/app/v1/rooms/" + url.PathEscape("#exists:hs1")); code != 200 {
+		t.Errorf("alias query: got HTTP %d want 200", code)
+	}
+	if code := get("/_matrix/app/v1/rooms/" + url.PathEscape("#missing:hs1")); code != 404 {
+		t.Errorf("missing alias query: got HTTP %d want 404", code)
+	}
+	if got := srv.UserQueries(); len(got) != 2 || got[0] != "@bob:hs1" {
+		t.Errorf("UserQueries: got %v", got)
+	}
+	if got := srv.AliasQueries(); len(got) != 2 || got[0] != "#exists:hs1" || got[1] != "#missing:hs1" {
+		t.Errorf("AliasQueries: got %v", got)
+	}
+}
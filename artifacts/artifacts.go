@@ -0,0 +1,100 @@
+// package artifacts manages the directory which debugging output (server logs, recorded traffic, etc)
+// is written to, so it all lands in one predictable place which CI can upload.
+//
+// Artifacts are written to $COMPLEMENT_ARTIFACTS_DIR/$TestName/$name, where subtests are nested
+// directories. If COMPLEMENT_ARTIFACTS_DIR is not set, no artifacts are written.
+package artifacts
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// characters which are not safe in file names on all platforms
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9_.=+-]`)
+
+// Manager writes artifacts under a root directory.
+type Manager struct {
+	root string
+}
+
+// New returns a Manager which writes artifacts under `root`. If `root` is empty, artifacts are not written.
+func New(root string) *Manager {
+	return &Manager{root: root}
+}
+
+// Enabled returns true if artifacts are written.
+func (m *Manager) Enabled() bool {
+	return m != nil && m.root != ""
+}
+
+// Dir returns the artifacts directory for the given test, creating it if needed. Returns "" if
+// artifacts are not enabled.
+func (m *Manager) Dir(testName string) (string, error) {
+	if !m.Enabled() {
+		return "", nil
+	}
+	dir := m.dir(testName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("artifacts: failed to create directory for %s: %w", testName, err)
+	}
+	return dir, nil
+}
+
+// Create creates the artifact file `name` for the given test. Returns nil if artifacts are not enabled.
+// The caller must close the file.
+func (m *Manager) Create(testName, name string) (*os.File, error) {
+	dir, err := m.Dir(testName)
+	if err != nil || dir == "" {
+		return nil, err
+	}
+	f, err := os.Create(filepath.Join(dir, sanitise(name)))
+	if err != nil {
+		return nil, fmt.Errorf("artifacts: failed to create %s for %s: %w", name, testName, err)
+	}
+	return f, nil
+}
+
+// WriteFile writes the artifact file `name` for the given test. Does nothing if artifacts are not enabled.
+func (m *Manager) WriteFile(testName, name string, data []byte) error {
+	f, err := m.Create(testName, name)
+	if err != nil || f == nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadFile reads the artifact file `name` of the given test, e.g one written by an earlier run. Returns an
+// error satisfying errors.Is(err, fs.ErrNotExist) if there is no such artifact, or artifacts are not enabled.
+func (m *Manager) ReadFile(testName, name string) ([]byte, error) {
+	if !m.Enabled() {
+		return nil, fmt.Errorf("artifacts: not enabled: %w", fs.ErrNotExist)
+	}
+	return os.ReadFile(filepath.Join(m.dir(testName), sanitise(name)))
+}
+
+// dir returns the artifacts directory for the given test, where subtests are nested directories.
+func (m *Manager) dir(testName string) string {
+	segments := strings.Split(testName, "/")
+	for i := range segments {
+		segments[i] = sanitise(segments[i])
+	}
+	return filepath.Join(append([]string{m.root}, segments...)...)
+}
+
+func sanitise(name string) string {
+	name = unsafeChars.ReplaceAllString(name, "_")
+	// don't allow escaping the artifacts directory
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
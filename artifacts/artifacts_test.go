@@ -0,0 +1,39 @@
+package artifacts
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManager(t *testing.T) {
+	root := t.TempDir()
+	m := New(root)
+	if err := m.WriteFile("TestFoo/sub test/..", "hs1.log", []byte("hello")); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	data, err := os.ReadFile(filepath.Join(root, "TestFoo", "sub_test", "_..", "hs1.log"))
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("got %q want %q", data, "hello")
+	}
+	data, err = m.ReadFile("TestFoo/sub test/..", "hs1.log")
+	if err != nil || string(data) != "hello" {
+		t.Errorf("ReadFile: got %q, %v want %q", data, err, "hello")
+	}
+	if _, err = m.ReadFile("TestFoo", "missing.log"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadFile of missing artifact: got error %v want fs.ErrNotExist", err)
+	}
+
+	disabled := New("")
+	if disabled.Enabled() {
+		t.Errorf("expected manager with no root to be disabled")
+	}
+	if err := disabled.WriteFile("TestFoo", "hs1.log", []byte("hello")); err != nil {
+		t.Errorf("WriteFile on disabled manager returned error: %s", err)
+	}
+}
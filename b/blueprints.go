@@ -18,10 +18,15 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
+var sidecarNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
 // KnownBlueprints lists static blueprints
 var KnownBlueprints = map[string]*Blueprint{
 	BlueprintCleanHS.Name:                     &BlueprintCleanHS,
@@ -32,6 +37,7 @@ var KnownBlueprints = map[string]*Blueprint{
 	BlueprintOneToOneRoom.Name:                &BlueprintOneToOneRoom,
 	BlueprintPerfManyMessages.Name:            &BlueprintPerfManyMessages,
 	BlueprintPerfManyRooms.Name:               &BlueprintPerfManyRooms,
+	BlueprintUserDirectory.Name:               &BlueprintUserDirectory,
 }
 
 // Blueprint represents an entire deployment to make.
@@ -42,6 +48,18 @@ type Blueprint struct {
 	Homeservers []Homeserver
 	// A set of user IDs to retain access_tokens for. If empty, all tokens are kept.
 	KeepAccessTokensForUsers []string
+	// Start an SMTP server which captures the emails sent by the homeservers when the blueprint is
+	// deployed, and tell the homeservers about it via COMPLEMENT_SMTP_HOST and COMPLEMENT_SMTP_PORT.
+	// It is not part of the built image. Only supported by Docker deployments.
+	EmailServer bool
+	// Start a reCAPTCHA verification server when the blueprint is deployed, and tell the homeservers
+	// about it via the COMPLEMENT_RECAPTCHA_* environment variables. Like EmailServer, it is not part
+	// of the built image. Only supported by Docker deployments.
+	CaptchaServer bool
+	// Start a TURN server using COMPLEMENT_TURN_IMAGE when the blueprint is deployed, and tell the
+	// homeservers about it via COMPLEMENT_TURN_URIS and COMPLEMENT_TURN_SHARED_SECRET. Ignored if
+	// COMPLEMENT_TURN_IMAGE is not set. Only supported by Docker deployments.
+	TURNServer bool
 }
 
 type Homeserver struct {
@@ -55,6 +73,66 @@ type Homeserver struct {
 	ApplicationServices []ApplicationService
 	// Optionally override the baseImageURI for blueprint creation
 	BaseImageURI *string
+	// Arbitrary data to store with the homeserver image, which is available in the deployment
+	// via complement.Labels(...).Metadata(). Keys and values must be valid docker labels.
+	Metadata map[string]string
+	// Plugins (e.g Synapse modules) to install on the homeserver before it first starts.
+	Plugins []Plugin
+	// Containers to run alongside the homeserver e.g a reverse proxy or redis. Only supported by
+	// Docker deployments.
+	Sidecars []Sidecar
+	// Environment variables of the form KEY=VALUE to set on the homeserver when it is deployed, e.g to
+	// toggle workers. They are not part of the built image, so do not need a new blueprint name. Only
+	// supported by Docker deployments.
+	Env []string
+	// Host directories or files to bind-mount into the homeserver when it is deployed, e.g a module under
+	// development or large media fixtures. Like Env, they are not part of the built image. Only supported
+	// by Docker deployments.
+	Mounts []Mount
+}
+
+// Mount is a host path which is bind-mounted into a homeserver container.
+type Mount struct {
+	// The path on the host. Relative paths are resolved against the working directory of the test,
+	// which is the directory of the test package.
+	HostPath string
+	// The absolute path in the container.
+	ContainerPath string
+	// If true, the homeserver cannot write to the mount.
+	ReadOnly bool
+}
+
+// Sidecar is a container which runs alongside a homeserver, such as a reverse proxy, coturn or redis.
+// Sidecars are started before the homeserver on the same network, and are removed with it. They can be
+// reached from the network at $Name.$HomeserverName e.g `redis.hs1`, and the homeserver is told their
+// hostnames via the COMPLEMENT_SIDECARS environment variable, as space-separated `name=hostname` pairs.
+type Sidecar struct {
+	// The name of the sidecar, which must be unique on the homeserver and a valid hostname label.
+	Name string
+	// The image to run e.g "redis:7-alpine". It is pulled if it does not exist locally.
+	Image string
+	// Optionally override the command of the image.
+	Cmd []string
+	// Environment variables for the container, as KEY=VALUE.
+	Env []string
+	// Files to copy into the container before it starts e.g an nginx config, keyed on absolute path.
+	Files map[string][]byte
+	// Container ports to publish on the host, so tests can talk to the sidecar directly.
+	Ports []int
+}
+
+// Plugin is a homeserver plugin, such as a Synapse module. Its files are copied into the container at
+// /complement/plugins/$Name/ and its config is written to /complement/plugins/$Name.yaml before the
+// homeserver starts, and the names of all plugins are passed in the COMPLEMENT_PLUGINS environment
+// variable. The homeserver image is responsible for loading them, e.g by merging the config into the
+// homeserver config and adding the plugin directory to the module search path.
+type Plugin struct {
+	// The name of the plugin, which must be unique on the homeserver and a valid file name.
+	Name string
+	// The files of the plugin, keyed on their path relative to the plugin directory e.g "my_module.py".
+	Files map[string][]byte
+	// Homeserver-specific config which enables the plugin e.g a Synapse `modules` entry, as YAML.
+	Config string
 }
 
 type User struct {
@@ -63,6 +141,25 @@ type User struct {
 	AvatarURL   string
 	AccountData []AccountData
 	DeviceID    *string
+	// Media to upload as this user. The MXC URIs of the uploaded media are available in the
+	// deployment via HomeserverDeployment.MediaURIs, keyed on the media Ref.
+	Media []Media
+	// If set, device keys and one-time keys are uploaded for this user's device, so that other
+	// users can start encrypted sessions with them.
+	E2E *E2EKeys
+}
+
+type Media struct {
+	// The unique reference for this media on the homeserver.
+	Ref         string
+	ContentType string
+	// The contents of the file. Base64 encoded when the blueprint is JSON.
+	Data []byte
+}
+
+type E2EKeys struct {
+	// The number of signed curve25519 one-time keys to upload.
+	OneTimeKeys int
 }
 
 type AccountData struct {
@@ -87,6 +184,21 @@ type ApplicationService struct {
 	RateLimited      bool
 	SendEphemeral    bool
 	EnableEncryption bool
+	// The third party protocols this application service provides, for /thirdparty lookups.
+	Protocols []string
+	// The user IDs, room aliases and room IDs the application service is interested in. If all are
+	// empty, the application service is interested in all users, non-exclusively.
+	UserNamespaces  []ApplicationServiceNamespace
+	AliasNamespaces []ApplicationServiceNamespace
+	RoomNamespaces  []ApplicationServiceNamespace
+}
+
+// ApplicationServiceNamespace is a namespace in an application service registration.
+type ApplicationServiceNamespace struct {
+	// If true, only the application service may create users or aliases in the namespace.
+	Exclusive bool
+	// The regular expression to match e.g "@_irc_.*:hs1"
+	Regex string
 }
 
 type Event struct {
@@ -110,7 +222,14 @@ func Validate(bp Blueprint) (Blueprint, error) {
 	}
 	var err error
 	for _, hs := range bp.Homeservers {
+		mediaRefs := make(map[string]bool)
 		for i, u := range hs.Users {
+			for _, m := range u.Media {
+				if m.Ref == "" || mediaRefs[m.Ref] {
+					return bp, fmt.Errorf("HS %s media ref '%s' must be set and unique", hs.Name, m.Ref)
+				}
+				mediaRefs[m.Ref] = true
+			}
 			if !strings.HasPrefix(u.Localpart, "@") {
 				return bp, fmt.Errorf("HS %s user localpart '%s' must start with '@'", hs.Name, u.Localpart)
 			}
@@ -129,7 +248,45 @@ func Validate(bp Blueprint) (Blueprint, error) {
 		for i, as := range hs.ApplicationServices {
 			hs.ApplicationServices[i], err = normalizeApplicationService(as)
 			if err != nil {
-				return bp, err
+				return bp, fmt.Errorf("HS %s: %w", hs.Name, err)
+			}
+		}
+		pluginNames := make(map[string]bool)
+		for _, p := range hs.Plugins {
+			if err = validatePlugin(p); err != nil {
+				return bp, fmt.Errorf("HS %s: %w", hs.Name, err)
+			}
+			if pluginNames[p.Name] {
+				return bp, fmt.Errorf("HS %s plugin name '%s' must be unique", hs.Name, p.Name)
+			}
+			pluginNames[p.Name] = true
+		}
+		for _, kv := range hs.Env {
+			if key, _, ok := strings.Cut(kv, "="); !ok || key == "" {
+				return bp, fmt.Errorf("HS %s env '%s' must be of the form KEY=VALUE", hs.Name, kv)
+			}
+		}
+		for _, m := range hs.Mounts {
+			if m.HostPath == "" || !path.IsAbs(m.ContainerPath) {
+				return bp, fmt.Errorf("HS %s mount '%s:%s' must have a host path and an absolute container path", hs.Name, m.HostPath, m.ContainerPath)
+			}
+		}
+		sidecarNames := make(map[string]bool)
+		for _, sc := range hs.Sidecars {
+			if !sidecarNameRegexp.MatchString(sc.Name) {
+				return bp, fmt.Errorf("HS %s sidecar name '%s' must be a valid hostname label", hs.Name, sc.Name)
+			}
+			if sidecarNames[sc.Name] {
+				return bp, fmt.Errorf("HS %s sidecar name '%s' must be unique", hs.Name, sc.Name)
+			}
+			sidecarNames[sc.Name] = true
+			if sc.Image == "" {
+				return bp, fmt.Errorf("HS %s sidecar %s must have an image", hs.Name, sc.Name)
+			}
+			for filePath := range sc.Files {
+				if !path.IsAbs(filePath) {
+					return bp, fmt.Errorf("HS %s sidecar %s file path '%s' must be absolute", hs.Name, sc.Name, filePath)
+				}
 			}
 		}
 	}
@@ -137,6 +294,18 @@ func Validate(bp Blueprint) (Blueprint, error) {
 	return bp, nil
 }
 
+func validatePlugin(p Plugin) error {
+	if !filepath.IsLocal(p.Name) || strings.ContainsAny(p.Name, "/\\ ") {
+		return fmt.Errorf("plugin name '%s' must be a valid file name", p.Name)
+	}
+	for filePath := range p.Files {
+		if !filepath.IsLocal(filePath) {
+			return fmt.Errorf("plugin %s file path '%s' must be relative to the plugin directory", p.Name, filePath)
+		}
+	}
+	return nil
+}
+
 func normaliseRoom(hsName string, r Room) (Room, error) {
 	var err error
 	if r.Creator != "" {
@@ -163,6 +332,12 @@ func normaliseRoom(hsName string, r Room) (Room, error) {
 	return r, nil
 }
 
+// UserPassword returns the password of the blueprint user with the given localpart, which can be
+// used to log in as them.
+func UserPassword(localpart string) string {
+	return "complement_meets_min_pasword_req_" + localpart
+}
+
 func normaliseUser(u string, hsName string) (string, error) {
 	// if they did it as @foo:bar make sure :bar is the name of the HS
 	if strings.Contains(u, ":") {
@@ -179,6 +354,17 @@ func normaliseUser(u string, hsName string) (string, error) {
 }
 
 func normalizeApplicationService(as ApplicationService) (ApplicationService, error) {
+	for _, namespaces := range [][]ApplicationServiceNamespace{as.UserNamespaces, as.AliasNamespaces, as.RoomNamespaces} {
+		for _, ns := range namespaces {
+			if _, err := regexp.Compile(ns.Regex); ns.Regex == "" || err != nil {
+				return as, fmt.Errorf("application service %s namespace regex '%s' must be a valid regular expression", as.ID, ns.Regex)
+			}
+		}
+	}
+	// Complement-controlled application services need to know their tokens, so keep them if set.
+	if as.HSToken != "" && as.ASToken != "" {
+		return as, nil
+	}
 	hsToken := make([]byte, 32)
 	_, err := rand.Read(hsToken)
 	if err != nil {
@@ -0,0 +1,114 @@
+package b
+
+import "testing"
+
+func TestValidatePlugins(t *testing.T) {
+	testCases := []struct {
+		name    string
+		plugins []Plugin
+		wantErr bool
+	}{
+		{name: "valid", plugins: []Plugin{{Name: "my_module", Files: map[string][]byte{"my_module.py": nil, "lib/util.py": nil}}}},
+		{name: "missing name", plugins: []Plugin{{}}, wantErr: true},
+		{name: "name with slash", plugins: []Plugin{{Name: "a/b"}}, wantErr: true},
+		{name: "duplicate name", plugins: []Plugin{{Name: "a"}, {Name: "a"}}, wantErr: true},
+		{name: "absolute file path", plugins: []Plugin{{Name: "a", Files: map[string][]byte{"/etc/passwd": nil}}}, wantErr: true},
+		{name: "file path escapes", plugins: []Plugin{{Name: "a", Files: map[string][]byte{"../b.py": nil}}}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		_, err := Validate(Blueprint{
+			Name:        "plugins",
+			Homeservers: []Homeserver{{Name: "hs1", Plugins: tc.plugins}},
+		})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateApplicationServiceNamespaces(t *testing.T) {
+	testCases := []struct {
+		name    string
+		as      ApplicationService
+		wantErr bool
+	}{
+		{name: "no namespaces", as: ApplicationService{ID: "as"}},
+		{name: "valid", as: ApplicationService{ID: "as", UserNamespaces: []ApplicationServiceNamespace{{Exclusive: true, Regex: "@_irc_.*:hs1"}}}},
+		{name: "missing regex", as: ApplicationService{ID: "as", AliasNamespaces: []ApplicationServiceNamespace{{Exclusive: true}}}, wantErr: true},
+		{name: "invalid regex", as: ApplicationService{ID: "as", RoomNamespaces: []ApplicationServiceNamespace{{Regex: "!(.*"}}}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		_, err := Validate(Blueprint{
+			Name:        "appservices",
+			Homeservers: []Homeserver{{Name: "hs1", ApplicationServices: []ApplicationService{tc.as}}},
+		})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateSidecars(t *testing.T) {
+	testCases := []struct {
+		name     string
+		sidecars []Sidecar
+		wantErr  bool
+	}{
+		{name: "valid", sidecars: []Sidecar{{Name: "redis", Image: "redis:7-alpine"}, {Name: "proxy", Image: "nginx", Files: map[string][]byte{"/etc/nginx/conf.d/default.conf": nil}}}},
+		{name: "missing name", sidecars: []Sidecar{{Image: "redis"}}, wantErr: true},
+		{name: "invalid name", sidecars: []Sidecar{{Name: "my.redis", Image: "redis"}}, wantErr: true},
+		{name: "duplicate name", sidecars: []Sidecar{{Name: "a", Image: "redis"}, {Name: "a", Image: "redis"}}, wantErr: true},
+		{name: "missing image", sidecars: []Sidecar{{Name: "a"}}, wantErr: true},
+		{name: "relative file path", sidecars: []Sidecar{{Name: "a", Image: "nginx", Files: map[string][]byte{"default.conf": nil}}}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		_, err := Validate(Blueprint{
+			Name:        "sidecars",
+			Homeservers: []Homeserver{{Name: "hs1", Sidecars: tc.sidecars}},
+		})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	testCases := []struct {
+		env     []string
+		wantErr bool
+	}{
+		{env: []string{"SYNAPSE_WORKERS=1", "EMPTY="}},
+		{env: []string{"SYNAPSE_WORKERS"}, wantErr: true},
+		{env: []string{"=1"}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		_, err := Validate(Blueprint{
+			Name:        "env",
+			Homeservers: []Homeserver{{Name: "hs1", Env: tc.env}},
+		})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%v: got error %v, want error: %v", tc.env, err, tc.wantErr)
+		}
+	}
+}
+
+func TestValidateMounts(t *testing.T) {
+	testCases := []struct {
+		mount   Mount
+		wantErr bool
+	}{
+		{mount: Mount{HostPath: "testdata/module", ContainerPath: "/modules/my_module", ReadOnly: true}},
+		{mount: Mount{HostPath: "/srv/media", ContainerPath: "/data/media"}},
+		{mount: Mount{ContainerPath: "/data/media"}, wantErr: true},
+		{mount: Mount{HostPath: "/srv/media", ContainerPath: "data/media"}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		_, err := Validate(Blueprint{
+			Name:        "mounts",
+			Homeservers: []Homeserver{{Name: "hs1", Mounts: []Mount{tc.mount}}},
+		})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%+v: got error %v, want error: %v", tc.mount, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package b
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The prefixes of the labels which are baked into homeserver images when a blueprint is built.
+const (
+	// 'access_token_$user_id: $token'
+	LabelPrefixAccessToken = "access_token_"
+	// 'device_id$user_id: $device_id'
+	LabelPrefixDeviceID = "device_id"
+	// 'application_service_$as_id: $registration'
+	LabelPrefixApplicationService = "application_service_"
+	// 'media_$ref: $mxc_uri'
+	LabelPrefixMedia = "media_"
+	// 'metadata_$key: $value' from Homeserver.Metadata
+	LabelPrefixMetadata = "metadata_"
+)
+
+// LabelSchema is the label which records the version of the label schema an image was built with.
+const LabelSchema = "complement_label_schema"
+
+// LabelSchemaVersion is the version of the label schema written by this version of Complement. It
+// must be bumped whenever the format or meaning of the labels changes, so images built by older
+// versions of Complement (e.g prebuilt or kept via COMPLEMENT_KEEP_BLUEPRINTS) are rebuilt rather
+// than misread.
+const LabelSchemaVersion = "2"
+
+// Labels are the labels of a homeserver image built from a blueprint. Use the methods to read the
+// data stored in them rather than parsing the labels directly.
+type Labels map[string]string
+
+// AccessTokens returns the access tokens of the users on the homeserver, keyed on user ID.
+func (l Labels) AccessTokens() map[string]string {
+	return l.withPrefix(LabelPrefixAccessToken)
+}
+
+// DeviceIDs returns the device IDs of the users on the homeserver, keyed on user ID.
+func (l Labels) DeviceIDs() map[string]string {
+	return l.withPrefix(LabelPrefixDeviceID)
+}
+
+// ApplicationServices returns the registration YAML of the application services on the homeserver,
+// keyed on application service ID.
+func (l Labels) ApplicationServices() map[string]string {
+	asMap := l.withPrefix(LabelPrefixApplicationService)
+	for id, registration := range asMap {
+		// labels can't be multiline, so newlines (and backslashes) in registrations are escaped when stored
+		asMap[id] = labelUnescaper.Replace(registration)
+	}
+	return asMap
+}
+
+// MediaURIs returns the MXC URIs of the media uploaded on the homeserver, keyed on the media Ref.
+func (l Labels) MediaURIs() map[string]string {
+	return l.withPrefix(LabelPrefixMedia)
+}
+
+// Metadata returns the Homeserver.Metadata of the blueprint.
+func (l Labels) Metadata() map[string]string {
+	return l.withPrefix(LabelPrefixMetadata)
+}
+
+// CheckSchema returns an error if the labels were written with a different label schema version to
+// this version of Complement, in which case the image must be rebuilt.
+func (l Labels) CheckSchema() error {
+	version, ok := l[LabelSchema]
+	if !ok {
+		return fmt.Errorf("image has no label schema version, want %s: it was built by an older version of Complement", LabelSchemaVersion)
+	}
+	if version != LabelSchemaVersion {
+		return fmt.Errorf("image has label schema version %s, want %s: it was built by a different version of Complement", version, LabelSchemaVersion)
+	}
+	return nil
+}
+
+// labelUnescaper reverses the escaping of multiline label values.
+var labelUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+
+func (l Labels) withPrefix(prefix string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range l {
+		if strings.HasPrefix(k, prefix) {
+			result[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,46 @@
+package b
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	labels := Labels{
+		"access_token_@alice:hs1":     "token",
+		"device_id@alice:hs1":         "ALICEDEVICE",
+		"application_service_my-as":   `id: my-as\nurl: null\nregex: '@\\n.*'\n`,
+		"media_avatar":                "mxc://hs1/abc",
+		"metadata_room_id":            "!room:hs1",
+		"complement_blueprint":        "test",
+		"org.opencontainers.image.ok": "yes",
+	}
+	testCases := []struct {
+		name string
+		got  map[string]string
+		want map[string]string
+	}{
+		{name: "AccessTokens", got: labels.AccessTokens(), want: map[string]string{"@alice:hs1": "token"}},
+		{name: "DeviceIDs", got: labels.DeviceIDs(), want: map[string]string{"@alice:hs1": "ALICEDEVICE"}},
+		{name: "ApplicationServices", got: labels.ApplicationServices(), want: map[string]string{"my-as": "id: my-as\nurl: null\nregex: '@\\n.*'\n"}},
+		{name: "MediaURIs", got: labels.MediaURIs(), want: map[string]string{"avatar": "mxc://hs1/abc"}},
+		{name: "Metadata", got: labels.Metadata(), want: map[string]string{"room_id": "!room:hs1"}},
+	}
+	for _, tc := range testCases {
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("%s: got %v want %v", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestLabelsCheckSchema(t *testing.T) {
+	if err := (Labels{LabelSchema: LabelSchemaVersion}).CheckSchema(); err != nil {
+		t.Errorf("CheckSchema: current version returned error: %s", err)
+	}
+	if err := (Labels{LabelSchema: "0"}).CheckSchema(); err == nil {
+		t.Errorf("CheckSchema: different version returned no error")
+	}
+	if err := (Labels{}).CheckSchema(); err == nil {
+		t.Errorf("CheckSchema: missing version returned no error")
+	}
+}
@@ -0,0 +1,62 @@
+package b
+
+// BlueprintUserDirectory contains a homeserver with users whose visibility in the user directory
+// differs, for testing the rule that users can only find users they share a room with, or who are in
+// a public room:
+//   - @alice and @bob share a private room, so can only find each other.
+//   - @charlie is in a public room, so can be found by everyone.
+//   - @eve is in no rooms, so can be found by no one.
+//
+// Every user has a display name starting with "Directory" so they can be searched for together.
+var BlueprintUserDirectory = MustValidate(Blueprint{
+	Name: "user_directory",
+	Homeservers: []Homeserver{
+		{
+			Name: "hs1",
+			Users: []User{
+				{
+					Localpart:   "@alice",
+					DisplayName: "Directory Alice",
+				},
+				{
+					Localpart:   "@bob",
+					DisplayName: "Directory Bob",
+				},
+				{
+					Localpart:   "@charlie",
+					DisplayName: "Directory Charlie",
+				},
+				{
+					Localpart:   "@eve",
+					DisplayName: "Directory Eve",
+				},
+			},
+			Rooms: []Room{
+				{
+					CreateRoom: map[string]interface{}{
+						"preset": "private_chat",
+						"invite": []string{"@bob:hs1"},
+					},
+					Creator: "@alice",
+					Events: []Event{
+						{
+							Type:     "m.room.member",
+							StateKey: Ptr("@bob:hs1"),
+							Content: map[string]interface{}{
+								"membership": "join",
+							},
+							Sender: "@bob",
+						},
+					},
+				},
+				{
+					CreateRoom: map[string]interface{}{
+						"preset":     "public_chat",
+						"visibility": "public",
+					},
+					Creator: "@charlie",
+				},
+			},
+		},
+	},
+})
@@ -0,0 +1,146 @@
+// package captcha contains a reCAPTCHA-compatible verification server, so registration flows which
+// require the m.login.recaptcha stage can be completed (or failed) under the control of the test.
+//
+// Every deployment starts its own server. Homeservers are told where it is via the environment
+// variables COMPLEMENT_RECAPTCHA_SITEVERIFY_URL, COMPLEMENT_RECAPTCHA_PUBLIC_KEY and
+// COMPLEMENT_RECAPTCHA_PRIVATE_KEY, which images should use to configure captcha verification.
+package captcha
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	// The site key homeservers should give to clients.
+	PublicKey = "complement_recaptcha_public_key"
+	// The secret homeservers must send when verifying responses.
+	PrivateKey = "complement_recaptcha_private_key"
+)
+
+// VerifyRequest is a request from a homeserver to verify a captcha response.
+type VerifyRequest struct {
+	Secret   string
+	Response string
+	RemoteIP string
+}
+
+// VerifyResponse is the result of verifying a captcha response.
+type VerifyResponse struct {
+	Success    bool     `json:"success"`
+	Hostname   string   `json:"hostname,omitempty"`
+	ErrorCodes []string `json:"error-codes,omitempty"`
+}
+
+// Approve returns a successful VerifyResponse.
+func Approve() VerifyResponse {
+	return VerifyResponse{Success: true, Hostname: "complement"}
+}
+
+// Deny returns a failed VerifyResponse with the given error codes e.g "invalid-input-response".
+func Deny(errorCodes ...string) VerifyResponse {
+	return VerifyResponse{Success: false, ErrorCodes: errorCodes}
+}
+
+// Server is an HTTP server implementing the reCAPTCHA siteverify API.
+type Server struct {
+	// The siteverify URL homeservers should use.
+	URL string
+
+	srv *http.Server
+	wg  sync.WaitGroup
+
+	mu       sync.Mutex
+	verifier func(req VerifyRequest) VerifyResponse
+	requests []VerifyRequest
+}
+
+// NewServer starts a captcha verification server on a random high-numbered port. `hostname` is the
+// hostname of the machine running Complement from the perspective of the homeservers. By default,
+// every non-empty response is approved: call SetVerifier to change this.
+func NewServer(hostname string) (*Server, error) {
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		return nil, fmt.Errorf("captcha.NewServer: net.Listen failed: %w", err)
+	}
+	s := &Server{
+		URL: fmt.Sprintf("http://%s:%d/recaptcha/api/siteverify", hostname, ln.Addr().(*net.TCPAddr).Port),
+		verifier: func(req VerifyRequest) VerifyResponse {
+			if req.Response == "" {
+				return Deny("missing-input-response")
+			}
+			return Approve()
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/recaptcha/api/siteverify", s.handleSiteVerify)
+	s.srv = &http.Server{Handler: mux}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.srv.Serve(ln)
+	}()
+	return s, nil
+}
+
+// Env returns the environment variables which tell a homeserver how to verify captchas with this server.
+func (s *Server) Env() []string {
+	return []string{
+		"COMPLEMENT_RECAPTCHA_SITEVERIFY_URL=" + s.URL,
+		"COMPLEMENT_RECAPTCHA_PUBLIC_KEY=" + PublicKey,
+		"COMPLEMENT_RECAPTCHA_PRIVATE_KEY=" + PrivateKey,
+	}
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	err := s.srv.Close()
+	s.wg.Wait()
+	return err
+}
+
+// SetVerifier sets the function which decides whether a captcha response is valid. Requests with
+// the wrong secret are always denied.
+func (s *Server) SetVerifier(fn func(req VerifyRequest) VerifyResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verifier = fn
+}
+
+// Requests returns all verification requests received so far, in the order they were received.
+func (s *Server) Requests() []VerifyRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]VerifyRequest(nil), s.requests...)
+}
+
+func (s *Server) handleSiteVerify(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	verifyReq := VerifyRequest{
+		Secret:   req.Form.Get("secret"),
+		Response: req.Form.Get("response"),
+		RemoteIP: req.Form.Get("remoteip"),
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, verifyReq)
+	verifier := s.verifier
+	s.mu.Unlock()
+	var res VerifyResponse
+	if verifyReq.Secret != PrivateKey {
+		res = Deny("invalid-input-secret")
+	} else {
+		res = verifier(verifyReq)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,53 @@
+package captcha
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestServerVerifiesResponses(t *testing.T) {
+	srv, err := NewServer("localhost")
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	defer srv.Close()
+	srv.SetVerifier(func(req VerifyRequest) VerifyResponse {
+		if req.Response == "good" {
+			return Approve()
+		}
+		return Deny("invalid-input-response")
+	})
+
+	testCases := []struct {
+		secret      string
+		response    string
+		wantSuccess bool
+	}{
+		{secret: PrivateKey, response: "good", wantSuccess: true},
+		{secret: PrivateKey, response: "bad", wantSuccess: false},
+		{secret: "wrong", response: "good", wantSuccess: false},
+	}
+	for _, tc := range testCases {
+		res, err := http.PostForm(srv.URL, url.Values{
+			"secret":   {tc.secret},
+			"response": {tc.response},
+		})
+		if err != nil {
+			t.Fatalf("PostForm: %s", err)
+		}
+		var verifyRes VerifyResponse
+		err = json.NewDecoder(res.Body).Decode(&verifyRes)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode response: %s", err)
+		}
+		if verifyRes.Success != tc.wantSuccess {
+			t.Errorf("secret=%s response=%s: got success=%v want %v", tc.secret, tc.response, verifyRes.Success, tc.wantSuccess)
+		}
+	}
+	if got := len(srv.Requests()); got != len(testCases) {
+		t.Errorf("Requests: got %d, want %d", got, len(testCases))
+	}
+}
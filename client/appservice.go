@@ -0,0 +1,33 @@
+package client
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// PingAppService asks the homeserver to ping the application service with the ID given, which
+// must be the application service this client is authenticated as, i.e the client's access token
+// is its as_token. `transactionID` is optional, and is passed to the application service.
+// Returns the raw http response. See MSC2659.
+func (c *CSAPI) PingAppService(t ct.TestLike, appserviceID, transactionID string) *http.Response {
+	t.Helper()
+	reqBody := map[string]interface{}{}
+	if transactionID != "" {
+		reqBody["transaction_id"] = transactionID
+	}
+	return c.Do(t, "POST", []string{"_matrix", "client", "v1", "appservice", appserviceID, "ping"}, WithJSONBody(t, reqBody))
+}
+
+// MustPingAppService is the same as PingAppService but fails the test if the response is not 2xx.
+// Returns the round trip time to the application service reported by the homeserver.
+func (c *CSAPI) MustPingAppService(t ct.TestLike, appserviceID, transactionID string) time.Duration {
+	t.Helper()
+	res := c.PingAppService(t, appserviceID, transactionID)
+	mustRespond2xx(t, res)
+	durationMs := gjson.GetBytes(ParseJSON(t, res), "duration_ms").Int()
+	return time.Duration(durationMs) * time.Millisecond
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"io"
+	"time"
 
 	"github.com/matrix-org/complement/ct"
 	"github.com/tidwall/gjson"
@@ -98,6 +99,100 @@ func (c *CSAPI) ConsumeRefreshToken(t ct.TestLike, refreshToken string) (newAcce
 	return newAccessToken, newRefreshToken, expiresInMs
 }
 
+// Whoami is the response to /account/whoami.
+type Whoami struct {
+	UserID   string
+	DeviceID string
+	IsGuest  bool
+}
+
+// MustWhoami calls /account/whoami, failing the test if the access token is not valid or is for
+// another user.
+func (c *CSAPI) MustWhoami(t ct.TestLike) Whoami {
+	t.Helper()
+	res := c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"})
+	body := ParseJSON(t, res)
+	whoami := Whoami{
+		UserID:   GetJSONFieldStr(t, body, "user_id"),
+		DeviceID: gjson.GetBytes(body, "device_id").Str,
+		IsGuest:  gjson.GetBytes(body, "is_guest").Bool(),
+	}
+	if c.UserID != "" && whoami.UserID != c.UserID {
+		ct.Fatalf(t, "MustWhoami: access token is for %s, want %s", whoami.UserID, c.UserID)
+	}
+	return whoami
+}
+
+// TokenState is the state of an access token, as reported by the homeserver.
+type TokenState string
+
+const (
+	// The access token is valid.
+	TokenValid TokenState = "valid"
+	// The access token is no longer valid, but the device still exists so the client can log in
+	// again without losing its encryption keys e.g the token expired.
+	TokenSoftLoggedOut TokenState = "soft_logout"
+	// The access token is no longer valid, and the device has been removed e.g the client logged out.
+	TokenLoggedOut TokenState = "logged_out"
+)
+
+// TokenState calls /account/whoami to find out whether the access token is valid, and if not whether
+// the client has been soft logged out. Fails the test on any other response.
+func (c *CSAPI) TokenState(t ct.TestLike) TokenState {
+	t.Helper()
+	res := c.Do(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"})
+	if res.StatusCode == 200 {
+		return TokenValid
+	}
+	body := ParseJSON(t, res)
+	errcode := gjson.GetBytes(body, "errcode").Str
+	if res.StatusCode != 401 || errcode != "M_UNKNOWN_TOKEN" {
+		ct.Fatalf(t, "TokenState: /account/whoami returned HTTP %d %s, want 200 or 401 M_UNKNOWN_TOKEN", res.StatusCode, string(body))
+	}
+	if gjson.GetBytes(body, "soft_logout").Bool() {
+		return TokenSoftLoggedOut
+	}
+	return TokenLoggedOut
+}
+
+// MustHaveTokenState fails the test if the access token is not in the state `want`.
+func (c *CSAPI) MustHaveTokenState(t ct.TestLike, want TokenState) {
+	t.Helper()
+	if got := c.TokenState(t); got != want {
+		ct.Fatalf(t, "MustHaveTokenState: %s access token is %s, want %s", c.UserID, got, want)
+	}
+}
+
+// MustWaitForTokenState polls /account/whoami until the access token is in the state `want`, failing
+// the test after `timeout`. This is useful to wait for a token to expire e.g after logging in with
+// LoginUserWithRefreshToken, which returns how long the token is valid for.
+func (c *CSAPI) MustWaitForTokenState(t ct.TestLike, want TokenState, timeout time.Duration) {
+	t.Helper()
+	start := time.Now()
+	for {
+		got := c.TokenState(t)
+		if got == want {
+			return
+		}
+		if time.Since(start) > timeout {
+			ct.Fatalf(t, "MustWaitForTokenState: %s access token is still %s after %v, want %s", c.UserID, got, timeout, want)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// MustLogout logs out this device, which invalidates the access token.
+func (c *CSAPI) MustLogout(t ct.TestLike) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "v3", "logout"}, WithJSONBody(t, struct{}{}))
+}
+
+// MustLogoutAll logs out all devices for this user, which invalidates all of their access tokens.
+func (c *CSAPI) MustLogoutAll(t ct.TestLike) {
+	t.Helper()
+	c.MustDo(t, "POST", []string{"_matrix", "client", "v3", "logout", "all"}, WithJSONBody(t, struct{}{}))
+}
+
 // RegisterUser will register the user with given parameters and
 // return user ID, access token and device ID. It fails the test on network error.
 func (c *CSAPI) RegisterUser(t ct.TestLike, localpart, password string) (userID, accessToken, deviceID string) {
@@ -125,6 +220,14 @@ func (c *CSAPI) RegisterUser(t ct.TestLike, localpart, password string) (userID,
 // RegisterSharedSecret registers a new account with a shared secret via HMAC
 // See https://github.com/matrix-org/synapse/blob/e550ab17adc8dd3c48daf7fedcd09418a73f524b/synapse/_scripts/register_new_matrix_user.py#L40
 func (c *CSAPI) RegisterSharedSecret(t ct.TestLike, user, pass string, isAdmin bool) (userID, accessToken, deviceID string) {
+	t.Helper()
+	return c.RegisterSharedSecretWith(t, SharedSecret, user, pass, isAdmin)
+}
+
+// RegisterSharedSecretWith is RegisterSharedSecret but uses the given shared secret rather than the one
+// Complement homeserver images are configured with, for homeservers not deployed by Complement.
+func (c *CSAPI) RegisterSharedSecretWith(t ct.TestLike, secret, user, pass string, isAdmin bool) (userID, accessToken, deviceID string) {
+	t.Helper()
 	resp := c.Do(t, "GET", []string{"_synapse", "admin", "v1", "register"})
 	if resp.StatusCode != 200 {
 		t.Skipf("Homeserver image does not support shared secret registration, /_synapse/admin/v1/register returned HTTP %d", resp.StatusCode)
@@ -135,7 +238,7 @@ func (c *CSAPI) RegisterSharedSecret(t ct.TestLike, user, pass string, isAdmin b
 	if !nonce.Exists() {
 		ct.Fatalf(t, "Malformed shared secret GET response: %s", string(body))
 	}
-	mac := hmac.New(sha1.New, []byte(SharedSecret))
+	mac := hmac.New(sha1.New, []byte(secret))
 	mac.Write([]byte(nonce.Str))
 	mac.Write([]byte("\x00"))
 	mac.Write([]byte(user))
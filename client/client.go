@@ -26,6 +26,7 @@ import (
 
 	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/debugui"
 	"github.com/matrix-org/complement/internal"
 )
 
@@ -661,6 +662,24 @@ func WithRawBody(body []byte) RequestOpt {
 	}
 }
 
+// WithReaderBody streams the HTTP request body from `body`, so large bodies do not need to be held in
+// memory. If `length` is negative the length is unknown, so the body is sent with chunked transfer
+// encoding, otherwise it is sent as the Content-Length. The body can only be read once, so cannot be
+// used with WithRetryUntil.
+func WithReaderBody(body io.Reader, length int64) RequestOpt {
+	return func(req *http.Request) {
+		req.Body = io.NopCloser(body)
+		req.GetBody = nil
+		req.ContentLength = length
+		if length < 0 {
+			req.ContentLength = -1
+		} else if length == 0 {
+			// a zero ContentLength with a non-nil body means unknown to the stdlib
+			req.Body = http.NoBody
+		}
+	}
+}
+
 // WithContentType sets the HTTP request Content-Type header to `cType`
 func WithContentType(cType string) RequestOpt {
 	return func(req *http.Request) {
@@ -668,6 +687,20 @@ func WithContentType(cType string) RequestOpt {
 	}
 }
 
+// WithHeader sets the HTTP request header `key` to `value`, replacing any existing values. Headers
+// set by earlier options (including WithContentType) can be overridden by later ones, and the
+// default Authorization header can be overridden to make requests with a different access token.
+func WithHeader(key, value string) RequestOpt {
+	return func(req *http.Request) {
+		req.Header.Set(key, value)
+	}
+}
+
+// WithUserAgent sets the HTTP request User-Agent header to `userAgent`
+func WithUserAgent(userAgent string) RequestOpt {
+	return WithHeader("User-Agent", userAgent)
+}
+
 // WithJSONBody sets the HTTP request body to the JSON serialised form of `obj`
 func WithJSONBody(t ct.TestLike, obj interface{}) RequestOpt {
 	return func(req *http.Request) {
@@ -728,6 +761,18 @@ func (c *CSAPI) MustDo(t ct.TestLike, method string, paths []string, opts ...Req
 // The caller does not need to worry about closing the returned `http.Response.Body` as
 // this is handled automatically.
 func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	res, err := c.TryDo(t, method, paths, opts...)
+	if err != nil {
+		ct.Fatalf(t, "CSAPI.Do %s", err)
+	}
+	return res
+}
+
+// TryDo is the same as Do but returns an error rather than failing the test if there was a network
+// error talking to the server, e.g because the connection was dropped part way through the request.
+// This is useful to test how the server behaves when clients disconnect, see Proxy.
+func (c *CSAPI) TryDo(t ct.TestLike, method string, paths []string, opts ...RequestOpt) (*http.Response, error) {
 	t.Helper()
 	escapedPaths := make([]string, len(paths))
 	for i := range paths {
@@ -758,7 +803,10 @@ func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...Request
 	if c.Debug {
 		t.Logf("Making %s request to %s (%s)", method, req.URL, c.AccessToken)
 		contentType := req.Header.Get("Content-Type")
-		if contentType == "application/json" || strings.HasPrefix(contentType, "text/") {
+		if req.Body != nil && req.GetBody == nil {
+			// streamed bodies may be huge, and cannot be read twice
+			t.Logf("Request body: <stream:%s>", contentType)
+		} else if contentType == "application/json" || strings.HasPrefix(contentType, "text/") {
 			if req.Body != nil {
 				body, _ := io.ReadAll(req.Body)
 				t.Logf("Request body: %s", string(body))
@@ -773,7 +821,7 @@ func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...Request
 		// Perform the HTTP request
 		res, err := c.Client.Do(req)
 		if err != nil {
-			ct.Fatalf(t, "CSAPI.Do response returned error: %s", err)
+			return nil, fmt.Errorf("response returned error: %w", err)
 		}
 		// `defer` is function scoped but it's okay that we only clean up all requests at
 		// the end. To also be clear, `defer` arguments are evaluated at the time of the
@@ -794,7 +842,7 @@ func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...Request
 		if res.Body != nil {
 			resBody, err = io.ReadAll(res.Body)
 			if err != nil {
-				ct.Fatalf(t, "CSAPI.Do failed to read response body for RetryUntil check: %s", err)
+				return nil, fmt.Errorf("failed to read response body: %w", err)
 			}
 			res.Body = io.NopCloser(bytes.NewBuffer(resBody))
 		}
@@ -810,14 +858,14 @@ func (c *CSAPI) Do(t ct.TestLike, method string, paths []string, opts ...Request
 		}
 
 		if retryUntil == nil || retryUntil.timeout == 0 {
-			return res // don't retry
+			return res, nil // don't retry
 		}
 
 		// check the condition
 		if retryUntil.untilFn(res) {
 			// remake the response and return
 			res.Body = io.NopCloser(bytes.NewBuffer(resBody))
-			return res
+			return res, nil
 		}
 		// condition not satisfied, do we timeout yet?
 		if time.Since(now) > retryUntil.timeout {
@@ -859,9 +907,48 @@ func (t *loggedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 	} else {
 		t.t.Logf("[CSAPI] %s %s%s => %s (%s)", req.Method, t.hsName, req.URL.Path, res.Status, time.Since(start))
 	}
+	if debugui.Enabled() {
+		t.recordForDebugUI(req, res, start)
+	}
 	return res, err
 }
 
+// recordForDebugUI records the request in the debug UI, buffering the response body so it can still
+// be read by the caller.
+func (t *loggedRoundTripper) recordForDebugUI(req *http.Request, res *http.Response, start time.Time) {
+	entry := debugui.HTTPEntry{
+		StartedDateTime: start,
+		Time:            float64(time.Since(start).Microseconds()) / 1000,
+		Request: debugui.HTTPRequest{
+			Method: req.Method,
+			URL:    req.URL.String(),
+		},
+		Comment: t.t.Name(),
+	}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(body)
+			entry.Request.PostData = &debugui.HTTPPostData{
+				MimeType: req.Header.Get("Content-Type"),
+				Text:     string(data),
+			}
+		}
+	}
+	if res != nil {
+		data, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = io.NopCloser(bytes.NewReader(data))
+		entry.Response = debugui.HTTPResponse{
+			Status: res.StatusCode,
+			Content: debugui.HTTPContent{
+				MimeType: res.Header.Get("Content-Type"),
+				Text:     string(data),
+			},
+		}
+	}
+	debugui.RecordHTTP(entry)
+}
+
 // Extracts a JSON object given a search key
 // Caller must check `result.Exists()` to see whether the object actually exists.
 func GetOptionalJSONFieldObject(t ct.TestLike, body []byte, wantKey string) gjson.Result {
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// Preflight makes a CORS preflight OPTIONS request to the given path, as a browser would before making
+// a `method` request from `origin` with the extra headers `requestHeaders`. The request is not
+// authenticated, as browsers never send credentials in preflight requests. Returns the raw http response.
+// See match.CORS for matchers for the response headers.
+func (c *CSAPI) Preflight(t ct.TestLike, method string, paths []string, origin string, requestHeaders ...string) *http.Response {
+	t.Helper()
+	unauthed := *c
+	unauthed.AccessToken = ""
+	opts := []RequestOpt{
+		WithHeader("Origin", origin),
+		WithHeader("Access-Control-Request-Method", method),
+	}
+	if len(requestHeaders) > 0 {
+		opts = append(opts, WithHeader("Access-Control-Request-Headers", strings.Join(requestHeaders, ", ")))
+	}
+	return unauthed.Do(t, "OPTIONS", paths, opts...)
+}
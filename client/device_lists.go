@@ -0,0 +1,93 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// DeviceLists returns the user IDs in `device_lists.changed` and `device_lists.left` of a /sync response.
+func DeviceLists(topLevelSyncJSON gjson.Result) (changed, left []string) {
+	for _, userID := range topLevelSyncJSON.Get("device_lists.changed").Array() {
+		changed = append(changed, userID.Str)
+	}
+	for _, userID := range topLevelSyncJSON.Get("device_lists.left").Array() {
+		left = append(left, userID.Str)
+	}
+	return changed, left
+}
+
+// SyncDeviceListsChanged passes when all `userIDs` are in `device_lists.changed` of the same /sync
+// response, which is how clients learn that they must query a user's keys again e.g after the user
+// joins a shared room or uploads new device keys.
+func SyncDeviceListsChanged(userIDs ...string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		changed, _ := DeviceLists(topLevelSyncJSON)
+		if missing := missingUserIDs(changed, userIDs); len(missing) > 0 {
+			return fmt.Errorf("SyncDeviceListsChanged: %v not in device_lists.changed %v", missing, changed)
+		}
+		return nil
+	}
+}
+
+// SyncDeviceListsLeft passes when all `userIDs` are in `device_lists.left` of the same /sync response,
+// which is how clients learn that they no longer share a room with a user and will not be told
+// about changes to their devices.
+func SyncDeviceListsLeft(userIDs ...string) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		_, left := DeviceLists(topLevelSyncJSON)
+		if missing := missingUserIDs(left, userIDs); len(missing) > 0 {
+			return fmt.Errorf("SyncDeviceListsLeft: %v not in device_lists.left %v", missing, left)
+		}
+		return nil
+	}
+}
+
+// MustSyncDeviceListBarrier waits until device list updates from before the call have been returned
+// by /sync, so that a later /sync can assert that an update was *not* sent. Homeservers send device
+// list updates asynchronously, and some (Synapse) send extra updates after keys are queried, so
+// checking a single /sync response for the absence of an update is racy.
+//
+// `barrierUser` uploads new device keys, then the client syncs from `since` until `barrierUser` is in
+// `device_lists.changed`. The client must share a room with `barrierUser`, who should be on the same
+// homeserver as the users whose updates are being waited for, so that updates over federation are
+// also ordered before the barrier. Fails the test if any of `unchangedUserIDs` appear in
+// `device_lists.changed` along the way. Returns the `next_batch` token after the barrier.
+func (c *CSAPI) MustSyncDeviceListBarrier(t ct.TestLike, since string, barrierUser *CSAPI, unchangedUserIDs ...string) string {
+	t.Helper()
+	deviceKeys, _ := barrierUser.MustGenerateOneTimeKeys(t, 0)
+	barrierUser.MustUploadKeys(t, deviceKeys, nil)
+	var unexpected []string
+	nextBatch := c.MustSyncUntil(t, SyncReq{Since: since}, func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		changed, _ := DeviceLists(topLevelSyncJSON)
+		for _, userID := range changed {
+			for _, unchanged := range unchangedUserIDs {
+				if userID == unchanged {
+					unexpected = append(unexpected, userID)
+				}
+			}
+		}
+		return SyncDeviceListsChanged(barrierUser.UserID)(clientUserID, topLevelSyncJSON)
+	})
+	if len(unexpected) > 0 {
+		ct.Fatalf(t, "MustSyncDeviceListBarrier: %s unexpectedly saw device list changes for %s", c.UserID, strings.Join(unexpected, ", "))
+	}
+	return nextBatch
+}
+
+// missingUserIDs returns the `want` user IDs which are not in `got`.
+func missingUserIDs(got, want []string) (missing []string) {
+	gotSet := make(map[string]bool, len(got))
+	for _, userID := range got {
+		gotSet[userID] = true
+	}
+	for _, userID := range want {
+		if !gotSet[userID] {
+			missing = append(missing, userID)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// DeviceTracker maintains a client's view of other users' devices in the way an E2EE client does: users
+// in `device_lists.changed` of /sync are marked as outdated and their devices are fetched again with
+// /keys/query, and users in `device_lists.left` are no longer tracked. Tests can then assert that the
+// view converges on the devices users really have e.g after joins, leaves and server restarts. As with
+// real clients, only devices which have uploaded device keys are known.
+//
+// A DeviceTracker is not safe for concurrent use.
+type DeviceTracker struct {
+	client *CSAPI
+	since  string
+	// the device IDs of each tracked user, sorted
+	devices  map[string][]string
+	outdated map[string]bool
+}
+
+// NewDeviceTracker returns a tracker for the devices of the given users, as well as any users the
+// client later sees in `device_lists.changed`. It does an initial /sync, so only device list changes
+// after the call are seen: the initial devices are fetched on the first call to Sync.
+func (c *CSAPI) NewDeviceTracker(t ct.TestLike, userIDs ...string) *DeviceTracker {
+	t.Helper()
+	_, since := c.MustSync(t, SyncReq{TimeoutMillis: "0"})
+	dt := &DeviceTracker{
+		client:   c,
+		since:    since,
+		devices:  make(map[string][]string),
+		outdated: make(map[string]bool),
+	}
+	dt.Track(userIDs...)
+	return dt
+}
+
+// Track starts tracking the devices of the given users, which are fetched on the next call to Sync.
+func (dt *DeviceTracker) Track(userIDs ...string) {
+	for _, userID := range userIDs {
+		if _, ok := dt.devices[userID]; !ok {
+			dt.devices[userID] = nil
+		}
+		dt.outdated[userID] = true
+	}
+}
+
+// Sync does a single /sync request (with the given timeout in milliseconds), applying its device list
+// changes, then queries the keys of all outdated users.
+func (dt *DeviceTracker) Sync(t ct.TestLike, timeoutMillis int) {
+	t.Helper()
+	res, nextBatch := dt.client.MustSync(t, SyncReq{Since: dt.since, TimeoutMillis: fmt.Sprintf("%d", timeoutMillis)})
+	dt.since = nextBatch
+	changed, left := DeviceLists(res)
+	dt.Track(changed...)
+	for _, userID := range left {
+		delete(dt.devices, userID)
+		delete(dt.outdated, userID)
+	}
+	dt.queryOutdated(t)
+}
+
+// queryOutdated fetches the devices of outdated users with /keys/query.
+func (dt *DeviceTracker) queryOutdated(t ct.TestLike) {
+	t.Helper()
+	if len(dt.outdated) == 0 {
+		return
+	}
+	deviceKeys := make(map[string][]string, len(dt.outdated))
+	for userID := range dt.outdated {
+		deviceKeys[userID] = []string{}
+	}
+	res := dt.client.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "query"}, WithJSONBody(t, map[string]interface{}{
+		"device_keys": deviceKeys,
+	}))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	// users whose server could not be reached stay outdated, as a client would retry
+	failures := body.Get("failures")
+	for userID := range dt.outdated {
+		if failures.Get(GjsonEscape(userServerName(userID))).Exists() {
+			continue
+		}
+		devices := []string{}
+		body.Get("device_keys." + GjsonEscape(userID)).ForEach(func(deviceID, _ gjson.Result) bool {
+			devices = append(devices, deviceID.Str)
+			return true
+		})
+		sort.Strings(devices)
+		dt.devices[userID] = devices
+		delete(dt.outdated, userID)
+	}
+}
+
+// userServerName returns the server name of a user ID, or "" if it is invalid.
+func userServerName(userID string) string {
+	_, serverName, _ := strings.Cut(userID, ":")
+	return serverName
+}
+
+// Devices returns the sorted device IDs of the user as currently known, and whether the user is tracked.
+func (dt *DeviceTracker) Devices(userID string) (deviceIDs []string, tracked bool) {
+	deviceIDs, tracked = dt.devices[userID]
+	return deviceIDs, tracked
+}
+
+// MustConverge syncs until the tracked devices of the users in `want` are exactly the given device IDs,
+// in any order. A nil entry asserts that the user is no longer tracked e.g after they left all shared
+// rooms. Users not in `want` are not checked. Fails the test after CSAPI.SyncUntilTimeout.
+func (dt *DeviceTracker) MustConverge(t ct.TestLike, want map[string][]string) {
+	t.Helper()
+	start := time.Now()
+	var diff string
+	for {
+		dt.Sync(t, 1000)
+		if diff = dt.diff(want); diff == "" {
+			return
+		}
+		if time.Since(start) > dt.client.SyncUntilTimeout {
+			ct.Fatalf(t, "%s DeviceTracker.MustConverge: timed out after %v: %s", dt.client.UserID, time.Since(start), diff)
+		}
+	}
+}
+
+// diff returns a description of how the tracked devices differ from `want`, or "" if they are the same.
+func (dt *DeviceTracker) diff(want map[string][]string) string {
+	userIDs := make([]string, 0, len(want))
+	for userID := range want {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	for _, userID := range userIDs {
+		got, tracked := dt.devices[userID]
+		wantDevices := want[userID]
+		if wantDevices == nil {
+			if tracked {
+				return fmt.Sprintf("%s is still tracked with devices %v", userID, got)
+			}
+			continue
+		}
+		if !tracked {
+			return fmt.Sprintf("%s is not tracked, want devices %v", userID, wantDevices)
+		}
+		wantSorted := append([]string{}, wantDevices...)
+		sort.Strings(wantSorted)
+		if dt.outdated[userID] || !reflect.DeepEqual(got, wantSorted) {
+			return fmt.Sprintf("%s has devices %v (outdated=%v), want %v", userID, got, dt.outdated[userID], wantSorted)
+		}
+	}
+	return ""
+}
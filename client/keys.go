@@ -0,0 +1,145 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// OneTimeKeyAlgorithm is the algorithm of keys generated by MustGenerateOneTimeKeys.
+const OneTimeKeyAlgorithm = "signed_curve25519"
+
+var oneTimeKeyCounter atomic.Int64
+
+// ClaimedKey is a one-time or fallback key returned by /keys/claim.
+type ClaimedKey struct {
+	// e.g signed_curve25519:AAAAAQ
+	KeyID string
+	// The key object, with `key` and `signatures`.
+	Key gjson.Result
+	// True if the key is a fallback key, which the homeserver returns when the device has no one-time
+	// keys left.
+	Fallback bool
+}
+
+// MustUploadOneTimeKeys generates and uploads `count` signed_curve25519 one-time keys for the device,
+// failing the test on error. Unlike keys from MustGenerateOneTimeKeys, the key IDs are unique across
+// calls, so this can be called repeatedly to top up the keys of a device. Returns the key IDs and the
+// one-time key counts from the response.
+func (c *CSAPI) MustUploadOneTimeKeys(t ct.TestLike, count uint) (keyIDs []string, otkCounts map[string]int) {
+	t.Helper()
+	_, generated := c.MustGenerateOneTimeKeys(t, count)
+	oneTimeKeys := make(map[string]interface{}, len(generated))
+	for _, key := range generated {
+		keyID := fmt.Sprintf("%s:complement%d", OneTimeKeyAlgorithm, oneTimeKeyCounter.Add(1))
+		oneTimeKeys[keyID] = key
+		keyIDs = append(keyIDs, keyID)
+	}
+	sort.Strings(keyIDs)
+	return keyIDs, c.MustUploadKeys(t, nil, oneTimeKeys)
+}
+
+// MustUploadFallbackKey generates and uploads a signed_curve25519 fallback key for the device, replacing
+// any previous fallback key, and fails the test on error. Returns the key ID.
+// See https://spec.matrix.org/v1.12/client-server-api/#one-time-and-fallback-keys
+func (c *CSAPI) MustUploadFallbackKey(t ct.TestLike) (keyID string) {
+	t.Helper()
+	_, generated := c.MustGenerateOneTimeKeys(t, 1)
+	keyID = fmt.Sprintf("%s:complementfallback%d", OneTimeKeyAlgorithm, oneTimeKeyCounter.Add(1))
+	var key map[string]interface{}
+	for _, k := range generated {
+		key = k.(map[string]interface{})
+	}
+	key["fallback"] = true
+	c.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "upload"}, WithJSONBody(t, map[string]interface{}{
+		"fallback_keys": map[string]interface{}{
+			keyID: key,
+		},
+	}))
+	return keyID
+}
+
+// MustGetOneTimeKeyCounts returns the number of one-time keys the device has on the server, per algorithm.
+func (c *CSAPI) MustGetOneTimeKeyCounts(t ct.TestLike) map[string]int {
+	t.Helper()
+	return c.MustUploadKeys(t, nil, nil)
+}
+
+// MustClaimKey claims a one-time key of the algorithm for the device of another user, which may be on
+// another homeserver, failing the test on error. Returns nil if the device has neither one-time nor
+// fallback keys left.
+func (c *CSAPI) MustClaimKey(t ct.TestLike, userID, deviceID, algorithm string) *ClaimedKey {
+	t.Helper()
+	res := c.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "claim"}, WithJSONBody(t, map[string]interface{}{
+		"one_time_keys": map[string]interface{}{
+			userID: map[string]string{
+				deviceID: algorithm,
+			},
+		},
+	}))
+	body := gjson.ParseBytes(ParseJSON(t, res))
+	if failures := body.Get("failures"); len(failures.Map()) > 0 {
+		ct.Fatalf(t, "MustClaimKey: failed to claim keys: %s", failures.Raw)
+	}
+	var claimed *ClaimedKey
+	body.Get("one_time_keys." + GjsonEscape(userID) + "." + GjsonEscape(deviceID)).ForEach(func(keyID, key gjson.Result) bool {
+		if !strings.HasPrefix(keyID.Str, algorithm+":") {
+			return true
+		}
+		claimed = &ClaimedKey{
+			KeyID:    keyID.Str,
+			Key:      key,
+			Fallback: key.Get("fallback").Bool(),
+		}
+		return false
+	})
+	return claimed
+}
+
+// OneTimeKeyCounts returns `device_one_time_keys_count` of a /sync response.
+func OneTimeKeyCounts(topLevelSyncJSON gjson.Result) map[string]int {
+	counts := make(map[string]int)
+	topLevelSyncJSON.Get("device_one_time_keys_count").ForEach(func(algorithm, count gjson.Result) bool {
+		counts[algorithm.Str] = int(count.Int())
+		return true
+	})
+	return counts
+}
+
+// SyncOneTimeKeyCountIs passes when `device_one_time_keys_count` has `count` keys of the algorithm.
+// Servers may omit algorithms with no keys, which counts as 0.
+func SyncOneTimeKeyCountIs(algorithm string, count int) SyncCheckOpt {
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		if got := OneTimeKeyCounts(topLevelSyncJSON)[algorithm]; got != count {
+			return fmt.Errorf("SyncOneTimeKeyCountIs: got %d %s keys, want %d", got, algorithm, count)
+		}
+		return nil
+	}
+}
+
+// SyncUnusedFallbackKeyTypes passes when `device_unused_fallback_key_types` contains exactly the algorithms
+// given, in any order. Call with no algorithms to wait until the fallback key has been used.
+func SyncUnusedFallbackKeyTypes(algorithms ...string) SyncCheckOpt {
+	want := append([]string(nil), algorithms...)
+	sort.Strings(want)
+	return func(clientUserID string, topLevelSyncJSON gjson.Result) error {
+		field := topLevelSyncJSON.Get("device_unused_fallback_key_types")
+		if !field.Exists() {
+			return fmt.Errorf("SyncUnusedFallbackKeyTypes: device_unused_fallback_key_types missing")
+		}
+		var got []string
+		for _, algorithm := range field.Array() {
+			got = append(got, algorithm.Str)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			return fmt.Errorf("SyncUnusedFallbackKeyTypes: got %v, want %v", got, want)
+		}
+		return nil
+	}
+}
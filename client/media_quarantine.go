@@ -0,0 +1,62 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// DownloadMedia downloads media via the authenticated client media API. Returns the raw http response.
+// See the `match` package for matchers e.g for quarantined media.
+func (c *CSAPI) DownloadMedia(t ct.TestLike, mxcURI string) *http.Response {
+	t.Helper()
+	origin, mediaID := SplitMxc(mxcURI)
+	return c.Do(t, "GET", []string{"_matrix", "client", "v1", "media", "download", origin, mediaID})
+}
+
+// ThumbnailMedia requests a thumbnail of media via the authenticated client media API, where `method` is
+// "crop" or "scale". Returns the raw http response.
+func (c *CSAPI) ThumbnailMedia(t ct.TestLike, mxcURI string, width, height int, method string) *http.Response {
+	t.Helper()
+	origin, mediaID := SplitMxc(mxcURI)
+	return c.Do(t, "GET", []string{"_matrix", "client", "v1", "media", "thumbnail", origin, mediaID}, WithQueries(url.Values{
+		"width":  []string{strconv.Itoa(width)},
+		"height": []string{strconv.Itoa(height)},
+		"method": []string{method},
+	}))
+}
+
+// MustQuarantineMedia quarantines the media via the Synapse admin API, so it can no longer be downloaded.
+// This user must be a server admin. Skips the test if the homeserver does not support the API.
+//
+// See https://element-hq.github.io/synapse/latest/admin_api/media_admin_api.html#quarantine-media
+func (c *CSAPI) MustQuarantineMedia(t ct.TestLike, mxcURI string) {
+	t.Helper()
+	origin, mediaID := SplitMxc(mxcURI)
+	res := c.Do(t, "POST", []string{"_synapse", "admin", "v1", "media", "quarantine", origin, mediaID})
+	c.skipIfUnsupportedAdminAPI(t, "MustQuarantineMedia", res)
+	mustRespond2xx(t, res)
+}
+
+// MustUnquarantineMedia undoes MustQuarantineMedia.
+func (c *CSAPI) MustUnquarantineMedia(t ct.TestLike, mxcURI string) {
+	t.Helper()
+	origin, mediaID := SplitMxc(mxcURI)
+	res := c.Do(t, "POST", []string{"_synapse", "admin", "v1", "media", "unquarantine", origin, mediaID})
+	c.skipIfUnsupportedAdminAPI(t, "MustUnquarantineMedia", res)
+	mustRespond2xx(t, res)
+}
+
+// MustQuarantineMediaInRoom quarantines all media sent in the room via the Synapse admin API. Returns the
+// number of media quarantined.
+func (c *CSAPI) MustQuarantineMediaInRoom(t ct.TestLike, roomID string) int {
+	t.Helper()
+	res := c.Do(t, "POST", []string{"_synapse", "admin", "v1", "room", roomID, "media", "quarantine"})
+	c.skipIfUnsupportedAdminAPI(t, "MustQuarantineMediaInRoom", res)
+	mustRespond2xx(t, res)
+	return int(gjson.GetBytes(ParseJSON(t, res), "num_quarantined").Int())
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// UploadStreamOpts are options for UploadContentStream.
+type UploadStreamOpts struct {
+	FileName string
+	// Defaults to "application/octet-stream".
+	ContentType string
+	// The length of the body, which is sent as the Content-Length. If negative, the length is unknown so
+	// the body is sent with chunked transfer encoding.
+	Length int64
+	// The most bytes to read from the body at a time, which is the size of each chunk when using chunked
+	// transfer encoding. Defaults to 32KiB.
+	ChunkSize int
+}
+
+// UploadContentStream uploads media by streaming it from `body`, so large files do not need to be held
+// in memory e.g to test max upload size enforcement. Returns the raw http response. See NewSizedReader
+// for a reader of any size.
+func (c *CSAPI) UploadContentStream(t ct.TestLike, body io.Reader, opts UploadStreamOpts) *http.Response {
+	t.Helper()
+	query := url.Values{}
+	if opts.FileName != "" {
+		query.Set("filename", opts.FileName)
+	}
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 32 * 1024
+	}
+	return c.Do(
+		t, "POST", []string{"_matrix", "media", "v3", "upload"},
+		WithReaderBody(&chunkedReader{r: body, chunkSize: chunkSize}, opts.Length), WithContentType(contentType), WithQueries(query),
+	)
+}
+
+// MustUploadContentStream is UploadContentStream, failing the test unless the upload succeeds. Returns
+// the MXC URI.
+func (c *CSAPI) MustUploadContentStream(t ct.TestLike, body io.Reader, opts UploadStreamOpts) string {
+	t.Helper()
+	res := c.UploadContentStream(t, body, opts)
+	mustRespond2xx(t, res)
+	return GetJSONFieldStr(t, ParseJSON(t, res), "content_uri")
+}
+
+// MustGetMaxUploadSize returns the largest upload the homeserver allows in bytes, as advertised by
+// the media config endpoint, or -1 if it does not advertise a limit.
+func (c *CSAPI) MustGetMaxUploadSize(t ct.TestLike) int64 {
+	t.Helper()
+	res := c.Do(t, "GET", []string{"_matrix", "client", "v1", "media", "config"})
+	if isUnrecognisedEndpoint(res) {
+		res.Body.Close()
+		res = c.Do(t, "GET", []string{"_matrix", "media", "v3", "config"})
+	}
+	mustRespond2xx(t, res)
+	size := gjson.GetBytes(ParseJSON(t, res), "m\\.upload\\.size")
+	if !size.Exists() {
+		return -1
+	}
+	return size.Int()
+}
+
+// NewSizedReader returns a reader of `size` bytes of `fill`, without allocating them.
+func NewSizedReader(size int64, fill byte) io.Reader {
+	return io.LimitReader(fillReader(fill), size)
+}
+
+type fillReader byte
+
+func (f fillReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(f)
+	}
+	return len(p), nil
+}
+
+// chunkedReader reads at most chunkSize bytes at a time.
+type chunkedReader struct {
+	r         io.Reader
+	chunkSize int
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if len(p) > c.chunkSize {
+		p = p[:c.chunkSize]
+	}
+	return c.r.Read(p)
+}
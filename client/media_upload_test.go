@@ -0,0 +1,44 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUploadContentStream(t *testing.T) {
+	type upload struct {
+		contentLength    int64
+		transferEncoding []string
+		body             []byte
+	}
+	uploads := make(chan upload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		uploads <- upload{contentLength: req.ContentLength, transferEncoding: req.TransferEncoding, body: body}
+		w.Write([]byte(`{"content_uri":"mxc://hs1/abc"}`))
+	}))
+	defer srv.Close()
+	c := NewCSAPI(CSAPIOpts{
+		BaseURL: srv.URL,
+		Client:  srv.Client(),
+	})
+	want := bytes.Repeat([]byte{'x'}, 100*1024)
+
+	mxc := c.MustUploadContentStream(t, NewSizedReader(int64(len(want)), 'x'), UploadStreamOpts{Length: int64(len(want))})
+	if mxc != "mxc://hs1/abc" {
+		t.Errorf("MustUploadContentStream: got %s", mxc)
+	}
+	got := <-uploads
+	if got.contentLength != int64(len(want)) || len(got.transferEncoding) > 0 || !bytes.Equal(got.body, want) {
+		t.Errorf("known length: got Content-Length %d, Transfer-Encoding %v, %d bytes", got.contentLength, got.transferEncoding, len(got.body))
+	}
+
+	c.MustUploadContentStream(t, NewSizedReader(int64(len(want)), 'x'), UploadStreamOpts{Length: -1, ChunkSize: 1000})
+	got = <-uploads
+	if got.contentLength != -1 || len(got.transferEncoding) != 1 || got.transferEncoding[0] != "chunked" || !bytes.Equal(got.body, want) {
+		t.Errorf("unknown length: got Content-Length %d, Transfer-Encoding %v, %d bytes", got.contentLength, got.transferEncoding, len(got.body))
+	}
+}
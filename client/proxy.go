@@ -0,0 +1,239 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrProxyDisconnect is returned for requests whose connection was dropped by a Proxy.
+var ErrProxyDisconnect = errors.New("complement proxy: connection dropped")
+
+// RequestMatcher decides whether a request should be affected by a Proxy fault.
+type RequestMatcher func(req *http.Request) bool
+
+// MatchAll matches every request.
+func MatchAll() RequestMatcher {
+	return func(req *http.Request) bool {
+		return true
+	}
+}
+
+// MatchPathPrefix matches requests whose (unescaped) path starts with `prefix` e.g "/_matrix/client/v3/sync".
+func MatchPathPrefix(prefix string) RequestMatcher {
+	return func(req *http.Request) bool {
+		return strings.HasPrefix(req.URL.Path, prefix)
+	}
+}
+
+// ProxyRequest is a request which went through a Proxy.
+type ProxyRequest struct {
+	Method string
+	Path   string
+	// The status code returned by the server, or 0 if no response was received.
+	StatusCode int
+	// The name of the fault which was injected, if any.
+	Fault string
+}
+
+type proxyFault struct {
+	name      string
+	match     RequestMatcher
+	remaining int // <= 0 means always
+	apply     func(p *Proxy, req *http.Request) (*http.Response, error)
+}
+
+// Proxy sits between a client and the homeserver, recording all requests and optionally injecting
+// faults such as delays and dropped connections, to test how the homeserver copes with unreliable
+// clients. Create one with CSAPI.UseProxy.
+type Proxy struct {
+	next http.RoundTripper
+
+	mu       sync.Mutex
+	faults   []*proxyFault
+	requests []ProxyRequest
+}
+
+// UseProxy routes all further requests from this client through a new Proxy, which is returned.
+// Other clients are not affected.
+func (c *CSAPI) UseProxy() *Proxy {
+	cli := &http.Client{}
+	if c.Client != nil {
+		*cli = *c.Client
+	}
+	next := cli.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	p := &Proxy{
+		next: next,
+	}
+	cli.Transport = p
+	c.Client = cli
+	return p
+}
+
+// Requests returns all requests which have gone through the proxy so far.
+func (p *Proxy) Requests() []ProxyRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]ProxyRequest(nil), p.requests...)
+}
+
+// DelayResponses waits for `delay` before sending matching requests to the server.
+// Returns a function which removes the fault.
+func (p *Proxy) DelayResponses(match RequestMatcher, delay time.Duration) (remove func()) {
+	return p.addFault(&proxyFault{
+		name:  fmt.Sprintf("delay %v", delay),
+		match: match,
+		apply: func(p *Proxy, req *http.Request) (*http.Response, error) {
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+			return p.next.RoundTrip(req)
+		},
+	})
+}
+
+// DisconnectBeforeResponse sends the next `times` matching requests to the server, waits for the
+// response, then drops the connection without returning it to the client. The server will have
+// processed the request but the client will see ErrProxyDisconnect, as if the network failed.
+// Use `times` <= 0 to affect all matching requests. Returns a function which removes the fault.
+func (p *Proxy) DisconnectBeforeResponse(match RequestMatcher, times int) (remove func()) {
+	return p.addFault(&proxyFault{
+		name:      "disconnect before response",
+		match:     match,
+		remaining: times,
+		apply: func(p *Proxy, req *http.Request) (*http.Response, error) {
+			res, err := p.next.RoundTrip(req)
+			if err != nil {
+				return nil, err
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			return nil, ErrProxyDisconnect
+		},
+	})
+}
+
+// DisconnectDuringRequestBody sends only the first `afterBytes` of the request body of the next `times`
+// matching requests to the server, then drops the connection. Use `times` <= 0 to affect all matching
+// requests. Returns a function which removes the fault.
+func (p *Proxy) DisconnectDuringRequestBody(match RequestMatcher, afterBytes int64, times int) (remove func()) {
+	return p.addFault(&proxyFault{
+		name:      fmt.Sprintf("disconnect after %d request bytes", afterBytes),
+		match:     match,
+		remaining: times,
+		apply: func(p *Proxy, req *http.Request) (*http.Response, error) {
+			if req.Body != nil {
+				req = req.Clone(req.Context())
+				req.Body = &disconnectingReader{r: req.Body, remaining: afterBytes}
+			}
+			return p.next.RoundTrip(req)
+		},
+	})
+}
+
+// DisconnectDuringResponseBody returns only the first `afterBytes` of the response body of the next
+// `times` matching requests to the client, then fails with ErrProxyDisconnect. Use `times` <= 0 to
+// affect all matching requests. Returns a function which removes the fault.
+func (p *Proxy) DisconnectDuringResponseBody(match RequestMatcher, afterBytes int64, times int) (remove func()) {
+	return p.addFault(&proxyFault{
+		name:      fmt.Sprintf("disconnect after %d response bytes", afterBytes),
+		match:     match,
+		remaining: times,
+		apply: func(p *Proxy, req *http.Request) (*http.Response, error) {
+			res, err := p.next.RoundTrip(req)
+			if err != nil {
+				return nil, err
+			}
+			res.Body = &disconnectingReader{r: res.Body, remaining: afterBytes}
+			return res, nil
+		},
+	})
+}
+
+func (p *Proxy) addFault(f *proxyFault) (remove func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults = append(p.faults, f)
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for i := range p.faults {
+			if p.faults[i] == f {
+				p.faults = append(p.faults[:i], p.faults[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (p *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	// find the first fault which applies to this request
+	var fault *proxyFault
+	p.mu.Lock()
+	for i, f := range p.faults {
+		if !f.match(req) {
+			continue
+		}
+		fault = f
+		if f.remaining > 0 {
+			f.remaining--
+			if f.remaining == 0 {
+				p.faults = append(p.faults[:i], p.faults[i+1:]...)
+			}
+		}
+		break
+	}
+	p.mu.Unlock()
+
+	var res *http.Response
+	var err error
+	record := ProxyRequest{
+		Method: req.Method,
+		Path:   req.URL.Path,
+	}
+	if fault != nil {
+		record.Fault = fault.name
+		res, err = fault.apply(p, req)
+	} else {
+		res, err = p.next.RoundTrip(req)
+	}
+	if res != nil {
+		record.StatusCode = res.StatusCode
+	}
+	p.mu.Lock()
+	p.requests = append(p.requests, record)
+	p.mu.Unlock()
+	return res, err
+}
+
+// disconnectingReader returns ErrProxyDisconnect after reading `remaining` bytes.
+type disconnectingReader struct {
+	r         io.ReadCloser
+	remaining int64
+}
+
+func (d *disconnectingReader) Read(b []byte) (int, error) {
+	if d.remaining <= 0 {
+		return 0, ErrProxyDisconnect
+	}
+	if int64(len(b)) > d.remaining {
+		b = b[:d.remaining]
+	}
+	n, err := d.r.Read(b)
+	d.remaining -= int64(n)
+	return n, err
+}
+
+func (d *disconnectingReader) Close() error {
+	return d.r.Close()
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyFaults(t *testing.T) {
+	var served atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if _, err := io.ReadAll(req.Body); err != nil {
+			return
+		}
+		served.Add(1)
+		w.Write([]byte(`{"hello":"world"}`))
+	}))
+	defer srv.Close()
+	c := NewCSAPI(CSAPIOpts{
+		BaseURL: srv.URL,
+		Client:  srv.Client(),
+	})
+	proxy := c.UseProxy()
+	other := NewCSAPI(CSAPIOpts{
+		BaseURL: srv.URL,
+		Client:  srv.Client(),
+	})
+	if _, err := other.TryDo(t, "GET", []string{"other"}); err != nil {
+		t.Fatalf("other client failed: %s", err)
+	}
+
+	// the request is processed by the server, but the client sees an error
+	proxy.DisconnectBeforeResponse(MatchPathPrefix("/send"), 1)
+	_, err := c.TryDo(t, "PUT", []string{"send", "1"}, WithRawBody([]byte(`{}`)))
+	if !errors.Is(err, ErrProxyDisconnect) {
+		t.Fatalf("DisconnectBeforeResponse: got error %v want ErrProxyDisconnect", err)
+	}
+	if served.Load() != 2 {
+		t.Fatalf("DisconnectBeforeResponse: server handled %d requests, want 2", served.Load())
+	}
+	// the fault only applied once
+	c.MustDo(t, "PUT", []string{"send", "1"}, WithRawBody([]byte(`{}`)))
+
+	// the server never sees the whole request
+	proxy.DisconnectDuringRequestBody(MatchAll(), 2, 1)
+	if _, err = c.TryDo(t, "PUT", []string{"upload"}, WithRawBody([]byte(`{"big":"body"}`))); err == nil {
+		t.Fatalf("DisconnectDuringRequestBody: request succeeded")
+	}
+	if served.Load() != 3 {
+		t.Fatalf("DisconnectDuringRequestBody: server handled %d requests, want 3", served.Load())
+	}
+
+	proxy.DisconnectDuringResponseBody(MatchAll(), 5, 1)
+	if _, err = c.TryDo(t, "GET", []string{"download"}); !errors.Is(err, ErrProxyDisconnect) {
+		t.Fatalf("DisconnectDuringResponseBody: got error %v want ErrProxyDisconnect", err)
+	}
+
+	remove := proxy.DelayResponses(MatchAll(), 200*time.Millisecond)
+	start := time.Now()
+	c.MustDo(t, "GET", []string{"slow"})
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("DelayResponses: response returned after %v", time.Since(start))
+	}
+	remove()
+
+	requests := proxy.Requests()
+	// requests from the other client are not recorded
+	if len(requests) != 5 {
+		t.Fatalf("got %d recorded requests, want 5: %+v", len(requests), requests)
+	}
+	if requests[0].Fault == "" || requests[0].StatusCode != 0 {
+		t.Fatalf("first request was not recorded with its fault: %+v", requests[0])
+	}
+	if requests[1].Fault != "" || requests[1].StatusCode != 200 {
+		t.Fatalf("second request was not recorded without a fault: %+v", requests[1])
+	}
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// SetRateLimitOverride overrides the rate limits of `userID` to allow `messagesPerSecond` with bursts of
+// `burstCount`, via the Synapse admin API. Zero for both disables rate limiting for the user. The client
+// must be a server admin. Skips the test if the homeserver does not support the admin API.
+// See https://element-hq.github.io/synapse/latest/admin_api/user_admin_api.html#set-ratelimit
+func (c *CSAPI) SetRateLimitOverride(t ct.TestLike, userID string, messagesPerSecond, burstCount int) {
+	t.Helper()
+	res := c.Do(t, "POST", []string{"_synapse", "admin", "v1", "users", userID, "override_ratelimit"}, WithJSONBody(t, map[string]interface{}{
+		"messages_per_second": messagesPerSecond,
+		"burst_count":         burstCount,
+	}))
+	c.checkRateLimitOverrideResponse(t, "SetRateLimitOverride", userID, res)
+}
+
+// MustDisableRateLimiting disables rate limiting for `userID`. See SetRateLimitOverride.
+func (c *CSAPI) MustDisableRateLimiting(t ct.TestLike, userID string) {
+	t.Helper()
+	c.SetRateLimitOverride(t, userID, 0, 0)
+}
+
+// MustEnableRateLimiting removes any rate limit override for `userID`, so the homeserver's configured rate
+// limits apply again. The client must be a server admin. Skips the test if the homeserver does not support
+// the admin API.
+func (c *CSAPI) MustEnableRateLimiting(t ct.TestLike, userID string) {
+	t.Helper()
+	res := c.Do(t, "DELETE", []string{"_synapse", "admin", "v1", "users", userID, "override_ratelimit"})
+	c.checkRateLimitOverrideResponse(t, "MustEnableRateLimiting", userID, res)
+}
+
+func (c *CSAPI) checkRateLimitOverrideResponse(t ct.TestLike, caller, userID string, res *http.Response) {
+	t.Helper()
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404, 405:
+		t.Skipf("%s: homeserver does not support rate limit overrides, got HTTP %d", caller, res.StatusCode)
+	default:
+		body, _ := io.ReadAll(res.Body)
+		ct.Fatalf(t, "%s: failed to override rate limits for %s: HTTP %d %s", caller, userID, res.StatusCode, string(body))
+	}
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// ReportEvent reports the event `eventID` in the room to the homeserver administrators. `score` is
+// optional, and ranges from -100 (most offensive) to 0 (inoffensive). Returns the raw http response.
+func (c *CSAPI) ReportEvent(t ct.TestLike, roomID, eventID, reason string, score *int) *http.Response {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"reason": reason,
+	}
+	if score != nil {
+		reqBody["score"] = *score
+	}
+	return c.Do(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "report", eventID}, WithJSONBody(t, reqBody))
+}
+
+// MustReportEvent is the same as ReportEvent but fails the test if the response is not 2xx.
+func (c *CSAPI) MustReportEvent(t ct.TestLike, roomID, eventID, reason string, score *int) {
+	t.Helper()
+	mustRespond2xx(t, c.ReportEvent(t, roomID, eventID, reason, score))
+}
+
+// ReportRoom reports the room to the homeserver administrators. Returns the raw http response.
+func (c *CSAPI) ReportRoom(t ct.TestLike, roomID, reason string) *http.Response {
+	t.Helper()
+	return c.Do(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, "report"}, WithJSONBody(t, map[string]interface{}{
+		"reason": reason,
+	}))
+}
+
+// MustReportRoom is the same as ReportRoom but fails the test if the response is not 2xx.
+func (c *CSAPI) MustReportRoom(t ct.TestLike, roomID, reason string) {
+	t.Helper()
+	mustRespond2xx(t, c.ReportRoom(t, roomID, reason))
+}
+
+// MustGetEventReports returns the event reports visible to this user, who must be a server admin,
+// via the Synapse admin API. Reports are filtered to the room if `roomID` is set. Skips the test if
+// the homeserver does not support the API. See the `match` package for report matchers.
+func (c *CSAPI) MustGetEventReports(t ct.TestLike, roomID string) gjson.Result {
+	t.Helper()
+	query := url.Values{}
+	if roomID != "" {
+		query.Set("room_id", roomID)
+	}
+	res := c.Do(t, "GET", []string{"_synapse", "admin", "v1", "event_reports"}, WithQueries(query))
+	if res.StatusCode == 404 {
+		t.Skipf("Homeserver image does not support listing event reports, /_synapse/admin/v1/event_reports returned HTTP %d", res.StatusCode)
+	}
+	mustRespond2xx(t, res)
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
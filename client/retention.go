@@ -0,0 +1,88 @@
+package client
+
+import (
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/ct"
+)
+
+// RetentionPolicy is the content of an `m.room.retention` state event, as proposed in MSC1763. Zero
+// lifetimes are not set.
+type RetentionPolicy struct {
+	MinLifetime time.Duration
+	MaxLifetime time.Duration
+}
+
+// MustSetRetentionPolicy sets the message retention policy of the room, and waits for it to come down
+// /sync. Returns the event ID of the `m.room.retention` event. Homeservers may clamp the lifetimes to
+// their configured limits, or ignore the policy entirely if they do not enforce retention.
+func (c *CSAPI) MustSetRetentionPolicy(t ct.TestLike, roomID string, policy RetentionPolicy) string {
+	t.Helper()
+	content := map[string]interface{}{}
+	if policy.MinLifetime != 0 {
+		content["min_lifetime"] = policy.MinLifetime.Milliseconds()
+	}
+	if policy.MaxLifetime != 0 {
+		content["max_lifetime"] = policy.MaxLifetime.Milliseconds()
+	}
+	return c.SendEventSynced(t, roomID, b.Event{
+		Type:     "m.room.retention",
+		StateKey: b.Ptr(""),
+		Content:  content,
+	})
+}
+
+// MustEventuallyExpire pages back through the whole room with /messages until none of `eventIDs` are
+// returned, e.g because the room's retention policy has expired them. As homeservers purge expired events
+// periodically, this retries until `timeout`, then fails the test with the events which are still
+// visible.
+func (c *CSAPI) MustEventuallyExpire(t ct.TestLike, roomID string, eventIDs []string, timeout time.Duration) {
+	t.Helper()
+	start := time.Now()
+	for {
+		visible := c.visibleEvents(t, roomID, eventIDs)
+		if len(visible) == 0 {
+			return
+		}
+		if time.Since(start) > timeout {
+			ct.Fatalf(t, "%s MustEventuallyExpire: events %v in %s are still visible after %v", c.UserID, visible, roomID, time.Since(start))
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// visibleEvents returns which of `eventIDs` are returned by /messages, sorted.
+func (c *CSAPI) visibleEvents(t ct.TestLike, roomID string, eventIDs []string) []string {
+	t.Helper()
+	want := make(map[string]bool, len(eventIDs))
+	for _, eventID := range eventIDs {
+		want[eventID] = true
+	}
+	var visible []string
+	query := url.Values{
+		"dir":   []string{"b"},
+		"limit": []string{"100"},
+	}
+	for {
+		res := c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "messages"}, WithQueries(query))
+		body := gjson.ParseBytes(ParseJSON(t, res))
+		chunk := body.Get("chunk").Array()
+		for _, ev := range chunk {
+			if want[ev.Get("event_id").Str] {
+				visible = append(visible, ev.Get("event_id").Str)
+			}
+		}
+		end := body.Get("end").Str
+		if len(chunk) == 0 || end == "" {
+			break
+		}
+		query.Set("from", end)
+	}
+	sort.Strings(visible)
+	return visible
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// These helpers use the Synapse admin API, so this user must be a server admin. They skip the test if the
+// homeserver does not support the API.
+// See https://element-hq.github.io/synapse/latest/admin_api/purge_history_api.html and
+// https://element-hq.github.io/synapse/latest/admin_api/rooms.html
+
+// MustPurgeHistory purges the history of the room before `upToEventID`, and waits for the purge to
+// complete. Events sent by local users are only purged if `deleteLocalEvents` is true. State events are
+// never purged.
+func (c *CSAPI) MustPurgeHistory(t ct.TestLike, roomID, upToEventID string, deleteLocalEvents bool) {
+	t.Helper()
+	res := c.Do(t, "POST", []string{"_synapse", "admin", "v1", "purge_history", roomID}, WithJSONBody(t, map[string]interface{}{
+		"delete_local_events":  deleteLocalEvents,
+		"purge_up_to_event_id": upToEventID,
+	}))
+	c.skipIfUnsupportedAdminAPI(t, "MustPurgeHistory", res)
+	mustRespond2xx(t, res)
+	purgeID := GetJSONFieldStr(t, ParseJSON(t, res), "purge_id")
+	c.awaitAdminTask(t, "MustPurgeHistory", []string{"_synapse", "admin", "v1", "purge_history_status", purgeID}, nil)
+}
+
+// MustBlockRoom blocks or unblocks the room, so local users cannot join it.
+func (c *CSAPI) MustBlockRoom(t ct.TestLike, roomID string, block bool) {
+	t.Helper()
+	res := c.Do(t, "PUT", []string{"_synapse", "admin", "v1", "rooms", roomID, "block"}, WithJSONBody(t, map[string]interface{}{
+		"block": block,
+	}))
+	c.skipIfUnsupportedAdminAPI(t, "MustBlockRoom", res)
+	mustRespond2xx(t, res)
+}
+
+// MustGetRoomBlocked returns true if the room is blocked.
+func (c *CSAPI) MustGetRoomBlocked(t ct.TestLike, roomID string) bool {
+	t.Helper()
+	res := c.Do(t, "GET", []string{"_synapse", "admin", "v1", "rooms", roomID, "block"})
+	c.skipIfUnsupportedAdminAPI(t, "MustGetRoomBlocked", res)
+	mustRespond2xx(t, res)
+	return gjson.GetBytes(ParseJSON(t, res), "block").Bool()
+}
+
+// ShutdownRoomOpts are options for MustShutdownRoom.
+type ShutdownRoomOpts struct {
+	// Block the room, so local users cannot join it again.
+	Block bool
+	// Purge the room from the database once every local user has left.
+	Purge bool
+	// If set, local users are moved to a new room created by this user, with `Message` sent in it.
+	NewRoomUserID string
+	Message       string
+}
+
+// MustShutdownRoom makes every local user leave the room, and waits for the shutdown to complete. Returns
+// the result of the shutdown, which lists e.g the `kicked_users` and the `new_room_id`.
+func (c *CSAPI) MustShutdownRoom(t ct.TestLike, roomID string, opts ShutdownRoomOpts) gjson.Result {
+	t.Helper()
+	reqBody := map[string]interface{}{
+		"block": opts.Block,
+		"purge": opts.Purge,
+	}
+	if opts.NewRoomUserID != "" {
+		reqBody["new_room_user_id"] = opts.NewRoomUserID
+	}
+	if opts.Message != "" {
+		reqBody["message"] = opts.Message
+	}
+	res := c.Do(t, "DELETE", []string{"_synapse", "admin", "v2", "rooms", roomID}, WithJSONBody(t, reqBody))
+	c.skipIfUnsupportedAdminAPI(t, "MustShutdownRoom", res)
+	mustRespond2xx(t, res)
+	deleteID := GetJSONFieldStr(t, ParseJSON(t, res), "delete_id")
+	var shutdown gjson.Result
+	c.awaitAdminTask(t, "MustShutdownRoom", []string{"_synapse", "admin", "v2", "rooms", "delete_status", deleteID}, func(status gjson.Result) {
+		shutdown = status.Get("shutdown_room")
+	})
+	return shutdown
+}
+
+// MustNotFindEvents asserts that none of the events in the room can be fetched by this user, whether
+// directly, via /context or via /messages, e.g after they have been purged. The user must still be able to
+// read the room.
+func (c *CSAPI) MustNotFindEvents(t ct.TestLike, roomID string, eventIDs []string) {
+	t.Helper()
+	var found []string
+	for _, eventID := range eventIDs {
+		res := c.Do(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", eventID})
+		res.Body.Close()
+		if res.StatusCode == 200 {
+			found = append(found, eventID+" (via /event)")
+		}
+		res = c.Do(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "context", eventID})
+		res.Body.Close()
+		if res.StatusCode == 200 {
+			found = append(found, eventID+" (via /context)")
+		}
+	}
+	for _, eventID := range c.visibleEvents(t, roomID, eventIDs) {
+		found = append(found, eventID+" (via /messages)")
+	}
+	if len(found) > 0 {
+		sort.Strings(found)
+		ct.Fatalf(t, "%s MustNotFindEvents: found events in %s: %v", c.UserID, roomID, found)
+	}
+}
+
+// awaitAdminTask polls the status of a background admin task until it is complete, failing the test if
+// it fails or does not complete within CSAPI.SyncUntilTimeout. `onComplete` is called with the final
+// status, if set.
+func (c *CSAPI) awaitAdminTask(t ct.TestLike, caller string, statusPath []string, onComplete func(status gjson.Result)) {
+	t.Helper()
+	start := time.Now()
+	for {
+		status := gjson.ParseBytes(ParseJSON(t, c.MustDo(t, "GET", statusPath)))
+		switch status.Get("status").Str {
+		case "complete":
+			if onComplete != nil {
+				onComplete(status)
+			}
+			return
+		case "failed":
+			ct.Fatalf(t, "%s: admin task failed: %s", caller, status.Raw)
+		}
+		if time.Since(start) > c.SyncUntilTimeout {
+			ct.Fatalf(t, "%s: timed out after %v waiting for admin task to complete, last status: %s", caller, time.Since(start), status.Raw)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (c *CSAPI) skipIfUnsupportedAdminAPI(t ct.TestLike, caller string, res *http.Response) {
+	t.Helper()
+	if isUnrecognisedEndpoint(res) {
+		t.Skipf("%s: homeserver does not support the Synapse admin API, got HTTP %d", caller, res.StatusCode)
+	}
+}
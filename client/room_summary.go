@@ -0,0 +1,75 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// roomSummaryPaths are the room summary endpoints from MSC3266, in order of preference.
+// Homeservers which have not stabilised the endpoint yet only support the unstable paths.
+var roomSummaryPaths = []func(roomIDOrAlias string) []string{
+	func(roomIDOrAlias string) []string {
+		return []string{"_matrix", "client", "v1", "room_summary", roomIDOrAlias}
+	},
+	func(roomIDOrAlias string) []string {
+		return []string{"_matrix", "client", "unstable", "im.nheko.summary", "summary", roomIDOrAlias}
+	},
+	func(roomIDOrAlias string) []string {
+		return []string{"_matrix", "client", "unstable", "im.nheko.summary", "rooms", roomIDOrAlias, "summary"}
+	},
+}
+
+// GetRoomSummary requests the MSC3266 summary of the room ID or alias given, which need not be
+// joined. Falls back to the unstable endpoints if the homeserver does not recognise the stable one.
+// Returns the raw http response.
+//
+// Args:
+//   - `via`: The list of servers to ask for the summary if the homeserver is not in the room.
+//     These should be a resolvable addresses within the deployment network.
+func (c *CSAPI) GetRoomSummary(t ct.TestLike, roomIDOrAlias string, via []spec.ServerName) *http.Response {
+	t.Helper()
+	viaStrings := make([]string, len(via))
+	for i, serverName := range via {
+		viaStrings[i] = string(serverName)
+	}
+	query := url.Values{
+		"via": viaStrings,
+	}
+	var res *http.Response
+	for _, path := range roomSummaryPaths {
+		res = c.Do(t, "GET", path(roomIDOrAlias), WithQueries(query))
+		if !isUnrecognisedEndpoint(res) {
+			return res
+		}
+	}
+	return res
+}
+
+// MustGetRoomSummary is the same as GetRoomSummary but fails the test if the response is not 2xx.
+// Returns the summary. See the `match` package for room summary matchers.
+func (c *CSAPI) MustGetRoomSummary(t ct.TestLike, roomIDOrAlias string, via []spec.ServerName) gjson.Result {
+	t.Helper()
+	res := c.GetRoomSummary(t, roomIDOrAlias, via)
+	mustRespond2xx(t, res)
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// isUnrecognisedEndpoint returns true if the response indicates the homeserver does not support the
+// endpoint, as opposed to e.g the room not being found.
+func isUnrecognisedEndpoint(res *http.Response) bool {
+	if res.StatusCode != 404 && res.StatusCode != 405 && res.StatusCode != 400 {
+		return false
+	}
+	body, _ := io.ReadAll(res.Body)
+	// put the body back so callers can still read the response
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	errcode := gjson.GetBytes(body, "errcode").Str
+	return errcode == "" || errcode == "M_UNRECOGNIZED"
+}
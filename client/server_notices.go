@@ -0,0 +1,110 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// ServerNoticeTag is the room tag of a user's server notices room.
+const ServerNoticeTag = "m.server_notice"
+
+// SendServerNotice sends a server notice with the given `m.room.message` content to `userID` via the
+// Synapse admin API. This user must be a server admin. If `txnID` is set, the request is idempotent for
+// that transaction ID. Returns the raw http response.
+//
+// See https://element-hq.github.io/synapse/latest/admin_api/server_notices.html
+func (c *CSAPI) SendServerNotice(t ct.TestLike, userID string, content map[string]interface{}, txnID string) *http.Response {
+	t.Helper()
+	reqBody := WithJSONBody(t, map[string]interface{}{
+		"user_id": userID,
+		"content": content,
+	})
+	if txnID != "" {
+		return c.Do(t, "PUT", []string{"_synapse", "admin", "v1", "send_server_notice", txnID}, reqBody)
+	}
+	return c.Do(t, "POST", []string{"_synapse", "admin", "v1", "send_server_notice"}, reqBody)
+}
+
+// MustSendServerNotice is the same as SendServerNotice but fails the test if the response is not 2xx.
+// Returns the event ID of the notice. Skips the test if the homeserver does not support sending server
+// notices, or does not have server notices enabled.
+func (c *CSAPI) MustSendServerNotice(t ct.TestLike, userID string, content map[string]interface{}, txnID string) string {
+	t.Helper()
+	res := c.SendServerNotice(t, userID, content, txnID)
+	if isUnrecognisedEndpoint(res) {
+		t.Skipf("MustSendServerNotice: homeserver does not support sending server notices, got HTTP %d", res.StatusCode)
+	}
+	if res.StatusCode == 400 {
+		body, _ := io.ReadAll(res.Body)
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		if strings.Contains(gjson.GetBytes(body, "error").Str, "not enabled") {
+			t.Skipf("MustSendServerNotice: server notices are not enabled on the homeserver: %s", string(body))
+		}
+	}
+	mustRespond2xx(t, res)
+	return GetJSONFieldStr(t, ParseJSON(t, res), "event_id")
+}
+
+// MustJoinServerNoticesRoom waits for the server notices room of this user, which is the room tagged
+// with ServerNoticeTag, joining it if the user is only invited. Returns the room ID. Fails the test if
+// the room does not appear within CSAPI.SyncUntilTimeout.
+func (c *CSAPI) MustJoinServerNoticesRoom(t ct.TestLike) string {
+	t.Helper()
+	start := time.Now()
+	checkedInvites := make(map[string]bool)
+	since := ""
+	for {
+		res, nextBatch := c.MustSync(t, SyncReq{Since: since, TimeoutMillis: "1000"})
+		since = nextBatch
+		var roomID string
+		// homeservers may join users to the room automatically
+		res.Get("rooms.join").ForEach(func(joinedRoomID, room gjson.Result) bool {
+			room.Get("account_data.events").ForEach(func(_, ev gjson.Result) bool {
+				if ev.Get("type").Str == "m.tag" && ev.Get("content.tags."+GjsonEscape(ServerNoticeTag)).Exists() {
+					roomID = joinedRoomID.Str
+				}
+				return roomID == ""
+			})
+			return roomID == ""
+		})
+		if roomID != "" {
+			return roomID
+		}
+		// the room is tagged when the user is invited, but tags are only sent down /sync for joined rooms
+		res.Get("rooms.invite").ForEach(func(invitedRoomID, _ gjson.Result) bool {
+			if checkedInvites[invitedRoomID.Str] {
+				return true
+			}
+			checkedInvites[invitedRoomID.Str] = true
+			if c.roomHasTag(t, invitedRoomID.Str, ServerNoticeTag) {
+				roomID = invitedRoomID.Str
+			}
+			return roomID == ""
+		})
+		if roomID != "" {
+			c.MustJoinRoom(t, roomID, nil)
+			return roomID
+		}
+		if time.Since(start) > c.SyncUntilTimeout {
+			ct.Fatalf(t, "%s MustJoinServerNoticesRoom: timed out after %v waiting for a room tagged %s", c.UserID, time.Since(start), ServerNoticeTag)
+		}
+	}
+}
+
+// roomHasTag returns true if this user has tagged the room with `tag`.
+func (c *CSAPI) roomHasTag(t ct.TestLike, roomID, tag string) bool {
+	t.Helper()
+	res := c.Do(t, "GET", []string{"_matrix", "client", "v3", "user", c.UserID, "rooms", roomID, "tags"})
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return false
+	}
+	return gjson.GetBytes(ParseJSON(t, res), "tags."+GjsonEscape(tag)).Exists()
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// RedirectHop is a single response in a chain of redirects.
+type RedirectHop struct {
+	// The URL which was requested.
+	URL *url.URL
+	// The status code of the response.
+	StatusCode int
+	// The Location of the response, or nil if the response was not a redirect.
+	Location *url.URL
+	// The Set-Cookie headers of the response, as SSO flows often track the session in a cookie.
+	Cookies []*http.Cookie
+}
+
+// maxRedirectHops is the most redirects followed by SSORedirectChain, to catch redirect loops.
+const maxRedirectHops = 10
+
+// SSORedirectChain requests /login/sso/redirect (or /login/sso/redirect/{idpID} if `idpID` is set)
+// with the `redirectURL` and follows the chain of redirects without a browser, returning each hop in
+// order. The chain stops at the first response which is not a redirect, or when a redirect points
+// back to `redirectURL`, which is not requested as it belongs to the client. Redirects to servers
+// which are unreachable from Complement, e.g an identity provider which is not running, also stop the
+// chain, with the final hop's Location set. Cookies set along the way are sent on later hops.
+func (c *CSAPI) SSORedirectChain(t ct.TestLike, idpID, redirectURL string) []RedirectHop {
+	t.Helper()
+	paths := []string{"_matrix", "client", "v3", "login", "sso", "redirect"}
+	if idpID != "" {
+		paths = append(paths, idpID)
+	}
+	escapedPaths := make([]string, len(paths))
+	for i := range paths {
+		escapedPaths[i] = url.PathEscape(paths[i])
+	}
+	next, err := url.Parse(c.BaseURL + "/" + strings.Join(escapedPaths, "/") + "?" + url.Values{
+		"redirectUrl": {redirectURL},
+	}.Encode())
+	if err != nil {
+		ct.Fatalf(t, "SSORedirectChain: failed to make URL: %s", err)
+	}
+	httpClient := c.noRedirectClient()
+	var hops []RedirectHop
+	for len(hops) < maxRedirectHops {
+		req, err := http.NewRequest("GET", next.String(), nil)
+		if err != nil {
+			ct.Fatalf(t, "SSORedirectChain: failed to create request: %s", err)
+		}
+		for _, hop := range hops {
+			for _, cookie := range hop.Cookies {
+				req.AddCookie(cookie)
+			}
+		}
+		res, err := httpClient.Do(req)
+		if err != nil {
+			if len(hops) > 0 {
+				t.Logf("SSORedirectChain: stopping at unreachable %s: %s", next, err)
+				return hops
+			}
+			ct.Fatalf(t, "SSORedirectChain: GET %s failed: %s", next, err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		hop := RedirectHop{
+			URL:        next,
+			StatusCode: res.StatusCode,
+			Cookies:    res.Cookies(),
+		}
+		if res.StatusCode >= 300 && res.StatusCode < 400 {
+			hop.Location, err = res.Location()
+			if err != nil {
+				ct.Fatalf(t, "SSORedirectChain: %d response from %s has an invalid Location: %s", res.StatusCode, next, err)
+			}
+		}
+		hops = append(hops, hop)
+		if hop.Location == nil || strings.HasPrefix(hop.Location.String(), redirectURL) {
+			return hops
+		}
+		next = hop.Location
+	}
+	ct.Fatalf(t, "SSORedirectChain: more than %d redirects, last was to %s", maxRedirectHops, next)
+	return nil
+}
+
+// MustSSORedirect requests /login/sso/redirect like SSORedirectChain, but only makes the first request,
+// failing the test unless it responds with a redirect. Returns the Location of the redirect, which is
+// usually the identity provider's authorization endpoint.
+func (c *CSAPI) MustSSORedirect(t ct.TestLike, idpID, redirectURL string) *url.URL {
+	t.Helper()
+	paths := []string{"_matrix", "client", "v3", "login", "sso", "redirect"}
+	if idpID != "" {
+		paths = append(paths, idpID)
+	}
+	noRedirects := *c
+	noRedirects.Client = c.noRedirectClient()
+	res := noRedirects.Do(t, "GET", paths, WithQueries(url.Values{"redirectUrl": {redirectURL}}))
+	if res.StatusCode < 300 || res.StatusCode >= 400 {
+		body, _ := io.ReadAll(res.Body)
+		ct.Fatalf(t, "MustSSORedirect: got HTTP %d %s, want a redirect", res.StatusCode, string(body))
+	}
+	location, err := res.Location()
+	if err != nil {
+		ct.Fatalf(t, "MustSSORedirect: invalid Location: %s", err)
+	}
+	return location
+}
+
+// GetLoginFallback requests the login fallback page, which clients without support for a login flow
+// can show in a web view. See https://spec.matrix.org/v1.12/client-server-api/#login-fallback
+func (c *CSAPI) GetLoginFallback(t ct.TestLike) *http.Response {
+	t.Helper()
+	return c.Do(t, "GET", []string{"_matrix", "static", "client", "login", ""})
+}
+
+// GetAuthFallback requests the fallback page for the user-interactive auth stage `authType` in the
+// session. See https://spec.matrix.org/v1.12/client-server-api/#fallback
+func (c *CSAPI) GetAuthFallback(t ct.TestLike, authType, session string) *http.Response {
+	t.Helper()
+	return c.Do(t, "GET", []string{"_matrix", "client", "v3", "auth", authType, "fallback", "web"}, WithQueries(url.Values{
+		"session": {session},
+	}))
+}
+
+// MustGetFallbackPage fails the test unless the response is a HTML page, returning the page.
+func MustGetFallbackPage(t ct.TestLike, res *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		ct.Fatalf(t, "MustGetFallbackPage: failed to read body: %s", err)
+	}
+	if res.StatusCode != 200 {
+		ct.Fatalf(t, "MustGetFallbackPage: %s returned HTTP %d: %s", res.Request.URL, res.StatusCode, string(body))
+	}
+	if contentType := res.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/html") {
+		ct.Fatalf(t, "MustGetFallbackPage: %s returned Content-Type %s, want text/html", res.Request.URL, contentType)
+	}
+	return string(body)
+}
+
+// noRedirectClient returns a copy of the client's HTTP client which returns redirects rather than
+// following them.
+func (c *CSAPI) noRedirectClient() *http.Client {
+	httpClient := http.Client{}
+	if c.Client != nil {
+		httpClient = *c.Client
+	}
+	httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &httpClient
+}
+
+// String returns the hop as e.g `302 https://hs1/_matrix/... -> https://idp/authorize`.
+func (h RedirectHop) String() string {
+	if h.Location == nil {
+		return fmt.Sprintf("%d %s", h.StatusCode, h.URL)
+	}
+	return fmt.Sprintf("%d %s -> %s", h.StatusCode, h.URL, h.Location)
+}
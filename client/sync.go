@@ -1,7 +1,9 @@
 package client
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"reflect"
@@ -160,10 +162,21 @@ func (c *CSAPI) MustSync(t ct.TestLike, syncReq SyncReq) (gjson.Result, string)
 // Returns the top-level parsed /sync response JSON on 2xx.
 func (c *CSAPI) Sync(t ct.TestLike, syncReq SyncReq) (gjson.Result, *http.Response) {
 	t.Helper()
+	query := syncQuery(syncReq)
+	res := c.Do(t, "GET", []string{"_matrix", "client", "v3", "sync"}, WithQueries(query))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return gjson.Result{}, res
+	}
+	body := ParseJSON(t, res)
+	result := gjson.ParseBytes(body)
+	return result, res
+}
+
+// syncQuery returns the /sync query parameters for the request options.
+func syncQuery(syncReq SyncReq) url.Values {
 	query := url.Values{
 		"timeout": []string{"1000"},
 	}
-	// configure the HTTP request based on SyncReq
 	if syncReq.TimeoutMillis != "" {
 		query["timeout"] = []string{syncReq.TimeoutMillis}
 	}
@@ -186,13 +199,117 @@ func (c *CSAPI) Sync(t ct.TestLike, syncReq SyncReq) (gjson.Result, *http.Respon
 	if syncReq.SetPresence != "" {
 		query["set_presence"] = []string{syncReq.SetPresence}
 	}
-	res := c.Do(t, "GET", []string{"_matrix", "client", "v3", "sync"}, WithQueries(query))
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return gjson.Result{}, res
+	return query
+}
+
+// SyncResult is the outcome of a long-poll /sync request started with StartSync.
+type SyncResult struct {
+	// The top-level parsed /sync response JSON. Only set on 2xx responses.
+	JSON gjson.Result
+	// The next_batch token from the response, to use as the since token of the next request.
+	NextBatch string
+	// The HTTP status code of the response, or 0 if the request was cancelled.
+	StatusCode int
+	// How long the server took to respond, or how long the request ran for before being cancelled.
+	Duration time.Duration
+	// True if the request was cancelled via SyncPoll.Cancel before the server responded.
+	Cancelled bool
+}
+
+// MustHonourTimeout fails the test if the server did not hold the request open for `timeout` before
+// responding, or if it took longer than `timeout` + `leeway`. Use this with a since token which is
+// up to date and a room which is quiet, so the server has nothing to return until the timeout expires.
+func (r SyncResult) MustHonourTimeout(t ct.TestLike, timeout, leeway time.Duration) {
+	t.Helper()
+	if r.Cancelled {
+		ct.Fatalf(t, "MustHonourTimeout: request was cancelled after %v", r.Duration)
 	}
-	body := ParseJSON(t, res)
-	result := gjson.ParseBytes(body)
-	return result, res
+	if r.Duration < timeout {
+		ct.Fatalf(t, "MustHonourTimeout: server responded after %v, before the timeout of %v", r.Duration, timeout)
+	}
+	if r.Duration > timeout+leeway {
+		ct.Fatalf(t, "MustHonourTimeout: server responded after %v, more than %v after the timeout of %v", r.Duration, leeway, timeout)
+	}
+}
+
+// SyncPoll is a /sync request which is running in the background. Create one with StartSync.
+type SyncPoll struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	result SyncResult
+	err    error
+}
+
+// StartSync starts a /sync request in the background and returns immediately, so the test can act
+// whilst the server is long-polling e.g to check that sending an event wakes up the request, or to
+// cancel the request part way through. Call Wait to get the result.
+//
+//	since := alice.MustSyncUntil(t, client.SyncReq{TimeoutMillis: "0"})
+//	poll := alice.StartSync(t, client.SyncReq{Since: since, TimeoutMillis: "10000"})
+//	bob.SendEventSynced(t, roomID, event)
+//	res := poll.Wait(t) // returns before the 10s timeout
+func (c *CSAPI) StartSync(t ct.TestLike, syncReq SyncReq) *SyncPoll {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	reqURL := c.BaseURL + "/_matrix/client/v3/sync?" + syncQuery(syncReq).Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		cancel()
+		ct.Fatalf(t, "StartSync failed to create http.NewRequest: %s", err)
+	}
+	if c.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.AccessToken)
+	}
+	p := &SyncPoll{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	// the request is made on another goroutine so errors are stored and reported by Wait, as
+	// tests cannot be failed from other goroutines.
+	go func() {
+		defer close(p.done)
+		start := time.Now()
+		res, err := c.Client.Do(req)
+		if err != nil {
+			p.result.Duration = time.Since(start)
+			if ctx.Err() != nil {
+				p.result.Cancelled = true
+			} else {
+				p.err = err
+			}
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		p.result.Duration = time.Since(start)
+		if err != nil {
+			p.err = err
+			return
+		}
+		p.result.StatusCode = res.StatusCode
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			p.result.JSON = gjson.ParseBytes(body)
+			p.result.NextBatch = p.result.JSON.Get("next_batch").Str
+		}
+	}()
+	return p
+}
+
+// Cancel aborts the request if the server has not responded yet. Call Wait to get the result.
+func (p *SyncPoll) Cancel() {
+	p.cancel()
+}
+
+// Wait blocks until the server responds or the request is cancelled, then returns the result.
+// Fails the test if the request could not be made, but not on non-2xx responses.
+func (p *SyncPoll) Wait(t ct.TestLike) SyncResult {
+	t.Helper()
+	<-p.done
+	p.cancel() // release the context
+	if p.err != nil {
+		ct.Fatalf(t, "SyncPoll.Wait: request failed: %s", p.err)
+	}
+	return p.result
 }
 
 // Check that the timeline for `roomID` has an event which passes the check function.
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// TimestampToEvent asks the homeserver for the closest event to `ts` in the room, looking in the
+// direction `dir` ("f" or "b"). The homeserver may ask other servers in the room if it does not have a
+// close enough event locally. Returns the raw http response. See the `match` package for matchers.
+func (c *CSAPI) TimestampToEvent(t ct.TestLike, roomID string, ts time.Time, dir string) *http.Response {
+	t.Helper()
+	return c.Do(t, "GET", []string{"_matrix", "client", "v1", "rooms", roomID, "timestamp_to_event"}, WithQueries(url.Values{
+		"ts":  []string{strconv.FormatInt(ts.UnixMilli(), 10)},
+		"dir": []string{dir},
+	}))
+}
+
+// MustTimestampToEvent is the same as TimestampToEvent but fails the test if no event was found.
+// Returns the event ID and origin_server_ts of the event.
+func (c *CSAPI) MustTimestampToEvent(t ct.TestLike, roomID string, ts time.Time, dir string) (eventID string, originServerTS time.Time) {
+	t.Helper()
+	res := c.TimestampToEvent(t, roomID, ts, dir)
+	mustRespond2xx(t, res)
+	body := ParseJSON(t, res)
+	eventID = GetJSONFieldStr(t, body, "event_id")
+	originServerTS = time.UnixMilli(gjson.GetBytes(body, "origin_server_ts").Int())
+	return eventID, originServerTS
+}
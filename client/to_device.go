@@ -0,0 +1,85 @@
+package client
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+var toDeviceSequenceCounter atomic.Int64
+
+// MustSendToDeviceSequence sends `count` to-device messages of type `evType` to a single device, one
+// request per message, for testing how homeservers batch large volumes of to-device messages. Each
+// message has the content `{"sequence_id": sequenceID, "seq": i}` where `i` counts from 0. Returns the
+// sequence ID, which is unique to this call, for use with CheckToDeviceSequence.
+func (c *CSAPI) MustSendToDeviceSequence(t ct.TestLike, evType, userID, deviceID string, count int) (sequenceID string) {
+	t.Helper()
+	sequenceID = fmt.Sprintf("%s-%d", c.UserID, toDeviceSequenceCounter.Add(1))
+	for i := 0; i < count; i++ {
+		c.MustSendToDeviceMessages(t, evType, map[string]map[string]map[string]interface{}{
+			userID: {
+				deviceID: {
+					"sequence_id": sequenceID,
+					"seq":         i,
+				},
+			},
+		})
+	}
+	return sequenceID
+}
+
+// MustSyncToDeviceMessages syncs from `since` until at least `count` to-device messages of type `evType`
+// have been received. Returns the messages in the order they were received, the number of messages of
+// that type in each /sync response which had any, and the `next_batch` token of the final response,
+// so tests can assert on how the homeserver batches to-device messages in /sync.
+//
+// Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) MustSyncToDeviceMessages(t ct.TestLike, since, evType string, count int) (messages []gjson.Result, batchSizes []int, nextBatch string) {
+	t.Helper()
+	start := time.Now()
+	syncReq := SyncReq{Since: since}
+	for len(messages) < count {
+		if time.Since(start) > c.SyncUntilTimeout {
+			ct.Fatalf(t, "%s MustSyncToDeviceMessages: timed out after %v with %d/%d %s messages in batches %v", c.UserID, time.Since(start), len(messages), count, evType, batchSizes)
+		}
+		response, next := c.MustSync(t, syncReq)
+		syncReq.Since = next
+		batchSize := 0
+		for _, ev := range response.Get("to_device.events").Array() {
+			if ev.Get("type").Str != evType {
+				continue
+			}
+			messages = append(messages, ev)
+			batchSize++
+		}
+		if batchSize > 0 {
+			batchSizes = append(batchSizes, batchSize)
+		}
+	}
+	return messages, batchSizes, syncReq.Since
+}
+
+// CheckToDeviceSequence checks that the messages sent by MustSendToDeviceSequence with the sequence ID
+// were each received exactly once and in order. Messages from other sequences are ignored.
+func CheckToDeviceSequence(messages []gjson.Result, sequenceID string, count int) error {
+	want := int64(0)
+	for _, msg := range messages {
+		content := msg.Get("content")
+		if content.Get("sequence_id").Str != sequenceID {
+			continue
+		}
+		seq := content.Get("seq").Int()
+		if seq != want {
+			return fmt.Errorf("sequence %s: got message %d, want %d", sequenceID, seq, want)
+		}
+		want++
+	}
+	if want != int64(count) {
+		return fmt.Errorf("sequence %s: got %d messages, want %d", sequenceID, want, count)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// UIAStage returns the `auth` dict which completes a single stage of user-interactive auth.
+// `params` are the parameters the server returned for this stage, e.g the public key for
+// m.login.recaptcha.
+type UIAStage func(session string, params gjson.Result) map[string]interface{}
+
+// DummyStage completes the m.login.dummy stage.
+func DummyStage() UIAStage {
+	return func(session string, params gjson.Result) map[string]interface{} {
+		return map[string]interface{}{
+			"type":    "m.login.dummy",
+			"session": session,
+		}
+	}
+}
+
+// PasswordStage completes the m.login.password stage as the given user.
+func PasswordStage(userID, password string) UIAStage {
+	return func(session string, params gjson.Result) map[string]interface{} {
+		return map[string]interface{}{
+			"type": "m.login.password",
+			"identifier": map[string]interface{}{
+				"type": "m.id.user",
+				"user": userID,
+			},
+			"password": password,
+			"session":  session,
+		}
+	}
+}
+
+// RecaptchaStage completes the m.login.recaptcha stage with the given captcha response token.
+func RecaptchaStage(response string) UIAStage {
+	return func(session string, params gjson.Result) map[string]interface{} {
+		return map[string]interface{}{
+			"type":     "m.login.recaptcha",
+			"response": response,
+			"session":  session,
+		}
+	}
+}
+
+// DoUIA performs a request which requires user-interactive auth. The request is made without `auth`,
+// then the first flow in the 401 response which only contains stages in `stages` is completed one
+// stage at a time. Returns the final response, which is the 401 response if a stage fails or if no
+// flow can be completed with the given stages. `body` must not contain `auth`.
+func (c *CSAPI) DoUIA(t ct.TestLike, method string, paths []string, body map[string]interface{}, stages map[string]UIAStage, opts ...RequestOpt) *http.Response {
+	t.Helper()
+	reqBody := make(map[string]interface{}, len(body)+1)
+	for k, v := range body {
+		reqBody[k] = v
+	}
+	var lastStage string
+	for {
+		res := c.Do(t, method, paths, append(opts, WithJSONBody(t, reqBody))...)
+		if res.StatusCode != 401 {
+			return res
+		}
+		resBody, err := io.ReadAll(res.Body)
+		if err != nil {
+			ct.Fatalf(t, "DoUIA: failed to read response body: %s", err)
+		}
+		res.Body = io.NopCloser(bytes.NewReader(resBody))
+		uia := gjson.ParseBytes(resBody)
+		if !uia.Get("flows").Exists() {
+			return res
+		}
+		completed := map[string]bool{}
+		for _, stage := range uia.Get("completed").Array() {
+			completed[stage.Str] = true
+		}
+		// a failed stage is returned as an errcode alongside the flows
+		if lastStage != "" && !completed[lastStage] {
+			t.Logf("DoUIA: stage %s failed: %s", lastStage, uia.Get("errcode").Str)
+			return res
+		}
+		next := nextUIAStage(uia.Get("flows").Array(), completed, stages)
+		if next == "" {
+			t.Logf("DoUIA: no flow can be completed with the given stages: %s", uia.Get("flows").Raw)
+			return res
+		}
+		session := uia.Get("session").Str
+		reqBody["auth"] = stages[next](session, uia.Get("params."+GjsonEscape(next)))
+		lastStage = next
+	}
+}
+
+// nextUIAStage returns the next stage to complete in the first flow which can be completed with
+// `stages`, or "" if there is no such flow.
+func nextUIAStage(flows []gjson.Result, completed map[string]bool, stages map[string]UIAStage) string {
+	for _, flow := range flows {
+		next := ""
+		ok := true
+		for _, stage := range flow.Get("stages").Array() {
+			if completed[stage.Str] {
+				continue
+			}
+			if _, has := stages[stage.Str]; !has {
+				ok = false
+				break
+			}
+			if next == "" {
+				next = stage.Str
+			}
+		}
+		if ok && next != "" {
+			return next
+		}
+	}
+	return ""
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// PreviewURL requests a preview of `previewURL` via the authenticated client media API, falling back to
+// the legacy media API if the homeserver does not support it. Returns the raw http response.
+// See the `urlpreview` package for a server to preview, and the `match` package for matchers.
+func (c *CSAPI) PreviewURL(t ct.TestLike, previewURL string) *http.Response {
+	t.Helper()
+	query := WithQueries(url.Values{
+		"url": []string{previewURL},
+	})
+	res := c.Do(t, "GET", []string{"_matrix", "client", "v1", "media", "preview_url"}, query)
+	if isUnrecognisedEndpoint(res) {
+		res.Body.Close()
+		res = c.Do(t, "GET", []string{"_matrix", "media", "v3", "preview_url"}, query)
+	}
+	return res
+}
+
+// MustPreviewURL is PreviewURL, failing the test unless the homeserver responds with a 2xx.
+// Returns the preview e.g `og:title`. Use GjsonEscape to look up keys containing dots.
+func (c *CSAPI) MustPreviewURL(t ct.TestLike, previewURL string) gjson.Result {
+	t.Helper()
+	res := c.PreviewURL(t, previewURL)
+	mustRespond2xx(t, res)
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
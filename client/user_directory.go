@@ -0,0 +1,52 @@
+package client
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// SearchUserDirectory searches the user directory for `searchTerm`. If `limit` is 0, the server's
+// default limit is used.
+func (c *CSAPI) SearchUserDirectory(t ct.TestLike, searchTerm string, limit int) *http.Response {
+	t.Helper()
+	body := map[string]interface{}{
+		"search_term": searchTerm,
+	}
+	if limit > 0 {
+		body["limit"] = limit
+	}
+	return c.Do(t, "POST", []string{"_matrix", "client", "v3", "user_directory", "search"}, WithJSONBody(t, body))
+}
+
+// MustSearchUserDirectory searches the user directory for `searchTerm`, failing the test on error.
+// Returns the response body, which has `results` and `limited` keys.
+func (c *CSAPI) MustSearchUserDirectory(t ct.TestLike, searchTerm string, limit int) gjson.Result {
+	t.Helper()
+	res := c.SearchUserDirectory(t, searchTerm, limit)
+	mustRespond2xx(t, res)
+	return gjson.ParseBytes(ParseJSON(t, res))
+}
+
+// MustSearchUserDirectoryUntil searches the user directory for `searchTerm` until `check` returns nil
+// for the response body e.g match.UserDirectoryHas. As homeservers typically update the user directory
+// in the background, this should be used rather than MustSearchUserDirectory when waiting for a change
+// to be reflected. Will time out after CSAPI.SyncUntilTimeout.
+func (c *CSAPI) MustSearchUserDirectoryUntil(t ct.TestLike, searchTerm string, check func(body gjson.Result) error) gjson.Result {
+	t.Helper()
+	start := time.Now()
+	for {
+		body := c.MustSearchUserDirectory(t, searchTerm, 0)
+		err := check(body)
+		if err == nil {
+			return body
+		}
+		if time.Since(start) > c.SyncUntilTimeout {
+			ct.Fatalf(t, "%s MustSearchUserDirectoryUntil: timed out after %v searching for '%s': %s", c.UserID, time.Since(start), searchTerm, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// Lease is a reference to a deployment which is shared between clients, e.g several Go test packages. The
+// deployment is kept alive while it has leases, and destroyed once it has had none for HOMERUNNER_LEASE_IDLE_SECS.
+// Leases expire unless they are refreshed, so clients which exit without releasing their lease do not keep
+// the deployment alive forever.
+type Lease struct {
+	ID      string
+	Expires time.Time
+	tenant  string
+	// the deployment key
+	key   string
+	timer *time.Timer
+}
+
+// LeaseDeployment leases the tenant's deployment of the blueprint, creating it if it does not exist. The
+// lease expires after `duration` unless refreshed via RefreshLease. If `duration` is 0, the configured
+// default lifetime is used. Returns true if the deployment was created by this lease.
+func (r *Runtime) LeaseDeployment(tenant, imageURI string, blueprint *b.Blueprint, duration time.Duration) (*docker.Deployment, *Lease, bool, error) {
+	if blueprint == nil {
+		return nil, nil, false, fmt.Errorf("blueprint must be supplied")
+	}
+	if duration == 0 {
+		duration = time.Duration(r.Config.HomeserverLifetimeMins) * time.Minute
+	}
+	r.leaseMu.Lock()
+	defer r.leaseMu.Unlock()
+	key := deploymentKey(tenant, blueprint.Name)
+	r.mu.Lock()
+	dep, exists := r.BlueprintToDeployment[key]
+	r.mu.Unlock()
+	if !exists {
+		var err error
+		// the lifetime only starts once the last lease has been released
+		dep, _, err = r.createDeployment(tenant, imageURI, blueprint, r.Config.LeaseIdleTimeout)
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.BlueprintToDeployment[key] != dep {
+		return nil, nil, false, fmt.Errorf("deployment with name '%s' expired while being leased", blueprint.Name)
+	}
+	lease := &Lease{
+		ID:      newLeaseID(),
+		Expires: time.Now().Add(duration),
+		tenant:  tenant,
+		key:     key,
+	}
+	lease.timer = time.AfterFunc(duration, func() {
+		logrus.Infof("Lease '%s' on blueprint '%s' has expired.", lease.ID, key)
+		if err := r.releaseLease(tenant, lease.ID, "expired"); err != nil {
+			logrus.WithError(err).Errorf("Failed to release expired lease '%s'", lease.ID)
+		}
+	})
+	r.Leases[lease.ID] = lease
+	r.BlueprintToLeases[key]++
+	r.Metrics.LeaseAcquired(!exists)
+	return dep, lease, !exists, nil
+}
+
+// RefreshLease resets the expiry timer of the lease so it expires after `duration`. If `duration` is 0,
+// the configured default lifetime is used.
+func (r *Runtime) RefreshLease(tenant, leaseID string, duration time.Duration) (time.Time, error) {
+	if duration == 0 {
+		duration = time.Duration(r.Config.HomeserverLifetimeMins) * time.Minute
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lease, ok := r.Leases[leaseID]
+	if !ok || lease.tenant != tenant {
+		return time.Time{}, fmt.Errorf("no lease with ID '%s' exists", leaseID)
+	}
+	if !lease.timer.Stop() {
+		// the timer has already fired and is waiting on the lock to release the lease
+		return time.Time{}, fmt.Errorf("lease '%s' has expired", leaseID)
+	}
+	lease.timer.Reset(duration)
+	lease.Expires = time.Now().Add(duration)
+	return lease.Expires, nil
+}
+
+// ReleaseLease releases the lease. Once a deployment has no leases, it is destroyed after
+// HOMERUNNER_LEASE_IDLE_SECS, or at the end of its lifetime if that is later, unless it is leased again.
+func (r *Runtime) ReleaseLease(tenant, leaseID string) error {
+	return r.releaseLease(tenant, leaseID, "request")
+}
+
+func (r *Runtime) releaseLease(tenant, leaseID, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lease, ok := r.Leases[leaseID]
+	if !ok || lease.tenant != tenant {
+		return fmt.Errorf("no lease with ID '%s' exists", leaseID)
+	}
+	lease.timer.Stop()
+	delete(r.Leases, leaseID)
+	r.Metrics.LeaseReleased(reason)
+	r.BlueprintToLeases[lease.key]--
+	if r.BlueprintToLeases[lease.key] > 0 {
+		return nil
+	}
+	delete(r.BlueprintToLeases, lease.key)
+	// don't shorten the lifetime of deployments which were created or extended with a longer lifetime
+	idleExpiry := time.Now().Add(r.Config.LeaseIdleTimeout)
+	if timer, ok := r.BlueprintToTimer[lease.key]; ok && idleExpiry.After(r.BlueprintToExpiry[lease.key]) {
+		timer.Stop()
+		timer.Reset(r.Config.LeaseIdleTimeout)
+		r.BlueprintToExpiry[lease.key] = idleExpiry
+	}
+	logrus.Infof("Blueprint '%s' has no leases, destroying it at %v unless it is leased again.", lease.key, r.BlueprintToExpiry[lease.key])
+	return nil
+}
+
+// LeaseCount returns the number of leases held on the tenant's deployment.
+func (r *Runtime) LeaseCount(tenant, blueprintName string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.BlueprintToLeases[deploymentKey(tenant, blueprintName)]
+}
+
+func newLeaseID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic("failed to generate lease ID: " + err.Error())
+	}
+	return hex.EncodeToString(id)
+}
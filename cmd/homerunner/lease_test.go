@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// newTestRuntime returns a runtime whose deployments have no containers. The keys of destroyed
+// deployments are sent on the returned channel.
+func newTestRuntime(t *testing.T, leaseIdleTimeout time.Duration) (*Runtime, chan string) {
+	t.Helper()
+	rt, err := NewRuntime(&Config{
+		HomeserverLifetimeMins: 30,
+		LeaseIdleTimeout:       leaseIdleTimeout,
+	})
+	if err != nil {
+		t.Fatalf("NewRuntime: %s", err)
+	}
+	destroyed := make(chan string, 100)
+	rt.createDeployment = func(tenant, imageURI string, blueprint *b.Blueprint, lifetime time.Duration) (*docker.Deployment, time.Time, error) {
+		dep := &docker.Deployment{
+			BlueprintName: blueprint.Name,
+			HS:            make(map[string]*docker.HomeserverDeployment),
+		}
+		if err := rt.addDeployment(deploymentKey(tenant, blueprint.Name), dep, lifetime); err != nil {
+			return nil, time.Time{}, err
+		}
+		return dep, time.Now().Add(lifetime), nil
+	}
+	rt.destroyContainers = func(d *docker.Deployment) {
+		destroyed <- d.BlueprintName
+	}
+	return rt, destroyed
+}
+
+func tenantContext(tenant string) context.Context {
+	return context.WithValue(context.Background(), ctxKeyTenant{}, tenant)
+}
+
+func mustLease(t *testing.T, rt *Runtime, tenant, blueprintName string) ResLease {
+	t.Helper()
+	res := RouteLease(tenantContext(tenant), rt, &ReqLease{BlueprintName: blueprintName})
+	if res.Code != 200 {
+		t.Fatalf("RouteLease: got HTTP %d want 200: %v", res.Code, res.JSON)
+	}
+	return res.JSON.(ResLease)
+}
+
+func mustRelease(t *testing.T, rt *Runtime, tenant, leaseID string) {
+	t.Helper()
+	res := RouteReleaseLease(tenantContext(tenant), rt, &ReqReleaseLease{LeaseID: leaseID})
+	if res.Code != 200 {
+		t.Fatalf("RouteReleaseLease: got HTTP %d want 200: %v", res.Code, res.JSON)
+	}
+}
+
+func TestLeaseAcquire(t *testing.T) {
+	rt, _ := newTestRuntime(t, time.Minute)
+	first := mustLease(t, rt, "", "foo")
+	if !first.Created || first.Leases != 1 {
+		t.Errorf("first lease: got created=%v leases=%d want created=true leases=1", first.Created, first.Leases)
+	}
+	second := mustLease(t, rt, "", "foo")
+	if second.Created || second.Leases != 2 {
+		t.Errorf("second lease: got created=%v leases=%d want created=false leases=2", second.Created, second.Leases)
+	}
+	if first.LeaseID == second.LeaseID {
+		t.Errorf("leases have the same ID %s", first.LeaseID)
+	}
+	if len(rt.BlueprintToDeployment) != 1 {
+		t.Errorf("got %d deployments want 1", len(rt.BlueprintToDeployment))
+	}
+	res := RouteLease(context.Background(), rt, &ReqLease{})
+	if res.Code != 400 {
+		t.Errorf("lease without a blueprint: got HTTP %d want 400", res.Code)
+	}
+}
+
+func TestLeaseRefresh(t *testing.T) {
+	rt, _ := newTestRuntime(t, time.Minute)
+	lease := mustLease(t, rt, "", "foo")
+	res := RouteRefreshLease(context.Background(), rt, &ReqRefreshLease{LeaseID: lease.LeaseID, LeaseSecs: 3600})
+	if res.Code != 200 {
+		t.Fatalf("RouteRefreshLease: got HTTP %d want 200: %v", res.Code, res.JSON)
+	}
+	if expires := res.JSON.(ResRefreshLease).Expires; !expires.After(lease.Expires) {
+		t.Errorf("refreshed lease expires at %v, want after %v", expires, lease.Expires)
+	}
+	res = RouteRefreshLease(context.Background(), rt, &ReqRefreshLease{LeaseID: "unknown"})
+	if res.Code != 404 {
+		t.Errorf("refresh unknown lease: got HTTP %d want 404", res.Code)
+	}
+	res = RouteRefreshLease(context.Background(), rt, &ReqRefreshLease{LeaseID: lease.LeaseID, LeaseSecs: -1})
+	if res.Code != 400 {
+		t.Errorf("refresh with negative lease_secs: got HTTP %d want 400", res.Code)
+	}
+}
+
+func TestLeaseRelease(t *testing.T) {
+	rt, destroyed := newTestRuntime(t, time.Minute)
+	first := mustLease(t, rt, "", "foo")
+	second := mustLease(t, rt, "", "foo")
+	mustRelease(t, rt, "", first.LeaseID)
+	if got := rt.LeaseCount("", "foo"); got != 1 {
+		t.Errorf("got %d leases want 1", got)
+	}
+	res := RouteReleaseLease(context.Background(), rt, &ReqReleaseLease{LeaseID: first.LeaseID})
+	if res.Code != 404 {
+		t.Errorf("release lease twice: got HTTP %d want 404", res.Code)
+	}
+	res = RouteRefreshLease(context.Background(), rt, &ReqRefreshLease{LeaseID: first.LeaseID})
+	if res.Code != 404 {
+		t.Errorf("refresh released lease: got HTTP %d want 404", res.Code)
+	}
+	mustRelease(t, rt, "", second.LeaseID)
+	if got := rt.LeaseCount("", "foo"); got != 0 {
+		t.Errorf("got %d leases want 0", got)
+	}
+	// the deployment is kept for HOMERUNNER_LEASE_IDLE_SECS
+	select {
+	case key := <-destroyed:
+		t.Errorf("deployment %s destroyed when its last lease was released", key)
+	default:
+	}
+}
+
+func TestLeaseIdleTeardown(t *testing.T) {
+	idleTimeout := 100 * time.Millisecond
+	rt, destroyed := newTestRuntime(t, idleTimeout)
+	lease := mustLease(t, rt, "", "foo")
+	mustRelease(t, rt, "", lease.LeaseID)
+	// leasing again before the idle timeout reuses the deployment and keeps it alive
+	lease = mustLease(t, rt, "", "foo")
+	if lease.Created {
+		t.Errorf("lease within the idle timeout created a new deployment")
+	}
+	select {
+	case key := <-destroyed:
+		t.Fatalf("leased deployment %s was destroyed", key)
+	case <-time.After(2 * idleTimeout):
+	}
+	mustRelease(t, rt, "", lease.LeaseID)
+	select {
+	case key := <-destroyed:
+		if key != "foo" {
+			t.Errorf("destroyed deployment %s want foo", key)
+		}
+	case <-time.After(10 * idleTimeout):
+		t.Fatalf("idle deployment was not destroyed")
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if len(rt.BlueprintToDeployment) != 0 {
+		t.Errorf("got %d deployments after idle teardown want 0", len(rt.BlueprintToDeployment))
+	}
+}
+
+func TestLeaseReleaseKeepsLongerLifetime(t *testing.T) {
+	idleTimeout := 100 * time.Millisecond
+	rt, destroyed := newTestRuntime(t, idleTimeout)
+	// created via /create with a longer lifetime than the idle timeout
+	if _, _, err := rt.createDeployment("", "", &b.Blueprint{Name: "created"}, time.Hour); err != nil {
+		t.Fatalf("createDeployment: %s", err)
+	}
+	// created by a lease, then extended via /keepalive
+	extended := mustLease(t, rt, "", "extended")
+	if _, err := rt.ExtendDeployment("", "extended", time.Hour); err != nil {
+		t.Fatalf("ExtendDeployment: %s", err)
+	}
+	mustRelease(t, rt, "", mustLease(t, rt, "", "created").LeaseID)
+	mustRelease(t, rt, "", extended.LeaseID)
+	select {
+	case key := <-destroyed:
+		t.Fatalf("deployment %s was destroyed before the end of its lifetime", key)
+	case <-time.After(5 * idleTimeout):
+	}
+}
+
+func TestLeaseTenantIsolation(t *testing.T) {
+	rt, _ := newTestRuntime(t, time.Minute)
+	alice := mustLease(t, rt, "alice", "foo")
+	bob := mustLease(t, rt, "bob", "foo")
+	if !alice.Created || !bob.Created {
+		t.Errorf("tenants shared a deployment: alice created=%v bob created=%v", alice.Created, bob.Created)
+	}
+	if bob.Leases != 1 {
+		t.Errorf("bob: got %d leases want 1", bob.Leases)
+	}
+	res := RouteReleaseLease(tenantContext("bob"), rt, &ReqReleaseLease{LeaseID: alice.LeaseID})
+	if res.Code != 404 {
+		t.Errorf("bob released alice's lease: got HTTP %d want 404", res.Code)
+	}
+	res = RouteRefreshLease(tenantContext("bob"), rt, &ReqRefreshLease{LeaseID: alice.LeaseID})
+	if res.Code != 404 {
+		t.Errorf("bob refreshed alice's lease: got HTTP %d want 404", res.Code)
+	}
+	if got := rt.LeaseCount("alice", "foo"); got != 1 {
+		t.Errorf("alice: got %d leases want 1", got)
+	}
+	mustRelease(t, rt, "alice", alice.LeaseID)
+}
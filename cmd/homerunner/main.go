@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -18,15 +19,26 @@ const Pkg = "homerunner"
 
 type Config struct {
 	HomeserverLifetimeMins int
-	Port                   int
-	SpawnHSTimeout         time.Duration
-	KeepBlueprints         []string
-	Snapshot               string
-	HSPortBindingIP        string
+	// How long a leased deployment is kept alive once its last lease is released.
+	LeaseIdleTimeout time.Duration
+	Port             int
+	SpawnHSTimeout   time.Duration
+	KeepBlueprints   []string
+	Snapshot         string
+	HSPortBindingIP  string
+	// Map of bearer token to the tenant it can access. If empty, requests do not need to be authenticated
+	// and all share the default tenant.
+	AuthTokens map[string]string
 }
 
-func (c *Config) DeriveComplementConfig(baseImageURI string) *config.Complement {
-	cfg := config.NewConfigFromEnvVars(Pkg, baseImageURI)
+// DeriveComplementConfig returns the Complement config for the tenant. Each tenant has its own package
+// namespace, so tenants cannot see or clean up each other's images and containers.
+func (c *Config) DeriveComplementConfig(tenant, baseImageURI string) *config.Complement {
+	pkg := Pkg
+	if tenant != "" {
+		pkg = Pkg + "_" + tenant
+	}
+	cfg := config.NewConfigFromEnvVars(pkg, baseImageURI)
 	cfg.BestEffort = true
 	cfg.KeepBlueprints = c.KeepBlueprints
 	cfg.SpawnHSTimeout = c.SpawnHSTimeout
@@ -46,15 +58,24 @@ func Getenv(key string, default_value string) string {
 func NewConfig() *Config {
 	cfg := &Config{
 		HomeserverLifetimeMins: 30,
+		LeaseIdleTimeout:       5 * time.Minute,
 		Port:                   54321,
 		SpawnHSTimeout:         5 * time.Second,
 		KeepBlueprints:         strings.Split(os.Getenv("HOMERUNNER_KEEP_BLUEPRINTS"), " "),
 		Snapshot:               os.Getenv("HOMERUNNER_SNAPSHOT_BLUEPRINT"),
 		HSPortBindingIP:        Getenv("HOMERUNNER_HS_PORTBINDING_IP", "127.0.0.1"),
 	}
+	authTokens, err := parseAuthTokens(os.Getenv("HOMERUNNER_AUTH_TOKENS"))
+	if err != nil {
+		logrus.Fatalf("HOMERUNNER_AUTH_TOKENS: %s", err)
+	}
+	cfg.AuthTokens = authTokens
 	if val, _ := strconv.Atoi(os.Getenv("HOMERUNNER_LIFETIME_MINS")); val != 0 {
 		cfg.HomeserverLifetimeMins = val
 	}
+	if val, _ := strconv.Atoi(os.Getenv("HOMERUNNER_LEASE_IDLE_SECS")); val != 0 {
+		cfg.LeaseIdleTimeout = time.Duration(val) * time.Second
+	}
 	if val, _ := strconv.Atoi(os.Getenv("HOMERUNNER_PORT")); val != 0 {
 		cfg.Port = val
 	}
@@ -64,13 +85,38 @@ func NewConfig() *Config {
 	return cfg
 }
 
+// parseAuthTokens parses a space delimited list of tenant:token pairs.
+func parseAuthTokens(val string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Fields(val) {
+		tenant, token, ok := strings.Cut(pair, ":")
+		if !ok || tenant == "" || token == "" {
+			return nil, fmt.Errorf("'%s' is not of the form tenant:token", pair)
+		}
+		if !validTenant.MatchString(tenant) {
+			return nil, fmt.Errorf("tenant '%s' must only contain lowercase letters, digits, '-' and '_'", tenant)
+		}
+		tokens[token] = tenant
+	}
+	return tokens, nil
+}
+
+// tenants are used in docker container and network names, so must be restricted to safe characters.
+var validTenant = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
 func cleanup(c *Config) {
-	cfg := c.DeriveComplementConfig("nothing")
-	builder, err := docker.NewBuilder(cfg)
-	if err != nil {
-		logrus.WithError(err).Fatalf("failed to run cleanup")
+	tenants := map[string]bool{"": true}
+	for _, tenant := range c.AuthTokens {
+		tenants[tenant] = true
+	}
+	for tenant := range tenants {
+		cfg := c.DeriveComplementConfig(tenant, "nothing")
+		builder, err := docker.NewBuilder(cfg)
+		if err != nil {
+			logrus.WithError(err).Fatalf("failed to run cleanup")
+		}
+		builder.Cleanup()
 	}
-	builder.Cleanup()
 }
 
 func main() {
@@ -92,7 +138,7 @@ func main() {
 		if err := json.NewDecoder(reqFile).Decode(&rc); err != nil {
 			logrus.Fatalf("file is not JSON: %s", err)
 		}
-		dep, _, err := rt.CreateDeployment(rc.BaseImageURI, rc.Blueprint)
+		dep, _, err := rt.CreateDeployment("", rc.BaseImageURI, rc.Blueprint, 0)
 		if err != nil {
 			logrus.Fatalf("failed to create deployment: %s", err)
 		}
@@ -101,7 +147,7 @@ func main() {
 		logrus.Infof("Servers: Run Homerunner with the env var HOMERUNNER_KEEP_BLUEPRINTS=%s set to prevent this blueprint being cleaned up", rc.Blueprint.Name)
 
 		// clean up after ourselves
-		_ = rt.DestroyDeployment(dep.BlueprintName)
+		_ = rt.DestroyDeployment("", dep.BlueprintName)
 		return
 	}
 
@@ -111,7 +157,10 @@ func main() {
 		Handler:      Routes(rt, cfg),
 		Addr:         fmt.Sprintf("0.0.0.0:%d", cfg.Port),
 	}
-	logrus.Infof("Homerunner listening on :%d with config %+v", cfg.Port, cfg)
+	// don't log the auth tokens
+	logCfg := *cfg
+	logCfg.AuthTokens = nil
+	logrus.Infof("Homerunner listening on :%d with config %+v and %d auth tokens", cfg.Port, logCfg, len(cfg.AuthTokens))
 
 	if err := srv.ListenAndServe(); err != nil {
 		logrus.Fatalf("ListenAndServe failed: %s", err)
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// buildDurationBuckets are the upper bounds in seconds of the blueprint build duration histogram.
+var buildDurationBuckets = []float64{5, 15, 30, 60, 120, 300, 600}
+
+// Metrics collects counters about homerunner, exposed in the Prometheus text format on /metrics.
+type Metrics struct {
+	mu                 sync.Mutex
+	activeDeployments  int
+	deploymentsCreated int
+	// keyed on the reason the deployment was destroyed: "request" or "expired"
+	deploymentsDestroyed map[string]int
+	// keyed on the stage which failed: "build" or "deploy"
+	failures         map[string]int
+	imageCacheHits   int
+	imageCacheMisses int
+	buildBuckets     []int
+	buildSum         float64
+	buildCount       int
+	activeLeases     int
+	// keyed on whether the lease created the deployment: "created" or "reused"
+	leasesAcquired map[string]int
+	// keyed on the reason the lease was released: "request", "expired" or "destroyed"
+	leasesReleased map[string]int
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		deploymentsDestroyed: make(map[string]int),
+		failures:             make(map[string]int),
+		buildBuckets:         make([]int, len(buildDurationBuckets)),
+		leasesAcquired:       make(map[string]int),
+		leasesReleased:       make(map[string]int),
+	}
+}
+
+func (m *Metrics) DeploymentCreated() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeDeployments++
+	m.deploymentsCreated++
+}
+
+func (m *Metrics) DeploymentDestroyed(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeDeployments--
+	m.deploymentsDestroyed[reason]++
+}
+
+func (m *Metrics) Failure(stage string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[stage]++
+}
+
+func (m *Metrics) ImageCache(hit bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if hit {
+		m.imageCacheHits++
+	} else {
+		m.imageCacheMisses++
+	}
+}
+
+func (m *Metrics) BlueprintBuilt(duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	secs := duration.Seconds()
+	for i, le := range buildDurationBuckets {
+		if secs <= le {
+			m.buildBuckets[i]++
+		}
+	}
+	m.buildSum += secs
+	m.buildCount++
+}
+
+func (m *Metrics) LeaseAcquired(created bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeLeases++
+	if created {
+		m.leasesAcquired["created"]++
+	} else {
+		m.leasesAcquired["reused"]++
+	}
+}
+
+func (m *Metrics) LeaseReleased(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeLeases--
+	m.leasesReleased[reason]++
+}
+
+// Write writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintln(w, "# HELP homerunner_active_deployments The number of deployments which currently exist.")
+	fmt.Fprintln(w, "# TYPE homerunner_active_deployments gauge")
+	fmt.Fprintf(w, "homerunner_active_deployments %d\n", m.activeDeployments)
+
+	fmt.Fprintln(w, "# HELP homerunner_deployments_created_total The number of deployments created.")
+	fmt.Fprintln(w, "# TYPE homerunner_deployments_created_total counter")
+	fmt.Fprintf(w, "homerunner_deployments_created_total %d\n", m.deploymentsCreated)
+
+	fmt.Fprintln(w, "# HELP homerunner_deployments_destroyed_total The number of deployments destroyed, by reason.")
+	fmt.Fprintln(w, "# TYPE homerunner_deployments_destroyed_total counter")
+	writeLabelled(w, "homerunner_deployments_destroyed_total", "reason", m.deploymentsDestroyed)
+
+	fmt.Fprintln(w, "# HELP homerunner_failures_total The number of failed deployment requests, by stage.")
+	fmt.Fprintln(w, "# TYPE homerunner_failures_total counter")
+	writeLabelled(w, "homerunner_failures_total", "stage", m.failures)
+
+	fmt.Fprintln(w, "# HELP homerunner_image_cache_hits_total The number of deployments which used already built blueprint images.")
+	fmt.Fprintln(w, "# TYPE homerunner_image_cache_hits_total counter")
+	fmt.Fprintf(w, "homerunner_image_cache_hits_total %d\n", m.imageCacheHits)
+	fmt.Fprintln(w, "# HELP homerunner_image_cache_misses_total The number of deployments which had to build blueprint images.")
+	fmt.Fprintln(w, "# TYPE homerunner_image_cache_misses_total counter")
+	fmt.Fprintf(w, "homerunner_image_cache_misses_total %d\n", m.imageCacheMisses)
+
+	fmt.Fprintln(w, "# HELP homerunner_blueprint_build_duration_seconds How long it took to build blueprint images.")
+	fmt.Fprintln(w, "# TYPE homerunner_blueprint_build_duration_seconds histogram")
+	for i, le := range buildDurationBuckets {
+		fmt.Fprintf(w, "homerunner_blueprint_build_duration_seconds_bucket{le=\"%v\"} %d\n", le, m.buildBuckets[i])
+	}
+	fmt.Fprintf(w, "homerunner_blueprint_build_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.buildCount)
+	fmt.Fprintf(w, "homerunner_blueprint_build_duration_seconds_sum %v\n", m.buildSum)
+	fmt.Fprintf(w, "homerunner_blueprint_build_duration_seconds_count %d\n", m.buildCount)
+
+	fmt.Fprintln(w, "# HELP homerunner_active_leases The number of leases which are currently held on deployments.")
+	fmt.Fprintln(w, "# TYPE homerunner_active_leases gauge")
+	fmt.Fprintf(w, "homerunner_active_leases %d\n", m.activeLeases)
+
+	fmt.Fprintln(w, "# HELP homerunner_leases_acquired_total The number of leases acquired, by whether they created or reused the deployment.")
+	fmt.Fprintln(w, "# TYPE homerunner_leases_acquired_total counter")
+	writeLabelled(w, "homerunner_leases_acquired_total", "deployment", m.leasesAcquired)
+
+	fmt.Fprintln(w, "# HELP homerunner_leases_released_total The number of leases released, by reason.")
+	fmt.Fprintln(w, "# TYPE homerunner_leases_released_total counter")
+	writeLabelled(w, "homerunner_leases_released_total", "reason", m.leasesReleased)
+}
+
+func writeLabelled(w io.Writer, name, labelName string, values map[string]int) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, labelName, k, values[k])
+	}
+}
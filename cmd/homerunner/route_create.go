@@ -14,6 +14,9 @@ type ReqCreate struct {
 	BaseImageURI  string       `json:"base_image_uri"`
 	BlueprintName string       `json:"blueprint_name"`
 	Blueprint     *b.Blueprint `json:"blueprint"`
+	// How long the deployment should live for before being destroyed automatically. Optional:
+	// defaults to HOMERUNNER_LIFETIME_MINS. Can be extended via /keepalive.
+	LifetimeSecs int `json:"lifetime_secs"`
 }
 
 type ResCreate struct {
@@ -49,7 +52,10 @@ func RouteCreate(ctx context.Context, rt *Runtime, rc *ReqCreate) util.JSONRespo
 		return util.MessageResponse(400, "one of 'blueprint_name' or 'blueprint' must be specified")
 	}
 
-	dep, expires, err := rt.CreateDeployment(rc.BaseImageURI, rc.Blueprint)
+	if rc.LifetimeSecs < 0 {
+		return util.MessageResponse(400, "lifetime_secs must not be negative")
+	}
+	dep, expires, err := rt.CreateDeployment(tenantFromContext(ctx), rc.BaseImageURI, rc.Blueprint, time.Duration(rc.LifetimeSecs)*time.Second)
 	if err != nil {
 		return util.MessageResponse(400, fmt.Sprintf("failed to create deployment: %s", err))
 	}
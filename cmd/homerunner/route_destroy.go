@@ -18,7 +18,7 @@ func RouteDestroy(ctx context.Context, rt *Runtime, rc *ReqDestroy) util.JSONRes
 	if rc.BlueprintName == "" {
 		return util.MessageResponse(400, "missing blueprint name")
 	}
-	err := rt.DestroyDeployment(rc.BlueprintName)
+	err := rt.DestroyDeployment(tenantFromContext(ctx), rc.BlueprintName)
 	if err != nil {
 		return util.MessageResponse(500, fmt.Sprintf("failed to destroy deployment: %s", err))
 	}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/util"
+)
+
+type ReqExec struct {
+	BlueprintName string   `json:"blueprint_name"`
+	HSName        string   `json:"hs_name"`
+	Cmd           []string `json:"cmd"`
+}
+
+// RouteExec handles running a command in a homeserver container, returning the exit code and output.
+func RouteExec(ctx context.Context, rt *Runtime, rc *ReqExec) util.JSONResponse {
+	if rc.BlueprintName == "" || rc.HSName == "" || len(rc.Cmd) == 0 {
+		return util.MessageResponse(400, "missing blueprint name, hs name or cmd")
+	}
+	deployer, hsDep, err := rt.Homeserver(tenantFromContext(ctx), rc.BlueprintName, rc.HSName)
+	if err != nil {
+		return util.MessageResponse(404, err.Error())
+	}
+	res, err := deployer.Exec(ctx, hsDep, rc.Cmd)
+	if err != nil {
+		return util.MessageResponse(500, fmt.Sprintf("failed to exec: %s", err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: res,
+	}
+}
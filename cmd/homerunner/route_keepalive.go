@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/util"
+)
+
+type ReqKeepAlive struct {
+	BlueprintName string `json:"blueprint_name"`
+	// The new lifetime of the deployment from now. Optional: defaults to HOMERUNNER_LIFETIME_MINS.
+	LifetimeSecs int `json:"lifetime_secs"`
+}
+
+type ResKeepAlive struct {
+	Expires time.Time `json:"expires"`
+}
+
+// RouteKeepAlive handles extending the lifetime of a deployment. Clients which run for longer than the
+// lifetime of a deployment should call this periodically, so that abandoned deployments still expire.
+func RouteKeepAlive(ctx context.Context, rt *Runtime, rc *ReqKeepAlive) util.JSONResponse {
+	if rc.BlueprintName == "" {
+		return util.MessageResponse(400, "missing blueprint name")
+	}
+	if rc.LifetimeSecs < 0 {
+		return util.MessageResponse(400, "lifetime_secs must not be negative")
+	}
+	expires, err := rt.ExtendDeployment(tenantFromContext(ctx), rc.BlueprintName, time.Duration(rc.LifetimeSecs)*time.Second)
+	if err != nil {
+		return util.MessageResponse(404, fmt.Sprintf("failed to extend deployment: %s", err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResKeepAlive{
+			Expires: expires,
+		},
+	}
+}
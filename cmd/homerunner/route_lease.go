@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/util"
+)
+
+type ReqLease struct {
+	BaseImageURI  string       `json:"base_image_uri"`
+	BlueprintName string       `json:"blueprint_name"`
+	Blueprint     *b.Blueprint `json:"blueprint"`
+	// How long the lease lasts before it is released automatically. Optional: defaults to
+	// HOMERUNNER_LIFETIME_MINS. Can be extended via /lease/refresh.
+	LeaseSecs int `json:"lease_secs"`
+}
+
+type ResLease struct {
+	LeaseID     string                                  `json:"lease_id"`
+	Homeservers map[string]*docker.HomeserverDeployment `json:"homeservers"`
+	Expires     time.Time                               `json:"expires"`
+	// True if this lease created the deployment, false if it was already running.
+	Created bool `json:"created"`
+	// The number of leases on the deployment, including this one.
+	Leases int `json:"leases"`
+}
+
+// RouteLease handles leasing a deployment which is shared between clients, creating it if it does not
+// exist. Blueprints are specified in the same way as RouteCreate.
+func RouteLease(ctx context.Context, rt *Runtime, rc *ReqLease) util.JSONResponse {
+	if knownBlueprint, ok := b.KnownBlueprints[rc.BlueprintName]; ok {
+		rc.Blueprint = knownBlueprint
+	}
+	if rc.Blueprint != nil {
+		if rc.BaseImageURI == "" {
+			return util.MessageResponse(400, "missing base image uri")
+		}
+	} else if rc.BlueprintName != "" {
+		rc.Blueprint = &b.Blueprint{
+			Name: rc.BlueprintName,
+		}
+		rc.BaseImageURI = "none"
+	} else {
+		return util.MessageResponse(400, "one of 'blueprint_name' or 'blueprint' must be specified")
+	}
+	if rc.LeaseSecs < 0 {
+		return util.MessageResponse(400, "lease_secs must not be negative")
+	}
+	tenant := tenantFromContext(ctx)
+	dep, lease, created, err := rt.LeaseDeployment(tenant, rc.BaseImageURI, rc.Blueprint, time.Duration(rc.LeaseSecs)*time.Second)
+	if err != nil {
+		return util.MessageResponse(400, fmt.Sprintf("failed to lease deployment: %s", err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResLease{
+			LeaseID:     lease.ID,
+			Homeservers: dep.HS,
+			Expires:     lease.Expires,
+			Created:     created,
+			Leases:      rt.LeaseCount(tenant, rc.Blueprint.Name),
+		},
+	}
+}
+
+type ReqRefreshLease struct {
+	LeaseID string `json:"lease_id"`
+	// The new lifetime of the lease from now. Optional: defaults to HOMERUNNER_LIFETIME_MINS.
+	LeaseSecs int `json:"lease_secs"`
+}
+
+type ResRefreshLease struct {
+	Expires time.Time `json:"expires"`
+}
+
+// RouteRefreshLease handles extending a lease. Clients which hold a lease for longer than its lifetime
+// should call this periodically, so that leases held by clients which have exited still expire.
+func RouteRefreshLease(ctx context.Context, rt *Runtime, rc *ReqRefreshLease) util.JSONResponse {
+	if rc.LeaseID == "" {
+		return util.MessageResponse(400, "missing lease id")
+	}
+	if rc.LeaseSecs < 0 {
+		return util.MessageResponse(400, "lease_secs must not be negative")
+	}
+	expires, err := rt.RefreshLease(tenantFromContext(ctx), rc.LeaseID, time.Duration(rc.LeaseSecs)*time.Second)
+	if err != nil {
+		return util.MessageResponse(404, fmt.Sprintf("failed to refresh lease: %s", err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResRefreshLease{
+			Expires: expires,
+		},
+	}
+}
+
+type ReqReleaseLease struct {
+	LeaseID string `json:"lease_id"`
+}
+
+type ResReleaseLease struct {
+}
+
+// RouteReleaseLease handles releasing a lease. The deployment is destroyed once it has had no leases for
+// HOMERUNNER_LEASE_IDLE_SECS.
+func RouteReleaseLease(ctx context.Context, rt *Runtime, rc *ReqReleaseLease) util.JSONResponse {
+	if rc.LeaseID == "" {
+		return util.MessageResponse(400, "missing lease id")
+	}
+	if err := rt.ReleaseLease(tenantFromContext(ctx), rc.LeaseID); err != nil {
+		return util.MessageResponse(404, fmt.Sprintf("failed to release lease: %s", err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResReleaseLease{},
+	}
+}
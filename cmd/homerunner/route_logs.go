@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RouteLogs handles streaming the logs of a homeserver container as plain text. The query parameters
+// `blueprint_name` and `hs_name` are required. If `follow=true`, the response continues to stream new
+// logs until the client disconnects.
+func RouteLogs(rt *Runtime, w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	blueprintName := query.Get("blueprint_name")
+	hsName := query.Get("hs_name")
+	if blueprintName == "" || hsName == "" {
+		http.Error(w, "missing blueprint_name or hs_name", 400)
+		return
+	}
+	deployer, hsDep, err := rt.Homeserver(tenantFromContext(req.Context()), blueprintName, hsName)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(200)
+	if err = deployer.Logs(req.Context(), hsDep, query.Get("follow") == "true", &flushWriter{w}); err != nil {
+		// we've already sent the headers so can only log this
+		logrus.WithError(err).Errorf("Failed to stream logs for %s %s", blueprintName, hsName)
+	}
+}
+
+// flushWriter flushes after every write so followed logs are sent to the client immediately.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/util"
+)
+
+type ReqRestore struct {
+	BlueprintName string `json:"blueprint_name"`
+	SnapshotName  string `json:"snapshot_name"`
+}
+
+type ResRestore struct {
+	Homeservers map[string]*docker.HomeserverDeployment `json:"homeservers"`
+}
+
+// RouteRestore handles restoring a deployment to a snapshot taken via RouteSnapshot. The homeservers
+// are replaced with new containers, so clients must use the returned URLs.
+func RouteRestore(ctx context.Context, rt *Runtime, rc *ReqRestore) util.JSONResponse {
+	if rc.BlueprintName == "" || rc.SnapshotName == "" {
+		return util.MessageResponse(400, "missing blueprint name or snapshot name")
+	}
+	if !validSnapshotName.MatchString(rc.SnapshotName) {
+		return util.MessageResponse(400, "snapshot name must only contain lowercase letters, digits, '-' and '_'")
+	}
+	dep, err := rt.RestoreDeployment(tenantFromContext(ctx), rc.BlueprintName, rc.SnapshotName)
+	if err != nil {
+		return util.MessageResponse(500, fmt.Sprintf("failed to restore deployment: %s", err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResRestore{
+			Homeservers: dep.HS,
+		},
+	}
+}
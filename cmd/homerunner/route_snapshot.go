@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/util"
+)
+
+type ReqSnapshot struct {
+	BlueprintName string `json:"blueprint_name"`
+	SnapshotName  string `json:"snapshot_name"`
+}
+
+type ResSnapshot struct {
+	Homeservers map[string]*docker.HomeserverDeployment `json:"homeservers"`
+}
+
+// RouteSnapshot handles snapshotting the current state of a deployment. The homeservers are restarted
+// as part of taking the snapshot, so their ports may change.
+func RouteSnapshot(ctx context.Context, rt *Runtime, rc *ReqSnapshot) util.JSONResponse {
+	if rc.BlueprintName == "" || rc.SnapshotName == "" {
+		return util.MessageResponse(400, "missing blueprint name or snapshot name")
+	}
+	if !validSnapshotName.MatchString(rc.SnapshotName) {
+		return util.MessageResponse(400, "snapshot name must only contain lowercase letters, digits, '-' and '_'")
+	}
+	dep, err := rt.SnapshotDeployment(tenantFromContext(ctx), rc.BlueprintName, rc.SnapshotName)
+	if err != nil {
+		return util.MessageResponse(500, fmt.Sprintf("failed to snapshot deployment: %s", err))
+	}
+	return util.JSONResponse{
+		Code: 200,
+		JSON: ResSnapshot{
+			Homeservers: dep.HS,
+		},
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSnapshotNameValidation(t *testing.T) {
+	rt, _ := newTestRuntime(t, time.Minute)
+	for _, name := range []string{"UPPER", "with.dot", "with/slash", "with:colon"} {
+		if res := RouteSnapshot(context.Background(), rt, &ReqSnapshot{BlueprintName: "foo", SnapshotName: name}); res.Code != 400 {
+			t.Errorf("RouteSnapshot(%q): got HTTP %d want 400", name, res.Code)
+		}
+		if res := RouteRestore(context.Background(), rt, &ReqRestore{BlueprintName: "foo", SnapshotName: name}); res.Code != 400 {
+			t.Errorf("RouteRestore(%q): got HTTP %d want 400", name, res.Code)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/util"
@@ -11,7 +14,7 @@ import (
 func Routes(rt *Runtime, cfg *Config) http.Handler {
 	mux := mux.NewRouter()
 	mux.Path("/create").Methods("POST", "OPTIONS").HandlerFunc(
-		withCORS(util.MakeJSONAPI(util.NewJSONRequestHandler(
+		withCORS(withAuth(cfg, util.MakeJSONAPI(util.NewJSONRequestHandler(
 			func(req *http.Request) util.JSONResponse {
 				rc := ReqCreate{}
 				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
@@ -19,10 +22,10 @@ func Routes(rt *Runtime, cfg *Config) http.Handler {
 				}
 				return RouteCreate(req.Context(), rt, &rc)
 			},
-		))),
+		)))),
 	)
 	mux.Path("/destroy").Methods("POST", "OPTIONS").HandlerFunc(
-		withCORS(util.MakeJSONAPI(util.NewJSONRequestHandler(
+		withCORS(withAuth(cfg, util.MakeJSONAPI(util.NewJSONRequestHandler(
 			func(req *http.Request) util.JSONResponse {
 				rc := ReqDestroy{}
 				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
@@ -30,7 +33,98 @@ func Routes(rt *Runtime, cfg *Config) http.Handler {
 				}
 				return RouteDestroy(req.Context(), rt, &rc)
 			},
-		))),
+		)))),
+	)
+	mux.Path("/keepalive").Methods("POST", "OPTIONS").HandlerFunc(
+		withCORS(withAuth(cfg, util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				rc := ReqKeepAlive{}
+				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+					return util.MessageResponse(400, "request body not JSON")
+				}
+				return RouteKeepAlive(req.Context(), rt, &rc)
+			},
+		)))),
+	)
+	mux.Path("/lease").Methods("POST", "OPTIONS").HandlerFunc(
+		withCORS(withAuth(cfg, util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				rc := ReqLease{}
+				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+					return util.MessageResponse(400, "request body not JSON")
+				}
+				return RouteLease(req.Context(), rt, &rc)
+			},
+		)))),
+	)
+	mux.Path("/lease/refresh").Methods("POST", "OPTIONS").HandlerFunc(
+		withCORS(withAuth(cfg, util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				rc := ReqRefreshLease{}
+				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+					return util.MessageResponse(400, "request body not JSON")
+				}
+				return RouteRefreshLease(req.Context(), rt, &rc)
+			},
+		)))),
+	)
+	mux.Path("/lease/release").Methods("POST", "OPTIONS").HandlerFunc(
+		withCORS(withAuth(cfg, util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				rc := ReqReleaseLease{}
+				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+					return util.MessageResponse(400, "request body not JSON")
+				}
+				return RouteReleaseLease(req.Context(), rt, &rc)
+			},
+		)))),
+	)
+	mux.Path("/snapshot").Methods("POST", "OPTIONS").HandlerFunc(
+		withCORS(withAuth(cfg, util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				rc := ReqSnapshot{}
+				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+					return util.MessageResponse(400, "request body not JSON")
+				}
+				return RouteSnapshot(req.Context(), rt, &rc)
+			},
+		)))),
+	)
+	mux.Path("/restore").Methods("POST", "OPTIONS").HandlerFunc(
+		withCORS(withAuth(cfg, util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				rc := ReqRestore{}
+				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+					return util.MessageResponse(400, "request body not JSON")
+				}
+				return RouteRestore(req.Context(), rt, &rc)
+			},
+		)))),
+	)
+	mux.Path("/exec").Methods("POST", "OPTIONS").HandlerFunc(
+		withCORS(withAuth(cfg, util.MakeJSONAPI(util.NewJSONRequestHandler(
+			func(req *http.Request) util.JSONResponse {
+				rc := ReqExec{}
+				if err := json.NewDecoder(req.Body).Decode(&rc); err != nil {
+					return util.MessageResponse(400, "request body not JSON")
+				}
+				return RouteExec(req.Context(), rt, &rc)
+			},
+		)))),
+	)
+	mux.Path("/logs").Methods("GET", "OPTIONS").HandlerFunc(
+		withCORS(withAuth(cfg, func(w http.ResponseWriter, req *http.Request) {
+			if req.Method == "OPTIONS" {
+				return
+			}
+			RouteLogs(rt, w, req)
+		})),
+	)
+	mux.Path("/metrics").Methods("GET").HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			rt.Metrics.Write(w)
+		},
 	)
 	mux.Path("/health").Methods("GET", "OPTIONS").HandlerFunc(
 		withCORS(func(res http.ResponseWriter, req *http.Request) {
@@ -47,3 +141,39 @@ func withCORS(handler http.HandlerFunc) http.HandlerFunc {
 		handler(w, req)
 	}
 }
+
+type ctxKeyTenant struct{}
+
+// withAuth checks the bearer token of the request if HOMERUNNER_AUTH_TOKENS is set, and stores the tenant
+// for the token in the request context.
+func withAuth(cfg *Config, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		// CORS preflight requests never include credentials
+		if len(cfg.AuthTokens) == 0 || req.Method == "OPTIONS" {
+			handler(w, req)
+			return
+		}
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		tenant := ""
+		if ok {
+			for t, tn := range cfg.AuthTokens {
+				if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+					tenant = tn
+				}
+			}
+		}
+		if tenant == "" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(401)
+			w.Write([]byte(`{"message":"missing or invalid bearer token"}`))
+			return
+		}
+		handler(w, req.WithContext(context.WithValue(req.Context(), ctxKeyTenant{}, tenant)))
+	}
+}
+
+// tenantFromContext returns the tenant of the authenticated request, or "" if auth is disabled.
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(ctxKeyTenant{}).(string)
+	return tenant
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"sync"
 	"time"
 
@@ -17,32 +18,78 @@ type Runtime struct {
 	mu                    *sync.Mutex
 	BlueprintToDeployment map[string]*docker.Deployment
 	BlueprintToTimer      map[string]*time.Timer
+	// When the timer of each deployment fires, destroying it unless it is leased.
+	BlueprintToExpiry    map[string]time.Time
+	BlueprintToSnapshots map[string][]string
+	// The number of leases held on each deployment. Leased deployments do not expire.
+	BlueprintToLeases map[string]int
+	// Leases keyed on lease ID
+	Leases  map[string]*Lease
+	Metrics *Metrics
+	// serialises LeaseDeployment, so concurrent leases of the same blueprint share one deployment
+	leaseMu *sync.Mutex
+	// create and tear down deployments for leases. Replaced in tests so they do not need Docker.
+	createDeployment  func(tenant, imageURI string, blueprint *b.Blueprint, lifetime time.Duration) (*docker.Deployment, time.Time, error)
+	destroyContainers func(d *docker.Deployment)
 }
 
 // NewRuntime makes a homerunner runtime
 func NewRuntime(cfg *Config) (*Runtime, error) {
-	return &Runtime{
+	r := &Runtime{
 		Config:                cfg,
 		BlueprintToDeployment: make(map[string]*docker.Deployment),
 		BlueprintToTimer:      make(map[string]*time.Timer),
+		BlueprintToExpiry:     make(map[string]time.Time),
+		BlueprintToSnapshots:  make(map[string][]string),
+		BlueprintToLeases:     make(map[string]int),
+		Leases:                make(map[string]*Lease),
+		Metrics:               NewMetrics(),
 		mu:                    &sync.Mutex{},
-	}, nil
+		leaseMu:               &sync.Mutex{},
+		destroyContainers: func(d *docker.Deployment) {
+			d.Deployer.Destroy(d, false, "", false)
+			d.Deployer.StopMockServers()
+		},
+	}
+	r.createDeployment = r.CreateDeployment
+	return r, nil
 }
 
-func (r *Runtime) CreateDeployment(imageURI string, blueprint *b.Blueprint) (*docker.Deployment, time.Time, error) {
-	duration := time.Duration(r.Config.HomeserverLifetimeMins) * time.Minute
+// CreateDeployment deploys the blueprint for the tenant, destroying it automatically after `lifetime`.
+// If `lifetime` is 0, the configured default lifetime is used. The lifetime can be extended via ExtendDeployment.
+// Tenants are isolated from each other, so the same blueprint can be deployed by different tenants. The
+// default tenant is "".
+func (r *Runtime) CreateDeployment(tenant, imageURI string, blueprint *b.Blueprint, lifetime time.Duration) (*docker.Deployment, time.Time, error) {
+	duration := lifetime
+	if duration == 0 {
+		duration = time.Duration(r.Config.HomeserverLifetimeMins) * time.Minute
+	}
 	var expires time.Time
 	if blueprint == nil {
 		return nil, expires, fmt.Errorf("blueprint must be supplied")
 	}
 	namespace := "homerunner_" + blueprint.Name
-	cfg := r.Config.DeriveComplementConfig(imageURI)
+	if tenant != "" {
+		namespace = "homerunner_" + tenant + "_" + blueprint.Name
+	}
+	cfg := r.Config.DeriveComplementConfig(tenant, imageURI)
 	builder, err := docker.NewBuilder(cfg)
 	if err != nil {
 		return nil, expires, err
 	}
-	if err = builder.ConstructBlueprintIfNotExist(*blueprint); err != nil {
-		return nil, expires, fmt.Errorf("CreateDeployment: Failed to construct blueprint: %s", err)
+	exists, err := builder.BlueprintExists(blueprint.Name)
+	if err != nil {
+		r.Metrics.Failure("build")
+		return nil, expires, fmt.Errorf("CreateDeployment: Failed to check for blueprint images: %s", err)
+	}
+	r.Metrics.ImageCache(exists)
+	if !exists {
+		start := time.Now()
+		if err = builder.ConstructBlueprint(*blueprint); err != nil {
+			r.Metrics.Failure("build")
+			return nil, expires, fmt.Errorf("CreateDeployment: Failed to construct blueprint: %s", err)
+		}
+		r.Metrics.BlueprintBuilt(time.Since(start))
 	}
 	d, err := docker.NewDeployer(namespace, cfg)
 	if err != nil {
@@ -50,42 +97,216 @@ func (r *Runtime) CreateDeployment(imageURI string, blueprint *b.Blueprint) (*do
 	}
 	dep, err := d.Deploy(context.Background(), blueprint.Name)
 	if err != nil {
+		r.Metrics.Failure("deploy")
 		return nil, expires, fmt.Errorf("CreateDeployment: Deploy returned error %s", err)
 	}
-	if err := r.addDeployment(blueprint.Name, dep, duration); err != nil {
+	if err := r.addDeployment(deploymentKey(tenant, blueprint.Name), dep, duration); err != nil {
+		r.Metrics.Failure("deploy")
 		return nil, expires, err
 	}
+	r.Metrics.DeploymentCreated()
 	return dep, time.Now().Add(duration), nil
 }
 
-func (r *Runtime) addDeployment(blueprintName string, d *docker.Deployment, duration time.Duration) error {
+func (r *Runtime) addDeployment(key string, d *docker.Deployment, duration time.Duration) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if _, ok := r.BlueprintToDeployment[blueprintName]; ok {
-		return fmt.Errorf("deployment with name %s already exists", blueprintName)
-	}
-	r.BlueprintToDeployment[blueprintName] = d
-	r.BlueprintToTimer[blueprintName] = time.AfterFunc(duration, func() {
-		logrus.Infof("Blueprint '%s' has expired. Tearing down network.", blueprintName)
-		err := r.DestroyDeployment(blueprintName)
-		if err != nil {
-			logrus.WithError(err).Errorf("Failed to tear down expired blueprint '%s'", blueprintName)
-		}
+	if _, ok := r.BlueprintToDeployment[key]; ok {
+		return fmt.Errorf("deployment with name %s already exists", d.BlueprintName)
+	}
+	r.BlueprintToDeployment[key] = d
+	r.BlueprintToTimer[key] = time.AfterFunc(duration, func() {
+		r.expireDeployment(key)
 	})
+	r.BlueprintToExpiry[key] = time.Now().Add(duration)
 	return nil
 }
 
-func (r *Runtime) DestroyDeployment(blueprintName string) error {
+// expireDeployment destroys the deployment when its lifetime is up, unless it is leased. Leased deployments
+// restart their lifetime once the last lease is released.
+func (r *Runtime) expireDeployment(key string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	d, ok := r.BlueprintToDeployment[blueprintName]
+	if r.BlueprintToLeases[key] > 0 {
+		return
+	}
+	logrus.Infof("Blueprint '%s' has expired. Tearing down network.", key)
+	if err := r.destroyDeploymentLocked(key, "expired"); err != nil {
+		logrus.WithError(err).Errorf("Failed to tear down expired blueprint '%s'", key)
+	}
+}
+
+// ExtendDeployment resets the expiry timer of the deployment so it is destroyed after `lifetime`. If
+// `lifetime` is 0, the configured default lifetime is used.
+func (r *Runtime) ExtendDeployment(tenant, blueprintName string, lifetime time.Duration) (time.Time, error) {
+	if lifetime == 0 {
+		lifetime = time.Duration(r.Config.HomeserverLifetimeMins) * time.Minute
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := deploymentKey(tenant, blueprintName)
+	timer, ok := r.BlueprintToTimer[key]
 	if !ok {
-		return fmt.Errorf("no deployment with name '%s' exists", blueprintName)
+		return time.Time{}, fmt.Errorf("no deployment with name '%s' exists", blueprintName)
 	}
-	d.Deployer.Destroy(d, false, "", false)
-	delete(r.BlueprintToDeployment, blueprintName)
-	timer := r.BlueprintToTimer[blueprintName]
+	if !timer.Stop() {
+		// the timer has already fired and is waiting on the lock to destroy the deployment
+		return time.Time{}, fmt.Errorf("deployment with name '%s' has expired", blueprintName)
+	}
+	timer.Reset(lifetime)
+	r.BlueprintToExpiry[key] = time.Now().Add(lifetime)
+	return r.BlueprintToExpiry[key], nil
+}
+
+func (r *Runtime) DestroyDeployment(tenant, blueprintName string) error {
+	return r.destroyDeployment(deploymentKey(tenant, blueprintName), "request")
+}
+
+func (r *Runtime) destroyDeployment(key, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.destroyDeploymentLocked(key, reason)
+}
+
+// destroyDeploymentLocked destroys the deployment and revokes any leases on it. The caller must hold the lock.
+func (r *Runtime) destroyDeploymentLocked(key, reason string) error {
+	d, ok := r.BlueprintToDeployment[key]
+	if !ok {
+		return fmt.Errorf("no deployment with name '%s' exists", key)
+	}
+	r.destroyContainers(d)
+	for _, snapshotName := range r.BlueprintToSnapshots[key] {
+		if err := d.Deployer.RemoveSnapshot(snapshotBlueprintName(d.BlueprintName, snapshotName)); err != nil {
+			logrus.WithError(err).Errorf("Failed to remove snapshot '%s' of blueprint '%s'", snapshotName, key)
+		}
+	}
+	delete(r.BlueprintToSnapshots, key)
+	delete(r.BlueprintToDeployment, key)
+	timer := r.BlueprintToTimer[key]
 	timer.Stop()
-	delete(r.BlueprintToTimer, blueprintName)
+	delete(r.BlueprintToTimer, key)
+	delete(r.BlueprintToExpiry, key)
+	for leaseID, lease := range r.Leases {
+		if lease.key == key {
+			lease.timer.Stop()
+			delete(r.Leases, leaseID)
+			r.Metrics.LeaseReleased("destroyed")
+		}
+	}
+	delete(r.BlueprintToLeases, key)
+	r.Metrics.DeploymentDestroyed(reason)
 	return nil
 }
+
+// SnapshotDeployment commits the current state of the deployment so it can be restored later with
+// RestoreDeployment. Taking a snapshot with an existing name replaces it.
+func (r *Runtime) SnapshotDeployment(tenant, blueprintName, snapshotName string) (*docker.Deployment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := deploymentKey(tenant, blueprintName)
+	d, ok := r.BlueprintToDeployment[key]
+	if !ok {
+		return nil, fmt.Errorf("no deployment with name '%s' exists", blueprintName)
+	}
+	if r.hasSnapshot(key, snapshotName) {
+		if err := d.Deployer.RemoveSnapshot(snapshotBlueprintName(blueprintName, snapshotName)); err != nil {
+			return nil, err
+		}
+		// the old images are gone, so only track the snapshot again once the new images exist
+		r.removeSnapshotName(key, snapshotName)
+	}
+	if err := d.Deployer.Snapshot(d, snapshotBlueprintName(blueprintName, snapshotName)); err != nil {
+		return nil, err
+	}
+	r.BlueprintToSnapshots[key] = append(r.BlueprintToSnapshots[key], snapshotName)
+	return d, nil
+}
+
+// RestoreDeployment replaces the running homeservers in the deployment with new homeservers created from
+// the snapshot. The new homeservers have different container IDs and ports. The expiry time of the
+// deployment is unchanged.
+func (r *Runtime) RestoreDeployment(tenant, blueprintName, snapshotName string) (*docker.Deployment, error) {
+	key := deploymentKey(tenant, blueprintName)
+	r.mu.Lock()
+	d, ok := r.BlueprintToDeployment[key]
+	hasSnapshot := r.hasSnapshot(key, snapshotName)
+	r.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no deployment with name '%s' exists", blueprintName)
+	}
+	if !hasSnapshot {
+		return nil, fmt.Errorf("deployment '%s' has no snapshot named '%s'", blueprintName, snapshotName)
+	}
+	// deploying can take a long time, so don't block other requests while doing it
+	restored, err := d.Deployer.Deploy(context.Background(), snapshotBlueprintName(blueprintName, snapshotName))
+	if err != nil {
+		if restored != nil {
+			d.Deployer.Destroy(restored, false, "", false)
+		}
+		return nil, fmt.Errorf("RestoreDeployment: Deploy returned error %s", err)
+	}
+	restored.BlueprintName = blueprintName
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.BlueprintToDeployment[key] != d {
+		// the deployment was destroyed or replaced whilst we were deploying the snapshot
+		d.Deployer.Destroy(restored, false, "", false)
+		return nil, fmt.Errorf("deployment '%s' was modified whilst restoring snapshot '%s'", blueprintName, snapshotName)
+	}
+	d.Deployer.Destroy(d, false, "", false)
+	r.BlueprintToDeployment[key] = restored
+	return restored, nil
+}
+
+// hasSnapshot returns true if the deployment has a snapshot with this name. The caller must hold the lock.
+func (r *Runtime) hasSnapshot(key, snapshotName string) bool {
+	for _, name := range r.BlueprintToSnapshots[key] {
+		if name == snapshotName {
+			return true
+		}
+	}
+	return false
+}
+
+// deploymentKey returns the key for the tenant's deployment in the runtime maps.
+func deploymentKey(tenant, blueprintName string) string {
+	if tenant == "" {
+		return blueprintName
+	}
+	return tenant + "/" + blueprintName
+}
+
+// removeSnapshotName stops tracking the snapshot of the deployment. The caller must hold the lock.
+func (r *Runtime) removeSnapshotName(key, snapshotName string) {
+	names := r.BlueprintToSnapshots[key]
+	for i, name := range names {
+		if name == snapshotName {
+			r.BlueprintToSnapshots[key] = append(names[:i:i], names[i+1:]...)
+			return
+		}
+	}
+}
+
+// snapshot names are used in docker image references, so must be restricted to safe characters.
+var validSnapshotName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+func snapshotBlueprintName(blueprintName, snapshotName string) string {
+	return blueprintName + "_snapshot_" + snapshotName
+}
+
+// Homeserver returns the homeserver `hsName` in the tenant's deployment, along with the deployer which
+// manages its container.
+func (r *Runtime) Homeserver(tenant, blueprintName, hsName string) (*docker.Deployer, *docker.HomeserverDeployment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.BlueprintToDeployment[deploymentKey(tenant, blueprintName)]
+	if !ok {
+		return nil, nil, fmt.Errorf("no deployment with name '%s' exists", blueprintName)
+	}
+	hsDep, ok := d.HS[hsName]
+	if !ok {
+		return nil, nil, fmt.Errorf("deployment '%s' has no homeserver named '%s'", blueprintName, hsName)
+	}
+	return d.Deployer, hsDep, nil
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// LoadCA uses the PEM encoded CA certificate and RSA private key at the given paths instead of a
+// generated CA.
+func (c *Complement) LoadCA(certPath, keyPath string) error {
+	if certPath == "" || keyPath == "" {
+		return fmt.Errorf("both the CA certificate and key must be given")
+	}
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("%s does not contain a PEM encoded certificate", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return fmt.Errorf("%s is not a CA certificate", certPath)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read CA key: %w", err)
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return fmt.Errorf("%s does not contain a PEM encoded key", keyPath)
+	}
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var parsed interface{}
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if key, ok = parsed.(*rsa.PrivateKey); !ok {
+				err = fmt.Errorf("got a %T key, only RSA keys are supported", parsed)
+			}
+		}
+	default:
+		err = fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse CA key: %w", err)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return fmt.Errorf("CA key %s does not match certificate %s", keyPath, certPath)
+	}
+	c.CACertificate = cert
+	c.CAPrivateKey = key
+	return nil
+}
+
+// GenerateCertificate mints a TLS certificate for `serverName` signed by the CA, returning the PEM
+// encoded certificate and RSA private key. `serverName` may include a port, which is ignored.
+func (c *Complement) GenerateCertificate(serverName string) (certPEM, keyPEM []byte, err error) {
+	host := serverName
+	if h, _, err := net.SplitHostPort(serverName); err == nil {
+		host = h
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	notBefore := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(time.Hour * 24 * 7),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		Subject: pkix.Name{
+			Organization: []string{"matrix.org"},
+			CommonName:   host,
+		},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, c.CACertificate, &priv.PublicKey, c.CAPrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert := bytes.NewBuffer(nil)
+	if err = pem.Encode(cert, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
+		return nil, nil, err
+	}
+	key := bytes.NewBuffer(nil)
+	if err = pem.Encode(key, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}); err != nil {
+		return nil, nil, err
+	}
+	return cert.Bytes(), key.Bytes(), nil
+}
+
+// VerifyCertificate checks that the raw certificate chain presented by a server is signed by the CA and
+// is for `serverName`, via either its subject alternative names or its common name. The common name is
+// accepted as homeservers which sign their own certificates with the CA often only set that.
+func (c *Complement) VerifyCertificate(rawCerts [][]byte, serverName string) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificate for %s", serverName)
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate for %s: %s", serverName, err)
+		}
+		certs[i] = cert
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(c.CACertificate)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("certificate for %s is not signed by the Complement CA: %s", serverName, err)
+	}
+	if certs[0].VerifyHostname(serverName) != nil && certs[0].Subject.CommonName != serverName {
+		return fmt.Errorf("certificate is for %v (CN=%s), not %s", certs[0].DNSNames, certs[0].Subject.CommonName, serverName)
+	}
+	return nil
+}
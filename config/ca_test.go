@@ -0,0 +1,67 @@
+package config
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCertificates(t *testing.T) {
+	var cfg Complement
+	if err := cfg.GenerateCA(); err != nil {
+		t.Fatalf("GenerateCA: %s", err)
+	}
+	certPEM, _, err := cfg.GenerateCertificate("hs1")
+	if err != nil {
+		t.Fatalf("GenerateCertificate: %s", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatalf("GenerateCertificate: not PEM: %s", certPEM)
+	}
+	rawCerts := [][]byte{block.Bytes}
+	if err = cfg.VerifyCertificate(rawCerts, "hs1"); err != nil {
+		t.Errorf("VerifyCertificate: %s", err)
+	}
+	if err = cfg.VerifyCertificate(rawCerts, "hs2"); err == nil {
+		t.Errorf("VerifyCertificate: accepted certificate for the wrong server")
+	}
+
+	// a certificate from another CA is rejected
+	var other Complement
+	if err = other.GenerateCA(); err != nil {
+		t.Fatalf("GenerateCA: %s", err)
+	}
+	if err = other.VerifyCertificate(rawCerts, "hs1"); err == nil {
+		t.Errorf("VerifyCertificate: accepted certificate from another CA")
+	}
+
+	// the CA can be loaded from disk, in PKCS #1 or #8 form
+	dir := t.TempDir()
+	caCert, _ := cfg.CACertificateBytes()
+	pkcs1, _ := cfg.CAPrivateKeyBytes()
+	der, err := x509.MarshalPKCS8PrivateKey(cfg.CAPrivateKey)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %s", err)
+	}
+	pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	for name, data := range map[string][]byte{"ca.crt": caCert, "pkcs1.key": pkcs1, "pkcs8.key": pkcs8} {
+		if err = os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+	}
+	for _, keyFile := range []string{"pkcs1.key", "pkcs8.key"} {
+		var loaded Complement
+		if err = loaded.LoadCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, keyFile)); err != nil {
+			t.Fatalf("LoadCA(%s): %s", keyFile, err)
+		}
+		if err = loaded.VerifyCertificate(rawCerts, "hs1"); err != nil {
+			t.Errorf("LoadCA(%s): VerifyCertificate: %s", keyFile, err)
+		}
+	}
+	if err = other.LoadCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.crt")); err == nil {
+		t.Errorf("LoadCA: accepted a certificate as the key")
+	}
+}
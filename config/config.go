@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"math/big"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
@@ -17,30 +18,67 @@ import (
 	"time"
 )
 
+// ExternalHomeserver is an already-running homeserver which tests are run against instead of a container.
+type ExternalHomeserver struct {
+	ServerName string
+	BaseURL    string
+}
+
 type HostMount struct {
 	HostPath      string
 	ContainerPath string
 	ReadOnly      bool
 }
 
+// ReadinessProbe is how Complement checks that a homeserver is ready to serve requests.
+type ReadinessProbe struct {
+	// The path on the client-server API to request e.g /_matrix/client/versions
+	Path string
+	// The HTTP status code which means the homeserver is ready. If 0, any response means it is ready.
+	StatusCode int
+	// How long to wait for the homeserver to be ready.
+	Timeout time.Duration
+}
+
 // The config for running Complement. This is configured using environment variables. The comments
 // in this struct are structured so they can be automatically parsed via gendoc. See /cmd/gendoc.
 type Complement struct {
 	// Name: COMPLEMENT_BASE_IMAGE
 	// Description: **Required.** The name of the Docker image to use as a base homeserver when generating
 	// blueprints. This image must conform to Complement's rules on containers, such as listening on the
-	// correct ports.
+	// correct ports. This can instead be the path to a Dockerfile or a build context directory containing
+	// a `Dockerfile`, e.g `../dockerfiles/synapse`, in which case Complement builds the image before
+	// running tests. Built images are tagged with a hash of the build context, so are only rebuilt when the
+	// context changes. Relative paths are resolved against the test package directory.
 	BaseImageURI string
 	// Name: COMPLEMENT_DEBUG
 	// Default: 0
 	// Description: If 1, prints out more verbose logging such as HTTP request/response bodies.
 	DebugLoggingEnabled bool
+	// Name: COMPLEMENT_DEBUG_UI_ADDR
+	// Description: If set, e.g `127.0.0.1:8765`, serves a web UI on this address while the tests run,
+	// which shows the transactions received by Complement federation servers, their room DAGs and the
+	// requests made by clients (downloadable as HAR). Intended for interactively debugging a single test.
+	DebugUIAddr string
 	// Name: COMPLEMENT_ALWAYS_PRINT_SERVER_LOGS
 	// Default: 0
 	// Description: If 1, always prints the Homeserver container logs even on success. When used with
 	// COMPLEMENT_ENABLE_DIRTY_RUNS, server logs are only printed once for reused deployments, at the very
 	// end of the test suite.
 	AlwaysPrintServerLogs bool
+	// Name: COMPLEMENT_STREAM_SERVER_LOGS
+	// Default: 0
+	// Description: If 1, Homeserver container logs are streamed into the test output as they are written,
+	// prefixed with the homeserver name, rather than only being printed after a test fails. Useful for
+	// debugging hangs. Only supported for Docker deployments created via `complement.Deploy` or
+	// `complement.OldDeploy`, as shared and dirty deployments outlive the test which created them.
+	StreamServerLogs bool
+	// Name: COMPLEMENT_STRICT_FEDERATION
+	// Default: 0
+	// Description: If 1, every federation server created by tests checks the transactions homeservers
+	// send to it, failing the test if a transaction has more than 50 PDUs or 100 EDUs, reuses a
+	// transaction ID, or sends PDUs before their prev_events.
+	StrictFederation bool
 	// Name: COMPLEMENT_SHARE_ENV_PREFIX
 	// Description: If set, all environment variables on the host with this prefix will be shared with
 	// every homeserver, with the prefix removed. For example, if the prefix was `FOO_` then setting
@@ -51,8 +89,30 @@ type Complement struct {
 	// Default: 30
 	// Description: The number of seconds to wait for a Homeserver container to be responsive after
 	// starting the container. Responsiveness is detected by `HEALTHCHECK` being healthy *and*
-	// the `/versions` endpoint returning 200 OK.
+	// COMPLEMENT_READINESS_PATH returning 200 OK.
 	SpawnHSTimeout time.Duration
+	// Name: COMPLEMENT_READINESS_PATH
+	// Default: /_matrix/client/versions
+	// Description: The path on the client-server API which must return 200 OK before a homeserver is
+	// considered ready, checked after the container's `HEALTHCHECK` (if the image has one) reports healthy.
+	// Useful for images which open their ports before they can serve requests, e.g `/health` for
+	// worker-mode Synapse.
+	ReadinessPath string
+	// Name: COMPLEMENT_READINESS_HEALTHCHECK_ONLY
+	// Default: 0
+	// Description: If 1, homeserver containers whose image has a `HEALTHCHECK` are ready as soon as it
+	// reports healthy, without also checking COMPLEMENT_READINESS_PATH. Containers without a `HEALTHCHECK`
+	// are still checked. Only supported for Docker deployments.
+	ReadinessHealthcheckOnly bool
+	// Name: COMPLEMENT_READINESS_PROBES
+	// Default: ""
+	// Description: Overrides how homeservers built from particular base images are checked to be ready, as
+	// a space-separated list of `image=path[,status[,timeout_secs]]` e.g
+	// `ghcr.io/element-hq/synapse:workers=/health,200,120`. The image must match the base image exactly as it
+	// is given to Complement. The status defaults to 200, and can be 0 to accept any response, which is useful
+	// for images which serve no client-server API at all. The timeout defaults to
+	// COMPLEMENT_SPAWN_HS_TIMEOUT_SECS. Other images use COMPLEMENT_READINESS_PATH.
+	ReadinessProbes map[string]ReadinessProbe
 	// Name: COMPLEMENT_CONTAINER_CPU_CORES
 	// Default: 0
 	// Description: The number of CPU cores available for the container to use (can be
@@ -60,6 +120,14 @@ type Complement struct {
 	// If 0, no limit is set and the container can use all available host CPUs. This is
 	// useful to mimic a resource-constrained environment, like a CI environment.
 	ContainerCPUCores float64
+	// Name: COMPLEMENT_CONTAINER_CPU_SHARES
+	// Default: 0
+	// Description: The relative weight of the container's CPU usage compared to other containers on
+	// the host, passed to Docker as the `--cpu-shares`/`CPUShares` argument. Docker's default weight
+	// is 1024. Unlike COMPLEMENT_CONTAINER_CPU_CORES this only applies when the host's CPUs are
+	// contended, so lowering it stops one busy homeserver starving others running in parallel without
+	// slowing homeservers down on an idle host. If 0, Docker's default is used.
+	ContainerCPUShares int64
 	// Name: COMPLEMENT_CONTAINER_MEMORY
 	// Default: 0
 	// Description: The maximum amount of memory the container can use (ex. "1GB"). Valid
@@ -81,17 +149,59 @@ type Complement struct {
 	// Description: A list of semicolon separated host mounts to mount on every container. The structure
 	// of the mount is `host-path:container-path:[ro]` for example `/path/on/host:/path/on/container` - you
 	// can optionally specify `:ro` to mount the path as readonly. A complete example with multiple mounts
-	// would look like `/host/a:/container/a:ro;/host/b:/container/b;/host/c:/container/c`
+	// would look like `/host/a:/container/a:ro;/host/b:/container/b;/host/c:/container/c`. Relative host
+	// paths are resolved against the working directory. Mounts for a single homeserver can instead be set
+	// in its blueprint via `b.Homeserver.Mounts`.
 	HostMounts []HostMount
+	// Name: COMPLEMENT_BLUEPRINT_REGISTRY
+	// Description: A docker repository e.g `registry.example.com/complement-blueprints` to share blueprint
+	// images between machines. Before building a blueprint, Complement tries to pull its images from the
+	// repository, tagged with a hash of the blueprint, the base images and the package namespace, so only
+	// identical blueprints are reused. Pulled images are cleaned up like locally built ones.
+	BlueprintRegistry string
+	// Name: COMPLEMENT_BLUEPRINT_REGISTRY_PUSH
+	// Default: 0
+	// Description: If 1, blueprint images which were built because they could not be pulled from
+	// COMPLEMENT_BLUEPRINT_REGISTRY are pushed to it, so other machines can pull them. Failing to push
+	// is logged but does not fail the test run.
+	BlueprintRegistryPush bool
+	// Name: COMPLEMENT_BLUEPRINT_REGISTRY_AUTH
+	// Description: Credentials for COMPLEMENT_BLUEPRINT_REGISTRY, as `username:password`. If unset,
+	// the registry is accessed anonymously.
+	BlueprintRegistryAuth string
 	// Name: COMPLEMENT_BASE_IMAGE_*
 	// Description: This allows you to override the base image used for a particular named homeserver.
 	// For example, `COMPLEMENT_BASE_IMAGE_HS1=complement-dendrite:latest` would use `complement-dendrite:latest`
 	// for the `hs1` homeserver in blueprints, but not any other homeserver (e.g `hs2`). This matching
 	// is case-insensitive. This allows Complement to test how different homeserver implementations work with each other.
+	// Like COMPLEMENT_BASE_IMAGE, this can be the path to a Dockerfile or build context directory.
 	BaseImageURIs map[string]string
 
 	// The namespace for all complement created blueprints and deployments
 	PackageNamespace string
+	// Name: COMPLEMENT_UNIQUE_NAMESPACE
+	// Default: 0
+	// Description: If 1, a random suffix is added to the package namespace for this run, so repeated or
+	// concurrent invocations of the same test package on one machine don't collide on (or clean up) each
+	// other's containers, networks and images. As blueprint images are namespaced, they are not reused
+	// between runs when this is enabled. Everything created by the run is removed when it exits.
+	UniqueNamespace bool
+	// Name: COMPLEMENT_CA_CERT_FILE
+	// Default: ""
+	// Description: The path to a PEM encoded CA certificate to use instead of generating a new CA for this run,
+	// so homeserver images can trust the CA ahead of time. Requires COMPLEMENT_CA_KEY_FILE.
+	CACertFile string
+	// Name: COMPLEMENT_CA_KEY_FILE
+	// Default: ""
+	// Description: The path to the PEM encoded RSA private key of COMPLEMENT_CA_CERT_FILE, in PKCS #1 or PKCS #8 form.
+	CAKeyFile string
+	// Name: COMPLEMENT_FEDERATION_VERIFY_TLS
+	// Default: 0
+	// Description: If 1, federation requests made by Complement to homeservers (e.g via `federation.Server.FederationClient`)
+	// verify that the homeserver's TLS certificate is signed by the Complement CA for its server name, rather than
+	// accepting any certificate. Homeservers should serve the certificate Complement mints for them. Only affects
+	// Docker deployments.
+	FederationVerifyTLS bool
 	// Certificate Authority generated values for this run of complement. Homeservers will use this
 	// as a base to derive their own signed Federation certificates.
 	CACertificate *x509.Certificate
@@ -123,6 +233,21 @@ type Complement struct {
 	// Eventually, dirty runs will become the default running mode of Complement, with an environment variable to
 	// disable this behaviour being added later, once this has stablised.
 	EnableDirtyRuns bool
+	// Name: COMPLEMENT_WARM_POOL_SIZE
+	// Default: 0
+	// Description: The number of single homeserver deployments to keep running in the background, so tests which
+	// call `Deploy(t, 1)` can lease one instead of waiting for a homeserver to start. A replacement is deployed
+	// whenever one is leased. When the test destroys the deployment, its state is wiped via
+	// COMPLEMENT_WARM_POOL_RESET_COMMAND (or a reset function given to TestMain via `WithWarmPoolReset`) and it is
+	// returned to the pool, unless the pool is already full. Deployments used by failed tests are destroyed as
+	// normal. The pool is only used if a reset is configured, and is not used when COMPLEMENT_ENABLE_DIRTY_RUNS is set.
+	WarmPoolSize int
+	// Name: COMPLEMENT_WARM_POOL_RESET_COMMAND
+	// Default: ""
+	// Description: A command which wipes the state of a homeserver in the warm pool, run with `sh -c` inside the
+	// container before it is returned to the pool, e.g a script which truncates the database tables. The homeserver
+	// is restarted once the command exits successfully. If the command fails, the deployment is destroyed instead.
+	WarmPoolResetCommand string
 
 	// The IP that is used to connect to the running homeserver from the host.
 	//
@@ -142,6 +267,132 @@ type Complement struct {
 	// called exactly once at the end of the test suite, and is called with the TestName of "COMPLEMENT_ENABLE_DIRTY_RUNS"
 	// and TestFailed=false.
 	PostTestScript string
+
+	// Name: COMPLEMENT_ARTIFACTS_DIR
+	// Default: ""
+	// Description: If set, debugging output is written to this directory so it can be uploaded by CI. Each test
+	// gets its own subdirectory (subtests are nested), which contains the logs of every homeserver in the
+	// test's deployments, along with anything the test itself writes via `complement.WriteArtifact`. If the
+	// test fails, the room DAGs of its Complement federation servers are also written as Graphviz and JSON,
+	// along with the `docker inspect` output of each homeserver container as `$hsName.inspect.json`.
+	ArtifactsDir string
+	// Name: COMPLEMENT_FAILURE_ARTIFACT_PATHS
+	// Default: ""
+	// Description: A space-separated list of paths in homeserver containers (e.g the database and rendered
+	// config, such as `/data /conf/homeserver.yaml`) which are copied to the artifacts directory of a test
+	// under `$hsName/` when the test fails. Requires COMPLEMENT_ARTIFACTS_DIR. Paths which do not exist in a
+	// container are skipped. Only supported for Docker deployments.
+	FailureArtifactPaths []string
+	// Name: COMPLEMENT_PROFILE_COMMAND
+	// Description: If set, this command is run via `sh -c` in every homeserver container of a test which
+	// is still running after COMPLEMENT_PROFILE_AFTER_SECS, and its output is written to the artifacts
+	// directory of the test as `$hsName.profile`, to diagnose slow homeservers. For example
+	// `curl -s 'localhost:6060/debug/pprof/goroutine?debug=2'` for homeservers which serve Go's pprof, or
+	// `py-spy dump --pid 1` for Synapse. Requires COMPLEMENT_ARTIFACTS_DIR. Only supported for Docker
+	// deployments which are not dirty.
+	ProfileCommand string
+	// Name: COMPLEMENT_PROFILE_AFTER_SECS
+	// Default: 60
+	// Description: The number of seconds a test can run for after deploying before COMPLEMENT_PROFILE_COMMAND
+	// is run.
+	ProfileAfter time.Duration
+
+	// Name: COMPLEMENT_TURN_IMAGE
+	// Description: If set, a TURN server is deployed alongside the homeservers of deployments which ask
+	// for one, using this coturn image (e.g `coturn/coturn:latest`). Homeservers are told about it via the environment
+	// variables `COMPLEMENT_TURN_URIS` and `COMPLEMENT_TURN_SHARED_SECRET`. VoIP tests which need a
+	// TURN server are skipped if this is not set.
+	TURNImage string
+
+	// Name: COMPLEMENT_NETEM_IMAGE
+	// Default: nicolaka/netshoot:latest
+	// Description: The image used to change the network conditions of homeservers, e.g to add latency or
+	// packet loss between them. It must contain `sh` and `tc`. It is run in the network namespace of the
+	// homeserver container with the NET_ADMIN capability, so the homeserver image does not need `tc`.
+	NetemImage string
+
+	// Name: COMPLEMENT_SHARD
+	// Default: ""
+	// Description: If set, only runs the tests assigned to this shard, so a test suite can be split across
+	// CI machines. Of the form `index/total` e.g `2/4` for the second of four shards. Tests are assigned to
+	// shards deterministically by hashing their top-level test name, and out-of-shard tests are skipped when
+	// they deploy (or call `complement.SkipIfNotInShard`).
+	ShardIndex int
+	// The total number of shards, parsed from COMPLEMENT_SHARD.
+	ShardTotal int
+
+	// Name: COMPLEMENT_SHARD_BY_BLUEPRINT
+	// Default: 0
+	// Description: If 1, tests which use a custom blueprint are assigned to shards by hashing the blueprint
+	// name rather than the test name, so each blueprint is only built on one shard. Has no effect unless
+	// COMPLEMENT_SHARD is set.
+	ShardByBlueprint bool
+
+	// Name: COMPLEMENT_LONG_MODE
+	// Default: 0
+	// Description: If 1, runs long-running tests such as fuzzing tests, which are skipped by default.
+	LongMode bool
+	// Name: COMPLEMENT_PERF_BASELINE_DIR
+	// Description: The COMPLEMENT_ARTIFACTS_DIR of an earlier run, e.g against an older homeserver image.
+	// If set, performance tests compare their results with the reports of the same tests in this
+	// directory, and fail if they have regressed by more than COMPLEMENT_PERF_MAX_REGRESSION_PERCENT.
+	PerfBaselineDir string
+	// Name: COMPLEMENT_PERF_MAX_REGRESSION_PERCENT
+	// Default: 20
+	// Description: How much slower than COMPLEMENT_PERF_BASELINE_DIR performance tests can be before they
+	// fail, as a percentage of the baseline latency.
+	PerfMaxRegressionPercent float64
+
+	// Name: COMPLEMENT_EXTERNAL_HOMESERVERS
+	// Default: ""
+	// Description: If set, tests are run against these already-running homeservers rather than Docker
+	// containers, so the test suite can be pointed at e.g a staging environment. A list of space separated
+	// `server_name=base_url` pairs e.g `staging.example.org=https://matrix.staging.example.org`, which are
+	// used as `hs1`, `hs2`, etc in order. Tests which need more servers than are listed, custom blueprints
+	// or control over the containers are skipped. COMPLEMENT_BASE_IMAGE is not required in this mode.
+	ExternalHomeservers []ExternalHomeserver
+
+	// Name: COMPLEMENT_EXTERNAL_SHARED_SECRET
+	// Default: ""
+	// Description: The registration shared secret of the homeservers in COMPLEMENT_EXTERNAL_HOMESERVERS, which
+	// is used to register test users via the Synapse admin registration API. As the homeservers are not
+	// reset between runs, users are registered with a random prefix to avoid clashes.
+	ExternalSharedSecret string
+
+	// Name: COMPLEMENT_KUBE_NAMESPACE
+	// Default: ""
+	// Description: If set, homeservers are deployed as pods in this Kubernetes namespace via `kubectl`
+	// rather than as Docker containers, for environments without a Docker daemon. The base images must be
+	// pullable by the cluster, and blueprints with users, rooms, application services or plugins cannot be
+	// deployed as they need images built by Docker. Homeservers are reached via `kubectl port-forward`.
+	KubeNamespace string
+
+	// Name: COMPLEMENT_KUBE_CONTEXT
+	// Default: ""
+	// Description: The kubeconfig context to use when COMPLEMENT_KUBE_NAMESPACE is set. Defaults to the
+	// current context.
+	KubeContext string
+
+	// Name: COMPLEMENT_PROCESS_COMMAND
+	// Default: ""
+	// Description: If set, homeservers are run as local processes with this shell command rather than as
+	// Docker containers, so changes to a homeserver can be tested without building images. The command is run
+	// via `sh -c` in the data directory of the homeserver with the environment variables `SERVER_NAME`,
+	// `COMPLEMENT_CONFIG` (the rendered COMPLEMENT_PROCESS_CONFIG_TEMPLATE), `COMPLEMENT_DATA_DIR`,
+	// `COMPLEMENT_CLIENT_PORT`, `COMPLEMENT_FEDERATION_PORT`, `COMPLEMENT_CA_CERT`, `COMPLEMENT_CA_KEY`, and
+	// `COMPLEMENT_TLS_CERT` and `COMPLEMENT_TLS_KEY` (a certificate for the homeserver signed by the CA).
+	// Homeservers are named `localhost:$COMPLEMENT_FEDERATION_PORT`. Blueprints with users, rooms, application
+	// services or plugins cannot be deployed. COMPLEMENT_BASE_IMAGE is not required in this mode, and
+	// COMPLEMENT_HOSTNAME_RUNNING_COMPLEMENT should usually be set to `localhost`.
+	ProcessCommand string
+
+	// Name: COMPLEMENT_PROCESS_CONFIG_TEMPLATE
+	// Default: ""
+	// Description: The path to a Go text/template of the homeserver config used with COMPLEMENT_PROCESS_COMMAND,
+	// which is rendered for each homeserver with the fields `.ServerName`, `.DataDir`, `.ClientPort`,
+	// `.FederationPort`, `.CACertPath`, `.CAKeyPath`, `.TLSCertPath`, `.TLSKeyPath` and `.SharedSecret`. The
+	// homeserver must allow shared secret registration with `.SharedSecret`.
+	ProcessConfigTemplate string
 }
 
 var hsRegex = regexp.MustCompile(`COMPLEMENT_BASE_IMAGE_(.+)=(.+)$`)
@@ -153,23 +404,61 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 		cfg.BaseImageURI = baseImageURI
 	}
 	cfg.DebugLoggingEnabled = os.Getenv("COMPLEMENT_DEBUG") == "1"
+	cfg.DebugUIAddr = os.Getenv("COMPLEMENT_DEBUG_UI_ADDR")
 	cfg.AlwaysPrintServerLogs = os.Getenv("COMPLEMENT_ALWAYS_PRINT_SERVER_LOGS") == "1"
+	cfg.StreamServerLogs = os.Getenv("COMPLEMENT_STREAM_SERVER_LOGS") == "1"
+	cfg.StrictFederation = os.Getenv("COMPLEMENT_STRICT_FEDERATION") == "1"
 	cfg.EnableDirtyRuns = os.Getenv("COMPLEMENT_ENABLE_DIRTY_RUNS") == "1"
+	cfg.WarmPoolSize = parseEnvWithDefault("COMPLEMENT_WARM_POOL_SIZE", 0)
+	cfg.WarmPoolResetCommand = os.Getenv("COMPLEMENT_WARM_POOL_RESET_COMMAND")
 	cfg.EnvVarsPropagatePrefix = os.Getenv("COMPLEMENT_SHARE_ENV_PREFIX")
 	cfg.PostTestScript = os.Getenv("COMPLEMENT_POST_TEST_SCRIPT")
+	cfg.ArtifactsDir = os.Getenv("COMPLEMENT_ARTIFACTS_DIR")
+	cfg.FailureArtifactPaths = strings.Fields(os.Getenv("COMPLEMENT_FAILURE_ARTIFACT_PATHS"))
+	cfg.ProfileCommand = os.Getenv("COMPLEMENT_PROFILE_COMMAND")
+	cfg.ProfileAfter = time.Duration(parseEnvWithDefault("COMPLEMENT_PROFILE_AFTER_SECS", 60)) * time.Second
+	cfg.LongMode = os.Getenv("COMPLEMENT_LONG_MODE") == "1"
+	cfg.PerfBaselineDir = os.Getenv("COMPLEMENT_PERF_BASELINE_DIR")
+	cfg.PerfMaxRegressionPercent = parseEnvAsFloatWithDefault("COMPLEMENT_PERF_MAX_REGRESSION_PERCENT", 20)
+	cfg.ShardByBlueprint = os.Getenv("COMPLEMENT_SHARD_BY_BLUEPRINT") == "1"
+	cfg.TURNImage = os.Getenv("COMPLEMENT_TURN_IMAGE")
+	cfg.NetemImage = os.Getenv("COMPLEMENT_NETEM_IMAGE")
+	if cfg.NetemImage == "" {
+		cfg.NetemImage = "nicolaka/netshoot:latest"
+	}
+	cfg.ExternalSharedSecret = os.Getenv("COMPLEMENT_EXTERNAL_SHARED_SECRET")
+	cfg.KubeNamespace = os.Getenv("COMPLEMENT_KUBE_NAMESPACE")
+	cfg.KubeContext = os.Getenv("COMPLEMENT_KUBE_CONTEXT")
+	cfg.ProcessCommand = os.Getenv("COMPLEMENT_PROCESS_COMMAND")
+	cfg.ProcessConfigTemplate = os.Getenv("COMPLEMENT_PROCESS_CONFIG_TEMPLATE")
 	cfg.SpawnHSTimeout = time.Duration(parseEnvWithDefault("COMPLEMENT_SPAWN_HS_TIMEOUT_SECS", 30)) * time.Second
+	cfg.ReadinessPath = os.Getenv("COMPLEMENT_READINESS_PATH")
+	if cfg.ReadinessPath == "" {
+		cfg.ReadinessPath = "/_matrix/client/versions"
+	}
+	cfg.ReadinessHealthcheckOnly = os.Getenv("COMPLEMENT_READINESS_HEALTHCHECK_ONLY") == "1"
 	if os.Getenv("COMPLEMENT_VERSION_CHECK_ITERATIONS") != "" {
 		fmt.Fprintln(os.Stderr, "Deprecated: COMPLEMENT_VERSION_CHECK_ITERATIONS will be removed in a later version. Use COMPLEMENT_SPAWN_HS_TIMEOUT_SECS instead which does the same thing and is clearer.")
 		// each iteration had a 50ms sleep between tries so the timeout is 50 * iteration ms
 		cfg.SpawnHSTimeout = time.Duration(50*parseEnvWithDefault("COMPLEMENT_VERSION_CHECK_ITERATIONS", 100)) * time.Millisecond
 	}
 	cfg.ContainerCPUCores = parseEnvAsFloatWithDefault("COMPLEMENT_CONTAINER_CPU_CORES", 0)
+	cfg.ContainerCPUShares = int64(parseEnvWithDefault("COMPLEMENT_CONTAINER_CPU_SHARES", 0))
 	parsedMemoryBytes, err := parseByteSizeString(os.Getenv("COMPLEMENT_CONTAINER_MEMORY"))
 	if err != nil {
 		panic("COMPLEMENT_CONTAINER_MEMORY parse error: " + err.Error())
 	}
 	cfg.ContainerMemoryBytes = parsedMemoryBytes
+	if shard := os.Getenv("COMPLEMENT_SHARD"); shard != "" {
+		cfg.ShardIndex, cfg.ShardTotal, err = parseShard(shard)
+		if err != nil {
+			panic("COMPLEMENT_SHARD parse error: " + err.Error())
+		}
+	}
 	cfg.KeepBlueprints = strings.Split(os.Getenv("COMPLEMENT_KEEP_BLUEPRINTS"), " ")
+	cfg.BlueprintRegistry = strings.TrimSuffix(os.Getenv("COMPLEMENT_BLUEPRINT_REGISTRY"), "/")
+	cfg.BlueprintRegistryPush = os.Getenv("COMPLEMENT_BLUEPRINT_REGISTRY_PUSH") == "1"
+	cfg.BlueprintRegistryAuth = os.Getenv("COMPLEMENT_BLUEPRINT_REGISTRY_AUTH")
 	hostMounts := os.Getenv("COMPLEMENT_HOST_MOUNTS")
 	if hostMounts != "" {
 		cfg.HostMounts, err = newHostMounts(strings.Split(hostMounts, ";"))
@@ -177,7 +466,19 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 			panic("COMPLEMENT_HOST_MOUNTS parse error: " + err.Error())
 		}
 	}
-	if cfg.BaseImageURI == "" {
+	if probes := os.Getenv("COMPLEMENT_READINESS_PROBES"); probes != "" {
+		cfg.ReadinessProbes, err = newReadinessProbes(strings.Fields(probes))
+		if err != nil {
+			panic("COMPLEMENT_READINESS_PROBES parse error: " + err.Error())
+		}
+	}
+	if externalHomeservers := os.Getenv("COMPLEMENT_EXTERNAL_HOMESERVERS"); externalHomeservers != "" {
+		cfg.ExternalHomeservers, err = newExternalHomeservers(strings.Fields(externalHomeservers))
+		if err != nil {
+			panic("COMPLEMENT_EXTERNAL_HOMESERVERS parse error: " + err.Error())
+		}
+	}
+	if cfg.BaseImageURI == "" && len(cfg.ExternalHomeservers) == 0 && cfg.ProcessCommand == "" {
 		panic("COMPLEMENT_BASE_IMAGE must be set")
 	}
 	// Parse HS specific base images
@@ -191,9 +492,20 @@ func NewConfigFromEnvVars(pkgNamespace, baseImageURI string) *Complement {
 	}
 
 	cfg.PackageNamespace = pkgNamespace
+	cfg.UniqueNamespace = os.Getenv("COMPLEMENT_UNIQUE_NAMESPACE") == "1"
+	if cfg.UniqueNamespace && cfg.PackageNamespace != "" {
+		cfg.PackageNamespace += "_" + namespaceSuffix()
+	}
 
-	// create CA certs and keys
-	if err := cfg.GenerateCA(); err != nil {
+	// create CA certs and keys, or load them
+	cfg.CACertFile = os.Getenv("COMPLEMENT_CA_CERT_FILE")
+	cfg.CAKeyFile = os.Getenv("COMPLEMENT_CA_KEY_FILE")
+	cfg.FederationVerifyTLS = os.Getenv("COMPLEMENT_FEDERATION_VERIFY_TLS") == "1"
+	if cfg.CACertFile != "" || cfg.CAKeyFile != "" {
+		if err := cfg.LoadCA(cfg.CACertFile, cfg.CAKeyFile); err != nil {
+			panic("Failed to load CA certificate/key: " + err.Error())
+		}
+	} else if err := cfg.GenerateCA(); err != nil {
 		panic("Failed to generate CA certificate/key: " + err.Error())
 	}
 	if cfg.PackageNamespace == "" {
@@ -237,6 +549,16 @@ func (c *Complement) CAPrivateKeyBytes() ([]byte, error) {
 	return caKey.Bytes(), err
 }
 
+// namespaceSuffix returns a suffix which is unique to this process, and is safe to use in container,
+// network and image names.
+func namespaceSuffix() string {
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		panic("failed to generate namespace suffix: " + err.Error())
+	}
+	return fmt.Sprintf("%d%x", os.Getpid(), random)
+}
+
 func parseEnvWithDefault(key string, defaultValue int) int {
 	inputString := os.Getenv(key)
 	if inputString == "" {
@@ -365,19 +687,41 @@ func intPow(n, m int64) int64 {
 	return result
 }
 
+// parseShard parses a shard of the form "index/total" where 1 <= index <= total.
+func parseShard(shard string) (index, total int, err error) {
+	indexStr, totalStr, ok := strings.Cut(shard, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("shard '%s' must be of the form index/total", shard)
+	}
+	if index, err = strconv.Atoi(indexStr); err != nil {
+		return 0, 0, fmt.Errorf("shard '%s' has invalid index: %w", shard, err)
+	}
+	if total, err = strconv.Atoi(totalStr); err != nil {
+		return 0, 0, fmt.Errorf("shard '%s' has invalid total: %w", shard, err)
+	}
+	if index < 1 || index > total {
+		return 0, 0, fmt.Errorf("shard '%s' index must be between 1 and %d", shard, total)
+	}
+	return index, total, nil
+}
+
 func newHostMounts(mounts []string) ([]HostMount, error) {
 	var hostMounts []HostMount
 	for _, m := range mounts {
 		segments := strings.Split(m, ":")
-		if len(segments) < 2 {
+		if len(segments) < 2 || segments[0] == "" || !filepath.IsAbs(segments[1]) {
 			return nil, fmt.Errorf("mount '%s' malformed", m)
 		}
 		var ro string
 		if len(segments) == 3 {
 			ro = segments[2]
 		}
+		hostPath, err := filepath.Abs(segments[0])
+		if err != nil {
+			return nil, fmt.Errorf("mount '%s' has invalid host path: %w", m, err)
+		}
 		hostMounts = append(hostMounts, HostMount{
-			HostPath:      segments[0],
+			HostPath:      hostPath,
 			ContainerPath: segments[1],
 			ReadOnly:      ro == "ro" || ro == "readonly",
 		})
@@ -385,6 +729,70 @@ func newHostMounts(mounts []string) ([]HostMount, error) {
 	return hostMounts, nil
 }
 
+func newExternalHomeservers(pairs []string) ([]ExternalHomeserver, error) {
+	var servers []ExternalHomeserver
+	for _, pair := range pairs {
+		serverName, baseURL, ok := strings.Cut(pair, "=")
+		if !ok || serverName == "" || baseURL == "" {
+			return nil, fmt.Errorf("homeserver '%s' malformed, expected server_name=base_url", pair)
+		}
+		servers = append(servers, ExternalHomeserver{
+			ServerName: serverName,
+			BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		})
+	}
+	return servers, nil
+}
+
+func newReadinessProbes(entries []string) (map[string]ReadinessProbe, error) {
+	probes := make(map[string]ReadinessProbe, len(entries))
+	for _, entry := range entries {
+		image, probeStr, ok := strings.Cut(entry, "=")
+		if !ok || image == "" || probeStr == "" {
+			return nil, fmt.Errorf("probe '%s' malformed, expected image=path[,status[,timeout_secs]]", entry)
+		}
+		segments := strings.Split(probeStr, ",")
+		if len(segments) > 3 || !strings.HasPrefix(segments[0], "/") {
+			return nil, fmt.Errorf("probe '%s' malformed, expected image=path[,status[,timeout_secs]]", entry)
+		}
+		probe := ReadinessProbe{
+			Path:       segments[0],
+			StatusCode: 200,
+		}
+		if len(segments) > 1 {
+			status, err := strconv.Atoi(segments[1])
+			if err != nil || status < 0 {
+				return nil, fmt.Errorf("probe '%s' has invalid status '%s'", entry, segments[1])
+			}
+			probe.StatusCode = status
+		}
+		if len(segments) > 2 {
+			secs, err := strconv.Atoi(segments[2])
+			if err != nil || secs <= 0 {
+				return nil, fmt.Errorf("probe '%s' has invalid timeout '%s'", entry, segments[2])
+			}
+			probe.Timeout = time.Duration(secs) * time.Second
+		}
+		probes[image] = probe
+	}
+	return probes, nil
+}
+
+// ReadinessProbeFor returns how to check that a homeserver built from `baseImage` is ready.
+func (c *Complement) ReadinessProbeFor(baseImage string) ReadinessProbe {
+	probe, ok := c.ReadinessProbes[baseImage]
+	if !ok {
+		probe = ReadinessProbe{
+			Path:       c.ReadinessPath,
+			StatusCode: 200,
+		}
+	}
+	if probe.Timeout == 0 {
+		probe.Timeout = c.SpawnHSTimeout
+	}
+	return probe
+}
+
 // Generate a certificate and private key
 func generateCAValues() (*x509.Certificate, *rsa.PrivateKey, error) {
 	// valid for 10 years
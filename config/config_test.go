@@ -0,0 +1,64 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadinessProbes(t *testing.T) {
+	probes, err := newReadinessProbes([]string{
+		"ghcr.io/element-hq/synapse:workers=/health,200,120",
+		"localhost/appservice-only=/,0",
+	})
+	if err != nil {
+		t.Fatalf("newReadinessProbes: %s", err)
+	}
+	cfg := Complement{
+		ReadinessPath:   "/_matrix/client/versions",
+		SpawnHSTimeout:  30 * time.Second,
+		ReadinessProbes: probes,
+	}
+	testCases := map[string]ReadinessProbe{
+		"ghcr.io/element-hq/synapse:workers": {Path: "/health", StatusCode: 200, Timeout: 120 * time.Second},
+		"localhost/appservice-only":          {Path: "/", StatusCode: 0, Timeout: 30 * time.Second},
+		"ghcr.io/element-hq/synapse:latest":  {Path: "/_matrix/client/versions", StatusCode: 200, Timeout: 30 * time.Second},
+	}
+	for image, want := range testCases {
+		if got := cfg.ReadinessProbeFor(image); got != want {
+			t.Errorf("ReadinessProbeFor(%s): got %+v want %+v", image, got, want)
+		}
+	}
+
+	for _, invalid := range []string{"no-probe", "image=health", "image=/health,ok", "image=/health,200,0", "image=/health,200,1,2"} {
+		if _, err := newReadinessProbes([]string{invalid}); err == nil {
+			t.Errorf("newReadinessProbes(%s): expected an error", invalid)
+		}
+	}
+}
+
+func TestHostMounts(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %s", err)
+	}
+	mounts, err := newHostMounts([]string{"/host/a:/container/a:ro", "testdata/b:/container/b"})
+	if err != nil {
+		t.Fatalf("newHostMounts: %s", err)
+	}
+	want := []HostMount{
+		{HostPath: "/host/a", ContainerPath: "/container/a", ReadOnly: true},
+		{HostPath: filepath.Join(wd, "testdata/b"), ContainerPath: "/container/b"},
+	}
+	if !reflect.DeepEqual(mounts, want) {
+		t.Errorf("newHostMounts: got %+v want %+v", mounts, want)
+	}
+
+	for _, invalid := range []string{"/host/a", ":/container/a", "/host/a:container/a"} {
+		if _, err := newHostMounts([]string{invalid}); err == nil {
+			t.Errorf("newHostMounts(%s): expected an error", invalid)
+		}
+	}
+}
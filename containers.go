@@ -0,0 +1,138 @@
+package complement
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// ContainerResult is the result of running a container via RunContainer.
+type ContainerResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+}
+
+// RunContainer runs a one-shot container from `image` (e.g `curlimages/curl:latest`) with the given command
+// on the deployment's network and waits up to a minute for it to exit, returning its output. Homeservers are
+// reachable from the container by their names e.g `https://hs1:8448`, so this can be used to make
+// network-level assertions from inside the network, where routing and TLS differ from the host. A non-zero
+// exit code does not fail the test. Skips the test if the deployment is not a Docker deployment.
+func RunContainer(t ct.TestLike, deployment Deployment, image string, cmd ...string) ContainerResult {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(*docker.Deployment)
+	if !ok {
+		t.Skipf("RunContainer: deployment %T is not a Docker deployment", deployment)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	t.Logf("RunContainer: %s %v", image, cmd)
+	res, err := dep.Deployer.RunContainer(ctx, dep.Network(), image, cmd)
+	if err != nil {
+		ct.Fatalf(t, "RunContainer: %s", err)
+	}
+	return ContainerResult{
+		ExitCode: res.ExitCode,
+		Stdout:   res.Stdout,
+		Stderr:   res.Stderr,
+	}
+}
+
+// ServerAddress returns the host-accessible address (host:port) of `port` in the container of the
+// homeserver `hsName`, for talking to ports other than the client and federation APIs e.g a metrics
+// listener. The port must be exposed by the homeserver image. Skips the test if the deployment is not
+// a Docker deployment.
+func ServerAddress(t ct.TestLike, deployment Deployment, hsName string, port int) string {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(*docker.Deployment)
+	if !ok {
+		t.Skipf("ServerAddress: deployment %T is not a Docker deployment", deployment)
+	}
+	hsDep := dep.HS[hsName]
+	if hsDep == nil {
+		ct.Fatalf(t, "ServerAddress: %s does not exist in this deployment", hsName)
+	}
+	addr, err := dep.Deployer.HostAddress(hsDep, port)
+	if err != nil {
+		ct.Fatalf(t, "ServerAddress: %s", err)
+	}
+	return addr
+}
+
+// SidecarAddress returns the host-accessible address (host:port) of `port` in the sidecar `sidecarName` of
+// the homeserver `hsName`. The port must be listed in the sidecar's Ports. Skips the test if the deployment
+// is not a Docker deployment.
+func SidecarAddress(t ct.TestLike, deployment Deployment, hsName, sidecarName string, port int) string {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(*docker.Deployment)
+	if !ok {
+		t.Skipf("SidecarAddress: deployment %T is not a Docker deployment", deployment)
+	}
+	hsDep := dep.HS[hsName]
+	if hsDep == nil {
+		ct.Fatalf(t, "SidecarAddress: %s does not exist in this deployment", hsName)
+	}
+	scDep := hsDep.Sidecars[sidecarName]
+	if scDep == nil {
+		ct.Fatalf(t, "SidecarAddress: %s has no sidecar %s", hsName, sidecarName)
+	}
+	addr, ok := scDep.Addresses[port]
+	if !ok {
+		ct.Fatalf(t, "SidecarAddress: port %d of sidecar %s is not published", port, sidecarName)
+	}
+	return addr
+}
+
+// AuxiliaryContainerOpts configures a container started via StartAuxiliaryContainer.
+type AuxiliaryContainerOpts struct {
+	// Optionally override the command of the image.
+	Cmd []string
+	// Environment variables for the container, as KEY=VALUE.
+	Env []string
+	// Files to copy into the container before it starts, keyed on absolute path.
+	Files map[string][]byte
+	// Container ports to publish on the host, so tests can talk to the container directly.
+	Ports []int
+}
+
+// AuxiliaryContainer is a running container started via StartAuxiliaryContainer.
+type AuxiliaryContainer struct {
+	// The hostname of the container on the deployment network, which is its name.
+	Hostname string
+	// The host-accessible addresses (host:port) of the published ports, keyed on container port.
+	Addresses map[int]string
+}
+
+// StartAuxiliaryContainer starts a long-lived helper container from `image` (e.g `postgres:16-alpine` or an S3
+// mock) on the deployment's network, where homeservers and other containers can reach it at `name`. Unlike
+// sidecars, these can be started after the deployment, for a single test. The container is removed when the
+// deployment is destroyed. This does not wait for the service in the container to be ready. Skips the test if
+// the deployment is not a Docker deployment.
+func StartAuxiliaryContainer(t ct.TestLike, deployment Deployment, name, image string, opts AuxiliaryContainerOpts) AuxiliaryContainer {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(*docker.Deployment)
+	if !ok {
+		t.Skipf("StartAuxiliaryContainer: deployment %T is not a Docker deployment", deployment)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	t.Logf("StartAuxiliaryContainer: %s %s %v", name, image, opts.Cmd)
+	auxDep, err := dep.Deployer.StartAuxiliaryContainer(ctx, dep, name, b.Sidecar{
+		Name:  name,
+		Image: image,
+		Cmd:   opts.Cmd,
+		Env:   opts.Env,
+		Files: opts.Files,
+		Ports: opts.Ports,
+	})
+	if err != nil {
+		ct.Fatalf(t, "StartAuxiliaryContainer: %s", err)
+	}
+	return AuxiliaryContainer{
+		Hostname:  auxDep.Hostname,
+		Addresses: auxDep.Addresses,
+	}
+}
@@ -0,0 +1,145 @@
+// Package db contains helpers to make read-only queries against the database of a homeserver, so tests
+// can assert on storage-level invariants which can't be observed via the API. Queries are run via the
+// database CLI inside the homeserver container, so no ports need to be exposed.
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Engine is the kind of database a homeserver uses.
+type Engine string
+
+const (
+	// Queried via `psql`, which must be in the homeserver container.
+	Postgres Engine = "postgres"
+	// Queried via `sqlite3`, which must be in the homeserver container.
+	SQLite Engine = "sqlite"
+)
+
+// Opts configure how to connect to the homeserver database. Zero values use the defaults of the
+// Synapse Complement image.
+type Opts struct {
+	// The database engine. If empty, Postgres is used if `psql` is available in the container, else SQLite.
+	Engine Engine
+	// The Postgres user. Default: postgres
+	User string
+	// The Postgres database name. Default: synapse
+	Name string
+	// The path of the SQLite database file in the container. Default: /data/homeserver.db
+	Path string
+}
+
+// DB runs read-only queries against the database of a homeserver.
+type DB struct {
+	deployment complement.Deployment
+	hsName     string
+	opts       Opts
+}
+
+// Open returns a DB for the homeserver `hsName` in the deployment. Skips the test if the deployment
+// does not support running commands in homeserver containers.
+func Open(t ct.TestLike, deployment complement.Deployment, hsName string, opts Opts) *DB {
+	t.Helper()
+	if opts.User == "" {
+		opts.User = "postgres"
+	}
+	if opts.Name == "" {
+		opts.Name = "synapse"
+	}
+	if opts.Path == "" {
+		opts.Path = "/data/homeserver.db"
+	}
+	if opts.Engine == "" {
+		_, _, exitCode := complement.Exec(t, deployment, hsName, "sh", "-c", "command -v psql")
+		if exitCode == 0 {
+			opts.Engine = Postgres
+		} else {
+			opts.Engine = SQLite
+		}
+	}
+	return &DB{
+		deployment: deployment,
+		hsName:     hsName,
+		opts:       opts,
+	}
+}
+
+// MustQuery runs the query in a read-only transaction and returns the rows as a JSON array of objects
+// keyed on column name. Fails the test if the query fails. As queries are passed to the database CLI,
+// any values in them must be escaped e.g via Quote.
+func (d *DB) MustQuery(t ct.TestLike, query string) gjson.Result {
+	t.Helper()
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	var cmd []string
+	switch d.opts.Engine {
+	case Postgres:
+		cmd = []string{
+			"psql", "--no-psqlrc", "--tuples-only", "--no-align", "--set", "ON_ERROR_STOP=1",
+			"--username", d.opts.User, "--dbname", d.opts.Name,
+			"--command", "SET SESSION CHARACTERISTICS AS TRANSACTION READ ONLY",
+			"--command", fmt.Sprintf("SELECT coalesce(json_agg(q), '[]') FROM (%s) q", query),
+		}
+	case SQLite:
+		cmd = []string{"sqlite3", "-readonly", "-json", d.opts.Path, query}
+	default:
+		ct.Fatalf(t, "MustQuery: unknown database engine '%s'", d.opts.Engine)
+	}
+	stdout, stderr, exitCode := complement.Exec(t, d.deployment, d.hsName, cmd...)
+	if exitCode != 0 {
+		ct.Fatalf(t, "MustQuery: %s query failed with exit code %d: %s\n%s", d.opts.Engine, exitCode, query, stderr)
+	}
+	out := strings.TrimSpace(stdout)
+	if d.opts.Engine == Postgres {
+		// the output of the SET command is printed before the result
+		out = strings.TrimSpace(strings.TrimPrefix(out, "SET"))
+	}
+	if out == "" {
+		// sqlite prints nothing if there are no rows
+		out = "[]"
+	}
+	if !gjson.Valid(out) {
+		ct.Fatalf(t, "MustQuery: query returned invalid JSON: %s", out)
+	}
+	return gjson.Parse(out)
+}
+
+// MustQueryInto runs the query like MustQuery and unmarshals the rows into `rows`, which should be a
+// pointer to a slice of structs with `json` tags matching the column names.
+func (d *DB) MustQueryInto(t ct.TestLike, rows interface{}, query string) {
+	t.Helper()
+	result := d.MustQuery(t, query)
+	if err := json.Unmarshal([]byte(result.Raw), rows); err != nil {
+		ct.Fatalf(t, "MustQueryInto: failed to unmarshal rows into %T: %s", rows, err)
+	}
+}
+
+// MustQueryInt runs a query which returns a single integer e.g `SELECT COUNT(*) AS n FROM users`, and
+// returns it. Fails the test if the query does not return exactly one row with one column.
+func (d *DB) MustQueryInt(t ct.TestLike, query string) int64 {
+	t.Helper()
+	rows := d.MustQuery(t, query).Array()
+	if len(rows) != 1 {
+		ct.Fatalf(t, "MustQueryInt: got %d rows, want 1: %s", len(rows), query)
+	}
+	columns := rows[0].Map()
+	if len(columns) != 1 {
+		ct.Fatalf(t, "MustQueryInt: got %d columns, want 1: %s", len(columns), query)
+	}
+	for _, v := range columns {
+		return v.Int()
+	}
+	return 0
+}
+
+// Quote returns `s` as an SQL string literal, for use in queries.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
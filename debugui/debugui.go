@@ -0,0 +1,223 @@
+// package debugui serves an EXPERIMENTAL local web UI which shows, live, the transactions received by
+// Complement federation servers, the room DAGs of those servers and the requests made by clients. It is
+// enabled by setting COMPLEMENT_DEBUG_UI_ADDR, and is intended for interactively debugging a single test
+// e.g `go test -run TestFoo`. Nothing is recorded unless the UI is running.
+// It is marked as EXPERIMENTAL as the API may break without warning.
+package debugui
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxEntries is the number of transactions and client requests kept, oldest first out.
+const maxEntries = 1000
+
+// Transaction is a /send transaction received by a Complement federation server.
+type Transaction struct {
+	Time          time.Time         `json:"time"`
+	Test          string            `json:"test"`
+	Destination   string            `json:"destination"`
+	Origin        string            `json:"origin"`
+	TransactionID string            `json:"transaction_id"`
+	PDUs          []json.RawMessage `json:"pdus"`
+	EDUs          []json.RawMessage `json:"edus"`
+}
+
+// Event is an event in a room DAG.
+type Event struct {
+	EventID    string   `json:"event_id"`
+	Type       string   `json:"type"`
+	Sender     string   `json:"sender"`
+	StateKey   *string  `json:"state_key,omitempty"`
+	Depth      int64    `json:"depth"`
+	PrevEvents []string `json:"prev_events"`
+}
+
+// Room is a room on a Complement federation server.
+type Room struct {
+	Server  string  `json:"server"`
+	RoomID  string  `json:"room_id"`
+	Version string  `json:"version"`
+	Events  []Event `json:"events"`
+}
+
+// HTTPEntry is a request made by a client, in the shape of a HAR 1.2 entry so it can be loaded into
+// browser developer tools.
+type HTTPEntry struct {
+	StartedDateTime time.Time    `json:"startedDateTime"`
+	Time            float64      `json:"time"` // milliseconds
+	Request         HTTPRequest  `json:"request"`
+	Response        HTTPResponse `json:"response"`
+	Comment         string       `json:"comment"` // the test which made the request
+}
+
+// HTTPRequest is the request of an HTTPEntry.
+type HTTPRequest struct {
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	PostData *HTTPPostData `json:"postData,omitempty"`
+}
+
+// HTTPPostData is the body of an HTTPRequest.
+type HTTPPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+// HTTPResponse is the response of an HTTPEntry. Status is 0 if the request failed.
+type HTTPResponse struct {
+	Status  int         `json:"status"`
+	Content HTTPContent `json:"content"`
+}
+
+// HTTPContent is the body of an HTTPResponse.
+type HTTPContent struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+var (
+	enabled atomic.Bool
+
+	mu           sync.Mutex
+	transactions []Transaction
+	httpEntries  []HTTPEntry
+	roomSources  = make(map[int]func() []Room)
+	nextSourceID int
+)
+
+// Enabled returns true if the UI is running, so callers can avoid the cost of recording.
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Start serves the UI on `addr` e.g "127.0.0.1:8765", and starts recording. Call the returned function
+// to stop serving.
+func Start(addr string) (stop func(), err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("debugui: failed to listen on %s: %w", addr, err)
+	}
+	srv := &http.Server{Handler: Handler()}
+	go srv.Serve(ln)
+	enabled.Store(true)
+	return func() {
+		enabled.Store(false)
+		srv.Close()
+	}, nil
+}
+
+// Handler returns the handler which serves the UI and its JSON API.
+func Handler() http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(indexHTML))
+	})
+	m.HandleFunc("/api/transactions", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		txns := append([]Transaction{}, transactions...)
+		mu.Unlock()
+		writeJSON(w, txns)
+	})
+	m.HandleFunc("/api/rooms", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, Rooms())
+	})
+	m.HandleFunc("/api/har", func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		entries := append([]HTTPEntry{}, httpEntries...)
+		mu.Unlock()
+		var har struct {
+			Log struct {
+				Version string `json:"version"`
+				Creator struct {
+					Name    string `json:"name"`
+					Version string `json:"version"`
+				} `json:"creator"`
+				Entries []HTTPEntry `json:"entries"`
+			} `json:"log"`
+		}
+		har.Log.Version = "1.2"
+		har.Log.Creator.Name = "complement"
+		har.Log.Creator.Version = "1"
+		har.Log.Entries = entries
+		writeJSON(w, har)
+	})
+	return m
+}
+
+// RecordTransaction records a transaction received by a federation server. Does nothing if the UI is not running.
+func RecordTransaction(txn Transaction) {
+	if !Enabled() {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	transactions = appendBounded(transactions, txn)
+}
+
+// RecordHTTP records a request made by a client. Does nothing if the UI is not running.
+func RecordHTTP(entry HTTPEntry) {
+	if !Enabled() {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	httpEntries = appendBounded(httpEntries, entry)
+}
+
+// RegisterRooms adds a source of rooms to show, which is called whenever the UI is refreshed. Call
+// the returned function to remove it e.g when the federation server stops.
+func RegisterRooms(rooms func() []Room) (unregister func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	id := nextSourceID
+	nextSourceID++
+	roomSources[id] = rooms
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(roomSources, id)
+	}
+}
+
+// Rooms returns the rooms of all registered sources, sorted by server then room ID.
+func Rooms() []Room {
+	mu.Lock()
+	sources := make([]func() []Room, 0, len(roomSources))
+	for _, source := range roomSources {
+		sources = append(sources, source)
+	}
+	mu.Unlock()
+	rooms := []Room{}
+	for _, source := range sources {
+		rooms = append(rooms, source()...)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].Server != rooms[j].Server {
+			return rooms[i].Server < rooms[j].Server
+		}
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	return rooms
+}
+
+func appendBounded[T any](s []T, v T) []T {
+	s = append(s, v)
+	if len(s) > maxEntries {
+		s = s[len(s)-maxEntries:]
+	}
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,63 @@
+package debugui
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDebugUI(t *testing.T) {
+	RecordTransaction(Transaction{TransactionID: "ignored"})
+	stop, err := Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+	defer stop()
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+
+	RecordTransaction(Transaction{Time: time.Now(), Origin: "hs1", TransactionID: "txn1", PDUs: []json.RawMessage{[]byte(`{}`)}})
+	RecordHTTP(HTTPEntry{Request: HTTPRequest{Method: "GET", URL: "http://hs1/_matrix/client/versions"}, Response: HTTPResponse{Status: 200}})
+	unregister := RegisterRooms(func() []Room {
+		return []Room{{Server: "complement", RoomID: "!a:complement", Events: []Event{{EventID: "$create", Type: "m.room.create"}}}}
+	})
+
+	get := func(path string, v interface{}) {
+		t.Helper()
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %s", path, err)
+		}
+		defer res.Body.Close()
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: failed to decode: %s", path, err)
+		}
+	}
+
+	var txns []Transaction
+	get("/api/transactions", &txns)
+	if len(txns) != 1 || txns[0].TransactionID != "txn1" {
+		t.Errorf("transactions: got %+v, want only txn1 as the first was recorded before Start", txns)
+	}
+	var har struct {
+		Log struct {
+			Entries []map[string]interface{} `json:"entries"`
+		} `json:"log"`
+	}
+	get("/api/har", &har)
+	if len(har.Log.Entries) != 1 || har.Log.Entries[0]["response"].(map[string]interface{})["status"] != float64(200) {
+		t.Errorf("har: got %+v", har.Log.Entries)
+	}
+	var rooms []Room
+	get("/api/rooms", &rooms)
+	if len(rooms) != 1 || len(rooms[0].Events) != 1 {
+		t.Errorf("rooms: got %+v", rooms)
+	}
+	unregister()
+	get("/api/rooms", &rooms)
+	if len(rooms) != 0 {
+		t.Errorf("rooms after unregister: got %+v", rooms)
+	}
+}
@@ -0,0 +1,82 @@
+package debugui
+
+// indexHTML renders the JSON API, refreshing every few seconds.
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Complement debug UI</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+nav button { margin-right: 0.5em; }
+nav button.active { font-weight: bold; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9em; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; vertical-align: top; text-align: left; }
+pre { margin: 0; white-space: pre-wrap; word-break: break-all; max-height: 20em; overflow: auto; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Complement</h1>
+<nav>
+<button data-tab="transactions" class="active">Transactions</button>
+<button data-tab="rooms">Room DAGs</button>
+<button data-tab="requests">Client requests</button>
+<a href="/api/har" download="complement.har">Download HAR</a>
+<label><input type="checkbox" id="live" checked> Live</label>
+</nav>
+<div id="content"></div>
+<script>
+let tab = "transactions";
+const el = (tag, text) => { const e = document.createElement(tag); if (text !== undefined) e.textContent = text; return e; };
+const row = (cells) => { const tr = el("tr"); cells.forEach(c => { const td = el("td"); if (c instanceof Node) td.appendChild(c); else td.textContent = c; tr.appendChild(td); }); return tr; };
+const table = (headings, rows) => { const t = el("table"); t.appendChild(row(headings.map(h => el("b", h)))); rows.forEach(r => t.appendChild(row(r))); return t; };
+const pre = (v) => el("pre", typeof v === "string" ? v : JSON.stringify(v, null, 2));
+const renderers = {
+	transactions: async () => {
+		const txns = await (await fetch("/api/transactions")).json();
+		return table(["Time", "Test", "Origin -> Destination", "Txn ID", "PDUs", "EDUs"], txns.reverse().map(t => [
+			t.time, t.test, t.origin + " -> " + t.destination, t.transaction_id, pre(t.pdus || []), pre(t.edus || []),
+		]));
+	},
+	rooms: async () => {
+		const rooms = await (await fetch("/api/rooms")).json();
+		const div = el("div");
+		rooms.forEach(r => {
+			div.appendChild(el("h3", r.server + " " + r.room_id + " (v" + r.version + ")"));
+			div.appendChild(table(["Depth", "Event ID", "Type", "State key", "Sender", "Prev events"], r.events.map(e => [
+				e.depth, e.event_id, e.type, e.state_key === undefined ? "" : JSON.stringify(e.state_key), e.sender, (e.prev_events || []).join("\n"),
+			])));
+		});
+		return div;
+	},
+	requests: async () => {
+		const har = await (await fetch("/api/har")).json();
+		return table(["Time", "Test", "Request", "Status", "ms", "Request body", "Response body"], har.log.entries.reverse().map(e => {
+			const status = el("span", e.response.status || "error");
+			if (!(e.response.status >= 200 && e.response.status < 300)) status.className = "error";
+			return [e.startedDateTime, e.comment, e.request.method + " " + e.request.url, status, Math.round(e.time),
+				pre(e.request.postData ? e.request.postData.text : ""), pre(e.response.content.text)];
+		}));
+	},
+};
+async function refresh() {
+	try {
+		const content = await renderers[tab]();
+		document.getElementById("content").replaceChildren(content);
+	} catch (err) {
+		document.getElementById("content").replaceChildren(el("p", "Failed to load: " + err));
+	}
+}
+document.querySelectorAll("nav button").forEach(b => b.onclick = () => {
+	document.querySelectorAll("nav button").forEach(o => o.classList.remove("active"));
+	b.classList.add("active");
+	tab = b.dataset.tab;
+	refresh();
+});
+setInterval(() => { if (document.getElementById("live").checked) refresh(); }, 2000);
+refresh();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,119 @@
+package complement
+
+import (
+	"sort"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/ct"
+)
+
+// DeployOpt is an option for Deploy.
+type DeployOpt func(*deployOpts)
+
+type deployOpts struct {
+	// hs name => env var => value
+	env map[string]map[string]string
+	// mock servers to start for the deployment
+	emailServer   bool
+	captchaServer bool
+	turnServer    bool
+}
+
+func newDeployOpts(opts []DeployOpt) *deployOpts {
+	var dopts deployOpts
+	for _, opt := range opts {
+		opt(&dopts)
+	}
+	return &dopts
+}
+
+// perDeployment returns true if the options need a deployment of their own, so cannot be applied to
+// dirty or warm pool deployments which are shared between tests.
+func (opts *deployOpts) perDeployment() bool {
+	return len(opts.env) > 0 || opts.emailServer || opts.captchaServer || opts.turnServer
+}
+
+// WithEnv sets environment variables on the homeserver `hsName` of a deployment, so a test can toggle
+// homeserver features without needing a new blueprint image e.g
+//
+//	complement.Deploy(t, 1, complement.WithEnv("hs1", map[string]string{"SYNAPSE_EXPERIMENTAL_MSC4222": "1"}))
+//
+// What each environment variable does is up to the homeserver image. Can be given several times, with
+// later values taking precedence. Only supported by Docker deployments: the test is skipped otherwise.
+// Deployments with environment variables are never dirty, even with COMPLEMENT_ENABLE_DIRTY_RUNS.
+func WithEnv(hsName string, env map[string]string) DeployOpt {
+	return func(opts *deployOpts) {
+		if opts.env == nil {
+			opts.env = make(map[string]map[string]string)
+		}
+		if opts.env[hsName] == nil {
+			opts.env[hsName] = make(map[string]string)
+		}
+		for k, v := range env {
+			opts.env[hsName][k] = v
+		}
+	}
+}
+
+// WithEmailServer starts an SMTP server which captures the emails sent by the homeservers of the
+// deployment, available via EmailServer. The homeserver image must configure email sending using
+// COMPLEMENT_SMTP_HOST and COMPLEMENT_SMTP_PORT. Only supported by Docker deployments.
+func WithEmailServer() DeployOpt {
+	return func(opts *deployOpts) {
+		opts.emailServer = true
+	}
+}
+
+// WithCaptchaServer starts a reCAPTCHA verification server for the homeservers of the deployment,
+// available via CaptchaServer. The homeserver image must configure captchas using the
+// COMPLEMENT_RECAPTCHA_* environment variables. Only supported by Docker deployments.
+func WithCaptchaServer() DeployOpt {
+	return func(opts *deployOpts) {
+		opts.captchaServer = true
+	}
+}
+
+// WithTURNServer starts a TURN server for the homeservers of the deployment, if COMPLEMENT_TURN_IMAGE is
+// set. The homeserver image must configure TURN using COMPLEMENT_TURN_URIS and
+// COMPLEMENT_TURN_SHARED_SECRET. Only supported by Docker deployments.
+func WithTURNServer() DeployOpt {
+	return func(opts *deployOpts) {
+		opts.turnServer = true
+	}
+}
+
+// applyDeployOpts sets the options on the homeservers of the blueprint, failing the test if they refer
+// to homeservers which are not in the blueprint.
+func applyDeployOpts(t ct.TestLike, blueprint b.Blueprint, opts *deployOpts) b.Blueprint {
+	t.Helper()
+	for hsName, env := range opts.env {
+		found := false
+		for i := range blueprint.Homeservers {
+			hs := &blueprint.Homeservers[i]
+			if hs.Name != hsName {
+				continue
+			}
+			found = true
+			hs.Env = append([]string{}, hs.Env...)
+			keys := make([]string, 0, len(env))
+			for k := range env {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				hs.Env = append(hs.Env, k+"="+env[k])
+			}
+		}
+		if !found {
+			ct.Fatalf(t, "WithEnv: homeserver '%s' is not in the deployment", hsName)
+		}
+	}
+	blueprint.EmailServer = blueprint.EmailServer || opts.emailServer
+	blueprint.CaptchaServer = blueprint.CaptchaServer || opts.captchaServer
+	blueprint.TURNServer = blueprint.TURNServer || opts.turnServer
+	blueprint, err := b.Validate(blueprint)
+	if err != nil {
+		ct.Fatalf(t, "WithEnv: %s", err)
+	}
+	return blueprint
+}
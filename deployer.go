@@ -0,0 +1,438 @@
+package complement
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/external"
+	"github.com/matrix-org/complement/internal/kube"
+	"github.com/matrix-org/complement/internal/process"
+)
+
+// ErrUnsupported is returned by a Deployer for operations it cannot perform. Tests which need the
+// operation are skipped rather than failed.
+var ErrUnsupported = errors.New("not supported by this deployer")
+
+// Deployer is a backend which creates homeservers for a test package. Homeservers are deployed as
+// Docker containers by default, as pods in COMPLEMENT_KUBE_NAMESPACE if set, as local processes if
+// COMPLEMENT_PROCESS_COMMAND is set, or attached to the servers in COMPLEMENT_EXTERNAL_HOMESERVERS if set.
+// See internal/kube and internal/process for examples of backends other than Docker. Further backends
+// can be maintained out of tree by implementing this interface and passing it to TestMain via WithDeployer.
+//
+// Deployments returned by Deploy must name their homeservers after those in the blueprint (`hs1`, `hs2`, etc).
+type Deployer interface {
+	// Construct prepares everything needed to deploy the blueprint e.g building images with the blueprint's
+	// users and rooms. It is called before every Deploy, so should be cheap if the blueprint is already constructed.
+	Construct(ctx context.Context, blueprint b.Blueprint) error
+	// Deploy creates running homeservers for a constructed blueprint.
+	Deploy(ctx context.Context, blueprint b.Blueprint) (Deployment, error)
+	// Destroy tears down a deployment created by this deployer. It is used when a deployment outlives the
+	// test which created it, e.g shared deployments which are still referenced at the end of the package.
+	// `testName` and `failed` describe the test(s) which used the deployment.
+	Destroy(dep Deployment, printServerLogs bool, testName string, failed bool)
+	// Restart the named homeserver in the deployment, keeping its data.
+	Restart(dep Deployment, hsName string) error
+	// PauseHS suspends the named homeserver, keeping its data in memory and its ports allocated.
+	PauseHS(dep Deployment, hsName string) error
+	// UnpauseHS resumes a homeserver previously suspended via PauseHS.
+	UnpauseHS(dep Deployment, hsName string) error
+	// NetworkOps returns the network operations supported by this deployer, or nil if there are none.
+	NetworkOps() NetworkOps
+	// Cleanup is called once all tests in the package have run.
+	Cleanup()
+}
+
+// NetworkOps controls the network between homeservers in a deployment.
+type NetworkOps interface {
+	// Network returns the name of the network the deployment's homeservers are attached to, so
+	// additional services can be attached to it.
+	Network(dep Deployment) string
+	// DisconnectHS partitions the named homeserver from the other homeservers in the deployment. It
+	// must remain reachable by clients.
+	DisconnectHS(dep Deployment, hsName string) error
+	// ConnectHS reconnects a homeserver previously partitioned via DisconnectHS.
+	ConnectHS(dep Deployment, hsName string) error
+	// SetNetworkConditions degrades the federation traffic sent by the named homeserver, replacing any
+	// conditions previously set. Zero conditions restore the network.
+	SetNetworkConditions(dep Deployment, hsName string, cond NetworkConditions) error
+}
+
+// NewDockerDeployer returns the default Deployer, which deploys homeservers as Docker containers. Stale
+// containers, networks and images from previous runs of this package are removed.
+func NewDockerDeployer(cfg *config.Complement) (Deployer, error) {
+	builder, err := docker.NewBuilder(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make docker builder: %w", err)
+	}
+	// remove any old images/containers/networks in case we died horribly before
+	builder.CleanupStale()
+	return &dockerDeployer{
+		config:               cfg,
+		complementBuilder:    builder,
+		existingDeploymentMu: &sync.Mutex{},
+	}, nil
+}
+
+// dockerDeployer deploys homeservers as Docker containers.
+type dockerDeployer struct {
+	config *config.Complement
+	// the builder we'll use to make containers
+	complementBuilder *docker.Builder
+	// a counter to stop tests from allocating the same container name
+	namespaceCounter uint64
+
+	// pointers to existing deployments for Deploy(t, 1) style deployments which are reused when run
+	// in dirty mode.
+	existingDeployment   *docker.Deployment
+	existingDeploymentMu *sync.Mutex
+}
+
+func (dd *dockerDeployer) Construct(ctx context.Context, blueprint b.Blueprint) error {
+	return dd.complementBuilder.ConstructBlueprintIfNotExist(blueprint)
+}
+
+func (dd *dockerDeployer) Deploy(ctx context.Context, blueprint b.Blueprint) (Deployment, error) {
+	namespace := fmt.Sprintf("%d", atomic.AddUint64(&dd.namespaceCounter, 1))
+	d, err := docker.NewDeployer(namespace, dd.config)
+	if err != nil {
+		return nil, fmt.Errorf("NewDeployer returned error %s", err)
+	}
+	opts := make(map[string]docker.HomeserverOpts)
+	for _, hs := range blueprint.Homeservers {
+		opts[hs.Name] = docker.HomeserverOpts{Sidecars: hs.Sidecars, Env: hs.Env, Mounts: hs.Mounts}
+	}
+	d.MockServers = docker.MockServers{
+		Email:   blueprint.EmailServer,
+		Captcha: blueprint.CaptchaServer,
+		TURN:    blueprint.TURNServer,
+	}
+	return d.DeployWithOpts(ctx, blueprint.Name, opts)
+}
+
+func (dd *dockerDeployer) Destroy(dep Deployment, printServerLogs bool, testName string, failed bool) {
+	dockerDep, ok := unwrapDeployment(dep).(*docker.Deployment)
+	if !ok || dockerDep.Dirty {
+		return
+	}
+	dockerDep.Deployer.Destroy(dockerDep, printServerLogs, testName, failed)
+	dockerDep.Deployer.StopMockServers()
+}
+
+func (dd *dockerDeployer) Restart(dep Deployment, hsName string) error {
+	return dd.withServer(dep, hsName, func(d *docker.Deployer, hsDep *docker.HomeserverDeployment) error {
+		return d.Restart(hsDep)
+	})
+}
+
+func (dd *dockerDeployer) PauseHS(dep Deployment, hsName string) error {
+	return dd.withServer(dep, hsName, func(d *docker.Deployer, hsDep *docker.HomeserverDeployment) error {
+		return d.PauseServer(hsDep)
+	})
+}
+
+func (dd *dockerDeployer) UnpauseHS(dep Deployment, hsName string) error {
+	return dd.withServer(dep, hsName, func(d *docker.Deployer, hsDep *docker.HomeserverDeployment) error {
+		return d.UnpauseServer(hsDep)
+	})
+}
+
+func (dd *dockerDeployer) NetworkOps() NetworkOps {
+	return dd
+}
+
+func (dd *dockerDeployer) Network(dep Deployment) string {
+	return dep.Network()
+}
+
+func (dd *dockerDeployer) DisconnectHS(dep Deployment, hsName string) error {
+	return dd.withServer(dep, hsName, func(d *docker.Deployer, hsDep *docker.HomeserverDeployment) error {
+		return d.DisconnectServer(hsDep)
+	})
+}
+
+func (dd *dockerDeployer) ConnectHS(dep Deployment, hsName string) error {
+	return dd.withServer(dep, hsName, func(d *docker.Deployer, hsDep *docker.HomeserverDeployment) error {
+		return d.ConnectServer(hsDep, hsName)
+	})
+}
+
+func (dd *dockerDeployer) SetNetworkConditions(dep Deployment, hsName string, cond NetworkConditions) error {
+	return dd.withServer(dep, hsName, func(d *docker.Deployer, hsDep *docker.HomeserverDeployment) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		return d.SetNetworkConditions(ctx, hsDep, docker.NetworkConditions(cond))
+	})
+}
+
+// withServer calls fn with the docker deployer and homeserver for `hsName` in the deployment.
+func (dd *dockerDeployer) withServer(dep Deployment, hsName string, fn func(d *docker.Deployer, hsDep *docker.HomeserverDeployment) error) error {
+	dockerDep, ok := unwrapDeployment(dep).(*docker.Deployment)
+	if !ok {
+		return fmt.Errorf("deployment %T was not created by the docker deployer", dep)
+	}
+	hsDep := dockerDep.HS[hsName]
+	if hsDep == nil {
+		return fmt.Errorf("%s does not exist in this deployment", hsName)
+	}
+	return fn(dockerDep.Deployer, hsDep)
+}
+
+func (dd *dockerDeployer) Cleanup() {
+	// any dirty deployments need logs printed and post scripts run
+	dd.existingDeploymentMu.Lock()
+	if dd.existingDeployment != nil {
+		dd.existingDeployment.DestroyAtCleanup()
+	}
+	dd.existingDeploymentMu.Unlock()
+	dd.complementBuilder.Cleanup()
+}
+
+func (dd *dockerDeployer) dirtyDeploy(t ct.TestLike, numServers int) Deployment {
+	dd.existingDeploymentMu.Lock()
+	defer dd.existingDeploymentMu.Unlock()
+	// do we even have a deployment?
+	if dd.existingDeployment == nil {
+		d, err := docker.NewDeployer("dirty", dd.config)
+		if err != nil {
+			ct.Fatalf(t, "dirtyDeploy: NewDeployer returned error %s", err)
+		}
+		// this creates a single hs1
+		dd.existingDeployment, err = d.CreateDirtyDeployment()
+		if err != nil {
+			ct.Fatalf(t, "CreateDirtyDeployment failed: %s", err)
+		}
+	}
+
+	// if we have an existing deployment, can we use it? We can use it if we have at least that number of servers deployed already.
+	if len(dd.existingDeployment.HS) >= numServers {
+		return dd.existingDeployment
+	}
+
+	// we need to scale up the dirty deployment to more servers. Use the same deployer so all servers
+	// share the same email server.
+	d := dd.existingDeployment.Deployer
+	for i := 1; i <= numServers; i++ {
+		hsName := fmt.Sprintf("hs%d", i)
+		_, ok := dd.existingDeployment.HS[hsName]
+		if ok {
+			continue
+		}
+		// scale up
+		hsDep, err := d.CreateDirtyServer(hsName)
+		if err != nil {
+			ct.Fatalf(t, "dirtyDeploy: failed to add %s: %s", hsName, err)
+		}
+		dd.existingDeployment.HS[hsName] = hsDep
+	}
+
+	return dd.existingDeployment
+}
+
+// externalDeployer attaches to the already-running homeservers in COMPLEMENT_EXTERNAL_HOMESERVERS.
+// Blueprints with users, rooms, application services or plugins cannot be constructed, and nothing is destroyed.
+type externalDeployer struct {
+	config *config.Complement
+}
+
+func (ed *externalDeployer) Construct(ctx context.Context, blueprint b.Blueprint) error {
+	if !isCleanBlueprint(blueprint) {
+		return fmt.Errorf("blueprint %s cannot be deployed to external homeservers (COMPLEMENT_EXTERNAL_HOMESERVERS): %w", blueprint.Name, ErrUnsupported)
+	}
+	return nil
+}
+
+func (ed *externalDeployer) Deploy(ctx context.Context, blueprint b.Blueprint) (Deployment, error) {
+	dep, err := external.NewDeployment(ed.config, len(blueprint.Homeservers))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", err, ErrUnsupported)
+	}
+	return dep, nil
+}
+
+func (ed *externalDeployer) Destroy(dep Deployment, printServerLogs bool, testName string, failed bool) {
+}
+
+func (ed *externalDeployer) Restart(dep Deployment, hsName string) error {
+	return ErrUnsupported
+}
+
+func (ed *externalDeployer) PauseHS(dep Deployment, hsName string) error {
+	return ErrUnsupported
+}
+
+func (ed *externalDeployer) UnpauseHS(dep Deployment, hsName string) error {
+	return ErrUnsupported
+}
+
+func (ed *externalDeployer) NetworkOps() NetworkOps {
+	return nil
+}
+
+func (ed *externalDeployer) Cleanup() {}
+
+// NewKubeDeployer returns a Deployer which deploys homeservers as pods in COMPLEMENT_KUBE_NAMESPACE via
+// kubectl. Only blueprints of clean homeservers can be deployed, as constructing blueprints needs Docker.
+func NewKubeDeployer(cfg *config.Complement) (Deployer, error) {
+	d, err := kube.NewDeployer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make kubernetes deployer: %w", err)
+	}
+	return &kubeDeployer{deployer: d}, nil
+}
+
+// kubeDeployer deploys homeservers as pods in a Kubernetes namespace.
+type kubeDeployer struct {
+	deployer *kube.Deployer
+}
+
+func (kd *kubeDeployer) Construct(ctx context.Context, blueprint b.Blueprint) error {
+	if !isCleanBlueprint(blueprint) {
+		return fmt.Errorf("blueprint %s cannot be deployed to kubernetes (COMPLEMENT_KUBE_NAMESPACE): %w", blueprint.Name, ErrUnsupported)
+	}
+	return nil
+}
+
+func (kd *kubeDeployer) Deploy(ctx context.Context, blueprint b.Blueprint) (Deployment, error) {
+	dep, err := kd.deployer.Deploy(ctx, len(blueprint.Homeservers))
+	if err != nil {
+		kd.deployer.Destroy(dep, true)
+		return nil, err
+	}
+	return dep, nil
+}
+
+func (kd *kubeDeployer) Destroy(dep Deployment, printServerLogs bool, testName string, failed bool) {
+	kubeDep, ok := unwrapDeployment(dep).(*kube.Deployment)
+	if !ok {
+		return
+	}
+	kd.deployer.Destroy(kubeDep, printServerLogs)
+}
+
+func (kd *kubeDeployer) Restart(dep Deployment, hsName string) error {
+	return ErrUnsupported
+}
+
+func (kd *kubeDeployer) PauseHS(dep Deployment, hsName string) error {
+	return ErrUnsupported
+}
+
+func (kd *kubeDeployer) UnpauseHS(dep Deployment, hsName string) error {
+	return ErrUnsupported
+}
+
+func (kd *kubeDeployer) NetworkOps() NetworkOps {
+	return nil
+}
+
+func (kd *kubeDeployer) Cleanup() {
+	kd.deployer.Cleanup()
+}
+
+// NewProcessDeployer returns a Deployer which runs homeservers as local processes with
+// COMPLEMENT_PROCESS_COMMAND. Only blueprints of clean homeservers can be deployed, as constructing
+// blueprints needs Docker.
+func NewProcessDeployer(cfg *config.Complement) (Deployer, error) {
+	d, err := process.NewDeployer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make process deployer: %w", err)
+	}
+	return &processDeployer{deployer: d}, nil
+}
+
+// processDeployer runs homeservers as local processes.
+type processDeployer struct {
+	deployer *process.Deployer
+}
+
+func (pd *processDeployer) Construct(ctx context.Context, blueprint b.Blueprint) error {
+	if !isCleanBlueprint(blueprint) {
+		return fmt.Errorf("blueprint %s cannot be deployed as local processes (COMPLEMENT_PROCESS_COMMAND): %w", blueprint.Name, ErrUnsupported)
+	}
+	return nil
+}
+
+func (pd *processDeployer) Deploy(ctx context.Context, blueprint b.Blueprint) (Deployment, error) {
+	dep, err := pd.deployer.Deploy(ctx, len(blueprint.Homeservers))
+	if err != nil {
+		pd.deployer.Destroy(dep, true)
+		return nil, err
+	}
+	return dep, nil
+}
+
+func (pd *processDeployer) Destroy(dep Deployment, printServerLogs bool, testName string, failed bool) {
+	processDep, ok := unwrapDeployment(dep).(*process.Deployment)
+	if !ok {
+		return
+	}
+	pd.deployer.Destroy(processDep, printServerLogs)
+}
+
+func (pd *processDeployer) Restart(dep Deployment, hsName string) error {
+	return pd.withServer(dep, hsName, pd.deployer.Restart)
+}
+
+func (pd *processDeployer) PauseHS(dep Deployment, hsName string) error {
+	return pd.withServer(dep, hsName, pd.deployer.Pause)
+}
+
+func (pd *processDeployer) UnpauseHS(dep Deployment, hsName string) error {
+	return pd.withServer(dep, hsName, pd.deployer.Unpause)
+}
+
+// withServer calls fn with the server for `hsName` in the deployment.
+func (pd *processDeployer) withServer(dep Deployment, hsName string, fn func(hs *process.Server) error) error {
+	processDep, ok := unwrapDeployment(dep).(*process.Deployment)
+	if !ok {
+		return fmt.Errorf("deployment %T was not created by the process deployer", dep)
+	}
+	for _, hs := range processDep.Servers {
+		if hs.HSName == hsName {
+			return fn(hs)
+		}
+	}
+	return fmt.Errorf("%s does not exist in this deployment", hsName)
+}
+
+func (pd *processDeployer) NetworkOps() NetworkOps {
+	return nil
+}
+
+func (pd *processDeployer) Cleanup() {
+	pd.deployer.Cleanup()
+}
+
+// isCleanBlueprint returns true if the blueprint only has homeservers without users, rooms, application
+// services, plugins, sidecars, env vars, mounts or mock servers, so can be deployed without building images.
+func isCleanBlueprint(blueprint b.Blueprint) bool {
+	if blueprint.EmailServer || blueprint.CaptchaServer || blueprint.TURNServer {
+		return false
+	}
+	for _, hs := range blueprint.Homeservers {
+		if len(hs.Users) > 0 || len(hs.Rooms) > 0 || len(hs.ApplicationServices) > 0 || len(hs.Plugins) > 0 || len(hs.Sidecars) > 0 || len(hs.Env) > 0 || len(hs.Mounts) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// unwrapDeployment returns the deployment created by the deployer, for deployments which are wrapped
+// by Complement e.g shared deployments.
+func unwrapDeployment(dep Deployment) Deployment {
+	if sd, ok := dep.(*sharedDeployment); ok {
+		dep = sd.Deployment
+	}
+	if pd, ok := dep.(*pooledDeployment); ok {
+		dep = pd.Deployment
+	}
+	return dep
+}
@@ -0,0 +1,164 @@
+package complement
+
+import (
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/captcha"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/email"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/internal/docker"
+	"github.com/matrix-org/complement/internal/external"
+	"github.com/matrix-org/complement/internal/process"
+)
+
+// The interfaces in this file are optional features of a Deployment. Custom deployments do not need to
+// implement them, so tests should use the functions below rather than type-asserting the deployment,
+// which skip the test if the deployment does not support the feature.
+
+// Docker deployments support every feature. Users of external homeservers can be logged in by user ID,
+// and deployments of local processes can also be restarted.
+var (
+	_ EmailServerProvider   = (*docker.Deployment)(nil)
+	_ CaptchaServerProvider = (*docker.Deployment)(nil)
+	_ LabelsProvider        = (*docker.Deployment)(nil)
+	_ UserLoginProvider     = (*docker.Deployment)(nil)
+	_ ServerRestarter       = (*docker.Deployment)(nil)
+	_ Execer                = (*docker.Deployment)(nil)
+
+	_ UserLoginProvider = (*external.Deployment)(nil)
+	_ ServerRestarter   = (*process.Deployment)(nil)
+)
+
+// EmailServerProvider is implemented by deployments which capture the emails sent by their homeservers.
+type EmailServerProvider interface {
+	// EmailServer returns the SMTP server which captures emails sent by homeservers in this deployment.
+	// Homeservers are told how to connect to it via the COMPLEMENT_SMTP_HOST and COMPLEMENT_SMTP_PORT
+	// environment variables.
+	EmailServer(t ct.TestLike) *email.Server
+}
+
+// EmailServer returns the SMTP server which captures emails sent by homeservers in the deployment, which
+// must have been deployed WithEmailServer. Skips the test if the deployment does not implement
+// EmailServerProvider.
+func EmailServer(t ct.TestLike, deployment Deployment) *email.Server {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(EmailServerProvider)
+	if !ok {
+		t.Skipf("EmailServer: deployment %T does not capture emails", deployment)
+	}
+	return dep.EmailServer(t)
+}
+
+// CaptchaServerProvider is implemented by deployments which control the captchas of their homeservers.
+type CaptchaServerProvider interface {
+	// CaptchaServer returns the reCAPTCHA verification server used by homeservers in this deployment.
+	// Homeservers are told how to use it via the COMPLEMENT_RECAPTCHA_SITEVERIFY_URL,
+	// COMPLEMENT_RECAPTCHA_PUBLIC_KEY and COMPLEMENT_RECAPTCHA_PRIVATE_KEY environment variables.
+	CaptchaServer(t ct.TestLike) *captcha.Server
+}
+
+// CaptchaServer returns the reCAPTCHA verification server used by homeservers in the deployment, which
+// must have been deployed WithCaptchaServer. Skips the test if the deployment does not implement
+// CaptchaServerProvider.
+func CaptchaServer(t ct.TestLike, deployment Deployment) *captcha.Server {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(CaptchaServerProvider)
+	if !ok {
+		t.Skipf("CaptchaServer: deployment %T does not control captchas", deployment)
+	}
+	return dep.CaptchaServer(t)
+}
+
+// LabelsProvider is implemented by deployments whose homeservers were deployed from images built from a
+// blueprint.
+type LabelsProvider interface {
+	// Labels returns the labels of the image the given HS was deployed from, which contain the data
+	// created when building the blueprint e.g access tokens, device IDs and Homeserver.Metadata.
+	// Fails the test if there is no container for the given HS name.
+	Labels(t ct.TestLike, hsName string) b.Labels
+}
+
+// Labels returns the labels of the image the homeserver `hsName` was deployed from. Skips the test if
+// the deployment does not implement LabelsProvider.
+func Labels(t ct.TestLike, deployment Deployment, hsName string) b.Labels {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(LabelsProvider)
+	if !ok {
+		t.Skipf("Labels: deployment %T has no image labels", deployment)
+	}
+	return dep.Labels(t, hsName)
+}
+
+// UserLoginProvider is implemented by deployments which can log in as existing users by user ID, e.g
+// users created by blueprints.
+type UserLoginProvider interface {
+	// LoginUser logs in to an existing user account on the given server by user ID, creating a new device
+	// (or using opts.DeviceID). If `password` is empty, the password of the blueprint user is used, so
+	// users created by blueprints can be logged in as without manual /login plumbing.
+	LoginUser(t ct.TestLike, hsName, userID, password string, opts helpers.LoginOpts) *client.CSAPI
+	// LoginDevices logs in to an existing user account `numDevices` times, returning a client for each new
+	// device. `password` behaves as in LoginUser.
+	LoginDevices(t ct.TestLike, hsName, userID, password string, numDevices int) []*client.CSAPI
+}
+
+// LoginUser logs in to the existing user `userID` on the homeserver `hsName`. See
+// UserLoginProvider.LoginUser. Skips the test if the deployment does not implement UserLoginProvider.
+func LoginUser(t ct.TestLike, deployment Deployment, hsName, userID, password string, opts helpers.LoginOpts) *client.CSAPI {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(UserLoginProvider)
+	if !ok {
+		t.Skipf("LoginUser: deployment %T cannot log in by user ID", deployment)
+	}
+	return dep.LoginUser(t, hsName, userID, password, opts)
+}
+
+// LoginDevices logs in to the existing user `userID` on the homeserver `hsName` `numDevices` times. See
+// UserLoginProvider.LoginDevices. Skips the test if the deployment does not implement UserLoginProvider.
+func LoginDevices(t ct.TestLike, deployment Deployment, hsName, userID, password string, numDevices int) []*client.CSAPI {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(UserLoginProvider)
+	if !ok {
+		t.Skipf("LoginDevices: deployment %T cannot log in by user ID", deployment)
+	}
+	return dep.LoginDevices(t, hsName, userID, password, numDevices)
+}
+
+// ServerRestarter is implemented by deployments which can restart individual homeservers.
+type ServerRestarter interface {
+	// RestartServer stops and starts the named homeserver, keeping its data, so tests can assert that
+	// state such as device lists or outstanding federation transactions survives a restart. The CSAPI
+	// URL may change, but clients created via this deployment are updated to use the new URL. Fails
+	// the test if there is a problem restarting.
+	RestartServer(t ct.TestLike, hsName string)
+}
+
+// RestartServer restarts the homeserver `hsName`, keeping its data. See ServerRestarter.RestartServer.
+// Skips the test if the deployment does not implement ServerRestarter.
+func RestartServer(t ct.TestLike, deployment Deployment, hsName string) {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(ServerRestarter)
+	if !ok {
+		t.Skipf("RestartServer: deployment %T cannot restart homeservers", deployment)
+	}
+	dep.RestartServer(t, hsName)
+}
+
+// Execer is implemented by deployments which can run commands alongside their homeservers.
+type Execer interface {
+	// Exec runs a command in the container of the given HS and waits up to a minute for it to exit, returning
+	// its output and exit code, so tests can e.g poke the database or trigger admin scripts. A non-zero exit
+	// code does not fail the test. Fails the test if the command cannot be run.
+	Exec(t ct.TestLike, hsName string, cmd ...string) (stdout, stderr string, exitCode int)
+}
+
+// Exec runs a command in the container of the homeserver `hsName`. See Execer.Exec. Skips the test if
+// the deployment does not implement Execer.
+func Exec(t ct.TestLike, deployment Deployment, hsName string, cmd ...string) (stdout, stderr string, exitCode int) {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(Execer)
+	if !ok {
+		t.Skipf("Exec: deployment %T cannot run commands in homeserver containers", deployment)
+	}
+	return dep.Exec(t, hsName, cmd...)
+}
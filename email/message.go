@@ -0,0 +1,132 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var linkRegex = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+// Message is an email received by the server.
+type Message struct {
+	// The envelope sender and recipients, from MAIL FROM and RCPT TO.
+	From string
+	To   []string
+	// The headers of the email.
+	Header  mail.Header
+	Subject string
+	// The decoded text/plain and text/html bodies. Either may be empty, depending on what the homeserver sent.
+	Text string
+	HTML string
+	// The raw email as sent over SMTP.
+	Raw []byte
+}
+
+// Links returns all http(s) links in the email, in order. The text body is used if present,
+// otherwise the HTML body.
+func (m *Message) Links() []string {
+	body := m.Text
+	if body == "" {
+		body = m.HTML
+	}
+	links := linkRegex.FindAllString(body, -1)
+	for i := range links {
+		links[i] = strings.ReplaceAll(links[i], "&amp;", "&")
+	}
+	return links
+}
+
+// LinkWithQueryParam returns the first link in the email which has the given query parameter, such as
+// the "token" of a validation link. Returns nil if no link has the parameter.
+func (m *Message) LinkWithQueryParam(param string) *url.URL {
+	for _, link := range m.Links() {
+		u, err := url.Parse(link)
+		if err != nil {
+			continue
+		}
+		if u.Query().Has(param) {
+			return u
+		}
+	}
+	return nil
+}
+
+func parseMessage(from string, to []string, raw []byte) (*Message, error) {
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		subject = parsed.Header.Get("Subject")
+	}
+	msg := &Message{
+		From:    from,
+		To:      to,
+		Header:  parsed.Header,
+		Subject: subject,
+		Raw:     raw,
+	}
+	if err := msg.readPart(parsed.Header.Get("Content-Type"), parsed.Header.Get("Content-Transfer-Encoding"), parsed.Body); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// readPart decodes a MIME part, recursing into multipart bodies, and stores the first text/plain and
+// text/html bodies found.
+func (m *Message) readPart(contentType, transferEncoding string, body io.Reader) error {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid Content-Type '%s': %w", contentType, err)
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// multipart.Reader transparently decodes quoted-printable and removes the header
+			if err := m.readPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part); err != nil {
+				return err
+			}
+		}
+	}
+	switch strings.ToLower(transferEncoding) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	decoded, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	switch mediaType {
+	case "text/plain":
+		if m.Text == "" {
+			m.Text = string(decoded)
+		}
+	case "text/html":
+		if m.HTML == "" {
+			m.HTML = string(decoded)
+		}
+	}
+	return nil
+}
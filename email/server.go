@@ -0,0 +1,238 @@
+// package email contains an SMTP server which captures emails sent by homeservers, so tests can
+// assert on email-based flows such as registration, password resets and adding 3PIDs.
+//
+// Every deployment starts its own server. Homeservers are told where it is via the environment
+// variables COMPLEMENT_SMTP_HOST and COMPLEMENT_SMTP_PORT, which images should use to configure
+// their email sending. The server does not support TLS.
+package email
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// Server is an SMTP server which accepts every email sent to it and stores it in memory.
+type Server struct {
+	// The hostname homeservers should use to connect to this server.
+	Host string
+	// The port this server is listening on.
+	Port int
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	messages []*Message
+	// closed and replaced whenever a message is received, to wake up waiters
+	notify chan struct{}
+}
+
+// NewServer starts an SMTP server on a random high-numbered port. `hostname` is the hostname of the
+// machine running Complement from the perspective of the homeservers.
+func NewServer(hostname string) (*Server, error) {
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		return nil, fmt.Errorf("email.NewServer: net.Listen failed: %w", err)
+	}
+	s := &Server{
+		Host:     hostname,
+		Port:     ln.Addr().(*net.TCPAddr).Port,
+		listener: ln,
+		notify:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Env returns the environment variables which tell a homeserver how to connect to this server.
+func (s *Server) Env() []string {
+	return []string{
+		"COMPLEMENT_SMTP_HOST=" + s.Host,
+		fmt.Sprintf("COMPLEMENT_SMTP_PORT=%d", s.Port),
+	}
+}
+
+// Close stops accepting new connections. Emails which have already been received can still be read.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Messages returns all emails received so far, in the order they were received.
+func (s *Server) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message(nil), s.messages...)
+}
+
+// To returns a matcher for WaitForMessage which matches emails sent to the given address.
+func To(address string) func(msg *Message) bool {
+	return func(msg *Message) bool {
+		for _, to := range msg.To {
+			if strings.EqualFold(to, address) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// WaitForMessage waits until an email is received which matches `match`, and returns it. Emails received
+// before this function was called are also checked. Fails the test if no email matches within the timeout.
+func (s *Server) WaitForMessage(t ct.TestLike, timeout time.Duration, match func(msg *Message) bool) *Message {
+	t.Helper()
+	deadline := time.After(timeout)
+	checked := 0
+	for {
+		s.mu.Lock()
+		messages := s.messages
+		notify := s.notify
+		s.mu.Unlock()
+		for ; checked < len(messages); checked++ {
+			if match(messages[checked]) {
+				return messages[checked]
+			}
+		}
+		select {
+		case <-notify:
+		case <-deadline:
+			ct.Fatalf(t, "email.WaitForMessage: no matching email received after %v (received %d emails)", timeout, checked)
+			return nil
+		}
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *Server) receive(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// handleConn implements the subset of RFC 5321 which homeservers need to send emails.
+func (s *Server) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(time.Minute))
+	tp := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) bool {
+		return tp.PrintfLine(format, args...) == nil
+	}
+	if !reply("220 complement ESMTP") {
+		return
+	}
+	var from string
+	var to []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		var ok bool
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			ok = reply("250 complement")
+		case "EHLO":
+			ok = reply("250-complement") && reply("250-8BITMIME") && reply("250 AUTH PLAIN LOGIN")
+		case "AUTH":
+			// accept any credentials
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			if strings.EqualFold(mechanism, "LOGIN") {
+				// username then password, both base64
+				if !reply("334 VXNlcm5hbWU6") {
+					return
+				}
+				if _, err := tp.ReadLine(); err != nil {
+					return
+				}
+				if !reply("334 UGFzc3dvcmQ6") {
+					return
+				}
+				if _, err := tp.ReadLine(); err != nil {
+					return
+				}
+			} else if initial == "" {
+				if !reply("334 ") {
+					return
+				}
+				if _, err := tp.ReadLine(); err != nil {
+					return
+				}
+			}
+			ok = reply("235 Authentication successful")
+		case "MAIL":
+			from = parsePath(arg)
+			to = nil
+			ok = reply("250 OK")
+		case "RCPT":
+			to = append(to, parsePath(arg))
+			ok = reply("250 OK")
+		case "DATA":
+			if len(to) == 0 {
+				ok = reply("503 RCPT first")
+				break
+			}
+			if !reply("354 End data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			raw, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			msg, err := parseMessage(from, to, raw)
+			if err != nil {
+				ok = reply("554 Failed to parse message: %s", err)
+				break
+			}
+			s.receive(msg)
+			from, to = "", nil
+			ok = reply("250 OK")
+		case "RSET":
+			from, to = "", nil
+			ok = reply("250 OK")
+		case "NOOP":
+			ok = reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			ok = reply("502 Command not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// parsePath extracts the address from "FROM:<alice@example.org> SIZE=123" or "TO:<bob@example.org>".
+func parsePath(arg string) string {
+	_, path, _ := strings.Cut(arg, ":")
+	path = strings.TrimSpace(path)
+	if i := strings.Index(path, ">"); i != -1 {
+		path = path[:i]
+	}
+	return strings.TrimPrefix(path, "<")
+}
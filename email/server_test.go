@@ -0,0 +1,56 @@
+package email
+
+import (
+	"fmt"
+	"net/smtp"
+	"testing"
+	"time"
+)
+
+func TestServerCapturesMultipartEmail(t *testing.T) {
+	srv, err := NewServer("localhost")
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	defer srv.Close()
+
+	raw := "From: Complement <noreply@hs1>\r\n" +
+		"To: alice@example.org\r\n" +
+		"Subject: =?utf-8?q?Validate_your_email?=\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"XYZ\"\r\n" +
+		"\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Click here: http://hs1/_synapse/client/validate?token=3Dabc&client_secret=3Ds=\r\n" +
+		"ecret\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<a href=\"http://hs1/_synapse/client/validate?token=abc&amp;client_secret=secret\">Click</a>\r\n" +
+		"--XYZ--\r\n"
+	addr := fmt.Sprintf("localhost:%d", srv.Port)
+	if err := smtp.SendMail(addr, nil, "noreply@hs1", []string{"alice@example.org"}, []byte(raw)); err != nil {
+		t.Fatalf("SendMail: %s", err)
+	}
+
+	msg := srv.WaitForMessage(t, time.Second, To("Alice@example.org"))
+	if msg.Subject != "Validate your email" {
+		t.Errorf("Subject: got %q", msg.Subject)
+	}
+	if msg.From != "noreply@hs1" {
+		t.Errorf("From: got %q", msg.From)
+	}
+	link := msg.LinkWithQueryParam("token")
+	if link == nil {
+		t.Fatalf("no link with token in %q", msg.Text)
+	}
+	if link.Query().Get("token") != "abc" || link.Query().Get("client_secret") != "secret" {
+		t.Errorf("link: got %s", link)
+	}
+	if len(srv.Messages()) != 1 {
+		t.Errorf("Messages: got %d, want 1", len(srv.Messages()))
+	}
+}
@@ -0,0 +1,70 @@
+package complement
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// DeploymentEnvironment describes the effective configuration of a deployment, so failures can be
+// reproduced. Docker deployments write it to the artifact `environment.json` of the test when they are
+// destroyed, if COMPLEMENT_ARTIFACTS_DIR is set.
+type DeploymentEnvironment struct {
+	BlueprintName string                           `json:"blueprint_name"`
+	Homeservers   map[string]HomeserverEnvironment `json:"homeservers"`
+}
+
+// HomeserverEnvironment describes the container of a homeserver.
+type HomeserverEnvironment struct {
+	ContainerID string `json:"container_id"`
+	// The image the container was created from e.g localhost/complement:pkg.blueprint.hs1
+	Image string `json:"image"`
+	// The content-addressable ID of the image.
+	ImageID string `json:"image_id"`
+	// COMPLEMENT_BASE_IMAGE, or the COMPLEMENT_BASE_IMAGE_* override for this homeserver.
+	BaseImage string `json:"base_image"`
+	// The registry digests of the base image e.g ghcr.io/element-hq/synapse@sha256:...
+	// Empty if the base image was built locally.
+	BaseImageDigests []string `json:"base_image_digests"`
+	// The environment variables of the container.
+	Env []string `json:"env"`
+	// The host address each exposed port is published on, e.g "8008/tcp" => "127.0.0.1:32768".
+	Ports      map[string]string `json:"ports"`
+	Network    string            `json:"network"`
+	BaseURL    string            `json:"base_url"`
+	FedBaseURL string            `json:"fed_base_url"`
+}
+
+// GetDeploymentEnvironment returns the effective configuration of the deployment: the images, resolved
+// base image digests, environment variables, port mappings and network of each homeserver. Skips the
+// test if the deployment is not a Docker deployment.
+func GetDeploymentEnvironment(t ct.TestLike, deployment Deployment) DeploymentEnvironment {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(*docker.Deployment)
+	if !ok {
+		t.Skipf("GetDeploymentEnvironment: deployment %T is not a Docker deployment", deployment)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	env, err := dep.Deployer.Environment(ctx, dep)
+	if err != nil {
+		ct.Fatalf(t, "GetDeploymentEnvironment: %s", err)
+	}
+	result := DeploymentEnvironment{
+		BlueprintName: env.BlueprintName,
+		Homeservers:   make(map[string]HomeserverEnvironment, len(env.Homeservers)),
+	}
+	for hsName, hsEnv := range env.Homeservers {
+		result.Homeservers[hsName] = HomeserverEnvironment(hsEnv)
+	}
+	return result
+}
+
+// JSON returns the environment as indented JSON, e.g to attach to a bug report.
+func (e DeploymentEnvironment) JSON() []byte {
+	data, _ := json.MarshalIndent(e, "", "  ")
+	return data
+}
@@ -0,0 +1,150 @@
+package eventgen
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/federation"
+)
+
+// ApplyToClients performs the actions in the room using the CSAPI client for each sender, keyed by
+// user ID. The room must have been created as described on Generator. Fails the test if any
+// request is rejected.
+//
+// Returns the event ID of each message and redaction, indexed by the position of the action.
+// Other entries are left empty.
+func ApplyToClients(t ct.TestLike, roomID string, clients map[string]*client.CSAPI, actions []Action) []string {
+	t.Helper()
+	return applyToClients(t, roomID, nil, clients, actions)
+}
+
+func applyToClients(t ct.TestLike, roomID string, serverNames []spec.ServerName, clients map[string]*client.CSAPI, actions []Action) []string {
+	t.Helper()
+	eventIDs := make([]string, len(actions))
+	// the membership of each user after the actions so far, for users whose membership has changed
+	memberships := make(map[string]string)
+	for i, a := range actions {
+		c := clients[a.Sender]
+		if c == nil {
+			ct.Fatalf(t, "ApplyToClients: action #%d (%s): no client for sender", i, a)
+		}
+		switch a.Kind {
+		case ActionInvite, ActionKick, ActionBan, ActionUnban:
+			// Over federation, the sender's homeserver may not have seen the target's last change of
+			// membership yet, in which case it would reject the action.
+			if serverNames != nil && memberships[a.Target] != "" {
+				if err := waitForMembership(t, c, roomID, a.Target, memberships[a.Target]); err != nil {
+					ct.Fatalf(t, "ApplyToClients: action #%d (%s): %s", i, a, err)
+				}
+			}
+		}
+		switch a.Kind {
+		case ActionJoin:
+			c.MustJoinRoom(t, roomID, serverNames)
+		case ActionLeave:
+			c.MustLeaveRoom(t, roomID)
+		case ActionInvite:
+			c.MustInviteRoom(t, roomID, a.Target)
+		case ActionKick, ActionBan, ActionUnban:
+			c.MustDo(t, "POST", []string{"_matrix", "client", "v3", "rooms", roomID, string(a.Kind)}, client.WithJSONBody(t, map[string]interface{}{
+				"user_id": a.Target,
+			}))
+		case ActionSetPowerLevel:
+			var content map[string]interface{}
+			pl := c.MustGetStateEventContent(t, roomID, "m.room.power_levels", "")
+			if err := json.Unmarshal([]byte(pl.Raw), &content); err != nil {
+				ct.Fatalf(t, "ApplyToClients: action #%d (%s): failed to parse power levels: %s", i, a, err)
+			}
+			content["users"] = withUserLevel(content["users"], a.Target, a.PowerLevel)
+			c.MustDo(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "state", "m.room.power_levels", ""}, client.WithJSONBody(t, content))
+		case ActionMessage:
+			eventIDs[i] = c.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+				Type: "m.room.message",
+				Content: map[string]interface{}{
+					"msgtype": "m.text",
+					"body":    a.String(),
+				},
+			})
+		case ActionRedact:
+			eventIDs[i] = c.MustSendRedaction(t, roomID, map[string]interface{}{}, eventIDs[a.Redacts])
+		}
+		if membership, ok := actionMemberships[a.Kind]; ok {
+			memberships[a.Target] = membership
+		}
+	}
+	return eventIDs
+}
+
+// ApplyToServerRoom creates an event for each action in a room on the Complement federation server,
+// adding it to the room. Senders must be users on `srv`. The room must have been created with
+// federation.InitialRoomEvents, which matches the setup described on Generator. The events are not
+// sent to any homeserver: this is left to the caller, who may want to send them in a different
+// order or to different servers.
+//
+// Returns the event created for each action, indexed by the position of the action.
+func ApplyToServerRoom(t ct.TestLike, srv *federation.Server, room *federation.ServerRoom, actions []Action) []gomatrixserverlib.PDU {
+	t.Helper()
+	pdus := make([]gomatrixserverlib.PDU, len(actions))
+	for i, a := range actions {
+		ev := federation.Event{
+			Sender: a.Sender,
+		}
+		switch a.Kind {
+		case ActionJoin, ActionLeave, ActionInvite, ActionKick, ActionBan, ActionUnban:
+			ev.Type = "m.room.member"
+			ev.StateKey = b.Ptr(a.Target)
+			ev.Content = map[string]interface{}{
+				"membership": actionMemberships[a.Kind],
+			}
+		case ActionSetPowerLevel:
+			var content map[string]interface{}
+			if err := json.Unmarshal(room.CurrentState("m.room.power_levels", "").Content(), &content); err != nil {
+				ct.Fatalf(t, "ApplyToServerRoom: action #%d (%s): failed to parse power levels: %s", i, a, err)
+			}
+			content["users"] = withUserLevel(content["users"], a.Target, a.PowerLevel)
+			ev.Type = "m.room.power_levels"
+			ev.StateKey = b.Ptr("")
+			ev.Content = content
+		case ActionMessage:
+			ev.Type = "m.room.message"
+			ev.Content = map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    a.String(),
+			}
+		case ActionRedact:
+			ev.Type = "m.room.redaction"
+			ev.Content = map[string]interface{}{}
+			ev.Redacts = pdus[a.Redacts].EventID()
+		}
+		pdus[i] = srv.MustCreateEvent(t, room, ev)
+		room.AddEvent(pdus[i])
+	}
+	return pdus
+}
+
+// actionMemberships is the membership of the target after each kind of membership action.
+var actionMemberships = map[ActionKind]string{
+	ActionJoin:   "join",
+	ActionLeave:  "leave",
+	ActionInvite: "invite",
+	ActionKick:   "leave",
+	ActionBan:    "ban",
+	ActionUnban:  "leave",
+}
+
+// withUserLevel returns a copy of the power levels `users` map with the level of `userID` set.
+func withUserLevel(users interface{}, userID string, level int64) map[string]interface{} {
+	out := make(map[string]interface{})
+	if existing, ok := users.(map[string]interface{}); ok {
+		for k, v := range existing {
+			out[k] = v
+		}
+	}
+	out[userID] = level
+	return out
+}
@@ -0,0 +1,114 @@
+package eventgen
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// CheckOpts configures Check.
+type CheckOpts struct {
+	// The seed for the first run. Each subsequent run uses the next seed. If 0, a time-based seed is
+	// used. The seed of a failing run is always logged so it can be reproduced.
+	Seed int64
+	// The number of random sequences to check. Defaults to 10.
+	Runs int
+	// The number of actions in each sequence. Defaults to 20.
+	Length int
+}
+
+// Check generates random action sequences and calls `property` with each one, failing the test if
+// the property returns an error. Failing sequences are shrunk to a minimal sequence which still
+// fails before being reported. As shrinking calls `property` many times, each call should set up
+// its own room rather than reusing state from an earlier call.
+//
+//	eventgen.Check(t, gen, eventgen.CheckOpts{}, func(actions []eventgen.Action) error {
+//		roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+//		eventgen.ApplyToClients(t, roomID, clients, actions)
+//		return checkSyncMatchesState(t, roomID)
+//	})
+func Check(t ct.TestLike, g *Generator, opts CheckOpts, property func(actions []Action) error) {
+	t.Helper()
+	if opts.Seed == 0 {
+		opts.Seed = time.Now().UnixNano()
+	}
+	if opts.Runs == 0 {
+		opts.Runs = 10
+	}
+	if opts.Length == 0 {
+		opts.Length = 20
+	}
+	for i := 0; i < opts.Runs; i++ {
+		seed := opts.Seed + int64(i)
+		actions := g.Generate(rand.New(rand.NewSource(seed)), opts.Length)
+		err := property(actions)
+		if err == nil {
+			continue
+		}
+		t.Logf("eventgen.Check: seed %d failed with %d actions, shrinking: %s", seed, len(actions), err)
+		shrunk := Shrink(g, actions, func(actions []Action) bool {
+			err = property(actions)
+			return err != nil
+		})
+		// re-run the minimal sequence to report its error, rather than the last attempted shrink
+		err = property(shrunk)
+		ct.Errorf(t, "eventgen.Check: property failed for seed %d: %v\nminimal failing sequence (%d actions):\n%s", seed, err, len(shrunk), Format(shrunk))
+		return
+	}
+}
+
+// Shrink returns the smallest valid subsequence of `actions` it can find for which `fails` still
+// returns true. Actions are removed in progressively smaller chunks, skipping any removal which
+// would make the sequence invalid. Removing a message also removes any redaction of it.
+func Shrink(g *Generator, actions []Action, fails func(actions []Action) bool) []Action {
+	for chunk := len(actions) / 2; chunk >= 1; {
+		removed := false
+		for start := 0; start+chunk <= len(actions); {
+			candidate := without(actions, start, start+chunk)
+			if g.Valid(candidate) == nil && fails(candidate) {
+				actions = candidate
+				removed = true
+				continue
+			}
+			start++
+		}
+		if !removed {
+			chunk /= 2
+		}
+	}
+	return actions
+}
+
+// Format returns a numbered list of the actions, for use in failure messages.
+func Format(actions []Action) string {
+	lines := make([]string, len(actions))
+	for i, a := range actions {
+		lines[i] = fmt.Sprintf("  #%d %s", i, a)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// without returns a copy of `actions` with the actions in [start, end) removed, renumbering
+// redactions and removing redactions of removed messages.
+func without(actions []Action, start, end int) []Action {
+	newIndex := make([]int, len(actions))
+	out := make([]Action, 0, len(actions))
+	for i, a := range actions {
+		newIndex[i] = -1
+		if i >= start && i < end {
+			continue
+		}
+		if a.Kind == ActionRedact {
+			if newIndex[a.Redacts] == -1 {
+				continue
+			}
+			a.Redacts = newIndex[a.Redacts]
+		}
+		newIndex[i] = len(out)
+		out = append(out, a)
+	}
+	return out
+}
@@ -0,0 +1,148 @@
+package eventgen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MembershipChurn are weights for Generator.Weights which only generate membership changes, with
+// joins and leaves more likely than invites, kicks and bans.
+var MembershipChurn = map[ActionKind]int{
+	ActionJoin:   4,
+	ActionLeave:  3,
+	ActionInvite: 2,
+	ActionKick:   1,
+	ActionBan:    1,
+	ActionUnban:  1,
+}
+
+// Memberships returns the membership of every user after the actions are applied to the room, as
+// "join", "invite", "leave" or "ban". Users who never joined are "leave".
+func (g *Generator) Memberships(actions []Action) map[string]string {
+	m := newModel(g)
+	for i, a := range actions {
+		m.apply(a, i)
+	}
+	memberships := map[string]string{g.Creator: "join"}
+	for _, userID := range g.Users {
+		memberships[userID] = "leave"
+		if membership := m.membership[userID]; membership != "" {
+			memberships[userID] = membership
+		}
+	}
+	return memberships
+}
+
+// ApplyToClientsVia is ApplyToClients for rooms whose users are spread across homeservers. Joins are
+// made via `serverNames`, which should include the creator's homeserver, as users on other
+// homeservers cannot join by room ID alone.
+func ApplyToClientsVia(t ct.TestLike, roomID string, serverNames []spec.ServerName, clients map[string]*client.CSAPI, actions []Action) []string {
+	t.Helper()
+	return applyToClients(t, roomID, serverNames, clients, actions)
+}
+
+// CheckMemberships waits until every client agrees that the room has the memberships `want`, as
+// returned by Generator.Memberships, returning an error describing the differences if they do not
+// agree within the client's SyncUntilTimeout. Joined users must see every membership via /members.
+// Invited users must see their invite in /sync. Other users can no longer see the room, so are not
+// checked. Use this after ApplyToClients to check that homeservers converge on the same state,
+// e.g as the property of Check.
+func CheckMemberships(t ct.TestLike, roomID string, clients map[string]*client.CSAPI, want map[string]string) error {
+	t.Helper()
+	userIDs := make([]string, 0, len(want))
+	for userID := range want {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	var errs []string
+	for _, userID := range userIDs {
+		c := clients[userID]
+		if c == nil {
+			return fmt.Errorf("CheckMemberships: no client for %s", userID)
+		}
+		switch want[userID] {
+		case "join":
+			if err := waitForMembers(t, c, roomID, want); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", userID, err))
+			}
+		case "invite":
+			// MustSyncUntil fails the test rather than returning an error, so check the latest sync
+			// response until the timeout ourselves.
+			err := pollUntil(c.SyncUntilTimeout, func() error {
+				res, _ := c.MustSync(t, client.SyncReq{})
+				return client.SyncInvitedTo(userID, roomID)(userID, res)
+			})
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", userID, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("CheckMemberships: clients disagree on the membership of room %s:\n%s", roomID, strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// waitForMembers waits until /members for the client has the memberships `want`.
+func waitForMembers(t ct.TestLike, c *client.CSAPI, roomID string, want map[string]string) error {
+	t.Helper()
+	return pollUntil(c.SyncUntilTimeout, func() error {
+		res := c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "members"})
+		got := make(map[string]string)
+		for _, ev := range gjson.ParseBytes(client.ParseJSON(t, res)).Get("chunk").Array() {
+			got[ev.Get("state_key").Str] = ev.Get("content.membership").Str
+		}
+		var diffs []string
+		for userID, membership := range want {
+			gotMembership := got[userID]
+			// users who never joined have no member event
+			if gotMembership == "" {
+				gotMembership = "leave"
+			}
+			if gotMembership != membership {
+				diffs = append(diffs, fmt.Sprintf("%s is %s, want %s", userID, gotMembership, membership))
+			}
+		}
+		if len(diffs) > 0 {
+			sort.Strings(diffs)
+			return fmt.Errorf("%s", strings.Join(diffs, ", "))
+		}
+		return nil
+	})
+}
+
+// waitForMembership waits until the client sees `userID` with the membership.
+func waitForMembership(t ct.TestLike, c *client.CSAPI, roomID, userID, membership string) error {
+	t.Helper()
+	return pollUntil(c.SyncUntilTimeout, func() error {
+		res := c.Do(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state", "m.room.member", userID})
+		body := client.ParseJSON(t, res)
+		if res.StatusCode != 200 {
+			return fmt.Errorf("%s does not see the membership of %s: HTTP %d %s", c.UserID, userID, res.StatusCode, string(body))
+		}
+		if got := gjson.GetBytes(body, "membership").Str; got != membership {
+			return fmt.Errorf("%s sees %s as %s, want %s", c.UserID, userID, got, membership)
+		}
+		return nil
+	})
+}
+
+// pollUntil calls `check` until it returns nil, returning its last error after `timeout`.
+func pollUntil(timeout time.Duration, check func() error) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,259 @@
+// package eventgen contains generators for random-but-valid sequences of room events, such as membership
+// churn, power level changes and redactions. These can be used to test properties of state resolution
+// and sync consistency probabilistically. Failing sequences can be shrunk to a minimal reproduction.
+package eventgen
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// ActionKind is the kind of change an Action makes to the room.
+type ActionKind string
+
+const (
+	ActionJoin          ActionKind = "join"
+	ActionLeave         ActionKind = "leave"
+	ActionInvite        ActionKind = "invite"
+	ActionKick          ActionKind = "kick"
+	ActionBan           ActionKind = "ban"
+	ActionUnban         ActionKind = "unban"
+	ActionSetPowerLevel ActionKind = "set_power_level"
+	ActionMessage       ActionKind = "message"
+	ActionRedact        ActionKind = "redact"
+)
+
+// Action is a single change to a room made by `Sender`.
+type Action struct {
+	Kind   ActionKind
+	Sender string
+	// The user affected by membership and power level changes.
+	Target string
+	// The new power level for ActionSetPowerLevel.
+	PowerLevel int64
+	// The index of the action in the sequence whose event should be redacted for ActionRedact.
+	Redacts int
+}
+
+func (a Action) String() string {
+	switch a.Kind {
+	case ActionMessage:
+		return fmt.Sprintf("%s: %s", a.Sender, a.Kind)
+	case ActionRedact:
+		return fmt.Sprintf("%s: %s action #%d", a.Sender, a.Kind, a.Redacts)
+	case ActionSetPowerLevel:
+		return fmt.Sprintf("%s: %s %s=%d", a.Sender, a.Kind, a.Target, a.PowerLevel)
+	}
+	return fmt.Sprintf("%s: %s %s", a.Sender, a.Kind, a.Target)
+}
+
+// Generator generates random sequences of actions which are valid according to the auth rules,
+// assuming the room was created by `Creator` with a public join rule and the default power levels
+// (ban, kick, invite and redact at 50 or lower), with no other users joined. Only the creator
+// changes power levels, and no other user is given more than 100.
+type Generator struct {
+	// The user who created the room. Always joined, and cannot leave or be demoted.
+	Creator string
+	// The other users which may be joined to the room.
+	Users []string
+	// Relative weights for each kind of action. If nil, all actions are equally likely.
+	Weights map[ActionKind]int
+	// True if the room version treats creators as privileged (v12+), in which case the creator
+	// can demote users who have been given power level 100.
+	PrivilegedCreators bool
+}
+
+// Generate returns `n` random actions using `rng`. The same seed always generates the same sequence.
+func (g *Generator) Generate(rng *rand.Rand, n int) []Action {
+	m := newModel(g)
+	kinds := g.kinds()
+	actions := make([]Action, 0, n)
+	// give up if we can't find a valid action after many attempts, which can happen if
+	// there are no users other than the creator and only membership actions are allowed.
+	for attempts := 0; len(actions) < n && attempts < 100*n; attempts++ {
+		a, ok := g.randomAction(rng, m, kinds[rng.Intn(len(kinds))], len(actions))
+		if !ok {
+			continue
+		}
+		m.apply(a, len(actions))
+		actions = append(actions, a)
+	}
+	return actions
+}
+
+// Valid returns nil if every action in the sequence is allowed by the auth rules, given the
+// initial room setup described on Generator.
+func (g *Generator) Valid(actions []Action) error {
+	m := newModel(g)
+	for i, a := range actions {
+		if err := m.check(a); err != nil {
+			return fmt.Errorf("action #%d (%s): %w", i, a, err)
+		}
+		m.apply(a, i)
+	}
+	return nil
+}
+
+func (g *Generator) kinds() []ActionKind {
+	all := []ActionKind{
+		ActionJoin, ActionLeave, ActionInvite, ActionKick, ActionBan, ActionUnban,
+		ActionSetPowerLevel, ActionMessage, ActionRedact,
+	}
+	if g.Weights == nil {
+		return all
+	}
+	var kinds []ActionKind
+	for _, k := range all {
+		for i := 0; i < g.Weights[k]; i++ {
+			kinds = append(kinds, k)
+		}
+	}
+	if len(kinds) == 0 {
+		return all
+	}
+	return kinds
+}
+
+func (g *Generator) randomAction(rng *rand.Rand, m *model, kind ActionKind, index int) (Action, bool) {
+	everyone := append([]string{g.Creator}, g.Users...)
+	a := Action{
+		Kind:   kind,
+		Sender: everyone[rng.Intn(len(everyone))],
+		Target: everyone[rng.Intn(len(everyone))],
+	}
+	switch kind {
+	case ActionJoin:
+		a.Sender = a.Target
+	case ActionLeave:
+		a.Sender = a.Target
+	case ActionSetPowerLevel:
+		levels := []int64{0, 50, 100}
+		a.PowerLevel = levels[rng.Intn(len(levels))]
+	case ActionRedact:
+		if len(m.redactable) == 0 {
+			return a, false
+		}
+		a.Redacts = m.redactable[rng.Intn(len(m.redactable))]
+	}
+	return a, m.check(a) == nil
+}
+
+// model tracks enough room state to work out whether an action is allowed.
+type model struct {
+	g           *Generator
+	membership  map[string]string
+	powerLevels map[string]int64
+	redactable  []int // indexes of messages which have not been redacted
+}
+
+func newModel(g *Generator) *model {
+	m := &model{
+		g:           g,
+		membership:  map[string]string{g.Creator: "join"},
+		powerLevels: map[string]int64{g.Creator: 100},
+	}
+	return m
+}
+
+func (m *model) level(userID string) int64 {
+	if userID == m.g.Creator {
+		return 100
+	}
+	return m.powerLevels[userID]
+}
+
+func (m *model) check(a Action) error {
+	if m.membership[a.Sender] != "join" && a.Kind != ActionJoin {
+		return fmt.Errorf("sender is not joined")
+	}
+	target := m.membership[a.Target]
+	switch a.Kind {
+	case ActionJoin:
+		if a.Sender != a.Target || target == "join" || target == "ban" {
+			return fmt.Errorf("cannot join from membership '%s'", target)
+		}
+	case ActionLeave:
+		if a.Sender != a.Target || a.Sender == m.g.Creator {
+			return fmt.Errorf("only non-creators can leave")
+		}
+	case ActionInvite:
+		if target == "join" || target == "ban" || target == "invite" {
+			return fmt.Errorf("cannot invite from membership '%s'", target)
+		}
+		// some servers default invite to 50 for public rooms
+		if m.level(a.Sender) < 50 {
+			return fmt.Errorf("insufficient power to invite")
+		}
+	case ActionKick:
+		if target != "join" && target != "invite" {
+			return fmt.Errorf("cannot kick from membership '%s'", target)
+		}
+		if a.Sender == a.Target || m.level(a.Sender) < 50 || m.level(a.Sender) <= m.level(a.Target) {
+			return fmt.Errorf("insufficient power to kick")
+		}
+	case ActionBan:
+		if target == "ban" {
+			return fmt.Errorf("already banned")
+		}
+		if a.Sender == a.Target || m.level(a.Sender) < 50 || m.level(a.Sender) <= m.level(a.Target) {
+			return fmt.Errorf("insufficient power to ban")
+		}
+	case ActionUnban:
+		if target != "ban" {
+			return fmt.Errorf("cannot unban from membership '%s'", target)
+		}
+		if m.level(a.Sender) < 50 || m.level(a.Sender) <= m.level(a.Target) {
+			return fmt.Errorf("insufficient power to unban")
+		}
+	case ActionSetPowerLevel:
+		// only the creator changes power levels to keep the model simple
+		if a.Sender != m.g.Creator || a.Target == m.g.Creator {
+			return fmt.Errorf("only the creator can change the power levels of others")
+		}
+		if m.level(a.Target) >= m.level(a.Sender) && !m.g.PrivilegedCreators {
+			return fmt.Errorf("cannot change the power level of a user with equal power")
+		}
+	case ActionMessage:
+	case ActionRedact:
+		found := false
+		for _, i := range m.redactable {
+			if i == a.Redacts {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("action #%d is not a redactable message", a.Redacts)
+		}
+		if m.level(a.Sender) < 50 {
+			return fmt.Errorf("insufficient power to redact")
+		}
+	default:
+		return fmt.Errorf("unknown action kind")
+	}
+	return nil
+}
+
+func (m *model) apply(a Action, index int) {
+	switch a.Kind {
+	case ActionJoin:
+		m.membership[a.Target] = "join"
+	case ActionLeave, ActionKick, ActionUnban:
+		m.membership[a.Target] = "leave"
+	case ActionInvite:
+		m.membership[a.Target] = "invite"
+	case ActionBan:
+		m.membership[a.Target] = "ban"
+	case ActionSetPowerLevel:
+		m.powerLevels[a.Target] = a.PowerLevel
+	case ActionMessage:
+		m.redactable = append(m.redactable, index)
+	case ActionRedact:
+		for i, r := range m.redactable {
+			if r == a.Redacts {
+				m.redactable = append(m.redactable[:i], m.redactable[i+1:]...)
+				break
+			}
+		}
+	}
+}
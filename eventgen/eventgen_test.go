@@ -0,0 +1,77 @@
+package eventgen
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+var testGenerator = &Generator{
+	Creator: "@creator:hs1",
+	Users:   []string{"@alice:hs1", "@bob:hs1", "@charlie:hs1"},
+}
+
+func TestGenerateIsValidAndDeterministic(t *testing.T) {
+	for seed := int64(0); seed < 50; seed++ {
+		actions := testGenerator.Generate(rand.New(rand.NewSource(seed)), 50)
+		if len(actions) != 50 {
+			t.Fatalf("seed %d: got %d actions, want 50", seed, len(actions))
+		}
+		if err := testGenerator.Valid(actions); err != nil {
+			t.Fatalf("seed %d: generated invalid sequence: %s\n%s", seed, err, Format(actions))
+		}
+		again := testGenerator.Generate(rand.New(rand.NewSource(seed)), 50)
+		if !reflect.DeepEqual(actions, again) {
+			t.Fatalf("seed %d: generated different sequences for the same seed", seed)
+		}
+	}
+}
+
+func TestShrink(t *testing.T) {
+	hasBan := func(actions []Action) bool {
+		for _, a := range actions {
+			if a.Kind == ActionBan {
+				return true
+			}
+		}
+		return false
+	}
+	for seed := int64(0); seed < 50; seed++ {
+		actions := testGenerator.Generate(rand.New(rand.NewSource(seed)), 50)
+		if !hasBan(actions) {
+			continue
+		}
+		shrunk := Shrink(testGenerator, actions, hasBan)
+		if err := testGenerator.Valid(shrunk); err != nil || !hasBan(shrunk) {
+			t.Fatalf("seed %d: shrunk to an invalid or passing sequence:\n%s", seed, Format(shrunk))
+		}
+		// at most the banner needs to join and be given power to ban
+		if len(shrunk) > 3 {
+			t.Fatalf("seed %d: shrunk to %d actions, want at most 3:\n%s", seed, len(shrunk), Format(shrunk))
+		}
+	}
+}
+
+func TestMembershipChurn(t *testing.T) {
+	g := &Generator{
+		Creator: testGenerator.Creator,
+		Users:   testGenerator.Users,
+		Weights: MembershipChurn,
+	}
+	for seed := int64(0); seed < 50; seed++ {
+		actions := g.Generate(rand.New(rand.NewSource(seed)), 30)
+		want := map[string]string{g.Creator: "join"}
+		for _, userID := range g.Users {
+			want[userID] = "leave"
+		}
+		for _, a := range actions {
+			if _, ok := MembershipChurn[a.Kind]; !ok {
+				t.Fatalf("seed %d: generated non-membership action %s", seed, a)
+			}
+			want[a.Target] = actionMemberships[a.Kind]
+		}
+		if got := g.Memberships(actions); !reflect.DeepEqual(got, want) {
+			t.Fatalf("seed %d: got memberships %v, want %v\n%s", seed, got, want, Format(actions))
+		}
+	}
+}
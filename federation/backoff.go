@@ -0,0 +1,137 @@
+package federation
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// RetryRecorder fails matching requests and records when each attempt was received, so the retry
+// schedule of a homeserver can be observed. Add it to the server with srv.Use(recorder.Middleware).
+type RetryRecorder struct {
+	match    RequestMatcher
+	code     int
+	mu       sync.Mutex
+	attempts []time.Time
+	failing  bool
+	// closed and replaced whenever an attempt is recorded
+	notify chan struct{}
+}
+
+// EXPERIMENTAL
+// NewRetryRecorder returns a RetryRecorder which responds to matching requests with the HTTP status code
+// until Stop is called.
+func NewRetryRecorder(match RequestMatcher, code int) *RetryRecorder {
+	return &RetryRecorder{
+		match:   match,
+		code:    code,
+		failing: true,
+		notify:  make(chan struct{}),
+	}
+}
+
+// Middleware records and fails matching requests. Once stopped, matching requests are handled as normal
+// and no longer recorded.
+func (r *RetryRecorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.match(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		r.mu.Lock()
+		if !r.failing {
+			r.mu.Unlock()
+			next.ServeHTTP(w, req)
+			return
+		}
+		r.attempts = append(r.attempts, time.Now())
+		close(r.notify)
+		r.notify = make(chan struct{})
+		r.mu.Unlock()
+		w.WriteHeader(r.code)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"complement: RetryRecorder middleware"}`))
+	})
+}
+
+// Stop failing matching requests, so the homeserver can succeed on its next attempt.
+func (r *RetryRecorder) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failing = false
+}
+
+// Attempts returns the times at which each failed attempt was received, in order.
+func (r *RetryRecorder) Attempts() []time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]time.Time(nil), r.attempts...)
+}
+
+// Intervals returns the time between each failed attempt and the one before it, so has one fewer
+// entry than Attempts.
+func (r *RetryRecorder) Intervals() []time.Duration {
+	return retryIntervals(r.Attempts())
+}
+
+// MustWaitForAttempts waits until at least `n` attempts have been recorded and returns them. Fails the
+// test if this takes longer than the timeout.
+func (r *RetryRecorder) MustWaitForAttempts(t ct.TestLike, n int, timeout time.Duration) []time.Time {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		r.mu.Lock()
+		if len(r.attempts) >= n {
+			attempts := append([]time.Time(nil), r.attempts...)
+			r.mu.Unlock()
+			return attempts
+		}
+		notify := r.notify
+		got := len(r.attempts)
+		r.mu.Unlock()
+		select {
+		case <-notify:
+		case <-deadline:
+			ct.Fatalf(t, "RetryRecorder.MustWaitForAttempts: timed out after %v waiting for %d attempts, got %d with intervals %v", timeout, n, got, r.Intervals())
+		}
+	}
+}
+
+// MustBackOffExponentially fails the test unless each interval between attempts is at least `minFactor`
+// times the previous interval e.g 1.5, and the first interval is at least `minInitial`. At least 3
+// attempts must have been recorded, so there are 2 intervals to compare.
+func (r *RetryRecorder) MustBackOffExponentially(t ct.TestLike, minInitial time.Duration, minFactor float64) {
+	t.Helper()
+	if err := checkExponentialBackoff(r.Intervals(), minInitial, minFactor); err != nil {
+		ct.Fatalf(t, "RetryRecorder.MustBackOffExponentially: %s", err)
+	}
+}
+
+func retryIntervals(attempts []time.Time) []time.Duration {
+	if len(attempts) < 2 {
+		return nil
+	}
+	intervals := make([]time.Duration, len(attempts)-1)
+	for i := 1; i < len(attempts); i++ {
+		intervals[i-1] = attempts[i].Sub(attempts[i-1])
+	}
+	return intervals
+}
+
+func checkExponentialBackoff(intervals []time.Duration, minInitial time.Duration, minFactor float64) error {
+	if len(intervals) < 2 {
+		return fmt.Errorf("need at least 2 intervals between attempts, got %v", intervals)
+	}
+	if intervals[0] < minInitial {
+		return fmt.Errorf("first retry after %v, want at least %v (intervals %v)", intervals[0], minInitial, intervals)
+	}
+	for i := 1; i < len(intervals); i++ {
+		want := time.Duration(float64(intervals[i-1]) * minFactor)
+		if intervals[i] < want {
+			return fmt.Errorf("retry %d after %v, want at least %v (%vx the previous interval %v) (intervals %v)", i+1, intervals[i], want, minFactor, intervals[i-1], intervals)
+		}
+	}
+	return nil
+}
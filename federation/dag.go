@@ -0,0 +1,181 @@
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/artifacts"
+	"github.com/matrix-org/complement/ct"
+)
+
+// DAGEvent is an event in a DAG.
+type DAGEvent struct {
+	EventID    string   `json:"event_id"`
+	Type       string   `json:"type"`
+	Sender     string   `json:"sender"`
+	StateKey   *string  `json:"state_key,omitempty"`
+	Depth      int64    `json:"depth"`
+	PrevEvents []string `json:"prev_events"`
+	AuthEvents []string `json:"auth_events"`
+}
+
+// DAG is the event graph of a room, for understanding failures e.g of state resolution tests. Export it
+// with DOT or JSON.
+type DAG struct {
+	RoomID string     `json:"room_id"`
+	Events []DAGEvent `json:"events"`
+}
+
+// NewDAG makes a DAG from events in a room, sorted by depth.
+func NewDAG(roomID string, events []gomatrixserverlib.PDU) DAG {
+	dag := DAG{
+		RoomID: roomID,
+		Events: make([]DAGEvent, len(events)),
+	}
+	for i, ev := range events {
+		dag.Events[i] = DAGEvent{
+			EventID:    ev.EventID(),
+			Type:       ev.Type(),
+			Sender:     string(ev.SenderID()),
+			StateKey:   ev.StateKey(),
+			Depth:      ev.Depth(),
+			PrevEvents: ev.PrevEventIDs(),
+			AuthEvents: ev.AuthEventIDs(),
+		}
+	}
+	sort.SliceStable(dag.Events, func(i, j int) bool {
+		return dag.Events[i].Depth < dag.Events[j].Depth
+	})
+	return dag
+}
+
+// DAG returns the DAG of the events in the room's timeline.
+func (r *ServerRoom) DAG() DAG {
+	r.TimelineMutex.RLock()
+	defer r.TimelineMutex.RUnlock()
+	return NewDAG(r.RoomID, r.Timeline)
+}
+
+// JSON returns the DAG as indented JSON.
+func (d DAG) JSON() []byte {
+	b, _ := json.MarshalIndent(d, "", "  ")
+	return b
+}
+
+// DOT returns the DAG in the Graphviz DOT language, with edges from each event to its prev_events.
+// Auth events are drawn as dashed edges if `withAuthEvents` is true. Render it with e.g
+// `dot -Tsvg dag.dot > dag.svg`. Edges to events which are not in the DAG are drawn to grey nodes.
+func (d DAG) DOT(withAuthEvents bool) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "digraph %q {\n", d.RoomID)
+	sb.WriteString("  rankdir=BT;\n  node [shape=box, fontname=monospace];\n")
+	known := make(map[string]bool, len(d.Events))
+	for _, ev := range d.Events {
+		known[ev.EventID] = true
+		label := ev.Type
+		if ev.StateKey != nil {
+			label += fmt.Sprintf(" (%q)", *ev.StateKey)
+		}
+		label += fmt.Sprintf("\n%s\n%s depth=%d", ev.EventID, ev.Sender, ev.Depth)
+		style := ""
+		if ev.StateKey != nil {
+			style = ", style=filled, fillcolor=lightblue"
+		}
+		fmt.Fprintf(&sb, "  %q [label=%q%s];\n", ev.EventID, label, style)
+	}
+	unknown := make(map[string]bool)
+	for _, ev := range d.Events {
+		for _, prev := range ev.PrevEvents {
+			fmt.Fprintf(&sb, "  %q -> %q;\n", ev.EventID, prev)
+			unknown[prev] = !known[prev]
+		}
+		if !withAuthEvents {
+			continue
+		}
+		for _, auth := range ev.AuthEvents {
+			fmt.Fprintf(&sb, "  %q -> %q [style=dashed, color=grey];\n", ev.EventID, auth)
+			unknown[auth] = !known[auth]
+		}
+	}
+	var missing []string
+	for eventID, isUnknown := range unknown {
+		if isUnknown {
+			missing = append(missing, eventID)
+		}
+	}
+	sort.Strings(missing)
+	for _, eventID := range missing {
+		fmt.Fprintf(&sb, "  %q [color=grey, fontcolor=grey];\n", eventID)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// MustBackfillDAG fetches the DAG of a room on a homeserver via /backfill, starting from `fromEventIDs`
+// and going back at most `limit` events. This server must be in the room, else the homeserver will
+// refuse to backfill. The room version is taken from the server's copy of the room if it has one,
+// else `roomVer` is used.
+func (s *Server) MustBackfillDAG(
+	t ct.TestLike, deployment FederationDeployment, remote spec.ServerName, roomID string,
+	roomVer gomatrixserverlib.RoomVersion, fromEventIDs []string, limit int,
+) DAG {
+	t.Helper()
+	events, err := s.backfill(deployment, remote, roomID, roomVer, fromEventIDs, limit)
+	if err != nil {
+		ct.Fatalf(t, "MustBackfillDAG: %s", err)
+	}
+	return NewDAG(roomID, events)
+}
+
+// backfill fetches events via /backfill from `remote`. The room version is taken from the server's copy
+// of the room if it has one, else `roomVer` is used.
+func (s *Server) backfill(
+	deployment FederationDeployment, remote spec.ServerName, roomID string,
+	roomVer gomatrixserverlib.RoomVersion, fromEventIDs []string, limit int,
+) ([]gomatrixserverlib.PDU, error) {
+	if room := s.rooms[roomID]; room != nil {
+		roomVer = room.Version
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(roomVer)
+	if err != nil {
+		return nil, err
+	}
+	txn, err := s.FederationClient(deployment).Backfill(context.Background(), s.serverName, remote, roomID, limit, fromEventIDs)
+	if err != nil {
+		return nil, fmt.Errorf("/backfill from %s failed: %w", remote, err)
+	}
+	events := make([]gomatrixserverlib.PDU, 0, len(txn.PDUs))
+	for _, raw := range txn.PDUs {
+		ev, err := verImpl.NewEventFromUntrustedJSON(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load backfilled event: %w", err)
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+// writeDAGArtifacts writes the DAG of every room on the server to the artifacts of the test, as Graphviz
+// and JSON.
+func (s *Server) writeDAGArtifacts() {
+	mgr := artifacts.New(s.cfg.ArtifactsDir)
+	if !mgr.Enabled() {
+		return
+	}
+	for roomID, room := range s.rooms {
+		dag := room.DAG()
+		name := fmt.Sprintf("dag-%s-%s", s.serverName, roomID)
+		if err := mgr.WriteFile(s.t.Name(), name+".dot", []byte(dag.DOT(false))); err != nil {
+			s.t.Logf("failed to write DAG of %s: %s", roomID, err)
+		}
+		if err := mgr.WriteFile(s.t.Name(), name+".json", dag.JSON()); err != nil {
+			s.t.Logf("failed to write DAG of %s: %s", roomID, err)
+		}
+	}
+}
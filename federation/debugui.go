@@ -0,0 +1,78 @@
+package federation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+
+	"github.com/matrix-org/complement/debugui"
+)
+
+// recordTransactionsForDebugUI records the transactions the server receives in the debug UI.
+func (s *Server) recordTransactionsForDebugUI(next http.Handler) http.Handler {
+	match := MatchPathPrefix("/_matrix/federation/v1/send/")
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" || !match(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		var txn struct {
+			Origin string            `json:"origin"`
+			PDUs   []json.RawMessage `json:"pdus"`
+			EDUs   []json.RawMessage `json:"edus"`
+		}
+		json.Unmarshal(body, &txn)
+		if txn.Origin == "" {
+			_, origin, _, _, _ := fclient.ParseAuthorization(req.Header.Get("Authorization"))
+			txn.Origin = string(origin)
+		}
+		debugui.RecordTransaction(debugui.Transaction{
+			Time:          time.Now(),
+			Test:          s.t.Name(),
+			Destination:   string(s.serverName),
+			Origin:        txn.Origin,
+			TransactionID: path.Base(req.URL.Path),
+			PDUs:          txn.PDUs,
+			EDUs:          txn.EDUs,
+		})
+		next.ServeHTTP(w, req)
+	})
+}
+
+// debugUIRooms returns the rooms on the server, for the debug UI.
+func (s *Server) debugUIRooms() []debugui.Room {
+	var rooms []debugui.Room
+	for _, room := range s.rooms {
+		rooms = append(rooms, debugui.Room{
+			Server:  string(s.serverName),
+			RoomID:  room.RoomID,
+			Version: string(room.Version),
+			Events:  debugUIEvents(room),
+		})
+	}
+	return rooms
+}
+
+func debugUIEvents(room *ServerRoom) []debugui.Event {
+	room.TimelineMutex.RLock()
+	defer room.TimelineMutex.RUnlock()
+	events := make([]debugui.Event, len(room.Timeline))
+	for i, ev := range room.Timeline {
+		events[i] = debugui.Event{
+			EventID:    ev.EventID(),
+			Type:       ev.Type(),
+			Sender:     string(ev.SenderID()),
+			StateKey:   ev.StateKey(),
+			Depth:      ev.Depth(),
+			PrevEvents: ev.PrevEventIDs(),
+		}
+	}
+	return events
+}
@@ -259,12 +259,10 @@ func HandleDirectoryLookups() func(*Server) {
 		s.directoryHandlerSetup = true
 		s.mux.Handle("/_matrix/federation/v1/query/directory", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			alias := req.URL.Query().Get("room_alias")
-			if roomID, ok := s.aliases[alias]; ok {
+			if mapping, ok := s.aliases[alias]; ok {
 				b, err := json.Marshal(fclient.RespDirectory{
-					RoomID: roomID,
-					Servers: []spec.ServerName{
-						s.serverName,
-					},
+					RoomID:  mapping.roomID,
+					Servers: mapping.servers,
 				})
 				if err != nil {
 					w.WriteHeader(500)
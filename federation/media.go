@@ -0,0 +1,22 @@
+package federation
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// DownloadMedia requests media from `remote` via the authenticated federation media API, as another
+// homeserver would on behalf of its users. Returns the raw http response, which is multipart on success.
+// The caller must close the response body.
+func (s *Server) DownloadMedia(t ct.TestLike, deployment FederationDeployment, remote spec.ServerName, mediaID string) *http.Response {
+	t.Helper()
+	res, err := s.FederationClient(deployment).DownloadMedia(context.Background(), s.serverName, remote, mediaID)
+	if err != nil {
+		ct.Fatalf(t, "DownloadMedia: failed to download %s from %s: %s", mediaID, remote, err)
+	}
+	return res
+}
@@ -0,0 +1,193 @@
+package federation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+)
+
+// Middleware wraps the handling of inbound federation requests.
+type Middleware func(next http.Handler) http.Handler
+
+// RequestMatcher decides whether a middleware applies to a request.
+type RequestMatcher func(req *http.Request) bool
+
+type middlewareEntry struct {
+	mw Middleware
+}
+
+// EXPERIMENTAL
+// Use adds a middleware which is run for every inbound request which matches a route on this server,
+// including routes added later. Middlewares run in the order they were added, and can be added and removed
+// at any time, including while the server is listening. Call the returned function to remove it.
+func (s *Server) Use(mw Middleware) (remove func()) {
+	entry := &middlewareEntry{mw: mw}
+	s.middlewaresMu.Lock()
+	s.middlewares = append(s.middlewares, entry)
+	s.middlewaresMu.Unlock()
+	return func() {
+		s.middlewaresMu.Lock()
+		defer s.middlewaresMu.Unlock()
+		for i := range s.middlewares {
+			if s.middlewares[i] == entry {
+				s.middlewares = append(s.middlewares[:i], s.middlewares[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// applyMiddlewares wraps the handler with the middlewares present at the time of the request.
+func (s *Server) applyMiddlewares(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.middlewaresMu.RLock()
+		h := next
+		for i := len(s.middlewares) - 1; i >= 0; i-- {
+			h = s.middlewares[i].mw(h)
+		}
+		s.middlewaresMu.RUnlock()
+		h.ServeHTTP(w, req)
+	})
+}
+
+// MatchAll matches every request.
+func MatchAll() RequestMatcher {
+	return func(req *http.Request) bool {
+		return true
+	}
+}
+
+// MatchPathPrefix matches requests whose path starts with the prefix e.g "/_matrix/federation/v1/send/".
+func MatchPathPrefix(prefix string) RequestMatcher {
+	return func(req *http.Request) bool {
+		return strings.HasPrefix(req.URL.Path, prefix)
+	}
+}
+
+// MatchRoute matches requests handled by the route with the given path template e.g
+// "/_matrix/federation/v2/send_join/{roomID}/{eventID}".
+func MatchRoute(pathTemplate string) RequestMatcher {
+	return func(req *http.Request) bool {
+		route := mux.CurrentRoute(req)
+		if route == nil {
+			return false
+		}
+		tpl, err := route.GetPathTemplate()
+		return err == nil && tpl == pathTemplate
+	}
+}
+
+// DelayRequests is a middleware which waits for the duration before handling matching requests.
+func DelayRequests(match RequestMatcher, delay time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if match(req) {
+				select {
+				case <-time.After(delay):
+				case <-req.Context().Done():
+					return
+				}
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// FailRequests is a middleware which responds to the first `times` matching requests with the HTTP status
+// code instead of handling them. If `times` is 0, all matching requests fail.
+func FailRequests(match RequestMatcher, code int, times int) Middleware {
+	var failed atomic.Int64
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if match(req) && (times == 0 || failed.Add(1) <= int64(times)) {
+				w.WriteHeader(code)
+				w.Write([]byte(`{"errcode":"M_UNKNOWN","error":"complement: FailRequests middleware"}`))
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// CapturedRequest is an inbound request recorded by a RequestCapture.
+type CapturedRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+	// From the X-Matrix Authorization header, if present.
+	Origin      spec.ServerName
+	Destination spec.ServerName
+	KeyID       gomatrixserverlib.KeyID
+	Signature   string
+}
+
+// Transaction parses the body of a captured /send request. The transaction ID is taken from the path, as
+// it is not in the body.
+func (r CapturedRequest) Transaction() (gomatrixserverlib.Transaction, error) {
+	var txn gomatrixserverlib.Transaction
+	if err := json.Unmarshal(r.Body, &txn); err != nil {
+		return txn, fmt.Errorf("failed to parse transaction from %s: %w", r.Path, err)
+	}
+	txn.TransactionID = gomatrixserverlib.TransactionID(path.Base(r.Path))
+	return txn, nil
+}
+
+// RequestCapture records inbound requests, including how they were authenticated.
+type RequestCapture struct {
+	match    RequestMatcher
+	mu       sync.Mutex
+	requests []CapturedRequest
+}
+
+// NewRequestCapture returns a RequestCapture which records matching requests. Add it to the server with
+// srv.Use(capture.Middleware).
+func NewRequestCapture(match RequestMatcher) *RequestCapture {
+	return &RequestCapture{match: match}
+}
+
+// Middleware records matching requests, then handles them as normal.
+func (c *RequestCapture) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !c.match(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		captured := CapturedRequest{
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Header: req.Header.Clone(),
+			Body:   body,
+		}
+		var scheme string
+		scheme, captured.Origin, captured.Destination, captured.KeyID, captured.Signature = fclient.ParseAuthorization(req.Header.Get("Authorization"))
+		if scheme != "X-Matrix" {
+			captured.Origin, captured.Destination, captured.KeyID, captured.Signature = "", "", "", ""
+		}
+		c.mu.Lock()
+		c.requests = append(c.requests, captured)
+		c.mu.Unlock()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Requests returns the requests captured so far, in the order they were received.
+func (c *RequestCapture) Requests() []CapturedRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CapturedRequest(nil), c.requests...)
+}
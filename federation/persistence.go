@@ -0,0 +1,278 @@
+package federation
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+const (
+	persistedStateFile        = "state.json"
+	persistedTransactionsFile = "transactions.jsonl"
+)
+
+// persistedState is the state of a server which is saved to disk by WithPersistence.
+type persistedState struct {
+	ServerName string `json:"server_name"`
+	// The port of the first listener, which is part of the server name.
+	Port       int                       `json:"port"`
+	KeyID      gomatrixserverlib.KeyID   `json:"key_id"`
+	PrivateKey []byte                    `json:"private_key"` // ed25519 seed
+	Rooms      []persistedRoom           `json:"rooms"`
+	Aliases    map[string]persistedAlias `json:"aliases"`
+}
+
+type persistedRoom struct {
+	RoomID             string                        `json:"room_id"`
+	Version            gomatrixserverlib.RoomVersion `json:"version"`
+	State              []json.RawMessage             `json:"state"`
+	Timeline           []json.RawMessage             `json:"timeline"`
+	ForwardExtremities []string                      `json:"forward_extremities"`
+	Depth              int64                         `json:"depth"`
+}
+
+type persistedAlias struct {
+	RoomID  string   `json:"room_id"`
+	Servers []string `json:"servers"`
+}
+
+// LoggedTransaction is a transaction received by a server with persistence, as recorded in its
+// transaction log.
+type LoggedTransaction struct {
+	Time          time.Time         `json:"time"`
+	Origin        string            `json:"origin"`
+	TransactionID string            `json:"transaction_id"`
+	PDUs          []json.RawMessage `json:"pdus"`
+	EDUs          []json.RawMessage `json:"edus"`
+}
+
+// EXPERIMENTAL
+// WithPersistence is an option which saves the identity of the server (its signing key and port, and so its
+// server name), its rooms and alias mappings to `dir`, and appends each transaction it receives to a log in
+// `dir`. If `dir` already contains saved state, the server resumes from it, so test scenarios which span
+// several test binaries (e.g crashing the harness then resuming) or long-running soak setups keep a
+// consistent server which homeservers already know.
+//
+// State is saved when the first listener is closed, and whenever MustSave is called: as a crashing
+// harness will not close its listeners, tests should call MustSave after changing the server's rooms.
+// Listen() reuses the saved port, failing the test if it is not free. Room implementations set via
+// WithImpl are not saved, so resumed rooms use the default implementation.
+func WithPersistence(dir string) func(*Server) {
+	return func(s *Server) {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			ct.Fatalf(s.t, "WithPersistence: failed to create %s: %s", dir, err)
+		}
+		s.persistDir = dir
+		if err := s.loadPersistedState(); err != nil {
+			ct.Fatalf(s.t, "WithPersistence: failed to load state from %s: %s", dir, err)
+		}
+		s.Use(s.logTransactions)
+	}
+}
+
+// MustSave saves the state of a server created with WithPersistence. Fails the test if the server is not
+// listening, as the server name is not yet known.
+func (s *Server) MustSave(t ct.TestLike) {
+	t.Helper()
+	if s.persistDir == "" {
+		ct.Fatalf(t, "MustSave: server was not created WithPersistence")
+	}
+	if !s.listening {
+		ct.Fatalf(t, "MustSave() called before Listen() - this is not supported because Listen() chooses the server name. Ensure you Listen() first!")
+	}
+	if err := s.savePersistedState(); err != nil {
+		ct.Fatalf(t, "MustSave: %s", err)
+	}
+}
+
+// TransactionLog returns the transactions received by a server created with WithPersistence, including
+// those received before it was resumed, oldest first.
+func (s *Server) TransactionLog(t ct.TestLike) []LoggedTransaction {
+	t.Helper()
+	if s.persistDir == "" {
+		ct.Fatalf(t, "TransactionLog: server was not created WithPersistence")
+	}
+	s.txnLogMu.Lock()
+	defer s.txnLogMu.Unlock()
+	f, err := os.Open(filepath.Join(s.persistDir, persistedTransactionsFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		ct.Fatalf(t, "TransactionLog: %s", err)
+	}
+	defer f.Close()
+	var txns []LoggedTransaction
+	decoder := json.NewDecoder(f)
+	for decoder.More() {
+		var txn LoggedTransaction
+		if err = decoder.Decode(&txn); err != nil {
+			ct.Fatalf(t, "TransactionLog: failed to decode transaction: %s", err)
+		}
+		txns = append(txns, txn)
+	}
+	return txns
+}
+
+// loadPersistedState resumes from the saved state, if there is any.
+func (s *Server) loadPersistedState() error {
+	data, err := os.ReadFile(filepath.Join(s.persistDir, persistedStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state persistedState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", persistedStateFile, err)
+	}
+	if len(state.PrivateKey) != ed25519.SeedSize {
+		return fmt.Errorf("invalid private key")
+	}
+	s.Priv = ed25519.NewKeyFromSeed(state.PrivateKey)
+	s.KeyID = state.KeyID
+	s.persistPort = state.Port
+	for _, pr := range state.Rooms {
+		verImpl, err := gomatrixserverlib.GetRoomVersion(pr.Version)
+		if err != nil {
+			return fmt.Errorf("room %s: %w", pr.RoomID, err)
+		}
+		room := NewServerRoom(pr.Version, pr.RoomID)
+		for _, raw := range pr.State {
+			ev, err := verImpl.NewEventFromTrustedJSON(raw, false)
+			if err != nil {
+				return fmt.Errorf("room %s: failed to load state event: %w", pr.RoomID, err)
+			}
+			if ev.StateKey() == nil {
+				return fmt.Errorf("room %s: state event %s has no state key", pr.RoomID, ev.EventID())
+			}
+			room.ReplaceCurrentState(ev)
+		}
+		for _, raw := range pr.Timeline {
+			ev, err := verImpl.NewEventFromTrustedJSON(raw, false)
+			if err != nil {
+				return fmt.Errorf("room %s: failed to load timeline event: %w", pr.RoomID, err)
+			}
+			room.Timeline = append(room.Timeline, ev)
+		}
+		room.ForwardExtremities = pr.ForwardExtremities
+		room.Depth = pr.Depth
+		s.rooms[room.RoomID] = room
+	}
+	for alias, mapping := range state.Aliases {
+		servers := make([]spec.ServerName, len(mapping.Servers))
+		for i, server := range mapping.Servers {
+			servers[i] = spec.ServerName(server)
+		}
+		s.aliases[alias] = aliasMapping{roomID: mapping.RoomID, servers: servers}
+	}
+	if len(s.aliases) > 0 {
+		HandleDirectoryLookups()(s)
+	}
+	return nil
+}
+
+// savePersistedState atomically replaces the saved state with the current state.
+func (s *Server) savePersistedState() error {
+	state := persistedState{
+		ServerName: string(s.serverName),
+		Port:       s.persistPort,
+		KeyID:      s.KeyID,
+		PrivateKey: s.Priv.Seed(),
+		Aliases:    make(map[string]persistedAlias, len(s.aliases)),
+	}
+	for _, room := range s.rooms {
+		pr := persistedRoom{
+			RoomID:  room.RoomID,
+			Version: room.Version,
+			Depth:   room.Depth,
+		}
+		room.StateMutex.RLock()
+		for _, ev := range room.State {
+			pr.State = append(pr.State, ev.JSON())
+		}
+		room.StateMutex.RUnlock()
+		room.TimelineMutex.RLock()
+		for _, ev := range room.Timeline {
+			pr.Timeline = append(pr.Timeline, ev.JSON())
+		}
+		pr.ForwardExtremities = append(pr.ForwardExtremities, room.ForwardExtremities...)
+		room.TimelineMutex.RUnlock()
+		state.Rooms = append(state.Rooms, pr)
+	}
+	for alias, mapping := range s.aliases {
+		servers := make([]string, len(mapping.servers))
+		for i, server := range mapping.servers {
+			servers[i] = string(server)
+		}
+		state.Aliases[alias] = persistedAlias{RoomID: mapping.roomID, Servers: servers}
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.persistDir, persistedStateFile+".tmp")
+	if err = os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write state: %w", err)
+	}
+	if err = os.Rename(tmp, filepath.Join(s.persistDir, persistedStateFile)); err != nil {
+		return fmt.Errorf("failed to replace state: %w", err)
+	}
+	return nil
+}
+
+// logTransactions appends the transactions the server receives to the transaction log.
+func (s *Server) logTransactions(next http.Handler) http.Handler {
+	match := MatchPathPrefix("/_matrix/federation/v1/send/")
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" || !match(req) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		txn := LoggedTransaction{
+			Time:          time.Now(),
+			TransactionID: path.Base(req.URL.Path),
+		}
+		json.Unmarshal(body, &txn)
+		if txn.Origin == "" {
+			_, origin, _, _, _ := fclient.ParseAuthorization(req.Header.Get("Authorization"))
+			txn.Origin = string(origin)
+		}
+		if err := s.appendTransactionLog(txn); err != nil {
+			s.t.Logf("WithPersistence: failed to log transaction %s: %s", txn.TransactionID, err)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (s *Server) appendTransactionLog(txn LoggedTransaction) error {
+	line, err := json.Marshal(txn)
+	if err != nil {
+		return err
+	}
+	s.txnLogMu.Lock()
+	defer s.txnLogMu.Unlock()
+	f, err := os.OpenFile(filepath.Join(s.persistDir, persistedTransactionsFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
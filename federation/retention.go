@@ -0,0 +1,48 @@
+package federation
+
+import (
+	"sort"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// MustEventuallyNotBackfill backfills the room from `remote`, starting from `fromEventIDs` and going back
+// at most `limit` events, until none of `eventIDs` are returned, e.g because the room's retention policy
+// has purged them. As homeservers purge expired events periodically, this retries until `timeout`, then
+// fails the test with the events which are still returned. This server must be in the room. The
+// `fromEventIDs` must not be purged themselves, so are usually recent or state events.
+func (s *Server) MustEventuallyNotBackfill(
+	t ct.TestLike, deployment FederationDeployment, remote spec.ServerName, roomID string,
+	roomVer gomatrixserverlib.RoomVersion, fromEventIDs []string, limit int, eventIDs []string, timeout time.Duration,
+) {
+	t.Helper()
+	unwanted := make(map[string]bool, len(eventIDs))
+	for _, eventID := range eventIDs {
+		unwanted[eventID] = true
+	}
+	start := time.Now()
+	for {
+		events, err := s.backfill(deployment, remote, roomID, roomVer, fromEventIDs, limit)
+		if err != nil {
+			ct.Fatalf(t, "MustEventuallyNotBackfill: %s", err)
+		}
+		var backfilled []string
+		for _, ev := range events {
+			if unwanted[ev.EventID()] {
+				backfilled = append(backfilled, ev.EventID())
+			}
+		}
+		if len(backfilled) == 0 {
+			return
+		}
+		if time.Since(start) > timeout {
+			sort.Strings(backfilled)
+			ct.Fatalf(t, "MustEventuallyNotBackfill: events %v in %s are still backfilled from %s after %v", backfilled, roomID, remote, time.Since(start))
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
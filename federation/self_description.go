@@ -0,0 +1,116 @@
+package federation
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// ServerVersion is the response to /_matrix/federation/v1/version.
+type ServerVersion struct {
+	Name    string
+	Version string
+}
+
+// MustGetServerVersion requests /_matrix/federation/v1/version from the homeserver, failing the test
+// unless it responds with a server name and version. `httpClient` must be able to reach the homeserver
+// by its server name, e.g complement.FederationHTTPClient.
+func MustGetServerVersion(t ct.TestLike, httpClient *http.Client, serverName spec.ServerName) ServerVersion {
+	t.Helper()
+	body := mustGetFederationJSON(t, "MustGetServerVersion", httpClient, serverName, "/_matrix/federation/v1/version")
+	v := ServerVersion{
+		Name:    body.Get("server.name").Str,
+		Version: body.Get("server.version").Str,
+	}
+	if v.Name == "" || v.Version == "" {
+		ct.Fatalf(t, "MustGetServerVersion: %s returned a version without server.name and server.version: %s", serverName, body.Raw)
+	}
+	return v
+}
+
+// ServerKeys are the signing keys a homeserver publishes at /_matrix/key/v2/server.
+type ServerKeys struct {
+	VerifyKeys    map[gomatrixserverlib.KeyID]ed25519.PublicKey
+	OldVerifyKeys map[gomatrixserverlib.KeyID]ed25519.PublicKey
+	ValidUntil    time.Time
+	// The response, for further assertions.
+	Raw gjson.Result
+}
+
+// MustGetServerKeys requests /_matrix/key/v2/server from the homeserver, failing the test unless the
+// response is for `serverName`, is valid in the future, and is signed by each of its verify keys.
+// `httpClient` must be able to reach the homeserver by its server name, e.g complement.FederationHTTPClient.
+func MustGetServerKeys(t ct.TestLike, httpClient *http.Client, serverName spec.ServerName) ServerKeys {
+	t.Helper()
+	body := mustGetFederationJSON(t, "MustGetServerKeys", httpClient, serverName, "/_matrix/key/v2/server")
+	keys, err := parseServerKeys(body, serverName, time.Now())
+	if err != nil {
+		ct.Fatalf(t, "MustGetServerKeys: %s: %s", serverName, err)
+	}
+	return keys
+}
+
+func parseServerKeys(body gjson.Result, serverName spec.ServerName, now time.Time) (ServerKeys, error) {
+	keys := ServerKeys{
+		VerifyKeys:    make(map[gomatrixserverlib.KeyID]ed25519.PublicKey),
+		OldVerifyKeys: make(map[gomatrixserverlib.KeyID]ed25519.PublicKey),
+		ValidUntil:    time.UnixMilli(body.Get("valid_until_ts").Int()),
+		Raw:           body,
+	}
+	if got := body.Get("server_name").Str; got != string(serverName) {
+		return keys, fmt.Errorf("server_name got '%s' want '%s'", got, serverName)
+	}
+	if !keys.ValidUntil.After(now) {
+		return keys, fmt.Errorf("valid_until_ts %v is not in the future", keys.ValidUntil)
+	}
+	for field, dst := range map[string]map[gomatrixserverlib.KeyID]ed25519.PublicKey{
+		"verify_keys":     keys.VerifyKeys,
+		"old_verify_keys": keys.OldVerifyKeys,
+	} {
+		for keyID, v := range body.Get(field).Map() {
+			key, err := base64.RawStdEncoding.DecodeString(v.Get("key").Str)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				return keys, fmt.Errorf("%s: key '%s' is not an unpadded base64 ed25519 key", field, keyID)
+			}
+			dst[gomatrixserverlib.KeyID(keyID)] = key
+		}
+	}
+	if len(keys.VerifyKeys) == 0 {
+		return keys, fmt.Errorf("no verify_keys")
+	}
+	for keyID, key := range keys.VerifyKeys {
+		if err := gomatrixserverlib.VerifyJSON(string(serverName), keyID, key, []byte(body.Raw)); err != nil {
+			return keys, fmt.Errorf("response is not signed by verify key '%s': %s", keyID, err)
+		}
+	}
+	return keys, nil
+}
+
+func mustGetFederationJSON(t ct.TestLike, caller string, httpClient *http.Client, serverName spec.ServerName, path string) gjson.Result {
+	t.Helper()
+	res, err := httpClient.Get("https://" + string(serverName) + path)
+	if err != nil {
+		ct.Fatalf(t, "%s: GET %s failed: %s", caller, path, err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		ct.Fatalf(t, "%s: failed to read response from %s: %s", caller, path, err)
+	}
+	if res.StatusCode != 200 {
+		ct.Fatalf(t, "%s: %s returned HTTP %d: %s", caller, path, res.StatusCode, string(body))
+	}
+	if !gjson.ValidBytes(body) {
+		ct.Fatalf(t, "%s: %s returned invalid JSON: %s", caller, path, string(body))
+	}
+	return gjson.ParseBytes(body)
+}
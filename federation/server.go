@@ -34,6 +34,7 @@ import (
 
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/debugui"
 	"github.com/matrix-org/complement/internal"
 )
 
@@ -55,6 +56,8 @@ type Server struct {
 	KeyID gomatrixserverlib.KeyID
 	// The homeserver name. This should be a resolvable address in the deployment network
 	serverName spec.ServerName
+	hostname   string
+	cfg        *config.Complement
 	listening  bool
 
 	certPath string
@@ -63,9 +66,23 @@ type Server struct {
 	srv      *http.Server
 
 	directoryHandlerSetup bool
-	aliases               map[string]string
+	aliases               map[string]aliasMapping
 	rooms                 map[string]*ServerRoom
 	keyRing               *gomatrixserverlib.KeyRing
+
+	middlewaresMu sync.RWMutex
+	middlewares   []*middlewareEntry
+
+	// set via WithPersistence
+	persistDir  string
+	persistPort int
+	txnLogMu    sync.Mutex
+}
+
+// aliasMapping is the response to a directory lookup of an alias on this server.
+type aliasMapping struct {
+	roomID  string
+	servers []spec.ServerName
 }
 
 // EXPERIMENTAL
@@ -85,8 +102,10 @@ func NewServer(t ct.TestLike, deployment FederationDeployment, opts ...func(*Ser
 		// The server name will be updated when the caller calls Listen() to include the port number
 		// of the HTTP server e.g "host.docker.internal:56353"
 		serverName:                  spec.ServerName(deployment.GetConfig().HostnameRunningComplement),
+		hostname:                    deployment.GetConfig().HostnameRunningComplement,
+		cfg:                         deployment.GetConfig(),
 		rooms:                       make(map[string]*ServerRoom),
-		aliases:                     make(map[string]string),
+		aliases:                     make(map[string]aliasMapping),
 		UnexpectedRequestsAreErrors: true,
 	}
 	fetcher := &basicKeyFetcher{
@@ -107,6 +126,7 @@ func NewServer(t ct.TestLike, deployment FederationDeployment, opts ...func(*Ser
 			fetcher,
 		},
 	}
+	srv.mux.Use(srv.applyMiddlewares)
 	srv.mux.Use(func(h http.Handler) http.Handler {
 		// Return a json Content-Type header to all requests by default
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -133,6 +153,14 @@ func NewServer(t ct.TestLike, deployment FederationDeployment, opts ...func(*Ser
 	srv.certPath = certPath
 	srv.keyPath = keyPath
 	srv.srv = httpServer
+	if debugui.Enabled() {
+		srv.Use(srv.recordTransactionsForDebugUI)
+	}
+	if srv.cfg.StrictFederation {
+		srv.CheckTransactions(func(err error) {
+			ct.Errorf(t, "COMPLEMENT_STRICT_FEDERATION: %s", err)
+		})
+	}
 
 	for _, opt := range opts {
 		opt(srv)
@@ -168,8 +196,22 @@ func (s *Server) MakeAliasMapping(aliasLocalpart, roomID string) string {
 	if !s.listening {
 		ct.Fatalf(s.t, "MakeAliasMapping() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the server name and thus changes the room alias. Ensure you Listen() first!")
 	}
+	return s.MakeAliasMappingWithServers(aliasLocalpart, roomID, s.serverName)
+}
+
+// MakeAliasMappingWithServers is like MakeAliasMapping, but directory lookups for the alias respond with
+// the given list of resident servers rather than this server. The list is returned as-is, so it can
+// include other fake servers, servers which are not in the room, or servers which no longer exist, to
+// test how homeservers fall back across the candidate servers. Returns the alias.
+func (s *Server) MakeAliasMappingWithServers(aliasLocalpart, roomID string, servers ...spec.ServerName) string {
+	if !s.listening {
+		ct.Fatalf(s.t, "MakeAliasMappingWithServers() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the server name and thus changes the room alias. Ensure you Listen() first!")
+	}
 	alias := fmt.Sprintf("#%s:%s", aliasLocalpart, s.serverName)
-	s.aliases[alias] = roomID
+	s.aliases[alias] = aliasMapping{
+		roomID:  roomID,
+		servers: servers,
+	}
 	HandleDirectoryLookups()(s)
 	return alias
 }
@@ -237,6 +279,19 @@ func (s *Server) FederationClient(deployment FederationDeployment) fclient.Feder
 	return fedClient
 }
 
+// EXPERIMENTAL
+// MustNewFederationClient returns a federation client for tests which only need to make signed requests to
+// homeservers. It creates a Server with a fresh signing key and a certificate derived from the Complement CA,
+// so homeservers trust it and can fetch its keys to verify the requests, and starts it listening. The client
+// signs requests as this server, whose name is available via the returned Server. Extra options are applied
+// to the server. Call the returned function to stop the server.
+func MustNewFederationClient(t ct.TestLike, deployment FederationDeployment, opts ...func(*Server)) (fedClient fclient.FederationClient, srv *Server, cancel func()) {
+	t.Helper()
+	srv = NewServer(t, deployment, append([]func(*Server){HandleKeyRequests()}, opts...)...)
+	cancel = srv.Listen()
+	return srv.FederationClient(deployment), srv, cancel
+}
+
 // MustSendTransaction sends the given PDUs/EDUs to the target destination, returning an error if the /send fails or if the response contains an error
 // for any sent PDUs. Times out after 10 seconds.
 //
@@ -344,13 +399,20 @@ func (s *Server) DoFederationRequest(
 
 // MustCreateEvent will create and sign a new latest event for the given room.
 // It does not insert this event into the room however. See ServerRoom.AddEvent for that.
+// The prev_events, auth_events, depth and origin_server_ts of the event can be set explicitly on `ev`,
+// to create events which exercise edge cases in the DAG.
 func (s *Server) MustCreateEvent(t ct.TestLike, room *ServerRoom, ev Event) gomatrixserverlib.PDU {
 	t.Helper()
 	proto, err := room.ProtoEventCreator(room, ev)
 	if err != nil {
 		ct.Fatalf(t, "MustCreateEvent: failed to create proto event: %v", err)
 	}
-	pdu, err := room.EventCreator(room, s, proto)
+	var pdu gomatrixserverlib.PDU
+	if ev.OriginServerTS.IsZero() {
+		pdu, err = room.EventCreator(room, s, proto)
+	} else {
+		pdu, err = signEvent(room, s, proto, ev.OriginServerTS)
+	}
 	if err != nil {
 		ct.Fatalf(t, "MustCreateEvent: failed to create PDU: %v", err)
 	}
@@ -533,21 +595,50 @@ func (s *Server) Listen() (cancel func()) {
 	if s.listening {
 		return
 	}
+	// servers with persistence reuse their port, as it is part of the server name
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", s.persistPort)) //nolint
+	if err != nil {
+		ct.Fatalf(s.t, "ListenFederationServer: net.Listen failed: %s", err)
+	}
+	return s.ListenOn(ln)
+}
+
+// ListenOn serves federation requests on the given listener, which allows the caller to choose the port.
+// It can be called multiple times to serve on several listeners simultaneously. The first listener (including
+// the one created by Listen()) decides the server name: use ServerNameFor to find the server name which routes
+// to other listeners. Call the returned function to gracefully close this listener.
+//
+// Server names use the hostname of the machine running Complement, which containers in the deployment
+// resolve to the host and which the deployment's RoundTripper maps to localhost, so no further
+// registration is needed for homeservers or Complement to reach the listener.
+func (s *Server) ListenOn(ln net.Listener) (cancel func()) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 
-	ln, err := net.Listen("tcp", ":0") //nolint
-	if err != nil {
-		ct.Fatalf(s.t, "ListenFederationServer: net.Listen failed: %s", err)
+	unregisterRooms := func() {}
+	firstListener := !s.listening
+	if firstListener {
+		s.serverName = s.ServerNameFor(ln)
+		s.listening = true
+		if s.persistDir != "" {
+			s.persistPort = ln.Addr().(*net.TCPAddr).Port
+		}
+		if debugui.Enabled() {
+			unregisterRooms = debugui.RegisterRooms(s.debugUIRooms)
+		}
+	}
+	// each listener has its own http.Server so they can be closed independently
+	srv := &http.Server{
+		Addr:         s.srv.Addr,
+		Handler:      s.srv.Handler,
+		TLSConfig:    s.srv.TLSConfig,
+		TLSNextProto: s.srv.TLSNextProto,
 	}
-	port := ln.Addr().(*net.TCPAddr).Port
-	s.serverName = spec.ServerName(fmt.Sprintf("%s:%d", s.serverName, port))
-	s.listening = true
 
 	go func() {
 		defer ln.Close()
 		defer wg.Done()
-		err := s.srv.ServeTLS(ln, s.certPath, s.keyPath)
+		err := srv.ServeTLS(ln, s.certPath, s.keyPath)
 		if err != nil && err != http.ErrServerClosed {
 			s.t.Logf("ListenFederationServer: ServeTLS failed: %s", err)
 			// Note that running s.t.FailNow is not allowed in a separate goroutine
@@ -556,7 +647,17 @@ func (s *Server) Listen() (cancel func()) {
 	}()
 
 	return func() {
-		err := s.srv.Close()
+		unregisterRooms()
+		// keep the room DAGs of failed tests, as they are hard to reconstruct from logs
+		if firstListener && s.t.Failed() {
+			s.writeDAGArtifacts()
+		}
+		if firstListener && s.persistDir != "" {
+			if err := s.savePersistedState(); err != nil {
+				ct.Errorf(s.t, "WithPersistence: failed to save state: %s", err)
+			}
+		}
+		err := srv.Close()
 		if err != nil {
 			ct.Fatalf(s.t, "ListenFederationServer: failed to shutdown server: %s", err)
 		}
@@ -564,6 +665,11 @@ func (s *Server) Listen() (cancel func()) {
 	}
 }
 
+// ServerNameFor returns the server name which routes to the given listener e.g "host.docker.internal:56353".
+func (s *Server) ServerNameFor(ln net.Listener) spec.ServerName {
+	return spec.ServerName(fmt.Sprintf("%s:%d", s.hostname, ln.Addr().(*net.TCPAddr).Port))
+}
+
 type joinRoom struct {
 	partialState bool
 	roomOpts     []ServerRoomOpt
@@ -588,15 +694,25 @@ func WithRoomOpts(opts ...ServerRoomOpt) JoinRoomOpt {
 
 // federationServer creates a federation server with the given handler
 func federationServer(cfg *config.Complement, h http.Handler) (*http.Server, string, string, error) {
-	var derBytes []byte
 	srv := &http.Server{
 		Addr:    ":8448",
 		Handler: h,
 	}
+	tlsCertPath, tlsKeyPath, err := federationCertificate(cfg, false)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return srv, tlsCertPath, tlsKeyPath, nil
+}
+
+// federationCertificate writes a certificate for the host running Complement, and its key, to a new
+// temporary directory. The certificate is derived from the Complement CA unless `selfSigned` is set.
+func federationCertificate(cfg *config.Complement, selfSigned bool) (certPath, keyPath string, err error) {
+	var derBytes []byte
 	dirNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	dirNumber, err := rand.Int(rand.Reader, dirNumberLimit)
 	if err != nil {
-		return nil, "", "", err
+		return "", "", err
 	}
 
 	os.MkdirAll(path.Join(os.TempDir(), dirNumber.String()), 0777)
@@ -606,14 +722,14 @@ func federationServer(cfg *config.Complement, h http.Handler) (*http.Server, str
 	certificateDuration := time.Hour * 48
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		return nil, "", "", err
+		return "", "", err
 	}
 	notBefore := time.Now()
 	notAfter := notBefore.Add(certificateDuration)
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		return nil, "", "", err
+		return "", "", err
 	}
 
 	template := x509.Certificate{
@@ -640,24 +756,28 @@ func federationServer(cfg *config.Complement, h http.Handler) (*http.Server, str
 		template.DNSNames = append(template.DNSNames, host)
 	}
 
-	// derive a new certificate from the base complement one
-	derBytes, err = x509.CreateCertificate(rand.Reader, &template, cfg.CACertificate, &priv.PublicKey, cfg.CAPrivateKey)
+	if selfSigned {
+		derBytes, err = x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	} else {
+		// derive a new certificate from the base complement one
+		derBytes, err = x509.CreateCertificate(rand.Reader, &template, cfg.CACertificate, &priv.PublicKey, cfg.CAPrivateKey)
+	}
 	if err != nil {
-		return nil, "", "", err
+		return "", "", err
 	}
 
 	certOut, err := os.Create(tlsCertPath)
 	if err != nil {
-		return nil, "", "", err
+		return "", "", err
 	}
 	defer certOut.Close() // nolint: errcheck
 	if err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		return nil, "", "", err
+		return "", "", err
 	}
 
 	keyOut, err := os.OpenFile(tlsKeyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return nil, "", "", err
+		return "", "", err
 	}
 	defer keyOut.Close() // nolint: errcheck
 	err = pem.Encode(keyOut, &pem.Block{
@@ -665,10 +785,10 @@ func federationServer(cfg *config.Complement, h http.Handler) (*http.Server, str
 		Bytes: x509.MarshalPKCS1PrivateKey(priv),
 	})
 	if err != nil {
-		return nil, "", "", err
+		return "", "", err
 	}
 
-	return srv, tlsCertPath, tlsKeyPath, nil
+	return tlsCertPath, tlsKeyPath, nil
 }
 
 type nopKeyDatabase struct {
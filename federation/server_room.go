@@ -31,6 +31,13 @@ type Event struct {
 	// The prev events of the event if we want to override or falsify them.
 	// If it is left at nil, MustCreateEvent will populate it automatically based on the forward extremities.
 	PrevEvents interface{}
+	// The depth of the event if we want to override or falsify it.
+	// If it is left at 0, MustCreateEvent will use one more than the current depth of the room.
+	Depth int64
+	// The origin_server_ts of the event if we want to override or falsify it.
+	// If it is left at the zero value, MustCreateEvent will use the current time. Setting this bypasses
+	// the room's EventCreator, as it has no way of being told the timestamp.
+	OriginServerTS time.Time
 	// If this is a redaction, the event that it redacts
 	Redacts string
 }
@@ -442,9 +449,13 @@ func (i *ServerRoomImplDefault) ProtoEventCreator(room *ServerRoom, ev Event) (*
 		// the usual behaviour.
 		prevEvents = room.ForwardExtremities
 	}
+	depth := ev.Depth
+	if depth == 0 {
+		depth = room.Depth + 1 // depth starts at 1
+	}
 	proto := gomatrixserverlib.ProtoEvent{
 		SenderID:   ev.Sender,
-		Depth:      int64(room.Depth + 1), // depth starts at 1
+		Depth:      depth,
 		Type:       ev.Type,
 		StateKey:   ev.StateKey,
 		RoomID:     room.RoomID,
@@ -476,12 +487,17 @@ func (i *ServerRoomImplDefault) ProtoEventCreator(room *ServerRoom, ev Event) (*
 }
 
 func (i *ServerRoomImplDefault) EventCreator(room *ServerRoom, s *Server, proto *gomatrixserverlib.ProtoEvent) (gomatrixserverlib.PDU, error) {
+	return signEvent(room, s, proto, time.Now())
+}
+
+// signEvent converts a proto event into a PDU with the given origin_server_ts, signed by the server.
+func signEvent(room *ServerRoom, s *Server, proto *gomatrixserverlib.ProtoEvent, ts time.Time) (gomatrixserverlib.PDU, error) {
 	verImpl, err := gomatrixserverlib.GetRoomVersion(room.Version)
 	if err != nil {
 		return nil, fmt.Errorf("EventCreator: invalid room version: %s", err)
 	}
 	eb := verImpl.NewEventBuilderFromProtoEvent(proto)
-	signedEvent, err := eb.Build(time.Now(), spec.ServerName(s.serverName), s.KeyID, s.Priv)
+	signedEvent, err := eb.Build(ts, spec.ServerName(s.serverName), s.KeyID, s.Priv)
 	if err != nil {
 		return nil, fmt.Errorf("EventCreator: failed to sign event: %s", err)
 	}
@@ -0,0 +1,121 @@
+package federation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// StateSnapshot is the resolved state of a room, as a map of (type, state_key) to event ID.
+// Snapshots can be taken from a ServerRoom or from a real homeserver, and compared to check that
+// the servers have converged on the same state.
+type StateSnapshot map[gomatrixserverlib.StateKeyTuple]string
+
+// NewStateSnapshot creates a snapshot from the given state events. Events which are not state events are ignored.
+func NewStateSnapshot(events []gomatrixserverlib.PDU) StateSnapshot {
+	snapshot := make(StateSnapshot, len(events))
+	for _, ev := range events {
+		if ev.StateKey() == nil {
+			continue
+		}
+		snapshot[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev.EventID()
+	}
+	return snapshot
+}
+
+// StateSnapshot returns the current state of the room.
+func (r *ServerRoom) StateSnapshot() StateSnapshot {
+	return NewStateSnapshot(r.AllCurrentState())
+}
+
+// Diff returns a human readable line for each (type, state_key) whose event differs between this
+// snapshot and `other`, sorted by type then state key. Returns nil if the snapshots are the same.
+func (s StateSnapshot) Diff(other StateSnapshot) (diffs []string) {
+	tuples := make(map[gomatrixserverlib.StateKeyTuple]struct{}, len(s))
+	for tuple := range s {
+		tuples[tuple] = struct{}{}
+	}
+	for tuple := range other {
+		tuples[tuple] = struct{}{}
+	}
+	for tuple := range tuples {
+		got, want := s[tuple], other[tuple]
+		if got == want {
+			continue
+		}
+		if got == "" {
+			got = "<missing>"
+		}
+		if want == "" {
+			want = "<missing>"
+		}
+		diffs = append(diffs, fmt.Sprintf("(%s, %q): %s != %s", tuple.EventType, tuple.StateKey, got, want))
+	}
+	sort.Strings(diffs)
+	return diffs
+}
+
+// MustEqual fails the test if this snapshot is not the same as `other`, logging every difference.
+func (s StateSnapshot) MustEqual(t ct.TestLike, other StateSnapshot, msg string) {
+	t.Helper()
+	diffs := s.Diff(other)
+	if len(diffs) > 0 {
+		ct.Fatalf(t, "%s: state snapshots differ in %d entries:\n%s", msg, len(diffs), strings.Join(diffs, "\n"))
+	}
+}
+
+// MustGetClientStateSnapshot returns the current state of the room as seen by the client via the CS API /state endpoint.
+func MustGetClientStateSnapshot(t ct.TestLike, c *client.CSAPI, roomID string) StateSnapshot {
+	t.Helper()
+	res := c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "state"})
+	body := client.ParseJSON(t, res)
+	snapshot := make(StateSnapshot)
+	gjson.ParseBytes(body).ForEach(func(_, ev gjson.Result) bool {
+		snapshot[gomatrixserverlib.StateKeyTuple{
+			EventType: ev.Get("type").Str,
+			StateKey:  ev.Get("state_key").Str,
+		}] = ev.Get("event_id").Str
+		return true
+	})
+	return snapshot
+}
+
+// MustGetStateSnapshot returns the state of the room after the event `atEventID`, as seen by the
+// remote server via the federation /state endpoint. The event must be known to the remote server.
+func (s *Server) MustGetStateSnapshot(t ct.TestLike, deployment FederationDeployment, remoteServer spec.ServerName, room *ServerRoom, atEventID string) StateSnapshot {
+	t.Helper()
+	fedClient := s.FederationClient(deployment)
+	resp, err := fedClient.LookupState(context.Background(), s.ServerName(), remoteServer, room.RoomID, atEventID, room.Version)
+	if err != nil {
+		ct.Fatalf(t, "MustGetStateSnapshot: /state at %s failed: %s", atEventID, err)
+	}
+	snapshot := NewStateSnapshot(resp.StateEvents.UntrustedEvents(room.Version))
+	// /state returns the state *before* the event, so apply the event itself if it is a state event.
+	// Ask for the event from the remote server, as it may not be in our copy of the room.
+	res, err := fedClient.GetEvent(context.Background(), s.ServerName(), remoteServer, atEventID)
+	if err != nil {
+		ct.Fatalf(t, "MustGetStateSnapshot: failed to get event %s: %s", atEventID, err)
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(room.Version)
+	if err != nil {
+		ct.Fatalf(t, "MustGetStateSnapshot: invalid room version: %s", err)
+	}
+	for _, pdu := range res.PDUs {
+		ev, err := verImpl.NewEventFromUntrustedJSON(pdu)
+		if err != nil {
+			ct.Fatalf(t, "MustGetStateSnapshot: failed to parse event %s: %s", atEventID, err)
+		}
+		if ev.EventID() == atEventID && ev.StateKey() != nil {
+			snapshot[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev.EventID()
+		}
+	}
+	return snapshot
+}
@@ -1,11 +1,22 @@
 package federation
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/internal"
 )
@@ -74,3 +85,529 @@ func TestComplementServerIsSigned(t *testing.T) {
 		}
 	}
 }
+
+func TestComplementServerListensOnMultipleListeners(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	})
+	srv.UnexpectedRequestsAreErrors = false
+	srv.Mux().HandleFunc("/ping", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+	})
+	ln1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %s", err)
+	}
+	cancel1 := srv.ListenOn(ln1)
+	defer cancel1()
+	cancel2 := srv.ListenOn(ln2)
+
+	if srv.ServerName() != srv.ServerNameFor(ln1) {
+		t.Errorf("server name %s is not the name of the first listener %s", srv.ServerName(), srv.ServerNameFor(ln1))
+	}
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(cfg.CACertificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+	for _, ln := range []net.Listener{ln1, ln2} {
+		resp, err := client.Get("https://" + string(srv.ServerNameFor(ln)) + "/ping")
+		if err != nil {
+			t.Fatalf("Failed to GET %s: %s", srv.ServerNameFor(ln), err)
+		}
+		internal.CloseIO(resp.Body, "server response body")
+		if resp.StatusCode != 200 {
+			t.Errorf("%s: expected 200, got %d", srv.ServerNameFor(ln), resp.StatusCode)
+		}
+	}
+
+	// closing one listener leaves the other running
+	cancel2()
+	if _, err = client.Get("https://" + string(srv.ServerNameFor(ln2)) + "/ping"); err == nil {
+		t.Errorf("expected request to closed listener to fail")
+	}
+	resp, err := client.Get("https://" + string(srv.ServerNameFor(ln1)) + "/ping")
+	if err != nil {
+		t.Fatalf("Failed to GET after closing other listener: %s", err)
+	}
+	internal.CloseIO(resp.Body, "server response body")
+}
+
+func TestComplementServerTLSOptions(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(cfg.CACertificate)
+
+	testCases := []struct {
+		name        string
+		opts        []func(*Server)
+		client      *tls.Config
+		wantSuccess bool
+		wantProto   string
+	}{
+		{
+			name:        "TLS 1.3 only rejects TLS 1.2 clients",
+			opts:        []func(*Server){WithTLSVersions(tls.VersionTLS13, 0)},
+			client:      &tls.Config{RootCAs: caCertPool, MaxVersion: tls.VersionTLS12},
+			wantSuccess: false,
+		},
+		{
+			name:        "cipher suites are restricted",
+			opts:        []func(*Server){WithTLSVersions(0, tls.VersionTLS12), WithCipherSuites(tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384)},
+			client:      &tls.Config{RootCAs: caCertPool, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+			wantSuccess: false,
+		},
+		{
+			name:        "ALPN without h2 negotiates http/1.1",
+			opts:        []func(*Server){WithALPN("http/1.1")},
+			client:      &tls.Config{RootCAs: caCertPool, NextProtos: []string{"h2", "http/1.1"}},
+			wantSuccess: true,
+			wantProto:   "http/1.1",
+		},
+		{
+			name:        "self-signed certificate is not trusted",
+			opts:        []func(*Server){WithSelfSignedCertificate()},
+			client:      &tls.Config{RootCAs: caCertPool},
+			wantSuccess: false,
+		},
+	}
+	for _, tc := range testCases {
+		srv := NewServer(t, &fedDeploy{
+			cfg:     cfg,
+			tripper: http.DefaultClient.Transport,
+		}, tc.opts...)
+		cancel := srv.Listen()
+		conn, err := tls.Dial("tcp", string(srv.ServerName()), tc.client)
+		if err == nil {
+			if got := conn.ConnectionState().NegotiatedProtocol; tc.wantProto != "" && got != tc.wantProto {
+				t.Errorf("%s: negotiated protocol %s, want %s", tc.name, got, tc.wantProto)
+			}
+			conn.Close()
+		}
+		if tc.wantSuccess && err != nil {
+			t.Errorf("%s: handshake failed: %s", tc.name, err)
+		} else if !tc.wantSuccess && err == nil {
+			t.Errorf("%s: handshake succeeded when it should have failed", tc.name)
+		}
+		cancel()
+	}
+}
+
+func TestComplementServerMiddleware(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	})
+	srv.Mux().HandleFunc("/ping", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+	})
+	cancel := srv.Listen()
+	defer cancel()
+	capture := NewRequestCapture(MatchAll())
+	srv.Use(capture.Middleware)
+	removeFail := srv.Use(FailRequests(MatchRoute("/ping"), 500, 1))
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(cfg.CACertificate)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+	get := func() int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "https://"+string(srv.ServerName())+"/ping", nil)
+		req.Header.Set("Authorization", `X-Matrix origin="hs1",destination="`+string(srv.ServerName())+`",key="ed25519:abc",sig="sig"`)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to GET: %s", err)
+		}
+		internal.CloseIO(resp.Body, "server response body")
+		return resp.StatusCode
+	}
+	if code := get(); code != 500 {
+		t.Errorf("first request: got %d want 500", code)
+	}
+	if code := get(); code != 200 {
+		t.Errorf("second request: got %d want 200", code)
+	}
+	removeFail()
+	srv.Use(FailRequests(MatchPathPrefix("/elsewhere"), 500, 0))
+	if code := get(); code != 200 {
+		t.Errorf("third request: got %d want 200", code)
+	}
+	reqs := capture.Requests()
+	if len(reqs) != 3 {
+		t.Fatalf("captured %d requests, want 3", len(reqs))
+	}
+	if reqs[0].Origin != "hs1" || reqs[0].KeyID != "ed25519:abc" {
+		t.Errorf("captured request has origin %s key %s, want hs1 ed25519:abc", reqs[0].Origin, reqs[0].KeyID)
+	}
+}
+
+func TestRetryRecorder(t *testing.T) {
+	recorder := NewRetryRecorder(MatchPathPrefix("/_matrix/federation/v1/send/"), 502)
+	handler := recorder.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+	}))
+	send := func(path string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("PUT", path, nil))
+		return w.Code
+	}
+	if code := send("/_matrix/federation/v1/query/profile"); code != 200 {
+		t.Errorf("unmatched request: got %d want 200", code)
+	}
+	go func() {
+		for _, delay := range []time.Duration{0, 10 * time.Millisecond, 30 * time.Millisecond} {
+			time.Sleep(delay)
+			send("/_matrix/federation/v1/send/txn1")
+		}
+	}()
+	attempts := recorder.MustWaitForAttempts(t, 3, 5*time.Second)
+	if len(attempts) != 3 {
+		t.Fatalf("got %d attempts, want 3", len(attempts))
+	}
+	recorder.MustBackOffExponentially(t, 5*time.Millisecond, 1.5)
+	recorder.Stop()
+	if code := send("/_matrix/federation/v1/send/txn1"); code != 200 {
+		t.Errorf("request after Stop: got %d want 200", code)
+	}
+	if got := len(recorder.Attempts()); got != 3 {
+		t.Errorf("got %d attempts after Stop, want 3", got)
+	}
+
+	for _, tc := range []struct {
+		intervals []time.Duration
+		wantErr   bool
+	}{
+		{intervals: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		{intervals: []time.Duration{time.Second}, wantErr: true},
+		{intervals: []time.Duration{100 * time.Millisecond, 2 * time.Second}, wantErr: true},
+		{intervals: []time.Duration{time.Second, 2 * time.Second, 2 * time.Second}, wantErr: true},
+	} {
+		err := checkExponentialBackoff(tc.intervals, 500*time.Millisecond, 1.5)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("checkExponentialBackoff(%v): got err %v, want error: %v", tc.intervals, err, tc.wantErr)
+		}
+	}
+}
+
+func TestComplementServerJoinUsers(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	})
+	cancel := srv.Listen()
+	defer cancel()
+
+	creator := srv.UserID("alice")
+	room := srv.MustMakeRoom(t, gomatrixserverlib.RoomVersionV10, InitialRoomEvents(gomatrixserverlib.RoomVersionV10, creator))
+
+	// public room: users join directly
+	users := srv.UserIDs("bob", 3)
+	pdus := srv.MustJoinUsers(t, room, "", users...)
+	if len(pdus) != len(users) {
+		t.Fatalf("MustJoinUsers returned %d events, want %d", len(pdus), len(users))
+	}
+	for _, userID := range users {
+		room.MustHaveMembershipForUser(t, userID, spec.Join)
+	}
+	// already joined users are skipped
+	if pdus = srv.MustJoinUsers(t, room, "", users...); len(pdus) != 0 {
+		t.Fatalf("MustJoinUsers returned %d events for joined users, want 0", len(pdus))
+	}
+
+	// invite-only room: users are invited first
+	room.AddEvent(srv.MustCreateEvent(t, room, Event{
+		Type:     spec.MRoomJoinRules,
+		StateKey: b.Ptr(""),
+		Sender:   creator,
+		Content:  map[string]interface{}{"join_rule": spec.Invite},
+	}))
+	charlie := srv.UserID("charlie")
+	pdus = srv.MustCreateEventAs(t, room, charlie, Event{
+		Type:    "m.room.message",
+		Content: map[string]interface{}{"msgtype": "m.text", "body": "hello"},
+	})
+	if len(pdus) != 3 {
+		t.Fatalf("MustCreateEventAs returned %d events, want invite, join and message", len(pdus))
+	}
+	if membership, _ := pdus[0].Membership(); membership != spec.Invite {
+		t.Fatalf("first event is not an invite: %s", pdus[0].JSON())
+	}
+	if pdus[2].SenderID() != spec.SenderID(charlie) {
+		t.Fatalf("message sent by %s, want %s", pdus[2].SenderID(), charlie)
+	}
+	room.MustHaveMembershipForUser(t, charlie, spec.Join)
+}
+
+func TestStateSnapshotDiff(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	})
+	cancel := srv.Listen()
+	defer cancel()
+
+	room := srv.MustMakeRoom(t, gomatrixserverlib.RoomVersionV10, InitialRoomEvents(gomatrixserverlib.RoomVersionV10, srv.UserID("alice")))
+	before := room.StateSnapshot()
+	if diffs := before.Diff(room.StateSnapshot()); len(diffs) != 0 {
+		t.Fatalf("snapshot differs from itself: %v", diffs)
+	}
+	bob := srv.UserID("bob")
+	srv.MustJoinUsers(t, room, "", bob)
+	diffs := before.Diff(room.StateSnapshot())
+	if len(diffs) != 1 {
+		t.Fatalf("got %d diffs, want 1: %v", len(diffs), diffs)
+	}
+	wantDiff := fmt.Sprintf("(m.room.member, %q): <missing> != %s", bob, room.CurrentState(spec.MRoomMember, bob).EventID())
+	if diffs[0] != wantDiff {
+		t.Fatalf("got diff %q, want %q", diffs[0], wantDiff)
+	}
+}
+
+func TestRoomDAG(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	})
+	cancel := srv.Listen()
+	defer cancel()
+
+	room := srv.MustMakeRoom(t, gomatrixserverlib.RoomVersionV10, InitialRoomEvents(gomatrixserverlib.RoomVersionV10, srv.UserID("alice")))
+	dag := room.DAG()
+	if len(dag.Events) != len(room.Timeline) {
+		t.Fatalf("got %d events, want %d", len(dag.Events), len(room.Timeline))
+	}
+	if dag.Events[0].Type != spec.MRoomCreate {
+		t.Fatalf("first event is %s, want %s", dag.Events[0].Type, spec.MRoomCreate)
+	}
+	dot := dag.DOT(false)
+	for _, ev := range dag.Events[1:] {
+		for _, prev := range ev.PrevEvents {
+			edge := fmt.Sprintf("%q -> %q;", ev.EventID, prev)
+			if !strings.Contains(dot, edge) {
+				t.Errorf("DOT missing edge %s:\n%s", edge, dot)
+			}
+		}
+	}
+	if strings.Contains(dot, "style=dashed") {
+		t.Errorf("DOT contains auth edges without withAuthEvents:\n%s", dot)
+	}
+	if !strings.Contains(dag.DOT(true), "style=dashed") {
+		t.Errorf("DOT with auth events has no auth edges")
+	}
+	var got DAG
+	if err := json.Unmarshal(dag.JSON(), &got); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %s", err)
+	}
+	if got.RoomID != room.RoomID || len(got.Events) != len(dag.Events) {
+		t.Errorf("JSON round trip: got %+v", got)
+	}
+}
+
+func TestServerPersistence(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	deployment := &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	}
+	dir := t.TempDir()
+	srv := NewServer(t, deployment, WithPersistence(dir))
+	cancel := srv.Listen()
+	room := srv.MustMakeRoom(t, gomatrixserverlib.RoomVersionV10, InitialRoomEvents(gomatrixserverlib.RoomVersionV10, srv.UserID("alice")))
+	alias := srv.MakeAliasMapping("persisted", room.RoomID)
+	req := httptest.NewRequest("PUT", "/_matrix/federation/v1/send/txn1", bytes.NewBufferString(`{"origin":"hs1","pdus":[{}],"edus":[]}`))
+	srv.logTransactions(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), req)
+	cancel()
+
+	resumed := NewServer(t, deployment, WithPersistence(dir))
+	cancel = resumed.Listen()
+	defer cancel()
+	if resumed.ServerName() != srv.ServerName() || resumed.KeyID != srv.KeyID || !resumed.Priv.Equal(srv.Priv) {
+		t.Fatalf("resumed server has a different identity: %s %s, want %s %s", resumed.ServerName(), resumed.KeyID, srv.ServerName(), srv.KeyID)
+	}
+	resumedRoom := resumed.rooms[room.RoomID]
+	if resumedRoom == nil {
+		t.Fatalf("resumed server does not have room %s", room.RoomID)
+	}
+	if len(resumedRoom.Timeline) != len(room.Timeline) || resumedRoom.Depth != room.Depth {
+		t.Errorf("resumed room has %d events at depth %d, want %d at depth %d", len(resumedRoom.Timeline), resumedRoom.Depth, len(room.Timeline), room.Depth)
+	}
+	if diffs := room.StateSnapshot().Diff(resumedRoom.StateSnapshot()); len(diffs) != 0 {
+		t.Errorf("resumed room state differs: %v", diffs)
+	}
+	if resumed.aliases[alias].roomID != room.RoomID {
+		t.Errorf("resumed server does not map %s to %s", alias, room.RoomID)
+	}
+	txns := resumed.TransactionLog(t)
+	if len(txns) != 1 || txns[0].TransactionID != "txn1" || txns[0].Origin != "hs1" || len(txns[0].PDUs) != 1 {
+		t.Errorf("TransactionLog: got %+v", txns)
+	}
+}
+
+func TestComplementServerCreateEventOverrides(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	})
+	cancel := srv.Listen()
+	defer cancel()
+
+	alice := srv.UserID("alice")
+	room := srv.MustMakeRoom(t, gomatrixserverlib.RoomVersionV10, InitialRoomEvents(gomatrixserverlib.RoomVersionV10, alice))
+	createEvent := room.CurrentState(spec.MRoomCreate, "")
+	aliceJoin := room.CurrentState(spec.MRoomMember, alice)
+	ts := time.UnixMilli(1234567890)
+	ev := srv.MustCreateEvent(t, room, Event{
+		Type:           "m.room.message",
+		Sender:         alice,
+		Content:        map[string]interface{}{"body": "from the past"},
+		PrevEvents:     []string{createEvent.EventID()},
+		AuthEvents:     []string{createEvent.EventID(), aliceJoin.EventID()},
+		Depth:          100,
+		OriginServerTS: ts,
+	})
+	if got := ev.PrevEventIDs(); len(got) != 1 || got[0] != createEvent.EventID() {
+		t.Errorf("prev_events: got %v want [%s]", got, createEvent.EventID())
+	}
+	if got := ev.AuthEventIDs(); len(got) != 2 || got[0] != createEvent.EventID() || got[1] != aliceJoin.EventID() {
+		t.Errorf("auth_events: got %v want [%s %s]", got, createEvent.EventID(), aliceJoin.EventID())
+	}
+	if ev.Depth() != 100 {
+		t.Errorf("depth: got %d want 100", ev.Depth())
+	}
+	if got := ev.OriginServerTS().Time(); !got.Equal(ts) {
+		t.Errorf("origin_server_ts: got %v want %v", got, ts)
+	}
+
+	// without overrides, the event follows on from the room
+	ev = srv.MustCreateEvent(t, room, Event{
+		Type:    "m.room.message",
+		Sender:  alice,
+		Content: map[string]interface{}{"body": "now"},
+	})
+	if ev.Depth() != room.Depth+1 {
+		t.Errorf("depth: got %d want %d", ev.Depth(), room.Depth+1)
+	}
+	if time.Since(ev.OriginServerTS().Time()) > time.Minute {
+		t.Errorf("origin_server_ts: got %v want now", ev.OriginServerTS().Time())
+	}
+}
+
+func TestMustGetServerKeys(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	}, HandleKeyRequests())
+	cancel := srv.Listen()
+	defer cancel()
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AddCert(cfg.CACertificate)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caCertPool}}}
+
+	keys := MustGetServerKeys(t, httpClient, srv.ServerName())
+	if got := keys.VerifyKeys[srv.KeyID]; !got.Equal(srv.Priv.Public()) {
+		t.Errorf("got verify key %x for %s, want %x", got, srv.KeyID, srv.Priv.Public())
+	}
+
+	// a response for a different server name is rejected
+	if _, err := parseServerKeys(keys.Raw, "other.example.org", time.Now()); err == nil {
+		t.Errorf("parseServerKeys accepted keys for the wrong server name")
+	}
+	// expired responses are rejected
+	if _, err := parseServerKeys(keys.Raw, srv.ServerName(), keys.ValidUntil.Add(time.Second)); err == nil {
+		t.Errorf("parseServerKeys accepted expired keys")
+	}
+}
+
+func TestTransactionChecker(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := NewServer(t, &fedDeploy{
+		cfg:     cfg,
+		tripper: http.DefaultClient.Transport,
+	})
+	cancel := srv.Listen()
+	defer cancel()
+
+	alice := srv.UserID("alice")
+	room := srv.MustMakeRoom(t, gomatrixserverlib.RoomVersionV10, InitialRoomEvents(gomatrixserverlib.RoomVersionV10, alice))
+	first := srv.MustCreateEvent(t, room, Event{Type: "m.room.message", Sender: alice, Content: map[string]interface{}{"body": "1"}})
+	room.AddEvent(first)
+	second := srv.MustCreateEvent(t, room, Event{Type: "m.room.message", Sender: alice, Content: map[string]interface{}{"body": "2"}})
+
+	checker, remove := srv.CheckTransactions(nil)
+	defer remove()
+	handled := 0
+	handler := checker.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handled++
+	}))
+	send := func(txnID string, pdus []gomatrixserverlib.PDU, numEDUs int) []error {
+		t.Helper()
+		txn := gomatrixserverlib.Transaction{Origin: "hs1", Destination: "localhost"}
+		for _, pdu := range pdus {
+			txn.PDUs = append(txn.PDUs, pdu.JSON())
+		}
+		for i := 0; i < numEDUs; i++ {
+			txn.EDUs = append(txn.EDUs, gomatrixserverlib.EDU{Type: "m.typing"})
+		}
+		body, err := json.Marshal(txn)
+		if err != nil {
+			t.Fatalf("failed to marshal transaction: %s", err)
+		}
+		before := len(checker.Violations())
+		req := httptest.NewRequest("PUT", "/_matrix/federation/v1/send/"+txnID, bytes.NewReader(body))
+		req.Header.Set("Authorization", `X-Matrix origin="hs1",destination="localhost",key="ed25519:a",sig="sig"`)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		return checker.Violations()[before:]
+	}
+
+	if errs := send("1", []gomatrixserverlib.PDU{first, second}, 1); len(errs) != 0 {
+		t.Errorf("valid transaction: got violations %v", errs)
+	}
+	// retrying the same transaction is fine
+	if errs := send("1", []gomatrixserverlib.PDU{first, second}, 1); len(errs) != 0 {
+		t.Errorf("retried transaction: got violations %v", errs)
+	}
+	if errs := send("1", []gomatrixserverlib.PDU{first}, 0); len(errs) != 1 {
+		t.Errorf("reused transaction ID: got violations %v, want 1", errs)
+	}
+	if errs := send("2", []gomatrixserverlib.PDU{second, first}, 0); len(errs) != 1 {
+		t.Errorf("PDU before its prev_event: got violations %v, want 1", errs)
+	}
+	if errs := send("3", nil, MaxTransactionEDUs+1); len(errs) != 1 {
+		t.Errorf("too many EDUs: got violations %v, want 1", errs)
+	}
+	tooManyPDUs := make([]gomatrixserverlib.PDU, MaxTransactionPDUs+1)
+	for i := range tooManyPDUs {
+		tooManyPDUs[i] = first
+	}
+	if errs := send("4", tooManyPDUs, 0); len(errs) != 1 {
+		t.Errorf("too many PDUs: got violations %v, want 1", errs)
+	}
+	if errs := send("0", nil, 1); len(errs) != 1 {
+		t.Errorf("decreasing transaction ID: got violations %v, want 1", errs)
+	}
+	if handled != 7 {
+		t.Errorf("handler called %d times, want 7", handled)
+	}
+}
@@ -0,0 +1,138 @@
+package federation
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/ct"
+)
+
+// UserIDs returns `n` user IDs on this server of the form @prefix-1:server, @prefix-2:server, etc.
+// Only valid AFTER calling Listen().
+func (s *Server) UserIDs(prefix string, n int) []string {
+	userIDs := make([]string, n)
+	for i := range userIDs {
+		userIDs[i] = s.UserID(fmt.Sprintf("%s-%d", prefix, i+1))
+	}
+	return userIDs
+}
+
+// MustCreateEventAs creates an event sent by a user on this server and adds it to the room. If the user
+// is not joined to the room, they are joined first as per MustJoinUsers. Returns all the events which
+// were added to the room, in order, so they can be sent to other servers with MustSendTransaction.
+func (s *Server) MustCreateEventAs(t ct.TestLike, room *ServerRoom, userID string, ev Event) []gomatrixserverlib.PDU {
+	t.Helper()
+	pdus := s.MustJoinUsers(t, room, "", userID)
+	ev.Sender = userID
+	pdu := s.MustCreateEvent(t, room, ev)
+	room.AddEvent(pdu)
+	return append(pdus, pdu)
+}
+
+// MustJoinUsers creates and adds join events to the room for users on this server who are not already
+// joined. If the room is not public, each user is invited by `inviter` first, who must be a joined user on
+// this server with permission to invite. If `inviter` is empty, any joined user on this server is used.
+// Returns all the events which were added to the room, in order, so they can be sent to other servers
+// with MustSendTransaction.
+func (s *Server) MustJoinUsers(t ct.TestLike, room *ServerRoom, inviter string, userIDs ...string) []gomatrixserverlib.PDU {
+	t.Helper()
+	var pdus []gomatrixserverlib.PDU
+	for _, userID := range userIDs {
+		s.mustBeLocalUser(t, "MustJoinUsers", userID)
+		membership := membershipOf(room, userID)
+		if membership == spec.Join {
+			continue
+		}
+		if membership != spec.Invite && joinRuleOf(room) != spec.Public {
+			pdus = append(pdus, s.MustInviteUsers(t, room, inviter, userID)...)
+		}
+		pdu := s.MustCreateEvent(t, room, Event{
+			Type:     spec.MRoomMember,
+			StateKey: b.Ptr(userID),
+			Sender:   userID,
+			Content: map[string]interface{}{
+				"membership": spec.Join,
+			},
+		})
+		room.AddEvent(pdu)
+		pdus = append(pdus, pdu)
+	}
+	return pdus
+}
+
+// MustInviteUsers creates and adds invite events to the room for the users, who can be on any server.
+// `inviter` must be a joined user on this server with permission to invite. If `inviter` is empty, any
+// joined user on this server is used. Returns the invite events, so they can be sent to other servers
+// with MustSendTransaction.
+func (s *Server) MustInviteUsers(t ct.TestLike, room *ServerRoom, inviter string, userIDs ...string) []gomatrixserverlib.PDU {
+	t.Helper()
+	if inviter == "" {
+		inviter = s.joinedLocalUser(t, room)
+	}
+	s.mustBeLocalUser(t, "MustInviteUsers", inviter)
+	pdus := make([]gomatrixserverlib.PDU, 0, len(userIDs))
+	for _, userID := range userIDs {
+		pdu := s.MustCreateEvent(t, room, Event{
+			Type:     spec.MRoomMember,
+			StateKey: b.Ptr(userID),
+			Sender:   inviter,
+			Content: map[string]interface{}{
+				"membership": spec.Invite,
+			},
+		})
+		room.AddEvent(pdu)
+		pdus = append(pdus, pdu)
+	}
+	return pdus
+}
+
+func (s *Server) mustBeLocalUser(t ct.TestLike, caller, userID string) {
+	t.Helper()
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		ct.Fatalf(t, "%s: invalid user ID %s: %s", caller, userID, err)
+	}
+	if domain != s.ServerName() {
+		ct.Fatalf(t, "%s: user %s is not on this server (%s), so this server cannot send events for them", caller, userID, s.ServerName())
+	}
+}
+
+// joinedLocalUser returns a user on this server who is joined to the room.
+func (s *Server) joinedLocalUser(t ct.TestLike, room *ServerRoom) string {
+	t.Helper()
+	for _, ev := range room.AllCurrentState() {
+		if ev.Type() != spec.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		_, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey())
+		if err == nil && domain == s.ServerName() && membershipOf(room, *ev.StateKey()) == spec.Join {
+			return *ev.StateKey()
+		}
+	}
+	ct.Fatalf(t, "no user on %s is joined to room %s", s.ServerName(), room.RoomID)
+	return ""
+}
+
+func membershipOf(room *ServerRoom, userID string) string {
+	ev := room.CurrentState(spec.MRoomMember, userID)
+	if ev == nil {
+		return ""
+	}
+	membership, _ := ev.Membership()
+	return membership
+}
+
+func joinRuleOf(room *ServerRoom) string {
+	ev := room.CurrentState(spec.MRoomJoinRules, "")
+	if ev == nil {
+		return spec.Invite
+	}
+	joinRule, err := ev.JoinRule()
+	if err != nil {
+		return spec.Invite
+	}
+	return joinRule
+}
@@ -0,0 +1,70 @@
+package federation
+
+import (
+	"crypto/tls"
+	"net/http"
+	"slices"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// EXPERIMENTAL
+// WithTLSConfig is an option which modifies the TLS configuration of the server, for anything not covered
+// by the other TLS options. It must be applied before calling Listen().
+func WithTLSConfig(modify func(cfg *tls.Config)) func(*Server) {
+	return func(s *Server) {
+		if s.srv.TLSConfig == nil {
+			s.srv.TLSConfig = &tls.Config{}
+		}
+		modify(s.srv.TLSConfig)
+	}
+}
+
+// EXPERIMENTAL
+// WithTLSVersions is an option which restricts the TLS versions the server accepts e.g tls.VersionTLS12.
+// A zero value leaves the min or max version as the Go default.
+func WithTLSVersions(minVersion, maxVersion uint16) func(*Server) {
+	return WithTLSConfig(func(cfg *tls.Config) {
+		cfg.MinVersion = minVersion
+		cfg.MaxVersion = maxVersion
+	})
+}
+
+// EXPERIMENTAL
+// WithCipherSuites is an option which restricts the cipher suites the server accepts for TLS 1.2 and below
+// e.g tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3 cipher suites are not configurable.
+func WithCipherSuites(suites ...uint16) func(*Server) {
+	return WithTLSConfig(func(cfg *tls.Config) {
+		cfg.CipherSuites = suites
+	})
+}
+
+// EXPERIMENTAL
+// WithALPN is an option which sets the application protocols the server negotiates via ALPN, in order of
+// preference e.g "h2", "http/1.1". HTTP/2 is disabled unless "h2" is listed. The server always supports
+// "http/1.1" as well, as the Go HTTP server requires it.
+func WithALPN(protocols ...string) func(*Server) {
+	return func(s *Server) {
+		WithTLSConfig(func(cfg *tls.Config) {
+			cfg.NextProtos = protocols
+		})(s)
+		if !slices.Contains(protocols, "h2") {
+			// a non-nil map stops the HTTP server from enabling HTTP/2
+			s.srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+	}
+}
+
+// EXPERIMENTAL
+// WithSelfSignedCertificate is an option which makes the server use a self-signed certificate instead of one
+// derived from the Complement CA, which homeservers should refuse to trust.
+func WithSelfSignedCertificate() func(*Server) {
+	return func(s *Server) {
+		certPath, keyPath, err := federationCertificate(s.cfg, true)
+		if err != nil {
+			ct.Fatalf(s.t, "WithSelfSignedCertificate: failed to create certificate: %s", err)
+		}
+		s.certPath = certPath
+		s.keyPath = keyPath
+	}
+}
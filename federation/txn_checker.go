@@ -0,0 +1,169 @@
+package federation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/fclient"
+)
+
+const (
+	// The most PDUs and EDUs a transaction may contain.
+	// https://spec.matrix.org/v1.12/server-server-api/#transactions
+	MaxTransactionPDUs = 50
+	MaxTransactionEDUs = 100
+)
+
+// TransactionChecker checks the transactions homeservers send to the server against the rules of the
+// spec, and reports each violation:
+//   - a transaction has more than MaxTransactionPDUs PDUs or MaxTransactionEDUs EDUs,
+//   - a transaction ID is reused for a different transaction from the same origin,
+//   - numeric transaction IDs from the same origin do not increase,
+//   - a PDU is sent before one of its prev_events in the same transaction.
+//
+// Transactions are still handled as normal. Create one with Server.CheckTransactions, or enable
+// COMPLEMENT_STRICT_FEDERATION to check every transaction sent to every federation server.
+type TransactionChecker struct {
+	srv         *Server
+	onViolation func(err error)
+
+	mu sync.Mutex
+	// origin => transaction ID => body
+	seen map[string]map[string][]byte
+	// origin => the last numeric transaction ID
+	lastNumericID map[string]int64
+	violations    []error
+}
+
+// EXPERIMENTAL
+// CheckTransactions checks all transactions sent to the server from now on, calling `onViolation` for
+// each violation, e.g to fail the test. `onViolation` may be nil, in which case violations are only
+// available via TransactionChecker.Violations. Call `remove` to stop checking.
+func (s *Server) CheckTransactions(onViolation func(err error)) (checker *TransactionChecker, remove func()) {
+	checker = &TransactionChecker{
+		srv:           s,
+		onViolation:   onViolation,
+		seen:          make(map[string]map[string][]byte),
+		lastNumericID: make(map[string]int64),
+	}
+	remove = s.Use(checker.Middleware)
+	return checker, remove
+}
+
+// Middleware checks transactions, then handles them as normal.
+func (c *TransactionChecker) Middleware(next http.Handler) http.Handler {
+	match := MatchPathPrefix("/_matrix/federation/v1/send/")
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !match(req) || req.Method != "PUT" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		_, origin, _, _, _ := fclient.ParseAuthorization(req.Header.Get("Authorization"))
+		for _, err := range c.check(string(origin), path.Base(req.URL.Path), body) {
+			c.report(err)
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Violations returns the violations found so far, in the order they were found.
+func (c *TransactionChecker) Violations() []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]error(nil), c.violations...)
+}
+
+func (c *TransactionChecker) report(err error) {
+	c.mu.Lock()
+	c.violations = append(c.violations, err)
+	c.mu.Unlock()
+	if c.onViolation != nil {
+		c.onViolation(err)
+	}
+}
+
+// check returns the violations in a transaction.
+func (c *TransactionChecker) check(origin, txnID string, body []byte) (violations []error) {
+	var txn gomatrixserverlib.Transaction
+	if err := json.Unmarshal(body, &txn); err != nil {
+		return []error{fmt.Errorf("transaction %s from %s: invalid JSON: %w", txnID, origin, err)}
+	}
+	if len(txn.PDUs) > MaxTransactionPDUs {
+		violations = append(violations, fmt.Errorf("transaction %s from %s has %d PDUs, more than %d", txnID, origin, len(txn.PDUs), MaxTransactionPDUs))
+	}
+	if len(txn.EDUs) > MaxTransactionEDUs {
+		violations = append(violations, fmt.Errorf("transaction %s from %s has %d EDUs, more than %d", txnID, origin, len(txn.EDUs), MaxTransactionEDUs))
+	}
+
+	c.mu.Lock()
+	if c.seen[origin] == nil {
+		c.seen[origin] = make(map[string][]byte)
+	}
+	prevBody, retried := c.seen[origin][txnID]
+	if retried && !bytes.Equal(prevBody, body) {
+		violations = append(violations, fmt.Errorf("transaction ID %s from %s was reused for a different transaction", txnID, origin))
+	}
+	c.seen[origin][txnID] = body
+	// retries of the same transaction are allowed to reuse the ID
+	if id, err := strconv.ParseInt(txnID, 10, 64); err == nil && !retried {
+		if last, ok := c.lastNumericID[origin]; ok && id <= last {
+			violations = append(violations, fmt.Errorf("transaction ID %s from %s is not greater than the previous transaction ID %d", txnID, origin, last))
+		}
+		c.lastNumericID[origin] = id
+	}
+	c.mu.Unlock()
+
+	return append(violations, c.checkPDUOrder(origin, txnID, txn.PDUs)...)
+}
+
+// checkPDUOrder checks that no PDU comes before one of its prev_events in the transaction. PDUs in rooms
+// unknown to the server are skipped, as their event IDs cannot be calculated without the room version.
+func (c *TransactionChecker) checkPDUOrder(origin, txnID string, pdus []json.RawMessage) (violations []error) {
+	// event ID => index in the transaction
+	positions := make(map[string]int)
+	events := make([]gomatrixserverlib.PDU, len(pdus))
+	for i, raw := range pdus {
+		var header struct {
+			RoomID string `json:"room_id"`
+		}
+		if err := json.Unmarshal(raw, &header); err != nil {
+			continue
+		}
+		room := c.srv.rooms[header.RoomID]
+		if room == nil {
+			continue
+		}
+		verImpl, err := gomatrixserverlib.GetRoomVersion(room.Version)
+		if err != nil {
+			continue
+		}
+		ev, err := verImpl.NewEventFromUntrustedJSON(raw)
+		if err != nil {
+			continue
+		}
+		events[i] = ev
+		positions[ev.EventID()] = i
+	}
+	for i, ev := range events {
+		if ev == nil {
+			continue
+		}
+		for _, prev := range ev.PrevEventIDs() {
+			if j, ok := positions[prev]; ok && j > i {
+				violations = append(violations, fmt.Errorf(
+					"transaction %s from %s has PDU %s at position %d before its prev_event %s at position %d", txnID, origin, ev.EventID(), i, prev, j,
+				))
+			}
+		}
+	}
+	return violations
+}
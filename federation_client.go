@@ -0,0 +1,79 @@
+package complement
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// FederationHTTPClient returns an HTTP client for requests to the federation API of homeservers in the
+// deployment e.g `https://hs1/_matrix/federation/v1/version`, which unlike deployment.RoundTripper()
+// verifies that the homeserver's TLS certificate is signed by the Complement CA for its server name, as
+// other homeservers would. Requests are not signed, so this is for unauthenticated endpoints. For non-Docker
+// deployments, the deployment's RoundTripper is used as-is.
+func FederationHTTPClient(t ct.TestLike, deployment Deployment) *http.Client {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(*docker.Deployment)
+	if !ok {
+		t.Logf("FederationHTTPClient: deployment %T is not a Docker deployment, TLS certificates will not be verified", deployment)
+		return &http.Client{Timeout: 10 * time.Second, Transport: deployment.RoundTripper()}
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &caVerifyingRoundTripper{dep: dep, transports: make(map[string]*http.Transport)},
+	}
+}
+
+// caVerifyingRoundTripper maps homeserver names to the host-accessible federation port like
+// docker.RoundTripper, but verifies certificates against the Complement CA.
+type caVerifyingRoundTripper struct {
+	dep *docker.Deployment
+	// a transport per homeserver, as the TLS server name differs
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+func (rt *caVerifyingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	hsName := req.URL.Hostname()
+	hsDep, ok := rt.dep.HS[hsName]
+	if !ok {
+		return nil, fmt.Errorf("FederationHTTPClient: unknown homeserver '%s'", hsName)
+	}
+	fedURL, err := url.Parse(hsDep.FedBaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("FederationHTTPClient: failed to parse federation URL of %s: %s", hsName, err)
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "https"
+	req.URL.Host = fedURL.Host
+	req.Host = hsName
+	return rt.transport(hsName).RoundTrip(req)
+}
+
+func (rt *caVerifyingRoundTripper) transport(hsName string) *http.Transport {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if transport, ok := rt.transports[hsName]; ok {
+		return transport
+	}
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName: hsName,
+			// The certificate is verified below instead, as the Complement PKI docs sign certificates with
+			// only a common name, which crypto/tls does not accept for hostname verification.
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return rt.dep.Config.VerifyCertificate(rawCerts, hsName)
+			},
+		},
+	}
+	rt.transports[hsName] = transport
+	return transport
+}
@@ -0,0 +1,83 @@
+// package fuzz contains a harness for sending malformed and boundary request bodies to client-server
+// API endpoints, asserting that the homeserver never returns a 5xx and continues to function afterwards.
+//
+// Fuzzing tests are slow, so should only be run when COMPLEMENT_LONG_MODE is enabled.
+package fuzz
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// TxnIDPlaceholder can be used as a path segment in a Template. It will be replaced with a unique
+// transaction ID for every request.
+const TxnIDPlaceholder = "{txnID}"
+
+// Template is a valid request which will be used as a base to generate mutations.
+type Template struct {
+	Method string
+	Paths  []string
+	// A valid request body. Must be accepted by the server with a 2xx response.
+	Body map[string]interface{}
+}
+
+// Opts configures a fuzzing run.
+type Opts struct {
+	// The seed for the random number generator. Runs with the same seed send the same requests.
+	Seed int64
+	// The maximum number of mutations to send. Default: 200
+	Iterations int
+	// An optional check which is called after all mutations have been sent, to assert that the
+	// homeserver state has not been corrupted. The valid template is always re-sent and must succeed
+	// regardless of whether this is set.
+	CheckState func(t ct.TestLike)
+}
+
+// MustNotServerError sends mutations of the template to the server, failing the test if any
+// response is a 5xx. The valid template is sent before and after fuzzing, and must succeed both times.
+func MustNotServerError(t ct.TestLike, c *client.CSAPI, tmpl Template, opts Opts) {
+	t.Helper()
+	if opts.Iterations == 0 {
+		opts.Iterations = 200
+	}
+	endpoint := tmpl.Method + " /" + strings.Join(tmpl.Paths, "/")
+	t.Logf("fuzz: %s with seed %d", endpoint, opts.Seed)
+
+	res := send(t, c, tmpl, client.WithJSONBody(t, tmpl.Body))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		ct.Fatalf(t, "fuzz: %s: valid template returned HTTP %d before fuzzing", endpoint, res.StatusCode)
+	}
+
+	rng := rand.New(rand.NewSource(opts.Seed))
+	for _, mut := range Mutations(rng, tmpl.Body, opts.Iterations) {
+		res = send(t, c, tmpl, client.WithRawBody(mut.Body))
+		if res.StatusCode >= 500 {
+			ct.Errorf(t, "fuzz: %s: mutation '%s' returned HTTP %d (seed %d)", endpoint, mut.Description, res.StatusCode, opts.Seed)
+		}
+	}
+
+	res = send(t, c, tmpl, client.WithJSONBody(t, tmpl.Body))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		ct.Errorf(t, "fuzz: %s: valid template returned HTTP %d after fuzzing (seed %d)", endpoint, res.StatusCode, opts.Seed)
+	}
+	if opts.CheckState != nil {
+		opts.CheckState(t)
+	}
+}
+
+func send(t ct.TestLike, c *client.CSAPI, tmpl Template, body client.RequestOpt) *http.Response {
+	t.Helper()
+	paths := make([]string, len(tmpl.Paths))
+	for i := range tmpl.Paths {
+		paths[i] = tmpl.Paths[i]
+		if paths[i] == TxnIDPlaceholder {
+			paths[i] = helpers.GetTxnID("fuzz")
+		}
+	}
+	return c.Do(t, tmpl.Method, paths, body)
+}
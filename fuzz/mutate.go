@@ -0,0 +1,146 @@
+package fuzz
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Mutation is a malformed or boundary request body derived from a valid template.
+type Mutation struct {
+	// A human readable description of what was changed, for logging.
+	Description string
+	// The raw request body to send. This may not be valid JSON.
+	Body []byte
+}
+
+// boundaryValues are substituted in place of valid values. They are chosen to hit common edge cases
+// in JSON parsing, type checking and canonical JSON handling.
+var boundaryValues = []struct {
+	name  string
+	value interface{}
+}{
+	{"null", nil},
+	{"empty string", ""},
+	{"long string", strings.Repeat("A", 65536)},
+	{"unicode string", "\u0000\u202e\U0001F600\uffff"},
+	{"zero", 0},
+	{"negative integer", -1},
+	{"max int64", int64(math.MaxInt64)},
+	{"min int64", int64(math.MinInt64)},
+	{"beyond canonical json range", float64(1 << 53)},
+	{"float", 1.5},
+	{"true", true},
+	{"false", false},
+	{"empty array", []interface{}{}},
+	{"array", []interface{}{"a", 1, nil}},
+	{"empty object", map[string]interface{}{}},
+	{"nested object", map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{}}}},
+}
+
+// rawBodies are request bodies which are not valid JSON objects at all.
+var rawBodies = []struct {
+	name string
+	body string
+}{
+	{"empty body", ""},
+	{"not json", "not json"},
+	{"json null", "null"},
+	{"json array", "[]"},
+	{"json string", `"string"`},
+	{"json number", "42"},
+	{"truncated object", `{"a":`},
+	{"trailing garbage", `{}}`},
+	{"invalid utf-8", "{\"a\":\"\xff\xfe\"}"},
+	{"deeply nested", strings.Repeat("[", 10000) + strings.Repeat("]", 10000)},
+}
+
+// Mutations generates up to `n` mutations of the template body. The first mutations systematically
+// remove each key and replace each key with every boundary value, then non-object bodies are returned,
+// after which random combinations of mutations are generated using `rng`. The same `rng` seed will
+// always produce the same mutations for the same template.
+func Mutations(rng *rand.Rand, template map[string]interface{}, n int) []Mutation {
+	var muts []Mutation
+	add := func(desc string, body []byte) bool {
+		muts = append(muts, Mutation{Description: desc, Body: body})
+		return len(muts) >= n
+	}
+	keys := sortedKeys(template)
+	for _, k := range keys {
+		body := cloneWith(template, k, nil, true)
+		if add(fmt.Sprintf("remove key '%s'", k), mustMarshal(body)) {
+			return muts
+		}
+		for _, bv := range boundaryValues {
+			body = cloneWith(template, k, bv.value, false)
+			if add(fmt.Sprintf("set key '%s' to %s", k, bv.name), mustMarshal(body)) {
+				return muts
+			}
+		}
+	}
+	for _, rb := range rawBodies {
+		if add(rb.name, []byte(rb.body)) {
+			return muts
+		}
+	}
+	if len(keys) == 0 {
+		return muts
+	}
+	// random combinations of several mutations at once
+	for {
+		body := cloneWith(template, "", nil, false)
+		var descs []string
+		numChanges := 1 + rng.Intn(len(keys))
+		for i := 0; i < numChanges; i++ {
+			k := keys[rng.Intn(len(keys))]
+			bv := boundaryValues[rng.Intn(len(boundaryValues))]
+			body[k] = bv.value
+			descs = append(descs, fmt.Sprintf("'%s'=%s", k, bv.name))
+		}
+		if rng.Intn(4) == 0 {
+			extra := fmt.Sprintf("complement_fuzz_%d", rng.Intn(1000))
+			body[extra] = boundaryValues[rng.Intn(len(boundaryValues))].value
+			descs = append(descs, fmt.Sprintf("extra key '%s'", extra))
+		}
+		if add("random: "+strings.Join(descs, ", "), mustMarshal(body)) {
+			return muts
+		}
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cloneWith returns a shallow copy of `m` with `key` set to `val`, or removed if `remove` is true.
+func cloneWith(m map[string]interface{}, key string, val interface{}, remove bool) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	if key == "" {
+		return out
+	}
+	if remove {
+		delete(out, key)
+	} else {
+		out[key] = val
+	}
+	return out
+}
+
+func mustMarshal(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("fuzz: failed to marshal mutation: %s", err))
+	}
+	return b
+}
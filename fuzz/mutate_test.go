@@ -0,0 +1,24 @@
+package fuzz
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestMutationsAreDeterministic(t *testing.T) {
+	template := map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "hello",
+	}
+	a := Mutations(rand.New(rand.NewSource(42)), template, 100)
+	b := Mutations(rand.New(rand.NewSource(42)), template, 100)
+	if len(a) != 100 || len(b) != 100 {
+		t.Fatalf("got %d and %d mutations, want 100", len(a), len(b))
+	}
+	for i := range a {
+		if a[i].Description != b[i].Description || !bytes.Equal(a[i].Body, b[i].Body) {
+			t.Fatalf("mutation %d differs with the same seed: '%s' vs '%s'", i, a[i].Description, b[i].Description)
+		}
+	}
+}
@@ -17,6 +17,7 @@ require (
 	golang.org/x/crypto v0.45.0
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9
 	gonum.org/v1/plot v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
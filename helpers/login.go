@@ -0,0 +1,42 @@
+package helpers
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// LoginPassword returns the password to log in as the user with. If `password` is empty, opts.Password is
+// used, falling back to the password blueprints give their users.
+func LoginPassword(t ct.TestLike, userID, password string, opts LoginOpts) string {
+	t.Helper()
+	if password == "" {
+		password = opts.Password
+	}
+	if password == "" {
+		localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			ct.Fatalf(t, "LoginPassword: invalid user ID '%s': %s", userID, err)
+		}
+		password = b.UserPassword(localpart)
+	}
+	return password
+}
+
+// MustLogin logs in the unauthenticated client as the user with a password, creating a new device unless
+// `deviceID` is set. The user ID, access token, device ID and password of the client are set on success.
+func MustLogin(t ct.TestLike, c *client.CSAPI, userID, password, deviceID string) {
+	t.Helper()
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		ct.Fatalf(t, "MustLogin: invalid user ID '%s', cannot login as this user: %s", userID, err)
+	}
+	c.Password = password
+	if deviceID == "" {
+		c.UserID, c.AccessToken, c.DeviceID = c.LoginUser(t, localpart, password)
+	} else {
+		c.UserID, c.AccessToken, c.DeviceID = c.LoginUser(t, localpart, password, client.WithDeviceID(deviceID))
+	}
+}
@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+
+	"github.com/matrix-org/complement/config"
+)
+
+// buildBaseImages builds the base images in the config which are Dockerfiles or build contexts rather than
+// images, replacing them in the config with the built images.
+func buildBaseImages(docker *client.Client, cfg *config.Complement) error {
+	var err error
+	cfg.BaseImageURI, err = buildBaseImageIfContext(docker, cfg.BaseImageURI)
+	if err != nil {
+		return fmt.Errorf("COMPLEMENT_BASE_IMAGE: %w", err)
+	}
+	for hsName, uri := range cfg.BaseImageURIs {
+		cfg.BaseImageURIs[hsName], err = buildBaseImageIfContext(docker, uri)
+		if err != nil {
+			return fmt.Errorf("COMPLEMENT_BASE_IMAGE_%s: %w", hsName, err)
+		}
+	}
+	return nil
+}
+
+// buildBaseImageIfContext builds the image if `uri` is a build context, returning the built image.
+// Otherwise returns `uri`, as it is an image. Images are tagged with the hash of their build context,
+// so are only built if the context has changed since they were last built.
+func buildBaseImageIfContext(docker *client.Client, uri string) (string, error) {
+	contextDir, dockerfile, ok := buildContext(uri)
+	if !ok {
+		return uri, nil
+	}
+	ctx := context.Background()
+	tarball, err := os.CreateTemp("", "complement-build-context-*.tar")
+	if err != nil {
+		return "", fmt.Errorf("failed to create build context: %w", err)
+	}
+	defer os.Remove(tarball.Name())
+	defer tarball.Close()
+	hash := sha256.New()
+	io.WriteString(hash, dockerfile+"\n")
+	if err = writeBuildContext(io.MultiWriter(tarball, hash), contextDir, dockerfile); err != nil {
+		return "", fmt.Errorf("failed to create build context of %s: %w", contextDir, err)
+	}
+	tag := "localhost/complement-base:" + hex.EncodeToString(hash.Sum(nil))[:32]
+	if _, err = docker.ImageInspect(ctx, tag); err == nil {
+		log.Printf("Using base image %s built from %s", tag, uri)
+		return tag, nil
+	} else if !errdefs.IsNotFound(err) {
+		return "", fmt.Errorf("failed to inspect %s: %w", tag, err)
+	}
+
+	log.Printf("Building base image %s from %s", tag, uri)
+	if _, err = tarball.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to read build context: %w", err)
+	}
+	res, err := docker.ImageBuild(ctx, tarball, types.ImageBuildOptions{
+		Tags:        []string{tag},
+		Dockerfile:  dockerfile,
+		Remove:      true,
+		ForceRemove: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to build %s: %w", uri, err)
+	}
+	if err = waitForProgressStream(res.Body); err != nil {
+		return "", fmt.Errorf("failed to build %s: %w", uri, err)
+	}
+	return tag, nil
+}
+
+// buildContext returns the build context directory and the path of the Dockerfile within it if `uri` is
+// a path to a Dockerfile, a directory containing a `Dockerfile`, or `$dir:$dockerfile` where the Dockerfile
+// is relative to the directory. Otherwise returns false, as `uri` is an image.
+func buildContext(uri string) (contextDir, dockerfile string, ok bool) {
+	if info, err := os.Stat(uri); err == nil {
+		if info.IsDir() {
+			return uri, "Dockerfile", fileExists(filepath.Join(uri, "Dockerfile"))
+		}
+		return filepath.Dir(uri), filepath.Base(uri), true
+	}
+	dir, file, found := strings.Cut(uri, ":")
+	if !found || !filepath.IsLocal(file) {
+		return "", "", false
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() || !fileExists(filepath.Join(dir, file)) {
+		return "", "", false
+	}
+	return dir, filepath.ToSlash(file), true
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// writeBuildContext writes the directory as a tar archive, excluding paths other than the Dockerfile which
+// match a pattern in its .dockerignore. Only simple patterns are supported (see filepath.Match), without
+// exceptions. Modification times are omitted, so the archive only changes when the contents do.
+func writeBuildContext(w io.Writer, dir, dockerfile string) error {
+	ignored, err := readDockerignore(filepath.Join(dir, ".dockerignore"))
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if ignored(rel) && rel != dockerfile {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		hdr.ModTime, hdr.AccessTime, hdr.ChangeTime = time.Unix(0, 0), time.Time{}, time.Time{}
+		hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// readDockerignore returns a function which returns true if the slash-separated path relative to the
+// build context is ignored.
+func readDockerignore(path string) (func(rel string) bool, error) {
+	var patterns []string
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return func(string) bool { return false }, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		patterns = append(patterns, strings.Trim(filepath.ToSlash(filepath.Clean(line)), "/"))
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return func(rel string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, rel); matched {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
@@ -26,6 +27,7 @@ import (
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
+	"gopkg.in/yaml.v3"
 
 	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/config"
@@ -34,11 +36,22 @@ import (
 
 const complementLabel = "complement_context"
 
+// baseImageLabel records the base image a homeserver container was created from. As blueprint images are
+// committed from such containers, they inherit it.
+const baseImageLabel = "complement_base_image"
+
+// prebuiltLabel marks images built ahead of the test run by PrebuildBlueprints.
+const prebuiltLabel = "complement_prebuilt"
+
 type Builder struct {
 	Config *config.Complement
 	Docker *client.Client
+	// If true, images are labelled as prebuilt so they survive CleanupStale.
+	Prebuild bool
 }
 
+// NewBuilder creates a builder. If the base images in the config are Dockerfiles or build contexts, they
+// are built and replaced in the config with the built images.
 func NewBuilder(cfg *config.Complement) (*Builder, error) {
 	cli, err := client.NewClientWithOpts(
 		client.FromEnv,
@@ -47,6 +60,9 @@ func NewBuilder(cfg *config.Complement) (*Builder, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = buildBaseImages(cli, cfg); err != nil {
+		return nil, err
+	}
 	return &Builder{
 		Docker: cli,
 		Config: cfg,
@@ -60,12 +76,23 @@ func (d *Builder) log(str string, args ...interface{}) {
 	log.Printf(str, args...)
 }
 
+// Cleanup removes all containers, images and networks in the package namespace.
 func (d *Builder) Cleanup() {
+	d.cleanup(false)
+}
+
+// CleanupStale removes everything left over from previous runs in the package namespace, except
+// images which were prebuilt for this run.
+func (d *Builder) CleanupStale() {
+	d.cleanup(true)
+}
+
+func (d *Builder) cleanup(keepPrebuilt bool) {
 	err := d.removeContainers()
 	if err != nil {
 		d.log("Cleanup: Failed to remove containers: %s", err)
 	}
-	err = d.removeImages()
+	err = d.removeImages(keepPrebuilt)
 	if err != nil {
 		d.log("Cleanup: Failed to remove images: %s", err)
 	}
@@ -96,7 +123,7 @@ func (d *Builder) removeNetworks() error {
 }
 
 // removeImages removes all images with `complementLabel`.
-func (d *Builder) removeImages() error {
+func (d *Builder) removeImages(keepPrebuilt bool) error {
 	images, err := d.Docker.ImageList(context.Background(), image.ListOptions{
 		Filters: label(
 			complementLabel,
@@ -122,8 +149,12 @@ func (d *Builder) removeImages() error {
 			continue
 		}
 		bprintName := img.Labels["complement_blueprint"]
-		keep := false
+		keep := keepPrebuilt && img.Labels[prebuiltLabel] != ""
+		// images in a unique namespace can never be reused, so keeping them would leak them
 		for _, keepBprint := range d.Config.KeepBlueprints {
+			if d.Config.UniqueNamespace {
+				break
+			}
 			if bprintName == keepBprint {
 				keep = true
 				break
@@ -167,20 +198,64 @@ func (d *Builder) removeContainers() error {
 	return nil
 }
 
-func (d *Builder) ConstructBlueprintIfNotExist(bprint b.Blueprint) error {
+// BlueprintExists returns true if images have already been built for this blueprint. Images built
+// with an incompatible label schema are removed, so the blueprint is rebuilt.
+func (d *Builder) BlueprintExists(blueprintName string) (bool, error) {
 	images, err := d.Docker.ImageList(context.Background(), image.ListOptions{
 		Filters: label(
-			"complement_blueprint="+bprint.Name,
+			"complement_blueprint="+blueprintName,
 			"complement_pkg="+d.Config.PackageNamespace,
 		),
 	})
 	if err != nil {
-		return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to ImageList: %w", bprint.Name, err)
+		return false, fmt.Errorf("failed to ImageList: %w", err)
+	}
+	stale := false
+	for _, img := range images {
+		if err := b.Labels(img.Labels).CheckSchema(); err != nil {
+			stale = true
+			d.log("Invalidating image %s of blueprint %s: %s", img.ID, blueprintName, err)
+		}
+	}
+	if !stale {
+		return len(images) > 0, nil
+	}
+	// remove all images of the blueprint, as it has to be rebuilt as a whole
+	for _, img := range images {
+		_, err = d.Docker.ImageRemove(context.Background(), img.ID, image.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to remove image %s built with an incompatible label schema: %w", img.ID, err)
+		}
+	}
+	return false, nil
+}
+
+func (d *Builder) ConstructBlueprintIfNotExist(bprint b.Blueprint) error {
+	exists, err := d.BlueprintExists(bprint.Name)
+	if err != nil {
+		return fmt.Errorf("ConstructBlueprintIfNotExist(%s): %w", bprint.Name, err)
+	}
+	if exists {
+		return nil
 	}
-	if len(images) == 0 {
-		err = d.ConstructBlueprint(bprint)
+	if d.Config.BlueprintRegistry != "" {
+		pulled, err := d.pullBlueprint(bprint)
 		if err != nil {
-			return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to ConstructBlueprint: %w", bprint.Name, err)
+			return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to pull blueprint: %w", bprint.Name, err)
+		}
+		if pulled {
+			return nil
+		}
+	}
+	err = d.ConstructBlueprint(bprint)
+	if err != nil {
+		return fmt.Errorf("ConstructBlueprintIfNotExist(%s): failed to ConstructBlueprint: %w", bprint.Name, err)
+	}
+	if d.Config.BlueprintRegistry != "" && d.Config.BlueprintRegistryPush {
+		if err = d.pushBlueprint(bprint); err != nil {
+			log.Printf("ConstructBlueprintIfNotExist(%s): failed to push blueprint: %s", bprint.Name, err)
 		}
 	}
 	return nil
@@ -233,7 +308,8 @@ func (d *Builder) ConstructBlueprint(bprint b.Blueprint) error {
 	return nil
 }
 
-// construct all Homeservers sequentially then commits them
+// construct all Homeservers concurrently then commits them. Homeservers which join rooms created by
+// other homeservers only create their rooms once those homeservers have created theirs.
 func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 	d.log("Constructing blueprint '%s'", bprint.Name)
 
@@ -244,21 +320,44 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 
 	runner := instruction.NewRunner(bprint.Name, d.Config.BestEffort, d.Config.DebugLoggingEnabled)
 	results := make([]result, len(bprint.Homeservers))
+	deps := roomRefDependencies(bprint.Homeservers)
+	// closed when the homeserver has created its rooms, or failed to
+	roomsDone := make([]chan struct{}, len(bprint.Homeservers))
+	for i := range roomsDone {
+		roomsDone[i] = make(chan struct{})
+	}
+	var wg sync.WaitGroup
+	wg.Add(len(bprint.Homeservers))
 	for i, hs := range bprint.Homeservers {
-		res := d.constructHomeserver(bprint.Name, runner, hs, networkName)
+		go func(i int, hs b.Homeserver) {
+			defer wg.Done()
+			defer close(roomsDone[i])
+			results[i] = d.constructHomeserver(bprint.Name, runner, hs, networkName, func() {
+				for _, dep := range deps[i] {
+					<-roomsDone[dep]
+				}
+			})
+		}(i, hs)
+	}
+	wg.Wait()
+	for _, res := range results {
+		if res.err == nil {
+			continue
+		}
+		errs = append(errs, res.err)
+		if res.containerID != "" {
+			// something went wrong, but we have a container which may have interesting logs
+			printLogs(d.Docker, res.containerID, res.contextStr)
+		}
+		if delErr := d.Docker.ContainerRemove(context.Background(), res.containerID, container.RemoveOptions{
+			Force: true,
+		}); delErr != nil {
+			d.log("%s: failed to remove container which failed to deploy: %s", res.contextStr, delErr)
+		}
+	}
+	for _, res := range results {
 		if res.err != nil {
-			errs = append(errs, res.err)
-			if res.containerID != "" {
-				// something went wrong, but we have a container which may have interesting logs
-				printLogs(d.Docker, res.containerID, res.contextStr)
-			}
-			if delErr := d.Docker.ContainerRemove(context.Background(), res.containerID, container.RemoveOptions{
-				Force: true,
-			}); delErr != nil {
-				d.log("%s: failed to remove container which failed to deploy: %s", res.contextStr, delErr)
-			}
-			// there is little point continuing to set up the remaining homeservers at this point
-			return
+			continue
 		}
 		// kill the container
 		defer func(r result) {
@@ -280,7 +379,10 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 			}
 
 		}(res)
-		results[i] = res
+	}
+	if len(errs) > 0 {
+		// there is little point committing the remaining homeservers at this point
+		return
 	}
 
 	// commit containers
@@ -296,23 +398,46 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 			for _, userID := range bprint.KeepAccessTokensForUsers {
 				tok, ok := accessTokens[userID]
 				if ok {
-					labels["access_token_"+userID] = tok
+					labels[b.LabelPrefixAccessToken+userID] = tok
 				}
 			}
 		} else {
 			// keep all tokens
 			for k, v := range accessTokens {
-				labels["access_token_"+k] = v
+				labels[b.LabelPrefixAccessToken+k] = v
 			}
 		}
 
 		deviceIDs := runner.DeviceIDs(res.homeserver.Name)
 		for userID, deviceID := range deviceIDs {
-			labels["device_id"+userID] = deviceID
+			labels[b.LabelPrefixDeviceID+userID] = deviceID
+		}
+
+		for ref, mxcURI := range runner.MediaURIs(res.homeserver.Name) {
+			labels[b.LabelPrefixMedia+ref] = mxcURI
+		}
+
+		for k, v := range res.homeserver.Metadata {
+			labels[b.LabelPrefixMetadata+k] = v
+		}
+
+		if d.Prebuild {
+			labels[prebuiltLabel] = "true"
+		}
+		labels[b.LabelSchema] = b.LabelSchemaVersion
+		if res.baseImage != "" {
+			labels[baseImageLabel] = res.baseImage
+		}
+		if names := pluginNames(res.homeserver.Plugins); names != "" {
+			labels[pluginsLabel] = names
 		}
 
 		// Combine the labels for tokens and application services
-		asLabels := labelsForApplicationServices(res.homeserver)
+		asLabels, err := labelsForApplicationServices(res.homeserver)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s : %w", res.contextStr, err))
+			continue
+		}
 		for k, v := range asLabels {
 			labels[k] = v
 		}
@@ -358,14 +483,19 @@ func (d *Builder) construct(bprint b.Blueprint) (errs []error) {
 func toChanges(labels map[string]string) []string {
 	var changes []string
 	for k, v := range labels {
-		changes = append(changes, fmt.Sprintf("LABEL \"%s\"=\"%s\"", k, v))
+		changes = append(changes, fmt.Sprintf("LABEL \"%s\"=\"%s\"", k, dockerfileQuoteEscaper.Replace(v)))
 	}
 	return changes
 }
 
-// construct this homeserver and execute its instructions, keeping the container alive.
-func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.Runner, hs b.Homeserver, networkName string) result {
-	contextStr := fmt.Sprintf("%s.%s.%s", d.Config.PackageNamespace, blueprintName, hs.Name)
+// dockerfileQuoteEscaper escapes the characters which are special in double-quoted Dockerfile strings, so
+// label values are stored verbatim rather than being unescaped or having variables substituted.
+var dockerfileQuoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+
+// construct this homeserver and execute its instructions, keeping the container alive. `waitForDeps` is
+// called after the users are created and blocks until the rooms this homeserver joins have been created.
+func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.Runner, hs b.Homeserver, networkName string, waitForDeps func()) result {
+	contextStr := d.contextStr(blueprintName, hs.Name)
 	d.log("%s : constructing homeserver...\n", contextStr)
 	dep, err := d.deployBaseImage(blueprintName, hs, contextStr, networkName)
 	if err != nil {
@@ -382,7 +512,11 @@ func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.
 		}
 	}
 	d.log("%s : deployed base image to %s (%s)\n", contextStr, dep.BaseURL, dep.ContainerID)
-	err = runner.Run(hs, dep.BaseURL)
+	err = runner.RunUsers(hs, dep.BaseURL)
+	if err == nil {
+		waitForDeps()
+		err = runner.RunRooms(hs, dep.BaseURL)
+	}
 	if err != nil {
 		d.log("%s : failed to run instructions: %s\n", contextStr, err)
 	}
@@ -391,47 +525,134 @@ func (d *Builder) constructHomeserver(blueprintName string, runner *instruction.
 		containerID: dep.ContainerID,
 		contextStr:  contextStr,
 		homeserver:  hs,
+		baseImage:   dep.Labels[baseImageLabel],
 	}
 }
 
 // deployBaseImage runs the base image and returns the baseURL, containerID or an error.
 func (d *Builder) deployBaseImage(blueprintName string, hs b.Homeserver, contextStr, networkName string) (*HomeserverDeployment, error) {
-	asIDToRegistrationMap := asIDToRegistrationFromLabels(labelsForApplicationServices(hs))
-	var baseImageURI string
-	if hs.BaseImageURI == nil {
-		baseImageURI = d.Config.BaseImageURI
-		// Use HS specific base image if defined
-		if uri, ok := d.Config.BaseImageURIs[hs.Name]; ok {
-			baseImageURI = uri
-		}
-	} else {
-		baseImageURI = *hs.BaseImageURI
+	asLabels, err := labelsForApplicationServices(hs)
+	if err != nil {
+		return nil, err
 	}
-
+	asIDToRegistrationMap := b.Labels(asLabels).ApplicationServices()
 	return deployImage(
-		d.Docker, baseImageURI, fmt.Sprintf("complement_%s", contextStr),
+		d.Docker, d.baseImageURI(hs), fmt.Sprintf("complement_%s", contextStr),
 		d.Config.PackageNamespace, blueprintName, hs.Name, asIDToRegistrationMap, contextStr,
-		networkName, d.Config,
+		networkName, d.Config, pluginEnv(pluginNames(hs.Plugins)), pluginFiles(hs.Plugins), nil,
 	)
 }
 
-// Multilines label using Dockerfile syntax is unsupported, let's inline \n instead
-func generateASRegistrationYaml(as b.ApplicationService) string {
-	return fmt.Sprintf("id: %s\\n", as.ID) +
-		fmt.Sprintf("hs_token: %s\\n", as.HSToken) +
-		fmt.Sprintf("as_token: %s\\n", as.ASToken) +
-		fmt.Sprintf("url: '%s'\\n", as.URL) +
-		fmt.Sprintf("sender_localpart: %s\\n", as.SenderLocalpart) +
-		fmt.Sprintf("rate_limited: %v\\n", as.RateLimited) +
-		fmt.Sprintf("de.sorunome.msc2409.push_ephemeral: %v\\n", as.SendEphemeral) +
-		fmt.Sprintf("push_ephemeral: %v\\n", as.SendEphemeral) +
-		fmt.Sprintf("org.matrix.msc3202: %v\\n", as.EnableEncryption) +
-		"namespaces:\\n" +
-		"  users:\\n" +
-		"    - exclusive: false\\n" +
-		"      regex: .*\\n" +
-		"  rooms: []\\n" +
-		"  aliases: []\\n"
+// roomRefDependencies returns the indexes of the homeservers each homeserver depends on, because it joins
+// rooms by Ref which they create. Only earlier homeservers are depended on, as rooms were historically
+// created in order, so there are no cycles.
+func roomRefDependencies(homeservers []b.Homeserver) [][]int {
+	creators := make(map[string]int)
+	deps := make([][]int, len(homeservers))
+	for i, hs := range homeservers {
+		seen := make(map[int]bool)
+		for _, room := range hs.Rooms {
+			if room.Ref == "" || room.Creator != "" {
+				continue
+			}
+			if creator, ok := creators[room.Ref]; ok && !seen[creator] {
+				seen[creator] = true
+				deps[i] = append(deps[i], creator)
+			}
+		}
+		for _, room := range hs.Rooms {
+			if room.Ref != "" && room.Creator != "" {
+				if _, ok := creators[room.Ref]; !ok {
+					creators[room.Ref] = i
+				}
+			}
+		}
+	}
+	return deps
+}
+
+// baseImageURI returns the image the homeserver is built from.
+func (d *Builder) baseImageURI(hs b.Homeserver) string {
+	if hs.BaseImageURI != nil {
+		return *hs.BaseImageURI
+	}
+	// Use HS specific base image if defined
+	if uri, ok := d.Config.BaseImageURIs[hs.Name]; ok {
+		return uri
+	}
+	return d.Config.BaseImageURI
+}
+
+// contextStr returns the context of the homeserver in the blueprint, which names its image.
+func (d *Builder) contextStr(blueprintName, hsName string) string {
+	return fmt.Sprintf("%s.%s.%s", d.Config.PackageNamespace, blueprintName, hsName)
+}
+
+// asRegistration is the registration file of an application service.
+type asRegistration struct {
+	ID                   string   `yaml:"id"`
+	HSToken              string   `yaml:"hs_token"`
+	ASToken              string   `yaml:"as_token"`
+	URL                  string   `yaml:"url"`
+	SenderLocalpart      string   `yaml:"sender_localpart"`
+	RateLimited          bool     `yaml:"rate_limited"`
+	MSC2409PushEphemeral bool     `yaml:"de.sorunome.msc2409.push_ephemeral"`
+	PushEphemeral        bool     `yaml:"push_ephemeral"`
+	ReceiveEphemeral     bool     `yaml:"receive_ephemeral,omitempty"`
+	MSC3202              bool     `yaml:"org.matrix.msc3202"`
+	Protocols            []string `yaml:"protocols"`
+	Namespaces           struct {
+		Users   []asNamespace `yaml:"users"`
+		Rooms   []asNamespace `yaml:"rooms"`
+		Aliases []asNamespace `yaml:"aliases"`
+	} `yaml:"namespaces"`
+}
+
+type asNamespace struct {
+	Exclusive bool   `yaml:"exclusive"`
+	Regex     string `yaml:"regex"`
+}
+
+// labelEscaper escapes newlines so multiline values can be stored in labels, which must be a single line.
+// Backslashes are escaped too, so b.Labels can tell escaped newlines apart from a literal `\n`.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// generateASRegistrationYaml returns the registration of the application service, escaped by labelEscaper.
+func generateASRegistrationYaml(as b.ApplicationService) (string, error) {
+	reg := asRegistration{
+		ID:                   as.ID,
+		HSToken:              as.HSToken,
+		ASToken:              as.ASToken,
+		URL:                  as.URL,
+		SenderLocalpart:      as.SenderLocalpart,
+		RateLimited:          as.RateLimited,
+		MSC2409PushEphemeral: as.SendEphemeral,
+		PushEphemeral:        as.SendEphemeral,
+		ReceiveEphemeral:     as.SendEphemeral,
+		MSC3202:              as.EnableEncryption,
+		Protocols:            append([]string{}, as.Protocols...),
+	}
+	reg.Namespaces.Users = toASNamespaces(as.UserNamespaces)
+	reg.Namespaces.Rooms = toASNamespaces(as.RoomNamespaces)
+	reg.Namespaces.Aliases = toASNamespaces(as.AliasNamespaces)
+	if len(as.UserNamespaces) == 0 && len(as.AliasNamespaces) == 0 && len(as.RoomNamespaces) == 0 {
+		reg.Namespaces.Users = []asNamespace{{Regex: ".*"}}
+	}
+	data, err := yaml.Marshal(reg)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal registration of application service %s: %w", as.ID, err)
+	}
+	return labelEscaper.Replace(string(data)), nil
+}
+
+// toASNamespaces returns the namespaces of a registration, which is an empty list rather than null if
+// there are none.
+func toASNamespaces(namespaces []b.ApplicationServiceNamespace) []asNamespace {
+	result := make([]asNamespace, 0, len(namespaces))
+	for _, ns := range namespaces {
+		result = append(result, asNamespace{Exclusive: ns.Exclusive, Regex: ns.Regex})
+	}
+	return result
 }
 
 // createNetworkIfNotExists creates a docker network and returns its name.
@@ -596,4 +817,5 @@ type result struct {
 	containerID string
 	contextStr  string
 	homeserver  b.Homeserver
+	baseImage   string
 }
@@ -0,0 +1,76 @@
+package docker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/matrix-org/complement/b"
+)
+
+// parseASRegistration reads back the registration as homeservers see it, once it has been stored in a label.
+func parseASRegistration(t *testing.T, as b.ApplicationService) (string, map[string]interface{}) {
+	t.Helper()
+	labels, err := labelsForApplicationServices(b.Homeserver{Name: "hs1", ApplicationServices: []b.ApplicationService{as}})
+	if err != nil {
+		t.Fatalf("labelsForApplicationServices: %s", err)
+	}
+	if label := labels[b.LabelPrefixApplicationService+as.ID]; strings.Contains(label, "\n") {
+		t.Fatalf("label contains a newline: %q", label)
+	}
+	registration := b.Labels(labels).ApplicationServices()[as.ID]
+	var parsed map[string]interface{}
+	if err := yaml.Unmarshal([]byte(registration), &parsed); err != nil {
+		t.Fatalf("registration is not valid YAML: %s\n%s", err, registration)
+	}
+	return registration, parsed
+}
+
+func TestGenerateASRegistrationYaml(t *testing.T) {
+	registration, parsed := parseASRegistration(t, b.ApplicationService{
+		ID:              "my_as",
+		URL:             "http://localhost:9000",
+		SenderLocalpart: "the-bot",
+		Protocols:       []string{"irc", "weird: [protocol], #1"},
+		UserNamespaces: []b.ApplicationServiceNamespace{
+			{Exclusive: true, Regex: `@_irc_.*:hs1`},
+			{Regex: `@it's\n"quoted"$`},
+		},
+	})
+	if !reflect.DeepEqual(parsed["protocols"], []interface{}{"irc", "weird: [protocol], #1"}) {
+		t.Errorf("protocols: got %v", parsed["protocols"])
+	}
+	namespaces := parsed["namespaces"].(map[string]interface{})
+	wantUsers := []interface{}{
+		map[string]interface{}{"exclusive": true, "regex": `@_irc_.*:hs1`},
+		map[string]interface{}{"exclusive": false, "regex": `@it's\n"quoted"$`},
+	}
+	if !reflect.DeepEqual(namespaces["users"], wantUsers) {
+		t.Errorf("user namespaces: got %v want %v", namespaces["users"], wantUsers)
+	}
+	for _, kind := range []string{"rooms", "aliases"} {
+		if !reflect.DeepEqual(namespaces[kind], []interface{}{}) {
+			t.Errorf("%s namespaces: got %v want []", kind, namespaces[kind])
+		}
+	}
+	if _, ok := parsed["receive_ephemeral"]; ok {
+		t.Errorf("receive_ephemeral was set without SendEphemeral:\n%s", registration)
+	}
+}
+
+func TestGenerateASRegistrationYamlDefaults(t *testing.T) {
+	_, parsed := parseASRegistration(t, b.ApplicationService{ID: "my_as", SendEphemeral: true})
+	if !reflect.DeepEqual(parsed["protocols"], []interface{}{}) {
+		t.Errorf("protocols: got %v want []", parsed["protocols"])
+	}
+	if parsed["receive_ephemeral"] != true || parsed["push_ephemeral"] != true {
+		t.Errorf("ephemeral: got receive_ephemeral=%v push_ephemeral=%v want true", parsed["receive_ephemeral"], parsed["push_ephemeral"])
+	}
+	// without namespaces, the application service is interested in all users
+	wantUsers := []interface{}{map[string]interface{}{"exclusive": false, "regex": ".*"}}
+	if users := parsed["namespaces"].(map[string]interface{})["users"]; !reflect.DeepEqual(users, wantUsers) {
+		t.Errorf("user namespaces: got %v want %v", users, wantUsers)
+	}
+}
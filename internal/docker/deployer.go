@@ -18,12 +18,16 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -38,14 +42,22 @@ import (
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/stdcopy"
 
+	"github.com/matrix-org/complement/artifacts"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/captcha"
 	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/email"
 )
 
 const (
 	MountCACertPath     = "/complement/ca/ca.crt"
 	MountCAKeyPath      = "/complement/ca/ca.key"
+	MountTLSCertPath    = "/complement/tls/server.crt" // minted for the homeserver by the CA
+	MountTLSKeyPath     = "/complement/tls/server.key"
 	MountAppServicePath = "/complement/appservice/" // All registration files sit here
+	MountPluginPath     = "/complement/plugins/"    // Each plugin has a directory and a config file here
 )
 
 type Deployer struct {
@@ -54,6 +66,23 @@ type Deployer struct {
 	Counter         int
 	debugLogging    bool
 	config          *config.Complement
+	artifacts       *artifacts.Manager
+	// Which mock servers to start for homeservers deployed by this deployer.
+	MockServers MockServers
+	// mock servers used by homeservers deployed by this deployer, created on first deploy
+	emailServer   *email.Server
+	captchaServer *captcha.Server
+	turn          *TURNDeployment
+}
+
+// MockServers are the servers which are started alongside homeservers, for tests which need them.
+type MockServers struct {
+	// Start an SMTP server which captures emails.
+	Email bool
+	// Start a reCAPTCHA verification server.
+	Captcha bool
+	// Start a TURN server, if COMPLEMENT_TURN_IMAGE is set.
+	TURN bool
 }
 
 func NewDeployer(deployNamespace string, cfg *config.Complement) (*Deployer, error) {
@@ -69,9 +98,80 @@ func NewDeployer(deployNamespace string, cfg *config.Complement) (*Deployer, err
 		Docker:          cli,
 		debugLogging:    cfg.DebugLoggingEnabled,
 		config:          cfg,
+		artifacts:       artifacts.New(cfg.ArtifactsDir),
 	}, nil
 }
 
+// mockServerEnv starts the mock servers requested via MockServers, and the TURN server if enabled, if
+// they are not already running. Returns the environment variables homeservers need to use them.
+func (d *Deployer) mockServerEnv(networkName string) ([]string, error) {
+	var env []string
+	if d.MockServers.Email {
+		if d.emailServer == nil {
+			srv, err := email.NewServer(d.config.HostnameRunningComplement)
+			if err != nil {
+				return nil, err
+			}
+			d.emailServer = srv
+		}
+		env = append(env, d.emailServer.Env()...)
+	}
+	if d.MockServers.Captcha {
+		if d.captchaServer == nil {
+			srv, err := captcha.NewServer(d.config.HostnameRunningComplement)
+			if err != nil {
+				return nil, err
+			}
+			d.captchaServer = srv
+		}
+		env = append(env, d.captchaServer.Env()...)
+	}
+	if d.MockServers.TURN && d.config.TURNImage != "" {
+		if d.turn == nil {
+			containerName := fmt.Sprintf("complement_%s_%s_turn", d.config.PackageNamespace, d.DeployNamespace)
+			td, err := deployTURN(d.Docker, d.config, containerName, networkName)
+			if td != nil {
+				// keep track of the container even on failure so it is removed
+				d.turn = td
+			}
+			if err != nil {
+				return nil, err
+			}
+		} else if err := d.turn.connect(d.Docker, networkName); err != nil {
+			// e.g restoring a homerunner snapshot, which deploys to the network of the snapshot blueprint
+			return nil, err
+		}
+		env = append(env, d.turn.Env()...)
+	}
+	return env, nil
+}
+
+// StopMockServers stops the email, captcha and TURN servers used by deployments from this deployer, if
+// they are running. This should be called once all deployments have been destroyed.
+func (d *Deployer) StopMockServers() {
+	if d.turn != nil {
+		err := d.Docker.ContainerRemove(context.Background(), d.turn.ContainerID, container.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			log.Printf("StopMockServers: failed to remove TURN container %s: %s", d.turn.ContainerID, err)
+		}
+		d.turn = nil
+	}
+	if d.emailServer != nil {
+		if err := d.emailServer.Close(); err != nil {
+			log.Printf("StopMockServers: failed to close email server: %s", err)
+		}
+		d.emailServer = nil
+	}
+	if d.captchaServer != nil {
+		if err := d.captchaServer.Close(); err != nil {
+			log.Printf("StopMockServers: failed to close captcha server: %s", err)
+		}
+		d.captchaServer = nil
+	}
+}
+
 func (d *Deployer) log(str string, args ...interface{}) {
 	if !d.debugLogging {
 		return
@@ -93,11 +193,16 @@ func (d *Deployer) CreateDirtyServer(hsName string) (*HomeserverDeployment, erro
 		baseImageURI = uri
 	}
 
+	mockEnv, err := d.mockServerEnv(networkName)
+	if err != nil {
+		return nil, fmt.Errorf("CreateDirtyServer: %w", err)
+	}
+
 	containerName := fmt.Sprintf("complement_%s_dirty_%s", d.config.PackageNamespace, hsName)
 	hsDeployment, err := deployImage(
 		d.Docker, baseImageURI, containerName,
 		d.config.PackageNamespace, "", hsName, nil, "dirty",
-		networkName, d.config,
+		networkName, d.config, mockEnv, nil, nil,
 	)
 	if err != nil {
 		if hsDeployment != nil && hsDeployment.ContainerID != "" {
@@ -129,11 +234,29 @@ func (d *Deployer) CreateDirtyDeployment() (*Deployment, error) {
 		HS: map[string]*HomeserverDeployment{
 			hsName: hsDeployment,
 		},
-		Config: d.config,
+		Config:  d.config,
+		Email:   d.emailServer,
+		Captcha: d.captchaServer,
 	}, nil
 }
 
 func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deployment, error) {
+	return d.DeployWithOpts(ctx, blueprintName, nil)
+}
+
+// HomeserverOpts are the parts of a blueprint homeserver which are applied at deploy time rather than
+// built into its image.
+type HomeserverOpts struct {
+	// The sidecars are started before the homeserver, and are removed when the deployment is destroyed.
+	Sidecars []b.Sidecar
+	// Extra environment variables for the homeserver container.
+	Env []string
+	// Extra host paths to bind-mount into the homeserver container, after those in COMPLEMENT_HOST_MOUNTS.
+	Mounts []b.Mount
+}
+
+// DeployWithOpts is Deploy, additionally applying the options of each homeserver, keyed on homeserver name.
+func (d *Deployer) DeployWithOpts(ctx context.Context, blueprintName string, opts map[string]HomeserverOpts) (*Deployment, error) {
 	dep := &Deployment{
 		Deployer:      d,
 		BlueprintName: blueprintName,
@@ -152,10 +275,21 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 	if len(images) == 0 {
 		return nil, fmt.Errorf("Deploy: No images have been built for blueprint %s", blueprintName)
 	}
+	for _, img := range images {
+		if err := b.Labels(img.Labels).CheckSchema(); err != nil {
+			return nil, fmt.Errorf("Deploy: cannot use image %s of blueprint %s: %w", img.ID, blueprintName, err)
+		}
+	}
 	networkName, err := createNetworkIfNotExists(d.Docker, d.config.PackageNamespace, blueprintName)
 	if err != nil {
 		return nil, fmt.Errorf("Deploy: %w", err)
 	}
+	mockEnv, err := d.mockServerEnv(networkName)
+	if err != nil {
+		return nil, fmt.Errorf("Deploy: %w", err)
+	}
+	dep.Email = d.emailServer
+	dep.Captcha = d.captchaServer
 
 	// deploy images in parallel
 	var mu sync.Mutex // protects mutable values like the counter and errors
@@ -169,13 +303,23 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 		mu.Unlock()
 		contextStr := img.Labels["complement_context"]
 		hsName := img.Labels["complement_hs_name"]
-		asIDToRegistrationMap := asIDToRegistrationFromLabels(img.Labels)
+		asIDToRegistrationMap := b.Labels(img.Labels).ApplicationServices()
+		// plugins were installed when the blueprint was built, but the homeserver still needs telling about them
+		env := append(pluginEnv(img.Labels[pluginsLabel]), mockEnv...)
+		env = append(env, sidecarEnv(hsName, opts[hsName].Sidecars)...)
+		env = append(env, opts[hsName].Env...)
+		sidecarDeps, err := d.deploySidecars(ctx, networkName, hsName, opts[hsName].Sidecars)
+		if err != nil {
+			d.destroySidecars(hsName, sidecarDeps, "")
+			return fmt.Errorf("Deploy: %w", err)
+		}
 
 		// TODO: Make CSAPI port configurable
 		containerName := fmt.Sprintf("complement_%s_%s_%s_%d", d.config.PackageNamespace, d.DeployNamespace, contextStr, counter)
 		deployment, err := deployImage(
 			d.Docker, img.ID, containerName,
 			d.config.PackageNamespace, blueprintName, hsName, asIDToRegistrationMap, contextStr, networkName, d.config,
+			env, nil, opts[hsName].Mounts,
 		)
 		if err != nil {
 			if deployment != nil && deployment.ContainerID != "" {
@@ -187,8 +331,10 @@ func (d *Deployer) Deploy(ctx context.Context, blueprintName string) (*Deploymen
 			// This gives better context for when `bind: address already in use` errors happen.
 			printPortBindingsOfAllComplementContainers(d.Docker, "While deploying "+containerName)
 
+			d.destroySidecars(hsName, sidecarDeps, "")
 			return fmt.Errorf("Deploy: Failed to deploy image %+v : %w", img, err)
 		}
+		deployment.Sidecars = sidecarDeps
 		mu.Lock()
 		d.log("%s -> %s (%s)\n", contextStr, deployment.BaseURL, deployment.ContainerID)
 		dep.HS[hsName] = deployment
@@ -219,7 +365,8 @@ func (d *Deployer) PrintLogs(dep *Deployment) {
 
 // Destroy a deployment. This will kill all running containers.
 func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool, testName string, failed bool) {
-	for _, hsDep := range dep.HS {
+	d.writeEnvironmentArtifact(dep, testName)
+	for hsName, hsDep := range dep.HS {
 		if printServerLogs {
 			// If we want the logs we gracefully stop the containers to allow
 			// the logs to be flushed.
@@ -239,6 +386,11 @@ func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool, testName strin
 			}
 		}
 
+		d.writeLogArtifact(hsDep.ContainerID, testName, hsName)
+		if failed {
+			d.writeFailureArtifacts(hsDep.ContainerID, testName, hsName)
+		}
+
 		result, err := d.executePostScript(hsDep, testName, failed)
 		if err != nil {
 			log.Printf("Failed to execute post test script: %s - %s", err, string(result))
@@ -253,6 +405,28 @@ func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool, testName strin
 		if err != nil {
 			log.Printf("Destroy: Failed to remove container %s : %s\n", hsDep.ContainerID, err)
 		}
+		d.destroySidecars(hsName, hsDep.Sidecars, testName)
+	}
+	dep.auxiliaryMu.Lock()
+	d.removeContainers(dep.Auxiliary, testName, "aux-")
+	dep.Auxiliary = nil
+	dep.auxiliaryMu.Unlock()
+}
+
+// writeLogArtifact writes the logs of the container to the artifacts directory of the test as `name`.log,
+// if enabled.
+func (d *Deployer) writeLogArtifact(containerID, testName, name string) {
+	f, err := d.artifacts.Create(testName, name+".log")
+	if err != nil {
+		log.Printf("Destroy: Failed to create log artifact for %s: %s\n", containerID, err)
+		return
+	}
+	if f == nil {
+		return
+	}
+	defer f.Close()
+	if err = d.containerLogs(context.Background(), containerID, false, f); err != nil {
+		log.Printf("Destroy: Failed to write log artifact for %s: %s\n", containerID, err)
 	}
 }
 
@@ -295,6 +469,42 @@ func (d *Deployer) StopServer(hsDep *HomeserverDeployment) error {
 	return nil
 }
 
+// DisconnectServer disconnects the homeserver container from its docker network, so it cannot reach or
+// be reached by other homeservers. The container keeps running and remains reachable from the host.
+func (d *Deployer) DisconnectServer(hsDep *HomeserverDeployment) error {
+	err := d.Docker.NetworkDisconnect(context.Background(), hsDep.Network, hsDep.ContainerID, false)
+	if err != nil {
+		return fmt.Errorf("failed to disconnect container %s from network %s: %s", hsDep.ContainerID, hsDep.Network, err)
+	}
+	return nil
+}
+
+// ConnectServer reconnects a homeserver container previously disconnected via DisconnectServer, using
+// `hsName` as its hostname on the network.
+func (d *Deployer) ConnectServer(hsDep *HomeserverDeployment, hsName string) error {
+	err := d.Docker.NetworkConnect(context.Background(), hsDep.Network, hsDep.ContainerID, &network.EndpointSettings{
+		Aliases: []string{hsName},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect container %s to network %s: %s", hsDep.ContainerID, hsDep.Network, err)
+	}
+	return nil
+}
+
+// HostAddress returns the host-accessible address (host:port) of `port` in the homeserver container. The
+// port must be exposed by the homeserver image, as all exposed ports are published.
+func (d *Deployer) HostAddress(hsDep *HomeserverDeployment, port int) (string, error) {
+	inspectResponse, err := inspectContainer(context.Background(), d.Docker, hsDep.ContainerID)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect ports: %w", err)
+	}
+	pb, err := findPortBinding(inspectResponse.NetworkSettings.Ports, d.config.HSPortBindingIP, port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(pb.HostIP, pb.HostPort), nil
+}
+
 // Restart a homeserver deployment.
 func (d *Deployer) Restart(hsDep *HomeserverDeployment) error {
 	if err := d.StopServer(hsDep); err != nil {
@@ -324,8 +534,7 @@ func (d *Deployer) StartServer(hsDep *HomeserverDeployment) error {
 	}
 	hsDep.SetEndpoints(baseURL, fedBaseURL)
 
-	stopTime := time.Now().Add(d.config.SpawnHSTimeout)
-	_, err = waitForContainer(ctx, d.Docker, hsDep, stopTime)
+	_, err = waitForContainer(ctx, d.Docker, hsDep, d.config)
 	if err != nil {
 		return fmt.Errorf("failed to wait for container %s: %s", hsDep.ContainerID, err)
 	}
@@ -333,10 +542,127 @@ func (d *Deployer) StartServer(hsDep *HomeserverDeployment) error {
 	return nil
 }
 
+// Snapshot commits the current state of every homeserver in the deployment to images, which can be
+// deployed later via Deploy(ctx, snapshotName). Each container is stopped whilst it is committed so
+// databases are flushed to disk, then started again. This may change the host ports of the homeserver.
+func (d *Deployer) Snapshot(dep *Deployment, snapshotName string) error {
+	for hsName, hsDep := range dep.HS {
+		if err := d.StopServer(hsDep); err != nil {
+			return fmt.Errorf("Snapshot: %s", err)
+		}
+		contextStr := fmt.Sprintf("%s.%s.%s", d.config.PackageNamespace, snapshotName, hsName)
+		// The container labels (access tokens, app services, etc) are copied to the image, so we only
+		// need to change the labels which identify the blueprint.
+		_, commitErr := d.Docker.ContainerCommit(context.Background(), hsDep.ContainerID, container.CommitOptions{
+			Author:    "Complement",
+			Reference: "localhost/complement:" + contextStr,
+			Changes: toChanges(map[string]string{
+				complementLabel:        contextStr,
+				"complement_blueprint": snapshotName,
+				b.LabelSchema:          b.LabelSchemaVersion,
+			}),
+			// Podman's compatibility API returns a 500 if the POST request has an empty body.
+			Config: &container.Config{},
+		})
+		// always try to restart the container, even if the commit failed
+		if err := d.StartServer(hsDep); err != nil {
+			return fmt.Errorf("Snapshot: %s", err)
+		}
+		if commitErr != nil {
+			return fmt.Errorf("Snapshot: failed to commit container %s: %s", hsDep.ContainerID, commitErr)
+		}
+		d.log("%s: Created snapshot image\n", contextStr)
+	}
+	return nil
+}
+
+// RemoveSnapshot removes the images created by Snapshot.
+func (d *Deployer) RemoveSnapshot(snapshotName string) error {
+	images, err := d.Docker.ImageList(context.Background(), image.ListOptions{
+		Filters: label(
+			"complement_pkg="+d.config.PackageNamespace,
+			"complement_blueprint="+snapshotName,
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("RemoveSnapshot: failed to ImageList: %w", err)
+	}
+	for _, img := range images {
+		_, err = d.Docker.ImageRemove(context.Background(), img.ID, image.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			return fmt.Errorf("RemoveSnapshot: failed to remove image %s: %w", img.ID, err)
+		}
+	}
+	return nil
+}
+
+// ExecResult is the result of running a command in a homeserver container.
+type ExecResult struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+// Exec runs a command in the homeserver container and waits for it to exit.
+func (d *Deployer) Exec(ctx context.Context, hsDep *HomeserverDeployment, cmd []string) (*ExecResult, error) {
+	execID, err := d.Docker.ContainerExecCreate(ctx, hsDep.ContainerID, container.ExecOptions{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Exec: failed to create exec in container %s: %w", hsDep.ContainerID, err)
+	}
+	attach, err := d.Docker.ContainerExecAttach(ctx, execID.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Exec: failed to attach to exec in container %s: %w", hsDep.ContainerID, err)
+	}
+	defer attach.Close()
+	var stdout, stderr bytes.Buffer
+	if _, err = stdcopy.StdCopy(&stdout, &stderr, attach.Reader); err != nil {
+		return nil, fmt.Errorf("Exec: failed to read output from container %s: %w", hsDep.ContainerID, err)
+	}
+	inspect, err := d.Docker.ContainerExecInspect(ctx, execID.ID)
+	if err != nil {
+		return nil, fmt.Errorf("Exec: failed to inspect exec in container %s: %w", hsDep.ContainerID, err)
+	}
+	return &ExecResult{
+		ExitCode: inspect.ExitCode,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+	}, nil
+}
+
+// Logs writes the stdout and stderr logs of the homeserver container to `w`. If `follow` is true, new
+// logs continue to be written until the context is cancelled or the container exits.
+func (d *Deployer) Logs(ctx context.Context, hsDep *HomeserverDeployment, follow bool, w io.Writer) error {
+	return d.containerLogs(ctx, hsDep.ContainerID, follow, w)
+}
+
+func (d *Deployer) containerLogs(ctx context.Context, containerID string, follow bool, w io.Writer) error {
+	reader, err := d.Docker.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStderr: true,
+		ShowStdout: true,
+		Follow:     follow,
+	})
+	if err != nil {
+		return fmt.Errorf("Logs: failed to get logs for container %s: %w", containerID, err)
+	}
+	defer reader.Close()
+	_, err = stdcopy.StdCopy(w, w, reader)
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("Logs: failed to read logs for container %s: %w", containerID, err)
+	}
+	return nil
+}
+
 // nolint
 func deployImage(
 	docker *client.Client, imageID string, containerName, pkgNamespace, blueprintName, hsName string,
 	asIDToRegistrationMap map[string]string, contextStr, networkName string, cfg *config.Complement,
+	extraEnv []string, extraFiles map[string][]byte, extraMounts []b.Mount,
 ) (*HomeserverDeployment, error) {
 	ctx := context.Background()
 	var extraHosts []string
@@ -359,6 +685,18 @@ func deployImage(
 			Type:     mount.TypeBind,
 		})
 	}
+	for _, m := range extraMounts {
+		hostPath, err := filepath.Abs(m.HostPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve host path of mount %s: %w", m.HostPath, err)
+		}
+		mounts = append(mounts, mount.Mount{
+			Source:   hostPath,
+			Target:   m.ContainerPath,
+			ReadOnly: m.ReadOnly,
+			Type:     mount.TypeBind,
+		})
+	}
 	if len(mounts) > 0 {
 		log.Printf("Using host mounts: %+v", mounts)
 	}
@@ -366,6 +704,7 @@ func deployImage(
 	env := []string{
 		"SERVER_NAME=" + hsName,
 	}
+	env = append(env, extraEnv...)
 	if cfg.EnvVarsPropagatePrefix != "" {
 		for _, ev := range os.Environ() {
 			if strings.HasPrefix(ev, cfg.EnvVarsPropagatePrefix) {
@@ -375,6 +714,11 @@ func deployImage(
 		log.Printf("Sharing %v host environment variables with container", env)
 	}
 
+	baseImage := imageID
+	if img, err := docker.ImageInspect(ctx, imageID); err == nil && img.Config != nil && img.Config.Labels[baseImageLabel] != "" {
+		baseImage = img.Config.Labels[baseImageLabel]
+	}
+
 	body, err := docker.ContainerCreate(ctx, &container.Config{
 		Image: imageID,
 		Env:   env,
@@ -384,6 +728,7 @@ func deployImage(
 			"complement_blueprint": blueprintName,
 			"complement_pkg":       pkgNamespace,
 			"complement_hs_name":   hsName,
+			baseImageLabel:         baseImage,
 		},
 	}, &container.HostConfig{
 		CapAdd: []string{"NET_ADMIN"}, // TODO : this should be some sort of option
@@ -408,6 +753,8 @@ func deployImage(
 			// `NanoCPUs` is the option that is "Applicable to all platforms" instead of
 			// `CPUPeriod`/`CPUQuota` (Unix only) or `CPUCount`/`CPUPercent` (Windows only).
 			NanoCPUs: int64(cfg.ContainerCPUCores * 1e9),
+			// The relative weight of the container when CPUs are contended
+			CPUShares: cfg.ContainerCPUShares,
 			// Constrain the maximum memory the container can use
 			Memory: cfg.ContainerMemoryBytes,
 		},
@@ -431,6 +778,9 @@ func deployImage(
 		if cfg.ContainerCPUCores > 0 {
 			constraintStrings = append(constraintStrings, fmt.Sprintf("%.1f CPU cores", cfg.ContainerCPUCores))
 		}
+		if cfg.ContainerCPUShares > 0 {
+			constraintStrings = append(constraintStrings, fmt.Sprintf("%d CPU shares", cfg.ContainerCPUShares))
+		}
 		if cfg.ContainerMemoryBytes > 0 {
 			// TODO: It would be nice to pretty print this in MB/GB etc.
 			constraintStrings = append(constraintStrings, fmt.Sprintf("%d bytes of memory", cfg.ContainerMemoryBytes))
@@ -454,6 +804,14 @@ func deployImage(
 		}
 	}
 
+	// Create any other files e.g plugins
+	for path, data := range extraFiles {
+		err = copyToContainer(docker, containerID, path, data)
+		if err != nil {
+			return stubDeployment, err
+		}
+	}
+
 	// Copy CA certificate and key
 	certBytes, err := cfg.CACertificateBytes()
 	if err != nil {
@@ -472,6 +830,20 @@ func deployImage(
 		return stubDeployment, fmt.Errorf("failed to copy CA key to container: %s", err)
 	}
 
+	// Copy a certificate and key for the homeserver, so it needn't sign its own
+	tlsCertBytes, tlsKeyBytes, err := cfg.GenerateCertificate(hsName)
+	if err != nil {
+		return stubDeployment, fmt.Errorf("failed to generate TLS certificate for %s: %s", hsName, err)
+	}
+	err = copyToContainer(docker, containerID, MountTLSCertPath, tlsCertBytes)
+	if err != nil {
+		return stubDeployment, fmt.Errorf("failed to copy TLS certificate to container: %s", err)
+	}
+	err = copyToContainer(docker, containerID, MountTLSKeyPath, tlsKeyBytes)
+	if err != nil {
+		return stubDeployment, fmt.Errorf("failed to copy TLS key to container: %s", err)
+	}
+
 	err = docker.ContainerStart(ctx, containerID, container.StartOptions{})
 	if err != nil {
 		return stubDeployment, fmt.Errorf("ContainerStart: %s", err)
@@ -504,18 +876,20 @@ func deployImage(
 		)
 	}
 
+	labels := b.Labels(inspect.Config.Labels)
 	d := &HomeserverDeployment{
 		BaseURL:             baseURL,
 		FedBaseURL:          fedBaseURL,
 		ContainerID:         containerID,
-		AccessTokens:        tokensFromLabels(inspect.Config.Labels),
-		ApplicationServices: asIDToRegistrationFromLabels(inspect.Config.Labels),
-		DeviceIDs:           deviceIDsFromLabels(inspect.Config.Labels),
+		AccessTokens:        labels.AccessTokens(),
+		ApplicationServices: labels.ApplicationServices(),
+		DeviceIDs:           labels.DeviceIDs(),
+		MediaURIs:           labels.MediaURIs(),
+		Labels:              labels,
 		Network:             networkName,
 	}
 
-	stopTime := time.Now().Add(cfg.SpawnHSTimeout)
-	iterCount, err := waitForContainer(ctx, docker, d, stopTime)
+	iterCount, err := waitForContainer(ctx, docker, d, cfg)
 	if err != nil {
 		return d, fmt.Errorf("%s: failed to check server is up. %w", contextStr, err)
 	} else {
@@ -649,9 +1023,13 @@ func inspectContainer(
 	return inspectResponse, nil
 }
 
-// waitForContainer waits until a homeserver deployment is ready to serve requests.
-func waitForContainer(ctx context.Context, docker *client.Client, hsDep *HomeserverDeployment, stopTime time.Time) (iterCount int, lastErr error) {
+// waitForContainer waits until a homeserver deployment is ready to serve requests: until the container's
+// healthcheck (if it has one) reports healthy, then until the readiness probe of its base image succeeds.
+func waitForContainer(ctx context.Context, docker *client.Client, hsDep *HomeserverDeployment, cfg *config.Complement) (iterCount int, lastErr error) {
 	iterCount = 0
+	hasHealthcheck := false
+	probe := cfg.ReadinessProbeFor(hsDep.Labels[baseImageLabel])
+	stopTime := time.Now().Add(probe.Timeout)
 
 	// If the container has a healthcheck, wait for it first
 	for {
@@ -674,13 +1052,17 @@ func waitForContainer(ctx context.Context, docker *client.Client, hsDep *Homeser
 		}
 
 		// The container is healthy or has no health check.
+		hasHealthcheck = inspect.State.Health != nil
 		lastErr = nil
 		break
 	}
+	if hasHealthcheck && cfg.ReadinessHealthcheckOnly {
+		return
+	}
 
 	// Having optionally waited for container to self-report healthy
-	// hit /versions to check it is actually responding
-	versionsURL := fmt.Sprintf("%s/_matrix/client/versions", hsDep.BaseURL)
+	// hit the readiness path to check it is actually responding
+	readinessURL := hsDep.BaseURL + probe.Path
 
 	for {
 		iterCount += 1
@@ -688,15 +1070,15 @@ func waitForContainer(ctx context.Context, docker *client.Client, hsDep *Homeser
 			lastErr = fmt.Errorf("timed out checking for homeserver to be up: %s", lastErr)
 			break
 		}
-		res, err := http.Get(versionsURL)
+		res, err := http.Get(readinessURL)
 		if err != nil {
-			lastErr = fmt.Errorf("GET %s => error: %s", versionsURL, err)
+			lastErr = fmt.Errorf("GET %s => error: %s", readinessURL, err)
 			time.Sleep(50 * time.Millisecond)
 			continue
 		}
 		defer internal.CloseIO(res.Body, "waitForContainer: version response body")
-		if res.StatusCode != 200 {
-			lastErr = fmt.Errorf("GET %s => HTTP %s", versionsURL, res.Status)
+		if probe.StatusCode != 0 && res.StatusCode != probe.StatusCode {
+			lastErr = fmt.Errorf("GET %s => HTTP %s, want HTTP %d", readinessURL, res.Status, probe.StatusCode)
 			time.Sleep(50 * time.Millisecond)
 			continue
 		}
@@ -733,11 +1115,19 @@ func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 		req.URL.Host = newURL.Host
 	}
 	req.URL.Scheme = "https"
+	tlsConfig := &tls.Config{
+		ServerName:         hsName,
+		InsecureSkipVerify: true,
+	}
+	if t.Deployment.Config.FederationVerifyTLS && hsName != t.Deployment.Config.HostnameRunningComplement {
+		// crypto/tls does not accept certificates with only a common name, which the Complement PKI docs
+		// tell homeservers to make, so verify them ourselves.
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return t.Deployment.Config.VerifyCertificate(rawCerts, hsName)
+		}
+	}
 	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			ServerName:         hsName,
-			InsecureSkipVerify: true,
-		},
+		TLSClientConfig: tlsConfig,
 	}
 	return transport.RoundTrip(req)
 }
@@ -1,17 +1,20 @@
 package docker
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/captcha"
 	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/email"
 	"github.com/matrix-org/complement/helpers"
-	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
@@ -25,9 +28,20 @@ type Deployment struct {
 	// Set to true if this deployment is a dirty deployment and so should not be destroyed.
 	Dirty bool
 	// A map of HS name to a HomeserverDeployment
-	HS               map[string]*HomeserverDeployment
-	Config           *config.Complement
+	HS     map[string]*HomeserverDeployment
+	Config *config.Complement
+	// Captures emails sent by the homeservers in this deployment.
+	Email *email.Server
+	// Verifies captchas for the homeservers in this deployment.
+	Captcha          *captcha.Server
 	localpartCounter atomic.Int64
+	// set via ProfileIfSlow
+	profileTimer *time.Timer
+	// Helper containers started via Deployer.StartAuxiliaryContainer, keyed on name.
+	Auxiliary   map[string]*SidecarDeployment
+	auxiliaryMu sync.Mutex
+	// set via StreamLogs
+	stopStreamingLogs func()
 }
 
 // HomeserverDeployment represents a running homeserver in a container.
@@ -39,6 +53,8 @@ type HomeserverDeployment struct {
 	accessTokensMutex   sync.RWMutex
 	ApplicationServices map[string]string // e.g { "my-as-id": "id: xxx\nas_token: xxx ..."} }
 	DeviceIDs           map[string]string // e.g { "@alice:hs1": "myDeviceID" }
+	MediaURIs           map[string]string // e.g { "avatar": "mxc://hs1/abcdef" }
+	Labels              b.Labels          // all labels of the homeserver image
 
 	// track all clients so if Restart() is called we can repoint to the new high-numbered port
 	CSAPIClients      []*client.CSAPI
@@ -46,6 +62,13 @@ type HomeserverDeployment struct {
 	// The docker network this HS is connected to.
 	// Useful if you want to connect other containers to the same network.
 	Network string
+	// The sidecars running alongside this HS, keyed on sidecar name.
+	Sidecars map[string]*SidecarDeployment
+
+	// set via SetRateLimiting
+	rateLimitMu       sync.Mutex
+	rateLimitDisabled bool
+	rateLimitAdmin    *client.CSAPI
 }
 
 // Updates the client and federation base URLs of the homeserver deployment.
@@ -76,6 +99,7 @@ func (d *Deployment) DestroyAtCleanup() {
 		return
 	}
 	d.Deployer.Destroy(d, d.Deployer.config.AlwaysPrintServerLogs, "COMPLEMENT_ENABLE_DIRTY_RUNS", false)
+	d.Deployer.StopMockServers()
 }
 
 // Destroy the entire deployment. Destroys all running containers. If `printServerLogs` is true,
@@ -88,7 +112,40 @@ func (d *Deployment) Destroy(t ct.TestLike) {
 		}
 		return
 	}
+	d.StopTestHooks()
 	d.Deployer.Destroy(d, d.Deployer.config.AlwaysPrintServerLogs || t.Failed(), t.Name(), t.Failed())
+	d.Deployer.StopMockServers()
+}
+
+// StopTestHooks stops capturing profiles and streaming logs for the test which is using the deployment,
+// for deployments which outlive the test e.g those leased from the warm pool.
+func (d *Deployment) StopTestHooks() {
+	if d.profileTimer != nil {
+		d.profileTimer.Stop()
+		d.profileTimer = nil
+	}
+	if d.stopStreamingLogs != nil {
+		d.stopStreamingLogs()
+		d.stopStreamingLogs = nil
+	}
+}
+
+// EmailServer returns the SMTP server which captures emails sent by homeservers in this deployment.
+func (d *Deployment) EmailServer(t ct.TestLike) *email.Server {
+	t.Helper()
+	if d.Email == nil {
+		ct.Fatalf(t, "EmailServer: deployment has no email server, deploy it with complement.WithEmailServer()")
+	}
+	return d.Email
+}
+
+// CaptchaServer returns the reCAPTCHA verification server used by homeservers in this deployment.
+func (d *Deployment) CaptchaServer(t ct.TestLike) *captcha.Server {
+	t.Helper()
+	if d.Captcha == nil {
+		ct.Fatalf(t, "CaptchaServer: deployment has no captcha server, deploy it with complement.WithCaptchaServer()")
+	}
+	return d.Captcha
 }
 
 func (d *Deployment) GetConfig() *config.Complement {
@@ -141,44 +198,54 @@ func (d *Deployment) Register(t ct.TestLike, hsName string, opts helpers.Registr
 	client.UserID = userID
 	client.AccessToken = accessToken
 	client.DeviceID = deviceID
+	d.applyRateLimiting(t, dep, userID)
 	return client
 }
 
 func (d *Deployment) Login(t ct.TestLike, hsName string, existing *client.CSAPI, opts helpers.LoginOpts) *client.CSAPI {
+	t.Helper()
+	password := existing.Password
+	if opts.Password != "" {
+		password = opts.Password
+	}
+	return d.login(t, "Deployment.Login", hsName, existing.UserID, password, opts.DeviceID)
+}
+
+func (d *Deployment) LoginUser(t ct.TestLike, hsName, userID, password string, opts helpers.LoginOpts) *client.CSAPI {
+	t.Helper()
+	password = helpers.LoginPassword(t, userID, password, opts)
+	return d.login(t, "Deployment.LoginUser", hsName, userID, password, opts.DeviceID)
+}
+
+func (d *Deployment) LoginDevices(t ct.TestLike, hsName, userID, password string, numDevices int) []*client.CSAPI {
+	t.Helper()
+	clients := make([]*client.CSAPI, numDevices)
+	for i := range clients {
+		clients[i] = d.LoginUser(t, hsName, userID, password, helpers.LoginOpts{})
+	}
+	return clients
+}
+
+// login logs in as the user with a password, returning a client for the new device.
+func (d *Deployment) login(t ct.TestLike, caller, hsName, userID, password, deviceID string) *client.CSAPI {
 	t.Helper()
 	dep, ok := d.HS[hsName]
 	if !ok {
-		ct.Fatalf(t, "Deployment.Login: HS name '%s' not found", hsName)
+		ct.Fatalf(t, "%s: HS name '%s' not found", caller, hsName)
 		return nil
 	}
-	localpart, _, err := gomatrixserverlib.SplitID('@', existing.UserID)
-	if err != nil {
-		ct.Fatalf(t, "Deployment.Login: existing CSAPI client has invalid user ID '%s', cannot login as this user: %s", existing.UserID, err)
-	}
 	c := client.NewCSAPI(client.CSAPIOpts{
 		BaseURL:          dep.BaseURL,
 		Client:           client.NewLoggedClient(t, hsName, nil),
 		SyncUntilTimeout: 5 * time.Second,
 		Debug:            d.Deployer.debugLogging,
-		Password:         existing.Password,
+		Password:         password,
 	})
-	if opts.Password != "" {
-		c.Password = opts.Password
-	}
 	// Appending a slice is not thread-safe. Protect the write with a mutex.
 	dep.CSAPIClientsMutex.Lock()
 	dep.CSAPIClients = append(dep.CSAPIClients, c)
 	dep.CSAPIClientsMutex.Unlock()
-	var userID, accessToken, deviceID string
-	if opts.DeviceID == "" {
-		userID, accessToken, deviceID = c.LoginUser(t, localpart, opts.Password)
-	} else {
-		userID, accessToken, deviceID = c.LoginUser(t, localpart, opts.Password, client.WithDeviceID(opts.DeviceID))
-	}
-
-	c.UserID = userID
-	c.AccessToken = accessToken
-	c.DeviceID = deviceID
+	helpers.MustLogin(t, c, userID, password, deviceID)
 	return c
 }
 
@@ -261,6 +328,18 @@ func (d *Deployment) Restart(t ct.TestLike) error {
 	return nil
 }
 
+func (d *Deployment) RestartServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	t.Logf("RestartServer %s", hsName)
+	hsDep := d.HS[hsName]
+	if hsDep == nil {
+		ct.Fatalf(t, "RestartServer: %s does not exist in this deployment", hsName)
+	}
+	if err := d.Deployer.Restart(hsDep); err != nil {
+		ct.Fatalf(t, "RestartServer: %s", err)
+	}
+}
+
 func (d *Deployment) StartServer(t ct.TestLike, hsName string) {
 	t.Helper()
 	t.Logf("StartServer %s", hsName)
@@ -317,3 +396,27 @@ func (d *Deployment) ContainerID(t ct.TestLike, hsName string) string {
 	}
 	return hsDep.ContainerID
 }
+
+func (d *Deployment) Exec(t ct.TestLike, hsName string, cmd ...string) (stdout, stderr string, exitCode int) {
+	t.Helper()
+	hsDep := d.HS[hsName]
+	if hsDep == nil {
+		ct.Fatalf(t, "Exec: %s does not exist in this deployment", hsName)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	res, err := d.Deployer.Exec(ctx, hsDep, cmd)
+	if err != nil {
+		ct.Fatalf(t, "Exec: %s", err)
+	}
+	return res.Stdout, res.Stderr, res.ExitCode
+}
+
+func (d *Deployment) Labels(t ct.TestLike, hsName string) b.Labels {
+	t.Helper()
+	hsDep := d.HS[hsName]
+	if hsDep == nil {
+		ct.Fatalf(t, "Labels: %s does not exist in this deployment", hsName)
+	}
+	return hsDep.Labels
+}
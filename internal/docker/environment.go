@@ -0,0 +1,102 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+)
+
+// Environment describes the effective configuration of a deployment, so failures can be reproduced.
+type Environment struct {
+	BlueprintName string                           `json:"blueprint_name"`
+	Homeservers   map[string]HomeserverEnvironment `json:"homeservers"`
+}
+
+// HomeserverEnvironment describes the container of a homeserver.
+type HomeserverEnvironment struct {
+	ContainerID string `json:"container_id"`
+	// The image the container was created from e.g localhost/complement:pkg.blueprint.hs1
+	Image string `json:"image"`
+	// The content-addressable ID of the image.
+	ImageID string `json:"image_id"`
+	// COMPLEMENT_BASE_IMAGE, or the COMPLEMENT_BASE_IMAGE_* override for this homeserver.
+	BaseImage string `json:"base_image"`
+	// The registry digests of the base image e.g ghcr.io/element-hq/synapse@sha256:...
+	// Empty if the base image was built locally.
+	BaseImageDigests []string `json:"base_image_digests"`
+	// The environment variables of the container.
+	Env []string `json:"env"`
+	// The host address each exposed port is published on, e.g "8008/tcp" => "127.0.0.1:32768".
+	Ports      map[string]string `json:"ports"`
+	Network    string            `json:"network"`
+	BaseURL    string            `json:"base_url"`
+	FedBaseURL string            `json:"fed_base_url"`
+}
+
+// Environment inspects the containers and images of the deployment.
+func (d *Deployer) Environment(ctx context.Context, dep *Deployment) (*Environment, error) {
+	env := &Environment{
+		BlueprintName: dep.BlueprintName,
+		Homeservers:   make(map[string]HomeserverEnvironment, len(dep.HS)),
+	}
+	for hsName, hsDep := range dep.HS {
+		// inspect directly rather than via inspectContainer, which fails for stopped containers
+		inspect, err := d.Docker.ContainerInspect(ctx, hsDep.ContainerID)
+		if err != nil {
+			return nil, fmt.Errorf("Environment: failed to inspect container %s: %w", hsDep.ContainerID, err)
+		}
+		hsEnv := HomeserverEnvironment{
+			ContainerID: hsDep.ContainerID,
+			ImageID:     inspect.Image,
+			BaseImage:   d.config.BaseImageURI,
+			Ports:       make(map[string]string),
+			Network:     hsDep.Network,
+			BaseURL:     hsDep.BaseURL,
+			FedBaseURL:  hsDep.FedBaseURL,
+		}
+		if uri, ok := d.config.BaseImageURIs[hsName]; ok {
+			hsEnv.BaseImage = uri
+		}
+		if inspect.Config != nil {
+			hsEnv.Image = inspect.Config.Image
+			hsEnv.Env = append([]string(nil), inspect.Config.Env...)
+			sort.Strings(hsEnv.Env)
+		}
+		if inspect.NetworkSettings != nil {
+			for port, bindings := range inspect.NetworkSettings.Ports {
+				if len(bindings) > 0 {
+					hsEnv.Ports[string(port)] = net.JoinHostPort(bindings[0].HostIP, bindings[0].HostPort)
+				}
+			}
+		}
+		if baseImage, err := d.Docker.ImageInspect(ctx, hsEnv.BaseImage); err == nil {
+			hsEnv.BaseImageDigests = baseImage.RepoDigests
+		}
+		env.Homeservers[hsName] = hsEnv
+	}
+	return env, nil
+}
+
+// writeEnvironmentArtifact writes the environment of the deployment to the artifacts directory of the
+// test as environment.json, if enabled.
+func (d *Deployer) writeEnvironmentArtifact(dep *Deployment, testName string) {
+	if !d.artifacts.Enabled() {
+		return
+	}
+	env, err := d.Environment(context.Background(), dep)
+	if err != nil {
+		log.Printf("Destroy: Failed to get environment: %s\n", err)
+		return
+	}
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		log.Printf("Destroy: Failed to marshal environment: %s\n", err)
+		return
+	}
+	if err = d.artifacts.WriteFile(testName, "environment.json", data); err != nil {
+		log.Printf("Destroy: Failed to write environment artifact: %s\n", err)
+	}
+}
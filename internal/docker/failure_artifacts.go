@@ -0,0 +1,104 @@
+package docker
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/errdefs"
+)
+
+// writeFailureArtifacts writes the `docker inspect` output of the container to the artifacts directory of
+// the test as `name`.inspect.json, and copies COMPLEMENT_FAILURE_ARTIFACT_PATHS out of the container into
+// the `name` subdirectory. The container may be stopped, but must not have been removed.
+func (d *Deployer) writeFailureArtifacts(containerID, testName, name string) {
+	if !d.artifacts.Enabled() {
+		return
+	}
+	ctx := context.Background()
+	inspect, err := d.Docker.ContainerInspect(ctx, containerID)
+	if err != nil {
+		log.Printf("Destroy: Failed to inspect container %s: %s\n", containerID, err)
+	} else {
+		data, _ := json.MarshalIndent(inspect, "", "  ")
+		if err = d.artifacts.WriteFile(testName, name+".inspect.json", data); err != nil {
+			log.Printf("Destroy: Failed to write inspect artifact for %s: %s\n", containerID, err)
+		}
+	}
+	if len(d.config.FailureArtifactPaths) == 0 {
+		return
+	}
+	dir, err := d.artifacts.Dir(testName)
+	if err != nil {
+		log.Printf("Destroy: Failed to create artifacts directory: %s\n", err)
+		return
+	}
+	dir = filepath.Join(dir, name)
+	for _, srcPath := range d.config.FailureArtifactPaths {
+		if err = d.copyFromContainer(ctx, containerID, srcPath, dir); err != nil {
+			log.Printf("Destroy: Failed to copy %s from container %s: %s\n", srcPath, containerID, err)
+		}
+	}
+}
+
+// copyFromContainer copies the file or directory at `srcPath` in the container to the same path under
+// `dstDir`. Does nothing if `srcPath` does not exist.
+func (d *Deployer) copyFromContainer(ctx context.Context, containerID, srcPath, dstDir string) error {
+	rc, _, err := d.Docker.CopyFromContainer(ctx, containerID, srcPath)
+	if errdefs.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer rc.Close()
+	// The entries of the tarball are relative to the parent directory of srcPath.
+	parent := filepath.Join(dstDir, filepath.FromSlash(path.Dir(path.Clean("/"+srcPath))))
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read tarball: %w", err)
+		}
+		target := filepath.Join(parent, filepath.FromSlash(hdr.Name))
+		// don't allow escaping the artifacts directory
+		if !strings.HasPrefix(target, filepath.Clean(dstDir)+string(filepath.Separator)) {
+			return fmt.Errorf("refusing to write %s outside of %s", hdr.Name, dstDir)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err = writeFileFrom(target, tr); err != nil {
+				return err
+			}
+		default:
+			// symlinks, devices etc are not useful outside of the container
+		}
+	}
+}
+
+func writeFileFrom(target string, r io.Reader) error {
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
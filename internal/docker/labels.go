@@ -1,8 +1,6 @@
 package docker
 
 import (
-	"strings"
-
 	"github.com/docker/docker/api/types/filters"
 
 	"github.com/matrix-org/complement/b"
@@ -19,45 +17,18 @@ func label(labelFilters ...string) filters.Args {
 	return f
 }
 
-func tokensFromLabels(labels map[string]string) map[string]string {
-	userIDToToken := make(map[string]string)
-	for k, v := range labels {
-		if strings.HasPrefix(k, "access_token_") {
-			userIDToToken[strings.TrimPrefix(k, "access_token_")] = v
-		}
-	}
-	return userIDToToken
-}
-
-func asIDToRegistrationFromLabels(labels map[string]string) map[string]string {
-	asMap := make(map[string]string)
-	for k, v := range labels {
-		if strings.HasPrefix(k, "application_service_") {
-			// cf comment of generateASRegistrationYaml for ReplaceAll explanation
-			asMap[strings.TrimPrefix(k, "application_service_")] = strings.ReplaceAll(v, "\\n", "\n")
-		}
-	}
-	return asMap
-}
-
-func labelsForApplicationServices(hs b.Homeserver) map[string]string {
+func labelsForApplicationServices(hs b.Homeserver) (map[string]string, error) {
 	labels := make(map[string]string)
 	// collect and store app service registrations as labels 'application_service_$as_id: $registration'
 	// collect and store app service access tokens as labels 'access_token_$sender_localpart: $as_token'
 	for _, as := range hs.ApplicationServices {
-		labels["application_service_"+as.ID] = generateASRegistrationYaml(as)
-
-		labels["access_token_@"+as.SenderLocalpart+":"+hs.Name] = as.ASToken
-	}
-	return labels
-}
-
-func deviceIDsFromLabels(labels map[string]string) map[string]string {
-	userIDToToken := make(map[string]string)
-	for k, v := range labels {
-		if strings.HasPrefix(k, "device_id") {
-			userIDToToken[strings.TrimPrefix(k, "device_id")] = v
+		registration, err := generateASRegistrationYaml(as)
+		if err != nil {
+			return nil, err
 		}
+		labels[b.LabelPrefixApplicationService+as.ID] = registration
+
+		labels[b.LabelPrefixAccessToken+"@"+as.SenderLocalpart+":"+hs.Name] = as.ASToken
 	}
-	return userIDToToken
+	return labels, nil
 }
@@ -0,0 +1,87 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// StreamLogs writes the logs of every homeserver in the deployment to `t` as they are written, each line
+// prefixed with the homeserver name, until the deployment is destroyed. Streaming continues across
+// restarts of the homeservers. `t` must outlive the deployment.
+func (d *Deployment) StreamLogs(t ct.TestLike) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for hsName, hsDep := range d.HS {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &lineLogger{t: t, prefix: hsName}
+			d.Deployer.followLogs(ctx, hsDep, w)
+			w.flush()
+		}()
+	}
+	d.stopStreamingLogs = func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// followLogs writes the logs of the homeserver container to `w` until the context is cancelled. The
+// stream is reopened if it ends e.g because the container was restarted.
+func (d *Deployer) followLogs(ctx context.Context, hsDep *HomeserverDeployment, w *lineLogger) {
+	since := ""
+	for ctx.Err() == nil {
+		reader, err := d.Docker.ContainerLogs(ctx, hsDep.ContainerID, container.LogsOptions{
+			ShowStderr: true,
+			ShowStdout: true,
+			Follow:     true,
+			Since:      since,
+		})
+		if err == nil {
+			stdcopy.StdCopy(w, w, reader)
+			reader.Close()
+		}
+		now := time.Now()
+		since = fmt.Sprintf("%d.%09d", now.Unix(), now.Nanosecond())
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// lineLogger logs each complete line written to it.
+type lineLogger struct {
+	t      ct.TestLike
+	prefix string
+	buf    bytes.Buffer
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf.Write(p)
+	for {
+		line, err := l.buf.ReadString('\n')
+		if err != nil {
+			// incomplete line, keep it for the next write
+			l.buf.WriteString(line)
+			return len(p), nil
+		}
+		l.t.Logf("%s: %s", l.prefix, strings.TrimSuffix(line, "\n"))
+	}
+}
+
+func (l *lineLogger) flush() {
+	if l.buf.Len() > 0 {
+		l.t.Logf("%s: %s", l.prefix, l.buf.String())
+		l.buf.Reset()
+	}
+}
@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+)
+
+// NetworkConditions are the conditions of the network as seen by packets a homeserver sends.
+type NetworkConditions struct {
+	// Latency is added to every packet.
+	Latency time.Duration
+	// Jitter varies the latency of each packet by up to this much, either way.
+	Jitter time.Duration
+	// PacketLoss is the percentage (0-100) of packets which are dropped.
+	PacketLoss float64
+}
+
+// IsZero returns true if the conditions do not change the network.
+func (c NetworkConditions) IsZero() bool {
+	return c.Latency == 0 && c.Jitter == 0 && c.PacketLoss == 0
+}
+
+// netemArgs returns the arguments to `tc qdisc ... netem` for the conditions.
+func (c NetworkConditions) netemArgs() string {
+	var args []string
+	if c.Latency > 0 || c.Jitter > 0 {
+		args = append(args, fmt.Sprintf("delay %dus", c.Latency.Microseconds()))
+		if c.Jitter > 0 {
+			args = append(args, fmt.Sprintf("%dus", c.Jitter.Microseconds()))
+		}
+	}
+	if c.PacketLoss > 0 {
+		args = append(args, fmt.Sprintf("loss %g%%", c.PacketLoss))
+	}
+	return strings.Join(args, " ")
+}
+
+// SetNetworkConditions applies the conditions to packets sent by the homeserver container using
+// `tc netem`, replacing any conditions previously set. Responses from the client-server API port
+// (8008) are not affected, so only federation traffic is degraded and clients in tests keep working.
+// As only outbound packets are affected, set the conditions on both homeservers to degrade traffic
+// in both directions. Zero conditions restore the network.
+//
+// `tc` is run in a container from COMPLEMENT_NETEM_IMAGE which shares the network namespace of the
+// homeserver container, so the homeserver image does not need `tc` or the NET_ADMIN capability.
+func (d *Deployer) SetNetworkConditions(ctx context.Context, hsDep *HomeserverDeployment, cond NetworkConditions) error {
+	if cond.PacketLoss < 0 || cond.PacketLoss > 100 {
+		return fmt.Errorf("SetNetworkConditions: packet loss %g%% is not between 0 and 100", cond.PacketLoss)
+	}
+	// the homeserver may have been reconnected to the network under a different interface name
+	script := `set -e
+dev=$(ip route show default | awk '{print $5; exit}')
+tc qdisc del dev "$dev" root 2>/dev/null || true
+`
+	if !cond.IsZero() {
+		// Send all packets to band 3, which has the netem qdisc, apart from client-server API
+		// responses which go to band 1.
+		script += fmt.Sprintf(`tc qdisc add dev "$dev" root handle 1: prio priomap 2 2 2 2 2 2 2 2 2 2 2 2 2 2 2 2
+tc qdisc add dev "$dev" parent 1:3 handle 30: netem %s
+tc filter add dev "$dev" protocol ip parent 1:0 prio 1 u32 match ip sport 8008 0xffff flowid 1:1
+`, cond.netemArgs())
+	}
+	res, err := d.runOneshot(ctx, d.config.NetemImage, []string{"sh", "-c", script}, &container.HostConfig{
+		NetworkMode: container.NetworkMode("container:" + hsDep.ContainerID),
+		CapAdd:      []string{"NET_ADMIN"},
+	}, &network.NetworkingConfig{})
+	if err != nil {
+		return fmt.Errorf("SetNetworkConditions: %w", err)
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("SetNetworkConditions: tc exited with code %d: %s%s", res.ExitCode, res.Stdout, res.Stderr)
+	}
+	return nil
+}
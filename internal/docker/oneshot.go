@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// RunContainer runs a short-lived container from `imageURI` on the given network, waits for it to exit
+// and returns its exit code and output. The image is pulled if it does not exist locally. This is useful
+// to run tools like curl or openssl from inside the network, where homeservers are reachable by their
+// server names. The container is always removed before returning.
+func (d *Deployer) RunContainer(ctx context.Context, networkName, imageURI string, cmd []string) (*ExecResult, error) {
+	return d.runOneshot(ctx, imageURI, cmd, &container.HostConfig{}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			networkName: {},
+		},
+	})
+}
+
+// runOneshot runs a container like RunContainer, with the given host and networking config.
+func (d *Deployer) runOneshot(
+	ctx context.Context, imageURI string, cmd []string, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig,
+) (*ExecResult, error) {
+	if err := pullImageIfNotExists(ctx, d.Docker, imageURI); err != nil {
+		return nil, fmt.Errorf("RunContainer: %w", err)
+	}
+	body, err := d.Docker.ContainerCreate(ctx, &container.Config{
+		Image: imageURI,
+		Cmd:   cmd,
+		Labels: map[string]string{
+			complementLabel:  "oneshot",
+			"complement_pkg": d.config.PackageNamespace,
+		},
+	}, hostConfig, networkingConfig, nil, "") // let docker name it, as this can be called concurrently
+	if err != nil {
+		return nil, fmt.Errorf("RunContainer: ContainerCreate: %w", err)
+	}
+	// use a fresh context so the container is removed even if ctx has been cancelled
+	defer d.Docker.ContainerRemove(context.Background(), body.ID, container.RemoveOptions{
+		Force: true,
+	})
+	// wait for the container before starting it, so we can't miss it exiting
+	waitCh, errCh := d.Docker.ContainerWait(ctx, body.ID, container.WaitConditionNextExit)
+	if err = d.Docker.ContainerStart(ctx, body.ID, container.StartOptions{}); err != nil {
+		return nil, fmt.Errorf("RunContainer: ContainerStart: %w", err)
+	}
+	var exitCode int
+	select {
+	case res := <-waitCh:
+		if res.Error != nil {
+			return nil, fmt.Errorf("RunContainer: container %s failed: %s", body.ID, res.Error.Message)
+		}
+		exitCode = int(res.StatusCode)
+	case err = <-errCh:
+		return nil, fmt.Errorf("RunContainer: failed to wait for container %s: %w", body.ID, err)
+	}
+	reader, err := d.Docker.ContainerLogs(ctx, body.ID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("RunContainer: failed to get logs for container %s: %w", body.ID, err)
+	}
+	defer reader.Close()
+	var stdout, stderr bytes.Buffer
+	if _, err = stdcopy.StdCopy(&stdout, &stderr, reader); err != nil {
+		return nil, fmt.Errorf("RunContainer: failed to read logs for container %s: %w", body.ID, err)
+	}
+	return &ExecResult{
+		ExitCode: exitCode,
+		Stdout:   stdout.String(),
+		Stderr:   stderr.String(),
+	}, nil
+}
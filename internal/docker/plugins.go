@@ -0,0 +1,40 @@
+package docker
+
+import (
+	"path"
+	"strings"
+
+	"github.com/matrix-org/complement/b"
+)
+
+// pluginsLabel records the names of the plugins installed in a blueprint image, space separated.
+const pluginsLabel = "complement_plugins"
+
+// pluginNames returns the space separated names of the plugins.
+func pluginNames(plugins []b.Plugin) string {
+	names := make([]string, len(plugins))
+	for i, p := range plugins {
+		names[i] = p.Name
+	}
+	return strings.Join(names, " ")
+}
+
+// pluginEnv returns the environment variables which tell the homeserver which plugins are installed.
+func pluginEnv(names string) []string {
+	if names == "" {
+		return nil
+	}
+	return []string{"COMPLEMENT_PLUGINS=" + names}
+}
+
+// pluginFiles returns the files to copy into the homeserver container for the plugins, keyed on path.
+func pluginFiles(plugins []b.Plugin) map[string][]byte {
+	files := make(map[string][]byte)
+	for _, p := range plugins {
+		for filePath, data := range p.Files {
+			files[path.Join(MountPluginPath, p.Name, filePath)] = data
+		}
+		files[path.Join(MountPluginPath, p.Name+".yaml")] = []byte(p.Config)
+	}
+	return files
+}
@@ -0,0 +1,48 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// CaptureProfiles runs COMPLEMENT_PROFILE_COMMAND in every homeserver container of the deployment,
+// writing the output of each to the artifact `$hsName.profile` of the test. Does nothing if
+// COMPLEMENT_PROFILE_COMMAND or COMPLEMENT_ARTIFACTS_DIR are not set.
+func (d *Deployer) CaptureProfiles(ctx context.Context, dep *Deployment, testName string) error {
+	if d.config.ProfileCommand == "" || !d.artifacts.Enabled() {
+		return nil
+	}
+	for hsName, hsDep := range dep.HS {
+		res, err := d.Exec(ctx, hsDep, []string{"sh", "-c", d.config.ProfileCommand})
+		if err != nil {
+			return fmt.Errorf("CaptureProfiles: %s: %w", hsName, err)
+		}
+		output := res.Stdout
+		if res.ExitCode != 0 {
+			output += fmt.Sprintf("\nCOMPLEMENT_PROFILE_COMMAND exited with code %d:\n%s", res.ExitCode, res.Stderr)
+		}
+		if err = d.artifacts.WriteFile(testName, hsName+".profile", []byte(output)); err != nil {
+			return fmt.Errorf("CaptureProfiles: %s: %w", hsName, err)
+		}
+	}
+	return nil
+}
+
+// ProfileIfSlow captures profiles of the homeservers via CaptureProfiles if the deployment has not
+// been destroyed after COMPLEMENT_PROFILE_AFTER_SECS, as a slow test is often caused by a slow
+// homeserver. Does nothing if COMPLEMENT_PROFILE_COMMAND is not set.
+func (d *Deployment) ProfileIfSlow(testName string) {
+	if d.Config.ProfileCommand == "" || d.Dirty {
+		return
+	}
+	d.profileTimer = time.AfterFunc(d.Config.ProfileAfter, func() {
+		log.Printf("%s is still running after %v, capturing homeserver profiles", testName, d.Config.ProfileAfter)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := d.Deployer.CaptureProfiles(ctx, d, testName); err != nil {
+			log.Printf("%s: failed to capture profiles: %s", testName, err)
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package docker
+
+import (
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// SetRateLimiting enables or disables rate limiting for every user on the homeserver which is known to the
+// deployment, i.e blueprint users and users created via Register, including users registered after this
+// call. Rate limits are overridden per user via an admin user, which is registered on first use.
+func (d *Deployment) SetRateLimiting(t ct.TestLike, hsName string, enabled bool) {
+	t.Helper()
+	dep, ok := d.HS[hsName]
+	if !ok {
+		ct.Fatalf(t, "Deployment.SetRateLimiting - HS name '%s' not found", hsName)
+	}
+	dep.rateLimitMu.Lock()
+	admin := dep.rateLimitAdmin
+	dep.rateLimitMu.Unlock()
+	if admin == nil {
+		// registered before disabling rate limiting, so Register does not try to use the admin itself
+		admin = d.Register(t, hsName, helpers.RegistrationOpts{LocalpartSuffix: "ratelimit-admin", IsAdmin: true})
+		admin.MustDisableRateLimiting(t, admin.UserID)
+	}
+
+	dep.rateLimitMu.Lock()
+	dep.rateLimitAdmin = admin
+	dep.rateLimitDisabled = !enabled
+	dep.rateLimitMu.Unlock()
+
+	dep.accessTokensMutex.RLock()
+	userIDs := make([]string, 0, len(dep.AccessTokens))
+	for userID := range dep.AccessTokens {
+		if userID != admin.UserID {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	dep.accessTokensMutex.RUnlock()
+	for _, userID := range userIDs {
+		if enabled {
+			admin.MustEnableRateLimiting(t, userID)
+		} else {
+			admin.MustDisableRateLimiting(t, userID)
+		}
+	}
+}
+
+// applyRateLimiting disables rate limiting for a newly registered user if SetRateLimiting disabled it for
+// the homeserver.
+func (d *Deployment) applyRateLimiting(t ct.TestLike, dep *HomeserverDeployment, userID string) {
+	t.Helper()
+	dep.rateLimitMu.Lock()
+	disabled := dep.rateLimitDisabled
+	admin := dep.rateLimitAdmin
+	dep.rateLimitMu.Unlock()
+	if disabled && admin != nil {
+		admin.MustDisableRateLimiting(t, userID)
+	}
+}
@@ -0,0 +1,188 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+
+	"github.com/matrix-org/complement/b"
+)
+
+// blueprintHash returns a hash of everything which determines the contents of the images of a blueprint,
+// so images can be shared via COMPLEMENT_BLUEPRINT_REGISTRY between machines which would build the same
+// images. Base images are identified by their image ID, so rebuilding a base image changes the hash.
+func (d *Builder) blueprintHash(bprint b.Blueprint) (string, error) {
+	baseImageIDs := make([]string, len(bprint.Homeservers))
+	for i, hs := range bprint.Homeservers {
+		baseImageURI := d.baseImageURI(hs)
+		img, err := d.Docker.ImageInspect(context.Background(), baseImageURI)
+		if err != nil {
+			return "", fmt.Errorf("failed to inspect base image %s: %w", baseImageURI, err)
+		}
+		baseImageIDs[i] = img.ID
+	}
+	return hashBlueprint(d.Config.PackageNamespace, baseImageIDs, bprint)
+}
+
+// hashBlueprint returns the hash of the blueprint built in the package namespace from base images with
+// the given IDs, one per homeserver. Application service tokens are excluded as they are generated
+// randomly when the blueprint is validated, so pulled images keep the tokens they were built with.
+func hashBlueprint(packageNamespace string, baseImageIDs []string, bprint b.Blueprint) (string, error) {
+	homeservers := make([]b.Homeserver, len(bprint.Homeservers))
+	for i, hs := range bprint.Homeservers {
+		hs.ApplicationServices = append([]b.ApplicationService(nil), hs.ApplicationServices...)
+		for j := range hs.ApplicationServices {
+			hs.ApplicationServices[j].HSToken = ""
+			hs.ApplicationServices[j].ASToken = ""
+		}
+		homeservers[i] = hs
+	}
+	bprint.Homeservers = homeservers
+	data, err := json.Marshal(struct {
+		PackageNamespace string
+		LabelSchema      string
+		BaseImageIDs     []string
+		Blueprint        b.Blueprint
+	}{
+		PackageNamespace: packageNamespace,
+		LabelSchema:      b.LabelSchemaVersion,
+		BaseImageIDs:     baseImageIDs,
+		Blueprint:        bprint,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal blueprint: %w", err)
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])[:32], nil
+}
+
+// registryRef returns the reference of the image of the homeserver in COMPLEMENT_BLUEPRINT_REGISTRY.
+func (d *Builder) registryRef(hash, hsName string) string {
+	return fmt.Sprintf("%s:%s-%s", d.Config.BlueprintRegistry, hash, strings.ToLower(hsName))
+}
+
+// pullBlueprint pulls the images of the blueprint from COMPLEMENT_BLUEPRINT_REGISTRY and tags them as if
+// they were built locally. Returns false if any image could not be pulled, in which case the blueprint
+// needs building. Images which were pulled before the failure are untagged, so they are not orphaned
+// when the blueprint is built.
+func (d *Builder) pullBlueprint(bprint b.Blueprint) (pulled bool, err error) {
+	ctx := context.Background()
+	hash, err := d.blueprintHash(bprint)
+	if err != nil {
+		return false, err
+	}
+	auth, err := d.registryAuth()
+	if err != nil {
+		return false, err
+	}
+	var tagged []string
+	defer func() {
+		if pulled {
+			return
+		}
+		for _, tag := range tagged {
+			if _, rmErr := d.Docker.ImageRemove(ctx, tag, image.RemoveOptions{}); rmErr != nil {
+				d.log("Failed to untag pulled image %s: %s", tag, rmErr)
+			}
+		}
+	}()
+	for _, hs := range bprint.Homeservers {
+		ref := d.registryRef(hash, hs.Name)
+		reader, err := d.Docker.ImagePull(ctx, ref, image.PullOptions{RegistryAuth: auth})
+		if err == nil {
+			err = waitForProgressStream(reader)
+		}
+		if err != nil {
+			d.log("Blueprint %s is not in the registry as %s: %s", bprint.Name, ref, err)
+			return false, nil
+		}
+		contextStr := d.contextStr(bprint.Name, hs.Name)
+		tag := "localhost/complement:" + contextStr
+		if err = d.Docker.ImageTag(ctx, ref, tag); err != nil {
+			return false, fmt.Errorf("failed to tag %s: %w", ref, err)
+		}
+		tagged = append(tagged, tag)
+		// only keep the localhost tag, so the image is cleaned up like one which was built locally
+		if _, err = d.Docker.ImageRemove(ctx, ref, image.RemoveOptions{}); err != nil {
+			return false, fmt.Errorf("failed to untag %s: %w", ref, err)
+		}
+		d.log("%s: Pulled docker image %s", contextStr, ref)
+	}
+	return true, nil
+}
+
+// pushBlueprint pushes the images of a newly built blueprint to COMPLEMENT_BLUEPRINT_REGISTRY.
+func (d *Builder) pushBlueprint(bprint b.Blueprint) error {
+	ctx := context.Background()
+	hash, err := d.blueprintHash(bprint)
+	if err != nil {
+		return err
+	}
+	auth, err := d.registryAuth()
+	if err != nil {
+		return err
+	}
+	for _, hs := range bprint.Homeservers {
+		ref := d.registryRef(hash, hs.Name)
+		contextStr := d.contextStr(bprint.Name, hs.Name)
+		if err = d.Docker.ImageTag(ctx, "localhost/complement:"+contextStr, ref); err != nil {
+			return fmt.Errorf("failed to tag %s: %w", ref, err)
+		}
+		reader, err := d.Docker.ImagePush(ctx, ref, image.PushOptions{RegistryAuth: auth})
+		if err == nil {
+			err = waitForProgressStream(reader)
+		}
+		// remove the registry tag even if the push failed, else the image is never cleaned up
+		if _, rmErr := d.Docker.ImageRemove(ctx, ref, image.RemoveOptions{}); rmErr != nil && err == nil {
+			err = fmt.Errorf("failed to untag %s: %w", ref, rmErr)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to push %s: %w", ref, err)
+		}
+		d.log("%s: Pushed docker image %s", contextStr, ref)
+	}
+	return nil
+}
+
+// registryAuth returns the encoded COMPLEMENT_BLUEPRINT_REGISTRY_AUTH, or "" if it is not set.
+func (d *Builder) registryAuth() (string, error) {
+	if d.Config.BlueprintRegistryAuth == "" {
+		return "", nil
+	}
+	username, password, ok := strings.Cut(d.Config.BlueprintRegistryAuth, ":")
+	if !ok {
+		return "", fmt.Errorf("COMPLEMENT_BLUEPRINT_REGISTRY_AUTH must be of the form username:password")
+	}
+	return registry.EncodeAuthConfig(registry.AuthConfig{
+		Username: username,
+		Password: password,
+	})
+}
+
+// waitForProgressStream reads a pull or push progress stream until it ends, returning the error in the
+// stream if the operation failed.
+func waitForProgressStream(reader io.ReadCloser) error {
+	defer reader.Close()
+	decoder := json.NewDecoder(reader)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("%s", msg.Error)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement/b"
+)
+
+func testBlueprint(asToken, hsToken string) b.Blueprint {
+	return b.Blueprint{
+		Name: "test_blueprint",
+		Homeservers: []b.Homeserver{
+			{
+				Name: "hs1",
+				Users: []b.User{
+					{Localpart: "alice"},
+				},
+				ApplicationServices: []b.ApplicationService{
+					{
+						ID:              "my_as",
+						ASToken:         asToken,
+						HSToken:         hsToken,
+						URL:             "http://localhost:9000",
+						SenderLocalpart: "the-bot",
+					},
+				},
+			},
+		},
+	}
+}
+
+func mustHashBlueprint(t *testing.T, namespace string, baseImageIDs []string, bprint b.Blueprint) string {
+	t.Helper()
+	hash, err := hashBlueprint(namespace, baseImageIDs, bprint)
+	if err != nil {
+		t.Fatalf("hashBlueprint: %s", err)
+	}
+	return hash
+}
+
+func TestHashBlueprint(t *testing.T) {
+	baseImageIDs := []string{"sha256:aaaa"}
+	bprint := testBlueprint("as_token_1", "hs_token_1")
+	hash := mustHashBlueprint(t, "pkg", baseImageIDs, bprint)
+	if got := mustHashBlueprint(t, "pkg", baseImageIDs, bprint); got != hash {
+		t.Errorf("hash is not stable: got %s then %s", hash, got)
+	}
+
+	// application service tokens are generated randomly, so must not change the hash
+	if got := mustHashBlueprint(t, "pkg", baseImageIDs, testBlueprint("as_token_2", "hs_token_2")); got != hash {
+		t.Errorf("changing application service tokens changed the hash: got %s want %s", got, hash)
+	}
+	if bprint.Homeservers[0].ApplicationServices[0].ASToken != "as_token_1" {
+		t.Errorf("hashBlueprint modified the application services of the blueprint")
+	}
+
+	// anything else which changes the images must change the hash
+	testCases := map[string]string{
+		"base image ID": mustHashBlueprint(t, "pkg", []string{"sha256:bbbb"}, bprint),
+		"namespace":     mustHashBlueprint(t, "other_pkg", baseImageIDs, bprint),
+		"users": mustHashBlueprint(t, "pkg", baseImageIDs, func() b.Blueprint {
+			bp := testBlueprint("as_token_1", "hs_token_1")
+			bp.Homeservers[0].Users = append(bp.Homeservers[0].Users, b.User{Localpart: "bob"})
+			return bp
+		}()),
+		"application service URL": mustHashBlueprint(t, "pkg", baseImageIDs, func() b.Blueprint {
+			bp := testBlueprint("as_token_1", "hs_token_1")
+			bp.Homeservers[0].ApplicationServices[0].URL = "http://localhost:9001"
+			return bp
+		}()),
+	}
+	for name, got := range testCases {
+		if got == hash {
+			t.Errorf("changing the %s did not change the hash", name)
+		}
+	}
+}
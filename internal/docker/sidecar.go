@@ -0,0 +1,182 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+
+	"github.com/matrix-org/complement/b"
+)
+
+// SidecarDeployment represents a running sidecar container of a homeserver, or an auxiliary container
+// of a deployment.
+type SidecarDeployment struct {
+	ContainerID string
+	// The hostname of the sidecar on the network e.g redis.hs1
+	Hostname string
+	// The host-accessible addresses (host:port) of the published ports, keyed on container port.
+	Addresses map[int]string
+}
+
+// sidecarHostname returns the hostname of a sidecar on the deployment network.
+func sidecarHostname(sidecarName, hsName string) string {
+	return sidecarName + "." + hsName
+}
+
+// sidecarEnv returns the environment variables which tell a homeserver the hostnames of its sidecars.
+func sidecarEnv(hsName string, sidecars []b.Sidecar) []string {
+	if len(sidecars) == 0 {
+		return nil
+	}
+	pairs := make([]string, len(sidecars))
+	for i, sc := range sidecars {
+		pairs[i] = sc.Name + "=" + sidecarHostname(sc.Name, hsName)
+	}
+	sort.Strings(pairs)
+	return []string{"COMPLEMENT_SIDECARS=" + strings.Join(pairs, " ")}
+}
+
+// deploySidecars runs the sidecars of the homeserver `hsName` on the network. On error, the sidecars
+// which were created are returned so they can be removed.
+func (d *Deployer) deploySidecars(ctx context.Context, networkName, hsName string, sidecars []b.Sidecar) (map[string]*SidecarDeployment, error) {
+	deployed := make(map[string]*SidecarDeployment, len(sidecars))
+	for _, sc := range sidecars {
+		containerName := fmt.Sprintf("complement_%s_%s_%s_%s", d.config.PackageNamespace, d.DeployNamespace, hsName, sc.Name)
+		scDep, err := d.startContainer(ctx, networkName, containerName, sidecarHostname(sc.Name, hsName), sc, map[string]string{
+			complementLabel:      "sidecar",
+			"complement_pkg":     d.config.PackageNamespace,
+			"complement_hs_name": hsName,
+		})
+		if scDep != nil {
+			deployed[sc.Name] = scDep
+		}
+		if err != nil {
+			return deployed, fmt.Errorf("sidecar %s of %s: %w", sc.Name, hsName, err)
+		}
+		d.log("%s -> sidecar %s (%s)\n", hsName, scDep.Hostname, scDep.ContainerID)
+	}
+	return deployed, nil
+}
+
+// startContainer runs a long-lived container on the network, reachable at `hostname`. On error, the
+// container is returned if it was created so it can be removed.
+func (d *Deployer) startContainer(
+	ctx context.Context, networkName, containerName, hostname string, sc b.Sidecar, labels map[string]string,
+) (*SidecarDeployment, error) {
+	if err := pullImageIfNotExists(ctx, d.Docker, sc.Image); err != nil {
+		return nil, err
+	}
+	exposedPorts := nat.PortSet{}
+	portBindings := nat.PortMap{}
+	for _, p := range sc.Ports {
+		port := nat.Port(fmt.Sprintf("%d/tcp", p))
+		exposedPorts[port] = struct{}{}
+		// an empty HostPort picks a random high-numbered port
+		portBindings[port] = []nat.PortBinding{{HostIP: d.config.HSPortBindingIP}}
+	}
+	body, err := d.Docker.ContainerCreate(ctx, &container.Config{
+		Image:        sc.Image,
+		Cmd:          sc.Cmd,
+		Env:          sc.Env,
+		ExposedPorts: exposedPorts,
+		Labels:       labels,
+	}, &container.HostConfig{
+		PortBindings: portBindings,
+	}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			networkName: {
+				Aliases: []string{hostname},
+			},
+		},
+	}, nil, containerName)
+	if err != nil {
+		return nil, fmt.Errorf("ContainerCreate: %w", err)
+	}
+	scDep := &SidecarDeployment{
+		ContainerID: body.ID,
+		Hostname:    hostname,
+		Addresses:   make(map[int]string),
+	}
+	for filePath, data := range sc.Files {
+		if err = copyToContainer(d.Docker, scDep.ContainerID, filePath, data); err != nil {
+			return scDep, err
+		}
+	}
+	if err = d.Docker.ContainerStart(ctx, scDep.ContainerID, container.StartOptions{}); err != nil {
+		return scDep, fmt.Errorf("ContainerStart: %w", err)
+	}
+	if len(sc.Ports) == 0 {
+		return scDep, nil
+	}
+	inspect, err := d.Docker.ContainerInspect(ctx, scDep.ContainerID)
+	if err != nil {
+		return scDep, fmt.Errorf("ContainerInspect: %w", err)
+	}
+	for _, p := range sc.Ports {
+		bindings := inspect.NetworkSettings.Ports[nat.Port(fmt.Sprintf("%d/tcp", p))]
+		if len(bindings) == 0 {
+			return scDep, fmt.Errorf("port %d is not published: %+v", p, inspect.NetworkSettings.Ports)
+		}
+		scDep.Addresses[p] = fmt.Sprintf("%s:%s", d.config.HSPortBindingIP, bindings[0].HostPort)
+	}
+	return scDep, nil
+}
+
+// StartAuxiliaryContainer runs a long-lived helper container (e.g a database or an S3 mock) on the network
+// of the deployment, reachable from the network at `name`. The container is removed when the deployment
+// is destroyed. Only the name, image, command, environment, files and ports of `spec` are used.
+func (d *Deployer) StartAuxiliaryContainer(ctx context.Context, dep *Deployment, name string, spec b.Sidecar) (*SidecarDeployment, error) {
+	if _, exists := dep.HS[name]; exists {
+		return nil, fmt.Errorf("StartAuxiliaryContainer: %s is the name of a homeserver", name)
+	}
+	dep.auxiliaryMu.Lock()
+	defer dep.auxiliaryMu.Unlock()
+	if _, exists := dep.Auxiliary[name]; exists {
+		return nil, fmt.Errorf("StartAuxiliaryContainer: %s is already running", name)
+	}
+	containerName := fmt.Sprintf("complement_%s_%s_aux_%s", d.config.PackageNamespace, d.DeployNamespace, name)
+	auxDep, err := d.startContainer(ctx, dep.Network(), containerName, name, spec, map[string]string{
+		complementLabel:  "auxiliary",
+		"complement_pkg": d.config.PackageNamespace,
+	})
+	if err != nil {
+		if auxDep != nil {
+			d.removeContainers(map[string]*SidecarDeployment{name: auxDep}, "", "")
+		}
+		return nil, fmt.Errorf("StartAuxiliaryContainer: %s: %w", name, err)
+	}
+	if dep.Auxiliary == nil {
+		dep.Auxiliary = make(map[string]*SidecarDeployment)
+	}
+	dep.Auxiliary[name] = auxDep
+	d.log("auxiliary %s (%s)\n", name, auxDep.ContainerID)
+	return auxDep, nil
+}
+
+// destroySidecars removes the sidecars of a homeserver, writing their logs to the artifacts of the test
+// if `testName` is set.
+func (d *Deployer) destroySidecars(hsName string, sidecars map[string]*SidecarDeployment, testName string) {
+	d.removeContainers(sidecars, testName, hsName+"-")
+}
+
+// removeContainers removes sidecar or auxiliary containers, writing their logs to the artifacts of the
+// test as $logPrefix$name.log if `testName` is set.
+func (d *Deployer) removeContainers(containers map[string]*SidecarDeployment, testName, logPrefix string) {
+	for name, scDep := range containers {
+		if testName != "" {
+			d.writeLogArtifact(scDep.ContainerID, testName, logPrefix+name)
+		}
+		err := d.Docker.ContainerRemove(context.Background(), scDep.ContainerID, container.RemoveOptions{
+			Force: true,
+		})
+		if err != nil {
+			log.Printf("Destroy: Failed to remove container %s : %s\n", scDep.ContainerID, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/turn"
+)
+
+// TURNSharedSecret is the shared secret homeservers must use to generate TURN credentials.
+const TURNSharedSecret = "complement"
+
+// TURNDeployment represents a running coturn container.
+type TURNDeployment struct {
+	ContainerID string
+	// The turn: URIs of the server, which are accessible from the host.
+	URIs []string
+	// The docker networks the container is attached to, where it can be reached at `turn`.
+	Networks []string
+}
+
+// connect attaches the TURN container to the network, if it is not already attached.
+func (td *TURNDeployment) connect(docker *client.Client, networkName string) error {
+	for _, nw := range td.Networks {
+		if nw == networkName {
+			return nil
+		}
+	}
+	err := docker.NetworkConnect(context.Background(), networkName, td.ContainerID, &network.EndpointSettings{
+		Aliases: []string{"turn"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to connect TURN container %s to network %s: %w", td.ContainerID, networkName, err)
+	}
+	td.Networks = append(td.Networks, networkName)
+	return nil
+}
+
+// Env returns the environment variables which tell a homeserver how to use this TURN server.
+func (td *TURNDeployment) Env() []string {
+	return []string{
+		"COMPLEMENT_TURN_URIS=" + strings.Join(td.URIs, " "),
+		"COMPLEMENT_TURN_SHARED_SECRET=" + TURNSharedSecret,
+	}
+}
+
+// deployTURN runs a coturn container on the given network, with the listening port published on the
+// host so clients in tests can allocate relays.
+func deployTURN(docker *client.Client, cfg *config.Complement, containerName, networkName string) (*TURNDeployment, error) {
+	ctx := context.Background()
+	if err := pullImageIfNotExists(ctx, docker, cfg.TURNImage); err != nil {
+		return nil, fmt.Errorf("deployTURN: %w", err)
+	}
+
+	ports := []nat.Port{"3478/udp", "3478/tcp"}
+	exposedPorts := nat.PortSet{}
+	portBindings := nat.PortMap{}
+	for _, port := range ports {
+		exposedPorts[port] = struct{}{}
+		// an empty HostPort picks a random high-numbered port
+		portBindings[port] = []nat.PortBinding{{HostIP: cfg.HSPortBindingIP}}
+	}
+	body, err := docker.ContainerCreate(ctx, &container.Config{
+		Image: cfg.TURNImage,
+		Cmd: []string{
+			"-n", "--log-file=stdout", "--no-cli", "--no-tls", "--no-dtls",
+			"--listening-port=3478", "--min-port=49160", "--max-port=49200",
+			"--use-auth-secret", "--static-auth-secret=" + TURNSharedSecret, "--realm=complement",
+		},
+		ExposedPorts: exposedPorts,
+		Labels: map[string]string{
+			complementLabel:  "turn",
+			"complement_pkg": cfg.PackageNamespace,
+		},
+	}, &container.HostConfig{
+		PortBindings: portBindings,
+	}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			networkName: {
+				Aliases: []string{"turn"},
+			},
+		},
+	}, nil, containerName)
+	if err != nil {
+		return nil, fmt.Errorf("deployTURN: ContainerCreate: %w", err)
+	}
+	td := &TURNDeployment{
+		ContainerID: body.ID,
+		Networks:    []string{networkName},
+	}
+	if err = docker.ContainerStart(ctx, td.ContainerID, container.StartOptions{}); err != nil {
+		return td, fmt.Errorf("deployTURN: ContainerStart: %w", err)
+	}
+	inspect, err := docker.ContainerInspect(ctx, td.ContainerID)
+	if err != nil {
+		return td, fmt.Errorf("deployTURN: ContainerInspect: %w", err)
+	}
+	for _, port := range ports {
+		bindings := inspect.NetworkSettings.Ports[port]
+		if len(bindings) == 0 {
+			return td, fmt.Errorf("deployTURN: port %s is not published: %+v", port, inspect.NetworkSettings.Ports)
+		}
+		td.URIs = append(td.URIs, fmt.Sprintf("turn:%s:%s?transport=%s", cfg.HSPortBindingIP, bindings[0].HostPort, port.Proto()))
+	}
+
+	// wait until the server responds to STUN binding requests
+	stopTime := time.Now().Add(cfg.SpawnHSTimeout)
+	proto, addr, err := turn.ParseURI(td.URIs[0])
+	if err != nil {
+		return td, fmt.Errorf("deployTURN: %w", err)
+	}
+	for {
+		_, err = turn.Ping(proto, addr, time.Second)
+		if err == nil {
+			break
+		}
+		if time.Now().After(stopTime) {
+			return td, fmt.Errorf("deployTURN: server did not respond within %v: %w", cfg.SpawnHSTimeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return td, nil
+}
+
+// pullImageIfNotExists pulls the image unless it already exists locally.
+func pullImageIfNotExists(ctx context.Context, docker *client.Client, imageURI string) error {
+	if _, err := docker.ImageInspect(ctx, imageURI); err == nil {
+		return nil
+	}
+	log.Printf("Pulling image %s", imageURI)
+	reader, err := docker.ImagePull(ctx, imageURI, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", imageURI, err)
+	}
+	// the pull completes when the progress stream ends
+	_, err = io.Copy(io.Discard, reader)
+	reader.Close()
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", imageURI, err)
+	}
+	return nil
+}
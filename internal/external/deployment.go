@@ -0,0 +1,203 @@
+// Package external implements deployments which attach to already-running homeservers rather than
+// deploying containers, configured via COMPLEMENT_EXTERNAL_HOMESERVERS.
+package external
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Deployment is a set of externally provided homeservers, named hs1, hs2, etc in the order they
+// were configured. As the homeservers are not owned by Complement, they are never modified beyond
+// what tests do via the APIs, and operations which need control over the servers skip the test.
+type Deployment struct {
+	Config *config.Complement
+	HS     map[string]config.ExternalHomeserver
+	// The registration shared secret of the homeservers, used to register users.
+	SharedSecret string
+	// A random prefix for all users registered by this deployment, as the homeservers may already
+	// have users from previous runs.
+	localpartPrefix  string
+	localpartCounter atomic.Int64
+}
+
+// NewDeployment returns a deployment for the first `numServers` external homeservers, or an error
+// if fewer homeservers are configured.
+func NewDeployment(cfg *config.Complement, numServers int) (*Deployment, error) {
+	if numServers > len(cfg.ExternalHomeservers) {
+		return nil, fmt.Errorf("%d homeservers required but only %d external homeservers are configured", numServers, len(cfg.ExternalHomeservers))
+	}
+	return NewDeploymentForServers(cfg, cfg.ExternalHomeservers[:numServers], cfg.ExternalSharedSecret)
+}
+
+// NewDeploymentForServers returns a deployment for the given homeservers, named hs1, hs2, etc in
+// order, which have the given registration shared secret. This is used by deployers which start
+// homeservers themselves but cannot otherwise control them, e.g in Kubernetes.
+func NewDeploymentForServers(cfg *config.Complement, servers []config.ExternalHomeserver, sharedSecret string) (*Deployment, error) {
+	prefix := make([]byte, 4)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate localpart prefix: %w", err)
+	}
+	d := &Deployment{
+		Config:          cfg,
+		HS:              make(map[string]config.ExternalHomeserver, len(servers)),
+		SharedSecret:    sharedSecret,
+		localpartPrefix: "complement-" + hex.EncodeToString(prefix),
+	}
+	for i, hs := range servers {
+		d.HS[fmt.Sprintf("hs%d", i+1)] = hs
+	}
+	return d, nil
+}
+
+func (d *Deployment) homeserver(t ct.TestLike, caller, hsName string) config.ExternalHomeserver {
+	t.Helper()
+	hs, ok := d.HS[hsName]
+	if !ok {
+		ct.Fatalf(t, "%s: HS name '%s' not found", caller, hsName)
+	}
+	return hs
+}
+
+func (d *Deployment) newClient(t ct.TestLike, hsName string, hs config.ExternalHomeserver) *client.CSAPI {
+	t.Helper()
+	return client.NewCSAPI(client.CSAPIOpts{
+		BaseURL:          hs.BaseURL,
+		Client:           client.NewLoggedClient(t, hsName, nil),
+		SyncUntilTimeout: 5 * time.Second,
+		Debug:            d.Config.DebugLoggingEnabled,
+	})
+}
+
+func (d *Deployment) GetFullyQualifiedHomeserverName(t ct.TestLike, hsName string) spec.ServerName {
+	t.Helper()
+	return spec.ServerName(d.homeserver(t, "Deployment.GetFullyQualifiedHomeserverName", hsName).ServerName)
+}
+
+func (d *Deployment) UnauthenticatedClient(t ct.TestLike, hsName string) *client.CSAPI {
+	t.Helper()
+	return d.newClient(t, hsName, d.homeserver(t, "Deployment.UnauthenticatedClient", hsName))
+}
+
+// Register a new user using the shared secret registration API, as external homeservers often
+// do not allow open registration.
+func (d *Deployment) Register(t ct.TestLike, hsName string, opts helpers.RegistrationOpts) *client.CSAPI {
+	t.Helper()
+	c := d.newClient(t, hsName, d.homeserver(t, "Deployment.Register", hsName))
+	if d.SharedSecret == "" {
+		t.Skipf("Deployment.Register: COMPLEMENT_EXTERNAL_SHARED_SECRET is not set, cannot register users")
+	}
+	password := opts.Password
+	if password == "" {
+		password = "complement_meets_min_password_req"
+	}
+	c.Password = password
+	localpart := fmt.Sprintf("%s-user-%v", d.localpartPrefix, d.localpartCounter.Add(1))
+	if opts.LocalpartSuffix != "" {
+		localpart += fmt.Sprintf("-%s", opts.LocalpartSuffix)
+	}
+	c.UserID, c.AccessToken, c.DeviceID = c.RegisterSharedSecretWith(t, d.SharedSecret, localpart, password, opts.IsAdmin)
+	return c
+}
+
+func (d *Deployment) Login(t ct.TestLike, hsName string, existing *client.CSAPI, opts helpers.LoginOpts) *client.CSAPI {
+	t.Helper()
+	password := existing.Password
+	if opts.Password != "" {
+		password = opts.Password
+	}
+	return d.login(t, "Deployment.Login", hsName, existing.UserID, password, opts.DeviceID)
+}
+
+func (d *Deployment) LoginUser(t ct.TestLike, hsName, userID, password string, opts helpers.LoginOpts) *client.CSAPI {
+	t.Helper()
+	password = helpers.LoginPassword(t, userID, password, opts)
+	return d.login(t, "Deployment.LoginUser", hsName, userID, password, opts.DeviceID)
+}
+
+func (d *Deployment) LoginDevices(t ct.TestLike, hsName, userID, password string, numDevices int) []*client.CSAPI {
+	t.Helper()
+	clients := make([]*client.CSAPI, numDevices)
+	for i := range clients {
+		clients[i] = d.LoginUser(t, hsName, userID, password, helpers.LoginOpts{})
+	}
+	return clients
+}
+
+func (d *Deployment) login(t ct.TestLike, caller, hsName, userID, password, deviceID string) *client.CSAPI {
+	t.Helper()
+	c := d.newClient(t, hsName, d.homeserver(t, caller, hsName))
+	helpers.MustLogin(t, c, userID, password, deviceID)
+	return c
+}
+
+func (d *Deployment) AppServiceUser(t ct.TestLike, hsName, appServiceUserID string) *client.CSAPI {
+	t.Helper()
+	skipUnsupported(t, "AppServiceUser")
+	return nil
+}
+
+func (d *Deployment) Restart(t ct.TestLike) error {
+	t.Helper()
+	skipUnsupported(t, "Restart")
+	return nil
+}
+
+func (d *Deployment) StopServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	skipUnsupported(t, "StopServer")
+}
+
+func (d *Deployment) StartServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	skipUnsupported(t, "StartServer")
+}
+
+func (d *Deployment) PauseServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	skipUnsupported(t, "PauseServer")
+}
+
+func (d *Deployment) UnpauseServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	skipUnsupported(t, "UnpauseServer")
+}
+
+func (d *Deployment) ContainerID(t ct.TestLike, hsName string) string {
+	t.Helper()
+	skipUnsupported(t, "ContainerID")
+	return ""
+}
+
+// Destroy does nothing, as the homeservers are not owned by Complement.
+func (d *Deployment) Destroy(t ct.TestLike) {}
+
+func (d *Deployment) GetConfig() *config.Complement {
+	return d.Config
+}
+
+// RoundTripper returns the default transport, as external homeservers are reachable by their real addresses.
+func (d *Deployment) RoundTripper() http.RoundTripper {
+	return http.DefaultTransport
+}
+
+// Network returns "" as external homeservers are not on a docker network.
+func (d *Deployment) Network() string {
+	return ""
+}
+
+func skipUnsupported(t ct.TestLike, op string) {
+	t.Helper()
+	t.Skipf("Deployment.%s is not supported by deployments of external homeservers", op)
+}
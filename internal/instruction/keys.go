@@ -0,0 +1,75 @@
+package instruction
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/curve25519"
+)
+
+// generateKeys returns signed device keys and `otkCount` signed curve25519 one-time keys for the device.
+// The curve25519 identity key is random bytes rather than a real key, as it is never used for Olm.
+func generateKeys(userID, deviceID string, otkCount int) (deviceKeys, oneTimeKeys map[string]interface{}, err error) {
+	ed25519PubKey, ed25519PrivKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ed25519 key: %w", err)
+	}
+	curveKey := make([]byte, 32)
+	if _, err = rand.Read(curveKey); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate curve25519 key: %w", err)
+	}
+	ed25519KeyID := "ed25519:" + deviceID
+	sign := func(input map[string]interface{}) error {
+		inputJSON, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		inputJSON, err = gomatrixserverlib.CanonicalJSON(inputJSON)
+		if err != nil {
+			return err
+		}
+		input["signatures"] = map[string]interface{}{
+			userID: map[string]interface{}{
+				ed25519KeyID: base64.RawStdEncoding.EncodeToString(ed25519.Sign(ed25519PrivKey, inputJSON)),
+			},
+		}
+		return nil
+	}
+
+	deviceKeys = map[string]interface{}{
+		"user_id":    userID,
+		"device_id":  deviceID,
+		"algorithms": []interface{}{"m.olm.v1.curve25519-aes-sha2", "m.megolm.v1.aes-sha2"},
+		"keys": map[string]interface{}{
+			ed25519KeyID:             base64.RawStdEncoding.EncodeToString(ed25519PubKey),
+			"curve25519:" + deviceID: base64.RawStdEncoding.EncodeToString(curveKey),
+		},
+	}
+	if err = sign(deviceKeys); err != nil {
+		return nil, nil, fmt.Errorf("failed to sign device keys: %w", err)
+	}
+
+	oneTimeKeys = make(map[string]interface{})
+	for i := 0; i < otkCount; i++ {
+		privateKey := make([]byte, 32)
+		if _, err = rand.Read(privateKey); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate one-time key: %w", err)
+		}
+		pubKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate one-time key: %w", err)
+		}
+		keyMap := map[string]interface{}{
+			"key": base64.RawStdEncoding.EncodeToString(pubKey),
+		}
+		if err = sign(keyMap); err != nil {
+			return nil, nil, fmt.Errorf("failed to sign one-time key: %w", err)
+		}
+		oneTimeKeys[fmt.Sprintf("signed_curve25519:%d", i)] = keyMap
+	}
+	return deviceKeys, oneTimeKeys, nil
+}
@@ -100,6 +100,22 @@ func (r *Runner) AccessTokens(hsDomain string) map[string]string {
 	return res
 }
 
+// MediaURIs returns the MXC URIs of all media uploaded on the given HS domain.
+// Returns a map of media ref => mxc URI
+func (r *Runner) MediaURIs(hsDomain string) map[string]string {
+	res := make(map[string]string)
+	prefix := "media_" + hsDomain + "/"
+	r.lookup.Range(func(k, v interface{}) bool {
+		key := k.(string)
+		val := v.(string)
+		if strings.HasPrefix(key, prefix) {
+			res[strings.TrimPrefix(key, prefix)] = val
+		}
+		return true
+	})
+	return res
+}
+
 // DeviceIDs returns the device ids for all users who were created on the given HS domain.
 // Returns a map of user_id => device_id
 func (r *Runner) DeviceIDs(hsDomain string) map[string]string {
@@ -150,41 +166,50 @@ func (r *Runner) RunInstructions(opts RunOpts, instrs []Instr) (resErr error) {
 }
 
 // Run all instructions until completion. Return an error if there was a problem executing any instruction.
-func (r *Runner) Run(hs b.Homeserver, hsURL string) (resErr error) {
-	userInstrSets := calculateUserInstructionSets(r, hs)
-	var wg sync.WaitGroup
-	wg.Add(len(userInstrSets))
-	for _, set := range userInstrSets {
-		go func(s []instruction) {
-			defer wg.Done()
-			err := r.runInstructionSet(fmt.Sprintf("%s.%s", r.blueprintName, hs.Name), hsURL, s)
-			if err != nil {
-				r.log("Instruction set failed: %s", err)
-				resErr = err
-				r.terminate.Store(true)
-			}
-		}(set)
+func (r *Runner) Run(hs b.Homeserver, hsURL string) error {
+	if err := r.RunUsers(hs, hsURL); err != nil {
+		return err
 	}
-	// wait for all users to be made before creating rooms
-	wg.Wait()
-	if resErr != nil {
-		r.log("Terminating: user creation failed: %s", resErr)
-		return resErr
+	return r.RunRooms(hs, hsURL)
+}
+
+// RunUsers runs the instructions which create the users of the homeserver, and their account data, media
+// and keys. Users do not depend on other homeservers, so users can be created on several homeservers at
+// once.
+func (r *Runner) RunUsers(hs b.Homeserver, hsURL string) error {
+	err := r.runInstructionSets(hs, hsURL, calculateUserInstructionSets(r, hs))
+	if err != nil {
+		r.log("Terminating: user creation failed: %s", err)
 	}
-	roomInstrSets := calculateRoomInstructionSets(r, hs)
-	wg.Add(len(roomInstrSets))
-	for _, set := range roomInstrSets {
+	return err
+}
+
+// RunRooms runs the instructions which create and join the rooms of the homeserver. The users of the
+// homeserver must have been created with RunUsers first. Rooms which are joined via a Ref can only be
+// run once the homeserver which creates the room has run its rooms.
+func (r *Runner) RunRooms(hs b.Homeserver, hsURL string) error {
+	return r.runInstructionSets(hs, hsURL, calculateRoomInstructionSets(r, hs))
+}
+
+// runInstructionSets runs the sets concurrently until they all complete. Terminates the runner if any
+// set fails.
+func (r *Runner) runInstructionSets(hs b.Homeserver, hsURL string, sets [][]instruction) (resErr error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wg.Add(len(sets))
+	for _, set := range sets {
 		go func(s []instruction) {
 			defer wg.Done()
 			err := r.runInstructionSet(fmt.Sprintf("%s.%s", r.blueprintName, hs.Name), hsURL, s)
 			if err != nil {
 				r.log("Instruction set failed: %s", err)
+				mu.Lock()
 				resErr = err
+				mu.Unlock()
 				r.terminate.Store(true)
 			}
 		}(set)
 	}
-	// wait for all rooms to be made before returning from this function
 	wg.Wait()
 	return resErr
 }
@@ -268,6 +293,11 @@ func (r *Runner) next(instrs []instruction, hsURL string, i int) (*http.Request,
 	i++
 
 	var body io.Reader
+	contentType := "application/json"
+	if instr.rawBody != nil {
+		body = bytes.NewReader(instr.rawBody)
+		contentType = instr.contentType
+	}
 	if instr.body == nil && instr.bodyFn != nil {
 		instr.body = instr.bodyFn(r.lookup)
 	}
@@ -286,8 +316,8 @@ func (r *Runner) next(instrs []instruction, hsURL string, i int) (*http.Request,
 	}
 
 	if body != nil {
-		// all bodies, if set, are JSON encoded
-		req.Header["Content-Type"] = []string{"application/json"}
+		// all bodies, if set, are JSON encoded unless they are raw bodies
+		req.Header["Content-Type"] = []string{contentType}
 	}
 
 	q := req.URL.Query()
@@ -382,6 +412,9 @@ type instruction struct {
 	storeResponse map[string]string
 	// Optional: A function to create the request body from the lookup map provided. Only used if `body` is <nil>.
 	bodyFn func(lk *sync.Map) interface{}
+	// Optional: A raw request body to send with the given content type, rather than JSON. Used for media uploads.
+	rawBody     []byte
+	contentType string
 }
 
 // url returns the complete path resolved url for this instruction. Query parameters must be
@@ -424,8 +457,21 @@ func calculateUserInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 			if user.DisplayName != "" {
 				instrs = append(instrs, instructionDisplayName(hs, user))
 			}
+			if user.AvatarURL != "" {
+				instrs = append(instrs, instructionAvatarURL(hs, user))
+			}
+			for _, ad := range user.AccountData {
+				instrs = append(instrs, instructionAccountData(hs, user, ad))
+			}
+			for _, m := range user.Media {
+				instrs = append(instrs, instructionUploadMedia(hs, user, m))
+			}
 		}
 		createdUsers[user.Localpart] = true
+		// keys are uploaded per-device, so do this after logging in as well
+		if user.E2E != nil {
+			instrs = append(instrs, instructionUploadKeys(hs, user))
+		}
 
 		sets[i] = instrs
 	}
@@ -448,9 +494,15 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 		// that the HS has fully joined the room before returning.
 		var joiningSender = ""
 
+		// rooms are keyed per homeserver, as the rooms of several homeservers may be created at once
+		roomKey := fmt.Sprintf("room_%s_%d", hs.Name, roomIndex)
+		roomIDLookup := "." + roomKey
+		if room.Ref != "" {
+			roomIDLookup = fmt.Sprintf(".room_ref_%s", room.Ref)
+		}
 		if room.Creator != "" {
 			storeRes := map[string]string{
-				fmt.Sprintf("room_%d", roomIndex): ".room_id",
+				roomKey: ".room_id",
 			}
 			if room.Ref != "" {
 				storeRes[fmt.Sprintf("room_ref_%s", room.Ref)] = ".room_id"
@@ -476,12 +528,9 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 			method := "PUT"
 			var path string
 			subs := map[string]string{
-				"$roomId":    fmt.Sprintf(".room_%d", roomIndex),
+				"$roomId":    roomIDLookup,
 				"$eventType": event.Type,
 			}
-			if room.Ref != "" {
-				subs["$roomId"] = fmt.Sprintf(".room_ref_%s", room.Ref)
-			}
 			if event.StateKey != nil {
 				path = "/_matrix/client/v3/rooms/$roomId/state/$eventType/$stateKey"
 				subs["$stateKey"] = *event.StateKey
@@ -529,7 +578,7 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 				// keep a ref to the current room index so it's correct when bodyFn is called
 				alias, ok := event.Content["alias"].(string)
 				if ok {
-					ri := roomIndex
+					rk := roomKey
 					instrs = append(instrs, instruction{
 						method:        "PUT",
 						path:          "/_matrix/client/v3/directory/room/" + url.PathEscape(alias),
@@ -537,7 +586,7 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 						substitutions: subs,
 						queryParams:   queryParams,
 						bodyFn: func(lk *sync.Map) interface{} {
-							val, _ := lk.Load(fmt.Sprintf("room_%d", ri))
+							val, _ := lk.Load(rk)
 							return map[string]interface{}{
 								"room_id": val,
 							}
@@ -564,7 +613,7 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 				path:        "/_matrix/client/v3/rooms/$roomId/members",
 				accessToken: "user_" + joiningSender,
 				substitutions: map[string]string{
-					"$roomId": fmt.Sprintf(".room_%d", roomIndex),
+					"$roomId": roomIDLookup,
 				},
 				body: map[string]interface{}{},
 			})
@@ -579,7 +628,7 @@ func calculateRoomInstructionSets(r *Runner, hs b.Homeserver) [][]instruction {
 func instructionRegister(hs b.Homeserver, user b.User) instruction {
 	body := map[string]interface{}{
 		"username": user.Localpart,
-		"password": "complement_meets_min_pasword_req_" + user.Localpart,
+		"password": b.UserPassword(user.Localpart),
 		"auth": map[string]string{
 			"type": "m.login.dummy",
 		},
@@ -616,11 +665,79 @@ func instructionDisplayName(hs b.Homeserver, user b.User) instruction {
 	}
 }
 
+func instructionAvatarURL(hs b.Homeserver, user b.User) instruction {
+	return instruction{
+		method: "PUT",
+		path: fmt.Sprintf(
+			"/_matrix/client/v3/profile/@%s:%s/avatar_url",
+			user.Localpart, hs.Name,
+		),
+		accessToken: fmt.Sprintf("user_@%s:%s", user.Localpart, hs.Name),
+		body: map[string]interface{}{
+			"avatar_url": user.AvatarURL,
+		},
+	}
+}
+
+func instructionAccountData(hs b.Homeserver, user b.User, ad b.AccountData) instruction {
+	return instruction{
+		method: "PUT",
+		path: fmt.Sprintf(
+			"/_matrix/client/v3/user/@%s:%s/account_data/%s",
+			user.Localpart, hs.Name, url.PathEscape(ad.Type),
+		),
+		accessToken: fmt.Sprintf("user_@%s:%s", user.Localpart, hs.Name),
+		body:        ad.Value,
+	}
+}
+
+func instructionUploadMedia(hs b.Homeserver, user b.User, m b.Media) instruction {
+	contentType := m.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return instruction{
+		method:      "POST",
+		path:        "/_matrix/media/v3/upload",
+		accessToken: fmt.Sprintf("user_@%s:%s", user.Localpart, hs.Name),
+		rawBody:     m.Data,
+		contentType: contentType,
+		storeResponse: map[string]string{
+			"media_" + hs.Name + "/" + m.Ref: ".content_uri",
+		},
+	}
+}
+
+// instructionUploadKeys uploads device keys and one-time keys for the user's current device. The keys
+// are generated when the instruction runs, as the device ID is not known until then.
+func instructionUploadKeys(hs b.Homeserver, user b.User) instruction {
+	userID := fmt.Sprintf("@%s:%s", user.Localpart, hs.Name)
+	return instruction{
+		method:      "POST",
+		path:        "/_matrix/client/v3/keys/upload",
+		accessToken: "user_" + userID,
+		bodyFn: func(lk *sync.Map) interface{} {
+			deviceID, _ := lk.Load("device_" + userID)
+			deviceIDStr, _ := deviceID.(string)
+			deviceKeys, oneTimeKeys, err := generateKeys(userID, deviceIDStr, user.E2E.OneTimeKeys)
+			if err != nil {
+				// sending no body will be rejected by the server and reported as a failed instruction
+				log.Printf("failed to generate keys for %s: %s", userID, err)
+				return nil
+			}
+			return map[string]interface{}{
+				"device_keys":   deviceKeys,
+				"one_time_keys": oneTimeKeys,
+			}
+		},
+	}
+}
+
 func instructionLogin(hs b.Homeserver, user b.User) instruction {
 	body := map[string]interface{}{
 		"type":     "m.login.password",
 		"user":     user.Localpart,
-		"password": "complement_meets_min_pasword_req_" + user.Localpart,
+		"password": b.UserPassword(user.Localpart),
 		"auth": map[string]string{
 			"type": "m.login.dummy",
 		},
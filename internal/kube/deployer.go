@@ -0,0 +1,326 @@
+// Package kube deploys homeservers as pods in a Kubernetes namespace by shelling out to `kubectl`,
+// for environments which have cluster access but no Docker daemon. It is configured via
+// COMPLEMENT_KUBE_NAMESPACE.
+package kube
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/complement/config"
+)
+
+const (
+	// the path the Complement CA is mounted at, as in Docker deployments
+	mountCAPath = "/complement/ca"
+
+	labelPkg        = "complement_pkg"
+	labelDeployment = "complement_deployment"
+)
+
+// Deployer creates pods, services and secrets in COMPLEMENT_KUBE_NAMESPACE. All resources are labelled
+// with the package namespace and deployment ID so they can be cleaned up.
+type Deployer struct {
+	config *config.Complement
+	// a random ID for this run, so concurrent runs in the same kubernetes namespace do not clash
+	runID   string
+	counter atomic.Uint64
+}
+
+// NewDeployer returns a deployer for the kubernetes namespace in the config, after checking that
+// kubectl can reach the cluster.
+func NewDeployer(cfg *config.Complement) (*Deployer, error) {
+	runID := make([]byte, 3)
+	if _, err := rand.Read(runID); err != nil {
+		return nil, fmt.Errorf("failed to generate run ID: %w", err)
+	}
+	d := &Deployer{
+		config: cfg,
+		runID:  hex.EncodeToString(runID),
+	}
+	if _, err := d.kubectl(context.Background(), nil, "get", "pods", "--limit=1"); err != nil {
+		return nil, fmt.Errorf("cannot access kubernetes namespace %s: %w", cfg.KubeNamespace, err)
+	}
+	return d, nil
+}
+
+// Deploy starts `numServers` homeservers from the base images and waits for them to be ready.
+func (d *Deployer) Deploy(ctx context.Context, numServers int) (*Deployment, error) {
+	dep := &Deployment{
+		Deployer: d,
+		ID:       fmt.Sprintf("complement-%s-%d", d.runID, d.counter.Add(1)),
+	}
+	if err := d.createCASecret(ctx, dep); err != nil {
+		return dep, err
+	}
+	for i := 1; i <= numServers; i++ {
+		hs, err := d.deployServer(ctx, dep, fmt.Sprintf("hs%d", i))
+		if hs != nil {
+			dep.Servers = append(dep.Servers, hs)
+		}
+		if err != nil {
+			return dep, err
+		}
+	}
+	return dep, dep.attach(d.config)
+}
+
+// Destroy deletes everything created for the deployment, printing homeserver logs first if
+// `printServerLogs` is true.
+func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, hs := range dep.Servers {
+		if printServerLogs {
+			logs, err := d.kubectl(ctx, nil, "logs", "pod/"+hs.Name)
+			if err != nil {
+				log.Printf("%s: failed to get logs: %s", hs.Name, err)
+			}
+			log.Printf("============================================\n\n\n")
+			log.Printf("Server logs:\n")
+			log.Printf("%s\n", logs)
+			log.Printf("============== %s : END LOGS ==============\n\n\n", hs.Name)
+		}
+		hs.stopPortForward()
+	}
+	if _, err := d.kubectl(ctx, nil, "delete", "pods,services,secrets", "--wait=false", "-l", labelDeployment+"="+dep.ID); err != nil {
+		log.Printf("%s: failed to delete deployment: %s", dep.ID, err)
+	}
+}
+
+// Cleanup deletes everything created by this run of the package.
+func (d *Deployer) Cleanup() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	selector := fmt.Sprintf("%s=%s,complement_run=%s", labelPkg, d.pkgLabel(), d.runID)
+	if _, err := d.kubectl(ctx, nil, "delete", "pods,services,secrets", "--wait=false", "-l", selector); err != nil {
+		log.Printf("failed to clean up kubernetes resources: %s", err)
+	}
+}
+
+func (d *Deployer) createCASecret(ctx context.Context, dep *Deployment) error {
+	certBytes, err := d.config.CACertificateBytes()
+	if err != nil {
+		return fmt.Errorf("failed to get CA certificate: %s", err)
+	}
+	keyBytes, err := d.config.CAPrivateKeyBytes()
+	if err != nil {
+		return fmt.Errorf("failed to get CA key: %s", err)
+	}
+	return d.apply(ctx, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   d.metadata(dep.ID+"-ca", dep, ""),
+		// encoding/json base64-encodes []byte, as kubernetes expects
+		"data": map[string][]byte{
+			"ca.crt": certBytes,
+			"ca.key": keyBytes,
+		},
+	})
+}
+
+// deployServer creates a pod for the homeserver and a service whose name is the server name, so
+// homeservers in the namespace can federate with each other.
+func (d *Deployer) deployServer(ctx context.Context, dep *Deployment, hsName string) (*Server, error) {
+	image := d.config.BaseImageURI
+	if img, ok := d.config.BaseImageURIs[hsName]; ok {
+		image = img
+	}
+	hs := &Server{
+		HSName: hsName,
+		Name:   dep.ID + "-" + hsName,
+	}
+	err := d.apply(ctx, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   d.metadata(hs.Name, dep, hsName),
+		"spec": map[string]interface{}{
+			"restartPolicy": "Never",
+			"containers": []interface{}{
+				map[string]interface{}{
+					"name":  "homeserver",
+					"image": image,
+					"env": []interface{}{
+						map[string]string{"name": "SERVER_NAME", "value": hs.Name},
+					},
+					"ports": []interface{}{
+						map[string]int{"containerPort": 8008},
+						map[string]int{"containerPort": 8448},
+					},
+					"volumeMounts": []interface{}{
+						map[string]interface{}{"name": "ca", "mountPath": mountCAPath, "readOnly": true},
+					},
+				},
+			},
+			"volumes": []interface{}{
+				map[string]interface{}{"name": "ca", "secret": map[string]string{"secretName": dep.ID + "-ca"}},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = d.apply(ctx, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   d.metadata(hs.Name, dep, hsName),
+		"spec": map[string]interface{}{
+			"selector": map[string]string{"complement_pod": hs.Name},
+			"ports": []interface{}{
+				map[string]interface{}{"name": "client", "port": 8008},
+				map[string]interface{}{"name": "federation", "port": 8448},
+			},
+		},
+	})
+	if err != nil {
+		return hs, err
+	}
+
+	timeout := fmt.Sprintf("--timeout=%ds", int(d.config.SpawnHSTimeout.Seconds()))
+	if _, err = d.kubectl(ctx, nil, "wait", "--for=condition=Ready", "pod/"+hs.Name, timeout); err != nil {
+		return hs, fmt.Errorf("%s: pod did not become ready: %w", hs.Name, err)
+	}
+	if err = d.portForward(hs); err != nil {
+		return hs, err
+	}
+	if err = waitForVersions(ctx, hs.BaseURL, d.config.ReadinessProbeFor(image)); err != nil {
+		return hs, fmt.Errorf("%s: %w", hs.Name, err)
+	}
+	return hs, nil
+}
+
+var forwardingRegex = regexp.MustCompile(`Forwarding from 127\.0\.0\.1:(\d+) -> 8008`)
+
+// portForward forwards a random local port to the client API of the homeserver, for the lifetime
+// of the deployment.
+func (d *Deployer) portForward(hs *Server) error {
+	cmd := exec.Command("kubectl", d.args("port-forward", "pod/"+hs.Name, ":8008")...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("%s: failed to start port-forward: %w", hs.Name, err)
+	}
+	hs.portForward = cmd
+	portCh := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if m := forwardingRegex.FindStringSubmatch(scanner.Text()); m != nil {
+				portCh <- m[1]
+				break
+			}
+		}
+		close(portCh)
+		// keep draining so kubectl does not block writing to stdout
+		io.Copy(io.Discard, stdout)
+	}()
+	select {
+	case port, ok := <-portCh:
+		if !ok {
+			return fmt.Errorf("%s: port-forward exited before forwarding", hs.Name)
+		}
+		hs.BaseURL = "http://127.0.0.1:" + port
+		return nil
+	case <-time.After(d.config.SpawnHSTimeout):
+		return fmt.Errorf("%s: timed out waiting for port-forward", hs.Name)
+	}
+}
+
+func (d *Deployer) metadata(name string, dep *Deployment, hsName string) map[string]interface{} {
+	labels := map[string]string{
+		labelPkg:         d.pkgLabel(),
+		labelDeployment:  dep.ID,
+		"complement_run": d.runID,
+	}
+	if hsName != "" {
+		labels["complement_hs_name"] = hsName
+		labels["complement_pod"] = name
+	}
+	return map[string]interface{}{
+		"name":   name,
+		"labels": labels,
+	}
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// pkgLabel returns the package namespace as a valid label value.
+func (d *Deployer) pkgLabel() string {
+	label := invalidLabelChars.ReplaceAllString(strings.ToLower(d.config.PackageNamespace), "-")
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return strings.Trim(label, "-")
+}
+
+func (d *Deployer) apply(ctx context.Context, manifest map[string]interface{}) error {
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	_, err = d.kubectl(ctx, bytes.NewReader(body), "apply", "-f", "-")
+	return err
+}
+
+// args returns the arguments to kubectl to run the command in the configured context and namespace.
+func (d *Deployer) args(args ...string) []string {
+	prefix := []string{"--namespace", d.config.KubeNamespace}
+	if d.config.KubeContext != "" {
+		prefix = append(prefix, "--context", d.config.KubeContext)
+	}
+	return append(prefix, args...)
+}
+
+func (d *Deployer) kubectl(ctx context.Context, stdin io.Reader, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "kubectl", d.args(args...)...)
+	cmd.Stdin = stdin
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if d.config.DebugLoggingEnabled {
+		log.Printf("kubectl %v", args)
+	}
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("kubectl %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// waitForVersions waits until the readiness probe (by default /versions) of the homeserver succeeds.
+func waitForVersions(ctx context.Context, baseURL string, probe config.ReadinessProbe) error {
+	httpClient := &http.Client{Timeout: time.Second}
+	deadline := time.Now().Add(probe.Timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		req, err := http.NewRequestWithContext(ctx, "GET", baseURL+probe.Path, nil)
+		if err != nil {
+			return err
+		}
+		res, err := httpClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if probe.StatusCode == 0 || res.StatusCode == probe.StatusCode {
+				return nil
+			}
+			err = fmt.Errorf("%s returned HTTP %d, want HTTP %d", probe.Path, res.StatusCode, probe.StatusCode)
+		}
+		lastErr = err
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("homeserver not ready after %v: %v", probe.Timeout, lastErr)
+}
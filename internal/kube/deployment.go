@@ -0,0 +1,62 @@
+package kube
+
+import (
+	"os/exec"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/external"
+)
+
+// Deployment is a set of homeservers running as pods. Clients talk to the homeservers through
+// `kubectl port-forward`, and the homeservers talk to each other through services.
+type Deployment struct {
+	// The deployment of the homeservers as seen by tests, once they are running.
+	*external.Deployment
+	Deployer *Deployer
+	// The prefix of the names of all resources in the deployment.
+	ID      string
+	Servers []*Server
+}
+
+// Server is a homeserver running in a pod.
+type Server struct {
+	// e.g hs1
+	HSName string
+	// The name of the pod and service, which is also the server name.
+	Name string
+	// The port-forwarded client API, e.g http://127.0.0.1:38646
+	BaseURL     string
+	portForward *exec.Cmd
+}
+
+func (s *Server) stopPortForward() {
+	if s.portForward != nil && s.portForward.Process != nil {
+		s.portForward.Process.Kill()
+		s.portForward.Wait()
+	}
+}
+
+// attach creates the test-facing deployment once all servers are running.
+func (d *Deployment) attach(cfg *config.Complement) error {
+	servers := make([]config.ExternalHomeserver, len(d.Servers))
+	for i, hs := range d.Servers {
+		servers[i] = config.ExternalHomeserver{
+			ServerName: hs.Name,
+			BaseURL:    hs.BaseURL,
+		}
+	}
+	dep, err := external.NewDeploymentForServers(cfg, servers, client.SharedSecret)
+	if err != nil {
+		return err
+	}
+	d.Deployment = dep
+	return nil
+}
+
+// Destroy the deployment, printing server logs if the test failed or COMPLEMENT_ALWAYS_PRINT_SERVER_LOGS is set.
+func (d *Deployment) Destroy(t ct.TestLike) {
+	t.Helper()
+	d.Deployer.Destroy(d, d.Deployer.config.AlwaysPrintServerLogs || t.Failed())
+}
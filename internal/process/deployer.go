@@ -0,0 +1,300 @@
+// Package process runs homeservers as local processes rather than containers, so changes to a
+// homeserver can be tested without building images. It is configured via COMPLEMENT_PROCESS_COMMAND.
+package process
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/config"
+)
+
+// TemplateData is the data the config template is rendered with.
+type TemplateData struct {
+	ServerName     string
+	DataDir        string
+	ClientPort     int
+	FederationPort int
+	CACertPath     string
+	CAKeyPath      string
+	TLSCertPath    string
+	TLSKeyPath     string
+	SharedSecret   string
+}
+
+// Deployer runs homeservers with COMPLEMENT_PROCESS_COMMAND, each in its own data directory under a
+// temporary directory which is removed by Cleanup.
+type Deployer struct {
+	config   *config.Complement
+	template *template.Template
+	dir      string
+	counter  atomic.Uint64
+}
+
+// NewDeployer returns a deployer for the command and config template in the config.
+func NewDeployer(cfg *config.Complement) (*Deployer, error) {
+	d := &Deployer{config: cfg}
+	if cfg.ProcessConfigTemplate != "" {
+		tmpl, err := template.ParseFiles(cfg.ProcessConfigTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse COMPLEMENT_PROCESS_CONFIG_TEMPLATE: %w", err)
+		}
+		d.template = tmpl
+	}
+	dir, err := os.MkdirTemp("", "complement-"+cfg.PackageNamespace+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	d.dir = dir
+	certBytes, err := cfg.CACertificateBytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CA certificate: %s", err)
+	}
+	keyBytes, err := cfg.CAPrivateKeyBytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CA key: %s", err)
+	}
+	if err = os.WriteFile(d.caCertPath(), certBytes, 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write CA certificate: %w", err)
+	}
+	if err = os.WriteFile(d.caKeyPath(), keyBytes, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write CA key: %w", err)
+	}
+	return d, nil
+}
+
+func (d *Deployer) caCertPath() string {
+	return filepath.Join(d.dir, "ca.crt")
+}
+
+func (d *Deployer) caKeyPath() string {
+	return filepath.Join(d.dir, "ca.key")
+}
+
+// Deploy starts `numServers` homeservers and waits for them to be ready.
+func (d *Deployer) Deploy(ctx context.Context, numServers int) (*Deployment, error) {
+	dep := &Deployment{
+		Deployer: d,
+		ID:       fmt.Sprintf("deployment-%d", d.counter.Add(1)),
+	}
+	for i := 1; i <= numServers; i++ {
+		hs, err := d.deployServer(ctx, dep, fmt.Sprintf("hs%d", i))
+		if hs != nil {
+			dep.Servers = append(dep.Servers, hs)
+		}
+		if err != nil {
+			return dep, err
+		}
+	}
+	return dep, dep.attach(d.config)
+}
+
+func (d *Deployer) deployServer(ctx context.Context, dep *Deployment, hsName string) (*Server, error) {
+	ports, err := freePorts(2)
+	if err != nil {
+		return nil, err
+	}
+	dataDir := filepath.Join(d.dir, dep.ID, hsName)
+	if err = os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("%s: failed to create data directory: %w", hsName, err)
+	}
+	hs := &Server{
+		HSName: hsName,
+		data: TemplateData{
+			ServerName:     fmt.Sprintf("localhost:%d", ports[1]),
+			DataDir:        dataDir,
+			ClientPort:     ports[0],
+			FederationPort: ports[1],
+			CACertPath:     d.caCertPath(),
+			CAKeyPath:      d.caKeyPath(),
+			TLSCertPath:    filepath.Join(dataDir, "server.crt"),
+			TLSKeyPath:     filepath.Join(dataDir, "server.key"),
+			SharedSecret:   client.SharedSecret,
+		},
+		BaseURL: fmt.Sprintf("http://localhost:%d", ports[0]),
+	}
+	certBytes, keyBytes, err := d.config.GenerateCertificate(hs.data.ServerName)
+	if err != nil {
+		return hs, fmt.Errorf("%s: failed to generate TLS certificate: %w", hsName, err)
+	}
+	if err = os.WriteFile(hs.data.TLSCertPath, certBytes, 0o644); err != nil {
+		return hs, fmt.Errorf("%s: failed to write TLS certificate: %w", hsName, err)
+	}
+	if err = os.WriteFile(hs.data.TLSKeyPath, keyBytes, 0o600); err != nil {
+		return hs, fmt.Errorf("%s: failed to write TLS key: %w", hsName, err)
+	}
+	if d.template != nil {
+		var buf bytes.Buffer
+		if err = d.template.Execute(&buf, hs.data); err != nil {
+			return hs, fmt.Errorf("%s: failed to render config template: %w", hsName, err)
+		}
+		hs.configPath = filepath.Join(dataDir, "config"+filepath.Ext(d.config.ProcessConfigTemplate))
+		if err = os.WriteFile(hs.configPath, buf.Bytes(), 0o644); err != nil {
+			return hs, fmt.Errorf("%s: failed to write config: %w", hsName, err)
+		}
+	}
+	return hs, d.start(ctx, hs)
+}
+
+// start runs the homeserver process and waits for it to respond to /versions.
+func (d *Deployer) start(ctx context.Context, hs *Server) error {
+	logFile, err := os.OpenFile(hs.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("%s: failed to open log file: %w", hs.HSName, err)
+	}
+	defer logFile.Close()
+	cmd := exec.Command("sh", "-c", d.config.ProcessCommand)
+	cmd.Dir = hs.data.DataDir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// run in its own process group, so the whole group can be signalled
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(os.Environ(),
+		"SERVER_NAME="+hs.data.ServerName,
+		"COMPLEMENT_CONFIG="+hs.configPath,
+		"COMPLEMENT_DATA_DIR="+hs.data.DataDir,
+		"COMPLEMENT_CLIENT_PORT="+strconv.Itoa(hs.data.ClientPort),
+		"COMPLEMENT_FEDERATION_PORT="+strconv.Itoa(hs.data.FederationPort),
+		"COMPLEMENT_CA_CERT="+hs.data.CACertPath,
+		"COMPLEMENT_CA_KEY="+hs.data.CAKeyPath,
+		"COMPLEMENT_TLS_CERT="+hs.data.TLSCertPath,
+		"COMPLEMENT_TLS_KEY="+hs.data.TLSKeyPath,
+	)
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("%s: failed to start process: %w", hs.HSName, err)
+	}
+	hs.cmd = cmd
+	exited := make(chan struct{})
+	hs.exited = exited
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	if d.config.DebugLoggingEnabled {
+		log.Printf("%s: started process %d as %s", hs.HSName, cmd.Process.Pid, hs.data.ServerName)
+	}
+	return waitForVersions(ctx, hs, d.config.ReadinessProbeFor(""))
+}
+
+// stop kills the process group of the homeserver and waits for it to exit.
+func (d *Deployer) stop(hs *Server) {
+	if hs.cmd == nil || hs.cmd.Process == nil {
+		return
+	}
+	syscall.Kill(-hs.cmd.Process.Pid, syscall.SIGKILL)
+	<-hs.exited
+	hs.cmd = nil
+}
+
+// signal sends the signal to the process group of the homeserver.
+func (d *Deployer) signal(hs *Server, sig syscall.Signal) error {
+	if hs.cmd == nil || hs.cmd.Process == nil {
+		return fmt.Errorf("%s is not running", hs.HSName)
+	}
+	return syscall.Kill(-hs.cmd.Process.Pid, sig)
+}
+
+// Destroy stops the homeservers in the deployment and removes their data, printing their logs first
+// if `printServerLogs` is true.
+func (d *Deployer) Destroy(dep *Deployment, printServerLogs bool) {
+	for _, hs := range dep.Servers {
+		// paused processes cannot be killed until they are resumed
+		d.signal(hs, syscall.SIGCONT)
+		d.stop(hs)
+		if printServerLogs {
+			logs, err := os.ReadFile(hs.logPath())
+			if err != nil {
+				log.Printf("%s: failed to read logs: %s", hs.HSName, err)
+			}
+			log.Printf("============================================\n\n\n")
+			log.Printf("Server logs:\n")
+			log.Printf("%s\n", logs)
+			log.Printf("============== %s : END LOGS ==============\n\n\n", hs.HSName)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(d.dir, dep.ID)); err != nil {
+		log.Printf("%s: failed to remove data: %s", dep.ID, err)
+	}
+}
+
+// Cleanup removes the temporary directory of the deployer.
+func (d *Deployer) Cleanup() {
+	if err := os.RemoveAll(d.dir); err != nil {
+		log.Printf("failed to remove %s: %s", d.dir, err)
+	}
+}
+
+// freePorts returns `n` ports which were free when this was called.
+func freePorts(n int) ([]int, error) {
+	ports := make([]int, n)
+	for i := range ports {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("failed to find a free port: %w", err)
+		}
+		// keep listening until all ports are chosen so the same port is not returned twice
+		defer ln.Close()
+		ports[i] = ln.Addr().(*net.TCPAddr).Port
+	}
+	return ports, nil
+}
+
+// waitForVersions waits until the readiness probe (by default /versions) of the homeserver succeeds, failing
+// early if it exits.
+func waitForVersions(ctx context.Context, hs *Server, probe config.ReadinessProbe) error {
+	httpClient := &http.Client{Timeout: time.Second}
+	deadline := time.Now().Add(probe.Timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		select {
+		case <-hs.exited:
+			return fmt.Errorf("%s: process exited before it was ready, see %s", hs.HSName, hs.logPath())
+		default:
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", hs.BaseURL+probe.Path, nil)
+		if err != nil {
+			return err
+		}
+		res, err := httpClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if probe.StatusCode == 0 || res.StatusCode == probe.StatusCode {
+				return nil
+			}
+			err = fmt.Errorf("%s returned HTTP %d, want HTTP %d", probe.Path, res.StatusCode, probe.StatusCode)
+		}
+		lastErr = err
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("%s: homeserver not ready after %v: %v", hs.HSName, probe.Timeout, lastErr)
+}
+
+// Restart the homeserver, keeping its data.
+func (d *Deployer) Restart(hs *Server) error {
+	d.signal(hs, syscall.SIGCONT)
+	d.stop(hs)
+	return d.start(context.Background(), hs)
+}
+
+// Pause suspends the homeserver process.
+func (d *Deployer) Pause(hs *Server) error {
+	return d.signal(hs, syscall.SIGSTOP)
+}
+
+// Unpause resumes a homeserver suspended via Pause.
+func (d *Deployer) Unpause(hs *Server) error {
+	return d.signal(hs, syscall.SIGCONT)
+}
@@ -0,0 +1,118 @@
+package process
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/external"
+)
+
+// Deployment is a set of homeservers running as local processes. Unlike external homeservers, they
+// can be restarted and paused.
+type Deployment struct {
+	// The deployment of the homeservers as seen by tests, once they are running.
+	*external.Deployment
+	Deployer *Deployer
+	ID       string
+	Servers  []*Server
+}
+
+// Server is a homeserver running as a local process.
+type Server struct {
+	// e.g hs1
+	HSName string
+	// e.g http://localhost:38646
+	BaseURL    string
+	data       TemplateData
+	configPath string
+	cmd        *exec.Cmd
+	// closed when cmd exits
+	exited <-chan struct{}
+}
+
+func (s *Server) logPath() string {
+	return filepath.Join(s.data.DataDir, "homeserver.log")
+}
+
+// attach creates the test-facing deployment once all servers are running.
+func (d *Deployment) attach(cfg *config.Complement) error {
+	servers := make([]config.ExternalHomeserver, len(d.Servers))
+	for i, hs := range d.Servers {
+		servers[i] = config.ExternalHomeserver{
+			ServerName: hs.data.ServerName,
+			BaseURL:    hs.BaseURL,
+		}
+	}
+	dep, err := external.NewDeploymentForServers(cfg, servers, client.SharedSecret)
+	if err != nil {
+		return err
+	}
+	d.Deployment = dep
+	return nil
+}
+
+// Server returns the server for `hsName`, failing the test if it does not exist.
+func (d *Deployment) Server(t ct.TestLike, hsName string) *Server {
+	t.Helper()
+	for _, hs := range d.Servers {
+		if hs.HSName == hsName {
+			return hs
+		}
+	}
+	ct.Fatalf(t, "Deployment: HS name '%s' not found", hsName)
+	return nil
+}
+
+// Restart all homeservers, keeping their data. The client and federation ports do not change.
+func (d *Deployment) Restart(t ct.TestLike) error {
+	t.Helper()
+	for _, hs := range d.Servers {
+		if err := d.Deployer.Restart(hs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Deployment) RestartServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	if err := d.Deployer.Restart(d.Server(t, hsName)); err != nil {
+		ct.Fatalf(t, "RestartServer: %s", err)
+	}
+}
+
+func (d *Deployment) StopServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	d.Deployer.stop(d.Server(t, hsName))
+}
+
+func (d *Deployment) StartServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	if err := d.Deployer.start(context.Background(), d.Server(t, hsName)); err != nil {
+		ct.Fatalf(t, "StartServer: %s", err)
+	}
+}
+
+func (d *Deployment) PauseServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	if err := d.Deployer.Pause(d.Server(t, hsName)); err != nil {
+		ct.Fatalf(t, "PauseServer: %s", err)
+	}
+}
+
+func (d *Deployment) UnpauseServer(t ct.TestLike, hsName string) {
+	t.Helper()
+	if err := d.Deployer.Unpause(d.Server(t, hsName)); err != nil {
+		ct.Fatalf(t, "UnpauseServer: %s", err)
+	}
+}
+
+// Destroy the deployment, printing server logs if the test failed or COMPLEMENT_ALWAYS_PRINT_SERVER_LOGS is set.
+func (d *Deployment) Destroy(t ct.TestLike) {
+	t.Helper()
+	d.Deployer.Destroy(d, d.Deployer.config.AlwaysPrintServerLogs || t.Failed())
+}
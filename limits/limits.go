@@ -0,0 +1,216 @@
+// Package limits contains generators for events at and beyond the size limits in the Matrix spec, and
+// assertions for how homeservers reject them, so that limit conformance can be covered broadly.
+//
+// See https://spec.matrix.org/v1.12/client-server-api/#size-limits
+package limits
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/federation"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+const (
+	// The maximum size in bytes of the complete event, as sent over federation.
+	MaxEventSize = 65536
+	// The maximum size in bytes of the type, state_key, sender, room_id and event_id of an event.
+	MaxIDSize = 255
+	// The maximum number of auth_events of an event.
+	MaxAuthEvents = 10
+	// The maximum number of prev_events of an event.
+	MaxPrevEvents = 20
+
+	// How much smaller than MaxEventSize the content of ClientEventNearLimit is, to leave room for the
+	// fields the homeserver adds to the event e.g hashes, signatures, auth_events and prev_events.
+	clientEventHeadroom = 4096
+)
+
+// String returns an ASCII string of exactly `n` bytes.
+func String(n int) string {
+	return strings.Repeat("a", n)
+}
+
+// ClientEventNearLimit returns a message event which is just under MaxEventSize once the homeserver has
+// added its own fields, so must be accepted.
+func ClientEventNearLimit() b.Event {
+	return b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    String(MaxEventSize - clientEventHeadroom),
+		},
+	}
+}
+
+// ClientEventOverLimit returns a message event whose content alone is larger than MaxEventSize, so must
+// be rejected.
+func ClientEventOverLimit() b.Event {
+	return b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    String(MaxEventSize),
+		},
+	}
+}
+
+// StateEventWithKeySize returns a state event whose state_key is `n` bytes. Events with state keys of
+// up to MaxIDSize bytes must be accepted.
+func StateEventWithKeySize(n int) b.Event {
+	return b.Event{
+		Type:     "com.example.limits",
+		StateKey: b.Ptr(String(n)),
+		Content:  map[string]interface{}{},
+	}
+}
+
+// EventWithTypeSize returns a message-like event whose type is `n` bytes. Events with types of up to
+// MaxIDSize bytes must be accepted.
+func EventWithTypeSize(n int) b.Event {
+	prefix := "com.example."
+	if n < len(prefix)+1 {
+		prefix = ""
+	}
+	return b.Event{
+		Type:    prefix + String(n-len(prefix)),
+		Content: map[string]interface{}{},
+	}
+}
+
+// MustRejectAsTooLarge fails the test unless the response is a client error with the errcode
+// M_TOO_LARGE, as homeservers return when an event exceeds the size limits.
+func MustRejectAsTooLarge(t ct.TestLike, res *http.Response) {
+	t.Helper()
+	if res.StatusCode < 400 || res.StatusCode > 499 {
+		ct.Fatalf(t, "MustRejectAsTooLarge: got status %d, want a 4xx", res.StatusCode)
+	}
+	must.MatchResponse(t, res, match.HTTPResponse{
+		JSON: []match.JSON{
+			match.JSONKeyEqual("errcode", "M_TOO_LARGE"),
+		},
+	})
+}
+
+// MustCreateEventOfSize creates an event in the room on the Complement federation server whose JSON, as
+// sent over federation, is exactly `size` bytes. This is done by adding a "pad" key to the content of
+// `ev`. The size may exceed MaxEventSize, in which case the event is signed regardless. The event is not
+// added to the room.
+func MustCreateEventOfSize(t ct.TestLike, srv *federation.Server, room *federation.ServerRoom, ev federation.Event, size int) gomatrixserverlib.PDU {
+	t.Helper()
+	content := make(map[string]interface{}, len(ev.Content)+1)
+	for k, v := range ev.Content {
+		content[k] = v
+	}
+	ev.Content = content
+	if ev.OriginServerTS.IsZero() {
+		// the timestamp must not change between attempts, as it would change the size
+		ev.OriginServerTS = time.Now()
+	}
+	pad := 0
+	// The size grows linearly with the padding as hashes and signatures are a fixed size, so this
+	// should converge on the second attempt.
+	for i := 0; i < 5; i++ {
+		content["pad"] = String(pad)
+		pdu := MustCreateUnvalidatedEvent(t, srv, room, ev)
+		got := len(pdu.JSON())
+		if got == size {
+			return pdu
+		}
+		unpadded := got - pad
+		if unpadded > size {
+			ct.Fatalf(t, "MustCreateEventOfSize: event is %d bytes without padding, which is larger than %d bytes", unpadded, size)
+		}
+		pad = size - unpadded
+	}
+	ct.Fatalf(t, "MustCreateEventOfSize: failed to create an event of %d bytes", size)
+	return nil
+}
+
+// MustCreateUnvalidatedEvent is like Server.MustCreateEvent, but signs events which fail validation e.g
+// because their state key is too long, so they can be sent to homeservers to check they are rejected.
+func MustCreateUnvalidatedEvent(t ct.TestLike, srv *federation.Server, room *federation.ServerRoom, ev federation.Event) gomatrixserverlib.PDU {
+	t.Helper()
+	proto, err := room.ProtoEventCreator(room, ev)
+	if err != nil {
+		ct.Fatalf(t, "MustCreateUnvalidatedEvent: failed to create proto event: %s", err)
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(room.Version)
+	if err != nil {
+		ct.Fatalf(t, "MustCreateUnvalidatedEvent: invalid room version: %s", err)
+	}
+	ts := ev.OriginServerTS
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	pdu, err := verImpl.NewEventBuilderFromProtoEvent(proto).Build(ts, srv.ServerName(), srv.KeyID, srv.Priv)
+	var validationErr gomatrixserverlib.EventValidationError
+	if err != nil && !errors.As(err, &validationErr) {
+		ct.Fatalf(t, "MustCreateUnvalidatedEvent: failed to sign event: %s", err)
+	}
+	return pdu
+}
+
+// TooManyAuthEvents returns MaxAuthEvents+1 event IDs from the timeline of the room, for use as the
+// AuthEvents of a federation.Event which must be rejected. The room must have at least that many events
+// e.g by sending some messages after federation.InitialRoomEvents, and must use room version 3 or later.
+func TooManyAuthEvents(t ct.TestLike, room *federation.ServerRoom) []string {
+	t.Helper()
+	if len(room.Timeline) <= MaxAuthEvents {
+		ct.Fatalf(t, "TooManyAuthEvents: room has %d events, need at least %d", len(room.Timeline), MaxAuthEvents+1)
+	}
+	verImpl, err := gomatrixserverlib.GetRoomVersion(room.Version)
+	if err != nil {
+		ct.Fatalf(t, "TooManyAuthEvents: invalid room version: %s", err)
+	}
+	if verImpl.EventFormat() == gomatrixserverlib.EventFormatV1 {
+		ct.Fatalf(t, "TooManyAuthEvents: room version %s uses event references, which are not supported", room.Version)
+	}
+	eventIDs := make([]string, 0, MaxAuthEvents+1)
+	for _, ev := range room.Timeline[:MaxAuthEvents+1] {
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	return eventIDs
+}
+
+// MustRejectPDUs sends the bad events to the homeserver `destination` in a transaction, followed by a
+// valid message from `sender`, and fails the test unless the bad events are rejected. The client `c`
+// must be joined to the room on the homeserver: once it sees the valid message, none of the bad events
+// may be visible to it. The bad events should not have been added to the room, so the valid message
+// does not reference them.
+func MustRejectPDUs(t ct.TestLike, deployment federation.FederationDeployment, srv *federation.Server, destination spec.ServerName, room *federation.ServerRoom, c *client.CSAPI, sender string, bad ...gomatrixserverlib.PDU) {
+	t.Helper()
+	sentinel := srv.MustCreateEvent(t, room, federation.Event{
+		Type:   "m.room.message",
+		Sender: sender,
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "after bad events",
+		},
+	})
+	room.AddEvent(sentinel)
+	pdus := make([]json.RawMessage, 0, len(bad)+1)
+	for _, pdu := range bad {
+		pdus = append(pdus, pdu.JSON())
+	}
+	pdus = append(pdus, sentinel.JSON())
+	srv.MustSendTransaction(t, deployment, destination, pdus, nil)
+	c.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(room.RoomID, sentinel.EventID()))
+	for _, pdu := range bad {
+		res := c.GetEvent(t, room.RoomID, pdu.EventID())
+		if res.StatusCode != 404 {
+			ct.Fatalf(t, "MustRejectPDUs: bad event %s (%d bytes) is visible to %s: got status %d for /event, want 404", pdu.EventID(), len(pdu.JSON()), c.UserID, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package limits
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/federation"
+)
+
+type fedDeploy struct {
+	cfg *config.Complement
+}
+
+func (d *fedDeploy) GetConfig() *config.Complement {
+	return d.cfg
+}
+
+func (d *fedDeploy) RoundTripper() http.RoundTripper {
+	return http.DefaultTransport
+}
+
+func TestMustCreateEventOfSize(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	srv := federation.NewServer(t, &fedDeploy{cfg: cfg})
+	cancel := srv.Listen()
+	defer cancel()
+	ver := gomatrixserverlib.RoomVersionV10
+	creator := srv.UserID("alice")
+	room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, creator))
+
+	for _, size := range []int{2048, MaxEventSize, MaxEventSize + 1} {
+		pdu := MustCreateEventOfSize(t, srv, room, federation.Event{
+			Type:    "m.room.message",
+			Sender:  creator,
+			Content: map[string]interface{}{"body": "hello"},
+		}, size)
+		if got := len(pdu.JSON()); got != size {
+			t.Errorf("MustCreateEventOfSize(%d): got %d bytes", size, got)
+		}
+	}
+
+	for _, n := range []int{1, MaxIDSize, MaxIDSize + 1} {
+		if got := len(EventWithTypeSize(n).Type); got != n {
+			t.Errorf("EventWithTypeSize(%d): got type of %d bytes", n, got)
+		}
+		if got := len(*StateEventWithKeySize(n).StateKey); got != n {
+			t.Errorf("StateEventWithKeySize(%d): got state key of %d bytes", n, got)
+		}
+	}
+}
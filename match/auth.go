@@ -0,0 +1,46 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// WhoamiDeviceID returns a matcher which will check that a /account/whoami response is for the device `wantDeviceID`.
+func WhoamiDeviceID(wantDeviceID string) JSON {
+	return func(body gjson.Result) error {
+		res := body.Get("device_id")
+		if !res.Exists() {
+			return fmt.Errorf("key 'device_id' missing")
+		}
+		if res.Str != wantDeviceID {
+			return fmt.Errorf("key 'device_id' got '%s' want '%s'", res.Str, wantDeviceID)
+		}
+		return nil
+	}
+}
+
+// WhoamiIsGuest returns a matcher which will check whether a /account/whoami response is for a guest user.
+// A missing 'is_guest' key is treated as false, as per the spec.
+func WhoamiIsGuest(wantIsGuest bool) JSON {
+	return func(body gjson.Result) error {
+		if got := body.Get("is_guest").Bool(); got != wantIsGuest {
+			return fmt.Errorf("key 'is_guest' got %v want %v", got, wantIsGuest)
+		}
+		return nil
+	}
+}
+
+// SoftLogout returns a matcher which will check that an error response is M_UNKNOWN_TOKEN, and whether
+// the client has been soft logged out. A missing 'soft_logout' key is treated as false, as per the spec.
+func SoftLogout(wantSoftLogout bool) JSON {
+	return func(body gjson.Result) error {
+		if errcode := body.Get("errcode").Str; errcode != "M_UNKNOWN_TOKEN" {
+			return fmt.Errorf("key 'errcode' got '%s' want 'M_UNKNOWN_TOKEN'", errcode)
+		}
+		if got := body.Get("soft_logout").Bool(); got != wantSoftLogout {
+			return fmt.Errorf("key 'soft_logout' got %v want %v", got, wantSoftLogout)
+		}
+		return nil
+	}
+}
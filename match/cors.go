@@ -0,0 +1,60 @@
+package match
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CORS returns the matchers for the CORS headers which the spec requires on all client-server API
+// responses, including responses to preflight OPTIONS requests.
+func CORS() []Header {
+	return []Header{
+		CORSAllowOrigin("*"),
+		CORSAllowMethods("GET", "POST", "PUT", "DELETE", "OPTIONS"),
+		CORSAllowHeaders("X-Requested-With", "Content-Type", "Authorization"),
+	}
+}
+
+// CORSAllowOrigin returns a matcher which will check that the Access-Control-Allow-Origin header is `wantOrigin`.
+func CORSAllowOrigin(wantOrigin string) Header {
+	return func(header http.Header) error {
+		if got := header.Get("Access-Control-Allow-Origin"); got != wantOrigin {
+			return fmt.Errorf("Access-Control-Allow-Origin got '%s' want '%s'", got, wantOrigin)
+		}
+		return nil
+	}
+}
+
+// CORSAllowMethods returns a matcher which will check that the Access-Control-Allow-Methods header
+// includes all of `wantMethods`. Other methods may also be allowed.
+func CORSAllowMethods(wantMethods ...string) Header {
+	return headerListIncludes("Access-Control-Allow-Methods", wantMethods)
+}
+
+// CORSAllowHeaders returns a matcher which will check that the Access-Control-Allow-Headers header
+// includes all of `wantHeaders`, case-insensitively. Other headers may also be allowed.
+func CORSAllowHeaders(wantHeaders ...string) Header {
+	return headerListIncludes("Access-Control-Allow-Headers", wantHeaders)
+}
+
+// headerListIncludes checks that the comma-separated list header `name` includes all of `want`,
+// case-insensitively. A value of "*" is treated as including everything except the Authorization
+// header, which browsers never treat as covered by a wildcard.
+func headerListIncludes(name string, want []string) Header {
+	return func(header http.Header) error {
+		got := make(map[string]bool)
+		for _, value := range header.Values(name) {
+			for _, item := range strings.Split(value, ",") {
+				got[strings.ToLower(strings.TrimSpace(item))] = true
+			}
+		}
+		for _, w := range want {
+			w = strings.ToLower(w)
+			if !got[w] && !(got["*"] && w != "authorization") {
+				return fmt.Errorf("%s got '%s' which does not include '%s'", name, strings.Join(header.Values(name), ", "), w)
+			}
+		}
+		return nil
+	}
+}
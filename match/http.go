@@ -1,12 +1,19 @@
 package match
 
+import "net/http"
+
 // HTTPResponse is the desired shape of the HTTP response. Can include any number of JSON matchers.
 type HTTPResponse struct {
 	StatusCode int
 	Headers    map[string]string
-	JSON       []JSON
+	// Matchers for headers which cannot be checked by exact value e.g lists of values. See Header.
+	HeaderMatchers []Header
+	JSON           []JSON
 }
 
+// Header will perform some matches on the given HTTP headers, returning an error on a mis-match.
+type Header func(header http.Header) error
+
 // HTTPRequest is the desired shape of the HTTP request. Can include any number of JSON matchers.
 type HTTPRequest struct {
 	Headers map[string]string
@@ -0,0 +1,13 @@
+package match
+
+// MediaUnavailable returns a matcher which will check that a media download or thumbnail response is an
+// error for media which cannot be served, e.g because it has been quarantined. Homeservers respond with
+// either M_NOT_FOUND or M_FORBIDDEN, so use it with any status code:
+//
+//	must.MatchResponse(t, res, match.HTTPResponse{JSON: []match.JSON{match.MediaUnavailable()}})
+func MediaUnavailable() JSON {
+	return AnyOf(
+		JSONKeyEqual("errcode", "M_NOT_FOUND"),
+		JSONKeyEqual("errcode", "M_FORBIDDEN"),
+	)
+}
@@ -0,0 +1,59 @@
+package match
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Redirect will perform some matches on the URL a response redirected to, returning an error on a mis-match.
+type Redirect func(location *url.URL) error
+
+// RedirectQueryParam returns a matcher which will check that the query parameter `key` is `want`.
+func RedirectQueryParam(key, want string) Redirect {
+	return func(location *url.URL) error {
+		query := location.Query()
+		if !query.Has(key) {
+			return fmt.Errorf("query parameter '%s' missing", key)
+		}
+		if got := query.Get(key); got != want {
+			return fmt.Errorf("query parameter '%s' got '%s' want '%s'", key, got, want)
+		}
+		return nil
+	}
+}
+
+// RedirectHasQueryParam returns a matcher which will check that the query parameter `key` exists and is not
+// empty, for parameters whose value is not known in advance e.g `loginToken` or `state`.
+func RedirectHasQueryParam(key string) Redirect {
+	return func(location *url.URL) error {
+		if location.Query().Get(key) == "" {
+			return fmt.Errorf("query parameter '%s' missing or empty", key)
+		}
+		return nil
+	}
+}
+
+// RedirectLacksQueryParam returns a matcher which will check that the query parameter `key` does not exist.
+func RedirectLacksQueryParam(key string) Redirect {
+	return func(location *url.URL) error {
+		if location.Query().Has(key) {
+			return fmt.Errorf("query parameter '%s' exists with value '%s'", key, location.Query().Get(key))
+		}
+		return nil
+	}
+}
+
+// RedirectPrefix returns a matcher which will check that the URL without its query string starts with `wantPrefix`,
+// e.g the authorization endpoint of an identity provider or the redirect URL of a client.
+func RedirectPrefix(wantPrefix string) Redirect {
+	return func(location *url.URL) error {
+		withoutQuery := *location
+		withoutQuery.RawQuery = ""
+		withoutQuery.Fragment = ""
+		if !strings.HasPrefix(withoutQuery.String(), wantPrefix) {
+			return fmt.Errorf("redirect to '%s' does not start with '%s'", withoutQuery.String(), wantPrefix)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,25 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// EventReport returns a matcher which will check that an admin list of event reports contains a report
+// of `eventID` in `roomID` made by `reporter` with the given reason.
+func EventReport(reporter, roomID, eventID, reason string) JSON {
+	return func(body gjson.Result) error {
+		reports := body.Get("event_reports")
+		if !reports.IsArray() {
+			return fmt.Errorf("key 'event_reports' missing or not an array")
+		}
+		for _, report := range reports.Array() {
+			if report.Get("user_id").Str == reporter && report.Get("room_id").Str == roomID &&
+				report.Get("event_id").Str == eventID && report.Get("reason").Str == reason {
+				return nil
+			}
+		}
+		return fmt.Errorf("no report of %s in %s by %s with reason '%s' in %s", eventID, roomID, reporter, reason, reports.Raw)
+	}
+}
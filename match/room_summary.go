@@ -0,0 +1,53 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// RoomSummaryMembership returns a matcher which will check the requesting user's membership in an MSC3266
+// room summary. Use an empty `wantMembership` to check that the user has no membership in the room.
+func RoomSummaryMembership(wantMembership string) JSON {
+	return func(body gjson.Result) error {
+		got := body.Get("membership").Str
+		if got == "leave" && wantMembership == "" {
+			// servers may report users who have never been in the room as having left it
+			return nil
+		}
+		if got != wantMembership {
+			return fmt.Errorf("room summary membership got '%s' want '%s'", got, wantMembership)
+		}
+		return nil
+	}
+}
+
+// RoomSummaryJoinRule returns a matcher which will check the join rule in an MSC3266 room summary.
+func RoomSummaryJoinRule(wantJoinRule string) JSON {
+	return func(body gjson.Result) error {
+		// the join rule was named join_rules in earlier versions of the MSC
+		got := body.Get("join_rule")
+		if !got.Exists() {
+			got = body.Get("join_rules")
+		}
+		if got.Str != wantJoinRule {
+			return fmt.Errorf("room summary join rule got '%s' want '%s'", got.Str, wantJoinRule)
+		}
+		return nil
+	}
+}
+
+// RoomSummaryEncryption returns a matcher which will check the encryption algorithm in an MSC3266 room
+// summary. Use an empty `wantAlgorithm` to check that the room is not encrypted.
+func RoomSummaryEncryption(wantAlgorithm string) JSON {
+	return func(body gjson.Result) error {
+		got := body.Get("encryption")
+		if !got.Exists() {
+			got = body.Get(`im\.nheko\.summary\.encryption`)
+		}
+		if got.Str != wantAlgorithm {
+			return fmt.Errorf("room summary encryption got '%s' want '%s'", got.Str, wantAlgorithm)
+		}
+		return nil
+	}
+}
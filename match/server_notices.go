@@ -0,0 +1,42 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// ServerNotice returns a matcher which will check that an event is a server notice message with the given
+// body. Use an empty `wantBody` to match any server notice.
+func ServerNotice(wantBody string) JSON {
+	return func(ev gjson.Result) error {
+		if ev.Get("type").Str != "m.room.message" {
+			return fmt.Errorf("server notice: got event type '%s' want 'm.room.message'", ev.Get("type").Str)
+		}
+		if got := ev.Get("content.msgtype").Str; got != "m.server_notice" {
+			return fmt.Errorf("server notice: got msgtype '%s' want 'm.server_notice'", got)
+		}
+		if got := ev.Get("content.body").Str; wantBody != "" && got != wantBody {
+			return fmt.Errorf("server notice: got body '%s' want '%s'", got, wantBody)
+		}
+		return nil
+	}
+}
+
+// ServerNoticeUsageLimitReached returns a matcher which will check that an event is a server notice that
+// the usage limit `wantLimitType` (e.g "monthly_active_user") of the homeserver has been reached, as sent
+// by homeservers which enforce resource limits.
+func ServerNoticeUsageLimitReached(wantLimitType string) JSON {
+	return func(ev gjson.Result) error {
+		if err := ServerNotice("")(ev); err != nil {
+			return err
+		}
+		if got := ev.Get("content.server_notice_type").Str; got != "m.server_notice.usage_limit_reached" {
+			return fmt.Errorf("server notice: got server_notice_type '%s' want 'm.server_notice.usage_limit_reached'", got)
+		}
+		if got := ev.Get("content.limit_type").Str; got != wantLimitType {
+			return fmt.Errorf("server notice: got limit_type '%s' want '%s'", got, wantLimitType)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,44 @@
+package match
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// TimestampToEventID returns a matcher which will check that a /timestamp_to_event response is for the event `wantEventID`.
+func TimestampToEventID(wantEventID string) JSON {
+	return func(body gjson.Result) error {
+		if got := body.Get("event_id").Str; got != wantEventID {
+			return fmt.Errorf("/timestamp_to_event got event '%s' want '%s'", got, wantEventID)
+		}
+		return nil
+	}
+}
+
+// TimestampToEventInDirection returns a matcher which will check that the event in a /timestamp_to_event
+// response is on the correct side of the requested timestamp `ts`: at or after it for dir "f", or at or
+// before it for dir "b".
+func TimestampToEventInDirection(ts time.Time, dir string) JSON {
+	return func(body gjson.Result) error {
+		res := body.Get("origin_server_ts")
+		if !res.Exists() {
+			return fmt.Errorf("key 'origin_server_ts' missing")
+		}
+		got, want := res.Int(), ts.UnixMilli()
+		switch dir {
+		case "f":
+			if got < want {
+				return fmt.Errorf("/timestamp_to_event dir=f returned event at %d, before the requested %d", got, want)
+			}
+		case "b":
+			if got > want {
+				return fmt.Errorf("/timestamp_to_event dir=b returned event at %d, after the requested %d", got, want)
+			}
+		default:
+			return fmt.Errorf("TimestampToEventInDirection: unknown direction '%s'", dir)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,48 @@
+package match
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+var gjsonEscaper = strings.NewReplacer(".", `\.`, "*", `\*`)
+
+// OpenGraph returns a matcher which will check that a URL preview has the given OpenGraph properties,
+// keyed on property e.g "og:title". Other properties in the preview are ignored.
+func OpenGraph(properties map[string]string) JSON {
+	return func(body gjson.Result) error {
+		keys := make([]string, 0, len(properties))
+		for property := range properties {
+			keys = append(keys, property)
+		}
+		sort.Strings(keys)
+		for _, property := range keys {
+			got := body.Get(gjsonEscaper.Replace(property))
+			if !got.Exists() {
+				return fmt.Errorf("OpenGraph: missing property %s", property)
+			}
+			if got.Str != properties[property] {
+				return fmt.Errorf("OpenGraph: property %s got '%s' want '%s'", property, got.Str, properties[property])
+			}
+		}
+		return nil
+	}
+}
+
+// OpenGraphImage returns a matcher which will check that a URL preview has an og:image which the
+// homeserver has downloaded, so is an MXC URI.
+func OpenGraphImage() JSON {
+	return func(body gjson.Result) error {
+		image := body.Get("og:image")
+		if !image.Exists() {
+			return fmt.Errorf("OpenGraphImage: missing property og:image")
+		}
+		if !strings.HasPrefix(image.Str, "mxc://") {
+			return fmt.Errorf("OpenGraphImage: og:image is not an MXC URI: %s", image.Raw)
+		}
+		return nil
+	}
+}
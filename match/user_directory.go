@@ -0,0 +1,48 @@
+package match
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// UserDirectoryHas returns a matcher which will check that a user directory search response contains
+// `userID`. If `displayName` is not empty, the result must also have that display name.
+func UserDirectoryHas(userID, displayName string) JSON {
+	return func(body gjson.Result) error {
+		for _, result := range body.Get("results").Array() {
+			if result.Get("user_id").Str != userID {
+				continue
+			}
+			if displayName != "" && result.Get("display_name").Str != displayName {
+				return fmt.Errorf("user directory result for %s has display name '%s' want '%s'", userID, result.Get("display_name").Str, displayName)
+			}
+			return nil
+		}
+		return fmt.Errorf("user directory results do not contain %s: %s", userID, body.Get("results").Raw)
+	}
+}
+
+// UserDirectoryLacks returns a matcher which will check that a user directory search response does not
+// contain `userID`.
+func UserDirectoryLacks(userID string) JSON {
+	return func(body gjson.Result) error {
+		for _, result := range body.Get("results").Array() {
+			if result.Get("user_id").Str == userID {
+				return fmt.Errorf("user directory results contain %s: %s", userID, result.Raw)
+			}
+		}
+		return nil
+	}
+}
+
+// UserDirectoryLimited returns a matcher which will check the `limited` flag of a user directory search
+// response.
+func UserDirectoryLimited(wantLimited bool) JSON {
+	return func(body gjson.Result) error {
+		if got := body.Get("limited").Bool(); got != wantLimited {
+			return fmt.Errorf("user directory limited got %v want %v", got, wantLimited)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// Matcher checks a scrape of metrics, returning an error if it does not match.
+type Matcher func(m Metrics) error
+
+// MustMatch fails the test if any of the matchers do not match the metrics.
+func MustMatch(t ct.TestLike, m Metrics, matchers ...Matcher) {
+	t.Helper()
+	for _, matcher := range matchers {
+		if err := matcher(m); err != nil {
+			ct.Fatalf(t, "MustMatch: %s", err)
+		}
+	}
+}
+
+// ValueEquals returns a matcher which checks that the sum of the samples of the metric `name` with the
+// given labels equals `want`.
+func ValueEquals(name string, labels map[string]string, want float64) Matcher {
+	return valueMatcher(name, labels, fmt.Sprintf("== %v", want), func(got float64) bool {
+		return got == want
+	})
+}
+
+// ValueAtLeast returns a matcher which checks that the sum of the samples of the metric `name` with the
+// given labels is at least `min`.
+func ValueAtLeast(name string, labels map[string]string, min float64) Matcher {
+	return valueMatcher(name, labels, fmt.Sprintf(">= %v", min), func(got float64) bool {
+		return got >= min
+	})
+}
+
+// ValueAtMost returns a matcher which checks that the sum of the samples of the metric `name` with the
+// given labels is at most `max`.
+func ValueAtMost(name string, labels map[string]string, max float64) Matcher {
+	return valueMatcher(name, labels, fmt.Sprintf("<= %v", max), func(got float64) bool {
+		return got <= max
+	})
+}
+
+// DeltaEquals returns a matcher which checks that the sum of the samples of the metric `name` with the
+// given labels has changed by exactly `want` since the `before` scrape. A metric missing from `before`
+// is treated as 0, as labelled metrics are often only exposed once they are first incremented.
+func DeltaEquals(before Metrics, name string, labels map[string]string, want float64) Matcher {
+	return deltaMatcher(before, name, labels, fmt.Sprintf("== %v", want), func(delta float64) bool {
+		return delta == want
+	})
+}
+
+// DeltaAtLeast returns a matcher which checks that the sum of the samples of the metric `name` with the
+// given labels has increased by at least `min` since the `before` scrape. A metric missing from `before`
+// is treated as 0.
+func DeltaAtLeast(before Metrics, name string, labels map[string]string, min float64) Matcher {
+	return deltaMatcher(before, name, labels, fmt.Sprintf(">= %v", min), func(delta float64) bool {
+		return delta >= min
+	})
+}
+
+func valueMatcher(name string, labels map[string]string, desc string, check func(got float64) bool) Matcher {
+	return func(m Metrics) error {
+		got, ok := m.Sum(name, labels)
+		if !ok {
+			return fmt.Errorf("metric %s%v not found", name, labels)
+		}
+		if !check(got) {
+			return fmt.Errorf("metric %s%v: got %v, want %s", name, labels, got, desc)
+		}
+		return nil
+	}
+}
+
+func deltaMatcher(before Metrics, name string, labels map[string]string, desc string, check func(delta float64) bool) Matcher {
+	return func(m Metrics) error {
+		got, ok := m.Sum(name, labels)
+		if !ok {
+			return fmt.Errorf("metric %s%v not found", name, labels)
+		}
+		prev, _ := before.Sum(name, labels)
+		if !check(got - prev) {
+			return fmt.Errorf("metric %s%v: changed by %v (%v -> %v), want %s", name, labels, got-prev, prev, got, desc)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,216 @@
+// Package metrics contains helpers to scrape the Prometheus metrics of a homeserver and assert on them,
+// so tests can check side effects which aren't visible via the API such as cache hit rates or the depth
+// of federation queues. Metrics are scraped from a port exposed by the homeserver image.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Sample is a single value of a metric, as exposed in the Prometheus text format.
+type Sample struct {
+	// The metric name e.g `synapse_http_server_requests_total`. Histograms and summaries have samples
+	// named with `_bucket`, `_sum` and `_count` suffixes.
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+func (s Sample) String() string {
+	if len(s.Labels) == 0 {
+		return fmt.Sprintf("%s %v", s.Name, s.Value)
+	}
+	labels := make([]string, 0, len(s.Labels))
+	for k, v := range s.Labels {
+		labels = append(labels, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(labels)
+	return fmt.Sprintf("%s{%s} %v", s.Name, strings.Join(labels, ","), s.Value)
+}
+
+// Metrics is the set of samples from a single scrape.
+type Metrics []Sample
+
+// Samples returns all samples of the metric `name` which have all of the given labels. Other labels on
+// the samples are ignored.
+func (m Metrics) Samples(name string, labels map[string]string) []Sample {
+	var samples []Sample
+	for _, s := range m {
+		if s.Name != name || !hasLabels(s, labels) {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+// Sum returns the sum of the values of all samples returned by Samples, and whether there were any.
+func (m Metrics) Sum(name string, labels map[string]string) (float64, bool) {
+	samples := m.Samples(name, labels)
+	var sum float64
+	for _, s := range samples {
+		sum += s.Value
+	}
+	return sum, len(samples) > 0
+}
+
+func hasLabels(s Sample, labels map[string]string) bool {
+	for k, v := range labels {
+		if s.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Scrape fetches and parses the metrics at `url` e.g `http://127.0.0.1:34567/_synapse/metrics`. Fails
+// the test if the metrics cannot be fetched or parsed.
+func Scrape(t ct.TestLike, url string) Metrics {
+	t.Helper()
+	httpClient := http.Client{
+		Timeout: 10 * time.Second,
+	}
+	res, err := httpClient.Get(url)
+	if err != nil {
+		ct.Fatalf(t, "Scrape: failed to GET %s: %s", url, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		ct.Fatalf(t, "Scrape: GET %s returned HTTP %d", url, res.StatusCode)
+	}
+	m, err := Parse(res.Body)
+	if err != nil {
+		ct.Fatalf(t, "Scrape: failed to parse metrics from %s: %s", url, err)
+	}
+	return m
+}
+
+// ScrapeServer scrapes the metrics of the homeserver `hsName`, which are served at `path` on `port` in
+// the container. The port must be exposed by the homeserver image. Skips the test if the deployment is
+// not a Docker deployment.
+func ScrapeServer(t ct.TestLike, deployment complement.Deployment, hsName string, port int, path string) Metrics {
+	t.Helper()
+	return Scrape(t, "http://"+complement.ServerAddress(t, deployment, hsName, port)+path)
+}
+
+// Parse parses metrics in the Prometheus text exposition format. Comments, including HELP and TYPE
+// lines, and timestamps are ignored.
+func Parse(r io.Reader) (Metrics, error) {
+	var m Metrics
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		m = append(m, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func parseSample(line string) (Sample, error) {
+	s := Sample{
+		Labels: make(map[string]string),
+	}
+	nameEnd := strings.IndexAny(line, "{ \t")
+	if nameEnd <= 0 {
+		return s, fmt.Errorf("missing metric name or value: %s", line)
+	}
+	s.Name = line[:nameEnd]
+	rest := line[nameEnd:]
+	if rest[0] == '{' {
+		var err error
+		rest, err = parseLabels(rest[1:], s.Labels)
+		if err != nil {
+			return s, fmt.Errorf("%s: %w", s.Name, err)
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("%s: expected a value and optional timestamp, got '%s'", s.Name, rest)
+	}
+	value, err := parseValue(fields[0])
+	if err != nil {
+		return s, fmt.Errorf("%s: %w", s.Name, err)
+	}
+	s.Value = value
+	return s, nil
+}
+
+// parseLabels parses `name="value",...}` into `labels`, returning the remainder of the line after the
+// closing brace.
+func parseLabels(in string, labels map[string]string) (string, error) {
+	for {
+		in = strings.TrimLeft(in, " \t")
+		if strings.HasPrefix(in, "}") {
+			return in[1:], nil
+		}
+		eq := strings.IndexByte(in, '=')
+		if eq <= 0 {
+			return "", fmt.Errorf("malformed label in '%s'", in)
+		}
+		name := strings.TrimSpace(in[:eq])
+		in = strings.TrimLeft(in[eq+1:], " \t")
+		if !strings.HasPrefix(in, `"`) {
+			return "", fmt.Errorf("label %s: value is not quoted", name)
+		}
+		var value strings.Builder
+		i := 1
+		for ; i < len(in) && in[i] != '"'; i++ {
+			if in[i] == '\\' && i+1 < len(in) {
+				i++
+				switch in[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(in[i])
+				}
+				continue
+			}
+			value.WriteByte(in[i])
+		}
+		if i == len(in) {
+			return "", fmt.Errorf("label %s: unterminated value", name)
+		}
+		labels[name] = value.String()
+		in = strings.TrimLeft(in[i+1:], " \t")
+		in = strings.TrimPrefix(in, ",")
+	}
+}
+
+func parseValue(v string) (float64, error) {
+	switch v {
+	case "+Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s'", v)
+	}
+	return f, nil
+}
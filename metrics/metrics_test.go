@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+const exposition = `# HELP http_requests_total Total requests.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",code="200"} 10
+http_requests_total{method="GET",code="404"} 2 1712345678000
+http_requests_total{method="PUT", code="200",} 3
+cache_size 1.5e3
+label_escapes{path="a\"b\\c\nd,e}"} 1
+queue_depth{destination="hs2"} +Inf
+`
+
+func TestParse(t *testing.T) {
+	m, err := Parse(strings.NewReader(exposition))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if len(m) != 6 {
+		t.Fatalf("got %d samples, want 6: %v", len(m), m)
+	}
+	if got, _ := m.Sum("http_requests_total", nil); got != 15 {
+		t.Errorf("sum of all requests: got %v want 15", got)
+	}
+	if got, _ := m.Sum("http_requests_total", map[string]string{"method": "GET"}); got != 12 {
+		t.Errorf("sum of GET requests: got %v want 12", got)
+	}
+	if got, _ := m.Sum("cache_size", nil); got != 1500 {
+		t.Errorf("cache_size: got %v want 1500", got)
+	}
+	if s := m.Samples("label_escapes", nil); len(s) != 1 || s[0].Labels["path"] != "a\"b\\c\nd,e}" {
+		t.Errorf("label_escapes: got %v", s)
+	}
+	if got, _ := m.Sum("queue_depth", nil); !math.IsInf(got, 1) {
+		t.Errorf("queue_depth: got %v want +Inf", got)
+	}
+	if _, ok := m.Sum("missing", nil); ok {
+		t.Errorf("missing metric was found")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, in := range []string{
+		"no_value",
+		`bad_label{a=b} 1`,
+		`unterminated{a="b} 1`,
+		"bad_value abc",
+	} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Errorf("Parse(%q): expected error", in)
+		}
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	before, err := Parse(strings.NewReader("requests_total{code=\"200\"} 5\n"))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	after, err := Parse(strings.NewReader("requests_total{code=\"200\"} 8\nrequests_total{code=\"500\"} 1\n"))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	ok200 := map[string]string{"code": "200"}
+	ok500 := map[string]string{"code": "500"}
+	for name, matcher := range map[string]Matcher{
+		"ValueEquals":    ValueEquals("requests_total", ok200, 8),
+		"ValueAtLeast":   ValueAtLeast("requests_total", nil, 9),
+		"ValueAtMost":    ValueAtMost("requests_total", ok500, 1),
+		"DeltaEquals":    DeltaEquals(before, "requests_total", ok200, 3),
+		"DeltaAtLeast":   DeltaAtLeast(before, "requests_total", nil, 4),
+		"DeltaNewMetric": DeltaEquals(before, "requests_total", ok500, 1),
+	} {
+		if err := matcher(after); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	for name, matcher := range map[string]Matcher{
+		"ValueEquals":  ValueEquals("requests_total", ok200, 5),
+		"ValueMissing": ValueAtLeast("missing", nil, 0),
+		"DeltaEquals":  DeltaEquals(before, "requests_total", ok200, 2),
+		"DeltaAtLeast": DeltaAtLeast(before, "requests_total", nil, 5),
+	} {
+		if err := matcher(after); err == nil {
+			t.Errorf("%s: expected mismatch", name)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/tidwall/gjson"
@@ -98,6 +99,16 @@ func MatchGJSON(t ct.TestLike, jsonResult gjson.Result, matchers ...match.JSON)
 	}
 }
 
+// EXPERIMENTAL
+// MatchRedirect performs assertions on the URL a response redirected to.
+func MatchRedirect(t ct.TestLike, location *url.URL, matchers ...match.Redirect) {
+	t.Helper()
+	err := should.MatchRedirect(location, matchers...)
+	if err != nil {
+		ct.Fatalf(t, err.Error())
+	}
+}
+
 // EXPERIMENTAL
 // MatchJSONBytes performs JSON assertions on a raw json byte slice.
 func MatchJSONBytes(t ct.TestLike, rawJson []byte, matchers ...match.JSON) {
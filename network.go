@@ -0,0 +1,53 @@
+package complement
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// NetworkConditions describe how the network degrades the federation traffic a homeserver sends.
+type NetworkConditions struct {
+	// Latency is added to every packet.
+	Latency time.Duration
+	// Jitter varies the latency of each packet by up to this much, either way.
+	Jitter time.Duration
+	// PacketLoss is the percentage (0-100) of packets which are dropped.
+	PacketLoss float64
+}
+
+// SetNetworkConditions adds latency, jitter and packet loss to the traffic the homeserver `hsName`
+// sends to other homeservers and to Complement's federation servers, replacing any conditions
+// previously set, so federation timeouts and retries can be tested. Traffic in the other direction is
+// not affected: set the conditions on both homeservers to degrade both directions. Clients in the test
+// are not affected. The conditions last until ResetNetworkConditions is called or the deployment is
+// destroyed. Skips the test if the deployment is not a Docker deployment.
+func SetNetworkConditions(t ct.TestLike, deployment Deployment, hsName string, cond NetworkConditions) {
+	t.Helper()
+	setNetworkConditions(t, "SetNetworkConditions", deployment, hsName, cond)
+}
+
+// ResetNetworkConditions removes the conditions set on the homeserver `hsName` via SetNetworkConditions.
+func ResetNetworkConditions(t ct.TestLike, deployment Deployment, hsName string) {
+	t.Helper()
+	setNetworkConditions(t, "ResetNetworkConditions", deployment, hsName, NetworkConditions{})
+}
+
+func setNetworkConditions(t ct.TestLike, caller string, deployment Deployment, hsName string, cond NetworkConditions) {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(*docker.Deployment)
+	if !ok {
+		t.Skipf("%s: deployment %T is not a Docker deployment", caller, deployment)
+	}
+	hsDep := dep.HS[hsName]
+	if hsDep == nil {
+		ct.Fatalf(t, "%s: %s does not exist in this deployment", caller, hsName)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := dep.Deployer.SetNetworkConditions(ctx, hsDep, docker.NetworkConditions(cond)); err != nil {
+		ct.Fatalf(t, "%s: %s", caller, err)
+	}
+}
@@ -0,0 +1,605 @@
+// package oidc is an EXPERIMENTAL in-process OAuth 2.0 / OpenID Connect provider, for testing homeservers
+// which delegate authentication to an external provider (MSC3861) without deploying a full provider like MAS.
+// It is marked as EXPERIMENTAL as the API may break without warning.
+//
+// The provider implements discovery, the authorization code flow (with PKCE), refresh tokens, JWKS,
+// token introspection and revocation. Whether an authorization request is approved is controlled by
+// the test via Provider.SetConsent.
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Subset of Deployment used by the provider
+type OIDCDeployment interface {
+	GetConfig() *config.Complement
+}
+
+// Client is an OAuth client which is allowed to use the provider.
+type Client struct {
+	ID string
+	// The client secret. If empty, the client is a public client and must use PKCE.
+	Secret string
+	// The redirect URIs which can be used in authorization requests. Required for the authorization code flow.
+	RedirectURIs []string
+}
+
+// AuthorizationRequest is an incoming request to the authorization endpoint, which the consent
+// function decides whether to approve.
+type AuthorizationRequest struct {
+	ClientID            string
+	RedirectURI         string
+	Scopes              []string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// Consent is the decision for an authorization request.
+type Consent struct {
+	// The subject (user) to issue tokens for. Required when approving.
+	Subject string
+	// Extra claims to include in the ID token and introspection responses, e.g "username".
+	Claims map[string]interface{}
+	// If set, the request is denied with this OAuth error code e.g "access_denied".
+	Error            string
+	ErrorDescription string
+}
+
+// Approve returns a Consent which approves the request as the given subject.
+func Approve(subject string) Consent {
+	return Consent{Subject: subject}
+}
+
+// Deny returns a Consent which denies the request with the given OAuth error code.
+func Deny(errCode, description string) Consent {
+	return Consent{Error: errCode, ErrorDescription: description}
+}
+
+// Token is an access token issued by the provider.
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	ClientID     string
+	Subject      string
+	Scopes       []string
+	Claims       map[string]interface{}
+	IssuedAt     time.Time
+	ExpiresAt    time.Time
+	Revoked      bool
+}
+
+type authCode struct {
+	req     AuthorizationRequest
+	consent Consent
+}
+
+// EXPERIMENTAL
+// Provider is an in-process OAuth 2.0 / OpenID Connect provider.
+type Provider struct {
+	t ct.TestLike
+
+	// How long issued access tokens are valid for. Default: 5 minutes.
+	TokenLifetime time.Duration
+
+	key       *rsa.PrivateKey
+	keyID     string
+	hostname  string
+	issuer    string
+	listening bool
+	mux       *mux.Router
+	srv       *http.Server
+
+	mu            sync.Mutex
+	consent       func(req AuthorizationRequest) Consent
+	clients       map[string]Client
+	codes         map[string]authCode
+	accessTokens  map[string]*Token
+	refreshTokens map[string]*Token
+}
+
+// EXPERIMENTAL
+// NewProvider creates a new OIDC provider with configured options. By default all authorization
+// requests are denied with "access_denied": call SetConsent to approve them.
+func NewProvider(t ct.TestLike, deployment OIDCDeployment, opts ...func(*Provider)) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		ct.Fatalf(t, "oidc.NewProvider failed to generate RSA key: %s", err)
+	}
+	p := &Provider{
+		t:             t,
+		TokenLifetime: 5 * time.Minute,
+		key:           key,
+		keyID:         "complement_" + util.RandomString(8),
+		hostname:      deployment.GetConfig().HostnameRunningComplement,
+		mux:           mux.NewRouter(),
+		consent: func(req AuthorizationRequest) Consent {
+			return Deny("access_denied", "complement: no consent function set")
+		},
+		clients:       make(map[string]Client),
+		codes:         make(map[string]authCode),
+		accessTokens:  make(map[string]*Token),
+		refreshTokens: make(map[string]*Token),
+	}
+	p.mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery).Methods("GET")
+	p.mux.HandleFunc("/authorize", p.handleAuthorize).Methods("GET")
+	p.mux.HandleFunc("/token", p.handleToken).Methods("POST")
+	p.mux.HandleFunc("/jwks.json", p.handleJWKS).Methods("GET")
+	p.mux.HandleFunc("/introspect", p.handleIntrospect).Methods("POST")
+	p.mux.HandleFunc("/revoke", p.handleRevoke).Methods("POST")
+	p.srv = &http.Server{Handler: p.mux}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// WithClient registers an OAuth client with the provider.
+func WithClient(c Client) func(*Provider) {
+	return func(p *Provider) {
+		p.AddClient(c)
+	}
+}
+
+// AddClient registers an OAuth client with the provider, replacing any existing client with the same ID.
+func (p *Provider) AddClient(c Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients[c.ID] = c
+}
+
+// SetConsent sets the function which decides whether authorization requests are approved.
+// It may be called at any time, e.g to deny requests part way through a test.
+func (p *Provider) SetConsent(fn func(req AuthorizationRequest) Consent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.consent = fn
+}
+
+// Issuer returns the issuer URL of this provider, which should be configured as the issuer in the
+// homeserver. Only valid AFTER calling Listen(), as the URL includes the port.
+func (p *Provider) Issuer() string {
+	if !p.listening {
+		ct.Fatalf(p.t, "Issuer() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the issuer. Ensure you Listen() first!")
+	}
+	return p.issuer
+}
+
+// Listen for requests on a random high-numbered port. Returns a function which stops the provider.
+func (p *Provider) Listen() (cancel func()) {
+	if p.listening {
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		ct.Fatalf(p.t, "oidc.Provider.Listen: net.Listen failed: %s", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	p.issuer = fmt.Sprintf("http://%s:%d/", p.hostname, port)
+	p.listening = true
+
+	go func() {
+		defer ln.Close()
+		defer wg.Done()
+		err := p.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			p.t.Logf("oidc.Provider.Listen: Serve failed: %s", err)
+		}
+	}()
+
+	return func() {
+		err := p.srv.Close()
+		if err != nil {
+			ct.Fatalf(p.t, "oidc.Provider.Listen: failed to shutdown server: %s", err)
+		}
+		wg.Wait()
+	}
+}
+
+// IssueToken directly issues an access token for the given client and subject, bypassing the
+// authorization flow. This is useful for tests which only care about the homeserver accepting tokens.
+func (p *Provider) IssueToken(clientID, subject string, scopes []string, claims map[string]interface{}) *Token {
+	return p.issue(clientID, subject, scopes, claims)
+}
+
+// RevokeToken revokes the given access token and its refresh token, so it is no longer active when introspected.
+func (p *Provider) RevokeToken(accessToken string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if tok, ok := p.accessTokens[accessToken]; ok {
+		tok.Revoked = true
+	}
+}
+
+// Tokens returns all access tokens issued by the provider so far, including revoked and expired ones.
+func (p *Provider) Tokens() []Token {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tokens := make([]Token, 0, len(p.accessTokens))
+	for _, tok := range p.accessTokens {
+		tokens = append(tokens, *tok)
+	}
+	return tokens
+}
+
+// Authorize performs a GET request to the given authorization URL, as a browser would, and returns
+// the redirect URI the provider redirects to. The redirect URI contains either a code or an error.
+// Fails the test if the provider does not redirect.
+func (p *Provider) Authorize(t ct.TestLike, authorizationURL string) *url.URL {
+	t.Helper()
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(authorizationURL)
+	if err != nil {
+		ct.Fatalf(t, "oidc.Provider.Authorize: GET %s failed: %s", authorizationURL, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		ct.Fatalf(t, "oidc.Provider.Authorize: GET %s returned HTTP %d, want 302", authorizationURL, res.StatusCode)
+	}
+	loc, err := res.Location()
+	if err != nil {
+		ct.Fatalf(t, "oidc.Provider.Authorize: invalid Location header: %s", err)
+	}
+	return loc
+}
+
+func (p *Provider) issue(clientID, subject string, scopes []string, claims map[string]interface{}) *Token {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	tok := &Token{
+		AccessToken:  "complement_at_" + util.RandomString(32),
+		RefreshToken: "complement_rt_" + util.RandomString(32),
+		ClientID:     clientID,
+		Subject:      subject,
+		Scopes:       scopes,
+		Claims:       claims,
+		IssuedAt:     now,
+		ExpiresAt:    now.Add(p.TokenLifetime),
+	}
+	p.accessTokens[tok.AccessToken] = tok
+	p.refreshTokens[tok.RefreshToken] = tok
+	return tok
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "authorize",
+		"token_endpoint":                        p.issuer + "token",
+		"jwks_uri":                              p.issuer + "jwks.json",
+		"introspection_endpoint":                p.issuer + "introspect",
+		"revocation_endpoint":                   p.issuer + "revoke",
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token", "client_credentials"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"scopes_supported":                      []string{"openid"},
+	})
+}
+
+func (p *Provider) handleAuthorize(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	authReq := AuthorizationRequest{
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scopes:              strings.Fields(q.Get("scope")),
+		State:               q.Get("state"),
+		Nonce:               q.Get("nonce"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+	}
+	p.mu.Lock()
+	client, ok := p.clients[authReq.ClientID]
+	consentFn := p.consent
+	p.mu.Unlock()
+	// Errors with the client or redirect URI must not redirect, per RFC 6749 section 4.1.2.1
+	if !ok {
+		writeOAuthError(w, 400, "invalid_client", "unknown client_id")
+		return
+	}
+	if !contains(client.RedirectURIs, authReq.RedirectURI) {
+		writeOAuthError(w, 400, "invalid_request", "redirect_uri is not registered for this client")
+		return
+	}
+	redirect, err := url.Parse(authReq.RedirectURI)
+	if err != nil {
+		writeOAuthError(w, 400, "invalid_request", "redirect_uri is not a valid URL")
+		return
+	}
+	params := redirect.Query()
+	if authReq.State != "" {
+		params.Set("state", authReq.State)
+	}
+	var consent Consent
+	switch {
+	case q.Get("response_type") != "code":
+		consent = Deny("unsupported_response_type", "only the code response type is supported")
+	case client.Secret == "" && authReq.CodeChallenge == "":
+		consent = Deny("invalid_request", "public clients must use PKCE")
+	default:
+		consent = consentFn(authReq)
+	}
+	if consent.Error != "" {
+		params.Set("error", consent.Error)
+		if consent.ErrorDescription != "" {
+			params.Set("error_description", consent.ErrorDescription)
+		}
+	} else {
+		code := "complement_code_" + util.RandomString(24)
+		p.mu.Lock()
+		p.codes[code] = authCode{req: authReq, consent: consent}
+		p.mu.Unlock()
+		params.Set("code", code)
+	}
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, req, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) handleToken(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", err.Error())
+		return
+	}
+	client, ok := p.authenticateClient(req)
+	if !ok {
+		writeOAuthError(w, 401, "invalid_client", "client authentication failed")
+		return
+	}
+	var tok *Token
+	var nonce string
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := req.PostForm.Get("code")
+		p.mu.Lock()
+		ac, ok := p.codes[code]
+		// codes are single use
+		delete(p.codes, code)
+		p.mu.Unlock()
+		if !ok || ac.req.ClientID != client.ID || ac.req.RedirectURI != req.PostForm.Get("redirect_uri") {
+			writeOAuthError(w, 400, "invalid_grant", "unknown code or mismatched client_id/redirect_uri")
+			return
+		}
+		if !verifyPKCE(ac.req.CodeChallenge, ac.req.CodeChallengeMethod, req.PostForm.Get("code_verifier")) {
+			writeOAuthError(w, 400, "invalid_grant", "code_verifier does not match code_challenge")
+			return
+		}
+		nonce = ac.req.Nonce
+		tok = p.issue(client.ID, ac.consent.Subject, ac.req.Scopes, ac.consent.Claims)
+	case "refresh_token":
+		p.mu.Lock()
+		old, ok := p.refreshTokens[req.PostForm.Get("refresh_token")]
+		if ok {
+			// refresh tokens are rotated on use
+			delete(p.refreshTokens, old.RefreshToken)
+		}
+		p.mu.Unlock()
+		if !ok || old.Revoked || old.ClientID != client.ID {
+			writeOAuthError(w, 400, "invalid_grant", "unknown or revoked refresh_token")
+			return
+		}
+		tok = p.issue(client.ID, old.Subject, old.Scopes, old.Claims)
+	case "client_credentials":
+		if client.Secret == "" {
+			writeOAuthError(w, 400, "unauthorized_client", "public clients cannot use client_credentials")
+			return
+		}
+		tok = p.issue(client.ID, client.ID, strings.Fields(req.PostForm.Get("scope")), nil)
+	default:
+		writeOAuthError(w, 400, "unsupported_grant_type", "")
+		return
+	}
+	res := map[string]interface{}{
+		"access_token":  tok.AccessToken,
+		"refresh_token": tok.RefreshToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(p.TokenLifetime.Seconds()),
+		"scope":         strings.Join(tok.Scopes, " "),
+	}
+	if contains(tok.Scopes, "openid") {
+		idToken, err := p.signIDToken(tok, nonce)
+		if err != nil {
+			writeOAuthError(w, 500, "server_error", err.Error())
+			return
+		}
+		res["id_token"] = idToken
+	}
+	writeJSON(w, 200, res)
+}
+
+func (p *Provider) handleJWKS(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"keys": []map[string]interface{}{
+			{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": p.keyID,
+				"n":   base64.RawURLEncoding.EncodeToString(p.key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.PublicKey.E)).Bytes()),
+			},
+		},
+	})
+}
+
+func (p *Provider) handleIntrospect(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", err.Error())
+		return
+	}
+	if _, ok := p.authenticateClient(req); !ok {
+		writeOAuthError(w, 401, "invalid_client", "client authentication failed")
+		return
+	}
+	p.mu.Lock()
+	tok, ok := p.accessTokens[req.PostForm.Get("token")]
+	var active bool
+	var res map[string]interface{}
+	if ok {
+		active = !tok.Revoked && time.Now().Before(tok.ExpiresAt)
+		res = tokenClaims(tok)
+	}
+	p.mu.Unlock()
+	if !active {
+		writeJSON(w, 200, map[string]interface{}{"active": false})
+		return
+	}
+	res["active"] = true
+	res["iss"] = p.issuer
+	res["token_type"] = "access_token"
+	res["scope"] = strings.Join(tok.Scopes, " ")
+	writeJSON(w, 200, res)
+}
+
+func (p *Provider) handleRevoke(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		writeOAuthError(w, 400, "invalid_request", err.Error())
+		return
+	}
+	if _, ok := p.authenticateClient(req); !ok {
+		writeOAuthError(w, 401, "invalid_client", "client authentication failed")
+		return
+	}
+	token := req.PostForm.Get("token")
+	p.mu.Lock()
+	if tok, ok := p.accessTokens[token]; ok {
+		tok.Revoked = true
+	}
+	if tok, ok := p.refreshTokens[token]; ok {
+		tok.Revoked = true
+	}
+	p.mu.Unlock()
+	// unknown tokens are not an error, per RFC 7009 section 2.2
+	writeJSON(w, 200, map[string]interface{}{})
+}
+
+// authenticateClient checks the client credentials using client_secret_basic, client_secret_post
+// or none (for public clients).
+func (p *Provider) authenticateClient(req *http.Request) (Client, bool) {
+	clientID, secret, hasBasic := req.BasicAuth()
+	if !hasBasic {
+		clientID = req.PostForm.Get("client_id")
+		secret = req.PostForm.Get("client_secret")
+	}
+	p.mu.Lock()
+	client, ok := p.clients[clientID]
+	p.mu.Unlock()
+	if !ok {
+		return Client{}, false
+	}
+	if client.Secret == "" {
+		return client, secret == ""
+	}
+	return client, subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) == 1
+}
+
+func (p *Provider) signIDToken(tok *Token, nonce string) (string, error) {
+	claims := tokenClaims(tok)
+	claims["iss"] = p.issuer
+	claims["aud"] = tok.ClientID
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": p.keyID,
+	})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// tokenClaims returns the claims about the token which are shared between ID tokens and introspection responses.
+func tokenClaims(tok *Token) map[string]interface{} {
+	claims := make(map[string]interface{}, len(tok.Claims)+4)
+	for k, v := range tok.Claims {
+		claims[k] = v
+	}
+	claims["sub"] = tok.Subject
+	claims["client_id"] = tok.ClientID
+	claims["iat"] = tok.IssuedAt.Unix()
+	claims["exp"] = tok.ExpiresAt.Unix()
+	return claims
+}
+
+func verifyPKCE(challenge, method, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+	switch method {
+	case "S256":
+		sum := sha256.Sum256([]byte(verifier))
+		return base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+	case "plain", "":
+		return verifier == challenge
+	}
+	return false
+}
+
+func writeOAuthError(w http.ResponseWriter, code int, errCode, description string) {
+	res := map[string]interface{}{"error": errCode}
+	if description != "" {
+		res["error_description"] = description
+	}
+	writeJSON(w, code, res)
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+func contains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/config"
+)
+
+type oidcDeploy struct {
+	cfg *config.Complement
+}
+
+func (d *oidcDeploy) GetConfig() *config.Complement {
+	return d.cfg
+}
+
+func TestProviderAuthorizationCodeFlow(t *testing.T) {
+	cfg := config.NewConfigFromEnvVars("test", "unimportant")
+	cfg.HostnameRunningComplement = "localhost"
+	p := NewProvider(t, &oidcDeploy{cfg: cfg}, WithClient(Client{
+		ID:           "synapse",
+		Secret:       "s3cret",
+		RedirectURIs: []string{"http://localhost/callback"},
+	}))
+	cancel := p.Listen()
+	defer cancel()
+
+	verifier := "complement-verifier-complement-verifier-1234"
+	sum := sha256.Sum256([]byte(verifier))
+	authURL := p.Issuer() + "authorize?" + url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"synapse"},
+		"redirect_uri":          {"http://localhost/callback"},
+		"scope":                 {"openid"},
+		"state":                 {"xyz"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+
+	// denied by default
+	redirect := p.Authorize(t, authURL)
+	if redirect.Query().Get("error") != "access_denied" || redirect.Query().Get("state") != "xyz" {
+		t.Fatalf("expected access_denied redirect, got %s", redirect)
+	}
+
+	p.SetConsent(func(req AuthorizationRequest) Consent {
+		c := Approve("alice")
+		c.Claims = map[string]interface{}{"username": "alice"}
+		return c
+	})
+	redirect = p.Authorize(t, authURL)
+	code := redirect.Query().Get("code")
+	if code == "" {
+		t.Fatalf("expected code in redirect, got %s", redirect)
+	}
+
+	postForm := func(path string, form url.Values) map[string]interface{} {
+		req, _ := http.NewRequest("POST", p.Issuer()+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("synapse", "s3cret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %s", path, err)
+		}
+		defer res.Body.Close()
+		var body map[string]interface{}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatalf("POST %s: failed to decode response: %s", path, err)
+		}
+		return body
+	}
+	tokenRes := postForm("token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"http://localhost/callback"},
+		"code_verifier": {verifier},
+	})
+	accessToken, _ := tokenRes["access_token"].(string)
+	if accessToken == "" || tokenRes["id_token"] == nil {
+		t.Fatalf("expected access_token and id_token, got %v", tokenRes)
+	}
+
+	// codes are single use
+	replay := postForm("token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {"http://localhost/callback"},
+		"code_verifier": {verifier},
+	})
+	if replay["error"] != "invalid_grant" {
+		t.Fatalf("expected invalid_grant on code reuse, got %v", replay)
+	}
+
+	introspection := postForm("introspect", url.Values{"token": {accessToken}})
+	if introspection["active"] != true || introspection["sub"] != "alice" || introspection["username"] != "alice" {
+		t.Fatalf("unexpected introspection response: %v", introspection)
+	}
+	p.RevokeToken(accessToken)
+	introspection = postForm("introspect", url.Values{"token": {accessToken}})
+	if introspection["active"] != false {
+		t.Fatalf("expected revoked token to be inactive, got %v", introspection)
+	}
+}
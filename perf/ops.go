@@ -0,0 +1,52 @@
+package perf
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// SendMessage returns an op which sends a text message into the room. All clients must be joined.
+func SendMessage(roomID string, weight int) Op {
+	return Op{
+		Name:   "send",
+		Weight: weight,
+		Do: func(t ct.TestLike, c *client.CSAPI) *http.Response {
+			return c.Do(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "send", "m.room.message", helpers.GetTxnID("perf")},
+				client.WithJSONBody(t, map[string]interface{}{
+					"msgtype": "m.text",
+					"body":    "perf",
+				}),
+			)
+		},
+	}
+}
+
+// InitialSync returns an op which performs a /sync with no since token and timeout=0.
+func InitialSync(weight int) Op {
+	return Op{
+		Name:   "sync",
+		Weight: weight,
+		Do: func(t ct.TestLike, c *client.CSAPI) *http.Response {
+			return c.Do(t, "GET", []string{"_matrix", "client", "v3", "sync"}, client.WithQueries(map[string][]string{
+				"timeout": {"0"},
+			}))
+		},
+	}
+}
+
+// Messages returns an op which paginates backwards through the most recent messages in the room.
+func Messages(roomID string, weight int) Op {
+	return Op{
+		Name:   "messages",
+		Weight: weight,
+		Do: func(t ct.TestLike, c *client.CSAPI) *http.Response {
+			return c.Do(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "messages"}, client.WithQueries(map[string][]string{
+				"dir":   {"b"},
+				"limit": {"20"},
+			}))
+		},
+	}
+}
@@ -0,0 +1,241 @@
+// package perf contains a harness for driving concurrent traffic against a deployment, collecting
+// latency percentiles per endpoint, and failing the test if latency objectives are not met. This
+// allows Complement to act as a basic performance gate.
+//
+// Load tests are slow and timing sensitive, so should only be run when COMPLEMENT_LONG_MODE is enabled.
+package perf
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Op is a single kind of request in a traffic mix.
+type Op struct {
+	// The name to collect latencies under, typically the endpoint e.g "send" or "sync".
+	Name string
+	// The relative weight of this op in the mix. Ops with a weight of 0 are treated as 1.
+	Weight int
+	// Do makes the request using the given client. The time taken by Do is recorded as the latency.
+	// Responses which are not 2xx are counted as errors.
+	Do func(t ct.TestLike, c *client.CSAPI) *http.Response
+}
+
+// Opts configures a load test.
+type Opts struct {
+	// The clients to make requests with. A random client is picked for each request. Required.
+	Clients []*client.CSAPI
+	// The number of workers making requests concurrently. Default: len(Clients).
+	Concurrency int
+	// The total number of requests to make across all workers. Either this or Duration must be set.
+	Requests int
+	// How long to run for. If set, takes priority over Requests.
+	Duration time.Duration
+	// The seed for picking ops and clients. The mix of requests is deterministic for a given seed
+	// when Requests is used, though the interleaving between workers is not.
+	Seed int64
+	// The traffic mix to drive. Required.
+	Mix []Op
+}
+
+// Stats are the latencies collected for a single op.
+type Stats struct {
+	Name      string
+	Count     int
+	Errors    int
+	latencies []time.Duration // sorted
+}
+
+// Percentile returns the latency at the given percentile, between 0 and 100.
+func (s *Stats) Percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(s.latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(s.latencies) {
+		i = len(s.latencies) - 1
+	}
+	return s.latencies[i]
+}
+
+// ErrorRate returns the fraction of requests which were not 2xx, between 0 and 1.
+func (s *Stats) ErrorRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Count)
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf(
+		"%s: n=%d errors=%d p50=%v p95=%v p99=%v",
+		s.Name, s.Count, s.Errors, s.Percentile(50), s.Percentile(95), s.Percentile(99),
+	)
+}
+
+// Result is the outcome of a load test.
+type Result struct {
+	// Stats for each op, keyed by Op.Name.
+	Ops      map[string]*Stats
+	Duration time.Duration
+}
+
+func (r *Result) String() string {
+	names := make([]string, 0, len(r.Ops))
+	for name := range r.Ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{fmt.Sprintf("%d ops in %v", len(names), r.Duration)}
+	for _, name := range names {
+		lines = append(lines, r.Ops[name].String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// SLO is a latency objective for an op. Zero latencies are not checked.
+type SLO struct {
+	P50 time.Duration
+	P95 time.Duration
+	P99 time.Duration
+	// The maximum fraction of requests which may fail, between 0 and 1. Default: 0, no failures.
+	MaxErrorRate float64
+}
+
+// Run drives the traffic mix against the deployment and returns the collected latencies. The
+// results are logged.
+func Run(t ct.TestLike, opts Opts) *Result {
+	t.Helper()
+	if len(opts.Clients) == 0 || len(opts.Mix) == 0 {
+		ct.Fatalf(t, "perf.Run: Clients and Mix must be set")
+	}
+	if opts.Requests == 0 && opts.Duration == 0 {
+		ct.Fatalf(t, "perf.Run: one of Requests or Duration must be set")
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = len(opts.Clients)
+	}
+	var weighted []int
+	for i, op := range opts.Mix {
+		weight := op.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		for j := 0; j < weight; j++ {
+			weighted = append(weighted, i)
+		}
+	}
+
+	// Requests are picked by a single goroutine so the mix does not depend on worker scheduling.
+	type request struct {
+		op          int
+		clientIndex int
+	}
+	rng := rand.New(rand.NewSource(opts.Seed))
+	next := func() request {
+		return request{
+			op:          weighted[rng.Intn(len(weighted))],
+			clientIndex: rng.Intn(len(opts.Clients)),
+		}
+	}
+	requests := make(chan request, opts.Concurrency)
+	stop := make(chan struct{})
+	go func() {
+		defer close(requests)
+		var deadline <-chan time.Time
+		if opts.Duration > 0 {
+			deadline = time.After(opts.Duration)
+		}
+		for i := 0; opts.Duration > 0 || i < opts.Requests; i++ {
+			select {
+			case requests <- next():
+			case <-deadline:
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	result := &Result{
+		Ops: make(map[string]*Stats),
+	}
+	for _, op := range opts.Mix {
+		result.Ops[op.Name] = &Stats{Name: op.Name}
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(opts.Concurrency)
+	for w := 0; w < opts.Concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			for req := range requests {
+				op := opts.Mix[req.op]
+				reqStart := time.Now()
+				res := op.Do(t, opts.Clients[req.clientIndex])
+				latency := time.Since(reqStart)
+				if res != nil && res.Body != nil {
+					io.Copy(io.Discard, res.Body)
+					res.Body.Close()
+				}
+				mu.Lock()
+				stats := result.Ops[op.Name]
+				stats.Count++
+				stats.latencies = append(stats.latencies, latency)
+				if res == nil || res.StatusCode < 200 || res.StatusCode >= 300 {
+					stats.Errors++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	result.Duration = time.Since(start)
+	for _, stats := range result.Ops {
+		sort.Slice(stats.latencies, func(i, j int) bool {
+			return stats.latencies[i] < stats.latencies[j]
+		})
+	}
+	t.Logf("perf.Run: %s", result)
+	return result
+}
+
+// MustMeetSLOs fails the test if any op exceeds its objective. Ops without an objective are not checked.
+func (r *Result) MustMeetSLOs(t ct.TestLike, slos map[string]SLO) {
+	t.Helper()
+	for name, slo := range slos {
+		stats, ok := r.Ops[name]
+		if !ok || stats.Count == 0 {
+			ct.Errorf(t, "perf: no requests were made for op '%s'", name)
+			continue
+		}
+		for _, check := range []struct {
+			percentile float64
+			max        time.Duration
+		}{{50, slo.P50}, {95, slo.P95}, {99, slo.P99}} {
+			if check.max == 0 {
+				continue
+			}
+			if got := stats.Percentile(check.percentile); got > check.max {
+				ct.Errorf(t, "perf: %s: p%v latency %v exceeds SLO of %v", name, check.percentile, got, check.max)
+			}
+		}
+		if rate := stats.ErrorRate(); rate > slo.MaxErrorRate {
+			ct.Errorf(t, "perf: %s: error rate %.2f%% exceeds SLO of %.2f%%", name, rate*100, slo.MaxErrorRate*100)
+		}
+	}
+}
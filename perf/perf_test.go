@@ -0,0 +1,56 @@
+package perf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	s := &Stats{}
+	for i := 1; i <= 100; i++ {
+		s.latencies = append(s.latencies, time.Duration(i)*time.Millisecond)
+	}
+	testCases := map[float64]time.Duration{
+		0:   1 * time.Millisecond,
+		50:  50 * time.Millisecond,
+		95:  95 * time.Millisecond,
+		99:  99 * time.Millisecond,
+		100: 100 * time.Millisecond,
+	}
+	for p, want := range testCases {
+		if got := s.Percentile(p); got != want {
+			t.Errorf("p%v: got %v want %v", p, got, want)
+		}
+	}
+	if got := (&Stats{}).Percentile(50); got != 0 {
+		t.Errorf("empty stats: got %v want 0", got)
+	}
+}
+
+func TestRegressions(t *testing.T) {
+	baseline := Report{
+		Image: "old",
+		Ops: map[string]OpSummary{
+			"initial_sync":     {P50Ms: 100, P95Ms: 200},
+			"incremental_sync": {P50Ms: 2, P95Ms: 4},
+			"missing":          {P50Ms: 100, P95Ms: 200},
+		},
+	}
+	report := Report{
+		Image: "new",
+		Ops: map[string]OpSummary{
+			// p95 regressed by 50%
+			"initial_sync": {P50Ms: 110, P95Ms: 300},
+			// regressed by 400%, but by less than minRegression
+			"incremental_sync": {P50Ms: 10, P95Ms: 12},
+		},
+	}
+	got := report.Regressions(baseline, 20)
+	want := []string{"initial_sync: p95 latency 300.0ms is 50% slower than 200.0ms with old"}
+	if len(got) != len(want) || (len(got) > 0 && got[0] != want[0]) {
+		t.Errorf("got %q want %q", got, want)
+	}
+	if got := report.Regressions(baseline, 60); len(got) != 0 {
+		t.Errorf("got %q want no regressions", got)
+	}
+}
@@ -0,0 +1,120 @@
+package perf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/artifacts"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Regressions smaller than this are ignored, as they are within the noise of a test run.
+const minRegression = 10 * time.Millisecond
+
+// Report is a summary of a Result which can be compared with later runs, e.g against a newer homeserver
+// image.
+type Report struct {
+	// The image the results were collected against, COMPLEMENT_BASE_IMAGE.
+	Image string               `json:"image"`
+	Ops   map[string]OpSummary `json:"ops"`
+}
+
+// OpSummary is a summary of the Stats of an op.
+type OpSummary struct {
+	Count  int     `json:"count"`
+	Errors int     `json:"errors"`
+	P50Ms  float64 `json:"p50_ms"`
+	P95Ms  float64 `json:"p95_ms"`
+	P99Ms  float64 `json:"p99_ms"`
+}
+
+// Report returns a summary of the result, collected against `image`.
+func (r *Result) Report(image string) Report {
+	report := Report{
+		Image: image,
+		Ops:   make(map[string]OpSummary, len(r.Ops)),
+	}
+	for name, stats := range r.Ops {
+		report.Ops[name] = OpSummary{
+			Count:  stats.Count,
+			Errors: stats.Errors,
+			P50Ms:  toMs(stats.Percentile(50)),
+			P95Ms:  toMs(stats.Percentile(95)),
+			P99Ms:  toMs(stats.Percentile(99)),
+		}
+	}
+	return report
+}
+
+// Regressions returns a description of each op whose p50 or p95 latency is more than `maxPercent`
+// percent slower than in the baseline. Ops which are not in the baseline are ignored.
+func (r Report) Regressions(baseline Report, maxPercent float64) []string {
+	names := make([]string, 0, len(baseline.Ops))
+	for name := range baseline.Ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var regressions []string
+	for _, name := range names {
+		got, ok := r.Ops[name]
+		if !ok {
+			continue
+		}
+		want := baseline.Ops[name]
+		for _, check := range []struct {
+			percentile    string
+			gotMs, wantMs float64
+		}{{"p50", got.P50Ms, want.P50Ms}, {"p95", got.P95Ms, want.P95Ms}} {
+			if check.gotMs-check.wantMs < toMs(minRegression) || check.gotMs <= check.wantMs*(1+maxPercent/100) {
+				continue
+			}
+			regressions = append(regressions, fmt.Sprintf(
+				"%s: %s latency %.1fms is %.0f%% slower than %.1fms with %s",
+				name, check.percentile, check.gotMs, (check.gotMs/check.wantMs-1)*100, check.wantMs, baseline.Image,
+			))
+		}
+	}
+	return regressions
+}
+
+// MustRecord writes the report of the result to `$name.json` in the artifacts directory of the test. If
+// COMPLEMENT_PERF_BASELINE_DIR is set, the report is compared with the report of the same name and test
+// in that directory, failing the test if it has regressed by more than
+// COMPLEMENT_PERF_MAX_REGRESSION_PERCENT. Returns the report.
+func (r *Result) MustRecord(t ct.TestLike, name string) Report {
+	t.Helper()
+	cfg := complement.GetConfig(t)
+	report := r.Report(cfg.BaseImageURI)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		ct.Fatalf(t, "perf.MustRecord: failed to marshal report: %s", err)
+	}
+	complement.WriteArtifact(t, name+".json", data)
+	if cfg.PerfBaselineDir == "" {
+		return report
+	}
+	data, err = artifacts.New(cfg.PerfBaselineDir).ReadFile(t.Name(), name+".json")
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Logf("perf.MustRecord: no baseline for %s in %s, not checking for regressions", name, cfg.PerfBaselineDir)
+		return report
+	} else if err != nil {
+		ct.Fatalf(t, "perf.MustRecord: failed to read baseline: %s", err)
+	}
+	var baseline Report
+	if err = json.Unmarshal(data, &baseline); err != nil {
+		ct.Fatalf(t, "perf.MustRecord: failed to parse baseline: %s", err)
+	}
+	for _, regression := range report.Regressions(baseline, cfg.PerfMaxRegressionPercent) {
+		ct.Errorf(t, "perf: %s", regression)
+	}
+	return report
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
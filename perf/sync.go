@@ -0,0 +1,124 @@
+package perf
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// SyncOpts configures MeasureSync.
+type SyncOpts struct {
+	// The client to sync as. Required.
+	Client *client.CSAPI
+	// Sends the events which incremental syncs wait for. Must be joined to RoomID. Required.
+	Sender *client.CSAPI
+	// The room to send events into, which the client must be joined to. Required.
+	RoomID string
+	// The number of initial and incremental syncs to make. Default: 10.
+	Iterations int
+	// The filter to sync with, as JSON or a filter ID e.g to enable lazy-loading members. Optional.
+	Filter string
+}
+
+// MeasureSync measures the latency of initial syncs, as "initial_sync", and of incremental syncs, as
+// "incremental_sync". The latency of an incremental sync is the time from an event being sent until a
+// long-polling sync returns it, so includes the time taken for the homeserver to wake up the sync.
+// Syncs are made one at a time, so the latencies are not affected by other requests. Fails the test if
+// an incremental sync does not return the event within CSAPI.SyncUntilTimeout.
+func MeasureSync(t ct.TestLike, opts SyncOpts) *Result {
+	t.Helper()
+	if opts.Client == nil || opts.Sender == nil || opts.RoomID == "" {
+		ct.Fatalf(t, "perf.MeasureSync: Client, Sender and RoomID must be set")
+	}
+	if opts.Iterations == 0 {
+		opts.Iterations = 10
+	}
+	initial := &Stats{Name: "initial_sync"}
+	incremental := &Stats{Name: "incremental_sync"}
+	start := time.Now()
+	var since string
+	for i := 0; i < opts.Iterations; i++ {
+		syncStart := time.Now()
+		res := opts.Client.Do(t, "GET", []string{"_matrix", "client", "v3", "sync"}, client.WithQueries(syncQuery(opts.Filter, "", 0)))
+		initial.record(time.Since(syncStart), res.StatusCode)
+		since = gjson.GetBytes(client.ParseJSON(t, res), "next_batch").Str
+	}
+	for i := 0; i < opts.Iterations; i++ {
+		eventID := opts.Sender.Unsafe_SendEventUnsynced(t, opts.RoomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "perf",
+			},
+		})
+		sent := time.Now()
+		for {
+			res := opts.Client.Do(t, "GET", []string{"_matrix", "client", "v3", "sync"}, client.WithQueries(syncQuery(opts.Filter, since, 10*time.Second)))
+			if res.StatusCode != 200 {
+				incremental.record(time.Since(sent), res.StatusCode)
+				res.Body.Close()
+				break
+			}
+			body := client.ParseJSON(t, res)
+			since = gjson.GetBytes(body, "next_batch").Str
+			if timelineContains(body, opts.RoomID, eventID) {
+				incremental.record(time.Since(sent), res.StatusCode)
+				break
+			}
+			if time.Since(sent) > opts.Client.SyncUntilTimeout {
+				ct.Fatalf(t, "perf.MeasureSync: timed out after %v waiting for event %s in incremental sync", time.Since(sent), eventID)
+			}
+		}
+	}
+	result := &Result{
+		Ops: map[string]*Stats{
+			initial.Name:     initial,
+			incremental.Name: incremental,
+		},
+		Duration: time.Since(start),
+	}
+	for _, stats := range result.Ops {
+		sort.Slice(stats.latencies, func(i, j int) bool {
+			return stats.latencies[i] < stats.latencies[j]
+		})
+	}
+	t.Logf("perf.MeasureSync: %s", result)
+	return result
+}
+
+func (s *Stats) record(latency time.Duration, statusCode int) {
+	s.Count++
+	s.latencies = append(s.latencies, latency)
+	if statusCode < 200 || statusCode >= 300 {
+		s.Errors++
+	}
+}
+
+func syncQuery(filter, since string, timeout time.Duration) url.Values {
+	query := url.Values{
+		"timeout": []string{strconv.FormatInt(timeout.Milliseconds(), 10)},
+	}
+	if filter != "" {
+		query.Set("filter", filter)
+	}
+	if since != "" {
+		query.Set("since", since)
+	}
+	return query
+}
+
+func timelineContains(syncBody []byte, roomID, eventID string) bool {
+	found := false
+	gjson.GetBytes(syncBody, "rooms.join."+client.GjsonEscape(roomID)+".timeline.events").ForEach(func(_, ev gjson.Result) bool {
+		found = ev.Get("event_id").Str == eventID
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,50 @@
+package complement
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// PrebuildBlueprints constructs the given blueprints in parallel, if they do not already exist in the docker
+// image cache. This allows CI to warm the image cache in a separate step before running `go test`, so tests
+// start instantly.
+//
+// The config must have the same package namespace (and base image) as the test package which will use the
+// blueprints, e.g `config.NewConfigFromEnvVars("csapi", "")`, and COMPLEMENT_UNIQUE_NAMESPACE must not be set.
+// Prebuilt images are kept when the test package starts, and removed when it exits. Use NumServersBlueprint
+// to prebuild the blueprints used by Deploy(t, numServers).
+func PrebuildBlueprints(cfg *config.Complement, blueprints ...b.Blueprint) error {
+	if cfg.UniqueNamespace {
+		return fmt.Errorf("PrebuildBlueprints: blueprints cannot be prebuilt when COMPLEMENT_UNIQUE_NAMESPACE is set")
+	}
+	builder, err := docker.NewBuilder(cfg)
+	if err != nil {
+		return fmt.Errorf("PrebuildBlueprints: failed to make docker builder: %w", err)
+	}
+	builder.Prebuild = true
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(blueprints))
+	for i := range blueprints {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = builder.ConstructBlueprintIfNotExist(blueprints[i])
+		}(i)
+	}
+	wg.Wait()
+	var failed []error
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("PrebuildBlueprints: failed to construct %d/%d blueprints: %v", len(failed), len(blueprints), failed)
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package complement
+
+import (
+	"context"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// CaptureProfiles runs COMPLEMENT_PROFILE_COMMAND in every homeserver container now, writing the output
+// to the artifacts directory of the test, e.g before a step which is known to be slow on some
+// homeservers. Profiles are also captured automatically for tests which are still running after
+// COMPLEMENT_PROFILE_AFTER_SECS. Does nothing if COMPLEMENT_PROFILE_COMMAND or COMPLEMENT_ARTIFACTS_DIR
+// are not set. Skips the test if the deployment is not a Docker deployment.
+func CaptureProfiles(t ct.TestLike, deployment Deployment) {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(*docker.Deployment)
+	if !ok {
+		t.Skipf("CaptureProfiles: deployment %T is not a Docker deployment", deployment)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := dep.Deployer.CaptureProfiles(ctx, dep, t.Name()); err != nil {
+		ct.Errorf(t, "CaptureProfiles: %s", err)
+	}
+}
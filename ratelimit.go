@@ -0,0 +1,33 @@
+package complement
+
+import (
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// DisableRateLimiting disables rate limiting on the homeserver `hsName` for every user known to the
+// deployment, including users registered later, so tests can make requests in bulk regardless of how
+// the homeserver image configures its rate limits. Tests which exercise rate limiting should instead
+// use EnableRateLimiting, or override the limits of individual users via CSAPI.SetRateLimitOverride.
+// Skips the test if the deployment is not a Docker deployment, or if the homeserver does not support
+// rate limit overrides.
+func DisableRateLimiting(t ct.TestLike, deployment Deployment, hsName string) {
+	t.Helper()
+	setRateLimiting(t, "DisableRateLimiting", deployment, hsName, false)
+}
+
+// EnableRateLimiting undoes DisableRateLimiting, so the homeserver's configured rate limits apply to
+// every user known to the deployment again.
+func EnableRateLimiting(t ct.TestLike, deployment Deployment, hsName string) {
+	t.Helper()
+	setRateLimiting(t, "EnableRateLimiting", deployment, hsName, true)
+}
+
+func setRateLimiting(t ct.TestLike, caller string, deployment Deployment, hsName string, enabled bool) {
+	t.Helper()
+	dep, ok := unwrapDeployment(deployment).(*docker.Deployment)
+	if !ok {
+		t.Skipf("%s: deployment %T is not a Docker deployment", caller, deployment)
+	}
+	dep.SetRateLimiting(t, hsName, enabled)
+}
@@ -0,0 +1,212 @@
+// Package roomupgrade contains a reusable conformance kit for room upgrades. For each pair of room
+// versions, it upgrades a room and checks that transferable state is carried over, that the old and new
+// rooms are linked, and optionally that a remote homeserver can follow the upgrade over federation.
+//
+// Homeservers opt into which version pairs are checked via Opts.Pairs, which can be built with
+// Consecutive (the default) or Matrix.
+package roomupgrade
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+// Pair is an upgrade of a room from one room version to another.
+type Pair struct {
+	From string
+	To   string
+}
+
+func (p Pair) String() string {
+	return fmt.Sprintf("v%s to v%s", p.From, p.To)
+}
+
+// Consecutive returns the upgrade from each version to the next, after sorting the versions.
+func Consecutive(versions []string) []Pair {
+	versions = sortVersions(versions)
+	var pairs []Pair
+	for i := 1; i < len(versions); i++ {
+		pairs = append(pairs, Pair{From: versions[i-1], To: versions[i]})
+	}
+	return pairs
+}
+
+// Matrix returns the upgrade from each version to every later version, after sorting the versions.
+// This is quadratic in the number of versions, so homeservers should opt into it deliberately.
+func Matrix(versions []string) []Pair {
+	versions = sortVersions(versions)
+	var pairs []Pair
+	for i := range versions {
+		for j := i + 1; j < len(versions); j++ {
+			pairs = append(pairs, Pair{From: versions[i], To: versions[j]})
+		}
+	}
+	return pairs
+}
+
+// sortVersions sorts numeric versions numerically, followed by any other versions lexically.
+func sortVersions(versions []string) []string {
+	sorted := append([]string(nil), versions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, errA := strconv.Atoi(sorted[i])
+		b, errB := strconv.Atoi(sorted[j])
+		switch {
+		case errA == nil && errB == nil:
+			return a < b
+		case errA == nil:
+			return true
+		case errB == nil:
+			return false
+		default:
+			return sorted[i] < sorted[j]
+		}
+	})
+	return sorted
+}
+
+// StableVersions returns the room versions which the homeserver advertises as stable in its
+// capabilities.
+func StableVersions(t ct.TestLike, c *client.CSAPI) []string {
+	t.Helper()
+	capabilities := c.GetCapabilities(t)
+	var versions []string
+	gjson.GetBytes(capabilities, `capabilities.m\.room_versions.available`).ForEach(func(k, v gjson.Result) bool {
+		if v.Str == "stable" {
+			versions = append(versions, k.Str)
+		}
+		return true
+	})
+	return sortVersions(versions)
+}
+
+// Opts configure Run.
+type Opts struct {
+	// The upgrades to check. Defaults to Consecutive(StableVersions(...)) of the local homeserver.
+	Pairs []Pair
+	// The homeserver which creates and upgrades the rooms. Defaults to hs1.
+	LocalHS string
+	// If set, a user on this homeserver joins each room before it is upgraded, then checks they see
+	// the tombstone and can follow it to the new room over federation.
+	RemoteHS string
+}
+
+// transferableState is the state which the spec says must be copied to the new room, with the content
+// the old room is created with.
+var transferableState = []b.Event{
+	{Type: "m.room.name", StateKey: b.Ptr(""), Content: map[string]interface{}{"name": "Upgrade me"}},
+	{Type: "m.room.topic", StateKey: b.Ptr(""), Content: map[string]interface{}{"topic": "Room upgrade conformance"}},
+	{Type: "m.room.avatar", StateKey: b.Ptr(""), Content: map[string]interface{}{"url": "mxc://example.org/upgrade"}},
+	{Type: "m.room.history_visibility", StateKey: b.Ptr(""), Content: map[string]interface{}{"history_visibility": "joined"}},
+	{Type: "m.room.guest_access", StateKey: b.Ptr(""), Content: map[string]interface{}{"guest_access": "can_join"}},
+	{Type: "m.room.join_rules", StateKey: b.Ptr(""), Content: map[string]interface{}{"join_rule": "public"}},
+	{Type: "m.room.encryption", StateKey: b.Ptr(""), Content: map[string]interface{}{"algorithm": "m.megolm.v1.aes-sha2"}},
+}
+
+// Run performs each upgrade in a subtest, checking that:
+//   - the old room gets an m.room.tombstone pointing at the new room,
+//   - the new room has the new version, and its create event points at the old room,
+//   - transferable state and the power levels of users are carried over,
+//   - if Opts.RemoteHS is set, a remote user sees the tombstone, can join the new room, and can see
+//     messages in it.
+func Run(t *testing.T, deployment complement.Deployment, opts Opts) {
+	t.Helper()
+	if opts.LocalHS == "" {
+		opts.LocalHS = "hs1"
+	}
+	alice := deployment.Register(t, opts.LocalHS, helpers.RegistrationOpts{LocalpartSuffix: "upgrader"})
+	// a user who is not a creator, so has an entry in the power levels of every room version
+	moderator := deployment.Register(t, opts.LocalHS, helpers.RegistrationOpts{LocalpartSuffix: "moderator"})
+	var remote *client.CSAPI
+	if opts.RemoteHS != "" {
+		remote = deployment.Register(t, opts.RemoteHS, helpers.RegistrationOpts{LocalpartSuffix: "remote"})
+	}
+	if opts.Pairs == nil {
+		opts.Pairs = Consecutive(StableVersions(t, alice))
+	}
+	if len(opts.Pairs) == 0 {
+		t.Skipf("roomupgrade.Run: no room version pairs to check")
+	}
+	for _, pair := range opts.Pairs {
+		pair := pair
+		t.Run(pair.String(), func(t *testing.T) {
+			checkUpgrade(t, deployment, opts, pair, alice, moderator, remote)
+		})
+	}
+}
+
+func checkUpgrade(t *testing.T, deployment complement.Deployment, opts Opts, pair Pair, alice, moderator, remote *client.CSAPI) {
+	t.Helper()
+	oldRoomID := alice.MustCreateRoom(t, map[string]interface{}{
+		"preset":        "public_chat",
+		"room_version":  pair.From,
+		"initial_state": transferableState,
+		"power_level_content_override": map[string]interface{}{
+			"users": map[string]interface{}{
+				alice.UserID:     100,
+				moderator.UserID: 50,
+			},
+		},
+	})
+	moderator.MustJoinRoom(t, oldRoomID, nil)
+	var remoteSince string
+	if remote != nil {
+		remote.MustJoinRoom(t, oldRoomID, []spec.ServerName{deployment.GetFullyQualifiedHomeserverName(t, opts.LocalHS)})
+		_, remoteSince = remote.MustSync(t, client.SyncReq{TimeoutMillis: "0"})
+	}
+
+	newRoomID := alice.MustUpgradeRoom(t, oldRoomID, pair.To)
+
+	// the old room is linked to the new room
+	tombstone := alice.MustGetStateEventContent(t, oldRoomID, "m.room.tombstone", "")
+	must.MatchGJSON(t, tombstone, match.JSONKeyEqual("replacement_room", newRoomID))
+
+	// the new room is linked to the old room, and has the new version
+	create := alice.MustGetStateEventContent(t, newRoomID, "m.room.create", "")
+	must.MatchGJSON(t, create,
+		match.JSONKeyEqual("predecessor.room_id", oldRoomID),
+		match.JSONKeyEqual("room_version", pair.To),
+	)
+
+	// transferable state is carried over
+	for _, ev := range transferableState {
+		got := alice.MustGetStateEventContent(t, newRoomID, ev.Type, *ev.StateKey)
+		if !reflect.DeepEqual(got.Value(), ev.Content) {
+			ct.Errorf(t, "%s was not carried over: got %s want %v", ev.Type, got.Raw, ev.Content)
+		}
+	}
+	pl := alice.MustGetStateEventContent(t, newRoomID, "m.room.power_levels", "")
+	must.MatchGJSON(t, pl, match.JSONKeyEqual("users."+client.GjsonEscape(moderator.UserID), float64(50)))
+
+	if remote == nil {
+		return
+	}
+	// the remote user sees the tombstone and can follow it over federation
+	remote.MustSyncUntil(t, client.SyncReq{Since: remoteSince}, client.SyncTimelineHas(oldRoomID, func(ev gjson.Result) bool {
+		return ev.Get("type").Str == "m.room.tombstone" && ev.Get("content.replacement_room").Str == newRoomID
+	}))
+	remote.MustJoinRoom(t, newRoomID, []spec.ServerName{deployment.GetFullyQualifiedHomeserverName(t, opts.LocalHS)})
+	remoteCreate := remote.MustGetStateEventContent(t, newRoomID, "m.room.create", "")
+	must.MatchGJSON(t, remoteCreate, match.JSONKeyEqual("predecessor.room_id", oldRoomID))
+	eventID := alice.SendEventSynced(t, newRoomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "after the upgrade",
+		},
+	})
+	remote.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(newRoomID, eventID))
+}
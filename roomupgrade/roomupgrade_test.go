@@ -0,0 +1,32 @@
+package roomupgrade
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPairs(t *testing.T) {
+	versions := []string{"10", "org.example.custom", "9", "11"}
+	wantConsecutive := []Pair{
+		{From: "9", To: "10"},
+		{From: "10", To: "11"},
+		{From: "11", To: "org.example.custom"},
+	}
+	if got := Consecutive(versions); !reflect.DeepEqual(got, wantConsecutive) {
+		t.Errorf("Consecutive: got %v want %v", got, wantConsecutive)
+	}
+	wantMatrix := []Pair{
+		{From: "9", To: "10"},
+		{From: "9", To: "11"},
+		{From: "9", To: "org.example.custom"},
+		{From: "10", To: "11"},
+		{From: "10", To: "org.example.custom"},
+		{From: "11", To: "org.example.custom"},
+	}
+	if got := Matrix(versions); !reflect.DeepEqual(got, wantMatrix) {
+		t.Errorf("Matrix: got %v want %v", got, wantMatrix)
+	}
+	if got := Consecutive([]string{"1"}); len(got) != 0 {
+		t.Errorf("Consecutive of one version: got %v want none", got)
+	}
+}
@@ -0,0 +1,179 @@
+package scenario
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Recorder records interactions with a deployment into a Scenario. Only client-server API traffic is
+// recorded: federation traffic between homeservers, or to a Complement federation server, is not, as it
+// cannot be replayed without the federation server. Scenarios of tests which rely on federation
+// requests (e.g a federation.Server sending events into a room) will therefore not replay the same.
+type Recorder struct {
+	mu       sync.Mutex
+	scenario Scenario
+}
+
+// NewRecorder makes a new recorder for a scenario with the given name, typically `t.Name()`.
+func NewRecorder(name string) *Recorder {
+	return &Recorder{
+		scenario: Scenario{Name: name},
+	}
+}
+
+// Scenario returns a copy of the scenario recorded so far.
+func (r *Recorder) Scenario() *Scenario {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sc := Scenario{
+		Name:         r.scenario.Name,
+		Interactions: make([]Interaction, len(r.scenario.Interactions)),
+	}
+	copy(sc.Interactions, r.scenario.Interactions)
+	return &sc
+}
+
+// Save writes the scenario recorded so far to the given path. This should only be called if the
+// test passed, as replaying a failing test is not useful.
+func (r *Recorder) Save(path string) error {
+	return r.Scenario().Save(path)
+}
+
+func (r *Recorder) add(i Interaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scenario.Interactions = append(r.scenario.Interactions, i)
+}
+
+// RecordClient records all subsequent requests made by this client.
+func (r *Recorder) RecordClient(hsName string, c *client.CSAPI) {
+	transport := c.Client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	c.Client.Transport = &recordingTransport{
+		rec:    r,
+		hsName: hsName,
+		wrap:   transport,
+	}
+}
+
+// RecordDeployment wraps the deployment such that all clients it creates record their requests
+// into this recorder.
+//
+//	rec := scenario.NewRecorder(t.Name())
+//	deployment := scenario.RecordDeployment(complement.Deploy(t, 1), rec)
+//	defer deployment.Destroy(t)
+//	...
+//	if !t.Failed() {
+//		must.NotError(t, "failed to save scenario", rec.Save("my_test.scenario.json"))
+//	}
+func RecordDeployment(deployment complement.Deployment, rec *Recorder) complement.Deployment {
+	return &recordingDeployment{
+		Deployment: deployment,
+		rec:        rec,
+	}
+}
+
+type recordingDeployment struct {
+	complement.Deployment
+	rec *Recorder
+}
+
+func (d *recordingDeployment) UnauthenticatedClient(t ct.TestLike, hsName string) *client.CSAPI {
+	t.Helper()
+	c := d.Deployment.UnauthenticatedClient(t, hsName)
+	d.rec.RecordClient(hsName, c)
+	return c
+}
+
+func (d *recordingDeployment) Register(t ct.TestLike, hsName string, opts helpers.RegistrationOpts) *client.CSAPI {
+	t.Helper()
+	c := d.Deployment.Register(t, hsName, opts)
+	d.rec.add(Interaction{
+		Kind:             KindRegister,
+		HSName:           hsName,
+		RegistrationOpts: &opts,
+		UserID:           c.UserID,
+		AccessToken:      c.AccessToken,
+		DeviceID:         c.DeviceID,
+	})
+	d.rec.RecordClient(hsName, c)
+	return c
+}
+
+func (d *recordingDeployment) Login(t ct.TestLike, hsName string, existing *client.CSAPI, opts helpers.LoginOpts) *client.CSAPI {
+	t.Helper()
+	c := d.Deployment.Login(t, hsName, existing, opts)
+	d.rec.add(Interaction{
+		Kind:           KindLogin,
+		HSName:         hsName,
+		LoginOpts:      &opts,
+		ExistingUserID: existing.UserID,
+		UserID:         c.UserID,
+		AccessToken:    c.AccessToken,
+		DeviceID:       c.DeviceID,
+	})
+	d.rec.RecordClient(hsName, c)
+	return c
+}
+
+type recordingTransport struct {
+	rec    *Recorder
+	hsName string
+	wrap   http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err == nil {
+			reqBody, _ = io.ReadAll(rc)
+			rc.Close()
+		}
+	}
+	res, err := t.wrap.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	resBody, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(resBody))
+	t.rec.add(Interaction{
+		Kind:         KindCSAPI,
+		HSName:       t.hsName,
+		AccessToken:  strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "),
+		Method:       req.Method,
+		Paths:        splitPath(req.URL),
+		RawQuery:     req.URL.RawQuery,
+		ContentType:  req.Header.Get("Content-Type"),
+		RequestBody:  reqBody,
+		StatusCode:   res.StatusCode,
+		ResponseBody: resBody,
+	})
+	return res, nil
+}
+
+// splitPath splits the URL path into unescaped segments, preserving escaped slashes within segments.
+func splitPath(u *url.URL) []string {
+	segments := strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/")
+	for i := range segments {
+		if unescaped, err := url.PathUnescape(segments[i]); err == nil {
+			segments[i] = unescaped
+		}
+	}
+	return segments
+}
@@ -0,0 +1,191 @@
+package scenario
+
+import (
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Replay replays the CSAPI interactions in the scenario against the deployment, failing the test if
+// any response has a different status code to the recorded response.
+//
+// Identifiers which differ between the recording and the replay (user IDs, access tokens, room IDs,
+// event IDs, sync tokens, etc) are remapped automatically by comparing the recorded response with the
+// replayed response, and substituting the new values into all subsequent requests.
+//
+// Requests are replayed sequentially in the order they were recorded. Tests which made requests
+// concurrently, or which retry requests until a condition is met, may report spurious differences.
+//
+// Returns the mapping of recorded identifiers to replayed identifiers.
+func Replay(t ct.TestLike, deployment complement.Deployment, sc *Scenario) map[string]string {
+	t.Helper()
+	r := &replayer{
+		deployment:  deployment,
+		mapping:     make(map[string]string),
+		clients:     make(map[string]*client.CSAPI),
+		unauthed:    make(map[string]*client.CSAPI),
+		userClients: make(map[string]*client.CSAPI),
+	}
+	for i, in := range sc.Interactions {
+		switch in.Kind {
+		case KindRegister:
+			opts := *in.RegistrationOpts
+			c := deployment.Register(t, in.HSName, opts)
+			r.addClient(in, c)
+		case KindLogin:
+			existing := r.userClients[r.remap(in.ExistingUserID)]
+			if existing == nil {
+				ct.Fatalf(t, "scenario.Replay: interaction %d: login for unknown user %s", i, in.ExistingUserID)
+			}
+			c := deployment.Login(t, in.HSName, existing, *in.LoginOpts)
+			r.addClient(in, c)
+		case KindCSAPI:
+			r.replayCSAPI(t, i, in)
+		default:
+			ct.Fatalf(t, "scenario.Replay: interaction %d has unknown kind '%s'", i, in.Kind)
+		}
+	}
+	return r.mapping
+}
+
+type replayer struct {
+	deployment  complement.Deployment
+	mapping     map[string]string
+	clients     map[string]*client.CSAPI // replayed access token -> client
+	unauthed    map[string]*client.CSAPI // hs name -> client
+	userClients map[string]*client.CSAPI // replayed user ID -> client
+}
+
+func (r *replayer) addClient(in Interaction, c *client.CSAPI) {
+	r.learnString(in.UserID, c.UserID)
+	r.learnString(in.AccessToken, c.AccessToken)
+	r.learnString(in.DeviceID, c.DeviceID)
+	r.clients[c.AccessToken] = c
+	r.userClients[c.UserID] = c
+}
+
+func (r *replayer) replayCSAPI(t ct.TestLike, i int, in Interaction) {
+	t.Helper()
+	var c *client.CSAPI
+	if in.AccessToken == "" {
+		c = r.unauthed[in.HSName]
+		if c == nil {
+			c = r.deployment.UnauthenticatedClient(t, in.HSName)
+			r.unauthed[in.HSName] = c
+		}
+	} else {
+		c = r.clients[r.remap(in.AccessToken)]
+		if c == nil {
+			ct.Fatalf(t, "scenario.Replay: interaction %d: %s %s uses an unknown access token", i, in.Method, strings.Join(in.Paths, "/"))
+		}
+	}
+	paths := make([]string, len(in.Paths))
+	for j := range in.Paths {
+		paths[j] = r.remap(in.Paths[j])
+	}
+	opts := []client.RequestOpt{
+		client.WithRawBody([]byte(r.remap(string(in.RequestBody)))),
+	}
+	if in.ContentType != "" {
+		opts = append(opts, client.WithContentType(in.ContentType))
+	}
+	if in.RawQuery != "" {
+		query, err := url.ParseQuery(in.RawQuery)
+		if err != nil {
+			ct.Fatalf(t, "scenario.Replay: interaction %d: invalid query string %s: %s", i, in.RawQuery, err)
+		}
+		for k, vals := range query {
+			for j := range vals {
+				vals[j] = r.remap(vals[j])
+			}
+			query[k] = vals
+		}
+		opts = append(opts, client.WithQueries(query))
+	}
+	res := c.Do(t, in.Method, paths, opts...)
+	if res.StatusCode != in.StatusCode {
+		ct.Errorf(t, "scenario.Replay: interaction %d: %s /%s returned HTTP %d, recorded HTTP %d", i, in.Method, strings.Join(paths, "/"), res.StatusCode, in.StatusCode)
+		return
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		ct.Fatalf(t, "scenario.Replay: interaction %d: failed to read response body: %s", i, err)
+	}
+	if gjson.ValidBytes(in.ResponseBody) && gjson.ValidBytes(body) {
+		r.learn("", gjson.ParseBytes(in.ResponseBody), gjson.ParseBytes(body))
+	}
+}
+
+// learn walks the recorded and replayed JSON in parallel, remembering identifiers which differ.
+func (r *replayer) learn(key string, recorded, replayed gjson.Result) {
+	switch {
+	case recorded.IsObject():
+		recorded.ForEach(func(k, v gjson.Result) bool {
+			r.learn(k.Str, v, replayed.Get(gjson.Escape(k.Str)))
+			return true
+		})
+	case recorded.IsArray():
+		recArr := recorded.Array()
+		repArr := replayed.Array()
+		for i := 0; i < len(recArr) && i < len(repArr); i++ {
+			r.learn(key, recArr[i], repArr[i])
+		}
+	case recorded.Type == gjson.String && replayed.Type == gjson.String:
+		if isIdentifier(key, recorded.Str) {
+			r.learnString(recorded.Str, replayed.Str)
+		}
+	}
+}
+
+func (r *replayer) learnString(recorded, replayed string) {
+	if recorded == "" || recorded == replayed {
+		return
+	}
+	r.mapping[recorded] = replayed
+}
+
+// remap replaces all known recorded identifiers with their replayed equivalent, longest first so
+// identifiers which are substrings of other identifiers are not partially replaced.
+func (r *replayer) remap(in string) string {
+	if in == "" || len(r.mapping) == 0 {
+		return in
+	}
+	if out, ok := r.mapping[in]; ok {
+		return out
+	}
+	keys := make([]string, 0, len(r.mapping))
+	for k := range r.mapping {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return len(keys[i]) > len(keys[j])
+	})
+	oldnew := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		oldnew = append(oldnew, k, r.mapping[k])
+	}
+	return strings.NewReplacer(oldnew...).Replace(in)
+}
+
+// isIdentifier returns true if this JSON string value is likely to be a server-generated identifier.
+func isIdentifier(key, val string) bool {
+	if val == "" {
+		return false
+	}
+	switch val[0] {
+	case '@', '!', '$', '#':
+		return true
+	}
+	if strings.HasPrefix(val, "mxc://") {
+		return true
+	}
+	return strings.HasSuffix(key, "_id") || strings.HasSuffix(key, "token") || strings.HasSuffix(key, "_batch") ||
+		key == "start" || key == "end" || key == "from" || key == "to"
+}
@@ -0,0 +1,101 @@
+package scenario
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func newTestReplayer() *replayer {
+	return &replayer{
+		mapping: make(map[string]string),
+	}
+}
+
+func TestLearnRemapsIdentifiers(t *testing.T) {
+	r := newTestReplayer()
+	recorded := gjson.Parse(`{
+		"room_id": "!old:hs1",
+		"event_id": "$oldevent",
+		"chunk": [{"sender": "@alice:hs1", "event_id": "$oldchunk"}],
+		"next_batch": "s1_2_3",
+		"body": "hello"
+	}`)
+	replayed := gjson.Parse(`{
+		"room_id": "!new:hs1",
+		"event_id": "$newevent",
+		"chunk": [{"sender": "@alice-1:hs1", "event_id": "$newchunk"}],
+		"next_batch": "s9_9_9",
+		"body": "goodbye"
+	}`)
+	r.learn("", recorded, replayed)
+	want := map[string]string{
+		"!old:hs1":   "!new:hs1",
+		"$oldevent":  "$newevent",
+		"$oldchunk":  "$newchunk",
+		"@alice:hs1": "@alice-1:hs1",
+		"s1_2_3":     "s9_9_9",
+	}
+	if len(r.mapping) != len(want) {
+		t.Errorf("mapping: got %v want %v", r.mapping, want)
+	}
+	for k, v := range want {
+		if r.mapping[k] != v {
+			t.Errorf("mapping[%s]: got %q want %q", k, r.mapping[k], v)
+		}
+	}
+}
+
+func TestLearnIgnoresUnchangedValues(t *testing.T) {
+	r := newTestReplayer()
+	r.learn("", gjson.Parse(`{"room_id":"!same:hs1","user_id":""}`), gjson.Parse(`{"room_id":"!same:hs1","user_id":"@bob:hs1"}`))
+	if len(r.mapping) != 0 {
+		t.Errorf("mapping: got %v want empty", r.mapping)
+	}
+}
+
+func TestRemap(t *testing.T) {
+	r := newTestReplayer()
+	r.learnString("!room:hs1", "!moor:hs1")
+	r.learnString("$event", "$tneve")
+	r.learnString("@alice:hs1", "@alice-1:hs1")
+	// a prefix of another identifier, which must not be partially replaced
+	r.learnString("$ev", "$xx")
+	testCases := map[string]string{
+		"":                     "",
+		"!room:hs1":            "!moor:hs1",
+		"$ev":                  "$xx",
+		"unrelated":            "unrelated",
+		"rooms/!room:hs1/send": "rooms/!moor:hs1/send",
+		`{"event_id":"$event","user_id":"@alice:hs1","other":"$ev"}`: `{"event_id":"$tneve","user_id":"@alice-1:hs1","other":"$xx"}`,
+	}
+	for in, want := range testCases {
+		if got := r.remap(in); got != want {
+			t.Errorf("remap(%q): got %q want %q", in, got, want)
+		}
+	}
+}
+
+func TestIsIdentifier(t *testing.T) {
+	testCases := []struct {
+		key  string
+		val  string
+		want bool
+	}{
+		{"sender", "@alice:hs1", true},
+		{"room_id", "!room:hs1", true},
+		{"event_id", "$event", true},
+		{"alias", "#alias:hs1", true},
+		{"url", "mxc://hs1/media", true},
+		{"device_id", "ABCDEF", true},
+		{"next_batch", "s1", true},
+		{"from", "t1", true},
+		{"body", "hello", false},
+		{"room_id", "", false},
+	}
+	for _, tc := range testCases {
+		if got := isIdentifier(tc.key, tc.val); got != tc.want {
+			t.Errorf("isIdentifier(%q, %q): got %v want %v", tc.key, tc.val, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// package scenario is an EXPERIMENTAL set of functions for recording the client traffic of a test into a
+// scenario file, and replaying it later against a different homeserver image. This allows quick
+// differential regression checks between server versions.
+// It is marked as EXPERIMENTAL as the API and file format may break without warning.
+package scenario
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/matrix-org/complement/helpers"
+)
+
+const (
+	// KindRegister is a user registration via Deployment.Register
+	KindRegister = "register"
+	// KindLogin is a login via Deployment.Login
+	KindLogin = "login"
+	// KindCSAPI is an arbitrary client-server API request
+	KindCSAPI = "csapi"
+)
+
+// Scenario is a recorded sequence of interactions with a deployment.
+type Scenario struct {
+	Name         string        `json:"name"`
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a single recorded request/response pair, or a Deployment-level operation.
+type Interaction struct {
+	Kind   string `json:"kind"`
+	HSName string `json:"hs_name"`
+
+	// Set for KindRegister and KindLogin
+	RegistrationOpts *helpers.RegistrationOpts `json:"registration_opts,omitempty"`
+	LoginOpts        *helpers.LoginOpts        `json:"login_opts,omitempty"`
+	ExistingUserID   string                    `json:"existing_user_id,omitempty"`
+	UserID           string                    `json:"user_id,omitempty"`
+	AccessToken      string                    `json:"access_token,omitempty"`
+	DeviceID         string                    `json:"device_id,omitempty"`
+
+	// Set for KindCSAPI
+	Method       string   `json:"method,omitempty"`
+	Paths        []string `json:"paths,omitempty"` // unescaped path segments
+	RawQuery     string   `json:"raw_query,omitempty"`
+	ContentType  string   `json:"content_type,omitempty"`
+	RequestBody  []byte   `json:"request_body,omitempty"`
+	StatusCode   int      `json:"status_code,omitempty"`
+	ResponseBody []byte   `json:"response_body,omitempty"`
+}
+
+// Load reads a scenario file written by Recorder.Save.
+func Load(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("scenario.Load: %w", err)
+	}
+	var sc Scenario
+	if err := json.Unmarshal(data, &sc); err != nil {
+		return nil, fmt.Errorf("scenario.Load: %s is not a valid scenario file: %w", path, err)
+	}
+	return &sc, nil
+}
+
+// Save writes the scenario to the given path as JSON.
+func (sc *Scenario) Save(path string) error {
+	data, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("scenario.Save: %w", err)
+	}
+	return os.WriteFile(path, data, 0644)
+}
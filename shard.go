@@ -0,0 +1,41 @@
+package complement
+
+import (
+	"hash/fnv"
+	"strings"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+)
+
+// SkipIfNotInShard skips the test if it is not assigned to this shard by COMPLEMENT_SHARD. Tests which
+// deploy are skipped automatically, so this only needs to be called by tests which do not.
+func SkipIfNotInShard(t ct.TestLike) {
+	t.Helper()
+	skipIfNotInShard(t, GetConfig(t), "")
+}
+
+// skipIfNotInShard skips the test if it is not in this shard. If `blueprintName` is set and sharding by
+// blueprint is enabled, the blueprint decides the shard, otherwise the top-level test name does.
+func skipIfNotInShard(t ct.TestLike, cfg *config.Complement, blueprintName string) {
+	t.Helper()
+	if cfg.ShardTotal == 0 {
+		return
+	}
+	// subtests are always in the same shard as their parent
+	name, _, _ := strings.Cut(t.Name(), "/")
+	if cfg.ShardByBlueprint && blueprintName != "" {
+		name = blueprintName
+	}
+	if shard := ShardFor(name, cfg.ShardTotal); shard != cfg.ShardIndex {
+		t.Skipf("%s is in shard %d/%d, this is shard %d/%d", name, shard, cfg.ShardTotal, cfg.ShardIndex, cfg.ShardTotal)
+	}
+}
+
+// ShardFor returns the shard (between 1 and `total`) which the test or blueprint `name` is assigned to.
+// The assignment only depends on the name and total, so is the same on every machine.
+func ShardFor(name string, total int) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32()%uint32(total)) + 1
+}
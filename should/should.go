@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/tidwall/gjson"
 	"golang.org/x/exp/slices"
@@ -101,6 +102,11 @@ func MatchResponse(res *http.Response, m match.HTTPResponse) ([]byte, error) {
 			}
 		}
 	}
+	for _, hm := range m.HeaderMatchers {
+		if err = hm(res.Header); err != nil {
+			return nil, fmt.Errorf("MatchResponse %s - %s", err, contextStr)
+		}
+	}
 	if m.JSON != nil {
 		if !gjson.ValidBytes(body) {
 			return nil, fmt.Errorf("MatchResponse response body is not valid JSON - %s", contextStr)
@@ -137,6 +143,20 @@ func MatchGJSON(jsonResult gjson.Result, matchers ...match.JSON) error {
 	return MatchJSONBytes([]byte(jsonResult.Raw), matchers...)
 }
 
+// EXPERIMENTAL
+// MatchRedirect performs assertions on the URL a response redirected to.
+func MatchRedirect(location *url.URL, matchers ...match.Redirect) error {
+	if location == nil {
+		return fmt.Errorf("MatchRedirect: no redirect")
+	}
+	for _, m := range matchers {
+		if err := m(location); err != nil {
+			return fmt.Errorf("MatchRedirect %s with location = %s", err, location)
+		}
+	}
+	return nil
+}
+
 // EXPERIMENTAL
 // MatchJSONBytes performs JSON assertions on a raw json byte slice.
 func MatchJSONBytes(rawJson []byte, matchers ...match.JSON) error {
@@ -0,0 +1,137 @@
+package complement
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/matrix-org/complement/ct"
+)
+
+// RunFlaky runs `fn` against a fresh deployment of `numServers` servers, retrying on a new deployment
+// up to `maxAttempts` times if the test body fails. This should only be used for tests which are known
+// to be flaky, as it hides genuine intermittent failures.
+//
+// Each attempt is run with its own ct.TestLike, so failures in one attempt do not fail the test. All logs
+// from each attempt are forwarded to `t` prefixed with the attempt number, and server logs are printed
+// when an attempt fails, so there is still a record of what went wrong. Each attempt is named
+// `$test/attempt_$n`, so artifacts written by each attempt are kept in separate directories. If a later attempt passes, the
+// test passes and is logged as FLAKY. If every attempt fails, the test fails with the errors from each
+// attempt.
+//
+//	complement.RunFlaky(t, 2, 3, func(t ct.TestLike, deployment complement.Deployment) {
+//		alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+//		...
+//	})
+func RunFlaky(t ct.TestLike, numServers, maxAttempts int, fn func(t ct.TestLike, deployment Deployment)) {
+	t.Helper()
+	runFlaky(t, maxAttempts, func(attempt ct.TestLike) {
+		deployment := Deploy(attempt, numServers)
+		defer deployment.Destroy(attempt)
+		fn(attempt, deployment)
+	})
+}
+
+// runFlaky runs `fn` up to `maxAttempts` times until an attempt passes. See RunFlaky.
+func runFlaky(t ct.TestLike, maxAttempts int, fn func(attempt ct.TestLike)) {
+	t.Helper()
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	var failedAttempts []*flakyAttempt
+	for i := 1; i <= maxAttempts; i++ {
+		attempt := &flakyAttempt{TestLike: t, number: i}
+		attempt.run(func() {
+			fn(attempt)
+		})
+		if attempt.skipped {
+			t.Skipf("RunFlaky: attempt %d skipped: %s", i, attempt.skipReason)
+			return
+		}
+		if !attempt.Failed() {
+			if len(failedAttempts) > 0 {
+				t.Logf("FLAKY: %s passed on attempt %d/%d", t.Name(), i, maxAttempts)
+			}
+			return
+		}
+		t.Logf("RunFlaky: attempt %d/%d of %s failed", i, maxAttempts, t.Name())
+		failedAttempts = append(failedAttempts, attempt)
+	}
+	var errs []string
+	for _, a := range failedAttempts {
+		errs = append(errs, fmt.Sprintf("attempt %d:\n\t%s", a.number, strings.Join(a.errs, "\n\t")))
+	}
+	ct.Errorf(t, "RunFlaky: all %d attempts failed:\n%s", maxAttempts, strings.Join(errs, "\n"))
+}
+
+// flakyAttempt is a ct.TestLike which records failures rather than failing the wrapped test.
+type flakyAttempt struct {
+	ct.TestLike
+	number int
+
+	mu         sync.Mutex
+	failed     bool
+	skipped    bool
+	skipReason string
+	errs       []string
+}
+
+// run executes fn in a new goroutine so that Fatalf and Skipf can stop the attempt via runtime.Goexit.
+func (a *flakyAttempt) run(fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				a.fail(fmt.Sprintf("panic: %v", r))
+			}
+		}()
+		fn()
+	}()
+	<-done
+}
+
+func (a *flakyAttempt) fail(msg string) {
+	a.mu.Lock()
+	a.failed = true
+	a.errs = append(a.errs, msg)
+	a.mu.Unlock()
+	a.TestLike.Logf("[attempt %d] ERROR: %s", a.number, msg)
+}
+
+// Name returns a name which is unique to the attempt, so attempts do not overwrite each other's artifacts.
+func (a *flakyAttempt) Name() string {
+	return fmt.Sprintf("%s/attempt_%d", a.TestLike.Name(), a.number)
+}
+
+func (a *flakyAttempt) Logf(msg string, args ...interface{}) {
+	a.TestLike.Logf("[attempt %d] %s", a.number, fmt.Sprintf(msg, args...))
+}
+
+func (a *flakyAttempt) Skipf(msg string, args ...interface{}) {
+	a.mu.Lock()
+	a.skipped = true
+	a.skipReason = fmt.Sprintf(msg, args...)
+	a.mu.Unlock()
+	runtime.Goexit()
+}
+
+func (a *flakyAttempt) Error(args ...interface{}) {
+	a.fail(fmt.Sprint(args...))
+}
+
+func (a *flakyAttempt) Errorf(msg string, args ...interface{}) {
+	a.fail(fmt.Sprintf(msg, args...))
+}
+
+func (a *flakyAttempt) Fatalf(msg string, args ...interface{}) {
+	a.fail(fmt.Sprintf(msg, args...))
+	runtime.Goexit()
+}
+
+func (a *flakyAttempt) Failed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.failed
+}
@@ -0,0 +1,122 @@
+package complement
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/artifacts"
+	"github.com/matrix-org/complement/ct"
+)
+
+// recordingT is a ct.TestLike which records failures and skips rather than acting on them.
+type recordingT struct {
+	name    string
+	logs    []string
+	errs    []string
+	skipped string
+}
+
+func (r *recordingT) Helper() {}
+func (r *recordingT) Logf(msg string, args ...interface{}) {
+	r.logs = append(r.logs, fmt.Sprintf(msg, args...))
+}
+func (r *recordingT) Skipf(msg string, args ...interface{}) {
+	r.skipped = fmt.Sprintf(msg, args...)
+}
+func (r *recordingT) Error(args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprint(args...))
+}
+func (r *recordingT) Errorf(msg string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(msg, args...))
+}
+func (r *recordingT) Fatalf(msg string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(msg, args...))
+}
+func (r *recordingT) Failed() bool { return len(r.errs) > 0 }
+func (r *recordingT) Name() string { return r.name }
+
+func TestRunFlakyPassesOnRetry(t *testing.T) {
+	rt := &recordingT{name: "TestFoo"}
+	attempts := 0
+	runFlaky(rt, 3, func(attempt ct.TestLike) {
+		attempts++
+		if attempts < 2 {
+			ct.Fatalf(attempt, "flaked")
+		}
+	})
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	if rt.Failed() {
+		t.Errorf("test failed, want it to pass: %v", rt.errs)
+	}
+	if !strings.Contains(strings.Join(rt.logs, "\n"), "FLAKY: TestFoo passed on attempt 2/3") {
+		t.Errorf("test was not logged as flaky: %v", rt.logs)
+	}
+}
+
+func TestRunFlakyFailsAfterMaxAttempts(t *testing.T) {
+	rt := &recordingT{name: "TestFoo"}
+	attempts := 0
+	runFlaky(rt, 3, func(attempt ct.TestLike) {
+		attempts++
+		attempt.Errorf("failure %d", attempts)
+	})
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+	if len(rt.errs) != 1 {
+		t.Fatalf("got errors %v, want 1", rt.errs)
+	}
+	for i := 1; i <= 3; i++ {
+		if !strings.Contains(rt.errs[0], fmt.Sprintf("failure %d", i)) {
+			t.Errorf("error does not contain the failure of attempt %d: %s", i, rt.errs[0])
+		}
+	}
+}
+
+func TestRunFlakySkips(t *testing.T) {
+	rt := &recordingT{name: "TestFoo"}
+	attempts := 0
+	runFlaky(rt, 3, func(attempt ct.TestLike) {
+		attempts++
+		attempt.Skipf("not supported")
+		t.Errorf("attempt continued after Skipf")
+	})
+	if attempts != 1 {
+		t.Errorf("got %d attempts, want 1", attempts)
+	}
+	if !strings.Contains(rt.skipped, "not supported") {
+		t.Errorf("test was not skipped, got skip reason %q", rt.skipped)
+	}
+	if rt.Failed() {
+		t.Errorf("skipped test failed: %v", rt.errs)
+	}
+}
+
+func TestRunFlakyAttemptNames(t *testing.T) {
+	rt := &recordingT{name: "TestFoo"}
+	store := artifacts.New(t.TempDir())
+	var names []string
+	runFlaky(rt, 2, func(attempt ct.TestLike) {
+		names = append(names, attempt.Name())
+		if err := store.WriteFile(attempt.Name(), "attempt.txt", []byte(attempt.Name())); err != nil {
+			t.Errorf("WriteFile: %s", err)
+		}
+		attempt.Errorf("failed")
+	})
+	want := []string{"TestFoo/attempt_1", "TestFoo/attempt_2"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("got attempt names %v, want %v", names, want)
+	}
+	// each attempt keeps its own artifacts
+	for _, name := range want {
+		data, err := store.ReadFile(name, "attempt.txt")
+		if err != nil {
+			t.Errorf("ReadFile %s: %s", name, err)
+		} else if string(data) != name {
+			t.Errorf("artifact of %s was overwritten with %q", name, data)
+		}
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"os"
 	"testing"
 
+	"github.com/matrix-org/complement/artifacts"
 	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/config"
 	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/debugui"
+	"github.com/matrix-org/complement/internal/docker"
 )
 
 var (
@@ -25,6 +28,10 @@ type complementOpts struct {
 	// - We pass in the Complement config (`testPackage.Config`) so the deployer can inspect
 	// `DebugLoggingEnabled`, `SpawnHSTimeout`, `PackageNamespace`, etc.
 	customDeployment func(t ct.TestLike, numServers int, config *config.Complement) Deployment
+	// Creates the Deployer used for this package, if set.
+	newDeployer func(config *config.Complement) (Deployer, error)
+	// Resets deployments in the warm pool, if set.
+	warmPoolReset WarmPoolResetFunc
 }
 type opt func(*complementOpts)
 
@@ -51,6 +58,24 @@ func WithDeployment(fn func(t ct.TestLike, numServers int, config *config.Comple
 	}
 }
 
+// WithDeployer replaces the default Docker deployer with the one returned by `fn`, which is called
+// once with the Complement config before any tests run. Unlike WithDeployment, the deployer is also
+// used for blueprints and shared deployments.
+func WithDeployer(fn func(config *config.Complement) (Deployer, error)) opt {
+	return func(co *complementOpts) {
+		co.newDeployer = fn
+	}
+}
+
+// WithWarmPoolReset sets how deployments in the warm pool are reset before being leased by another test,
+// replacing COMPLEMENT_WARM_POOL_RESET_COMMAND. This allows homeserver-specific resets e.g via an admin API.
+// The pool is only used if COMPLEMENT_WARM_POOL_SIZE is set.
+func WithWarmPoolReset(fn WarmPoolResetFunc) opt {
+	return func(co *complementOpts) {
+		co.warmPoolReset = fn
+	}
+}
+
 // TestMain is the main entry point for Complement.
 //
 // It will clean up any old containers/images/networks from the previous run, then run the tests, then clean up
@@ -71,19 +96,60 @@ func TestMain(m *testing.M, namespace string, customOpts ...opt) {
 	}
 
 	var err error
-	testPackage, err = NewTestPackage(namespace)
+	testPackage, err = newTestPackage(namespace, opts.newDeployer)
 	if err != nil {
 		fmt.Printf("Error: %s", err)
 		os.Exit(1)
 	}
+	testPackage.startWarmPool(opts.warmPoolReset)
+	stopDebugUI := func() {}
+	if testPackage.Config.DebugUIAddr != "" {
+		stopDebugUI, err = debugui.Start(testPackage.Config.DebugUIAddr)
+		if err != nil {
+			fmt.Printf("Error: %s", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Debug UI: http://%s\n", testPackage.Config.DebugUIAddr)
+	}
 	exitCode := m.Run()
 	if opts.cleanup != nil {
 		opts.cleanup(testPackage.Config)
 	}
 	testPackage.Cleanup()
+	stopDebugUI()
 	os.Exit(exitCode)
 }
 
+// GetConfig returns the Complement config for this test package. This is useful for creating
+// Complement-controlled servers before deploying, e.g so their URLs can be used in blueprints.
+func GetConfig(t ct.TestLike) *config.Complement {
+	t.Helper()
+	if testPackage == nil {
+		ct.Fatalf(t, "GetConfig: testPackage not set, did you forget to call complement.TestMain?")
+	}
+	return testPackage.Config
+}
+
+// ArtifactsDir returns the directory which the test can write debugging output to, which is a
+// subdirectory of COMPLEMENT_ARTIFACTS_DIR. Returns "" if COMPLEMENT_ARTIFACTS_DIR is not set.
+func ArtifactsDir(t ct.TestLike) string {
+	t.Helper()
+	dir, err := artifacts.New(GetConfig(t).ArtifactsDir).Dir(t.Name())
+	if err != nil {
+		ct.Fatalf(t, "ArtifactsDir: %s", err)
+	}
+	return dir
+}
+
+// WriteArtifact writes the file `name` to the artifacts directory of the test, so it is available
+// for debugging after the test run. Does nothing if COMPLEMENT_ARTIFACTS_DIR is not set.
+func WriteArtifact(t ct.TestLike, name string, data []byte) {
+	t.Helper()
+	if err := artifacts.New(GetConfig(t).ArtifactsDir).WriteFile(t.Name(), name, data); err != nil {
+		ct.Errorf(t, "WriteArtifact: %s", err)
+	}
+}
+
 // Deploy will deploy the given blueprint or terminate the test.
 // It will construct the blueprint if it doesn't already exist in the docker image cache.
 // This function is the main setup function for all tests as it provides a deployment with
@@ -93,7 +159,7 @@ func OldDeploy(t ct.TestLike, blueprint b.Blueprint) Deployment {
 	if testPackage == nil {
 		ct.Fatalf(t, "Deploy: testPackage not set, did you forget to call complement.TestMain?")
 	}
-	return testPackage.OldDeploy(t, blueprint)
+	return streamLogsIfEnabled(t, testPackage.OldDeploy(t, blueprint))
 }
 
 // Deploy will deploy the given number of servers or terminate the test.
@@ -102,13 +168,57 @@ func OldDeploy(t ct.TestLike, blueprint b.Blueprint) Deployment {
 //
 // For test consistency and compatibility, deployers should be creating servers that can
 // be referred to as `hs1`, `hs2`, etc as the `hsName` in the `Deployment` interface.
-func Deploy(t ct.TestLike, numServers int) Deployment {
+//
+// Options such as WithEnv can be given to change how the homeservers are deployed.
+func Deploy(t ct.TestLike, numServers int, opts ...DeployOpt) Deployment {
 	t.Helper()
 	if testPackage == nil {
 		ct.Fatalf(t, "Deploy: testPackage not set, did you forget to call complement.TestMain?")
 	}
 	if customDeployer != nil {
+		skipIfNotInShard(t, testPackage.Config, "")
+		if len(newDeployOpts(opts).env) > 0 {
+			t.Skipf("Deploy: custom deployments do not support WithEnv")
+		}
 		return customDeployer(t, numServers, testPackage.Config)
 	}
-	return testPackage.Deploy(t, numServers)
+	return streamLogsIfEnabled(t, testPackage.Deploy(t, numServers, opts...))
+}
+
+// streamLogsIfEnabled streams the homeserver logs of the deployment into the test output if
+// COMPLEMENT_STREAM_SERVER_LOGS is set. Dirty deployments outlive the test, so are not streamed.
+func streamLogsIfEnabled(t ct.TestLike, deployment Deployment) Deployment {
+	if !testPackage.Config.StreamServerLogs {
+		return deployment
+	}
+	if dep, ok := unwrapDeployment(deployment).(*docker.Deployment); ok && !dep.Dirty {
+		dep.StreamLogs(t)
+	}
+	return deployment
+}
+
+// SharedDeployment will deploy the given number of servers or terminate the test, sharing the deployment
+// with any other test in this package which asks for the same number of servers at the same time.
+// This allows tests and subtests marked with `t.Parallel()` to avoid paying the deployment cost each time.
+//
+// Deployments are reference counted: each call must be paired with a call to `Destroy`, and the
+// underlying deployment is only destroyed when the last reference is released. For example:
+//
+//	deployment := complement.SharedDeployment(t, 1)
+//	defer deployment.Destroy(t)
+//
+// As the deployment is shared, tests must not make assumptions about the state of the homeservers,
+// e.g. that the user directory is empty.
+func SharedDeployment(t ct.TestLike, numServers int) Deployment {
+	t.Helper()
+	if testPackage == nil {
+		ct.Fatalf(t, "SharedDeployment: testPackage not set, did you forget to call complement.TestMain?")
+	}
+	skipIfNotInShard(t, testPackage.Config, "")
+	return testPackage.SharedDeployment(t, numServers, func() Deployment {
+		if customDeployer != nil {
+			return customDeployer(t, numServers, testPackage.Config)
+		}
+		return testPackage.Deploy(t, numServers)
+	})
 }
@@ -0,0 +1,109 @@
+package complement
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MatrixDimension is an environment variable of the homeservers, and the values to test it with e.g
+// workers on and off.
+type MatrixDimension struct {
+	Env    string
+	Values []string
+}
+
+// MatrixConfig is a deployment configuration generated by Matrix.
+type MatrixConfig struct {
+	// The name of the configuration, which is the name of its subtest e.g "SYNAPSE_WORKERS=1,ROOM_VERSION=10".
+	Name string
+	// The environment variables of the homeservers, of the form KEY=VALUE.
+	Env []string
+}
+
+// MatrixResult is the outcome of running a test against one configuration of a matrix.
+type MatrixResult struct {
+	Config  string `json:"config"`
+	Passed  bool   `json:"passed"`
+	Skipped bool   `json:"skipped"`
+}
+
+// Matrix returns every combination of the values of the dimensions, in order with the last dimension
+// varying fastest. What each environment variable does is up to the homeserver image.
+//
+//	complement.Matrix(
+//		complement.MatrixDimension{Env: "SYNAPSE_WORKERS", Values: []string{"0", "1"}},
+//		complement.MatrixDimension{Env: "ROOM_VERSION", Values: []string{"10", "11"}},
+//	)
+//
+// returns 4 configurations, from SYNAPSE_WORKERS=0,ROOM_VERSION=10 to SYNAPSE_WORKERS=1,ROOM_VERSION=11.
+func Matrix(dimensions ...MatrixDimension) []MatrixConfig {
+	configs := []MatrixConfig{{}}
+	for _, dim := range dimensions {
+		next := make([]MatrixConfig, 0, len(configs)*len(dim.Values))
+		for _, cfg := range configs {
+			for _, val := range dim.Values {
+				kv := dim.Env + "=" + val
+				next = append(next, MatrixConfig{
+					Name: strings.TrimPrefix(cfg.Name+","+kv, ","),
+					Env:  append(append([]string{}, cfg.Env...), kv),
+				})
+			}
+		}
+		configs = next
+	}
+	return configs
+}
+
+// RunMatrix runs `fn` as a subtest named after each configuration, against a fresh deployment of
+// `numServers` servers which all have the environment variables of the configuration. Once every
+// configuration has run, a summary of the results is logged and written to the artifact `matrix.json`.
+// Only supported by Docker deployments, as other deployers cannot set environment variables on
+// homeservers: the subtests are skipped otherwise.
+//
+//	complement.RunMatrix(t, 2, complement.Matrix(workers, roomVersions), func(t *testing.T, deployment complement.Deployment) {
+//		alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+//		...
+//	})
+func RunMatrix(t *testing.T, numServers int, configs []MatrixConfig, fn func(t *testing.T, deployment Deployment)) {
+	t.Helper()
+	results := make([]MatrixResult, 0, len(configs))
+	for _, cfg := range configs {
+		blueprint := NumServersBlueprint(numServers)
+		for i := range blueprint.Homeservers {
+			blueprint.Homeservers[i].Env = cfg.Env
+		}
+		blueprint, err := b.Validate(blueprint)
+		if err != nil {
+			ct.Fatalf(t, "RunMatrix: invalid configuration %s: %s", cfg.Name, err)
+		}
+		var skipped bool
+		passed := t.Run(cfg.Name, func(t *testing.T) {
+			defer func() {
+				skipped = t.Skipped()
+			}()
+			deployment := OldDeploy(t, blueprint)
+			defer deployment.Destroy(t)
+			fn(t, deployment)
+		})
+		results = append(results, MatrixResult{Config: cfg.Name, Passed: passed && !skipped, Skipped: skipped})
+	}
+
+	var summary strings.Builder
+	for _, res := range results {
+		outcome := "FAIL"
+		if res.Skipped {
+			outcome = "SKIP"
+		} else if res.Passed {
+			outcome = "PASS"
+		}
+		fmt.Fprintf(&summary, "\n\t%s: %s", outcome, res.Config)
+	}
+	t.Logf("RunMatrix: results of %d configurations:%s", len(results), summary.String())
+	data, _ := json.MarshalIndent(results, "", "  ")
+	WriteArtifact(t, "matrix.json", data)
+}
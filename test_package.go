@@ -2,11 +2,11 @@ package complement
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/matrix-org/complement/b"
@@ -81,15 +81,15 @@ type Deployment interface {
 type TestPackage struct {
 	// the config used for this package.
 	Config *config.Complement
-	// the builder we'll use to make containers
-	complementBuilder *docker.Builder
-	// a counter to stop tests from allocating the same container name
-	namespaceCounter uint64
+	// creates the deployments for this package
+	deployer Deployer
 
-	// pointers to existing deployments for Deploy(t, 1) style deployments which are reused when run
-	// in dirty mode.
-	existingDeployment   *docker.Deployment
-	existingDeploymentMu *sync.Mutex
+	// reference-counted deployments handed out by SharedDeployment, keyed on the number of servers.
+	sharedDeployments   map[int]*sharedDeployment
+	sharedDeploymentsMu *sync.Mutex
+
+	// leases deployments to Deploy(t, 1) if COMPLEMENT_WARM_POOL_SIZE is set, else nil.
+	warmPool *warmPool
 }
 
 // NewTestPackage creates a new test package which can be used to deploy containers for all tests
@@ -97,34 +97,72 @@ type TestPackage struct {
 // before any tests run. After the tests have run, call `TestPackage.Cleanup`. Tests can deploy
 // containers by calling `TestPackage.Deploy`.
 func NewTestPackage(pkgNamespace string) (*TestPackage, error) {
+	return newTestPackage(pkgNamespace, nil)
+}
+
+// newTestPackage creates a new test package which deploys homeservers using the deployer returned
+// by `newDeployer`. If `newDeployer` is nil, the default deployer is used.
+func newTestPackage(pkgNamespace string, newDeployer func(cfg *config.Complement) (Deployer, error)) (*TestPackage, error) {
 	cfg := config.NewConfigFromEnvVars(pkgNamespace, "")
 	log.Printf("config: %+v", cfg)
-	builder, err := docker.NewBuilder(cfg)
+	if newDeployer == nil {
+		newDeployer = NewDockerDeployer
+		if cfg.KubeNamespace != "" {
+			newDeployer = NewKubeDeployer
+		}
+		if cfg.ProcessCommand != "" {
+			newDeployer = NewProcessDeployer
+		}
+		if len(cfg.ExternalHomeservers) > 0 {
+			newDeployer = func(cfg *config.Complement) (Deployer, error) {
+				return &externalDeployer{config: cfg}, nil
+			}
+		}
+	}
+	deployer, err := newDeployer(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to make docker builder: %w", err)
+		return nil, err
 	}
-	// remove any old images/containers/networks in case we died horribly before
-	builder.Cleanup()
 
 	// we use GMSL which uses logrus by default. We don't want those logs in our test output unless they are Serious.
 	logrus.SetLevel(logrus.ErrorLevel)
 
 	return &TestPackage{
-		complementBuilder:    builder,
-		namespaceCounter:     0,
-		Config:               cfg,
-		existingDeploymentMu: &sync.Mutex{},
+		deployer:            deployer,
+		Config:              cfg,
+		sharedDeployments:   make(map[int]*sharedDeployment),
+		sharedDeploymentsMu: &sync.Mutex{},
 	}, nil
 }
 
+// startWarmPool starts deploying homeservers into the warm pool if COMPLEMENT_WARM_POOL_SIZE is set.
+// `reset` is used to reset deployments if set, else COMPLEMENT_WARM_POOL_RESET_COMMAND.
+func (tp *TestPackage) startWarmPool(reset WarmPoolResetFunc) {
+	if tp.Config.WarmPoolSize <= 0 || tp.Config.EnableDirtyRuns {
+		return
+	}
+	if reset == nil && tp.Config.WarmPoolResetCommand != "" {
+		reset = commandReset(tp.Config.WarmPoolResetCommand)
+	}
+	if reset == nil {
+		log.Printf("COMPLEMENT_WARM_POOL_SIZE is set without COMPLEMENT_WARM_POOL_RESET_COMMAND or WithWarmPoolReset, not using the warm pool")
+		return
+	}
+	tp.warmPool = newWarmPool(tp, tp.Config.WarmPoolSize, reset)
+}
+
 func (tp *TestPackage) Cleanup() {
-	// any dirty deployments need logs printed and post scripts run
-	tp.existingDeploymentMu.Lock()
-	if tp.existingDeployment != nil {
-		tp.existingDeployment.DestroyAtCleanup()
+	if tp.warmPool != nil {
+		tp.warmPool.close()
+	}
+	// any shared deployments which were never fully released are torn down here
+	tp.sharedDeploymentsMu.Lock()
+	for numServers, sd := range tp.sharedDeployments {
+		tp.deployer.Destroy(sd.Deployment, tp.Config.AlwaysPrintServerLogs || sd.failed, "SharedDeployment", sd.failed)
+		delete(tp.sharedDeployments, numServers)
 	}
-	tp.existingDeploymentMu.Unlock()
-	tp.complementBuilder.Cleanup()
+	tp.sharedDeploymentsMu.Unlock()
+	tp.deployer.Cleanup()
 }
 
 // Deploy will deploy the given blueprint or terminate the test.
@@ -133,94 +171,132 @@ func (tp *TestPackage) Cleanup() {
 // which tests can interact with.
 func (tp *TestPackage) OldDeploy(t ct.TestLike, blueprint b.Blueprint) Deployment {
 	t.Helper()
-	timeStartBlueprint := time.Now()
-	if err := tp.complementBuilder.ConstructBlueprintIfNotExist(blueprint); err != nil {
-		ct.Fatalf(t, "OldDeploy: Failed to construct blueprint: %s", err)
-	}
-	namespace := fmt.Sprintf("%d", atomic.AddUint64(&tp.namespaceCounter, 1))
-	d, err := docker.NewDeployer(namespace, tp.complementBuilder.Config)
-	if err != nil {
-		ct.Fatalf(t, "OldDeploy: NewDeployer returned error %s", err)
-	}
-	timeStartDeploy := time.Now()
-	dep, err := d.Deploy(context.Background(), blueprint.Name)
-	if err != nil {
-		ct.Fatalf(t, "OldDeploy: Deploy returned error %s", err)
-	}
-	t.Logf("OldDeploy times: %v blueprints, %v containers", timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy))
-	return dep
+	skipIfNotInShard(t, tp.Config, blueprint.Name)
+	return tp.deploy(t, "OldDeploy", blueprint)
 }
 
-func (tp *TestPackage) Deploy(t ct.TestLike, numServers int) Deployment {
+func (tp *TestPackage) Deploy(t ct.TestLike, numServers int, opts ...DeployOpt) Deployment {
 	t.Helper()
-	if tp.Config.EnableDirtyRuns {
-		return tp.dirtyDeploy(t, numServers)
+	skipIfNotInShard(t, tp.Config, "")
+	dopts := newDeployOpts(opts)
+	// dirty servers are shared between tests, so cannot have per-test env vars or mock servers
+	if dd, ok := tp.deployer.(*dockerDeployer); ok && tp.Config.EnableDirtyRuns && !dopts.perDeployment() {
+		return dd.dirtyDeploy(t, numServers)
 	}
 	// non-dirty deployments below
-	blueprint := mapServersToBlueprint(numServers)
-	timeStartBlueprint := time.Now()
-	if err := tp.complementBuilder.ConstructBlueprintIfNotExist(blueprint); err != nil {
-		ct.Fatalf(t, "Deploy: Failed to construct blueprint: %s", err)
+	if tp.warmPool != nil && numServers == 1 && !dopts.perDeployment() {
+		if dep := tp.warmPool.lease(t); dep != nil {
+			profileIfSlow(t, dep)
+			return dep
+		}
 	}
-	namespace := fmt.Sprintf("%d", atomic.AddUint64(&tp.namespaceCounter, 1))
-	d, err := docker.NewDeployer(namespace, tp.complementBuilder.Config)
-	if err != nil {
-		ct.Fatalf(t, "Deploy: NewDeployer returned error %s", err)
+	return tp.deploy(t, "Deploy", applyDeployOpts(t, NumServersBlueprint(numServers), dopts))
+}
+
+// deploy constructs and deploys the blueprint using the package deployer, skipping the test if the
+// deployer does not support the blueprint.
+func (tp *TestPackage) deploy(t ct.TestLike, caller string, blueprint b.Blueprint) Deployment {
+	t.Helper()
+	timeStartBlueprint := time.Now()
+	if err := tp.deployer.Construct(context.Background(), blueprint); err != nil {
+		if errors.Is(err, ErrUnsupported) {
+			t.Skipf("%s: %s", caller, err)
+		}
+		ct.Fatalf(t, "%s: Failed to construct blueprint: %s", caller, err)
 	}
 	timeStartDeploy := time.Now()
-	dep, err := d.Deploy(context.Background(), blueprint.Name)
+	dep, err := tp.deployer.Deploy(context.Background(), blueprint)
 	if err != nil {
-		ct.Fatalf(t, "Deploy: Deploy returned error %s", err)
+		if errors.Is(err, ErrUnsupported) {
+			t.Skipf("%s: %s", caller, err)
+		}
+		ct.Fatalf(t, "%s: Deploy returned error %s", caller, err)
 	}
-	t.Logf("Deploy times: %v blueprints, %v containers", timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy))
+	t.Logf("%s times: %v blueprints, %v containers", caller, timeStartDeploy.Sub(timeStartBlueprint), time.Since(timeStartDeploy))
+	profileIfSlow(t, dep)
 	return dep
 }
 
-func (tp *TestPackage) dirtyDeploy(t ct.TestLike, numServers int) Deployment {
-	tp.existingDeploymentMu.Lock()
-	defer tp.existingDeploymentMu.Unlock()
-	// do we even have a deployment?
-	if tp.existingDeployment == nil {
-		d, err := docker.NewDeployer("dirty", tp.complementBuilder.Config)
-		if err != nil {
-			ct.Fatalf(t, "dirtyDeploy: NewDeployer returned error %s", err)
-		}
-		// this creates a single hs1
-		tp.existingDeployment, err = d.CreateDirtyDeployment()
-		if err != nil {
-			ct.Fatalf(t, "CreateDirtyDeployment failed: %s", err)
-		}
+// profileIfSlow captures profiles of the homeservers if the test is still using the deployment after
+// COMPLEMENT_PROFILE_AFTER_SECS. Only Docker deployments are supported.
+func profileIfSlow(t ct.TestLike, dep Deployment) {
+	if dockerDep, ok := unwrapDeployment(dep).(*docker.Deployment); ok {
+		dockerDep.ProfileIfSlow(t.Name())
 	}
+}
 
-	// if we have an existing deployment, can we use it? We can use it if we have at least that number of servers deployed already.
-	if len(tp.existingDeployment.HS) >= numServers {
-		return tp.existingDeployment
+// SharedDeployment returns a deployment with the given number of servers which is shared between all
+// callers that currently hold a reference to it. The deployment is created via `deploy` on first use.
+// Each call increments a reference count, and each call to `Destroy` on the returned deployment
+// decrements it. The underlying deployment is only destroyed when the last reference is released,
+// or at the end of the test package if references are leaked.
+func (tp *TestPackage) SharedDeployment(t ct.TestLike, numServers int, deploy func() Deployment) Deployment {
+	t.Helper()
+	tp.sharedDeploymentsMu.Lock()
+	defer tp.sharedDeploymentsMu.Unlock()
+	sd, ok := tp.sharedDeployments[numServers]
+	if !ok {
+		sd = &sharedDeployment{
+			Deployment: deploy(),
+			tp:         tp,
+			numServers: numServers,
+		}
+		tp.sharedDeployments[numServers] = sd
 	}
+	sd.refs++
+	t.Logf("SharedDeployment: acquired %d server deployment (refs=%d)", numServers, sd.refs)
+	return sd
+}
 
-	// we need to scale up the dirty deployment to more servers
-	d, err := docker.NewDeployer("dirty", tp.complementBuilder.Config)
-	if err != nil {
-		ct.Fatalf(t, "dirtyDeploy: NewDeployer returned error %s", err)
+func (tp *TestPackage) releaseSharedDeployment(t ct.TestLike, sd *sharedDeployment) {
+	t.Helper()
+	tp.sharedDeploymentsMu.Lock()
+	defer tp.sharedDeploymentsMu.Unlock()
+	if tp.sharedDeployments[sd.numServers] != sd || sd.refs == 0 {
+		ct.Fatalf(t, "SharedDeployment: Destroy called more times than the deployment was acquired")
 	}
-	for i := 1; i <= numServers; i++ {
-		hsName := fmt.Sprintf("hs%d", i)
-		_, ok := tp.existingDeployment.HS[hsName]
-		if ok {
-			continue
-		}
-		// scale up
-		hsDep, err := d.CreateDirtyServer(hsName)
-		if err != nil {
-			ct.Fatalf(t, "dirtyDeploy: failed to add %s: %s", hsName, err)
-		}
-		tp.existingDeployment.HS[hsName] = hsDep
+	if t.Failed() {
+		sd.failed = true
 	}
+	sd.refs--
+	t.Logf("SharedDeployment: released %d server deployment (refs=%d)", sd.numServers, sd.refs)
+	if sd.refs > 0 {
+		return
+	}
+	delete(tp.sharedDeployments, sd.numServers)
+	// make sure logs are printed if any of the tests which used this deployment failed, not just this one.
+	sd.Deployment.Destroy(&failedTestLike{TestLike: t, failed: sd.failed})
+}
+
+// sharedDeployment is a reference-counted Deployment. Calling Destroy releases a reference rather
+// than destroying the underlying deployment.
+type sharedDeployment struct {
+	Deployment
+	tp         *TestPackage
+	numServers int
+	refs       int
+	// true if any test which held a reference to this deployment failed
+	failed bool
+}
+
+func (sd *sharedDeployment) Destroy(t ct.TestLike) {
+	t.Helper()
+	sd.tp.releaseSharedDeployment(t, sd)
+}
+
+// failedTestLike reports the test as failed if `failed` is set, regardless of the wrapped test state.
+type failedTestLike struct {
+	ct.TestLike
+	failed bool
+}
 
-	return tp.existingDeployment
+func (f *failedTestLike) Failed() bool {
+	return f.failed || f.TestLike.Failed()
 }
 
-// converts the requested number of servers into a single blueprint, which can be deployed using normal blueprint machinery.
-func mapServersToBlueprint(numServers int) b.Blueprint {
+// NumServersBlueprint returns the blueprint used by Deploy(t, numServers), which has `numServers`
+// homeservers named hs1, hs2, etc with no users or rooms.
+func NumServersBlueprint(numServers int) b.Blueprint {
 	servers := make([]b.Homeserver, numServers)
 	for i := range servers {
 		servers[i] = b.Homeserver{
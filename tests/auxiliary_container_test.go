@@ -0,0 +1,36 @@
+package tests
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestAuxiliaryContainer(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	aux := complement.StartAuxiliaryContainer(t, deployment, "static", "nginx:alpine", complement.AuxiliaryContainerOpts{
+		Files: map[string][]byte{
+			"/usr/share/nginx/html/hello.txt": []byte("hello complement"),
+		},
+		Ports: []int{80},
+	})
+
+	t.Run("Reachable from the network by name", func(t *testing.T) {
+		result := complement.RunContainer(t, deployment, "curlimages/curl:latest", "-sf", "--retry", "5", "--retry-connrefused", "http://"+aux.Hostname+"/hello.txt")
+		must.Equal(t, result.ExitCode, 0, "curl exit code: "+result.Stderr)
+		must.Equal(t, result.Stdout, "hello complement", "body")
+	})
+	t.Run("Reachable from the host via published ports", func(t *testing.T) {
+		res, err := http.Get("http://" + aux.Addresses[80] + "/hello.txt")
+		must.NotError(t, "failed to GET from auxiliary container", err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		must.NotError(t, "failed to read body", err)
+		must.Equal(t, string(body), "hello complement", "body")
+	})
+}
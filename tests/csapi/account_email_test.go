@@ -0,0 +1,75 @@
+package csapi_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/email"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+// Homeservers only send emails if the image configures email sending using COMPLEMENT_SMTP_HOST
+// and COMPLEMENT_SMTP_PORT, so this test is skipped if the homeserver refuses to send the email.
+func TestAddEmailThreePIDSendsValidationEmail(t *testing.T) {
+	deployment := complement.Deploy(t, 1, complement.WithEmailServer())
+	defer deployment.Destroy(t)
+	password := "superuser"
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{
+		Password: password,
+	})
+	address := "alice@example.org"
+	clientSecret := "complement_client_secret"
+
+	res := alice.Do(t, "POST", []string{"_matrix", "client", "v3", "account", "3pid", "email", "requestToken"},
+		client.WithJSONBody(t, map[string]interface{}{
+			"client_secret": clientSecret,
+			"email":         address,
+			"send_attempt":  1,
+		}),
+	)
+	if res.StatusCode != 200 {
+		t.Skipf("homeserver is not configured to send emails: HTTP %d", res.StatusCode)
+	}
+	sid := must.ParseJSON(t, res.Body).Get("sid").Str
+
+	msg := complement.EmailServer(t, deployment).WaitForMessage(t, 10*time.Second, email.To(address))
+	link := msg.LinkWithQueryParam("token")
+	if link == nil {
+		t.Fatalf("validation email did not contain a link with a token: %s", msg.Text)
+	}
+	must.Equal(t, link.Query().Get("client_secret"), clientSecret, "client_secret in validation link")
+	must.Equal(t, link.Query().Get("sid"), sid, "sid in validation link")
+	// submit the token to the homeserver, as if the user clicked the link
+	alice.MustDo(t, "POST", []string{"_matrix", "client", "v3", "account", "3pid", "email", "submit_token"},
+		client.WithJSONBody(t, map[string]interface{}{
+			"client_secret": clientSecret,
+			"sid":           sid,
+			"token":         link.Query().Get("token"),
+		}),
+	)
+	alice.MustDo(t, "POST", []string{"_matrix", "client", "v3", "account", "3pid", "add"},
+		client.WithJSONBody(t, map[string]interface{}{
+			"client_secret": clientSecret,
+			"sid":           sid,
+			"auth": map[string]interface{}{
+				"type":     "m.login.password",
+				"user":     alice.UserID,
+				"password": password,
+			},
+		}),
+	)
+	res = alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "account", "3pid"})
+	must.MatchResponse(t, res, match.HTTPResponse{
+		JSON: []match.JSON{
+			match.JSONCheckOff("threepids", []interface{}{address}, match.CheckOffMapper(func(r gjson.Result) interface{} {
+				return r.Get("address").Str
+			})),
+		},
+	})
+}
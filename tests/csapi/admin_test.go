@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/tidwall/gjson"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/match"
 	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/runtime"
 	"github.com/matrix-org/gomatrixserverlib/spec"
 )
 
@@ -91,7 +93,49 @@ func TestServerNotices(t *testing.T) {
 			t.Errorf("expected event IDs to be the same, but got '%s' and '%s'", eventID1, eventID2)
 		}
 	})
+	t.Run("Alice can find the server notices room by its tag", func(t *testing.T) {
+		eventID := admin.MustSendServerNotice(t, alice.UserID, map[string]interface{}{
+			"msgtype": "m.server_notice",
+			"body":    "hello from server notices!",
+		}, "")
+		if noticesRoomID := alice.MustJoinServerNoticesRoom(t); noticesRoomID != roomID {
+			t.Errorf("expected the server notices room %s, but got %s", roomID, noticesRoomID)
+		}
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHas(roomID, func(ev gjson.Result) bool {
+			return ev.Get("event_id").Str == eventID && match.ServerNotice("hello from server notices!")(ev) == nil
+		}))
+	})
+}
 
+// Test that the user agent of a client is visible to admins via /admin/whois
+func TestWhoisUserAgent(t *testing.T) {
+	runtime.SkipIf(t, runtime.Dendrite) // Dendrite does not record user agents
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	admin := deployment.Register(t, "hs1", helpers.RegistrationOpts{
+		IsAdmin: true,
+	})
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	userAgent := "Complement/1.0 (whois test)"
+	alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"}, client.WithUserAgent(userAgent))
+
+	// homeservers may batch up writes of client connection info, so retry until it is visible.
+	admin.MustDo(t, "GET", []string{"_matrix", "client", "v3", "admin", "whois", alice.UserID},
+		client.WithRetryUntil(10*time.Second, func(res *http.Response) bool {
+			body := client.ParseJSON(t, res)
+			for _, device := range gjson.GetBytes(body, "devices").Map() {
+				for _, session := range device.Get("sessions").Array() {
+					for _, conn := range session.Get("connections").Array() {
+						if conn.Get("user_agent").Str == userAgent {
+							return true
+						}
+					}
+				}
+			}
+			return false
+		}),
+	)
 }
 
 func sendServerNotice(t *testing.T, admin *client.CSAPI, reqBody client.RequestOpt, txnID *string) (eventID string) {
@@ -9,6 +9,7 @@ import (
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
 	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/match"
@@ -163,3 +164,28 @@ func TestLogin(t *testing.T) {
 		})
 	})
 }
+
+// Test that users created by blueprints can be logged in as on multiple devices.
+func TestLoginBlueprintUserDevices(t *testing.T) {
+	deployment := complement.OldDeploy(t, b.BlueprintAlice)
+	defer deployment.Destroy(t)
+
+	clients := complement.LoginDevices(t, deployment, "hs1", "@alice:hs1", "", 2)
+	if clients[0].DeviceID == clients[1].DeviceID {
+		t.Fatalf("expected different device IDs, got %s twice", clients[0].DeviceID)
+	}
+	alice := complement.LoginUser(t, deployment, "hs1", "@alice:hs1", "", helpers.LoginOpts{DeviceID: "ALICE_PHONE"})
+	must.Equal(t, alice.DeviceID, "ALICE_PHONE", "device ID")
+
+	res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "devices"})
+	must.MatchResponse(t, res, match.HTTPResponse{
+		JSON: []match.JSON{
+			match.JSONCheckOff("devices", []interface{}{clients[0].DeviceID, clients[1].DeviceID, "ALICE_PHONE"},
+				match.CheckOffMapper(func(r gjson.Result) interface{} {
+					return r.Get("device_id").Str
+				}),
+				match.CheckOffAllowUnwanted(),
+			),
+		},
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/match"
 	"github.com/matrix-org/complement/must"
@@ -91,3 +92,40 @@ func TestLogout(t *testing.T) {
 		})
 	})
 }
+
+func TestLogoutTokenState(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	password := "superuser"
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{
+		Password: password,
+	})
+
+	t.Run("Whoami returns the device of the access token", func(t *testing.T) {
+		whoami := alice.MustWhoami(t)
+		must.Equal(t, whoami.DeviceID, alice.DeviceID, "whoami device ID")
+		res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.WhoamiDeviceID(alice.DeviceID),
+				match.WhoamiIsGuest(false),
+			},
+		})
+	})
+	t.Run("Logging out is a hard logout", func(t *testing.T) {
+		_, clientToLogout := createSession(t, deployment, alice.UserID, password)
+		clientToLogout.MustHaveTokenState(t, client.TokenValid)
+		clientToLogout.MustLogout(t)
+		clientToLogout.MustHaveTokenState(t, client.TokenLoggedOut)
+		res := clientToLogout.Do(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: http.StatusUnauthorized,
+			JSON: []match.JSON{
+				match.SoftLogout(false),
+			},
+		})
+		// other sessions are unaffected
+		alice.MustHaveTokenState(t, client.TokenValid)
+	})
+}
@@ -0,0 +1,75 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/captcha"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+// Homeservers only require captchas if the image is configured to do so using the
+// COMPLEMENT_RECAPTCHA_* environment variables, so this test is skipped if registration does not
+// offer the m.login.recaptcha stage.
+func TestRegistrationWithCaptcha(t *testing.T) {
+	deployment := complement.Deploy(t, 1, complement.WithCaptchaServer())
+	defer deployment.Destroy(t)
+	unauthedClient := deployment.UnauthenticatedClient(t, "hs1")
+	captchaServer := complement.CaptchaServer(t, deployment)
+
+	res := unauthedClient.Do(t, "POST", []string{"_matrix", "client", "v3", "register"}, client.WithJSONBody(t, map[string]interface{}{}))
+	body := must.ParseJSON(t, res.Body)
+	if !body.Get(`flows.#.stages|@flatten|#(=="m.login.recaptcha")`).Exists() {
+		t.Skipf("homeserver does not require captchas for registration: %s", body.Get("flows").Raw)
+	}
+	must.Equal(t, body.Get(`params.m\.login\.recaptcha.public_key`).Str, captcha.PublicKey, "recaptcha public_key")
+
+	stages := map[string]client.UIAStage{
+		"m.login.recaptcha": client.RecaptchaStage("complement_captcha_response"),
+		"m.login.dummy":     client.DummyStage(),
+		"m.login.terms":     termsStage,
+	}
+	t.Run("Registration fails if the captcha is not verified", func(t *testing.T) {
+		captchaServer.SetVerifier(func(req captcha.VerifyRequest) captcha.VerifyResponse {
+			return captcha.Deny("invalid-input-response")
+		})
+		res := unauthedClient.DoUIA(t, "POST", []string{"_matrix", "client", "v3", "register"}, map[string]interface{}{
+			"username": "captcha_denied",
+			"password": "complement_meets_min_password_req",
+		}, stages)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 401,
+		})
+	})
+	t.Run("Registration succeeds if the captcha is verified", func(t *testing.T) {
+		captchaServer.SetVerifier(func(req captcha.VerifyRequest) captcha.VerifyResponse {
+			if req.Response != "complement_captcha_response" {
+				return captcha.Deny("invalid-input-response")
+			}
+			return captcha.Approve()
+		})
+		res := unauthedClient.DoUIA(t, "POST", []string{"_matrix", "client", "v3", "register"}, map[string]interface{}{
+			"username": "captcha_approved",
+			"password": "complement_meets_min_password_req",
+		}, stages)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 200,
+			JSON: []match.JSON{
+				match.JSONKeyPresent("access_token"),
+			},
+		})
+		requests := captchaServer.Requests()
+		must.Equal(t, requests[len(requests)-1].Response, "complement_captcha_response", "captcha response verified by homeserver")
+	})
+}
+
+func termsStage(session string, params gjson.Result) map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "m.login.terms",
+		"session": session,
+	}
+}
@@ -0,0 +1,85 @@
+package csapi_tests
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/appservice"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestApplicationServiceExclusiveNamespaces(t *testing.T) {
+	as := appservice.NewServer(t, complement.GetConfig(t), "namespaces")
+	cancel := as.Listen()
+	defer cancel()
+
+	registration := as.ApplicationService()
+	registration.UserNamespaces = []b.ApplicationServiceNamespace{
+		{Exclusive: true, Regex: "@_bridge_.*:hs1"},
+	}
+	registration.AliasNamespaces = []b.ApplicationServiceNamespace{
+		{Exclusive: true, Regex: "#_bridge_.*:hs1"},
+	}
+	// the appservice URL contains a random port, so the blueprint must not be reused between runs
+	asURL, err := url.Parse(as.URL())
+	must.NotError(t, "failed to parse appservice URL", err)
+	deployment := complement.OldDeploy(t, b.MustValidate(b.Blueprint{
+		Name: "namespaces_" + asURL.Port(),
+		Homeservers: []b.Homeserver{
+			{
+				Name:                "hs1",
+				ApplicationServices: []b.ApplicationService{registration},
+			},
+		},
+	}))
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{})
+
+	asClient := deployment.UnauthenticatedClient(t, "hs1")
+	asClient.AccessToken = as.ASToken
+
+	t.Run("Users cannot register in an exclusive namespace", func(t *testing.T) {
+		res := deployment.UnauthenticatedClient(t, "hs1").Do(t, "GET", []string{"_matrix", "client", "v3", "register", "available"},
+			client.WithQueries(url.Values{"username": {"_bridge_bob"}}),
+		)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 400,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_EXCLUSIVE"),
+			},
+		})
+	})
+	t.Run("Application services can register in their exclusive namespace", func(t *testing.T) {
+		res := asClient.MustDo(t, "POST", []string{"_matrix", "client", "v3", "register"}, client.WithJSONBody(t, map[string]interface{}{
+			"type":     "m.login.application_service",
+			"username": "_bridge_charlie",
+		}))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("user_id", "@_bridge_charlie:hs1"),
+			},
+		})
+	})
+	t.Run("Users cannot create aliases in an exclusive namespace", func(t *testing.T) {
+		res := alice.Do(t, "PUT", []string{"_matrix", "client", "v3", "directory", "room", "#_bridge_general:hs1"}, client.WithJSONBody(t, map[string]interface{}{
+			"room_id": roomID,
+		}))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 400,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_EXCLUSIVE"),
+			},
+		})
+	})
+	t.Run("Users can create aliases outside the exclusive namespaces", func(t *testing.T) {
+		alice.MustDo(t, "PUT", []string{"_matrix", "client", "v3", "directory", "room", "#general:hs1"}, client.WithJSONBody(t, map[string]interface{}{
+			"room_id": roomID,
+		}))
+	})
+}
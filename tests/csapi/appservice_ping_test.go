@@ -0,0 +1,60 @@
+package csapi_tests
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/appservice"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestApplicationServicePing(t *testing.T) {
+	as := appservice.NewServer(t, complement.GetConfig(t), "ping")
+	cancel := as.Listen()
+	defer cancel()
+
+	// the appservice URL contains a random port, so the blueprint must not be reused between runs
+	asURL, err := url.Parse(as.URL())
+	must.NotError(t, "failed to parse appservice URL", err)
+	deployment := complement.OldDeploy(t, b.MustValidate(b.Blueprint{
+		Name: "ping_" + asURL.Port(),
+		Homeservers: []b.Homeserver{
+			{
+				Name:                "hs1",
+				ApplicationServices: []b.ApplicationService{as.ApplicationService()},
+			},
+		},
+	}))
+	defer deployment.Destroy(t)
+
+	asClient := deployment.UnauthenticatedClient(t, "hs1")
+	asClient.AccessToken = as.ASToken
+
+	t.Run("Ping reaches the appservice", func(t *testing.T) {
+		asClient.MustPingAppService(t, as.ID, "complement_txn_1")
+		must.ContainSubset(t, as.Pings(), []string{"complement_txn_1"})
+	})
+	t.Run("Ping fails if the appservice is unhealthy", func(t *testing.T) {
+		as.SetPingStatus(500)
+		defer as.SetPingStatus(200)
+		res := asClient.PingAppService(t, as.ID, "complement_txn_2")
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 502,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_BAD_STATUS"),
+			},
+		})
+	})
+	t.Run("Cannot ping another appservice", func(t *testing.T) {
+		res := asClient.PingAppService(t, "not_"+as.ID, "")
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 403,
+			JSON: []match.JSON{
+				match.JSONKeyEqual("errcode", "M_FORBIDDEN"),
+			},
+		})
+	})
+}
@@ -0,0 +1,72 @@
+package csapi_tests
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/appservice"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that application services can lazily provision rooms when the homeserver queries an alias in
+// their namespace.
+func TestApplicationServiceAliasQuery(t *testing.T) {
+	as := appservice.NewServer(t, complement.GetConfig(t), "aliasquery")
+	cancel := as.Listen()
+	defer cancel()
+
+	registration := as.ApplicationService()
+	registration.AliasNamespaces = []b.ApplicationServiceNamespace{
+		{Exclusive: true, Regex: "#_bridge_.*:hs1"},
+	}
+	// the appservice URL contains a random port, so the blueprint must not be reused between runs
+	asURL, err := url.Parse(as.URL())
+	must.NotError(t, "failed to parse appservice URL", err)
+	deployment := complement.OldDeploy(t, b.MustValidate(b.Blueprint{
+		Name: "aliasquery_" + asURL.Port(),
+		Homeservers: []b.Homeserver{
+			{
+				Name:                "hs1",
+				ApplicationServices: []b.ApplicationService{registration},
+			},
+		},
+	}))
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	asClient := deployment.UnauthenticatedClient(t, "hs1")
+	asClient.AccessToken = as.ASToken
+	as.SetAliasQueryHandler(func(roomAlias string) bool {
+		if roomAlias != "#_bridge_general:hs1" {
+			return false
+		}
+		res := asClient.Do(t, "POST", []string{"_matrix", "client", "v3", "createRoom"}, client.WithJSONBody(t, map[string]interface{}{
+			"preset":          "public_chat",
+			"room_alias_name": "_bridge_general",
+		}))
+		return res.StatusCode == 200
+	})
+
+	t.Run("Querying a provisioned alias creates the room", func(t *testing.T) {
+		roomID := alice.MustJoinRoom(t, "#_bridge_general:hs1", nil)
+		must.ContainSubset(t, as.AliasQueries(), []string{"#_bridge_general:hs1"})
+		res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "directory", "room", "#_bridge_general:hs1"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("room_id", roomID),
+			},
+		})
+	})
+	t.Run("Querying an unknown alias is not found", func(t *testing.T) {
+		res := alice.Do(t, "GET", []string{"_matrix", "client", "v3", "directory", "room", "#_bridge_missing:hs1"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 404,
+		})
+		must.ContainSubset(t, as.AliasQueries(), []string{"#_bridge_missing:hs1"})
+	})
+}
@@ -0,0 +1,83 @@
+package csapi_tests
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/wellknown"
+)
+
+func TestClientWellKnownDiscovery(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	srv := wellknown.NewServer(t, deployment.GetConfig())
+	cancel := srv.Listen()
+	defer cancel()
+	httpClient := &http.Client{Timeout: time.Second}
+
+	testCases := []struct {
+		name       string
+		res        wellknown.Response
+		wantAction wellknown.Action
+	}{
+		{name: "Valid well-known discovers the homeserver", res: wellknown.Valid(alice.BaseURL, ""), wantAction: wellknown.ActionPrompt},
+		{name: "Missing well-known is ignored", res: wellknown.NotFound(), wantAction: wellknown.ActionIgnore},
+		{name: "Malformed well-known fails", res: wellknown.Malformed(), wantAction: wellknown.ActionFailPrompt},
+		{name: "Slow well-known fails", res: wellknown.Slow(wellknown.Valid(alice.BaseURL, ""), 2*time.Second), wantAction: wellknown.ActionFailPrompt},
+		// the homeserver does not implement the identity server API
+		{name: "Invalid identity server fails", res: wellknown.Valid(alice.BaseURL, alice.BaseURL), wantAction: wellknown.ActionFailError},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv.SetResponse(tc.res)
+			got := wellknown.Discover(httpClient, srv.LocalURL())
+			if got.Action != tc.wantAction {
+				t.Fatalf("got action %s want %s: %v", got.Action, tc.wantAction, got.Err)
+			}
+			if tc.wantAction == wellknown.ActionPrompt && got.HomeserverURL != alice.BaseURL {
+				t.Errorf("got homeserver URL %s want %s", got.HomeserverURL, alice.BaseURL)
+			}
+		})
+	}
+}
+
+func TestClientWellKnownDiscoveryEndToEnd(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	opts := client.CSAPIOpts{
+		UserID:      alice.UserID,
+		AccessToken: alice.AccessToken,
+		DeviceID:    alice.DeviceID,
+	}
+
+	t.Run("Client discovered via a well-known server can use the homeserver", func(t *testing.T) {
+		srv := wellknown.NewServer(t, deployment.GetConfig(), wellknown.WithResponse(wellknown.Valid(alice.BaseURL, "")))
+		cancel := srv.Listen()
+		defer cancel()
+		discovered, _ := wellknown.MustDiscoverClient(t, srv.LocalURL(), opts)
+		if discovered.BaseURL != alice.BaseURL {
+			t.Errorf("got base URL %s want %s", discovered.BaseURL, alice.BaseURL)
+		}
+		discovered.MustWhoami(t)
+		if srv.Requests() != 1 {
+			t.Errorf("got %d well-known requests, want 1", srv.Requests())
+		}
+	})
+
+	// Homeservers may serve their own well-known document, in which case it must lead back to them.
+	t.Run("Homeserver-hosted well-known leads to a working homeserver", func(t *testing.T) {
+		d := wellknown.Discover(&http.Client{Timeout: 5 * time.Second}, alice.BaseURL)
+		if d.Action == wellknown.ActionIgnore {
+			t.Skipf("homeserver does not serve /.well-known/matrix/client")
+		}
+		discovered, _ := wellknown.MustDiscoverClient(t, alice.BaseURL, opts)
+		discovered.MustWhoami(t)
+	})
+}
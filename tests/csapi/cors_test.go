@@ -0,0 +1,48 @@
+package csapi_tests
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestCORS(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	origin := "https://client.example.com"
+
+	endpoints := []struct {
+		method string
+		paths  []string
+	}{
+		{"GET", []string{"_matrix", "client", "versions"}},
+		{"POST", []string{"_matrix", "client", "v3", "login"}},
+		{"GET", []string{"_matrix", "client", "v3", "sync"}},
+		{"PUT", []string{"_matrix", "client", "v3", "profile", alice.UserID, "displayname"}},
+	}
+	t.Run("Preflight requests are answered with CORS headers", func(t *testing.T) {
+		for _, endpoint := range endpoints {
+			res := alice.Preflight(t, endpoint.method, endpoint.paths, origin, "Authorization", "Content-Type")
+			if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+				t.Errorf("OPTIONS %v returned HTTP %d, want 200 or 204", endpoint.paths, res.StatusCode)
+				continue
+			}
+			must.MatchResponse(t, res, match.HTTPResponse{
+				HeaderMatchers: match.CORS(),
+			})
+		}
+	})
+	t.Run("Responses include CORS headers", func(t *testing.T) {
+		res := alice.Do(t, "GET", []string{"_matrix", "client", "v3", "account", "whoami"}, client.WithHeader("Origin", origin))
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode:     http.StatusOK,
+			HeaderMatchers: match.CORS(),
+		})
+	})
+}
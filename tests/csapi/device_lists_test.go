@@ -462,3 +462,21 @@ func TestDeviceListUpdates(t *testing.T) {
 	t.Run("when local user rejoins a room", func(t *testing.T) { testOtherUserRejoin(t, deployment, "hs1", "hs1") })
 	t.Run("when remote user rejoins a room", func(t *testing.T) { testOtherUserRejoin(t, deployment, "hs1", "hs2") })
 }
+
+// Tests that users are not notified about device list updates of users they share no rooms with. The
+// absence of an update is checked using a barrier, as homeservers may process updates asynchronously.
+func TestDeviceListUpdatesNotSentToUnrelatedUsers(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{LocalpartSuffix: "alice"})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{LocalpartSuffix: "bob"})
+	barry := deployment.Register(t, "hs1", helpers.RegistrationOpts{LocalpartSuffix: "barry"})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	barry.MustJoinRoom(t, roomID, nil)
+	since := alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(barry.UserID, roomID))
+
+	deviceKeys, _ := bob.MustGenerateOneTimeKeys(t, 0)
+	bob.MustUploadKeys(t, deviceKeys, nil)
+	alice.MustSyncDeviceListBarrier(t, since, barry, bob.UserID)
+}
@@ -0,0 +1,50 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/limits"
+)
+
+// Test that events are accepted up to the size limits in the spec, and rejected beyond them.
+func TestEventSizeLimits(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{})
+
+	mustReject := func(t *testing.T, ev b.Event) {
+		t.Helper()
+		if ev.StateKey != nil {
+			res := alice.Do(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "state", ev.Type, *ev.StateKey}, client.WithJSONBody(t, ev.Content))
+			limits.MustRejectAsTooLarge(t, res)
+			return
+		}
+		res := alice.Do(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "send", ev.Type, helpers.GetTxnID("limits")}, client.WithJSONBody(t, ev.Content))
+		limits.MustRejectAsTooLarge(t, res)
+	}
+
+	t.Run("Event near the size limit is accepted", func(t *testing.T) {
+		alice.SendEventSynced(t, roomID, limits.ClientEventNearLimit())
+	})
+	t.Run("Event over the size limit is rejected", func(t *testing.T) {
+		mustReject(t, limits.ClientEventOverLimit())
+	})
+	t.Run("State key at the length limit is accepted", func(t *testing.T) {
+		alice.SendEventSynced(t, roomID, limits.StateEventWithKeySize(limits.MaxIDSize))
+	})
+	t.Run("State key over the length limit is rejected", func(t *testing.T) {
+		mustReject(t, limits.StateEventWithKeySize(limits.MaxIDSize+1))
+	})
+	t.Run("Event type at the length limit is accepted", func(t *testing.T) {
+		alice.SendEventSynced(t, roomID, limits.EventWithTypeSize(limits.MaxIDSize))
+	})
+	t.Run("Event type over the length limit is rejected", func(t *testing.T) {
+		mustReject(t, limits.EventWithTypeSize(limits.MaxIDSize+1))
+	})
+}
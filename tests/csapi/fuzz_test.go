@@ -0,0 +1,79 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/fuzz"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Sends malformed request bodies to common endpoints and checks the server never 5xxs.
+func TestFuzzRequestBodies(t *testing.T) {
+	if !complement.GetConfig(t).LongMode {
+		t.Skipf("fuzzing tests are only run when COMPLEMENT_LONG_MODE=1")
+	}
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	checkRoomStillWorks := func(t ct.TestLike) {
+		alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "still working",
+			},
+		})
+	}
+
+	templates := map[string]fuzz.Template{
+		"createRoom": {
+			Method: "POST",
+			Paths:  []string{"_matrix", "client", "v3", "createRoom"},
+			Body: map[string]interface{}{
+				"preset":     "private_chat",
+				"name":       "Fuzz",
+				"topic":      "Fuzzing",
+				"invite":     []string{},
+				"visibility": "private",
+			},
+		},
+		"send": {
+			Method: "PUT",
+			Paths:  []string{"_matrix", "client", "v3", "rooms", roomID, "send", "m.room.message", fuzz.TxnIDPlaceholder},
+			Body: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "Hello world",
+			},
+		},
+		"displayname": {
+			Method: "PUT",
+			Paths:  []string{"_matrix", "client", "v3", "profile", alice.UserID, "displayname"},
+			Body: map[string]interface{}{
+				"displayname": "Alice",
+			},
+		},
+		"filter": {
+			Method: "POST",
+			Paths:  []string{"_matrix", "client", "v3", "user", alice.UserID, "filter"},
+			Body: map[string]interface{}{
+				"room": map[string]interface{}{
+					"timeline": map[string]interface{}{"limit": 10},
+				},
+				"presence": map[string]interface{}{"types": []string{"m.presence"}},
+			},
+		},
+	}
+	for name, tmpl := range templates {
+		t.Run(name, func(t *testing.T) {
+			fuzz.MustNotServerError(t, alice, tmpl, fuzz.Opts{
+				Seed:       1,
+				CheckState: checkRoomStillWorks,
+			})
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/runtime"
+)
+
+func TestLoginSSORedirect(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	unauthedClient := deployment.UnauthenticatedClient(t, "hs1")
+
+	flows := must.ParseJSON(t, unauthedClient.MustDo(t, "GET", []string{"_matrix", "client", "v3", "login"}).Body)
+	var ssoFlow gjson.Result
+	for _, flow := range flows.Get("flows").Array() {
+		if flow.Get("type").Str == "m.login.sso" {
+			ssoFlow = flow
+		}
+	}
+	if !ssoFlow.Exists() {
+		t.Skipf("homeserver does not advertise m.login.sso")
+	}
+
+	redirectURL := "http://localhost/complement-client"
+	idpID := ssoFlow.Get("identity_providers.0.id").Str
+	hops := unauthedClient.SSORedirectChain(t, idpID, redirectURL)
+	t.Logf("SSO redirect chain: %v", hops)
+	// the homeserver must send the user somewhere, rather than logging them straight in
+	must.MatchRedirect(t, hops[0].Location, match.RedirectLacksQueryParam("loginToken"))
+}
+
+func TestLoginFallback(t *testing.T) {
+	runtime.SkipIf(t, runtime.Dendrite) // does not serve the login fallback
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	unauthedClient := deployment.UnauthenticatedClient(t, "hs1")
+
+	page := client.MustGetFallbackPage(t, unauthedClient.GetLoginFallback(t))
+	if len(page) == 0 {
+		t.Fatalf("login fallback page is empty")
+	}
+}
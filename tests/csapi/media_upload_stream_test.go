@@ -0,0 +1,52 @@
+package csapi_tests
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestMediaUploadStream(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	t.Run("Uploads of unknown length are accepted", func(t *testing.T) {
+		want := bytes.Repeat([]byte{'a'}, 256*1024)
+		mxcURI := alice.MustUploadContentStream(t, client.NewSizedReader(int64(len(want)), 'a'), client.UploadStreamOpts{
+			FileName:  "stream.bin",
+			Length:    -1,
+			ChunkSize: 4096,
+		})
+		got, _ := alice.DownloadContentAuthenticated(t, mxcURI)
+		if !bytes.Equal(got, want) {
+			t.Errorf("downloaded %d bytes, want the %d bytes uploaded", len(got), len(want))
+		}
+	})
+
+	maxUploadSize := alice.MustGetMaxUploadSize(t)
+	if maxUploadSize < 0 {
+		t.Logf("Homeserver does not advertise m.upload.size, skipping max upload size tests")
+		return
+	}
+	for name, length := range map[string]int64{"known": maxUploadSize + 1, "unknown": -1} {
+		t.Run("Uploads larger than m.upload.size are rejected with "+name+" length", func(t *testing.T) {
+			res := alice.UploadContentStream(t, client.NewSizedReader(maxUploadSize+1, 'b'), client.UploadStreamOpts{
+				Length: length,
+			})
+			must.MatchResponse(t, res, match.HTTPResponse{
+				StatusCode: http.StatusRequestEntityTooLarge,
+				JSON: []match.JSON{
+					match.JSONKeyEqual("errcode", "M_TOO_LARGE"),
+				},
+			})
+		})
+	}
+}
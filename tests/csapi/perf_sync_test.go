@@ -0,0 +1,50 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/perf"
+)
+
+// Measures initial and incremental /sync latency for a user in a room with thousands of messages. The
+// report is written to the artifacts directory, so it can be used as the baseline for a newer image via
+// COMPLEMENT_PERF_BASELINE_DIR.
+func TestPerfSyncLatency(t *testing.T) {
+	deployment := complement.OldDeploy(t, b.BlueprintPerfManyMessages)
+	defer deployment.Destroy(t)
+	if !deployment.GetConfig().LongMode {
+		t.Skipf("load tests are only run when COMPLEMENT_LONG_MODE=1")
+	}
+
+	alice := complement.LoginUser(t, deployment, "hs1", "@alice:hs1", "", helpers.LoginOpts{})
+	bob := complement.LoginUser(t, deployment, "hs1", "@bob:hs1", "", helpers.LoginOpts{})
+	res := bob.MustDo(t, "GET", []string{"_matrix", "client", "v3", "joined_rooms"})
+	roomID := gjson.GetBytes(client.ParseJSON(t, res), "joined_rooms.0").Str
+	if roomID == "" {
+		t.Fatalf("bob is not joined to any rooms")
+	}
+
+	t.Run("Full state", func(t *testing.T) {
+		result := perf.MeasureSync(t, perf.SyncOpts{
+			Client: alice,
+			Sender: bob,
+			RoomID: roomID,
+		})
+		result.MustRecord(t, "sync")
+	})
+	t.Run("Lazy-loaded members", func(t *testing.T) {
+		result := perf.MeasureSync(t, perf.SyncOpts{
+			Client: alice,
+			Sender: bob,
+			RoomID: roomID,
+			Filter: `{"room":{"state":{"lazy_load_members":true}}}`,
+		})
+		result.MustRecord(t, "sync")
+	})
+}
@@ -0,0 +1,45 @@
+package csapi_tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/perf"
+)
+
+// Drives a mix of sends, syncs and pagination into a shared room and checks latencies stay reasonable.
+func TestPerfBasicTrafficMix(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	if !deployment.GetConfig().LongMode {
+		t.Skipf("load tests are only run when COMPLEMENT_LONG_MODE=1")
+	}
+
+	clients := make([]*client.CSAPI, 10)
+	for i := range clients {
+		clients[i] = deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	}
+	roomID := clients[0].MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	for _, c := range clients[1:] {
+		c.MustJoinRoom(t, roomID, nil)
+	}
+
+	result := perf.Run(t, perf.Opts{
+		Clients:  clients,
+		Requests: 500,
+		Seed:     1,
+		Mix: []perf.Op{
+			perf.SendMessage(roomID, 5),
+			perf.InitialSync(2),
+			perf.Messages(roomID, 3),
+		},
+	})
+	result.MustMeetSLOs(t, map[string]perf.SLO{
+		"send":     {P99: 2 * time.Second},
+		"sync":     {P99: 5 * time.Second},
+		"messages": {P99: 2 * time.Second},
+	})
+}
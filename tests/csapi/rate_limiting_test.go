@@ -0,0 +1,72 @@
+package csapi_tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/runtime"
+)
+
+func TestRateLimiting(t *testing.T) {
+	runtime.SkipIf(t, runtime.Dendrite, runtime.Conduwuit) // no admin API for rate limit overrides
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	admin := deployment.Register(t, "hs1", helpers.RegistrationOpts{IsAdmin: true})
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	message := b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "rate limited?",
+		},
+	}
+	txnID := 0
+	sendMessages := func(count int) (limited bool) {
+		for i := 0; i < count; i++ {
+			txnID++
+			res := alice.Do(t, "PUT", []string{"_matrix", "client", "v3", "rooms", roomID, "send", message.Type, fmt.Sprintf("ratelimit-%d", txnID)}, client.WithJSONBody(t, message.Content))
+			if res.StatusCode == 429 {
+				must.MatchResponse(t, res, match.HTTPResponse{
+					JSON: []match.JSON{
+						match.JSONKeyEqual("errcode", "M_LIMIT_EXCEEDED"),
+					},
+				})
+				return true
+			}
+			must.MatchResponse(t, res, match.HTTPResponse{StatusCode: 200})
+		}
+		return false
+	}
+
+	t.Run("Users are rate limited once a strict override is set", func(t *testing.T) {
+		admin.SetRateLimitOverride(t, alice.UserID, 1, 1)
+		if !sendMessages(10) {
+			t.Fatalf("sent 10 messages without being rate limited")
+		}
+	})
+	t.Run("DisableRateLimiting lifts rate limits for existing and new users", func(t *testing.T) {
+		complement.DisableRateLimiting(t, deployment, "hs1")
+		if sendMessages(20) {
+			t.Fatalf("rate limited after DisableRateLimiting")
+		}
+		bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+		bob.MustJoinRoom(t, roomID, nil)
+		for i := 0; i < 20; i++ {
+			bob.Unsafe_SendEventUnsynced(t, roomID, message)
+		}
+	})
+	t.Run("EnableRateLimiting restores the configured rate limits", func(t *testing.T) {
+		complement.EnableRateLimiting(t, deployment, "hs1")
+		admin.SetRateLimitOverride(t, alice.UserID, 1, 1)
+		if !sendMessages(10) {
+			t.Fatalf("sent 10 messages without being rate limited")
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package csapi_tests
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/runtime"
+)
+
+func TestReport(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	admin := deployment.Register(t, "hs1", helpers.RegistrationOpts{
+		IsAdmin: true,
+	})
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.MustJoinRoom(t, roomID, nil)
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "something offensive",
+		},
+	})
+
+	t.Run("Can report an event", func(t *testing.T) {
+		score := -100
+		bob.MustReportEvent(t, roomID, eventID, "this is offensive", &score)
+	})
+	t.Run("Cannot report an event in a room you are not in", func(t *testing.T) {
+		charlie := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+		res := charlie.ReportEvent(t, roomID, eventID, "this is offensive", nil)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: http.StatusNotFound,
+		})
+	})
+	t.Run("Can report a room", func(t *testing.T) {
+		runtime.SkipIf(t, runtime.Dendrite) // room reporting is not implemented
+		bob.MustReportRoom(t, roomID, "this room is offensive")
+	})
+	t.Run("Admin can see event reports", func(t *testing.T) {
+		runtime.SkipIf(t, runtime.Dendrite) // uses the Synapse admin API
+		reports := admin.MustGetEventReports(t, roomID)
+		must.MatchGJSON(t, reports, match.EventReport(bob.UserID, roomID, eventID, "this is offensive"))
+	})
+}
@@ -0,0 +1,81 @@
+package csapi_tests
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/runtime"
+)
+
+func TestAdminPurgeHistory(t *testing.T) {
+	runtime.SkipIf(t, runtime.Dendrite) // uses the Synapse admin API
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	admin := deployment.Register(t, "hs1", helpers.RegistrationOpts{
+		IsAdmin: true,
+	})
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	var purgedEventIDs []string
+	for i := 0; i < 3; i++ {
+		purgedEventIDs = append(purgedEventIDs, alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "to be purged",
+			},
+		}))
+	}
+	keptEventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "to be kept",
+		},
+	})
+
+	admin.MustPurgeHistory(t, roomID, keptEventID, true)
+	alice.MustNotFindEvents(t, roomID, purgedEventIDs)
+	alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "event", keptEventID})
+}
+
+func TestAdminShutdownRoom(t *testing.T) {
+	runtime.SkipIf(t, runtime.Dendrite) // uses the Synapse admin API
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	admin := deployment.Register(t, "hs1", helpers.RegistrationOpts{
+		IsAdmin: true,
+	})
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.MustJoinRoom(t, roomID, nil)
+
+	shutdown := admin.MustShutdownRoom(t, roomID, client.ShutdownRoomOpts{
+		Block: true,
+		Purge: true,
+	})
+	must.MatchGJSON(t, shutdown, match.JSONCheckOff("kicked_users", []interface{}{alice.UserID, bob.UserID}))
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncLeftFrom(alice.UserID, roomID))
+
+	if !admin.MustGetRoomBlocked(t, roomID) {
+		t.Errorf("expected room %s to be blocked after shutting it down", roomID)
+	}
+	res := bob.JoinRoom(t, roomID, nil)
+	must.MatchResponse(t, res, match.HTTPResponse{
+		StatusCode: http.StatusForbidden,
+	})
+
+	admin.MustBlockRoom(t, roomID, false)
+	if admin.MustGetRoomBlocked(t, roomID) {
+		t.Errorf("expected room %s to be unblocked", roomID)
+	}
+}
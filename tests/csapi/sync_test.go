@@ -913,3 +913,47 @@ func respondToGetMissingEventsEndpoints(t *testing.T, srv *federation.Server, ro
 		}),
 	).Methods("POST")
 }
+
+func TestSyncLongPoll(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{})
+	since := alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(alice.UserID, roomID))
+
+	t.Run("Server waits for the timeout when there is nothing to return", func(t *testing.T) {
+		since = alice.MustSyncUntil(t, client.SyncReq{Since: since, TimeoutMillis: "0"})
+		res := alice.StartSync(t, client.SyncReq{Since: since, TimeoutMillis: "2000"}).Wait(t)
+		res.MustHonourTimeout(t, 2*time.Second, 5*time.Second)
+		since = res.NextBatch
+	})
+	t.Run("Server returns before the timeout when a new event arrives", func(t *testing.T) {
+		poll := alice.StartSync(t, client.SyncReq{Since: since, TimeoutMillis: "30000"})
+		eventID := alice.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "wake up",
+			},
+		})
+		res := poll.Wait(t)
+		if res.StatusCode != 200 || res.Duration >= 30*time.Second {
+			t.Fatalf("long-poll returned %d after %v, want 200 before the timeout", res.StatusCode, res.Duration)
+		}
+		// the event may arrive in a later response if the request woke up for something else
+		alice.MustSyncUntil(t, client.SyncReq{Since: since}, client.SyncTimelineHasEventID(roomID, eventID))
+	})
+	t.Run("Long-poll can be cancelled", func(t *testing.T) {
+		since = alice.MustSyncUntil(t, client.SyncReq{Since: since, TimeoutMillis: "0"})
+		poll := alice.StartSync(t, client.SyncReq{Since: since, TimeoutMillis: "30000"})
+		time.Sleep(100 * time.Millisecond)
+		poll.Cancel()
+		res := poll.Wait(t)
+		if !res.Cancelled {
+			t.Fatalf("long-poll was not cancelled, returned %d after %v", res.StatusCode, res.Duration)
+		}
+		// the since token is still usable after the cancelled request
+		alice.MustSync(t, client.SyncReq{Since: since, TimeoutMillis: "0"})
+	})
+}
@@ -0,0 +1,124 @@
+package csapi_tests
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/appservice"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestThirdPartyLookups(t *testing.T) {
+	as := appservice.NewServer(t, complement.GetConfig(t), "thirdparty", appservice.WithProtocol("ircish", appservice.Protocol{
+		Metadata: map[string]interface{}{
+			"user_fields":     []string{"username"},
+			"location_fields": []string{"channel"},
+			"icon":            "mxc://example.org/ircish",
+			"field_types": map[string]interface{}{
+				"username": map[string]string{"regexp": "[a-z]+", "placeholder": "alice"},
+				"channel":  map[string]string{"regexp": "#[a-z]+", "placeholder": "#general"},
+			},
+			"instances": []map[string]interface{}{
+				{
+					"desc":       "The ircish network",
+					"network_id": "ircish",
+					"fields":     map[string]string{},
+				},
+			},
+		},
+		Locations: []map[string]interface{}{
+			{"alias": "#ircish_general:hs1", "fields": map[string]interface{}{"channel": "#general"}},
+			{"alias": "#ircish_random:hs1", "fields": map[string]interface{}{"channel": "#random"}},
+		},
+		Users: []map[string]interface{}{
+			{"userid": "@ircish_bob:hs1", "fields": map[string]interface{}{"username": "bob"}},
+		},
+	}))
+	cancel := as.Listen()
+	defer cancel()
+
+	// the appservice URL contains a random port, so the blueprint must not be reused between runs
+	asURL, err := url.Parse(as.URL())
+	must.NotError(t, "failed to parse appservice URL", err)
+	deployment := complement.OldDeploy(t, b.MustValidate(b.Blueprint{
+		Name: "thirdparty_" + asURL.Port(),
+		Homeservers: []b.Homeserver{
+			{
+				Name:                "hs1",
+				ApplicationServices: []b.ApplicationService{as.ApplicationService()},
+			},
+		},
+	}))
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	t.Run("Protocols include the appservice protocol", func(t *testing.T) {
+		res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "thirdparty", "protocols"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("ircish.user_fields", []interface{}{"username"}),
+				match.JSONKeyEqual("ircish.location_fields", []interface{}{"channel"}),
+				match.JSONKeyEqual("ircish.instances.0.network_id", "ircish"),
+			},
+		})
+	})
+	t.Run("Protocol metadata can be fetched", func(t *testing.T) {
+		res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "thirdparty", "protocol", "ircish"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyEqual("icon", "mxc://example.org/ircish"),
+			},
+		})
+	})
+	t.Run("Locations can be looked up by fields", func(t *testing.T) {
+		res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "thirdparty", "location", "ircish"},
+			client.WithQueries(url.Values{"channel": {"#random"}}),
+		)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyArrayOfSize("@this", 1),
+				match.JSONKeyEqual("0.alias", "#ircish_random:hs1"),
+				match.JSONKeyEqual("0.protocol", "ircish"),
+			},
+		})
+	})
+	t.Run("Locations can be looked up by alias", func(t *testing.T) {
+		res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "thirdparty", "location"},
+			client.WithQueries(url.Values{"alias": {"#ircish_general:hs1"}}),
+		)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyArrayOfSize("@this", 1),
+				match.JSONKeyEqual("0.fields.channel", "#general"),
+			},
+		})
+	})
+	t.Run("Users can be looked up by user ID", func(t *testing.T) {
+		res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "thirdparty", "user"},
+			client.WithQueries(url.Values{"userid": {"@ircish_bob:hs1"}}),
+		)
+		must.MatchResponse(t, res, match.HTTPResponse{
+			JSON: []match.JSON{
+				match.JSONKeyArrayOfSize("@this", 1),
+				match.JSONKeyEqual("0.fields.username", "bob"),
+				match.JSONKeyEqual("0.protocol", "ircish"),
+			},
+		})
+	})
+	t.Run("Unknown protocols are not found", func(t *testing.T) {
+		res := alice.Do(t, "GET", []string{"_matrix", "client", "v3", "thirdparty", "protocol", "unknown"})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 404,
+		})
+	})
+
+	// the lookups should have been made to the appservice, which checks the hs_token
+	if len(as.Requests()) == 0 {
+		t.Errorf("expected the homeserver to query the appservice, but it made no requests")
+	}
+}
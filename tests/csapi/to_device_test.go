@@ -62,3 +62,23 @@ func TestToDeviceMessages(t *testing.T) {
 	charlie.MustSyncUntil(t, client.SyncReq{Since: charlieSince}, client.SyncToDeviceHas(alice.UserID, checkEvent))
 
 }
+
+// Test that a large volume of to-device messages to one device, which may not all fit in a single
+// /sync response, are each delivered exactly once and in order.
+func TestToDeviceMessagesLargeVolume(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	const numMessages = 250
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	_, bobSince := bob.MustSync(t, client.SyncReq{TimeoutMillis: "0"})
+
+	sequenceID := alice.MustSendToDeviceSequence(t, "my.test.type", bob.UserID, bob.DeviceID, numMessages)
+
+	messages, batchSizes, _ := bob.MustSyncToDeviceMessages(t, bobSince, "my.test.type", numMessages)
+	t.Logf("received %d messages in /sync batches of %v", len(messages), batchSizes)
+	if err := client.CheckToDeviceSequence(messages, sequenceID, numMessages); err != nil {
+		t.Fatalf("%s", err)
+	}
+}
@@ -2,6 +2,7 @@ package csapi_tests
 
 import (
 	"fmt"
+	"net/url"
 	"testing"
 
 	"github.com/matrix-org/complement"
@@ -264,3 +265,45 @@ func TestTxnIdWithRefreshToken(t *testing.T) {
 	// The event should have been deduplicated and we should get back the same event ID
 	must.Equal(t, eventID2, eventID1, "Expected eventID1 and eventID2 to be the same from a client using a refresh token")
 }
+
+// TestTxnIdempotentAfterDisconnect tests that when the connection drops before the client receives the
+// response to a /send request, retrying the request with the same transaction ID returns the original
+// event rather than sending a duplicate.
+func TestTxnIdempotentAfterDisconnect(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	c := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := c.MustCreateRoom(t, map[string]interface{}{})
+
+	proxy := c.UseProxy()
+	proxy.DisconnectBeforeResponse(client.MatchPathPrefix("/_matrix/client/v3/rooms/"+roomID+"/send"), 1)
+
+	txnID := "disconnected"
+	paths := []string{"_matrix", "client", "v3", "rooms", roomID, "send", "m.room.message", txnID}
+	body := client.WithJSONBody(t, map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "sent once",
+	})
+	if _, err := c.TryDo(t, "PUT", paths, body); err == nil {
+		t.Fatalf("request succeeded, expected the proxy to drop the connection")
+	}
+	// the client retries, as it did not see the response
+	res := c.MustDo(t, "PUT", paths, body)
+	eventID := client.GetJSONFieldStr(t, client.ParseJSON(t, res), "event_id")
+
+	// there should only be one copy of the event
+	res = c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "rooms", roomID, "messages"}, client.WithQueries(url.Values{
+		"dir":   []string{"b"},
+		"limit": []string{"10"},
+	}))
+	var eventIDs []string
+	for _, ev := range gjson.GetBytes(client.ParseJSON(t, res), "chunk").Array() {
+		if ev.Get("content.body").Str == "sent once" {
+			eventIDs = append(eventIDs, ev.Get("event_id").Str)
+		}
+	}
+	if len(eventIDs) != 1 || eventIDs[0] != eventID {
+		t.Fatalf("got events %v, want only %s", eventIDs, eventID)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/matrix-org/complement/match"
 	"github.com/matrix-org/complement/must"
 	"github.com/matrix-org/complement/runtime"
+	"github.com/matrix-org/complement/urlpreview"
 )
 
 const oGraphTitle = "The Rock"
@@ -95,3 +96,50 @@ func TestUrlPreview(t *testing.T) {
 		},
 	})
 }
+
+// Test that previews are made safely, using the URL preview server to serve pages which misbehave.
+func TestUrlPreviewSafety(t *testing.T) {
+	runtime.SkipIf(t, runtime.Dendrite) // FIXME: https://github.com/matrix-org/dendrite/issues/621
+
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	srv := urlpreview.NewServer(t, deployment.GetConfig())
+	cancel := srv.Listen()
+	defer cancel()
+	oGraph := map[string]string{
+		"og:title": oGraphTitle,
+		"og:type":  oGraphType,
+		"og:url":   oGraphUrl,
+	}
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	t.Run("Previews follow redirects", func(t *testing.T) {
+		srv.SetPage("/redirect", urlpreview.Redirect(srv.URL("/redirected.html")))
+		srv.SetPage("/redirected.html", urlpreview.OpenGraph("Redirected", oGraph))
+		preview := alice.MustPreviewURL(t, srv.URL("/redirect"))
+		must.MatchGJSON(t, preview, match.OpenGraph(oGraph))
+	})
+
+	t.Run("Previews of redirects to private IP addresses are refused", func(t *testing.T) {
+		for i, privateURL := range urlpreview.PrivateIPURLs {
+			path := fmt.Sprintf("/private-%d", i)
+			srv.SetPage(path, urlpreview.Redirect(privateURL))
+			res := alice.PreviewURL(t, srv.URL(path))
+			if res.StatusCode < 400 {
+				t.Errorf("preview of redirect to %s: got HTTP %d, want an error", privateURL, res.StatusCode)
+			}
+			res.Body.Close()
+		}
+	})
+
+	t.Run("Previews of huge pages are refused", func(t *testing.T) {
+		srv.SetPage("/huge.html", urlpreview.Huge(urlpreview.OpenGraph("Huge", oGraph), 1<<30))
+		res := alice.PreviewURL(t, srv.URL("/huge.html"))
+		if res.StatusCode < 400 {
+			t.Errorf("preview of 1GiB page: got HTTP %d, want an error", res.StatusCode)
+		}
+		res.Body.Close()
+	})
+}
@@ -0,0 +1,49 @@
+package csapi_tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that users can only find users in the user directory if they share a room, or the other user is
+// in a public room.
+func TestUserDirectoryVisibility(t *testing.T) {
+	deployment := complement.OldDeploy(t, b.BlueprintUserDirectory)
+	defer deployment.Destroy(t)
+
+	alice := complement.LoginUser(t, deployment, "hs1", "@alice:hs1", "", helpers.LoginOpts{})
+	bob := complement.LoginUser(t, deployment, "hs1", "@bob:hs1", "", helpers.LoginOpts{})
+	eve := complement.LoginUser(t, deployment, "hs1", "@eve:hs1", "", helpers.LoginOpts{})
+
+	t.Run("Users who share a room can find each other", func(t *testing.T) {
+		alice.MustSearchUserDirectoryUntil(t, "Directory", match.UserDirectoryHas("@bob:hs1", "Directory Bob"))
+		bob.MustSearchUserDirectoryUntil(t, "Directory", match.UserDirectoryHas("@alice:hs1", "Directory Alice"))
+	})
+	t.Run("Users in public rooms can be found by everyone", func(t *testing.T) {
+		for _, c := range []*client.CSAPI{alice, bob, eve} {
+			c.MustSearchUserDirectoryUntil(t, "Directory", match.UserDirectoryHas("@charlie:hs1", "Directory Charlie"))
+		}
+	})
+	t.Run("Users who do not share a room cannot find each other", func(t *testing.T) {
+		body := eve.MustSearchUserDirectory(t, "Directory", 0)
+		must.MatchGJSON(t, body,
+			match.UserDirectoryLacks("@alice:hs1"),
+			match.UserDirectoryLacks("@bob:hs1"),
+		)
+		body = alice.MustSearchUserDirectory(t, "Directory", 0)
+		must.MatchGJSON(t, body, match.UserDirectoryLacks("@eve:hs1"))
+	})
+	t.Run("Results are limited", func(t *testing.T) {
+		body := alice.MustSearchUserDirectory(t, "Directory", 1)
+		must.MatchGJSON(t, body,
+			match.JSONKeyArrayOfSize("results", 1),
+			match.UserDirectoryLimited(true),
+		)
+	})
+}
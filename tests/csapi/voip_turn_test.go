@@ -0,0 +1,31 @@
+package csapi_tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/turn"
+)
+
+// Requires COMPLEMENT_TURN_IMAGE to be set, and the homeserver image to configure TURN using
+// COMPLEMENT_TURN_URIS and COMPLEMENT_TURN_SHARED_SECRET.
+func TestTURNServerCredentialsAllocate(t *testing.T) {
+	if complement.GetConfig(t).TURNImage == "" {
+		t.Skipf("COMPLEMENT_TURN_IMAGE is not set")
+	}
+	deployment := complement.Deploy(t, 1, complement.WithTURNServer())
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	creds := turn.MustGetCredentials(t, alice)
+	if creds.TTL <= 0 {
+		t.Errorf("expected a positive ttl, got %d", creds.TTL)
+	}
+	// shared secret credentials are of the form expiry:user_id
+	if !strings.HasSuffix(creds.Username, ":"+alice.UserID) {
+		t.Errorf("expected username to end with the user ID, got %s", creds.Username)
+	}
+	turn.MustAllocate(t, creds)
+}
@@ -0,0 +1,33 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/db"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/runtime"
+)
+
+// Test that rooms created via the API leave no state groups without a room in the database.
+func TestNoOrphanedStateGroups(t *testing.T) {
+	// The queries below use the Synapse schema.
+	runtime.SkipIf(t, runtime.Dendrite, runtime.Conduit, runtime.Conduwuit)
+
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+
+	hsDB := db.Open(t, deployment, "hs1", db.Opts{})
+	users := hsDB.MustQueryInt(t, "SELECT COUNT(*) AS n FROM users WHERE name = "+db.Quote(alice.UserID))
+	must.Equal(t, users, int64(1), "user rows for alice")
+	groups := hsDB.MustQueryInt(t, "SELECT COUNT(*) AS n FROM state_groups WHERE room_id = "+db.Quote(roomID))
+	must.NotEqual(t, groups, int64(0), "state groups for the new room")
+	orphaned := hsDB.MustQueryInt(t, `
+		SELECT COUNT(*) AS n FROM state_groups sg
+		WHERE NOT EXISTS (SELECT 1 FROM rooms r WHERE r.room_id = sg.room_id)`)
+	must.Equal(t, orphaned, int64(0), "orphaned state groups")
+}
@@ -0,0 +1,20 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestDeploymentWithEnv(t *testing.T) {
+	deployment := complement.Deploy(t, 1, complement.WithEnv("hs1", map[string]string{
+		"COMPLEMENT_TEST_ENV": "hello",
+	}))
+	defer deployment.Destroy(t)
+
+	stdout, _, exitCode := complement.Exec(t, deployment, "hs1", "sh", "-c", "echo $COMPLEMENT_TEST_ENV")
+	must.Equal(t, exitCode, 0, "exit code")
+	must.Equal(t, strings.TrimSpace(stdout), "hello", "stdout")
+}
@@ -0,0 +1,35 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement"
+)
+
+func TestDeploymentEnvironment(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	env := complement.GetDeploymentEnvironment(t, deployment)
+	hs1, ok := env.Homeservers["hs1"]
+	if !ok {
+		t.Fatalf("environment has no hs1: %s", env.JSON())
+	}
+	if hs1.ContainerID != deployment.ContainerID(t, "hs1") {
+		t.Errorf("got container ID %s, want %s", hs1.ContainerID, deployment.ContainerID(t, "hs1"))
+	}
+	if hs1.Network != deployment.Network() {
+		t.Errorf("got network %s, want %s", hs1.Network, deployment.Network())
+	}
+	clientPort, ok := hs1.Ports["8008/tcp"]
+	if !ok {
+		t.Fatalf("environment has no mapping for the client port: %s", env.JSON())
+	}
+	if !strings.HasSuffix(hs1.BaseURL, clientPort[strings.LastIndex(clientPort, ":"):]) {
+		t.Errorf("client port is published on %s, but the base URL is %s", clientPort, hs1.BaseURL)
+	}
+	if hs1.ImageID == "" || hs1.BaseImage == "" {
+		t.Errorf("environment is missing image details: %s", env.JSON())
+	}
+}
@@ -0,0 +1,19 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestDeploymentExec(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	stdout, stderr, exitCode := complement.Exec(t, deployment, "hs1", "sh", "-c", "echo $SERVER_NAME; echo oops >&2; exit 3")
+	must.Equal(t, strings.TrimSpace(stdout), "hs1", "stdout")
+	must.Equal(t, strings.TrimSpace(stderr), "oops", "stderr")
+	must.Equal(t, exitCode, 3, "exit code")
+}
@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Test that a homeserver which was offline catches up on the events sent while it was down.
+func TestFederationCatchUpAfterOffline(t *testing.T) {
+	deployment := complement.Deploy(t, 2)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs2", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.MustJoinRoom(t, roomID, []spec.ServerName{deployment.GetFullyQualifiedHomeserverName(t, "hs1")})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	deployment.StopServer(t, "hs2")
+	var eventIDs []string
+	for i := 0; i < 5; i++ {
+		eventIDs = append(eventIDs, alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    fmt.Sprintf("sent while hs2 is offline %d", i),
+			},
+		}))
+	}
+	deployment.StartServer(t, "hs2")
+
+	// hs1 may be backing off from hs2 after failing to reach it. Receiving a transaction from hs2
+	// tells hs1 that hs2 is back, so it retries straight away.
+	bob.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "hs2 is back",
+		},
+	})
+	// hs1 may only send the latest event, leaving hs2 to fetch the earlier ones
+	bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventIDs[len(eventIDs)-1]))
+	for _, eventID := range eventIDs {
+		bob.MustGetEvent(t, roomID, eventID)
+	}
+}
@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Test that a client's view of a remote user's devices converges as the user joins, adds a device,
+// survives a restart of their homeserver and leaves.
+func TestFederationDeviceTracker(t *testing.T) {
+	deployment := complement.Deploy(t, 2)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs2", helpers.RegistrationOpts{Password: "bobspassword"})
+	uploadDeviceKeys := func(c *client.CSAPI) {
+		deviceKeys, _ := c.MustGenerateOneTimeKeys(t, 0)
+		c.MustUploadKeys(t, deviceKeys, nil)
+	}
+	uploadDeviceKeys(bob)
+
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	tracker := alice.NewDeviceTracker(t)
+
+	bob.MustJoinRoom(t, roomID, []spec.ServerName{deployment.GetFullyQualifiedHomeserverName(t, "hs1")})
+	tracker.MustConverge(t, map[string][]string{bob.UserID: {bob.DeviceID}})
+
+	bob2 := deployment.Login(t, "hs2", bob, helpers.LoginOpts{Password: "bobspassword"})
+	uploadDeviceKeys(bob2)
+	tracker.MustConverge(t, map[string][]string{bob.UserID: {bob.DeviceID, bob2.DeviceID}})
+
+	complement.RestartServer(t, deployment, "hs2")
+	bob2.MustDo(t, "DELETE", []string{"_matrix", "client", "v3", "devices", bob2.DeviceID}, client.WithJSONBody(t, map[string]interface{}{
+		"auth": map[string]interface{}{
+			"type": "m.login.password",
+			"identifier": map[string]interface{}{
+				"type": "m.id.user",
+				"user": bob.UserID,
+			},
+			"password": "bobspassword",
+		},
+	}))
+	tracker.MustConverge(t, map[string][]string{bob.UserID: {bob.DeviceID}})
+
+	bob.MustLeaveRoom(t, roomID)
+	tracker.MustConverge(t, map[string][]string{bob.UserID: nil})
+}
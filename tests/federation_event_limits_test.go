@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/federation"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/limits"
+)
+
+// Test that events received over federation are accepted at the size limits in the spec, and
+// rejected beyond them.
+func TestInboundFederationEventLimits(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleMakeSendJoinRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+		federation.HandleEventRequests(),
+		federation.HandleEventAuthRequests(),
+	)
+	cancel := srv.Listen()
+	defer cancel()
+
+	ver := alice.GetDefaultRoomVersion(t)
+	charlie := srv.UserID("charlie")
+	room := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
+	roomAlias := srv.MakeAliasMapping("limits", room.RoomID)
+	alice.MustJoinRoom(t, roomAlias, nil)
+
+	t.Run("Event at the size limit is accepted", func(t *testing.T) {
+		pdu := limits.MustCreateEventOfSize(t, srv, room, federation.Event{
+			Type:   "m.room.message",
+			Sender: charlie,
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "at the size limit",
+			},
+		}, limits.MaxEventSize)
+		room.AddEvent(pdu)
+		srv.MustSendTransaction(t, deployment, "hs1", []json.RawMessage{pdu.JSON()}, nil)
+		alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(room.RoomID, pdu.EventID()))
+	})
+
+	t.Run("Events beyond the limits are rejected", func(t *testing.T) {
+		// make sure there are enough events in the room to use as too many auth events
+		var fillers []json.RawMessage
+		for len(room.Timeline) <= limits.MaxAuthEvents {
+			pdu := srv.MustCreateEvent(t, room, federation.Event{
+				Type:    "m.room.message",
+				Sender:  charlie,
+				Content: map[string]interface{}{"msgtype": "m.text", "body": "filler"},
+			})
+			room.AddEvent(pdu)
+			fillers = append(fillers, pdu.JSON())
+		}
+		srv.MustSendTransaction(t, deployment, "hs1", fillers, nil)
+
+		tooLarge := limits.MustCreateEventOfSize(t, srv, room, federation.Event{
+			Type:   "m.room.message",
+			Sender: charlie,
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "over the size limit",
+			},
+		}, limits.MaxEventSize+1)
+		longStateKey := limits.MustCreateUnvalidatedEvent(t, srv, room, federation.Event{
+			Type:     "com.example.limits",
+			Sender:   charlie,
+			StateKey: b.Ptr(limits.String(limits.MaxIDSize + 1)),
+			Content:  map[string]interface{}{},
+		})
+		longType := limits.MustCreateUnvalidatedEvent(t, srv, room, federation.Event{
+			Type:    limits.EventWithTypeSize(limits.MaxIDSize + 1).Type,
+			Sender:  charlie,
+			Content: map[string]interface{}{},
+		})
+		tooManyAuthEvents := srv.MustCreateEvent(t, room, federation.Event{
+			Type:       "m.room.message",
+			Sender:     charlie,
+			Content:    map[string]interface{}{"msgtype": "m.text", "body": "too many auth events"},
+			AuthEvents: limits.TooManyAuthEvents(t, room),
+		})
+		limits.MustRejectPDUs(t, deployment, srv, "hs1", room, alice, charlie,
+			tooLarge, longStateKey, longType, tooManyAuthEvents,
+		)
+	})
+}
@@ -235,3 +235,21 @@ func checkKeysAndSignatures(t *testing.T, body []byte, jsonObj gjson.Result, key
 		}
 	}
 }
+
+// Test that the server keys can be fetched from inside the network via the federation port, as other
+// homeservers would, rather than via the port mapped to the host.
+func TestInboundFederationKeysFromNetwork(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	res := complement.RunContainer(t, deployment, "curlimages/curl:latest",
+		"--silent", "--show-error", "--insecure", "--fail", "https://hs1:8448/_matrix/key/v2/server",
+	)
+	if res.ExitCode != 0 {
+		t.Fatalf("curl exited with code %d: %s", res.ExitCode, res.Stderr)
+	}
+	must.MatchGJSON(t, gjson.Parse(res.Stdout),
+		match.JSONKeyEqual("server_name", "hs1"),
+		match.JSONKeyPresent("verify_keys"),
+	)
+}
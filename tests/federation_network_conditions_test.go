@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Test that events are still sent over federation when the network between homeservers is slow and
+// lossy, and that they are delayed by at least the added latency.
+func TestFederationWithDegradedNetwork(t *testing.T) {
+	deployment := complement.Deploy(t, 2)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs2", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.MustJoinRoom(t, roomID, []spec.ServerName{deployment.GetFullyQualifiedHomeserverName(t, "hs1")})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+	_, bobSince := bob.MustSync(t, client.SyncReq{})
+
+	latency := 2 * time.Second
+	complement.SetNetworkConditions(t, deployment, "hs1", complement.NetworkConditions{
+		Latency:    latency,
+		Jitter:     100 * time.Millisecond,
+		PacketLoss: 10,
+	})
+	defer complement.ResetNetworkConditions(t, deployment, "hs1")
+
+	start := time.Now()
+	eventID := alice.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "sent over a slow network",
+		},
+	})
+	bobSince = bob.MustSyncUntil(t, client.SyncReq{Since: bobSince}, client.SyncTimelineHasEventID(roomID, eventID))
+	// allow for the jitter
+	if elapsed := time.Since(start); elapsed < latency-100*time.Millisecond {
+		t.Errorf("event arrived after %v, want at least the added latency of %v", elapsed, latency)
+	}
+
+	// once the network is restored, events are sent as normal
+	complement.ResetNetworkConditions(t, deployment, "hs1")
+	eventID = alice.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "sent over a restored network",
+		},
+	})
+	bob.MustSyncUntil(t, client.SyncReq{Since: bobSince}, client.SyncTimelineHasEventID(roomID, eventID))
+}
@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Test that one-time keys can be claimed over federation until they run out, after which the fallback
+// key is returned, and that the key counts in /sync track this.
+func TestFederationClaimOneTimeKeys(t *testing.T) {
+	deployment := complement.Deploy(t, 2)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs2", helpers.RegistrationOpts{})
+
+	deviceKeys, _ := alice.MustGenerateOneTimeKeys(t, 0)
+	alice.MustUploadKeys(t, deviceKeys, nil)
+	keyIDs, counts := alice.MustUploadOneTimeKeys(t, 2)
+	if counts[client.OneTimeKeyAlgorithm] != 2 {
+		t.Fatalf("got one-time key counts %v after uploading 2 keys", counts)
+	}
+	fallbackKeyID := alice.MustUploadFallbackKey(t)
+	aliceSince := alice.MustSyncUntil(t, client.SyncReq{},
+		client.SyncOneTimeKeyCountIs(client.OneTimeKeyAlgorithm, 2),
+		client.SyncUnusedFallbackKeyTypes(client.OneTimeKeyAlgorithm),
+	)
+
+	claimedKeyIDs := make(map[string]bool)
+	for range keyIDs {
+		key := bob.MustClaimKey(t, alice.UserID, alice.DeviceID, client.OneTimeKeyAlgorithm)
+		if key == nil || key.Fallback {
+			t.Fatalf("got %+v, want a one-time key", key)
+		}
+		claimedKeyIDs[key.KeyID] = true
+	}
+	for _, keyID := range keyIDs {
+		if !claimedKeyIDs[keyID] {
+			t.Errorf("one-time key %s was not claimed, claimed %v", keyID, claimedKeyIDs)
+		}
+	}
+
+	// once one-time keys run out, the fallback key is returned, and keeps being returned
+	for i := 0; i < 2; i++ {
+		key := bob.MustClaimKey(t, alice.UserID, alice.DeviceID, client.OneTimeKeyAlgorithm)
+		if key == nil || !key.Fallback || key.KeyID != fallbackKeyID {
+			t.Fatalf("got %+v, want fallback key %s", key, fallbackKeyID)
+		}
+	}
+	alice.MustSyncUntil(t, client.SyncReq{Since: aliceSince},
+		client.SyncOneTimeKeyCountIs(client.OneTimeKeyAlgorithm, 0),
+		client.SyncUnusedFallbackKeyTypes(),
+	)
+	if counts = alice.MustGetOneTimeKeyCounts(t); counts[client.OneTimeKeyAlgorithm] != 0 {
+		t.Errorf("got one-time key counts %v after all keys were claimed", counts)
+	}
+}
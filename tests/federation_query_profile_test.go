@@ -124,3 +124,23 @@ func TestInboundFederationProfile(t *testing.T) {
 		})
 	})
 }
+
+func TestInboundFederationFullProfile(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	fedClient, srv, cancel := federation.MustNewFederationClient(t, deployment)
+	defer cancel()
+
+	const alicePublicName = "Alice Liddell"
+
+	alice.MustSetDisplayName(t, alicePublicName)
+
+	profile, err := fedClient.LookupProfile(
+		context.Background(), srv.ServerName(), deployment.GetFullyQualifiedHomeserverName(t, "hs1"), alice.UserID, "",
+	)
+	must.NotError(t, "failed to GET /profile", err)
+	must.Equal(t, profile.DisplayName, alicePublicName, "display name mismatch")
+}
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+// Test that device keys and events which could not be sent over federation yet survive a restart of
+// the sending homeserver.
+func TestFederationStateSurvivesRestart(t *testing.T) {
+	deployment := complement.Deploy(t, 2)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs2", helpers.RegistrationOpts{})
+	deviceKeys, _ := alice.MustGenerateOneTimeKeys(t, 0)
+	alice.MustUploadKeys(t, deviceKeys, nil)
+
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.MustJoinRoom(t, roomID, []spec.ServerName{deployment.GetFullyQualifiedHomeserverName(t, "hs1")})
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	// send an event which hs1 cannot deliver until hs2 is back
+	deployment.StopServer(t, "hs2")
+	eventID := alice.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "sent while hs2 is down",
+		},
+	})
+	complement.RestartServer(t, deployment, "hs1")
+	deployment.StartServer(t, "hs2")
+
+	// hs1 may be backing off from hs2 after failing to reach it. Receiving a transaction from hs2
+	// tells hs1 that hs2 is back, so it retries straight away.
+	bob.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "hs2 is back",
+		},
+	})
+	bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+
+	res := bob.MustDo(t, "POST", []string{"_matrix", "client", "v3", "keys", "query"}, client.WithJSONBody(t, map[string]interface{}{
+		"device_keys": map[string]interface{}{
+			alice.UserID: []string{},
+		},
+	}))
+	must.MatchResponse(t, res, match.HTTPResponse{
+		JSON: []match.JSON{
+			match.JSONKeyEqual("device_keys."+client.GjsonEscape(alice.UserID)+"."+client.GjsonEscape(alice.DeviceID)+".keys", deviceKeys["keys"]),
+		},
+	})
+}
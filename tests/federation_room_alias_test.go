@@ -5,6 +5,7 @@ import (
 
 	"github.com/matrix-org/complement"
 	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/federation"
 	"github.com/matrix-org/complement/helpers"
 	"github.com/matrix-org/complement/match"
 	"github.com/matrix-org/complement/must"
@@ -34,3 +35,49 @@ func TestRemoteAliasRequestsUnderstandUnicode(t *testing.T) {
 		},
 	})
 }
+
+// Test that when a remote alias resolves to a list of servers which starts with a stale entry,
+// the homeserver falls back to the other servers in the list to join the room.
+func TestRemoteAliasJoinFallsBackAcrossServers(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	// a server which used to be in the room but has since gone away
+	staleSrv := federation.NewServer(t, deployment)
+	cancelStale := staleSrv.Listen()
+	staleServerName := staleSrv.ServerName()
+	cancelStale()
+
+	// the server which actually has the room
+	residentSrv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleMakeSendJoinRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+	)
+	cancelResident := residentSrv.Listen()
+	defer cancelResident()
+	ver := alice.GetDefaultRoomVersion(t)
+	room := residentSrv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, residentSrv.UserID("charlie")))
+
+	// the server which owns the alias, but is not in the room
+	directorySrv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+	)
+	cancelDirectory := directorySrv.Listen()
+	defer cancelDirectory()
+	roomAlias := directorySrv.MakeAliasMappingWithServers("fallback", room.RoomID, staleServerName, residentSrv.ServerName())
+
+	res := alice.MustDo(t, "GET", []string{"_matrix", "client", "v3", "directory", "room", roomAlias})
+	must.MatchResponse(t, res, match.HTTPResponse{
+		StatusCode: 200,
+		JSON: []match.JSON{
+			match.JSONKeyEqual("room_id", room.RoomID),
+			match.JSONKeyEqual("servers", []interface{}{string(staleServerName), string(residentSrv.ServerName())}),
+		},
+	})
+
+	alice.MustJoinRoom(t, roomAlias, nil)
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(alice.UserID, room.RoomID))
+}
@@ -0,0 +1,38 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/eventgen"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Test that homeservers agree on the membership of a room after random joins, leaves, invites, kicks
+// and bans by users on both sides of the federation.
+func TestFederationRoomMembershipChurn(t *testing.T) {
+	deployment := complement.Deploy(t, 2)
+	defer deployment.Destroy(t)
+
+	creator := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	clients := map[string]*client.CSAPI{creator.UserID: creator}
+	gen := &eventgen.Generator{
+		Creator: creator.UserID,
+		Weights: eventgen.MembershipChurn,
+	}
+	for _, hsName := range []string{"hs1", "hs1", "hs2", "hs2"} {
+		user := deployment.Register(t, hsName, helpers.RegistrationOpts{})
+		clients[user.UserID] = user
+		gen.Users = append(gen.Users, user.UserID)
+	}
+	via := []spec.ServerName{deployment.GetFullyQualifiedHomeserverName(t, "hs1")}
+
+	eventgen.Check(t, gen, eventgen.CheckOpts{Runs: 3, Length: 15}, func(actions []eventgen.Action) error {
+		roomID := creator.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+		eventgen.ApplyToClientsVia(t, roomID, via, clients, actions)
+		return eventgen.CheckMemberships(t, roomID, clients, gen.Memberships(actions))
+	})
+}
@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/federation"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Tests that after the Complement server sends many membership and state changes to a room, the
+// homeserver converges on the same state as the Complement server, over both the CS and federation APIs.
+func TestFederationRoomStateConverges(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleMakeSendJoinRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+	)
+	srv.UnexpectedRequestsAreErrors = false
+	cancel := srv.Listen()
+	defer cancel()
+
+	ver := alice.GetDefaultRoomVersion(t)
+	charlie := srv.UserID("charlie")
+	serverRoom := srv.MustMakeRoom(t, ver, federation.InitialRoomEvents(ver, charlie))
+	alice.MustJoinRoom(t, serverRoom.RoomID, []spec.ServerName{srv.ServerName()})
+
+	// join lots of users, then make the room invite-only and invite some more.
+	pdus := srv.MustJoinUsers(t, serverRoom, "", srv.UserIDs("joiner", 10)...)
+	pdus = append(pdus, srv.MustCreateEventAs(t, serverRoom, charlie, federation.Event{
+		Type:     spec.MRoomJoinRules,
+		StateKey: b.Ptr(""),
+		Content:  map[string]interface{}{"join_rule": spec.Invite},
+	})...)
+	pdus = append(pdus, srv.MustInviteUsers(t, serverRoom, charlie, srv.UserIDs("invitee", 5)...)...)
+	srv.MustSendTransaction(t, deployment, "hs1", rawEvents(pdus), nil)
+
+	lastEventID := pdus[len(pdus)-1].EventID()
+	alice.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(serverRoom.RoomID, lastEventID))
+
+	want := serverRoom.StateSnapshot()
+	federation.MustGetClientStateSnapshot(t, alice, serverRoom.RoomID).MustEqual(t, want, "CS API /state")
+	srv.MustGetStateSnapshot(t, deployment, "hs1", serverRoom, lastEventID).MustEqual(t, want, "federation /state")
+}
+
+func rawEvents(pdus []gomatrixserverlib.PDU) []json.RawMessage {
+	raw := make([]json.RawMessage, len(pdus))
+	for i := range pdus {
+		raw[i] = pdus[i].JSON()
+	}
+	return raw
+}
@@ -2,13 +2,17 @@ package tests
 
 import (
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+
 	"github.com/matrix-org/complement"
 	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/federation"
 	"github.com/matrix-org/complement/helpers"
-	"github.com/tidwall/gjson"
 )
 
 // Test that to-device messages can go from one homeserver to another.
@@ -107,3 +111,55 @@ func TestToDeviceMessagesOverFederation(t *testing.T) {
 		})
 	}
 }
+
+// Test that a large volume of to-device messages to a remote device are all delivered, without
+// exceeding the limit of 100 EDUs per federation transaction.
+func TestToDeviceMessagesOverFederationAreBatched(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+
+	const numMessages = 250
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	waiter := helpers.NewWaiter()
+	var mu sync.Mutex
+	received := make(map[int64]bool)
+	var bobUserID string
+	const bobDeviceID = "BOBDEVICE"
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleTransactionRequests(nil, func(edu gomatrixserverlib.EDU) {
+			if edu.Type != "m.direct_to_device" {
+				return
+			}
+			msg := gjson.GetBytes(edu.Content, "messages."+gjson.Escape(bobUserID)+"."+bobDeviceID)
+			if !msg.Exists() {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			received[msg.Get("seq").Int()] = true
+			if len(received) == numMessages {
+				waiter.Finish()
+			}
+		}),
+	)
+	capture := federation.NewRequestCapture(federation.MatchPathPrefix("/_matrix/federation/v1/send/"))
+	srv.Use(capture.Middleware)
+	cancel := srv.Listen()
+	defer cancel()
+	bobUserID = srv.UserID("bob")
+
+	alice.MustSendToDeviceSequence(t, "my.test.type", bobUserID, bobDeviceID, numMessages)
+	waiter.Waitf(t, 30*time.Second, "timed out waiting for %d to-device messages", numMessages)
+
+	for _, req := range capture.Requests() {
+		txn, err := req.Transaction()
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if len(txn.EDUs) > 100 {
+			t.Errorf("transaction %s has %d EDUs, want at most 100", txn.TransactionID, len(txn.EDUs))
+		}
+	}
+}
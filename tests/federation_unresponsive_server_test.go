@@ -0,0 +1,54 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+)
+
+// Test that a homeserver keeps serving its clients while a remote homeserver in the room is
+// unresponsive, i.e it accepts connections but never responds, and that events sent in the meantime
+// reach the remote homeserver once it responds again.
+func TestFederationWithUnresponsiveServer(t *testing.T) {
+	deployment := complement.Deploy(t, 2)
+	defer deployment.Destroy(t)
+
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs2", helpers.RegistrationOpts{})
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	bob.MustJoinRoom(t, roomID, []spec.ServerName{deployment.GetFullyQualifiedHomeserverName(t, "hs1")})
+	aliceSince := alice.MustSyncUntil(t, client.SyncReq{}, client.SyncJoinedTo(bob.UserID, roomID))
+
+	deployment.PauseServer(t, "hs2")
+	start := time.Now()
+	eventID := alice.Unsafe_SendEventUnsynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "sent while hs2 is unresponsive",
+		},
+	})
+	alice.MustSyncUntil(t, client.SyncReq{Since: aliceSince}, client.SyncTimelineHasEventID(roomID, eventID))
+	// sending must not wait for hs2, which would take as long as the federation request timeout
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("sending an event took %v while a remote server was unresponsive", elapsed)
+	}
+	deployment.UnpauseServer(t, "hs2")
+
+	// hs1 may be backing off from hs2 after its requests timed out. Receiving a transaction from hs2
+	// tells hs1 that hs2 is back, so it retries straight away.
+	bob.SendEventSynced(t, roomID, b.Event{
+		Type: "m.room.message",
+		Content: map[string]interface{}{
+			"msgtype": "m.text",
+			"body":    "hs2 is back",
+		},
+	})
+	bob.MustSyncUntil(t, client.SyncReq{}, client.SyncTimelineHasEventID(roomID, eventID))
+}
@@ -0,0 +1,26 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/federation"
+)
+
+// Test that homeservers describe themselves over federation with a TLS certificate trusted by other
+// homeservers, without needing the Complement federation server.
+func TestFederationSelfDescription(t *testing.T) {
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	httpClient := complement.FederationHTTPClient(t, deployment)
+	serverName := deployment.GetFullyQualifiedHomeserverName(t, "hs1")
+
+	t.Run("GET /federation/v1/version returns the server name and version", func(t *testing.T) {
+		v := federation.MustGetServerVersion(t, httpClient, serverName)
+		t.Logf("%s is running %s %s", serverName, v.Name, v.Version)
+	})
+	t.Run("GET /key/v2/server returns self-signed keys", func(t *testing.T) {
+		keys := federation.MustGetServerKeys(t, httpClient, serverName)
+		t.Logf("%s has verify keys valid until %v", serverName, keys.ValidUntil)
+	})
+}
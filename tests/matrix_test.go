@@ -0,0 +1,23 @@
+package tests
+
+import (
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/matrix-org/complement"
+)
+
+func TestRunMatrix(t *testing.T) {
+	configs := complement.Matrix(
+		complement.MatrixDimension{Env: "COMPLEMENT_MATRIX_TEST", Values: []string{"a", "b"}},
+	)
+	complement.RunMatrix(t, 1, configs, func(t *testing.T, deployment complement.Deployment) {
+		// the subtest is named after the configuration, which is the env var
+		wantEnv := path.Base(t.Name())
+		env := complement.GetDeploymentEnvironment(t, deployment)
+		if !slices.Contains(env.Homeservers["hs1"].Env, wantEnv) {
+			t.Errorf("hs1 does not have env var %s: %v", wantEnv, env.Homeservers["hs1"].Env)
+		}
+	})
+}
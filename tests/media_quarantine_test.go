@@ -0,0 +1,49 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/federation"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/internal/data"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+	"github.com/matrix-org/complement/runtime"
+)
+
+func TestMediaQuarantine(t *testing.T) {
+	runtime.SkipIf(t, runtime.Dendrite) // uses the Synapse admin API
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	admin := deployment.Register(t, "hs1", helpers.RegistrationOpts{
+		IsAdmin: true,
+	})
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+	)
+	cancel := srv.Listen()
+	defer cancel()
+
+	mxcURI := alice.UploadContent(t, data.LargePng, "test.png", "image/png")
+	_, mediaID := client.SplitMxc(mxcURI)
+	admin.MustQuarantineMedia(t, mxcURI)
+
+	unavailable := match.HTTPResponse{JSON: []match.JSON{match.MediaUnavailable()}}
+	t.Run("Quarantined media cannot be downloaded", func(t *testing.T) {
+		must.MatchResponse(t, alice.DownloadMedia(t, mxcURI), unavailable)
+	})
+	t.Run("Quarantined media cannot be thumbnailed", func(t *testing.T) {
+		must.MatchResponse(t, alice.ThumbnailMedia(t, mxcURI, 32, 32, "scale"), unavailable)
+	})
+	t.Run("Quarantined media cannot be downloaded over federation", func(t *testing.T) {
+		must.MatchResponse(t, srv.DownloadMedia(t, deployment, "hs1", mediaID), unavailable)
+	})
+	t.Run("Unquarantined media can be downloaded again", func(t *testing.T) {
+		admin.MustUnquarantineMedia(t, mxcURI)
+		must.MatchResponse(t, alice.DownloadMedia(t, mxcURI), match.HTTPResponse{StatusCode: 200})
+	})
+}
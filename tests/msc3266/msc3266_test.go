@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+func TestRoomSummary(t *testing.T) {
+	deployment := complement.Deploy(t, 2)
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	bob := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+	charlie := deployment.Register(t, "hs2", helpers.RegistrationOpts{})
+
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{
+		"preset": "public_chat",
+		"initial_state": []map[string]interface{}{
+			{
+				"type":      "m.room.encryption",
+				"state_key": "",
+				"content": map[string]interface{}{
+					"algorithm": "m.megolm.v1.aes-sha2",
+				},
+			},
+		},
+	})
+	inviteOnlyRoomID := alice.MustCreateRoom(t, map[string]interface{}{
+		"preset": "private_chat",
+	})
+	alice.MustInviteRoom(t, inviteOnlyRoomID, bob.UserID)
+
+	t.Run("Joined user sees their membership", func(t *testing.T) {
+		summary := alice.MustGetRoomSummary(t, roomID, nil)
+		must.MatchGJSON(t, summary,
+			match.JSONKeyEqual("room_id", roomID),
+			match.RoomSummaryMembership(spec.Join),
+			match.RoomSummaryJoinRule(spec.Public),
+			match.RoomSummaryEncryption("m.megolm.v1.aes-sha2"),
+		)
+	})
+	t.Run("Invited user can see the summary of an invite-only room", func(t *testing.T) {
+		summary := bob.MustGetRoomSummary(t, inviteOnlyRoomID, nil)
+		must.MatchGJSON(t, summary,
+			match.RoomSummaryMembership(spec.Invite),
+			match.RoomSummaryJoinRule(spec.Invite),
+			match.RoomSummaryEncryption(""),
+		)
+	})
+	t.Run("Remote user can see the summary of an unjoined public room", func(t *testing.T) {
+		summary := charlie.MustGetRoomSummary(t, roomID, []spec.ServerName{
+			deployment.GetFullyQualifiedHomeserverName(t, "hs1"),
+		})
+		must.MatchGJSON(t, summary,
+			match.JSONKeyEqual("room_id", roomID),
+			match.RoomSummaryMembership(""),
+			match.RoomSummaryJoinRule(spec.Public),
+			match.RoomSummaryEncryption("m.megolm.v1.aes-sha2"),
+		)
+	})
+	t.Run("Summary can be requested by alias", func(t *testing.T) {
+		alias := "#summary_alias:" + string(deployment.GetFullyQualifiedHomeserverName(t, "hs1"))
+		alice.MustDo(t, "PUT", []string{"_matrix", "client", "v3", "directory", "room", alias}, client.WithJSONBody(t, map[string]interface{}{
+			"room_id": roomID,
+		}))
+		summary := charlie.MustGetRoomSummary(t, alias, []spec.ServerName{
+			deployment.GetFullyQualifiedHomeserverName(t, "hs1"),
+		})
+		must.MatchGJSON(t, summary, match.JSONKeyEqual("room_id", roomID))
+	})
+	t.Run("Unjoined user cannot see the summary of an invite-only room", func(t *testing.T) {
+		res := charlie.GetRoomSummary(t, inviteOnlyRoomID, []spec.ServerName{
+			deployment.GetFullyQualifiedHomeserverName(t, "hs1"),
+		})
+		must.MatchResponse(t, res, match.HTTPResponse{
+			StatusCode: 404,
+		})
+	})
+}
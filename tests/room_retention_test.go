@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/federation"
+	"github.com/matrix-org/complement/helpers"
+	"github.com/matrix-org/complement/runtime"
+)
+
+// Test that messages older than the max_lifetime of a room's retention policy are hidden from clients and
+// purged, so are no longer backfilled by other servers. Requires the homeserver to enforce retention
+// policies with a purge job which runs frequently.
+func TestRoomRetentionPolicy(t *testing.T) {
+	runtime.SkipIf(t, runtime.Dendrite) // Dendrite does not support retention policies
+	deployment := complement.Deploy(t, 1)
+	defer deployment.Destroy(t)
+	alice := deployment.Register(t, "hs1", helpers.RegistrationOpts{})
+
+	srv := federation.NewServer(t, deployment,
+		federation.HandleKeyRequests(),
+		federation.HandleTransactionRequests(nil, nil),
+	)
+	cancel := srv.Listen()
+	defer cancel()
+
+	roomID := alice.MustCreateRoom(t, map[string]interface{}{"preset": "public_chat"})
+	room := srv.MustJoinRoom(t, deployment, "hs1", roomID, srv.UserID("charlie"))
+
+	var eventIDs []string
+	for i := 0; i < 3; i++ {
+		eventIDs = append(eventIDs, alice.SendEventSynced(t, roomID, b.Event{
+			Type: "m.room.message",
+			Content: map[string]interface{}{
+				"msgtype": "m.text",
+				"body":    "ephemeral",
+			},
+		}))
+	}
+	retentionEventID := alice.MustSetRetentionPolicy(t, roomID, client.RetentionPolicy{
+		MaxLifetime: time.Second,
+	})
+
+	t.Run("Expired messages are not visible to clients", func(t *testing.T) {
+		alice.MustEventuallyExpire(t, roomID, eventIDs, 30*time.Second)
+	})
+	t.Run("Expired messages are not backfilled", func(t *testing.T) {
+		srv.MustEventuallyNotBackfill(
+			t, deployment, spec.ServerName("hs1"), roomID, room.Version,
+			[]string{retentionEventID}, 100, eventIDs, 30*time.Second,
+		)
+	})
+}
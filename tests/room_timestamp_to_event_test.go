@@ -52,6 +52,24 @@ func TestJumpToDateEndpoint(t *testing.T) {
 			mustCheckEventisReturnedForTime(t, alice, roomID, eventB.AfterTimestamp, "b", eventB.EventID)
 		})
 
+		t.Run("should find event on the correct side of the given timestamp", func(t *testing.T) {
+			t.Parallel()
+			roomID, eventA, eventB := createTestRoom(t, alice)
+			res := alice.TimestampToEvent(t, roomID, eventA.AfterTimestamp, "f")
+			must.MatchResponse(t, res, match.HTTPResponse{
+				StatusCode: 200,
+				JSON: []match.JSON{
+					match.TimestampToEventID(eventB.EventID),
+					match.TimestampToEventInDirection(eventA.AfterTimestamp, "f"),
+				},
+			})
+			eventID, originServerTS := alice.MustTimestampToEvent(t, roomID, eventB.BeforeTimestamp, "b")
+			must.Equal(t, eventID, eventA.EventID, "event before eventB")
+			if originServerTS.After(eventB.BeforeTimestamp) {
+				t.Fatalf("event %s at %v is after the requested %v", eventID, originServerTS, eventB.BeforeTimestamp)
+			}
+		})
+
 		t.Run("should find nothing before the earliest timestamp", func(t *testing.T) {
 			t.Parallel()
 			timeBeforeRoomCreation := time.Now()
@@ -0,0 +1,19 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/roomupgrade"
+)
+
+// Test that rooms can be upgraded between each pair of consecutive stable room versions, with a
+// remote user following the upgrade over federation.
+func TestRoomUpgradeConformance(t *testing.T) {
+	deployment := complement.Deploy(t, 2)
+	defer deployment.Destroy(t)
+
+	roomupgrade.Run(t, deployment, roomupgrade.Opts{
+		RemoteHS: "hs2",
+	})
+}
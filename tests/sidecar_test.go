@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/must"
+)
+
+const sidecarProxyConfig = `
+server {
+	listen 80;
+	location / {
+		proxy_pass http://hs1:8008;
+		proxy_set_header Host $host;
+		proxy_set_header X-Forwarded-For $remote_addr;
+	}
+}
+`
+
+// Test that homeservers can be deployed behind a reverse proxy running as a sidecar.
+func TestSidecarReverseProxy(t *testing.T) {
+	deployment := complement.OldDeploy(t, b.MustValidate(b.Blueprint{
+		Name: "sidecar_reverse_proxy",
+		Homeservers: []b.Homeserver{
+			{
+				Name: "hs1",
+				Sidecars: []b.Sidecar{
+					{
+						Name:  "proxy",
+						Image: "nginx:alpine",
+						Files: map[string][]byte{
+							"/etc/nginx/conf.d/default.conf": []byte(sidecarProxyConfig),
+						},
+						Ports: []int{80},
+					},
+				},
+			},
+		},
+	}))
+	defer deployment.Destroy(t)
+
+	proxied := deployment.UnauthenticatedClient(t, "hs1")
+	proxied.BaseURL = "http://" + complement.SidecarAddress(t, deployment, "hs1", "proxy", 80)
+	res := proxied.MustDo(t, "GET", []string{"_matrix", "client", "versions"})
+	must.MatchResponse(t, res, match.HTTPResponse{
+		JSON: []match.JSON{
+			match.JSONKeyPresent("versions"),
+		},
+	})
+
+	// the proxy is reachable from inside the network by its sidecar hostname
+	result := complement.RunContainer(t, deployment, "curlimages/curl:latest", "-sf", "http://proxy.hs1/_matrix/client/versions")
+	must.Equal(t, result.ExitCode, 0, "curl exit code: "+result.Stderr)
+}
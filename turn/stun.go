@@ -0,0 +1,216 @@
+package turn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// A minimal implementation of the STUN (RFC 5389) and TURN (RFC 5766) messages needed to check
+// that a TURN server accepts credentials and can allocate relayed addresses.
+
+const (
+	magicCookie = 0x2112A442
+
+	methodBinding  = 0x0001
+	methodAllocate = 0x0003
+
+	classSuccess = 0x0100
+	classError   = 0x0110
+
+	attrUsername           = 0x0006
+	attrMessageIntegrity   = 0x0008
+	attrErrorCode          = 0x0009
+	attrLifetime           = 0x000D
+	attrRealm              = 0x0014
+	attrNonce              = 0x0015
+	attrXORRelayedAddress  = 0x0016
+	attrRequestedTransport = 0x0019
+	attrXORMappedAddress   = 0x0020
+
+	protocolUDP = 17
+)
+
+type attribute struct {
+	typ   uint16
+	value []byte
+}
+
+type message struct {
+	typ   uint16
+	txID  [12]byte
+	attrs []attribute
+}
+
+func newMessage(typ uint16) *message {
+	m := &message{typ: typ}
+	rand.Read(m.txID[:])
+	return m
+}
+
+func (m *message) add(typ uint16, value []byte) {
+	m.attrs = append(m.attrs, attribute{typ: typ, value: value})
+}
+
+func (m *message) get(typ uint16) []byte {
+	for _, a := range m.attrs {
+		if a.typ == typ {
+			return a.value
+		}
+	}
+	return nil
+}
+
+// encode serialises the message. If `key` is set, a MESSAGE-INTEGRITY attribute is appended.
+func (m *message) encode(key []byte) []byte {
+	var body bytes.Buffer
+	for _, a := range m.attrs {
+		writeAttr(&body, a.typ, a.value)
+	}
+	header := func(length int) []byte {
+		h := make([]byte, 20)
+		binary.BigEndian.PutUint16(h[0:], m.typ)
+		binary.BigEndian.PutUint16(h[2:], uint16(length))
+		binary.BigEndian.PutUint32(h[4:], magicCookie)
+		copy(h[8:], m.txID[:])
+		return h
+	}
+	if key == nil {
+		return append(header(body.Len()), body.Bytes()...)
+	}
+	// The HMAC is computed with the length in the header including the MESSAGE-INTEGRITY attribute,
+	// which is 4 bytes of header + 20 bytes of HMAC-SHA1.
+	mac := hmac.New(sha1.New, key)
+	mac.Write(header(body.Len() + 24))
+	mac.Write(body.Bytes())
+	writeAttr(&body, attrMessageIntegrity, mac.Sum(nil))
+	return append(header(body.Len()), body.Bytes()...)
+}
+
+func writeAttr(w *bytes.Buffer, typ uint16, value []byte) {
+	binary.Write(w, binary.BigEndian, typ)
+	binary.Write(w, binary.BigEndian, uint16(len(value)))
+	w.Write(value)
+	// attributes are padded to 4 bytes
+	if pad := len(value) % 4; pad != 0 {
+		w.Write(make([]byte, 4-pad))
+	}
+}
+
+func decodeMessage(b []byte) (*message, error) {
+	if len(b) < 20 {
+		return nil, fmt.Errorf("STUN message too short: %d bytes", len(b))
+	}
+	if binary.BigEndian.Uint32(b[4:]) != magicCookie {
+		return nil, fmt.Errorf("not a STUN message: bad magic cookie")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if len(b) < 20+length {
+		return nil, fmt.Errorf("STUN message truncated: have %d bytes, want %d", len(b), 20+length)
+	}
+	m := &message{typ: binary.BigEndian.Uint16(b[0:])}
+	copy(m.txID[:], b[8:20])
+	body := b[20 : 20+length]
+	for len(body) >= 4 {
+		typ := binary.BigEndian.Uint16(body[0:])
+		attrLen := int(binary.BigEndian.Uint16(body[2:]))
+		if len(body) < 4+attrLen {
+			return nil, fmt.Errorf("STUN attribute 0x%04x truncated", typ)
+		}
+		m.add(typ, body[4:4+attrLen])
+		padded := 4 + attrLen
+		if pad := attrLen % 4; pad != 0 {
+			padded += 4 - pad
+		}
+		if padded > len(body) {
+			break
+		}
+		body = body[padded:]
+	}
+	return m, nil
+}
+
+// readMessage reads a single STUN message. Over UDP each read is one message, over TCP messages are
+// framed by the length in the header.
+func readMessage(conn net.Conn) (*message, error) {
+	if _, ok := conn.(*net.UDPConn); ok {
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return decodeMessage(buf[:n])
+	}
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	return decodeMessage(append(header, body...))
+}
+
+func roundTrip(conn net.Conn, req *message, key []byte) (*message, error) {
+	if _, err := conn.Write(req.encode(key)); err != nil {
+		return nil, err
+	}
+	for {
+		res, err := readMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		// ignore responses to earlier requests
+		if res.txID == req.txID {
+			return res, nil
+		}
+	}
+}
+
+func errorCode(m *message) (int, string) {
+	v := m.get(attrErrorCode)
+	if len(v) < 4 {
+		return 0, ""
+	}
+	return int(v[2]&0x7)*100 + int(v[3]), string(v[4:])
+}
+
+// xorAddress decodes an XOR-MAPPED-ADDRESS or XOR-RELAYED-ADDRESS attribute.
+func xorAddress(v []byte, txID [12]byte) (*net.UDPAddr, error) {
+	if len(v) < 8 {
+		return nil, fmt.Errorf("XOR address too short")
+	}
+	port := binary.BigEndian.Uint16(v[2:]) ^ uint16(magicCookie>>16)
+	var xorKey [16]byte
+	binary.BigEndian.PutUint32(xorKey[0:], magicCookie)
+	copy(xorKey[4:], txID[:])
+	var ip net.IP
+	switch v[1] {
+	case 0x01:
+		ip = make(net.IP, 4)
+	case 0x02:
+		ip = make(net.IP, 16)
+	default:
+		return nil, fmt.Errorf("unknown address family 0x%02x", v[1])
+	}
+	if len(v) < 4+len(ip) {
+		return nil, fmt.Errorf("XOR address truncated")
+	}
+	for i := range ip {
+		ip[i] = v[4+i] ^ xorKey[i]
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// longTermKey returns the key for long-term credentials, per RFC 5389 section 15.4.
+func longTermKey(username, realm, password string) []byte {
+	sum := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return sum[:]
+}
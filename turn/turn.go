@@ -0,0 +1,149 @@
+// package turn contains helpers to fetch TURN credentials from homeservers and check that the
+// TURN server they point to actually works, so VoIP configuration regressions are caught.
+//
+// Complement deploys a coturn container alongside the homeservers if COMPLEMENT_TURN_IMAGE is set.
+// Homeservers are told about it via the environment variables COMPLEMENT_TURN_URIS and
+// COMPLEMENT_TURN_SHARED_SECRET, which images should use to configure their TURN settings.
+package turn
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Credentials are the TURN credentials returned by /voip/turnServer.
+type Credentials struct {
+	Username string
+	Password string
+	URIs     []string
+	// The time in seconds for which the credentials are valid.
+	TTL int64
+}
+
+// MustGetCredentials fetches TURN credentials for the user from /voip/turnServer. Skips the test if the
+// homeserver has no TURN server configured.
+func MustGetCredentials(t ct.TestLike, c *client.CSAPI) Credentials {
+	t.Helper()
+	res := c.MustDo(t, "GET", []string{"_matrix", "client", "v3", "voip", "turnServer"})
+	body := gjson.ParseBytes(client.ParseJSON(t, res))
+	creds := Credentials{
+		Username: body.Get("username").Str,
+		Password: body.Get("password").Str,
+		TTL:      body.Get("ttl").Int(),
+	}
+	for _, uri := range body.Get("uris").Array() {
+		creds.URIs = append(creds.URIs, uri.Str)
+	}
+	if len(creds.URIs) == 0 {
+		t.Skipf("homeserver has no TURN server configured: %s", body.Raw)
+	}
+	return creds
+}
+
+// ParseURI parses a turn: URI into a network ("udp" or "tcp") and host:port address. turns: URIs are
+// not supported.
+func ParseURI(uri string) (network, addr string, err error) {
+	rest, ok := strings.CutPrefix(uri, "turn:")
+	if !ok {
+		return "", "", fmt.Errorf("unsupported TURN URI: %s", uri)
+	}
+	network = "udp"
+	if hostPort, query, hasQuery := strings.Cut(rest, "?"); hasQuery {
+		rest = hostPort
+		for _, param := range strings.Split(query, "&") {
+			if transport, ok := strings.CutPrefix(param, "transport="); ok {
+				network = transport
+			}
+		}
+	}
+	if _, _, err := net.SplitHostPort(rest); err != nil {
+		rest = net.JoinHostPort(rest, "3478")
+	}
+	if network != "udp" && network != "tcp" {
+		return "", "", fmt.Errorf("unsupported TURN transport '%s' in %s", network, uri)
+	}
+	return network, rest, nil
+}
+
+// Ping sends a STUN binding request to the server and returns the server reflexive address of this client.
+func Ping(network, addr string, timeout time.Duration) (*net.UDPAddr, error) {
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	req := newMessage(methodBinding)
+	res, err := roundTrip(conn, req, nil)
+	if err != nil {
+		return nil, fmt.Errorf("binding request failed: %w", err)
+	}
+	if res.typ != methodBinding|classSuccess {
+		code, reason := errorCode(res)
+		return nil, fmt.Errorf("binding request failed: %d %s", code, reason)
+	}
+	return xorAddress(res.get(attrXORMappedAddress), res.txID)
+}
+
+// Allocate requests a UDP relay allocation from the TURN server using long-term credentials, and
+// returns the relayed address. The allocation is left to expire.
+func Allocate(network, addr, username, password string, timeout time.Duration) (*net.UDPAddr, error) {
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// The first request is unauthenticated, and the server responds with the realm and nonce to use.
+	req := newMessage(methodAllocate)
+	req.add(attrRequestedTransport, []byte{protocolUDP, 0, 0, 0})
+	res, err := roundTrip(conn, req, nil)
+	if err != nil {
+		return nil, fmt.Errorf("allocate request failed: %w", err)
+	}
+	if code, reason := errorCode(res); code != 401 {
+		return nil, fmt.Errorf("expected 401 challenge to unauthenticated allocate request, got %d %s", code, reason)
+	}
+	realm, nonce := res.get(attrRealm), res.get(attrNonce)
+
+	req = newMessage(methodAllocate)
+	req.add(attrRequestedTransport, []byte{protocolUDP, 0, 0, 0})
+	req.add(attrUsername, []byte(username))
+	req.add(attrRealm, realm)
+	req.add(attrNonce, nonce)
+	res, err = roundTrip(conn, req, longTermKey(username, string(realm), password))
+	if err != nil {
+		return nil, fmt.Errorf("authenticated allocate request failed: %w", err)
+	}
+	if res.typ != methodAllocate|classSuccess {
+		code, reason := errorCode(res)
+		return nil, fmt.Errorf("authenticated allocate request failed: %d %s", code, reason)
+	}
+	return xorAddress(res.get(attrXORRelayedAddress), res.txID)
+}
+
+// MustAllocate checks that every turn: URI in the credentials can allocate a relayed address using the
+// credentials. Fails the test if any allocation fails.
+func MustAllocate(t ct.TestLike, creds Credentials) {
+	t.Helper()
+	for _, uri := range creds.URIs {
+		network, addr, err := ParseURI(uri)
+		if err != nil {
+			t.Logf("MustAllocate: skipping %s", err)
+			continue
+		}
+		relayed, err := Allocate(network, addr, creds.Username, creds.Password, 5*time.Second)
+		if err != nil {
+			ct.Fatalf(t, "MustAllocate: %s: %s", uri, err)
+		}
+		t.Logf("MustAllocate: %s allocated relayed address %s", uri, relayed)
+	}
+}
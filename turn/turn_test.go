@@ -0,0 +1,109 @@
+package turn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseURI(t *testing.T) {
+	testCases := []struct {
+		uri         string
+		wantNetwork string
+		wantAddr    string
+		wantErr     bool
+	}{
+		{uri: "turn:127.0.0.1:3478?transport=udp", wantNetwork: "udp", wantAddr: "127.0.0.1:3478"},
+		{uri: "turn:turn.example.org?transport=tcp", wantNetwork: "tcp", wantAddr: "turn.example.org:3478"},
+		{uri: "turn:127.0.0.1:5000", wantNetwork: "udp", wantAddr: "127.0.0.1:5000"},
+		{uri: "turns:127.0.0.1:5349", wantErr: true},
+		{uri: "turn:127.0.0.1:3478?transport=sctp", wantErr: true},
+	}
+	for _, tc := range testCases {
+		network, addr, err := ParseURI(tc.uri)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got none", tc.uri)
+			}
+			continue
+		}
+		if err != nil || network != tc.wantNetwork || addr != tc.wantAddr {
+			t.Errorf("%s: got (%s, %s, %v) want (%s, %s)", tc.uri, network, addr, err, tc.wantNetwork, tc.wantAddr)
+		}
+	}
+}
+
+// Check that Allocate performs the long-term credential challenge and produces valid message integrity.
+func TestAllocate(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+	relayed := &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3).To4(), Port: 49160}
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := decodeMessage(buf[:n])
+			if err != nil {
+				return
+			}
+			res := &message{txID: req.txID}
+			if req.get(attrMessageIntegrity) == nil {
+				res.typ = methodAllocate | classError
+				res.add(attrErrorCode, append([]byte{0, 0, 4, 1}, "Unauthorized"...))
+				res.add(attrRealm, []byte("complement"))
+				res.add(attrNonce, []byte("abcdef"))
+			} else if validIntegrity(buf[:n], longTermKey("user", "complement", "pass")) {
+				res.typ = methodAllocate | classSuccess
+				res.add(attrXORRelayedAddress, xorEncode(relayed, req.txID))
+			} else {
+				res.typ = methodAllocate | classError
+				res.add(attrErrorCode, append([]byte{0, 0, 4, 1}, "Bad integrity"...))
+			}
+			conn.WriteTo(res.encode(nil), from)
+		}
+	}()
+
+	got, err := Allocate("udp", conn.LocalAddr().String(), "user", "pass", time.Second)
+	if err != nil {
+		t.Fatalf("Allocate: %s", err)
+	}
+	if got.String() != relayed.String() {
+		t.Errorf("Allocate: got relayed address %s want %s", got, relayed)
+	}
+	if _, err = Allocate("udp", conn.LocalAddr().String(), "user", "wrong", time.Second); err == nil {
+		t.Errorf("Allocate: expected error with wrong password")
+	}
+}
+
+// validIntegrity checks the MESSAGE-INTEGRITY attribute, which is always the last attribute sent by Allocate.
+func validIntegrity(msg []byte, key []byte) bool {
+	miStart := len(msg) - 24
+	header := append([]byte(nil), msg[:20]...)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(msg)-20))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(header)
+	mac.Write(msg[20:miStart])
+	return bytes.Equal(mac.Sum(nil), msg[miStart+4:])
+}
+
+func xorEncode(addr *net.UDPAddr, txID [12]byte) []byte {
+	v := make([]byte, 8)
+	v[1] = 0x01
+	binary.BigEndian.PutUint16(v[2:], uint16(addr.Port)^uint16(magicCookie>>16))
+	var cookie [4]byte
+	binary.BigEndian.PutUint32(cookie[:], magicCookie)
+	for i := 0; i < 4; i++ {
+		v[4+i] = addr.IP.To4()[i] ^ cookie[i]
+	}
+	return v
+}
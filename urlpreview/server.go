@@ -0,0 +1,242 @@
+// package urlpreview is an EXPERIMENTAL web server for homeservers to generate URL previews of, so the
+// correctness and safety of /preview_url can be tested. The pages it serves are controlled by the test,
+// including nasty cases like redirect loops, huge bodies and redirects to private IP addresses.
+// It is marked as EXPERIMENTAL as the API may break without warning.
+package urlpreview
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+)
+
+// PrivateIPURLs are URLs on private, loopback and link-local addresses, including the cloud metadata
+// endpoint. Homeservers should refuse to preview them, including when redirected to them.
+var PrivateIPURLs = []string{
+	"http://127.0.0.1:8008/_matrix/client/versions",
+	"http://10.0.0.1/",
+	"http://192.168.0.1/",
+	"http://169.254.169.254/latest/meta-data/",
+	"http://[::1]:8008/_matrix/client/versions",
+}
+
+// Page is what the server responds with for a path.
+type Page struct {
+	// Defaults to 200, or 302 if Location is set.
+	StatusCode int
+	// Defaults to "text/html; charset=utf-8".
+	ContentType string
+	// If set, the page redirects here.
+	Location string
+	// The <title> of the generated HTML.
+	Title string
+	// OpenGraph properties of the generated HTML, keyed on property e.g "og:title".
+	OpenGraph map[string]string
+	// If set, this is the response body instead of the generated HTML.
+	Body []byte
+	// If greater than the length of the body, the body is padded with whitespace to this many bytes. The
+	// padding is streamed, so huge pages do not need to fit in memory.
+	Size int64
+	// How long to wait before responding.
+	Delay time.Duration
+}
+
+// OpenGraph returns an HTML page with the given title and OpenGraph properties e.g
+//
+//	urlpreview.OpenGraph("The Rock", map[string]string{"og:title": "The Rock", "og:type": "video.movie"})
+func OpenGraph(title string, properties map[string]string) Page {
+	return Page{Title: title, OpenGraph: properties}
+}
+
+// Redirect returns a page which redirects to `location` with a 302.
+func Redirect(location string) Page {
+	return Page{Location: location}
+}
+
+// File returns a page whose body is `data`, e.g an image for og:image.
+func File(contentType string, data []byte) Page {
+	return Page{ContentType: contentType, Body: data}
+}
+
+// Huge returns the page padded to `size` bytes, to test that homeservers limit how much they download.
+func Huge(page Page, size int64) Page {
+	page.Size = size
+	return page
+}
+
+// Slow returns the page after waiting for the delay.
+func Slow(page Page, delay time.Duration) Page {
+	page.Delay = delay
+	return page
+}
+
+// HTML returns the body of the page, generating HTML from the title and OpenGraph properties if the page
+// has no Body. It is not padded.
+func (p Page) HTML() []byte {
+	if p.Body != nil {
+		return p.Body
+	}
+	var sb strings.Builder
+	sb.WriteString("<html prefix=\"og: http://ogp.me/ns#\">\n<head>\n")
+	if p.Title != "" {
+		fmt.Fprintf(&sb, "<title>%s</title>\n", html.EscapeString(p.Title))
+	}
+	properties := make([]string, 0, len(p.OpenGraph))
+	for property := range p.OpenGraph {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+	for _, property := range properties {
+		fmt.Fprintf(&sb, "<meta property=\"%s\" content=\"%s\" />\n", html.EscapeString(property), html.EscapeString(p.OpenGraph[property]))
+	}
+	sb.WriteString("</head>\n<body></body>\n</html>\n")
+	return []byte(sb.String())
+}
+
+// EXPERIMENTAL
+// Server serves pages controlled by the test. Paths without a page 404.
+type Server struct {
+	t         ct.TestLike
+	hostname  string
+	port      int
+	listening bool
+	srv       *http.Server
+
+	mu       sync.Mutex
+	pages    map[string]Page
+	requests map[string]int
+}
+
+// EXPERIMENTAL
+// NewServer creates a new server without any pages. Add pages with SetPage.
+func NewServer(t ct.TestLike, cfg *config.Complement) *Server {
+	s := &Server{
+		t:        t,
+		hostname: cfg.HostnameRunningComplement,
+		pages:    make(map[string]Page),
+		requests: make(map[string]int),
+	}
+	s.srv = &http.Server{Handler: http.HandlerFunc(s.handle)}
+	return s
+}
+
+// SetPage sets the page served at `path` e.g "/page.html". It takes effect for the next request.
+func (s *Server) SetPage(path string, page Page) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pages[path] = page
+}
+
+// Requests returns the number of requests the server has received for `path`, so tests can check
+// whether a homeserver fetched a page, e.g that previews are cached or that blocked URLs are not fetched.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// URL returns the URL of `path` as reachable from containers on the complement network, e.g homeservers,
+// so is the URL to preview. Only valid AFTER calling Listen().
+func (s *Server) URL(path string) string {
+	if !s.listening {
+		ct.Fatalf(s.t, "URL() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the URL. Ensure you Listen() first!")
+	}
+	return fmt.Sprintf("http://%s:%d%s", s.hostname, s.port, path)
+}
+
+// Listen for requests on a random high-numbered port. Returns a function which stops the server.
+func (s *Server) Listen() (cancel func()) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		ct.Fatalf(s.t, "urlpreview.Server.Listen: net.Listen failed: %s", err)
+	}
+	s.port = ln.Addr().(*net.TCPAddr).Port
+	s.listening = true
+
+	go func() {
+		defer ln.Close()
+		defer wg.Done()
+		err := s.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			s.t.Logf("urlpreview.Server.Listen: Serve failed: %s", err)
+		}
+	}()
+
+	return func() {
+		err := s.srv.Close()
+		if err != nil {
+			ct.Fatalf(s.t, "urlpreview.Server.Listen: failed to shutdown server: %s", err)
+		}
+		wg.Wait()
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.requests[req.URL.Path]++
+	page, ok := s.pages[req.URL.Path]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if page.Delay > 0 {
+		select {
+		case <-time.After(page.Delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	statusCode := page.StatusCode
+	if page.Location != "" {
+		w.Header().Set("Location", page.Location)
+		if statusCode == 0 {
+			statusCode = http.StatusFound
+		}
+	}
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	contentType := page.ContentType
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	body := page.HTML()
+	size := int64(len(body))
+	if page.Size > size {
+		size = page.Size
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+	w.WriteHeader(statusCode)
+	if req.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(body); err != nil {
+		return
+	}
+	// the homeserver is expected to hang up on huge pages, so errors are ignored
+	io.CopyN(w, padding{}, size-int64(len(body))) // nolint:errcheck
+}
+
+// padding is an endless stream of spaces.
+type padding struct{}
+
+func (padding) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	return len(p), nil
+}
@@ -0,0 +1,60 @@
+package urlpreview
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/complement/config"
+)
+
+func TestServer(t *testing.T) {
+	srv := NewServer(t, &config.Complement{HostnameRunningComplement: "127.0.0.1"})
+	cancel := srv.Listen()
+	defer cancel()
+	srv.SetPage("/page.html", Huge(OpenGraph("A <title>", map[string]string{"og:title": `"quoted"`}), 4096))
+	srv.SetPage("/redirect", Redirect(srv.URL("/page.html")))
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := noRedirects.Get(srv.URL("/redirect"))
+	if err != nil {
+		t.Fatalf("GET /redirect: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 302 || res.Header.Get("Location") != srv.URL("/page.html") {
+		t.Errorf("GET /redirect: got HTTP %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	res, err = http.Get(srv.URL("/page.html"))
+	if err != nil {
+		t.Fatalf("GET /page.html: %s", err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("GET /page.html: failed to read body: %s", err)
+	}
+	if len(body) != 4096 {
+		t.Errorf("GET /page.html: got %d bytes, want 4096", len(body))
+	}
+	for _, want := range []string{"<title>A &lt;title&gt;</title>", `<meta property="og:title" content="&#34;quoted&#34;" />`} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("GET /page.html: body does not contain %s", want)
+		}
+	}
+
+	res, err = http.Get(srv.URL("/missing"))
+	if err != nil {
+		t.Fatalf("GET /missing: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Errorf("GET /missing: got HTTP %d, want 404", res.StatusCode)
+	}
+	if got := srv.Requests("/page.html"); got != 1 {
+		t.Errorf("Requests(/page.html): got %d, want 1", got)
+	}
+}
@@ -0,0 +1,213 @@
+package complement
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/internal/docker"
+)
+
+// WarmPoolResetFunc wipes the state of a deployment from the warm pool, so it can be leased by another
+// test. Deployments are only returned to the pool if this returns nil.
+type WarmPoolResetFunc func(ctx context.Context, deployment Deployment) error
+
+// warmPool keeps single homeserver deployments running in the background, so Deploy(t, 1) can lease one
+// rather than waiting for a homeserver to start. See COMPLEMENT_WARM_POOL_SIZE.
+type warmPool struct {
+	tp    *TestPackage
+	size  int
+	reset WarmPoolResetFunc
+
+	mu   sync.Mutex
+	idle []Deployment
+	// the number of deployments being deployed or reset, which will become idle
+	pending int
+	// the number of deployments leased by tests
+	leased int
+	closed bool
+	// tracks deployments being deployed or reset in the background
+	wg sync.WaitGroup
+}
+
+func newWarmPool(tp *TestPackage, size int, reset WarmPoolResetFunc) *warmPool {
+	p := &warmPool{
+		tp:    tp,
+		size:  size,
+		reset: reset,
+	}
+	p.fill()
+	return p
+}
+
+// fill deploys homeservers in the background until there are `size` idle in the pool, including those
+// which will become idle. Leased deployments do not count towards the size, so the pool is refilled as
+// tests lease deployments.
+func (p *warmPool) fill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for ; !p.closed && len(p.idle)+p.pending < p.size; p.pending++ {
+		p.wg.Add(1)
+		go p.deploy()
+	}
+}
+
+func (p *warmPool) deploy() {
+	defer p.wg.Done()
+	ctx := context.Background()
+	blueprint := NumServersBlueprint(1)
+	err := p.tp.deployer.Construct(ctx, blueprint)
+	var dep Deployment
+	if err == nil {
+		dep, err = p.tp.deployer.Deploy(ctx, blueprint)
+	}
+	if err != nil {
+		// this is not retried until the pool is next refilled, so a broken deployer does not repeatedly
+		// fail in the background. Tests deploy their own homeserver when the pool is empty, which will
+		// report the error.
+		log.Printf("warm pool: failed to deploy homeserver: %s", err)
+		p.mu.Lock()
+		p.pending--
+		p.mu.Unlock()
+		return
+	}
+	p.put(dep)
+}
+
+// put adds a deployed or reset deployment to the pool, or destroys it if the pool has been closed or
+// already has `size` idle deployments.
+func (p *warmPool) put(dep Deployment) {
+	p.mu.Lock()
+	p.pending--
+	if !p.closed && len(p.idle) < p.size {
+		p.idle = append(p.idle, dep)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	p.tp.deployer.Destroy(dep, p.tp.Config.AlwaysPrintServerLogs, "COMPLEMENT_WARM_POOL_SIZE", false)
+}
+
+// lease returns an idle deployment from the pool and deploys a replacement, or returns nil if there are
+// no idle deployments.
+func (p *warmPool) lease(t ct.TestLike) Deployment {
+	t.Helper()
+	p.mu.Lock()
+	if len(p.idle) == 0 {
+		p.mu.Unlock()
+		t.Logf("Deploy: warm pool is empty, deploying a new homeserver")
+		return nil
+	}
+	dep := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	p.leased++
+	idle := len(p.idle)
+	p.mu.Unlock()
+	t.Logf("Deploy: leased homeserver from warm pool (%d idle)", idle)
+	p.fill()
+	return &pooledDeployment{
+		Deployment: dep,
+		pool:       p,
+	}
+}
+
+// release returns a leased deployment to the pool once it has been reset in the background. Deployments
+// used by failed tests are destroyed so their logs are printed, and replaced.
+func (p *warmPool) release(t ct.TestLike, dep Deployment) {
+	t.Helper()
+	testName := t.Name()
+	p.mu.Lock()
+	p.leased--
+	if t.Failed() || p.closed {
+		p.mu.Unlock()
+		p.discard(dep, p.tp.Config.AlwaysPrintServerLogs || t.Failed(), testName, t.Failed())
+		return
+	}
+	p.pending++
+	p.wg.Add(1)
+	p.mu.Unlock()
+	go func() {
+		defer p.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute+p.tp.Config.SpawnHSTimeout)
+		defer cancel()
+		if err := p.reset(ctx, dep); err != nil {
+			log.Printf("warm pool: failed to reset homeserver used by %s, destroying it: %s", testName, err)
+			p.mu.Lock()
+			p.pending--
+			p.mu.Unlock()
+			p.discard(dep, p.tp.Config.AlwaysPrintServerLogs, testName, false)
+			return
+		}
+		p.put(dep)
+	}()
+}
+
+// discard destroys a deployment which is no longer in the pool and deploys a replacement.
+func (p *warmPool) discard(dep Deployment, printServerLogs bool, testName string, failed bool) {
+	p.tp.deployer.Destroy(dep, printServerLogs, testName, failed)
+	p.fill()
+}
+
+// close destroys all idle deployments, once those being deployed or reset have finished. Leased
+// deployments which were never released are not destroyed.
+func (p *warmPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.wg.Wait()
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, dep := range idle {
+		p.tp.deployer.Destroy(dep, p.tp.Config.AlwaysPrintServerLogs, "COMPLEMENT_WARM_POOL_SIZE", false)
+	}
+}
+
+// pooledDeployment is a Deployment leased from the warm pool. Calling Destroy returns it to the pool
+// rather than destroying it.
+type pooledDeployment struct {
+	Deployment
+	pool     *warmPool
+	released bool
+}
+
+func (pd *pooledDeployment) Destroy(t ct.TestLike) {
+	t.Helper()
+	if pd.released {
+		ct.Fatalf(t, "Deploy: Destroy called more than once on a warm pool deployment")
+		return
+	}
+	pd.released = true
+	if dockerDep, ok := pd.Deployment.(*docker.Deployment); ok {
+		dockerDep.StopTestHooks()
+	}
+	pd.pool.release(t, pd.Deployment)
+}
+
+// commandReset returns a WarmPoolResetFunc which runs `command` in each homeserver container of a
+// Docker deployment then restarts the homeserver. See COMPLEMENT_WARM_POOL_RESET_COMMAND.
+func commandReset(command string) WarmPoolResetFunc {
+	return func(ctx context.Context, deployment Deployment) error {
+		dockerDep, ok := unwrapDeployment(deployment).(*docker.Deployment)
+		if !ok {
+			return fmt.Errorf("COMPLEMENT_WARM_POOL_RESET_COMMAND is only supported by Docker deployments, got %T", deployment)
+		}
+		for hsName, hsDep := range dockerDep.HS {
+			res, err := dockerDep.Deployer.Exec(ctx, hsDep, []string{"sh", "-c", command})
+			if err != nil {
+				return fmt.Errorf("%s: failed to run reset command: %w", hsName, err)
+			}
+			if res.ExitCode != 0 {
+				return fmt.Errorf("%s: reset command exited with code %d: %s", hsName, res.ExitCode, res.Stderr)
+			}
+			if err = dockerDep.Deployer.Restart(hsDep); err != nil {
+				return fmt.Errorf("%s: %w", hsName, err)
+			}
+		}
+		return nil
+	}
+}
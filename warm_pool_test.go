@@ -0,0 +1,206 @@
+package complement
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/complement/b"
+	"github.com/matrix-org/complement/config"
+)
+
+// fakeDeployment is a Deployment which only has an identity. Calling any Deployment method panics.
+type fakeDeployment struct {
+	Deployment
+	id int
+}
+
+// fakeDeployer creates fakeDeployments, recording which have been destroyed.
+type fakeDeployer struct {
+	mu        sync.Mutex
+	deployed  int
+	destroyed map[int]bool
+	failed    map[int]bool
+	deployErr error
+}
+
+func (d *fakeDeployer) Construct(ctx context.Context, blueprint b.Blueprint) error { return nil }
+func (d *fakeDeployer) Deploy(ctx context.Context, blueprint b.Blueprint) (Deployment, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.deployErr != nil {
+		return nil, d.deployErr
+	}
+	d.deployed++
+	return &fakeDeployment{id: d.deployed}, nil
+}
+func (d *fakeDeployer) Destroy(dep Deployment, printServerLogs bool, testName string, failed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := dep.(*fakeDeployment).id
+	if d.destroyed[id] {
+		panic(fmt.Sprintf("deployment %d destroyed twice", id))
+	}
+	d.destroyed[id] = true
+	d.failed[id] = failed
+}
+func (d *fakeDeployer) Restart(dep Deployment, hsName string) error   { return nil }
+func (d *fakeDeployer) PauseHS(dep Deployment, hsName string) error   { return nil }
+func (d *fakeDeployer) UnpauseHS(dep Deployment, hsName string) error { return nil }
+func (d *fakeDeployer) NetworkOps() NetworkOps                        { return nil }
+func (d *fakeDeployer) Cleanup()                                      {}
+
+func (d *fakeDeployer) counts() (deployed, destroyed int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deployed, len(d.destroyed)
+}
+
+// newTestWarmPool returns a warm pool of `size` fake deployments, once they have all been deployed.
+func newTestWarmPool(size int, reset WarmPoolResetFunc) (*warmPool, *fakeDeployer) {
+	deployer := &fakeDeployer{
+		destroyed: make(map[int]bool),
+		failed:    make(map[int]bool),
+	}
+	tp := &TestPackage{
+		Config:   &config.Complement{},
+		deployer: deployer,
+	}
+	if reset == nil {
+		reset = func(ctx context.Context, deployment Deployment) error { return nil }
+	}
+	p := newWarmPool(tp, size, reset)
+	p.wg.Wait()
+	return p, deployer
+}
+
+// assertPool checks the accounting of the pool once all background work has finished.
+func assertPool(t *testing.T, p *warmPool, wantIdle, wantLeased int) {
+	t.Helper()
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) != wantIdle || p.leased != wantLeased || p.pending != 0 {
+		t.Errorf("got %d idle, %d leased, %d pending, want %d idle, %d leased, 0 pending", len(p.idle), p.leased, p.pending, wantIdle, wantLeased)
+	}
+}
+
+func assertDeployer(t *testing.T, d *fakeDeployer, wantDeployed, wantDestroyed int) {
+	t.Helper()
+	deployed, destroyed := d.counts()
+	if deployed != wantDeployed || destroyed != wantDestroyed {
+		t.Errorf("got %d deployed, %d destroyed, want %d deployed, %d destroyed", deployed, destroyed, wantDeployed, wantDestroyed)
+	}
+}
+
+func TestWarmPoolRefillsLeasedDeployments(t *testing.T) {
+	p, deployer := newTestWarmPool(2, nil)
+	assertPool(t, p, 2, 0)
+	rt := &recordingT{name: "TestFoo"}
+	dep1 := p.lease(rt)
+	dep2 := p.lease(rt)
+	if dep1 == nil || dep2 == nil {
+		t.Fatalf("lease returned nil with idle deployments")
+	}
+	// the pool keeps 2 idle deployments while 2 are leased
+	assertPool(t, p, 2, 2)
+	assertDeployer(t, deployer, 4, 0)
+}
+
+func TestWarmPoolLeaseWhenEmpty(t *testing.T) {
+	p, deployer := newTestWarmPool(1, nil)
+	deployer.deployErr = fmt.Errorf("no docker")
+	rt := &recordingT{name: "TestFoo"}
+	if dep := p.lease(rt); dep == nil {
+		t.Fatalf("lease returned nil with an idle deployment")
+	}
+	// the replacement failed to deploy
+	assertPool(t, p, 0, 1)
+	if dep := p.lease(rt); dep != nil {
+		t.Fatalf("lease returned %v from an empty pool", dep)
+	}
+	assertPool(t, p, 0, 1)
+}
+
+func TestWarmPoolRelease(t *testing.T) {
+	var resets int
+	p, deployer := newTestWarmPool(1, func(ctx context.Context, deployment Deployment) error {
+		resets++
+		return nil
+	})
+	rt := &recordingT{name: "TestFoo"}
+	dep := p.lease(rt)
+	assertPool(t, p, 1, 1)
+	dep.Destroy(rt)
+	// the reset deployment is surplus to the replacement, so is destroyed
+	assertPool(t, p, 1, 0)
+	assertDeployer(t, deployer, 2, 1)
+	if resets != 1 {
+		t.Errorf("got %d resets, want 1", resets)
+	}
+	dep.Destroy(rt)
+	if !rt.Failed() {
+		t.Errorf("Destroy called twice did not fail the test")
+	}
+	assertPool(t, p, 1, 0)
+}
+
+func TestWarmPoolReleaseReturnsToPool(t *testing.T) {
+	p, deployer := newTestWarmPool(1, nil)
+	// the replacement fails to deploy, so there is room in the pool for the released deployment
+	deployer.deployErr = fmt.Errorf("no docker")
+	rt := &recordingT{name: "TestFoo"}
+	dep := p.lease(rt)
+	assertPool(t, p, 0, 1)
+	dep.Destroy(rt)
+	assertPool(t, p, 1, 0)
+	assertDeployer(t, deployer, 1, 0)
+	if again := p.lease(rt); again.(*pooledDeployment).Deployment != dep.(*pooledDeployment).Deployment {
+		t.Errorf("lease did not return the released deployment")
+	}
+}
+
+func TestWarmPoolDiscardsFailedDeployments(t *testing.T) {
+	p, deployer := newTestWarmPool(1, nil)
+	rt := &recordingT{name: "TestFoo"}
+	dep := p.lease(rt)
+	rt.errs = append(rt.errs, "test failed")
+	dep.Destroy(rt)
+	assertPool(t, p, 1, 0)
+	assertDeployer(t, deployer, 2, 1)
+	if !deployer.failed[1] {
+		t.Errorf("deployment of failed test was not destroyed as failed")
+	}
+}
+
+func TestWarmPoolDiscardsDeploymentsWhichFailToReset(t *testing.T) {
+	p, deployer := newTestWarmPool(1, func(ctx context.Context, deployment Deployment) error {
+		return fmt.Errorf("reset failed")
+	})
+	rt := &recordingT{name: "TestFoo"}
+	dep := p.lease(rt)
+	dep.Destroy(rt)
+	assertPool(t, p, 1, 0)
+	assertDeployer(t, deployer, 2, 1)
+	if deployer.failed[1] {
+		t.Errorf("deployment which failed to reset was destroyed as failed")
+	}
+}
+
+func TestWarmPoolClose(t *testing.T) {
+	p, deployer := newTestWarmPool(2, nil)
+	rt := &recordingT{name: "TestFoo"}
+	dep := p.lease(rt)
+	p.close()
+	// leased deployments are not destroyed
+	assertPool(t, p, 0, 1)
+	assertDeployer(t, deployer, 3, 2)
+	// deployments released after the pool is closed are destroyed rather than reset
+	dep.Destroy(rt)
+	assertPool(t, p, 0, 0)
+	assertDeployer(t, deployer, 3, 3)
+	if dep := p.lease(rt); dep != nil {
+		t.Errorf("lease returned %v from a closed pool", dep)
+	}
+}
@@ -0,0 +1,28 @@
+package wellknown
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+)
+
+// MustDiscoverClient creates a client whose base URL is found by performing client discovery against
+// `serverURL`, rather than being given directly, so the whole discovery chain is exercised: the
+// well-known document must be served, must point at a homeserver, and that homeserver must respond to
+// /versions. Fails the test unless discovery results in ActionPrompt. The BaseURL in `opts` is ignored.
+// If opts.Client is nil, a client with a 10s timeout is used for both discovery and the returned client.
+func MustDiscoverClient(t ct.TestLike, serverURL string, opts client.CSAPIOpts) (*client.CSAPI, Discovery) {
+	t.Helper()
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	d := Discover(opts.Client, serverURL)
+	if d.Action != ActionPrompt {
+		ct.Fatalf(t, "MustDiscoverClient: discovery against %s resulted in %s, want %s: %v", serverURL, d.Action, ActionPrompt, d.Err)
+	}
+	t.Logf("MustDiscoverClient: %s/.well-known/matrix/client -> %s", serverURL, d.HomeserverURL)
+	opts.BaseURL = d.HomeserverURL
+	return client.NewCSAPI(opts), d
+}
@@ -0,0 +1,105 @@
+package wellknown
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Action is the outcome of client discovery, as defined by the spec.
+type Action string
+
+const (
+	// Use the discovered URLs.
+	ActionPrompt Action = "PROMPT"
+	// There is no well-known information, so continue as if discovery was not attempted.
+	ActionIgnore Action = "IGNORE"
+	// The well-known information could not be used, so ask the user for the URLs.
+	ActionFailPrompt Action = "FAIL_PROMPT"
+	// The well-known information is invalid, so stop.
+	ActionFailError Action = "FAIL_ERROR"
+)
+
+// Discovery is the result of client discovery.
+type Discovery struct {
+	Action            Action
+	HomeserverURL     string
+	IdentityServerURL string
+	// Why discovery did not result in ActionPrompt.
+	Err error
+}
+
+// Discover performs client auto-discovery against the server at `serverURL` by following the
+// algorithm in https://spec.matrix.org/v1.10/client-server-api/#well-known-uri including
+// validation of the homeserver and identity server URLs. Set a timeout on the HTTP client to
+// test slow responses.
+func Discover(httpClient *http.Client, serverURL string) Discovery {
+	res, err := httpClient.Get(strings.TrimSuffix(serverURL, "/") + "/.well-known/matrix/client")
+	if err != nil {
+		return Discovery{Action: ActionFailPrompt, Err: fmt.Errorf("failed to fetch well-known: %w", err)}
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return Discovery{Action: ActionIgnore, Err: fmt.Errorf("well-known returned 404")}
+	}
+	if res.StatusCode != 200 {
+		return Discovery{Action: ActionFailPrompt, Err: fmt.Errorf("well-known returned HTTP %d", res.StatusCode)}
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return Discovery{Action: ActionFailPrompt, Err: fmt.Errorf("failed to read well-known: %w", err)}
+	}
+	var wk struct {
+		Homeserver *struct {
+			BaseURL string `json:"base_url"`
+		} `json:"m.homeserver"`
+		IdentityServer *struct {
+			BaseURL string `json:"base_url"`
+		} `json:"m.identity_server"`
+	}
+	if err = json.Unmarshal(body, &wk); err != nil {
+		return Discovery{Action: ActionFailPrompt, Err: fmt.Errorf("well-known is not valid JSON: %w", err)}
+	}
+	if wk.Homeserver == nil || wk.Homeserver.BaseURL == "" {
+		return Discovery{Action: ActionFailPrompt, Err: fmt.Errorf("well-known is missing m.homeserver.base_url")}
+	}
+
+	d := Discovery{Action: ActionPrompt, HomeserverURL: strings.TrimSuffix(wk.Homeserver.BaseURL, "/")}
+	if err = validate(httpClient, d.HomeserverURL, "/_matrix/client/versions"); err != nil {
+		return Discovery{Action: ActionFailError, Err: fmt.Errorf("invalid m.homeserver: %w", err)}
+	}
+	if wk.IdentityServer != nil {
+		d.IdentityServerURL = strings.TrimSuffix(wk.IdentityServer.BaseURL, "/")
+		if err = validate(httpClient, d.IdentityServerURL, "/_matrix/identity/v2"); err != nil {
+			return Discovery{Action: ActionFailError, Err: fmt.Errorf("invalid m.identity_server: %w", err)}
+		}
+	}
+	return d
+}
+
+// validate checks that the base URL is a valid URL and that the server responds successfully to `path`.
+func validate(httpClient *http.Client, baseURL, path string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("base_url '%s' is not a http(s) URL", baseURL)
+	}
+	res, err := httpClient.Get(baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GET %s returned HTTP %d", path, res.StatusCode)
+	}
+	var body map[string]interface{}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return fmt.Errorf("GET %s did not return a JSON object: %w", path, err)
+	}
+	return nil
+}
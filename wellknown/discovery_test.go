@@ -0,0 +1,49 @@
+package wellknown
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/complement/config"
+)
+
+func TestDiscover(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/_matrix/client/versions" {
+			w.Write([]byte(`{"versions":["v1.1"]}`))
+			return
+		}
+		w.WriteHeader(404)
+	}))
+	defer hs.Close()
+
+	srv := NewServer(t, &config.Complement{HostnameRunningComplement: "localhost"})
+	cancel := srv.Listen()
+	defer cancel()
+
+	testCases := []struct {
+		name       string
+		res        Response
+		wantAction Action
+	}{
+		{name: "valid", res: Valid(hs.URL, ""), wantAction: ActionPrompt},
+		{name: "not found", res: NotFound(), wantAction: ActionIgnore},
+		{name: "server error", res: Response{StatusCode: 500}, wantAction: ActionFailPrompt},
+		{name: "malformed", res: Malformed(), wantAction: ActionFailPrompt},
+		{name: "missing homeserver", res: JSON(map[string]interface{}{}), wantAction: ActionFailPrompt},
+		{name: "slow", res: Slow(Valid(hs.URL, ""), time.Second), wantAction: ActionFailPrompt},
+		{name: "invalid homeserver URL", res: Valid("ftp://example.org", ""), wantAction: ActionFailError},
+		{name: "homeserver not a homeserver", res: Valid(srv.LocalURL(), ""), wantAction: ActionFailError},
+		{name: "identity server not an identity server", res: Valid(hs.URL, hs.URL), wantAction: ActionFailError},
+	}
+	httpClient := &http.Client{Timeout: 200 * time.Millisecond}
+	for _, tc := range testCases {
+		srv.SetResponse(tc.res)
+		got := Discover(httpClient, srv.LocalURL())
+		if got.Action != tc.wantAction {
+			t.Errorf("%s: got action %s want %s (err=%v)", tc.name, got.Action, tc.wantAction, got.Err)
+		}
+	}
+}
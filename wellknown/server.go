@@ -0,0 +1,180 @@
+// package wellknown is an EXPERIMENTAL server for /.well-known/matrix/client, along with an
+// implementation of client auto-discovery, so discovery handling and the validation of homeserver
+// and identity server URLs can be tested with valid and broken well-known responses.
+// It is marked as EXPERIMENTAL as the API may break without warning.
+package wellknown
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/complement/config"
+	"github.com/matrix-org/complement/ct"
+)
+
+// Response is the response the server gives to /.well-known/matrix/client.
+type Response struct {
+	StatusCode int
+	Body       []byte
+	// How long to wait before responding.
+	Delay time.Duration
+}
+
+// Valid returns a well-known response pointing at the given homeserver and (optional) identity server.
+func Valid(homeserverURL, identityServerURL string) Response {
+	body := map[string]interface{}{
+		"m.homeserver": map[string]string{"base_url": homeserverURL},
+	}
+	if identityServerURL != "" {
+		body["m.identity_server"] = map[string]string{"base_url": identityServerURL}
+	}
+	return JSON(body)
+}
+
+// JSON returns a 200 well-known response with the given body, which can contain anything.
+func JSON(body interface{}) Response {
+	b, err := json.Marshal(body)
+	if err != nil {
+		panic(fmt.Sprintf("wellknown.JSON: failed to marshal body: %s", err))
+	}
+	return Response{StatusCode: 200, Body: b}
+}
+
+// Malformed returns a 200 well-known response whose body is not valid JSON.
+func Malformed() Response {
+	return Response{StatusCode: 200, Body: []byte(`{"m.homeserver": {"base_url": `)}
+}
+
+// NotFound returns a 404 well-known response.
+func NotFound() Response {
+	return Response{StatusCode: 404, Body: []byte(`{"errcode":"M_NOT_FOUND","error":"Not found"}`)}
+}
+
+// Slow returns the response after waiting for the delay.
+func Slow(res Response, delay time.Duration) Response {
+	res.Delay = delay
+	return res
+}
+
+// EXPERIMENTAL
+// Server serves /.well-known/matrix/client with a response controlled by the test.
+type Server struct {
+	t         ct.TestLike
+	hostname  string
+	port      int
+	listening bool
+	srv       *http.Server
+
+	mu       sync.Mutex
+	response Response
+	requests int
+}
+
+// EXPERIMENTAL
+// NewServer creates a new well-known server, which responds with NotFound() until SetResponse is called.
+func NewServer(t ct.TestLike, cfg *config.Complement, opts ...func(*Server)) *Server {
+	s := &Server{
+		t:        t,
+		hostname: cfg.HostnameRunningComplement,
+		response: NotFound(),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/matrix/client", s.handleWellKnown)
+	s.srv = &http.Server{Handler: mux}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithResponse sets the initial response of the server.
+func WithResponse(res Response) func(*Server) {
+	return func(s *Server) {
+		s.response = res
+	}
+}
+
+// SetResponse changes the response of the server. It takes effect for the next request.
+func (s *Server) SetResponse(res Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.response = res
+}
+
+// Requests returns the number of requests the server has received.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// URL returns the base URL of the server as reachable from containers on the complement network,
+// e.g homeservers. Only valid AFTER calling Listen().
+func (s *Server) URL() string {
+	if !s.listening {
+		ct.Fatalf(s.t, "URL() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the URL. Ensure you Listen() first!")
+	}
+	return fmt.Sprintf("http://%s:%d", s.hostname, s.port)
+}
+
+// LocalURL returns the base URL of the server as reachable from the machine running Complement,
+// e.g clients in tests. Only valid AFTER calling Listen().
+func (s *Server) LocalURL() string {
+	if !s.listening {
+		ct.Fatalf(s.t, "LocalURL() called before Listen() - this is not supported because Listen() chooses a high-numbered port and thus changes the URL. Ensure you Listen() first!")
+	}
+	return fmt.Sprintf("http://127.0.0.1:%d", s.port)
+}
+
+// Listen for requests on a random high-numbered port. Returns a function which stops the server.
+func (s *Server) Listen() (cancel func()) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	ln, err := net.Listen("tcp", ":0") //nolint
+	if err != nil {
+		ct.Fatalf(s.t, "wellknown.Server.Listen: net.Listen failed: %s", err)
+	}
+	s.port = ln.Addr().(*net.TCPAddr).Port
+	s.listening = true
+
+	go func() {
+		defer ln.Close()
+		defer wg.Done()
+		err := s.srv.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			s.t.Logf("wellknown.Server.Listen: Serve failed: %s", err)
+		}
+	}()
+
+	return func() {
+		err := s.srv.Close()
+		if err != nil {
+			ct.Fatalf(s.t, "wellknown.Server.Listen: failed to shutdown server: %s", err)
+		}
+		wg.Wait()
+	}
+}
+
+func (s *Server) handleWellKnown(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	res := s.response
+	s.mu.Unlock()
+	if res.Delay > 0 {
+		select {
+		case <-time.After(res.Delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	// clients on the web need CORS headers to read the response
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Body)
+}
@@ -0,0 +1,188 @@
+// Package workers contains helpers for homeservers which run in workers mode, where client-server API
+// requests are split between several processes, e.g Synapse's synchrotrons and event persisters. Requests
+// can be sent directly to a particular worker, bypassing the usual routing, to assert that data written via
+// one worker is replicated to the others within a bound.
+package workers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/complement"
+	"github.com/matrix-org/complement/client"
+	"github.com/matrix-org/complement/ct"
+	"github.com/matrix-org/complement/match"
+	"github.com/matrix-org/complement/should"
+)
+
+// How long to wait between attempts when no worker has caught up.
+const pollInterval = 50 * time.Millisecond
+
+// Worker is a worker process which serves the client-server API on its own port in the homeserver
+// container. The port must be exposed by the homeserver image.
+type Worker struct {
+	// The name to refer to the worker by e.g "synchrotron1".
+	Name string
+	Port int
+}
+
+// Clients are clients for the same user and device which each send requests directly to a different
+// worker of a homeserver.
+type Clients struct {
+	names   []string
+	clients map[string]*client.CSAPI
+}
+
+// NewClients returns clients for the user and device of `c` which send requests directly to each of the
+// workers of the homeserver `hsName`. Skips the test if the deployment is not a Docker deployment.
+func NewClients(t ct.TestLike, deployment complement.Deployment, hsName string, c *client.CSAPI, workers ...Worker) *Clients {
+	t.Helper()
+	if len(workers) == 0 {
+		ct.Fatalf(t, "workers.NewClients: no workers given")
+	}
+	cs := &Clients{
+		clients: make(map[string]*client.CSAPI, len(workers)),
+	}
+	for _, w := range workers {
+		if _, exists := cs.clients[w.Name]; exists {
+			ct.Fatalf(t, "workers.NewClients: worker '%s' given more than once", w.Name)
+		}
+		cs.names = append(cs.names, w.Name)
+		cs.clients[w.Name] = client.NewCSAPI(client.CSAPIOpts{
+			UserID:           c.UserID,
+			AccessToken:      c.AccessToken,
+			DeviceID:         c.DeviceID,
+			Password:         c.Password,
+			BaseURL:          "http://" + complement.ServerAddress(t, deployment, hsName, w.Port),
+			Client:           client.NewLoggedClient(t, hsName+"/"+w.Name, nil),
+			SyncUntilTimeout: c.SyncUntilTimeout,
+			Debug:            c.Debug,
+		})
+	}
+	return cs
+}
+
+// Client returns the client which sends requests to the worker `name`. Fails the test if there is no
+// such worker.
+func (cs *Clients) Client(t ct.TestLike, name string) *client.CSAPI {
+	t.Helper()
+	c, ok := cs.clients[name]
+	if !ok {
+		ct.Fatalf(t, "workers.Client: unknown worker '%s', have %v", name, cs.names)
+	}
+	return c
+}
+
+// DoAll sends the same request to every worker, returning the responses keyed on worker name. Request
+// bodies must be set via options which can be applied more than once, e.g client.WithJSONBody.
+func (cs *Clients) DoAll(t ct.TestLike, method string, paths []string, opts ...client.RequestOpt) map[string]*http.Response {
+	t.Helper()
+	responses := make(map[string]*http.Response, len(cs.names))
+	for _, name := range cs.names {
+		responses[name] = cs.clients[name].Do(t, method, paths, opts...)
+	}
+	return responses
+}
+
+// MustMatchAllWithin repeatedly sends the request to every worker until its response matches `m`, failing
+// the test if any worker has not matched within `within` e.g to assert that a profile change made via one
+// worker is visible via every worker which serves profiles. Returns how long each worker took to match.
+func (cs *Clients) MustMatchAllWithin(t ct.TestLike, within time.Duration, m match.HTTPResponse, method string, paths []string, opts ...client.RequestOpt) map[string]time.Duration {
+	t.Helper()
+	return cs.untilAll(t, "MustMatchAllWithin", within, func(name string) error {
+		_, err := should.MatchResponse(cs.clients[name].Do(t, method, paths, opts...), m)
+		return err
+	})
+}
+
+// MustSyncUntilAll syncs on every worker until all of the checks have passed on each of them, failing the
+// test if any worker has not passed them within `within` e.g to assert that an event sent via one worker
+// is visible via every sync worker. Each worker is synced from `syncReq.Since`, and syncs do not wait for
+// new data, so workers are polled in turn. Returns how long each worker took to pass the checks.
+func (cs *Clients) MustSyncUntilAll(t ct.TestLike, within time.Duration, syncReq client.SyncReq, checks ...client.SyncCheckOpt) map[string]time.Duration {
+	t.Helper()
+	syncReq.TimeoutMillis = "0"
+	since := make(map[string]string, len(cs.names))
+	remaining := make(map[string][]client.SyncCheckOpt, len(cs.names))
+	for _, name := range cs.names {
+		since[name] = syncReq.Since
+		remaining[name] = checks
+	}
+	return cs.untilAll(t, "MustSyncUntilAll", within, func(name string) error {
+		c := cs.clients[name]
+		req := syncReq
+		req.Since = since[name]
+		var response gjson.Result
+		response, since[name] = c.MustSync(t, req)
+		var failing []client.SyncCheckOpt
+		var errs []string
+		for _, check := range remaining[name] {
+			if err := check(c.UserID, response); err != nil {
+				failing = append(failing, check)
+				errs = append(errs, err.Error())
+			}
+		}
+		remaining[name] = failing
+		if len(errs) > 0 {
+			return fmt.Errorf("%s", strings.Join(errs, ", "))
+		}
+		return nil
+	})
+}
+
+// untilAll calls `attempt` for each worker in turn until it has returned nil for every worker, failing the
+// test with the last error of each worker which has not succeeded within `within`. Returns how long each
+// worker took to succeed.
+func (cs *Clients) untilAll(t ct.TestLike, caller string, within time.Duration, attempt func(name string) error) map[string]time.Duration {
+	t.Helper()
+	start := time.Now()
+	took := make(map[string]time.Duration, len(cs.names))
+	lastErrs := make(map[string]error, len(cs.names))
+	for {
+		for _, name := range cs.names {
+			if _, done := took[name]; done {
+				continue
+			}
+			if err := attempt(name); err != nil {
+				lastErrs[name] = err
+				continue
+			}
+			took[name] = time.Since(start)
+			delete(lastErrs, name)
+		}
+		if len(took) == len(cs.names) {
+			t.Logf("workers.%s: all workers caught up %s", caller, formatDurations(took))
+			return took
+		}
+		if time.Since(start) > within {
+			pending := make([]string, 0, len(lastErrs))
+			for name, err := range lastErrs {
+				pending = append(pending, fmt.Sprintf("%s: %s", name, err))
+			}
+			sort.Strings(pending)
+			ct.Fatalf(
+				t, "workers.%s: %d/%d workers had not caught up after %v (caught up: %s):\n%s",
+				caller, len(pending), len(cs.names), within, formatDurations(took), strings.Join(pending, "\n"),
+			)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func formatDurations(took map[string]time.Duration) string {
+	names := make([]string, 0, len(took))
+	for name := range took {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%v", name, took[name])
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
@@ -0,0 +1,29 @@
+package workers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUntilAll(t *testing.T) {
+	cs := &Clients{names: []string{"synchrotron1", "synchrotron2"}}
+	attempts := map[string]int{}
+	took := cs.untilAll(t, "TestUntilAll", time.Second, func(name string) error {
+		attempts[name]++
+		// synchrotron2 lags behind by 2 attempts
+		if name == "synchrotron2" && attempts[name] < 3 {
+			return fmt.Errorf("not yet")
+		}
+		return nil
+	})
+	if attempts["synchrotron1"] != 1 || attempts["synchrotron2"] != 3 {
+		t.Errorf("got attempts %v, want synchrotron1=1 synchrotron2=3", attempts)
+	}
+	if len(took) != 2 {
+		t.Fatalf("got durations for %v, want both workers", took)
+	}
+	if took["synchrotron2"] < 2*pollInterval || took["synchrotron2"] < took["synchrotron1"] {
+		t.Errorf("got durations %v, want synchrotron2 to take at least %v", took, 2*pollInterval)
+	}
+}